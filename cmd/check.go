@@ -0,0 +1,76 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/spf13/cobra"
+)
+
+// CheckCmd represents the check command
+func CheckCmd(identityProvider *idp.IDP) *cobra.Command {
+	var cluster bool
+	cmd := &cobra.Command{
+		Use:   "check",
+		Short: "validates the configuration without serving requests",
+		Long: `Builds the IdP from the configuration file, loads the service providers,
+and checks that the certificates are valid, the signing key matches its
+certificate, and the session store, LDAP directory, and SQL database can be
+reached. A line is printed for each check, and the command fails if any do.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if cluster {
+				var err error
+				if identityProvider, err = clusterIDP(); err != nil {
+					return err
+				}
+			}
+			return check(cmd.OutOrStdout(), identityProvider)
+		},
+		Args: cobra.NoArgs,
+	}
+	cmd.Flags().BoolVar(&cluster, "cluster", false, "check the Redis session store used by the cluster command")
+	return cmd
+}
+
+// check writes a report of the IDP's checks to out and returns an error if any failed
+func check(out io.Writer, identityProvider *idp.IDP) error {
+	if err := checkDevMode(); err != nil {
+		fmt.Fprintf(out, "FAIL configuration: %v\n", err)
+		return fmt.Errorf("configuration is invalid: %v", err)
+	}
+	if _, err := identityProvider.Handler(); err != nil {
+		fmt.Fprintf(out, "FAIL configuration: %v\n", err)
+		return fmt.Errorf("configuration is invalid: %v", err)
+	}
+	defer identityProvider.Close()
+	fmt.Fprintln(out, "PASS configuration")
+	failed := 0
+	for _, result := range identityProvider.Check(context.Background()) {
+		if result.Err != nil {
+			failed++
+			fmt.Fprintf(out, "FAIL %s: %v\n", result.Name, result.Err)
+			continue
+		}
+		fmt.Fprintf(out, "PASS %s\n", result.Name)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
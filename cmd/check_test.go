@@ -0,0 +1,78 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+type unavailableCache struct {
+	store.Cache
+}
+
+func (unavailableCache) Set(key string, entry []byte) error {
+	return errors.New("store is down")
+}
+
+func Test_check(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certificate, key, err := generateCertificate(certificateOptions{keyType: "rsa", commonName: "idp.example.com", validity: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificatePath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err = writePEM(certificatePath, "CERTIFICATE", certificate, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = writePEM(keyPath, "PRIVATE KEY", key, 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("tls-certificate", certificatePath)
+	viper.Set("tls-private-key", keyPath)
+	defer func() {
+		viper.Set("tls-certificate", "/etc/lite-idp/cert.pem")
+		viper.Set("tls-private-key", "/etc/lite-idp/key.pem")
+	}()
+
+	var out bytes.Buffer
+	assert.NoError(t, check(&out, &idp.IDP{}))
+	assert.Contains(t, out.String(), "PASS configuration\n")
+	assert.Contains(t, out.String(), "PASS signing key\n")
+	assert.NotContains(t, out.String(), "FAIL")
+
+	out.Reset()
+	assert.Error(t, check(&out, &idp.IDP{UserCache: unavailableCache{}}))
+	assert.Contains(t, out.String(), "FAIL session store: store is down\n")
+
+	out.Reset()
+	viper.Set("tls-certificate", filepath.Join(dir, "missing.pem"))
+	assert.Error(t, check(&out, &idp.IDP{}))
+	assert.Contains(t, out.String(), "FAIL configuration: ")
+}
@@ -16,7 +16,6 @@ package cmd
 
 import (
 	"github.com/amdonov/lite-idp/idp"
-	"github.com/amdonov/lite-idp/store/redis"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -29,19 +28,18 @@ func ClusterCmd() *cobra.Command {
 		Long: `Support running multiple instances of idp. 
 Cache data is stored in Redis.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			tempCache, err := redis.New(viper.GetDuration("temp-cache-duration"))
+			identityProvider, err := clusterIDP()
 			if err != nil {
 				return err
 			}
-			userCache, err := redis.New(viper.GetDuration("user-cache-duration"))
-			if err != nil {
-				return err
-			}
-			return ServeCmd(&idp.IDP{
-				TempCache: tempCache,
-				UserCache: userCache,
-			}).RunE(cmd, args)
+			return ServeCmd(identityProvider).RunE(cmd, args)
 		},
 		Args: cobra.NoArgs,
 	}
 }
+
+// clusterIDP returns an IDP that keeps its state in Redis. It's the same as serving with store set to redis.
+func clusterIDP() (*idp.IDP, error) {
+	viper.Set("store", "redis")
+	return &idp.IDP{}, nil
+}
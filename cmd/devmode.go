@@ -0,0 +1,51 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// checkDevMode refuses dev-mode when the server listens on an address other machines can reach, unless
+// dev-mode-allow-remote is also set, so a production configuration can't turn it on by accident
+func checkDevMode() error {
+	address := viper.GetString("listen-address")
+	if !viper.GetBool("dev-mode") || loopbackAddress(address) {
+		return nil
+	}
+	if viper.GetBool("dev-mode-allow-remote") {
+		log.Warnf("dev-mode is reachable from other machines on %s because dev-mode-allow-remote is set", address)
+		return nil
+	}
+	return fmt.Errorf("dev-mode accepts logins without a real password check and can only be used with a "+
+		"loopback listen-address, not %s, unless dev-mode-allow-remote is set", address)
+}
+
+// loopbackAddress reports whether a listen address only accepts connections from the local machine
+func loopbackAddress(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,62 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_loopbackAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"127.0.0.1:9443", true},
+		{"127.0.0.2:9443", true},
+		{"[::1]:9443", true},
+		{"localhost:9443", true},
+		{":9443", false},
+		{"0.0.0.0:9443", false},
+		{"192.0.2.1:9443", false},
+		{"idp.example.com:9443", false},
+		{"127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, loopbackAddress(tt.address), tt.address)
+	}
+}
+
+func Test_checkDevMode(t *testing.T) {
+	defer viper.Set("listen-address", "127.0.0.1:9443")
+	defer viper.Set("dev-mode", false)
+	defer viper.Set("dev-mode-allow-remote", false)
+	viper.Set("listen-address", ":9443")
+	assert.NoError(t, checkDevMode(), "production configurations don't set dev-mode")
+
+	viper.Set("dev-mode", true)
+	assert.Error(t, checkDevMode(), "dev-mode shouldn't be reachable from other machines")
+	_, err := loadConfig()
+	assert.Error(t, err, "the configuration shouldn't load")
+
+	viper.Set("listen-address", "127.0.0.1:9443")
+	assert.NoError(t, checkDevMode())
+
+	viper.Set("listen-address", ":9443")
+	viper.Set("dev-mode-allow-remote", true)
+	assert.NoError(t, checkDevMode(), "remote access can be allowed explicitly")
+}
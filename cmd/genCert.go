@@ -0,0 +1,210 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// certificateOptions describe a self-signed certificate
+type certificateOptions struct {
+	keyType    string
+	keySize    int
+	commonName string
+	hosts      []string
+	validity   time.Duration
+	// signing certificates can only be used to sign messages, not for TLS
+	signing bool
+}
+
+// GenCertCmd represents the gen-cert command
+func GenCertCmd() *cobra.Command {
+	options := certificateOptions{}
+	var certificatePath, keyPath string
+	var force bool
+	cmd := &cobra.Command{
+		Use:   "gen-cert",
+		Short: "generates a self-signed certificate for development and testing",
+		Long: `Generates a key pair and a self-signed certificate. They're written to the
+tls-certificate and tls-private-key files from the configuration, or the
+signing-certificate and signing-private-key files with --signing, unless other
+paths are given.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			// Signing certificates default to the signing-certificate and signing-private-key settings
+			prefix := "tls"
+			if options.signing {
+				prefix = "signing"
+			}
+			if certificatePath == "" {
+				certificatePath = viper.GetString(prefix + "-certificate")
+			}
+			if keyPath == "" {
+				keyPath = viper.GetString(prefix + "-private-key")
+			}
+			if certificatePath == "" || keyPath == "" {
+				return fmt.Errorf("set %s-certificate and %s-private-key or use --tls-certificate and --tls-private-key", prefix, prefix)
+			}
+			if options.commonName == "" {
+				options.commonName = hostname(viper.GetString("server-name"))
+			}
+			if !force {
+				for _, path := range []string{certificatePath, keyPath} {
+					if _, err := os.Stat(path); err == nil {
+						return fmt.Errorf("%s already exists, use --force to replace it", path)
+					}
+				}
+			}
+			certificate, key, err := generateCertificate(options)
+			if err != nil {
+				return err
+			}
+			if err = writePEM(keyPath, "PRIVATE KEY", key, 0600); err != nil {
+				return err
+			}
+			if err = writePEM(certificatePath, "CERTIFICATE", certificate, 0644); err != nil {
+				return err
+			}
+			log.Infof("wrote certificate for %s to %s and private key to %s", options.commonName, certificatePath, keyPath)
+			return nil
+		},
+		Args: cobra.NoArgs,
+	}
+	flags := cmd.Flags()
+	flags.StringVar(&certificatePath, "tls-certificate", "", "certificate file, defaults to the tls-certificate or signing-certificate setting")
+	flags.StringVar(&keyPath, "tls-private-key", "", "private key file, defaults to the tls-private-key or signing-private-key setting")
+	flags.StringVar(&options.keyType, "key-type", "rsa", "type of key to generate, rsa or ec")
+	flags.IntVar(&options.keySize, "key-size", 0, "RSA modulus size or EC curve size in bits, defaults to 2048 for RSA and 256 for EC")
+	flags.StringVar(&options.commonName, "common-name", "", "subject common name, defaults to the host in server-name")
+	flags.StringSliceVar(&options.hosts, "san", nil, "DNS names and IP addresses for the subject alternative name, defaults to the common name")
+	flags.DurationVar(&options.validity, "validity", 365*24*time.Hour, "how long the certificate is valid")
+	flags.BoolVar(&options.signing, "signing", false, "generate a certificate for signing SAML messages instead of TLS")
+	flags.BoolVar(&force, "force", false, "replace existing files")
+	return cmd
+}
+
+// generateCertificate returns a DER encoded self-signed certificate and its PKCS #8 encoded private key
+func generateCertificate(options certificateOptions) ([]byte, []byte, error) {
+	if options.validity <= 0 {
+		return nil, nil, errors.New("validity must be positive")
+	}
+	key, err := generateKey(options.keyType, options.keySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: options.commonName},
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(options.validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	if !options.signing {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+		if _, ok := key.(*rsa.PrivateKey); ok {
+			template.KeyUsage |= x509.KeyUsageKeyEncipherment
+		}
+		hosts := options.hosts
+		if len(hosts) == 0 && options.commonName != "" {
+			hosts = []string{options.commonName}
+		}
+		for _, host := range hosts {
+			if ip := net.ParseIP(host); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, host)
+			}
+		}
+	}
+	certificate, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, nil, err
+	}
+	encodedKey, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certificate, encodedKey, nil
+}
+
+func generateKey(keyType string, size int) (crypto.Signer, error) {
+	switch strings.ToLower(keyType) {
+	case "rsa":
+		if size == 0 {
+			size = 2048
+		}
+		if size < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		return rsa.GenerateKey(rand.Reader, size)
+	case "ec", "ecdsa":
+		var curve elliptic.Curve
+		switch size {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported EC key size %d, use 256, 384, or 521", size)
+		}
+		return ecdsa.GenerateKey(curve, rand.Reader)
+	}
+	return nil, fmt.Errorf("unsupported key type %s, use rsa or ec", keyType)
+}
+
+func writePEM(path, blockType string, data []byte, mode os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if err = pem.Encode(f, &pem.Block{Type: blockType, Bytes: data}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// hostname removes the port from a server name
+func hostname(serverName string) string {
+	if host, _, err := net.SplitHostPort(serverName); err == nil {
+		return host
+	}
+	return serverName
+}
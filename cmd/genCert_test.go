@@ -0,0 +1,91 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_generateCertificate(t *testing.T) {
+	der, _, err := generateCertificate(certificateOptions{
+		keyType:    "rsa",
+		commonName: "idp.example.com",
+		hosts:      []string{"idp.example.com", "127.0.0.1"},
+		validity:   time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "idp.example.com", cert.Subject.CommonName)
+	assert.Equal(t, []string{"idp.example.com"}, cert.DNSNames)
+	assert.Len(t, cert.IPAddresses, 1)
+	assert.Contains(t, cert.ExtKeyUsage, x509.ExtKeyUsageServerAuth)
+	assert.NoError(t, cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature),
+		"certificate should be self-signed")
+
+	der, _, err = generateCertificate(certificateOptions{keyType: "ec", commonName: "signer", validity: time.Hour, signing: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	assert.IsType(t, &ecdsa.PublicKey{}, cert.PublicKey)
+	assert.Empty(t, cert.ExtKeyUsage, "signing certificates should not be usable for TLS")
+	assert.Equal(t, x509.KeyUsageDigitalSignature, cert.KeyUsage)
+
+	_, _, err = generateCertificate(certificateOptions{keyType: "dsa", validity: time.Hour})
+	assert.Error(t, err, "unsupported key types should be rejected")
+}
+
+func TestGenCertCmd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gen-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certificate := filepath.Join(dir, "cert.pem")
+	key := filepath.Join(dir, "key.pem")
+	cmd := GenCertCmd()
+	cmd.SetArgs([]string{"--tls-certificate", certificate, "--tls-private-key", key, "--key-type", "ec"})
+	if err = cmd.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = tls.LoadX509KeyPair(certificate, key)
+	assert.NoError(t, err, "files should be usable by the IdP")
+	info, err := os.Stat(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "private key should only be readable by the owner")
+
+	cmd = GenCertCmd()
+	cmd.SilenceUsage, cmd.SilenceErrors = true, true
+	cmd.SetArgs([]string{"--tls-certificate", certificate, "--tls-private-key", key})
+	assert.Error(t, cmd.Execute(), "existing files should not be replaced without --force")
+}
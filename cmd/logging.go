@@ -0,0 +1,135 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/gorilla/handlers"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// configureLogging applies the log-format and log-level settings
+func configureLogging() error {
+	level, err := log.ParseLevel(viper.GetString("log-level"))
+	if err != nil {
+		return err
+	}
+	formatter, err := logFormatter()
+	if err != nil {
+		return err
+	}
+	log.SetLevel(level)
+	log.SetFormatter(formatter)
+	return nil
+}
+
+func logFormatter() (log.Formatter, error) {
+	switch format := viper.GetString("log-format"); format {
+	case "text":
+		return &log.TextFormatter{}, nil
+	case "json":
+		return &log.JSONFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported log-format %s, use text or json", format)
+	}
+}
+
+// accessLog writes a line for each request to out. JSON logs have a field for each detail of the request.
+// Otherwise the Apache combined format is used. Requests relayed by trusted proxies are logged with the
+// client's address.
+func accessLog(out io.Writer, h http.Handler) http.Handler {
+	if viper.GetString("log-format") != "json" {
+		combined := handlers.CombinedLoggingHandler(out, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h.ServeHTTP(w, r)
+			// The combined log is written from the request once it's handled
+			if ip := idp.ClientIPFor(r); ip != nil {
+				r.RemoteAddr = ip.String()
+			}
+		}))
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			combined.ServeHTTP(w, idp.WithRequestInfo(r))
+		})
+	}
+	logger := log.New()
+	logger.Out = out
+	logger.Formatter = &log.JSONFormatter{}
+	return &jsonAccessLog{logger, h}
+}
+
+type jsonAccessLog struct {
+	logger  *log.Logger
+	handler http.Handler
+}
+
+func (l *jsonAccessLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	r = idp.WithRequestInfo(r)
+	recorder := &statusRecorder{ResponseWriter: w}
+	l.handler.ServeHTTP(recorder, r)
+	if recorder.status == 0 {
+		recorder.status = http.StatusOK
+	}
+	remote := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+	if ip := idp.ClientIPFor(r); ip != nil {
+		remote = ip.String()
+	}
+	entry := l.logger.WithFields(log.Fields{
+		"method":      r.Method,
+		"path":        r.URL.Path,
+		"status":      recorder.status,
+		"size":        recorder.size,
+		"duration":    time.Since(start).Seconds(),
+		"remote_addr": remote,
+		"sp":          idp.ServiceProviderFor(r),
+	})
+	// Failed requests can be matched to the reference on the error page
+	if id := idp.CorrelationIDFor(r); id != "" {
+		entry = entry.WithField("correlation_id", id)
+	}
+	entry.Info("request")
+}
+
+// statusRecorder captures the status and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.size += n
+	return n, err
+}
@@ -0,0 +1,74 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_accessLog_json(t *testing.T) {
+	viper.Set("log-format", "json")
+	defer viper.Set("log-format", "text")
+	var out bytes.Buffer
+	h := accessLog(&out, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "missing", http.StatusNotFound)
+	}))
+	r := httptest.NewRequest("GET", "/SAML2/Redirect/SSO?SAMLRequest=abc", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	entry := map[string]interface{}{}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "GET", entry["method"])
+	assert.Equal(t, "/SAML2/Redirect/SSO", entry["path"], "query strings can hold SAML messages and shouldn't be logged")
+	assert.Equal(t, float64(http.StatusNotFound), entry["status"])
+	assert.Equal(t, "192.0.2.1", entry["remote_addr"])
+	assert.Contains(t, entry, "duration")
+	assert.Contains(t, entry, "sp")
+}
+
+func Test_accessLog_text(t *testing.T) {
+	var out bytes.Buffer
+	h := accessLog(&out, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/metadata", nil))
+	assert.True(t, strings.Contains(out.String(), `"GET /metadata HTTP/1.1" 200`), "text logs should use the combined format")
+}
+
+func Test_configureLogging(t *testing.T) {
+	defer func() {
+		viper.Set("log-level", "info")
+		viper.Set("log-format", "text")
+		configureLogging()
+	}()
+	viper.Set("log-level", "debug")
+	viper.Set("log-format", "json")
+	assert.NoError(t, configureLogging())
+	assert.Equal(t, log.DebugLevel, log.GetLevel())
+	viper.Set("log-format", "xml")
+	assert.Error(t, configureLogging(), "unknown formats should be rejected")
+	viper.Set("log-format", "text")
+	viper.Set("log-level", "loud")
+	assert.Error(t, configureLogging(), "unknown levels should be rejected")
+}
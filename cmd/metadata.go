@@ -0,0 +1,59 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/spf13/cobra"
+)
+
+// MetadataCmd represents the metadata command
+func MetadataCmd(identityProvider *idp.IDP) *cobra.Command {
+	var output string
+	var pretty bool
+	cmd := &cobra.Command{
+		Use:   "metadata",
+		Short: "writes the IdP's signed metadata",
+		Long: `Builds the IdP from the configuration file and writes the same metadata
+that the server publishes to stdout or a file. It's signed unless sign-metadata
+is false.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if _, err := identityProvider.Handler(); err != nil {
+				return err
+			}
+			defer identityProvider.Close()
+			indent := ""
+			if pretty {
+				indent = "  "
+			}
+			metadata, err := identityProvider.Metadata(indent)
+			if err != nil {
+				return err
+			}
+			if output != "" {
+				return ioutil.WriteFile(output, metadata, 0644)
+			}
+			_, err = os.Stdout.Write(metadata)
+			return err
+		},
+		Args: cobra.NoArgs,
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "file to write the metadata to instead of stdout")
+	cmd.Flags().BoolVar(&pretty, "pretty", false, "indent the metadata")
+	return cmd
+}
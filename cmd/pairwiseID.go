@@ -0,0 +1,83 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/store/redis"
+	"github.com/spf13/cobra"
+)
+
+// PairwiseIDCmd represents the pairwise-id command
+func PairwiseIDCmd() *cobra.Command {
+	return pairwiseIDCmd(func() (store.Cache, error) {
+		return redis.New(0)
+	})
+}
+
+func pairwiseIDCmd(newCache func() (store.Cache, error)) *cobra.Command {
+	// run calls f with the store and closes it afterwards
+	run := func(f func(ids *idp.PairwiseIDStore) error) error {
+		cache, err := newCache()
+		if err != nil {
+			return err
+		}
+		if closer, ok := cache.(io.Closer); ok {
+			defer closer.Close()
+		}
+		return f(idp.NewPairwiseIDStore(cache))
+	}
+	cmd := &cobra.Command{
+		Use:   "pairwise-id",
+		Short: "looks up or revokes persistent NameIDs",
+		Long: `Manages the persistent NameIDs issued to service providers. The identifiers
+are read from the Redis server used by the cluster command.`,
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "lookup <user> <entity-id>",
+		Short: "prints the user's persistent NameID for the service provider",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(func(ids *idp.PairwiseIDStore) error {
+				id, err := ids.Lookup(args[1], args[0])
+				if err == store.ErrNotFound {
+					return fmt.Errorf("%s has no persistent NameID for %s", args[0], args[1])
+				}
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(cmd.OutOrStdout(), id)
+				return nil
+			})
+		},
+		Args: cobra.ExactArgs(2),
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "revoke <user> <entity-id>",
+		Short: "removes the user's persistent NameID for the service provider",
+		Long: `Removes the user's persistent NameID for the service provider. A new
+identifier is issued the next time the user logs in to the service provider.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(func(ids *idp.PairwiseIDStore) error {
+				return ids.Revoke(args[1], args[0])
+			})
+		},
+		Args: cobra.ExactArgs(2),
+	})
+	return cmd
+}
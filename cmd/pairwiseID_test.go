@@ -0,0 +1,54 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_pairwiseIDCmd(t *testing.T) {
+	cache, err := store.New(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := idp.NewPairwiseIDStore(cache).Get("https://sp.example.com/", "joe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	execute := func(args ...string) (string, error) {
+		cmd := pairwiseIDCmd(func() (store.Cache, error) { return cache, nil })
+		var out bytes.Buffer
+		cmd.SetOutput(&out)
+		cmd.SetArgs(args)
+		err := cmd.Execute()
+		return strings.TrimSpace(out.String()), err
+	}
+
+	out, err := execute("lookup", "joe", "https://sp.example.com/")
+	assert.NoError(t, err)
+	assert.Equal(t, id, out)
+
+	_, err = execute("revoke", "joe", "https://sp.example.com/")
+	assert.NoError(t, err)
+	_, err = execute("lookup", "joe", "https://sp.example.com/")
+	assert.EqualError(t, err, "joe has no persistent NameID for https://sp.example.com/")
+}
@@ -0,0 +1,125 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/amdonov/lite-idp/idp"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// reloader serves requests with the most recently loaded IDP. Requests that are already
+// being handled finish with the IDP that received them.
+type reloader struct {
+	current atomic.Value
+}
+
+type loadedIDP struct {
+	idp     *idp.IDP
+	handler http.Handler
+	admin   http.Handler
+}
+
+func newReloader(identityProvider *idp.IDP) (*reloader, error) {
+	config, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	identityProvider.Config = &config
+	handler, err := identityProvider.Handler()
+	if err != nil {
+		return nil, err
+	}
+	r := &reloader{}
+	r.current.Store(&loadedIDP{identityProvider, handler, identityProvider.AdminHandler()})
+	return r, nil
+}
+
+func (r *reloader) load() *loadedIDP {
+	return r.current.Load().(*loadedIDP)
+}
+
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.load().handler.ServeHTTP(w, req)
+}
+
+// adminHandler serves the admin endpoints of the current IDP
+func (r *reloader) adminHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if admin := r.load().admin; admin != nil {
+			admin.ServeHTTP(w, req)
+			return
+		}
+		http.NotFound(w, req)
+	})
+}
+
+// tlsConfig returns a configuration that switches to the current IDP's certificates for each new connection
+func (r *reloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return r.load().idp.TLSConfig, nil
+		},
+	}
+}
+
+// reload rereads the configuration file and rebuilds the IDP. The current IDP is kept if anything fails.
+func (r *reloader) reload() error {
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			return err
+		}
+	}
+	if err := configureLogging(); err != nil {
+		return err
+	}
+	config, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	next, err := r.load().idp.ReloadConfig(config)
+	if err != nil {
+		return err
+	}
+	handler, err := next.Handler()
+	if err != nil {
+		return err
+	}
+	previous := r.load()
+	r.current.Store(&loadedIDP{next, handler, next.AdminHandler()})
+	if err = previous.idp.Close(); err != nil {
+		log.Warnf("failed to close the previous configuration: %v", err)
+	}
+	return nil
+}
+
+// loadConfig translates the configuration files, environment, and flags into the IDP's Config
+func loadConfig() (idp.Config, error) {
+	config := idp.Config{}
+	if err := checkDevMode(); err != nil {
+		return config, err
+	}
+	if err := viper.Unmarshal(&config); err != nil {
+		return config, err
+	}
+	if viper.IsSet("user-cache-duration") {
+		log.Warn("user-cache-duration is no longer used, set session-lifetime instead")
+	}
+	return config, nil
+}
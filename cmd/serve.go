@@ -16,12 +16,18 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync/atomic"
+	"syscall"
 
 	"github.com/amdonov/lite-idp/idp"
-	"github.com/gorilla/handlers"
+	"github.com/amdonov/lite-idp/version"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -29,48 +35,200 @@ import (
 
 // ServeCmd represents the serve command
 func ServeCmd(indentityProvider *idp.IDP) *cobra.Command {
-	return &cobra.Command{
+	cmd := &cobra.Command{
 		Use:   "serve",
 		Short: "runs idp server",
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := configureLogging(); err != nil {
+				return err
+			}
+			log.Infof("starting %s", version.Get())
 			// Listen for shutdown signal
 			stop := make(chan os.Signal, 1)
-			signal.Notify(stop, os.Interrupt)
-			handler, err := indentityProvider.Handler()
+			signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+			current, err := newReloader(indentityProvider)
 			if err != nil {
 				return err
 			}
-			server := &http.Server{
-				TLSConfig: indentityProvider.TLSConfig,
-				Handler:   handlers.CombinedLoggingHandler(os.Stdout, hsts(handler)),
-				Addr:      viper.GetString("listen-address"),
+			handler := accessLog(os.Stdout, current)
+			// Probes are served by the admin listener when there is one
+			adminAddress := viper.GetString("admin-listen-address")
+			if adminAddress == "" {
+				handler = probes(current, handler)
 			}
+			requests := &inFlightHandler{handler: handler}
+			server := newServer(viper.GetString("listen-address"), requests)
+			server.TLSConfig = current.tlsConfig()
+			// Reload configuration and certificates on SIGHUP
+			hup := make(chan os.Signal, 1)
+			signal.Notify(hup, syscall.SIGHUP)
+			go func() {
+				for range hup {
+					log.Info("reloading configuration")
+					if err := current.reload(); err != nil {
+						log.Errorf("failed to reload configuration, continuing with the previous configuration: %v", err)
+						continue
+					}
+					log.Info("configuration reloaded")
+				}
+			}()
+			// Optionally keep metrics off the public port
+			var metricsServer *http.Server
+			if address := viper.GetString("metrics-address"); address != "" {
+				mux := http.NewServeMux()
+				mux.Handle(viper.GetString("metrics-path"), indentityProvider.MetricsHandler)
+				metricsServer = newServer(address, mux)
+				go func() {
+					log.Infof("serving metrics on %s", address)
+					if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+						log.Errorf("metrics listener failed: %v", err)
+					}
+				}()
+			}
+			// Optionally serve metrics, probes, and metadata on a private interface
+			var adminServer *http.Server
+			if adminAddress != "" {
+				adminServer = newServer(adminAddress, current.adminHandler())
+				if adminServer.TLSConfig, err = adminTLSConfig(); err != nil {
+					return err
+				}
+				go func() {
+					cert, key := viper.GetString("admin-tls-certificate"), viper.GetString("admin-tls-private-key")
+					var err error
+					if cert != "" {
+						log.Infof("serving admin endpoints with TLS on %s", adminAddress)
+						err = adminServer.ListenAndServeTLS(cert, key)
+					} else {
+						log.Infof("serving admin endpoints on %s", adminAddress)
+						err = adminServer.ListenAndServe()
+					}
+					if err != http.ErrServerClosed {
+						log.Errorf("admin listener failed: %v", err)
+					}
+				}()
+			}
+			drained := make(chan error, 1)
 			go func() {
 				// Handle shutdown signal
 				<-stop
-				server.Shutdown(context.Background())
+				ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("shutdown-timeout"))
+				defer cancel()
+				inFlight := requests.count()
+				log.Infof("shutting down, draining %d in-flight requests", inFlight)
+				if metricsServer != nil {
+					metricsServer.Shutdown(ctx)
+				}
+				if adminServer != nil {
+					adminServer.Shutdown(ctx)
+				}
+				err := server.Shutdown(ctx)
+				log.Infof("drained %d in-flight requests", inFlight-requests.count())
+				drained <- err
 			}()
 
 			log.Infof("listening for connections on %s", server.Addr)
 			if err = server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
 				return err
 			}
+			// ListenAndServeTLS returns as soon as shutdown starts
+			err = <-drained
+			if closeErr := current.load().idp.Close(); closeErr != nil {
+				log.Errorf("failed to close the identity provider: %v", closeErr)
+			}
+			if err != nil {
+				return fmt.Errorf("requests were still in flight after shutdown-timeout: %v", err)
+			}
 			log.Info("server shutdown cleanly")
 			return nil
 		},
 		Args: cobra.NoArgs,
 	}
+	// The flags override the settings of the same name
+	flags := cmd.Flags()
+	flags.Duration("read-header-timeout", viper.GetDuration("read-header-timeout"), "time allowed to read a request's headers")
+	flags.Duration("read-timeout", viper.GetDuration("read-timeout"), "time allowed to read an entire request")
+	flags.Duration("write-timeout", viper.GetDuration("write-timeout"), "time allowed to write a response")
+	flags.Duration("idle-timeout", viper.GetDuration("idle-timeout"), "time to keep idle connections open")
+	for _, name := range []string{"read-header-timeout", "read-timeout", "write-timeout", "idle-timeout"} {
+		viper.BindPFlag(name, flags.Lookup(name))
+	}
+	return cmd
+}
+
+// newServer returns a server with timeouts so slow clients can't hold connections open indefinitely
+func newServer(address string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		Addr:              address,
+		ReadHeaderTimeout: viper.GetDuration("read-header-timeout"),
+		ReadTimeout:       viper.GetDuration("read-timeout"),
+		WriteTimeout:      viper.GetDuration("write-timeout"),
+		IdleTimeout:       viper.GetDuration("idle-timeout"),
+	}
+}
+
+// inFlightHandler counts the requests being handled so shutdown can report how many it drained
+type inFlightHandler struct {
+	// accessed atomically and kept first for alignment on 32-bit platforms
+	inFlight int64
+	handler  http.Handler
+}
+
+func (h *inFlightHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt64(&h.inFlight, 1)
+	defer atomic.AddInt64(&h.inFlight, -1)
+	h.handler.ServeHTTP(w, r)
 }
 
-type hstsHandler struct {
+func (h *inFlightHandler) count() int64 {
+	return atomic.LoadInt64(&h.inFlight)
+}
+
+// probeHandler serves liveness and readiness probes without the logging and HSTS middleware
+// so frequent checks from orchestrators don't fill the access log
+type probeHandler struct {
+	paths   map[string]bool
+	probe   http.Handler
 	handler http.Handler
 }
 
-func (h *hstsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+func (h *probeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.paths[r.URL.Path] {
+		h.probe.ServeHTTP(w, r)
+		return
+	}
 	h.handler.ServeHTTP(w, r)
 }
 
-func hsts(h http.Handler) http.Handler {
-	return &hstsHandler{h}
+func probes(probe, h http.Handler) http.Handler {
+	paths := map[string]bool{
+		viper.GetString("health-path"):    true,
+		viper.GetString("readiness-path"): true,
+	}
+	return &probeHandler{paths, probe, h}
+}
+
+// adminTLSConfig uses the tls-min-version and tls-cipher-suites of the public listener, and asks admin clients for
+// certificates issued by admin-client-ca, which the session API accepts instead of admin-api-token
+func adminTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if err := idp.ConfigureTLSVersions(config); err != nil {
+		return nil, err
+	}
+	ca := viper.GetString("admin-client-ca")
+	if ca == "" {
+		return config, nil
+	}
+	data, err := ioutil.ReadFile(ca)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", ca)
+	}
+	config.ClientCAs = pool
+	// Probes and metrics don't need a certificate
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	return config, nil
 }
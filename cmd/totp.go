@@ -0,0 +1,83 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/store/redis"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// TOTPCmd represents the totp command
+func TOTPCmd() *cobra.Command {
+	return totpCmd(func() (store.Cache, error) {
+		return redis.New(0)
+	})
+}
+
+func totpCmd(newCache func() (store.Cache, error)) *cobra.Command {
+	// run calls f with the store and closes it afterwards
+	run := func(f func(secrets *idp.TOTPSecretStore) error) error {
+		cache, err := newCache()
+		if err != nil {
+			return err
+		}
+		if closer, ok := cache.(io.Closer); ok {
+			defer closer.Close()
+		}
+		return f(idp.NewTOTPSecretStore(cache))
+	}
+	cmd := &cobra.Command{
+		Use:   "totp",
+		Short: "enrolls users for one-time code logins",
+		Long: `Manages the TOTP secrets users enter one-time codes with. The secrets are
+kept in the Redis server used by the cluster command.`,
+	}
+	cmd.AddCommand(&cobra.Command{
+		Use:   "enroll <user>",
+		Short: "generates a new TOTP secret for the user",
+		Long: `Generates a new TOTP secret for the user, replacing any existing one. The
+secret is printed along with an otpauth URL, which can be turned into a QR code
+for authenticator apps with a tool such as qrencode.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(func(secrets *idp.TOTPSecretStore) error {
+				secret, err := secrets.Enroll(args[0])
+				if err != nil {
+					return err
+				}
+				fmt.Fprintln(cmd.OutOrStdout(), secret)
+				fmt.Fprintln(cmd.OutOrStdout(), idp.TOTPURL(viper.GetString("totp-issuer"), args[0], secret))
+				return nil
+			})
+		},
+		Args: cobra.ExactArgs(1),
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "remove <user>",
+		Short: "removes the user's TOTP secret",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return run(func(secrets *idp.TOTPSecretStore) error {
+				return secrets.Remove(args[0])
+			})
+		},
+		Args: cobra.ExactArgs(1),
+	})
+	return cmd
+}
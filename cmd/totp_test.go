@@ -0,0 +1,58 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_totpCmd(t *testing.T) {
+	cache, err := store.New(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	execute := func(args ...string) (string, error) {
+		cmd := totpCmd(func() (store.Cache, error) { return cache, nil })
+		var out bytes.Buffer
+		cmd.SetOutput(&out)
+		cmd.SetArgs(args)
+		err := cmd.Execute()
+		return strings.TrimSpace(out.String()), err
+	}
+	secrets := idp.NewTOTPSecretStore(cache)
+
+	out, err := execute("enroll", "joe")
+	assert.NoError(t, err)
+	lines := strings.Split(out, "\n")
+	if assert.Len(t, lines, 2) {
+		secret, err := secrets.Lookup("joe")
+		assert.NoError(t, err)
+		assert.Equal(t, secret, lines[0])
+		assert.True(t, strings.HasPrefix(lines[1], "otpauth://totp/lite-idp:joe?"))
+		assert.Contains(t, lines[1], "secret="+secret)
+	}
+
+	_, err = execute("remove", "joe")
+	assert.NoError(t, err)
+	_, err = secrets.Lookup("joe")
+	assert.Equal(t, store.ErrNotFound, err)
+}
@@ -0,0 +1,300 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsig
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+var attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;",
+	"\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+
+// Canonicalize marshals v to XML and returns it in exclusive canonical form without comments,
+// http://www.w3.org/2001/10/xml-exc-c14n#, along with the value of the root element's ID attribute.
+func Canonicalize(v interface{}) ([]byte, string, error) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return nil, "", err
+	}
+	return CanonicalizeXML(data)
+}
+
+// c14nMethod selects the namespace declarations that are rendered
+type c14nMethod struct {
+	// inclusive renders every namespace in scope, not just those that are visibly utilized
+	inclusive bool
+	// prefixes exclusive canonicalization renders like inclusive canonicalization, "" for the default namespace
+	prefixes map[string]bool
+}
+
+// exclusive is exclusive canonicalization without an InclusiveNamespaces PrefixList
+var exclusive = c14nMethod{}
+
+// newC14NMethod returns the canonicalization method of a CanonicalizationMethod or Transform
+func newC14NMethod(transform Transform) (c14nMethod, error) {
+	switch transform.Algorithm {
+	case ExclusiveC14N:
+		method := c14nMethod{prefixes: map[string]bool{}}
+		if transform.InclusiveNamespaces != nil {
+			for _, prefix := range strings.Fields(transform.InclusiveNamespaces.PrefixList) {
+				if prefix == "#default" {
+					prefix = ""
+				}
+				method.prefixes[prefix] = true
+			}
+		}
+		return method, nil
+	case InclusiveC14N:
+		if transform.InclusiveNamespaces != nil {
+			return c14nMethod{}, errors.New("inclusive canonicalization does not take inclusive namespaces")
+		}
+		return c14nMethod{inclusive: true}, nil
+	}
+	return c14nMethod{}, fmt.Errorf("unsupported canonicalization algorithm %s", transform.Algorithm)
+}
+
+// declaration is a namespace declaration
+type declaration struct {
+	prefix, uri string
+}
+
+// scope tracks the namespace declarations of an element in the input and those rendered in the output. Elements
+// rarely declare more than a few namespaces, so they're searched in order.
+type scope struct {
+	declared []declaration
+	rendered []declaration
+}
+
+// c14nAttr is an attribute along with the URI of its namespace, which orders attributes in the canonical form
+type c14nAttr struct {
+	xml.Attr
+	space string
+}
+
+// byNamespace sorts attributes by namespace URI and then local name
+type byNamespace []c14nAttr
+
+func (a byNamespace) Len() int      { return len(a) }
+func (a byNamespace) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a byNamespace) Less(i, j int) bool {
+	if a[i].space != a[j].space {
+		return a[i].space < a[j].space
+	}
+	return a[i].Name.Local < a[j].Name.Local
+}
+
+// CanonicalizeXML returns the XML document in exclusive canonical form along with the value of the root element's ID attribute
+func CanonicalizeXML(data []byte) ([]byte, string, error) {
+	return canonicalize(data, exclusive, func([]xml.Name) bool { return true }, func([]xml.Name) bool { return false })
+}
+
+// canonicalize returns the first element for which selected returns true in canonical form without the subtrees
+// for which omitted returns true. Both are called with the names of the element and its ancestors, root first,
+// with namespace URIs in place of prefixes.
+func canonicalize(data []byte, method c14nMethod, selected, omitted func(path []xml.Name) bool) ([]byte, string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var out bytes.Buffer
+	out.Grow(len(data))
+	scopes := make([]scope, 0, 16)
+	path := make([]xml.Name, 0, 16)
+	// attrs and prefixes are reused for every element
+	attrs := []c14nAttr{}
+	prefixes := []string{}
+	id := ""
+	// depths of the selected element and the omitted subtree being skipped, zero when there isn't one
+	start, skip := 0, 0
+	done := false
+	// Methods that don't render every prefix in scope only have to look at the element itself
+	declaredPrefixes := method.inclusive || len(method.prefixes) > 0
+	lookup := func(prefix string, output bool) (string, bool) {
+		for i := len(scopes) - 1; i >= 0; i-- {
+			namespaces := scopes[i].declared
+			if output {
+				namespaces = scopes[i].rendered
+			}
+			for _, ns := range namespaces {
+				if ns.prefix == prefix {
+					return ns.uri, true
+				}
+			}
+		}
+		return "", false
+	}
+	for {
+		token, err := decoder.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			current := scope{}
+			attrs = attrs[:0]
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					current.declared = append(current.declared, declaration{"", a.Value})
+				case a.Name.Space == "xmlns":
+					current.declared = append(current.declared, declaration{a.Name.Local, a.Value})
+				default:
+					attrs = append(attrs, c14nAttr{Attr: a})
+				}
+			}
+			if len(scopes) == 0 {
+				for _, a := range attrs {
+					if a.Name.Space == "" && a.Name.Local == "ID" {
+						id = a.Value
+					}
+				}
+			}
+			scopes = append(scopes, current)
+			space, _ := lookup(t.Name.Space, false)
+			path = append(path, xml.Name{Space: space, Local: t.Name.Local})
+			if skip == 0 && start != 0 && omitted(path) {
+				skip = len(path)
+			}
+			if skip != 0 {
+				continue
+			}
+			if start == 0 && !done && selected(path) {
+				start = len(path)
+			}
+			if start == 0 {
+				continue
+			}
+			// Render declarations for visibly utilized prefixes, and those the method includes, that differ from
+			// the output ancestors
+			prefixes = append(prefixes[:0], t.Name.Space)
+			for _, a := range attrs {
+				if a.Name.Space != "" && !contains(prefixes, a.Name.Space) {
+					prefixes = append(prefixes, a.Name.Space)
+				}
+			}
+			if declaredPrefixes {
+				for _, s := range scopes {
+					for _, ns := range s.declared {
+						if (method.inclusive || method.prefixes[ns.prefix]) && !contains(prefixes, ns.prefix) {
+							prefixes = append(prefixes, ns.prefix)
+						}
+					}
+				}
+			}
+			rendered := prefixes[:0]
+			for _, prefix := range prefixes {
+				if prefix == "xml" {
+					continue
+				}
+				uri, _ := lookup(prefix, false)
+				if output, ok := lookup(prefix, true); (ok && output == uri) || (!ok && uri == "" && prefix == "") {
+					continue
+				}
+				current.rendered = append(current.rendered, declaration{prefix, uri})
+				rendered = append(rendered, prefix)
+			}
+			scopes[len(scopes)-1].rendered = current.rendered
+			sort.Strings(rendered)
+			// Attributes are sorted by namespace URI and then local name
+			for n := range attrs {
+				if attrs[n].Name.Space != "" {
+					attrs[n].space, _ = lookup(attrs[n].Name.Space, false)
+				}
+			}
+			sort.Stable(byNamespace(attrs))
+			out.WriteByte('<')
+			writeQualified(&out, t.Name)
+			for _, prefix := range rendered {
+				uri, _ := lookup(prefix, true)
+				if prefix == "" {
+					out.WriteString(` xmlns="`)
+				} else {
+					out.WriteString(" xmlns:")
+					out.WriteString(prefix)
+					out.WriteString(`="`)
+				}
+				attrEscaper.WriteString(&out, uri)
+				out.WriteByte('"')
+			}
+			for _, a := range attrs {
+				out.WriteByte(' ')
+				writeQualified(&out, a.Name)
+				out.WriteString(`="`)
+				attrEscaper.WriteString(&out, a.Value)
+				out.WriteByte('"')
+			}
+			out.WriteByte('>')
+		case xml.EndElement:
+			if start != 0 && skip == 0 {
+				out.WriteString("</")
+				writeQualified(&out, t.Name)
+				out.WriteByte('>')
+			}
+			switch len(path) {
+			case skip:
+				skip = 0
+			case start:
+				start = 0
+				done = true
+			}
+			scopes = scopes[:len(scopes)-1]
+			path = path[:len(path)-1]
+		case xml.CharData:
+			// Text outside of the selected element isn't part of the canonical form
+			if start != 0 && skip == 0 {
+				escapeText(&out, t)
+			}
+		}
+	}
+	return out.Bytes(), id, nil
+}
+
+// escapeText writes character data with &, <, > and carriage returns escaped
+func escapeText(out *bytes.Buffer, text []byte) {
+	last := 0
+	for n, c := range text {
+		var escaped string
+		switch c {
+		case '&':
+			escaped = "&amp;"
+		case '<':
+			escaped = "&lt;"
+		case '>':
+			escaped = "&gt;"
+		case '\r':
+			escaped = "&#xD;"
+		default:
+			continue
+		}
+		out.Write(text[last:n])
+		out.WriteString(escaped)
+		last = n + 1
+	}
+	out.Write(text[last:])
+}
+
+func writeQualified(out *bytes.Buffer, name xml.Name) {
+	if name.Space != "" {
+		out.WriteString(name.Space)
+		out.WriteByte(':')
+	}
+	out.WriteString(name.Local)
+}
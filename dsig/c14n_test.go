@@ -0,0 +1,139 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsig
+
+import (
+	"encoding/xml"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonicalizeXML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"redundant declarations", `<a xmlns="urn:a" ID="1"><b xmlns="urn:a"></b><c xmlns="urn:c"/></a>`,
+			`<a xmlns="urn:a" ID="1"><b></b><c xmlns="urn:c"></c></a>`},
+		{"sorted attributes", `<a z="1" xmlns:p="urn:p" p:b="2" a="3" xmlns="urn:a"></a>`,
+			`<a xmlns="urn:a" xmlns:p="urn:p" a="3" z="1" p:b="2"></a>`},
+		{"unused prefixes", `<a xmlns="urn:a" xmlns:x="urn:x"><x:b/></a>`,
+			`<a xmlns="urn:a"><x:b xmlns:x="urn:x"></x:b></a>`},
+		{"escaping", `<a b="&quot;&amp;&lt;&#9;">&amp;&lt;&gt;"'</a>`,
+			`<a b="&quot;&amp;&lt;&#x9;">&amp;&lt;&gt;"'</a>`},
+		{"comments", `<a><!-- note -->text</a>`, `<a>text</a>`},
+		{"undeclared default", `<a xmlns="urn:a"><b xmlns=""></b></a>`, `<a xmlns="urn:a"><b xmlns=""></b></a>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, _, err := CanonicalizeXML([]byte(tt.in))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.want, string(got))
+		})
+	}
+}
+
+func TestCanonicalize(t *testing.T) {
+	type child struct {
+		XMLName xml.Name `xml:"urn:a Child"`
+		Value   string   `xml:",chardata"`
+	}
+	type root struct {
+		XMLName xml.Name `xml:"urn:a Root"`
+		ID      string   `xml:",attr"`
+		Child   child
+	}
+	got, id, err := Canonicalize(root{ID: "_1", Child: child{Value: "a & b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "_1", id)
+	assert.Equal(t, `<Root xmlns="urn:a" ID="_1"><Child>a &amp; b</Child></Root>`, string(got))
+}
+
+func TestNewC14NMethod(t *testing.T) {
+	in := `<a xmlns="urn:a" xmlns:x="urn:x" xmlns:y="urn:y"><b xmlns:z="urn:z"><c></c></b></a>`
+	isB := func(path []xml.Name) bool { return len(path) == 2 }
+	tests := []struct {
+		name      string
+		transform Transform
+		whole     string
+		subset    string
+	}{
+		{"exclusive", Transform{Algorithm: ExclusiveC14N},
+			`<a xmlns="urn:a"><b><c></c></b></a>`, `<b xmlns="urn:a"><c></c></b>`},
+		{"inclusive", Transform{Algorithm: InclusiveC14N},
+			`<a xmlns="urn:a" xmlns:x="urn:x" xmlns:y="urn:y"><b xmlns:z="urn:z"><c></c></b></a>`,
+			`<b xmlns="urn:a" xmlns:x="urn:x" xmlns:y="urn:y" xmlns:z="urn:z"><c></c></b>`},
+		{"inclusive namespaces", Transform{Algorithm: ExclusiveC14N, InclusiveNamespaces: &InclusiveNamespaces{PrefixList: "x z undeclared"}},
+			`<a xmlns="urn:a" xmlns:x="urn:x"><b xmlns:z="urn:z"><c></c></b></a>`,
+			`<b xmlns="urn:a" xmlns:x="urn:x" xmlns:z="urn:z"><c></c></b>`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, err := newC14NMethod(tt.transform)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, err := canonicalize([]byte(in), method, func([]xml.Name) bool { return true }, func([]xml.Name) bool { return false })
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.whole, string(got))
+			got, _, err = canonicalize([]byte(in), method, isB, func([]xml.Name) bool { return false })
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.subset, string(got), "namespaces declared by ancestors should be rendered on the apex")
+		})
+	}
+	noDefault := `<a xmlns="urn:a"><b xmlns=""><c></c></b></a>`
+	method, _ := newC14NMethod(Transform{Algorithm: ExclusiveC14N, InclusiveNamespaces: &InclusiveNamespaces{PrefixList: "#default"}})
+	got, _, err := canonicalize([]byte(noDefault), method, isB, func([]xml.Name) bool { return false })
+	if assert.NoError(t, err) {
+		assert.Equal(t, `<b><c></c></b>`, string(got), "an empty default namespace isn't declared")
+	}
+
+	_, err = newC14NMethod(Transform{Algorithm: InclusiveC14N, InclusiveNamespaces: &InclusiveNamespaces{PrefixList: "x"}})
+	assert.Error(t, err, "only exclusive canonicalization has inclusive namespaces")
+	_, err = newC14NMethod(Transform{Algorithm: "http://www.w3.org/2006/12/xml-c14n11"})
+	assert.Error(t, err)
+}
+
+// testAssertion is a SAML assertion with the namespace declarations the xml package writes on every element
+const testAssertion = `<Assertion xmlns="urn:oasis:names:tc:SAML:2.0:assertion" ID="_8e8dc5f69a98cc4c1ff3427e5ce34606fd672f91e6" Version="2.0" IssueInstant="2018-03-01T12:00:00Z">` +
+	`<Issuer xmlns="urn:oasis:names:tc:SAML:2.0:assertion">https://idp.example.com/</Issuer>` +
+	`<Subject xmlns="urn:oasis:names:tc:SAML:2.0:assertion"><NameID xmlns="urn:oasis:names:tc:SAML:2.0:assertion" Format="urn:oasis:names:tc:SAML:2.0:nameid-format:transient" NameQualifier="https://idp.example.com/" SPNameQualifier="dex">_ce3d2948b4cf20146dee0a0b3dd6f69b6cf86f62d7</NameID>` +
+	`<SubjectConfirmation xmlns="urn:oasis:names:tc:SAML:2.0:assertion" Method="urn:oasis:names:tc:SAML:2.0:cm:bearer"><SubjectConfirmationData xmlns="urn:oasis:names:tc:SAML:2.0:assertion" InResponseTo="_1" NotOnOrAfter="2018-03-01T12:05:00Z" Recipient="http://127.0.0.1:5556/dex/callback"></SubjectConfirmationData></SubjectConfirmation></Subject>` +
+	`<Conditions xmlns="urn:oasis:names:tc:SAML:2.0:assertion" NotBefore="2018-03-01T11:59:30Z" NotOnOrAfter="2018-03-01T12:05:00Z"><AudienceRestriction xmlns="urn:oasis:names:tc:SAML:2.0:assertion"><Audience xmlns="urn:oasis:names:tc:SAML:2.0:assertion">dex</Audience></AudienceRestriction></Conditions>` +
+	`<AuthnStatement xmlns="urn:oasis:names:tc:SAML:2.0:assertion" AuthnInstant="2018-03-01T12:00:00Z" SessionIndex="session" SessionNotOnOrAfter="2018-03-01T20:00:00Z"><AuthnContext xmlns="urn:oasis:names:tc:SAML:2.0:assertion"><AuthnContextClassRef xmlns="urn:oasis:names:tc:SAML:2.0:assertion">urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport</AuthnContextClassRef></AuthnContext></AuthnStatement>` +
+	`<AttributeStatement xmlns="urn:oasis:names:tc:SAML:2.0:assertion"><Attribute xmlns="urn:oasis:names:tc:SAML:2.0:assertion" Name="mail" NameFormat="urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified"><AttributeValue xmlns="urn:oasis:names:tc:SAML:2.0:assertion" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="xs:string" xmlns:xs="http://www.w3.org/2001/XMLSchema">joe@example.com</AttributeValue></Attribute>` +
+	`<Attribute xmlns="urn:oasis:names:tc:SAML:2.0:assertion" Name="groups"><AttributeValue xmlns="urn:oasis:names:tc:SAML:2.0:assertion">admins &amp; users</AttributeValue><AttributeValue xmlns="urn:oasis:names:tc:SAML:2.0:assertion">developers</AttributeValue></Attribute></AttributeStatement>` +
+	`</Assertion>`
+
+func BenchmarkCanonicalizeXML(b *testing.B) {
+	data := []byte(testAssertion)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for n := 0; n < b.N; n++ {
+		if _, _, err := CanonicalizeXML(data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
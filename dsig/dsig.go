@@ -0,0 +1,367 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dsig creates and verifies enveloped XML digital signatures with RSA and ECDSA keys. Signatures have the
+// same form as those of the xmlsig package, but they can use inclusive canonicalization or exclusive
+// canonicalization with InclusiveNamespaces.
+package dsig
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	// Hash functions used by the supported algorithms
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+
+	"github.com/amdonov/xmlsig"
+)
+
+// Signature algorithms
+const (
+	RSASHA1     = "http://www.w3.org/2000/09/xmldsig#rsa-sha1"
+	RSASHA256   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	RSASHA512   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	ECDSASHA1   = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha1"
+	ECDSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+	ECDSASHA384 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha384"
+	ECDSASHA512 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha512"
+)
+
+// Digest algorithms
+const (
+	SHA1   = "http://www.w3.org/2000/09/xmldsig#sha1"
+	SHA256 = "http://www.w3.org/2001/04/xmlenc#sha256"
+	SHA384 = "http://www.w3.org/2001/04/xmldsig-more#sha384"
+	SHA512 = "http://www.w3.org/2001/04/xmlenc#sha512"
+)
+
+// Canonicalization algorithms, without comments
+const (
+	ExclusiveC14N = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	InclusiveC14N = "http://www.w3.org/TR/2001/REC-xml-c14n-20010315"
+)
+
+const enveloped = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+
+var signatureHashes = map[string]crypto.Hash{
+	RSASHA1:     crypto.SHA1,
+	RSASHA256:   crypto.SHA256,
+	RSASHA512:   crypto.SHA512,
+	ECDSASHA1:   crypto.SHA1,
+	ECDSASHA256: crypto.SHA256,
+	ECDSASHA384: crypto.SHA384,
+	ECDSASHA512: crypto.SHA512,
+}
+
+var digestHashes = map[string]crypto.Hash{
+	SHA1:   crypto.SHA1,
+	SHA256: crypto.SHA256,
+	SHA384: crypto.SHA384,
+	SHA512: crypto.SHA512,
+}
+
+// SignatureAlgorithms returns the signature algorithms that can be used with the key in order of preference
+func SignatureAlgorithms(key crypto.PublicKey) []string {
+	switch key.(type) {
+	case *rsa.PublicKey:
+		return []string{RSASHA256, RSASHA512, RSASHA1}
+	case *ecdsa.PublicKey:
+		return []string{ECDSASHA256, ECDSASHA384, ECDSASHA512, ECDSASHA1}
+	}
+	return nil
+}
+
+// DigestAlgorithms returns the supported digest algorithms in order of preference
+func DigestAlgorithms() []string {
+	return []string{SHA256, SHA384, SHA512, SHA1}
+}
+
+// DigestAlgorithm returns the digest algorithm that uses the same hash function as the signature algorithm
+func DigestAlgorithm(signatureAlgorithm string) string {
+	switch signatureHashes[signatureAlgorithm] {
+	case crypto.SHA1:
+		return SHA1
+	case crypto.SHA384:
+		return SHA384
+	case crypto.SHA512:
+		return SHA512
+	}
+	return SHA256
+}
+
+// SignerOptions select the algorithms a Signer uses. Empty values select the defaults.
+type SignerOptions struct {
+	SignatureAlgorithm string
+	DigestAlgorithm    string
+	// ExclusiveC14N or InclusiveC14N
+	Canonicalization string
+	// Prefixes that exclusive canonicalization renders like inclusive canonicalization, #default for the default namespace
+	InclusiveNamespaces []string
+}
+
+type signer struct {
+	cert            string
+	key             crypto.Signer
+	signatureMethod string
+	digestMethod    string
+	// canonicalization of both SignedInfo and the signed element
+	canonicalization Transform
+	method           c14nMethod
+	// template is nil unless SignedInfo is canonicalized the same way for every document
+	template *signedInfoTemplate
+}
+
+// signedInfoTemplate is the canonical form of a signer's SignedInfo split around the reference's ID and digest value
+type signedInfoTemplate struct {
+	beforeID, beforeDigest, end string
+}
+
+// Placeholders for the ID and digest value when the template is made. Neither is changed by canonicalization.
+const (
+	templateID     = "_template_id"
+	templateDigest = "template_digest"
+)
+
+// NewSigner returns a signer for the certificate's private key. The preferred signature algorithm
+// for the key is used if options.SignatureAlgorithm is empty and the digest algorithm matches the
+// signature algorithm's hash function if options.DigestAlgorithm is empty. Documents are canonicalized
+// with exclusive canonicalization unless options.Canonicalization is InclusiveC14N.
+func NewSigner(cert tls.Certificate, options SignerOptions) (Signer, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("certificate is required for signing")
+	}
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key cannot be used for signing")
+	}
+	supported := SignatureAlgorithms(parsed.PublicKey)
+	if len(supported) == 0 {
+		return nil, errors.New("signing requires an RSA or ECDSA key")
+	}
+	signatureMethod := options.SignatureAlgorithm
+	if signatureMethod == "" {
+		signatureMethod = supported[0]
+	} else if !contains(supported, signatureMethod) {
+		return nil, fmt.Errorf("signature algorithm %s cannot be used with the certificate's key", signatureMethod)
+	}
+	digestMethod := options.DigestAlgorithm
+	if digestMethod == "" {
+		digestMethod = DigestAlgorithm(signatureMethod)
+	} else if _, ok := digestHashes[digestMethod]; !ok {
+		return nil, fmt.Errorf("unsupported digest algorithm %s", digestMethod)
+	}
+	canonicalization := Transform{Algorithm: options.Canonicalization}
+	if canonicalization.Algorithm == "" {
+		canonicalization.Algorithm = ExclusiveC14N
+	}
+	if len(options.InclusiveNamespaces) > 0 {
+		if canonicalization.Algorithm != ExclusiveC14N {
+			return nil, errors.New("inclusive namespaces can only be used with exclusive canonicalization")
+		}
+		canonicalization.InclusiveNamespaces = &InclusiveNamespaces{PrefixList: strings.Join(options.InclusiveNamespaces, " ")}
+	}
+	method, err := newC14NMethod(canonicalization)
+	if err != nil {
+		return nil, err
+	}
+	s := &signer{
+		cert:             base64.StdEncoding.EncodeToString(cert.Certificate[0]),
+		key:              key,
+		signatureMethod:  signatureMethod,
+		digestMethod:     digestMethod,
+		canonicalization: canonicalization,
+		method:           method,
+	}
+	// Exclusive canonicalization without inclusive namespaces doesn't render the namespaces the signed element
+	// declares, so its SignedInfo only differs by ID and digest value
+	if canonicalization.Algorithm == ExclusiveC14N && canonicalization.InclusiveNamespaces == nil {
+		if s.template, err = s.newSignedInfoTemplate(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// newSignedInfoTemplate canonicalizes the signer's SignedInfo once with placeholders for the ID and digest value
+func (s *signer) newSignedInfoTemplate() (*signedInfoTemplate, error) {
+	canonical, err := canonicalizeSignedInfo([]byte("<Root/>"), s.newSignature(templateID, templateDigest), s.method)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(string(canonical), templateID)
+	if len(parts) != 2 {
+		return nil, errors.New("unable to make a SignedInfo template")
+	}
+	rest := strings.Split(parts[1], templateDigest)
+	if len(rest) != 2 {
+		return nil, errors.New("unable to make a SignedInfo template")
+	}
+	return &signedInfoTemplate{beforeID: parts[0], beforeDigest: rest[0], end: rest[1]}, nil
+}
+
+// canonicalize returns the canonical SignedInfo for the ID and digest value
+func (t *signedInfoTemplate) canonicalize(id, digest string) []byte {
+	b := make([]byte, 0, len(t.beforeID)+len(id)+len(t.beforeDigest)+len(digest)+len(t.end))
+	b = append(b, t.beforeID...)
+	b = append(b, id...)
+	b = append(b, t.beforeDigest...)
+	b = append(b, digest...)
+	return append(b, t.end...)
+}
+
+func (s *signer) Algorithm() string {
+	return s.signatureMethod
+}
+
+// Sign returns the base64 encoded signature of data. ECDSA signatures are the concatenation of r and s as required by XML signature.
+func (s *signer) Sign(data []byte) (string, error) {
+	hash := signatureHashes[s.signatureMethod]
+	h := hash.New()
+	h.Write(data)
+	sig, err := s.key.Sign(rand.Reader, h.Sum(nil), hash)
+	if err != nil {
+		return "", err
+	}
+	if key, ok := s.key.Public().(*ecdsa.PublicKey); ok {
+		if sig, err = concatenate(sig, (key.Curve.Params().BitSize+7)/8); err != nil {
+			return "", err
+		}
+	}
+	return base64.StdEncoding.EncodeToString(sig), nil
+}
+
+func (s *signer) CreateSignature(v interface{}) (*Signature, error) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	canonical, id, err := canonicalize(data, s.method, func([]xml.Name) bool { return true }, func([]xml.Name) bool { return false })
+	if err != nil {
+		return nil, err
+	}
+	h := digestHashes[s.digestMethod].New()
+	h.Write(canonical)
+	signature := s.newSignature(id, base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	if s.template != nil && plainID(id) {
+		canonical = s.template.canonicalize(id, signature.SignedInfo.Reference.DigestValue)
+	} else if canonical, err = canonicalizeSignedInfo(data, signature, s.method); err != nil {
+		return nil, err
+	}
+	if signature.SignatureValue, err = s.Sign(canonical); err != nil {
+		return nil, err
+	}
+	signature.KeyInfo.X509Data = &xmlsig.X509Data{X509Certificate: s.cert}
+	return signature, nil
+}
+
+// newSignature returns an unsigned signature that references the element with the ID
+func (s *signer) newSignature(id, digest string) *Signature {
+	signature := &Signature{}
+	info := &signature.SignedInfo
+	info.CanonicalizationMethod = s.canonicalization
+	info.SignatureMethod.Algorithm = s.signatureMethod
+	if id != "" {
+		info.Reference.URI = "#" + id
+	}
+	info.Reference.Transforms.Transform = []Transform{{Algorithm: enveloped}, s.canonicalization}
+	info.Reference.DigestMethod.Algorithm = s.digestMethod
+	info.Reference.DigestValue = digest
+	return signature
+}
+
+// plainID reports whether the ID is made up of ASCII letters, digits, underscores, hyphens, and periods, which
+// appear the same in XML and its canonical form
+func plainID(id string) bool {
+	if id == "" {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// canonicalizeSignedInfo canonicalizes the signature's SignedInfo as it appears once the signature is placed in the
+// signed element. Inclusive canonicalization renders the namespaces declared by the element there.
+func canonicalizeSignedInfo(data []byte, signature *Signature, method c14nMethod) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	var root xml.StartElement
+	for {
+		token, err := decoder.RawToken()
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			root = start
+			break
+		}
+	}
+	var b bytes.Buffer
+	b.WriteString("<Root")
+	// The signature declares its own default namespace
+	for _, a := range root.Attr {
+		if a.Name.Space == "xmlns" {
+			b.WriteString(" xmlns:" + a.Name.Local + `="` + attrEscaper.Replace(a.Value) + `"`)
+		}
+	}
+	b.WriteString(">")
+	if err := xml.NewEncoder(&b).Encode(signature); err != nil {
+		return nil, err
+	}
+	b.WriteString("</Root>")
+	canonical, _, err := canonicalize(b.Bytes(), method, isSignedInfo, func([]xml.Name) bool { return false })
+	return canonical, err
+}
+
+// concatenate converts an ASN.1 ECDSA signature to fixed length r and s values
+func concatenate(sig []byte, size int) ([]byte, error) {
+	var parsed struct{ R, S *big.Int }
+	if _, err := asn1.Unmarshal(sig, &parsed); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 2*size)
+	r, s := parsed.R.Bytes(), parsed.S.Bytes()
+	copy(out[size-len(r):size], r)
+	copy(out[2*size-len(s):], s)
+	return out, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
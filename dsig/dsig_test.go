@@ -0,0 +1,200 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type document struct {
+	XMLName xml.Name `xml:"urn:test Document"`
+	ID      string   `xml:",attr"`
+	Value   string   `xml:"urn:test Value"`
+}
+
+func certificate(t testing.TB, key crypto.Signer) tls.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "test"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestNewSigner_rsa(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := certificate(t, key)
+	signer, err := NewSigner(cert, SignerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, RSASHA256, signer.Algorithm(), "RSA-SHA256 should be the default")
+	doc := &document{ID: "_1", Value: "test"}
+	sig, err := signer.CreateSignature(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, SHA256, sig.SignedInfo.Reference.DigestMethod.Algorithm, "digest should follow the signature algorithm")
+	assert.Equal(t, "#_1", sig.SignedInfo.Reference.URI)
+	canonical, _, _ := Canonicalize(doc)
+	digest := crypto.SHA256.New()
+	digest.Write(canonical)
+	assert.Equal(t, base64.StdEncoding.EncodeToString(digest.Sum(nil)), sig.SignedInfo.Reference.DigestValue)
+	info, _, _ := Canonicalize(sig.SignedInfo)
+	h := crypto.SHA256.New()
+	h.Write(info)
+	value, _ := base64.StdEncoding.DecodeString(sig.SignatureValue)
+	assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, h.Sum(nil), value))
+
+	signer, err = NewSigner(cert, SignerOptions{SignatureAlgorithm: RSASHA1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err = signer.CreateSignature(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, RSASHA1, sig.SignedInfo.SignatureMethod.Algorithm)
+	assert.Equal(t, SHA1, sig.SignedInfo.Reference.DigestMethod.Algorithm)
+
+	_, err = NewSigner(cert, SignerOptions{SignatureAlgorithm: ECDSASHA256})
+	assert.Error(t, err, "ECDSA algorithms require an EC key")
+	_, err = NewSigner(cert, SignerOptions{Canonicalization: "http://www.w3.org/2006/12/xml-c14n11"})
+	assert.Error(t, err)
+	_, err = NewSigner(cert, SignerOptions{Canonicalization: InclusiveC14N, InclusiveNamespaces: []string{"saml"}})
+	assert.Error(t, err, "inclusive namespaces only apply to exclusive canonicalization")
+}
+
+func TestNewSigner_ecdsa(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSigner(certificate(t, key), SignerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ECDSASHA256, signer.Algorithm())
+	sig, err := signer.CreateSignature(&document{ID: "_1", Value: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, _, _ := Canonicalize(sig.SignedInfo)
+	h := crypto.SHA256.New()
+	h.Write(info)
+	value, _ := base64.StdEncoding.DecodeString(sig.SignatureValue)
+	if assert.Len(t, value, 64, "signature should be r and s concatenated") {
+		r, s := new(big.Int).SetBytes(value[:32]), new(big.Int).SetBytes(value[32:])
+		assert.True(t, ecdsa.Verify(&key.PublicKey, h.Sum(nil), r, s))
+	}
+}
+
+func TestSigner_signedInfoTemplate(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := certificate(t, key)
+	for _, options := range []SignerOptions{{}, {SignatureAlgorithm: ECDSASHA512, DigestAlgorithm: SHA1}} {
+		created, err := NewSigner(cert, options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := created.(*signer)
+		if !assert.NotNil(t, s.template, "exclusive canonicalization should use a template") {
+			return
+		}
+		for _, id := range []string{"_1", "_8e8dc5f69a98cc4c1ff3427e5ce34606fd672f91e6", "id-1.2"} {
+			digest := "bm90IGEgcmVhbCBkaWdlc3Q="
+			want, err := canonicalizeSignedInfo([]byte(`<Root xmlns:x="urn:x"/>`), s.newSignature(id, digest), s.method)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, string(want), string(s.template.canonicalize(id, digest)))
+		}
+	}
+	for _, id := range []string{"", "a&b", `a"b`, "é"} {
+		assert.False(t, plainID(id), "%q needs to be canonicalized", id)
+	}
+
+	created, err := NewSigner(cert, SignerOptions{Canonicalization: InclusiveC14N})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, created.(*signer).template, "inclusive canonicalization renders the signed element's namespaces")
+	created, err = NewSigner(cert, SignerOptions{InclusiveNamespaces: []string{"x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, created.(*signer).template)
+}
+
+func BenchmarkSigner_CreateSignature(b *testing.B) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		b.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarks := []struct {
+		name    string
+		key     crypto.Signer
+		options SignerOptions
+	}{
+		{"rsa", rsaKey, SignerOptions{}},
+		{"ecdsa", ecKey, SignerOptions{}},
+		{"inclusive", ecKey, SignerOptions{Canonicalization: InclusiveC14N}},
+	}
+	doc := &document{ID: "_1", Value: "test"}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			signer, err := NewSigner(certificate(b, bm.key), bm.options)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if _, err := signer.CreateSignature(doc); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
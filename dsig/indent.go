@@ -0,0 +1,65 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsig
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+)
+
+// MarshalIndentSigned marshals v like xml.MarshalIndent with an enveloped signature placed in it by setSignature.
+// The whitespace added by indenting is part of the signed content, so the signature is computed over the
+// indented document instead of the compact form that signer.CreateSignature covers.
+func MarshalIndentSigned(signer Signer, v interface{}, setSignature func(*Signature), prefix, indent string) ([]byte, error) {
+	signature, err := signer.CreateSignature(v)
+	if err != nil {
+		return nil, err
+	}
+	setSignature(signature)
+	info := &signature.SignedInfo
+	digestHash, ok := digestHashes[info.Reference.DigestMethod.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest algorithm %s", info.Reference.DigestMethod.Algorithm)
+	}
+	// The signer canonicalizes the document and SignedInfo the same way
+	method, err := newC14NMethod(info.CanonicalizationMethod)
+	if err != nil {
+		return nil, err
+	}
+	// The signature is left out of the digest, so its placeholder values don't matter yet
+	data, err := xml.MarshalIndent(v, prefix, indent)
+	if err != nil {
+		return nil, err
+	}
+	canonical, _, err := canonicalize(data, method, func([]xml.Name) bool { return true }, isSignature)
+	if err != nil {
+		return nil, err
+	}
+	h := digestHash.New()
+	h.Write(canonical)
+	info.Reference.DigestValue = base64.StdEncoding.EncodeToString(h.Sum(nil))
+	// SignedInfo is signed as it appears in the indented document
+	if data, err = xml.MarshalIndent(v, prefix, indent); err != nil {
+		return nil, err
+	}
+	if canonical, _, err = canonicalize(data, method, isSignedInfo, func([]xml.Name) bool { return false }); err != nil {
+		return nil, err
+	}
+	if signature.SignatureValue, err = signer.Sign(canonical); err != nil {
+		return nil, err
+	}
+	return xml.MarshalIndent(v, prefix, indent)
+}
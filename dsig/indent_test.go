@@ -0,0 +1,44 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsig
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalIndentSigned(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSigner(certificate(t, key), SignerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := &signedDocument{ID: "_1", Value: "test"}
+	data, err := MarshalIndentSigned(signer, doc, func(s *Signature) { doc.Signature = s }, "", "  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.Contains(string(data), "\n  <Value"), "document should be indented")
+	assert.NoError(t, Verify(data, key.Public()))
+	tampered := strings.Replace(string(data), "\n  <Value", "<Value", 1)
+	assert.Error(t, Verify([]byte(tampered), key.Public()), "whitespace should be covered by the signature")
+}
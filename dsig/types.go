@@ -0,0 +1,73 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsig
+
+import (
+	"encoding/xml"
+
+	"github.com/amdonov/xmlsig"
+)
+
+// Signature is an enveloped XML signature. It has the same form as xmlsig.Signature, except that its
+// canonicalization method and transforms can carry the InclusiveNamespaces of exclusive canonicalization.
+type Signature struct {
+	XMLName        xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+	SignedInfo     SignedInfo
+	SignatureValue string `xml:"http://www.w3.org/2000/09/xmldsig# SignatureValue"`
+	KeyInfo        xmlsig.KeyInfo
+}
+
+// SignedInfo includes a canonicalization algorithm, a signature algorithm, and a reference
+type SignedInfo struct {
+	XMLName                xml.Name         `xml:"http://www.w3.org/2000/09/xmldsig# SignedInfo"`
+	CanonicalizationMethod Transform        `xml:"http://www.w3.org/2000/09/xmldsig# CanonicalizationMethod"`
+	SignatureMethod        xmlsig.Algorithm `xml:"http://www.w3.org/2000/09/xmldsig# SignatureMethod"`
+	Reference              Reference
+}
+
+// Reference identifies the signed element and holds its digest
+type Reference struct {
+	XMLName      xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# Reference"`
+	URI          string   `xml:",attr,omitempty"`
+	Transforms   Transforms
+	DigestMethod xmlsig.Algorithm `xml:"http://www.w3.org/2000/09/xmldsig# DigestMethod"`
+	DigestValue  string           `xml:"http://www.w3.org/2000/09/xmldsig# DigestValue"`
+}
+
+// Transforms are applied in order to the referenced element before it's digested
+type Transforms struct {
+	XMLName   xml.Name    `xml:"http://www.w3.org/2000/09/xmldsig# Transforms"`
+	Transform []Transform `xml:"http://www.w3.org/2000/09/xmldsig# Transform"`
+}
+
+// Transform is a transform or canonicalization algorithm
+type Transform struct {
+	Algorithm           string `xml:",attr"`
+	InclusiveNamespaces *InclusiveNamespaces
+}
+
+// InclusiveNamespaces lists prefixes that exclusive canonicalization renders like inclusive canonicalization,
+// separated by spaces. #default stands for the default namespace.
+type InclusiveNamespaces struct {
+	XMLName    xml.Name `xml:"http://www.w3.org/2001/10/xml-exc-c14n# InclusiveNamespaces"`
+	PrefixList string   `xml:",attr"`
+}
+
+// Signer creates enveloped signatures for documents and signs the data of messages sent with the HTTP-Redirect binding
+type Signer interface {
+	Sign([]byte) (string, error)
+	CreateSignature(interface{}) (*Signature, error)
+	Algorithm() string
+}
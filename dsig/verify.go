@@ -0,0 +1,198 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsig
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+)
+
+const namespace = "http://www.w3.org/2000/09/xmldsig#"
+
+// ErrNoSignature is returned by Verify for documents without an enveloped signature
+var ErrNoSignature = errors.New("document is not signed")
+
+type envelopedSignature struct {
+	SignedInfo     SignedInfo
+	SignatureValue string `xml:"http://www.w3.org/2000/09/xmldsig# SignatureValue"`
+}
+
+// Verify checks the enveloped signature of the XML document's root element with the public key. Only
+// signatures that reference the root element and use exclusive or inclusive canonicalization are accepted.
+func Verify(data []byte, key crypto.PublicKey) error {
+	if err := checkSingleRoot(data); err != nil {
+		return err
+	}
+	var doc struct {
+		ID        string               `xml:",attr"`
+		Signature []envelopedSignature `xml:"http://www.w3.org/2000/09/xmldsig# Signature"`
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	switch len(doc.Signature) {
+	case 0:
+		return ErrNoSignature
+	case 1:
+	default:
+		return errors.New("document has more than one signature")
+	}
+	info := doc.Signature[0].SignedInfo
+	infoMethod, err := newC14NMethod(info.CanonicalizationMethod)
+	if err != nil {
+		return err
+	}
+	if uri := info.Reference.URI; uri != "" && uri != "#"+doc.ID {
+		return errors.New("signature does not reference the document")
+	}
+	// The document is canonicalized exclusively unless a transform says otherwise
+	method := exclusive
+	for _, transform := range info.Reference.Transforms.Transform {
+		switch transform.Algorithm {
+		case enveloped:
+		case ExclusiveC14N, InclusiveC14N:
+			if method, err = newC14NMethod(transform); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported transform %s", transform.Algorithm)
+		}
+	}
+	digestHash, ok := digestHashes[info.Reference.DigestMethod.Algorithm]
+	if !ok {
+		return fmt.Errorf("unsupported digest algorithm %s", info.Reference.DigestMethod.Algorithm)
+	}
+	signatureHash, ok := signatureHashes[info.SignatureMethod.Algorithm]
+	if !ok {
+		return fmt.Errorf("unsupported signature algorithm %s", info.SignatureMethod.Algorithm)
+	}
+	// The digest covers the document without the signature
+	canonical, _, err := canonicalize(data, method, func(path []xml.Name) bool { return true }, isSignature)
+	if err != nil {
+		return err
+	}
+	digest, err := base64.StdEncoding.DecodeString(info.Reference.DigestValue)
+	if err != nil {
+		return err
+	}
+	h := digestHash.New()
+	h.Write(canonical)
+	if subtle.ConstantTimeCompare(h.Sum(nil), digest) != 1 {
+		return errors.New("digest does not match the document")
+	}
+	// The signature value covers SignedInfo as it appears in the document
+	canonical, _, err = canonicalize(data, infoMethod, isSignedInfo, func([]xml.Name) bool { return false })
+	if err != nil {
+		return err
+	}
+	signature, err := base64.StdEncoding.DecodeString(doc.Signature[0].SignatureValue)
+	if err != nil {
+		return err
+	}
+	h = signatureHash.New()
+	h.Write(canonical)
+	return verifySignature(key, info.SignatureMethod.Algorithm, signatureHash, h.Sum(nil), signature)
+}
+
+// checkSingleRoot returns an error if the document has content after its root element. Only the root element is
+// canonicalized and unmarshaled, so anything that follows it would be accepted without being signed.
+func checkSingleRoot(data []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	done := false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if done {
+				return errors.New("document has more than one root element")
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+			done = depth == 0
+		case xml.CharData:
+			if depth == 0 && len(bytes.TrimSpace(t)) != 0 {
+				return errors.New("document has text outside of the root element")
+			}
+		}
+	}
+	if !done {
+		return errors.New("document does not have a root element")
+	}
+	return nil
+}
+
+// VerifyData checks a signature created by a Signer's Sign method over data, such as the query string of a message
+// sent with the HTTP-Redirect binding. ECDSA signatures must be the concatenation of r and s.
+func VerifyData(data []byte, algorithm string, signature []byte, key crypto.PublicKey) error {
+	hash, ok := signatureHashes[algorithm]
+	if !ok {
+		return fmt.Errorf("unsupported signature algorithm %s", algorithm)
+	}
+	h := hash.New()
+	h.Write(data)
+	return verifySignature(key, algorithm, hash, h.Sum(nil), signature)
+}
+
+func verifySignature(key crypto.PublicKey, algorithm string, hash crypto.Hash, sum, signature []byte) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if !contains(SignatureAlgorithms(k), algorithm) {
+			return fmt.Errorf("signature algorithm %s cannot be used with an RSA key", algorithm)
+		}
+		return rsa.VerifyPKCS1v15(k, hash, sum, signature)
+	case *ecdsa.PublicKey:
+		if !contains(SignatureAlgorithms(k), algorithm) {
+			return fmt.Errorf("signature algorithm %s cannot be used with an ECDSA key", algorithm)
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("ECDSA signature has the wrong length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(k, sum, r, s) {
+			return errors.New("ECDSA verification failure")
+		}
+		return nil
+	}
+	return errors.New("signature verification requires an RSA or ECDSA key")
+}
+
+// isSignature matches signatures that are children of the root element
+func isSignature(path []xml.Name) bool {
+	return len(path) == 2 && path[1] == xml.Name{Space: namespace, Local: "Signature"}
+}
+
+// isSignedInfo matches the SignedInfo of a signature that is a child of the root element
+func isSignedInfo(path []xml.Name) bool {
+	return len(path) == 3 && isSignature(path[:2]) && path[2] == xml.Name{Space: namespace, Local: "SignedInfo"}
+}
@@ -0,0 +1,198 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dsig
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/xml"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type signedDocument struct {
+	XMLName   xml.Name `xml:"urn:test Document"`
+	ID        string   `xml:",attr"`
+	Signature *Signature
+	Value     string `xml:"urn:test Value"`
+}
+
+func signedXML(t testing.TB, key crypto.Signer) []byte {
+	signer, err := NewSigner(certificate(t, key), SignerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := &signedDocument{ID: "_1", Value: "test"}
+	if doc.Signature, err = signer.CreateSignature(doc); err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		data := signedXML(t, key)
+		assert.NoError(t, Verify(data, key.Public()))
+		tampered := strings.Replace(string(data), ">test<", ">changed<", 1)
+		assert.Error(t, Verify([]byte(tampered), key.Public()), "changes to the document should be detected")
+	}
+	assert.Error(t, Verify(signedXML(t, rsaKey), ecKey.Public()), "the wrong key should be rejected")
+	assert.Equal(t, ErrNoSignature, Verify([]byte(`<Document xmlns="urn:test" ID="_1"></Document>`), rsaKey.Public()))
+}
+
+func TestVerify_trailingContent(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := signedXML(t, key)
+	assert.NoError(t, Verify(append([]byte("<?xml version=\"1.0\"?>\n"), append(data, "\n"...)...), key.Public()),
+		"whitespace and a declaration outside of the root element should be accepted")
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"element", `<Document xmlns="urn:test" ID="_2"><Value>evil</Value></Document>`},
+		{"text", "evil"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wrapped := append(append([]byte{}, data...), tt.content...)
+			assert.Error(t, Verify(wrapped, key.Public()), "content after the signed element should be rejected")
+		})
+	}
+}
+
+func TestVerifyData(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("SAMLRequest=request&RelayState=state&SigAlg=alg")
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		signer, err := NewSigner(certificate(t, key), SignerOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		encoded, err := signer.Sign(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, VerifyData(data, signer.Algorithm(), signature, key.Public()))
+		assert.Error(t, VerifyData([]byte("SAMLRequest=other"), signer.Algorithm(), signature, key.Public()),
+			"changes to the data should be detected")
+		assert.Error(t, VerifyData(data, "urn:unknown", signature, key.Public()))
+	}
+	assert.Error(t, VerifyData(data, ECDSASHA256, make([]byte, 64), rsaKey.Public()),
+		"algorithms for other key types should be rejected")
+}
+
+func TestVerify_canonicalization(t *testing.T) {
+	// The namespaced attribute declares a prefix on the root element that Signature doesn't use
+	type document struct {
+		XMLName   xml.Name `xml:"urn:test Document"`
+		ID        string   `xml:",attr"`
+		Lang      string   `xml:"urn:lang lang,attr"`
+		Signature *Signature
+		Value     string `xml:"urn:test Value"`
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		options    SignerOptions
+		prefixList string
+	}{
+		{"exclusive", SignerOptions{}, ""},
+		{"inclusive", SignerOptions{Canonicalization: InclusiveC14N}, ""},
+		{"inclusive namespaces", SignerOptions{InclusiveNamespaces: []string{"#default", "_"}}, "#default _"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := NewSigner(certificate(t, key), tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			doc := &document{ID: "_1", Lang: "en", Value: "test"}
+			if doc.Signature, err = signer.CreateSignature(doc); err != nil {
+				t.Fatal(err)
+			}
+			info := doc.Signature.SignedInfo
+			algorithm := tt.options.Canonicalization
+			if algorithm == "" {
+				algorithm = ExclusiveC14N
+			}
+			assert.Equal(t, algorithm, info.CanonicalizationMethod.Algorithm)
+			if assert.Len(t, info.Reference.Transforms.Transform, 2) {
+				assert.Equal(t, info.CanonicalizationMethod, info.Reference.Transforms.Transform[1])
+			}
+			if tt.prefixList == "" {
+				assert.Nil(t, info.CanonicalizationMethod.InclusiveNamespaces)
+			} else if assert.NotNil(t, info.CanonicalizationMethod.InclusiveNamespaces) {
+				assert.Equal(t, tt.prefixList, info.CanonicalizationMethod.InclusiveNamespaces.PrefixList)
+			}
+			data, err := xml.Marshal(doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.NoError(t, Verify(data, key.Public()))
+			tampered := strings.Replace(string(data), ">test<", ">changed<", 1)
+			assert.Error(t, Verify([]byte(tampered), key.Public()), "changes to the document should be detected")
+		})
+	}
+}
+
+func BenchmarkVerify(b *testing.B) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := signedXML(b, key)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := Verify(data, key.Public()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
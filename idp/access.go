@@ -0,0 +1,109 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// AccessRule limits the client addresses that can reach an endpoint
+type AccessRule struct {
+	// Path of the endpoint without the base-path. A trailing * matches every path that starts with the rest.
+	Path string
+	// Addresses and CIDR blocks that can reach the endpoint, any address if it's empty
+	Allow []string
+	// Addresses and CIDR blocks that can't reach the endpoint, even if they're allowed
+	Deny []string
+}
+
+type accessRule struct {
+	path        string
+	prefix      bool
+	allow, deny []*net.IPNet
+}
+
+func (i *IDP) configureAccessRules() error {
+	rules := []AccessRule{}
+	if err := i.settings.UnmarshalKey("access-rules", &rules); err != nil {
+		return err
+	}
+	i.accessRules = nil
+	for _, rule := range rules {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("access-rules path %q must start with /", rule.Path)
+		}
+		allow, err := parseNetworks("access-rules allow", rule.Allow)
+		if err != nil {
+			return err
+		}
+		deny, err := parseNetworks("access-rules deny", rule.Deny)
+		if err != nil {
+			return err
+		}
+		i.accessRules = append(i.accessRules, accessRule{
+			path:   strings.TrimSuffix(rule.Path, "*"),
+			prefix: strings.HasSuffix(rule.Path, "*"),
+			allow:  allow,
+			deny:   deny,
+		})
+	}
+	return nil
+}
+
+func (rule accessRule) matches(requestPath string) bool {
+	if rule.prefix {
+		return strings.HasPrefix(requestPath, rule.path)
+	}
+	return requestPath == rule.path
+}
+
+// allows reports whether the rule lets the address through. Denied addresses are turned away even if they're allowed.
+func (rule accessRule) allows(ip net.IP) bool {
+	if containsIP(rule.deny, ip) {
+		return false
+	}
+	return len(rule.allow) == 0 || containsIP(rule.allow, ip)
+}
+
+// restrictAccess answers requests with 403 Forbidden when an access rule for the path doesn't allow the client's
+// address, which is the one reported by trusted proxies
+func (i *IDP) restrictAccess(h http.Handler) http.Handler {
+	if len(i.accessRules) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The router only serves clean paths, so others can't be used to get around a rule
+		requestPath := path.Clean(r.URL.Path)
+		ip := getIP(r)
+		for _, rule := range i.accessRules {
+			if rule.matches(requestPath) && !rule.allows(ip) {
+				log.WithFields(log.Fields{
+					"event": "access_denied",
+					"ip":    ip.String(),
+					"path":  r.URL.Path,
+				}).Warnf("denied %s access to %s", ip, r.URL.Path)
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
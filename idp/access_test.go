@@ -0,0 +1,82 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_restrictAccess(t *testing.T) {
+	viper.Set("trusted-proxies", []string{"192.0.2.1"})
+	defer viper.Set("trusted-proxies", nil)
+	viper.Set("access-rules", []AccessRule{
+		{Path: "/SAML2/SOAP/ArtifactResolution", Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.1.2.3"}},
+		{Path: "/ui/*", Deny: []string{"203.0.113.0/24"}},
+	})
+	defer viper.Set("access-rules", nil)
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	handler, _ := i.Handler()
+	tests := []struct {
+		name          string
+		method, path  string
+		remote, proxy string
+		forbidden     bool
+	}{
+		{"allowed", "POST", "/SAML2/SOAP/ArtifactResolution", "10.0.0.5", "", false},
+		{"not allowed", "POST", "/SAML2/SOAP/ArtifactResolution", "198.51.100.7", "", true},
+		{"denied", "POST", "/SAML2/SOAP/ArtifactResolution", "10.1.2.3", "", true},
+		{"unclean path", "POST", "/SAML2//SOAP/ArtifactResolution", "198.51.100.7", "", true},
+		{"allowed behind proxy", "POST", "/SAML2/SOAP/ArtifactResolution", "192.0.2.1", "10.0.0.5", false},
+		{"not allowed behind proxy", "POST", "/SAML2/SOAP/ArtifactResolution", "192.0.2.1", "198.51.100.7", true},
+		{"untrusted forwarded header", "POST", "/SAML2/SOAP/ArtifactResolution", "198.51.100.7", "10.0.0.5", true},
+		{"public endpoint", "GET", "/SAML2/Redirect/SSO", "198.51.100.7", "", false},
+		{"prefix", "GET", "/ui/login.html", "203.0.113.5", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.RemoteAddr = tt.remote + ":1234"
+			if tt.proxy != "" {
+				r.Header.Set("X-Forwarded-For", tt.proxy)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if tt.forbidden {
+				assert.Equal(t, http.StatusForbidden, w.Code)
+			} else {
+				assert.NotEqual(t, http.StatusForbidden, w.Code)
+			}
+		})
+	}
+}
+
+func TestIDP_configureAccessRules(t *testing.T) {
+	defer viper.Set("access-rules", nil)
+	for _, rule := range []AccessRule{
+		{Path: "/SAML2/SOAP/ArtifactResolution", Allow: []string{"10.0.0.0/33"}},
+		{Path: "/SAML2/SOAP/ArtifactResolution", Deny: []string{"example.com"}},
+		{Path: "SAML2/SOAP/ArtifactResolution", Allow: []string{"10.0.0.0/8"}},
+	} {
+		viper.Set("access-rules", []AccessRule{rule})
+		i := &IDP{settings: viper.GetViper()}
+		assert.Error(t, i.configureAccessRules(), rule.Path)
+	}
+}
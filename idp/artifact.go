@@ -15,24 +15,31 @@
 package idp
 
 import (
+	"bytes"
 	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/url"
 	"time"
 
+	"github.com/amdonov/lite-idp/dsig"
 	"github.com/amdonov/lite-idp/model"
 	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/store"
 	"github.com/golang/protobuf/proto"
 	log "github.com/sirupsen/logrus"
 )
 
 // DefaultArtifactResolveHandler is the default implementation for the artifact resolution handler. It can be used as is, wrapped in other handlers, or replaced completely.
+// Errors are returned as SOAP faults.
 func (i *IDP) DefaultArtifactResolveHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// We require transport authentication rather than message authentication
 		tlsCert, err := getCertFromRequest(r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+			writeSOAPFault(w, deniedFault(http.StatusUnauthorized, err))
 			return
 		}
 		log.Infof("received artifact resolution request from %s", getSubjectDN(tlsCert.Subject))
@@ -41,85 +48,161 @@ func (i *IDP) DefaultArtifactResolveHandler() http.HandlerFunc {
 }
 
 func (i *IDP) processArtifactResolutionRequest(w http.ResponseWriter, r *http.Request) {
-	decoder := xml.NewDecoder(r.Body)
+	if err := i.resolveArtifact(w, r); err != nil {
+		writeSOAPFault(w, err)
+	}
+}
+
+// resolveArtifact writes the ArtifactResponse for an ArtifactResolve
+func (i *IDP) resolveArtifact(w http.ResponseWriter, r *http.Request) error {
+	start := time.Now()
+	sp := ""
+	defer func() { i.metrics.artifactResolve.Observe(since(start), sp) }()
+	raw, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return clientFault(err)
+	}
+	i.debugMessage(messageReceived, raw)
 	var resolveEnv saml.ArtifactResolveEnvelope
-	err := decoder.Decode(&resolveEnv)
-	// TODO confirm appropriate error response for this service
+	if err = xml.Unmarshal(raw, &resolveEnv); err != nil {
+		return clientFault(err)
+	}
+	resolve := &saml.ArtifactResolve{}
+	message, err := unmarshalSOAPRequest(resolveEnv.Body.RawRequest, resolve)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return clientFault(err)
+	}
+	// Artifacts are only issued to known service providers
+	serviceProvider, ok := i.sps.get(resolve.Issuer)
+	if !ok {
+		return deniedFault(http.StatusForbidden, &UnknownServiceProviderError{resolve.Issuer})
+	}
+	sp = serviceProvider.EntityID
+	recordServiceProvider(r, sp)
+	if err := verifyArtifactResolveSignature(serviceProvider, message); err != nil {
+		i.metrics.signatureFailures.Inc(sp)
+		return deniedFault(http.StatusForbidden, err)
+	}
+	if err := i.checkIssueInstant(resolve.IssueInstant); err != nil {
+		return deniedFault(http.StatusBadRequest, err)
+	}
+	// Artifacts can only be resolved once
+	data, err := store.Take(i.ArtifactCache, resolve.Artifact)
+	if err == store.ErrNotFound {
+		return deniedFault(http.StatusBadRequest, errors.New("artifact is unknown or was already resolved"))
 	}
-
-	artifact := resolveEnv.Body.ArtifactResolve.Artifact
-	data, err := i.TempCache.Get(artifact)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return err
 	}
 	artifactResponse := &model.ArtifactResponse{}
-	err = proto.Unmarshal(data, artifactResponse)
-	// TODO confirm appropriate error response for this service
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if err = proto.Unmarshal(data, artifactResponse); err != nil {
+		return err
+	}
+	// Only the service provider the artifact was sent to can resolve it
+	if artifactResponse.Request.Issuer != serviceProvider.EntityID {
+		return deniedFault(http.StatusForbidden, fmt.Errorf("%s tried to resolve an artifact issued to %s",
+			serviceProvider.EntityID, artifactResponse.Request.Issuer))
 	}
 	now := time.Now()
-	response := i.makeAuthnResponse(artifactResponse.Request, artifactResponse.User)
-	artResponseEnv := saml.ArtifactResponseEnvelope{
-		Body: saml.ArtifactResponseBody{
-			ArtifactResponse: saml.ArtifactResponse{
-				StatusResponseType: saml.StatusResponseType{
-					ID:           saml.NewID(),
-					IssueInstant: now,
-					InResponseTo: resolveEnv.Body.ArtifactResolve.ID,
-					Version:      "2.0",
-					Issuer:       saml.NewIssuer(i.entityID),
-					Status: &saml.Status{
-						StatusCode: saml.StatusCode{
-							Value: "urn:oasis:names:tc:SAML:2.0:status:Success",
-						},
-					},
+	// Failures found while the assertion is built, such as by an AssertionDecorator, are reported with a status
+	status := artifactStatus(artifactResponse)
+	var response *saml.Response
+	if status == nil {
+		if response, err = i.makeAuthnResponse(artifactResponse.Request, artifactResponse.User); err != nil {
+			if status = failureStatus(err); status == nil {
+				return err
+			}
+			log.Warnf("sending %s status to %s: %v", status.StatusCode.StatusCode.Value, serviceProvider.EntityID, err)
+		}
+	}
+	if status != nil {
+		response = i.makeStatusResponse(artifactResponse.Request, status)
+	}
+	if err = i.signResponse(r.Context(), response, artifactResponse.Request.Issuer); err != nil {
+		return err
+	}
+	artResponse := saml.ArtifactResponse{
+		StatusResponseType: saml.StatusResponseType{
+			ID:           saml.NewID(),
+			IssueInstant: now,
+			InResponseTo: resolve.ID,
+			Version:      "2.0",
+			Issuer:       i.issuer(resolve.Issuer),
+			Status: &saml.Status{
+				StatusCode: saml.StatusCode{
+					Value: "urn:oasis:names:tc:SAML:2.0:status:Success",
 				},
-				Response: *response,
 			},
 		},
+		Response: *response,
+	}
+	// The ArtifactResponse is signed as well as the Response it carries, so the service provider can tell the
+	// artifact was resolved by the IdP
+	if artResponse.Signature, err = i.signerFor(serviceProvider.EntityID).CreateSignature(artResponse); err != nil {
+		return err
 	}
+	artResponseEnv := saml.ArtifactResponseEnvelope{
+		Body: saml.ArtifactResponseBody{
+			ArtifactResponse: artResponse,
+		},
+	}
+	// Encode before writing so failures can still be reported as faults
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	if err = xml.NewEncoder(&b).Encode(artResponseEnv); err != nil {
+		return err
+	}
+	i.debugMessage(messageSent, b.Bytes())
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	if _, err = w.Write(b.Bytes()); err != nil {
+		log.Errorf("failed to write artifact response: %v", err)
+	}
+	return nil
+}
 
-	signature, err := i.signer.CreateSignature(response.Assertion)
-	// TODO confirm appropriate error response for this service
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-	response.Assertion.Signature = signature
-	// TODO handle these errors. Probably can't do anything besides log, as we've already started to write the
-	// response.
-	_, err = w.Write([]byte(xml.Header))
-	encoder := xml.NewEncoder(w)
-	err = encoder.Encode(artResponseEnv)
-	err = encoder.Flush()
+// verifyArtifactResolveSignature checks the enveloped signature on an ArtifactResolve with the service provider's
+// certificate. Unsigned requests are accepted from service providers that don't require ArtifactResolveSigned.
+func verifyArtifactResolveSignature(sp *ServiceProvider, message []byte) error {
+	err := dsig.Verify(message, sp.publicKey)
+	if err == dsig.ErrNoSignature && !*sp.ArtifactResolveSigned {
+		return nil
+	}
+	return err
 }
 
+// sendArtifactResponse saves the user and request under a new artifact, which the browser takes to the assertion
+// consumer service. The service provider resolves it at the artifact resolution service for the Response.
 func (i *IDP) sendArtifactResponse(authRequest *model.AuthnRequest, user *model.User,
 	w http.ResponseWriter, r *http.Request) error {
+	return i.redirectArtifact(&model.ArtifactResponse{
+		User:    user,
+		Request: authRequest,
+	}, w, r)
+}
+
+// redirectArtifact saves the response under a new artifact and sends the browser to the request's assertion
+// consumer service with it
+func (i *IDP) redirectArtifact(response *model.ArtifactResponse, w http.ResponseWriter, r *http.Request) error {
+	authRequest := response.Request
 	target, err := url.Parse(authRequest.AssertionConsumerServiceURL)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
 	}
-	parameters := url.Values{}
 	artifact := getArtifact(i.entityID)
 	// Store required data in the cache
-	response := &model.ArtifactResponse{
-		User:    user,
-		Request: authRequest,
-	}
 	data, err := proto.Marshal(response)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return err
+	}
+	if err = tracedSet(r.Context(), "artifact", i.ArtifactCache, artifact, data); err != nil {
+		return err
+	}
+	// Keep any parameters the assertion consumer service's location already has
+	parameters := target.Query()
+	parameters.Set("SAMLart", artifact)
+	if authRequest.RelayState != "" {
+		parameters.Set("RelayState", authRequest.RelayState)
 	}
-	i.TempCache.Set(artifact, data)
-	parameters.Add("SAMLart", artifact)
-	parameters.Add("RelayState", authRequest.RelayState)
 	target.RawQuery = parameters.Encode()
 	// Don't send temporary redirect. We don't want the post resent
 	http.Redirect(w, r, target.String(), http.StatusFound)
@@ -15,46 +15,214 @@
 package idp
 
 import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/amdonov/lite-idp/dsig"
 	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/store"
 	"github.com/golang/protobuf/proto"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
+// resolverEntityID issued the ArtifactResolve in testdata, which is signed with the key of the service provider
+// in sp-metadata.xml
+const resolverEntityID = "https://www.jw.dev.gfclab.com/user"
+
+// getTestIDPWithResolver registers the service provider from testdata and one with its certificate for the
+// ArtifactResolve in testdata
+func getTestIDPWithResolver(t *testing.T, i *IDP, signed bool) *httptest.Server {
+	base := &IDP{}
+	getTestIDPWithSP(t, base).Close()
+	dex, _ := base.sps.get("dex")
+	resolver := *dex
+	resolver.EntityID = resolverEntityID
+	resolver.ArtifactResolveSigned = &signed
+	viper.Set("sps", []ServiceProvider{*dex, resolver})
+	return getTestIDP(t, i)
+}
+
+// cacheArtifact stores an artifact issued to the service provider
+func cacheArtifact(t *testing.T, i *IDP, artifact, entityID string) {
+	data, err := proto.Marshal(&model.ArtifactResponse{
+		Request: &model.AuthnRequest{Issuer: entityID},
+		User:    &model.User{Name: "joe"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = i.ArtifactCache.Set(artifact, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestIDP_DefaultArtifactResolveHandler(t *testing.T) {
+	// The request was captured in 2018
+	viper.Set("clock-skew", "876000h")
+	defer viper.Set("clock-skew", "3m")
+	defer viper.Set("sps", nil)
 	i := &IDP{}
 	i.ArtifactResolveHandler = i.processArtifactResolutionRequest
-	ts := getTestIDP(t, i)
+	ts := getTestIDPWithResolver(t, i, true)
 	defer ts.Close()
 	in, err := os.Open(filepath.Join("testdata", "artifact-resolve-request.xml"))
 	if err != nil {
 		t.Fatal(err)
 	}
 	// Need to cache user before attempting an artifact resolve
-	req := &model.ArtifactResponse{
-		Request: &model.AuthnRequest{},
-		User:    &model.User{},
-	}
-	data, err := proto.Marshal(req)
+	cacheArtifact(t, i, "123456", resolverEntityID)
+	resp, err := ts.Client().Post(ts.URL+viper.GetString("artifact-service-path"), "text/xml", in)
 	if err != nil {
 		t.Fatal(err)
 	}
-	i.TempCache.Set("123456", data)
-	resp, err := ts.Client().Post(ts.URL+viper.GetString("artifact-service-path"), "text/xml", in)
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode, "failed to resolve artifact")
+	var env struct {
+		Body struct {
+			ArtifactResponse string `xml:",innerxml"`
+		}
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&env); err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, dsig.Verify([]byte(env.Body.ArtifactResponse), i.TLSConfig.Certificates[0].Leaf.PublicKey),
+		"the ArtifactResponse should be signed")
+
+	// A second resolution of the same artifact must fail
+	if in, err = os.Open(filepath.Join("testdata", "artifact-resolve-request.xml")); err != nil {
+		t.Fatal(err)
+	}
+	resp, err = ts.Client().Post(ts.URL+viper.GetString("artifact-service-path"), "text/xml", in)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer resp.Body.Close()
-	assert.Equal(t, 200, resp.StatusCode, "failed to resolve artifact")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "artifacts should only be resolved once")
+	_, err = i.ArtifactCache.Get("123456")
+	assert.Equal(t, store.ErrNotFound, err)
+}
+
+func TestIDP_resolveArtifact_signatures(t *testing.T) {
+	defer viper.Set("sps", nil)
+	i := &IDP{}
+	getTestIDPWithResolver(t, i, true).Close()
+	resolve := func(issuer, artifact string, sign bool, tamper func([]byte) []byte) *httptest.ResponseRecorder {
+		env := saml.ArtifactResolveEnvelope{Body: saml.ArtifactResolveBody{ArtifactResolve: saml.ArtifactResolve{
+			RequestAbstractType: saml.RequestAbstractType{
+				ID:           saml.NewID(),
+				Version:      "2.0",
+				IssueInstant: time.Now(),
+				Issuer:       issuer,
+			},
+			Artifact: artifact,
+		}}}
+		if sign {
+			signature, err := i.signer.CreateSignature(env.Body.ArtifactResolve)
+			if err != nil {
+				t.Fatal(err)
+			}
+			env.Body.ArtifactResolve.Signature = signature
+		}
+		data, err := xml.Marshal(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tamper != nil {
+			data = tamper(data)
+		}
+		w := httptest.NewRecorder()
+		i.processArtifactResolutionRequest(w, httptest.NewRequest("POST", "/", bytes.NewReader(data)))
+		return w
+	}
+
+	// The service provider in testdata shares the IdP's key
+	cacheArtifact(t, i, "signed", "dex")
+	assert.Equal(t, http.StatusOK, resolve("dex", "signed", true, nil).Code)
+
+	cacheArtifact(t, i, "unsigned", "dex")
+	assert.Equal(t, http.StatusOK, resolve("dex", "unsigned", false, nil).Code,
+		"unsigned requests are accepted unless the service provider is required to sign")
+
+	cacheArtifact(t, i, "required", resolverEntityID)
+	w := resolve(resolverEntityID, "required", false, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "<faultcode>soap:Client</faultcode>")
+	_, err := i.ArtifactCache.Get("required")
+	assert.NoError(t, err, "rejected requests shouldn't use up the artifact")
+
+	w = resolve("dex", "signed-tampered", true, func(data []byte) []byte {
+		return bytes.Replace(data, []byte("signed-tampered"), []byte("required"), 1)
+	})
+	assert.Equal(t, http.StatusForbidden, w.Code, "the signature must cover the artifact")
+
+	w = resolve("dex", "required", true, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code, "artifacts can only be resolved by the service provider they were issued to")
+	assert.Contains(t, w.Body.String(), "artifact issued to "+resolverEntityID)
+
+	assert.Equal(t, http.StatusForbidden, resolve("https://unknown.example.com", "signed", false, nil).Code)
+
+	// Another message signed by the service provider can't vouch for an ArtifactResolve after it
+	loginReq := newTestAuthnRequest()
+	signature, err := i.signer.CreateSignature(loginReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginReq.Signature = signature
+	signed, err := xml.Marshal(loginReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacheArtifact(t, i, "wrapped", "dex")
+	w = resolve("dex", "wrapped", false, func(data []byte) []byte {
+		return bytes.Replace(data, []byte("<ArtifactResolve"), append(signed, "<ArtifactResolve"...), 1)
+	})
+	assert.Equal(t, http.StatusBadRequest, w.Code, "the signed element must be the ArtifactResolve")
+	_, err = i.ArtifactCache.Get("wrapped")
+	assert.NoError(t, err, "rejected requests shouldn't use up the artifact")
 }
 
 func TestIDP_sendArtifactResponse(t *testing.T) {
 	i := &IDP{}
-	getTestIDP(t, i)
-	i.sendArtifactResponse(&model.AuthnRequest{}, &model.User{}, httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+	getTestIDP(t, i).Close()
+	request := &model.AuthnRequest{ID: "request", AssertionConsumerServiceURL: "https://sp.example.com/acs?tenant=a"}
+	w := httptest.NewRecorder()
+	if err := i.sendArtifactResponse(request, &model.User{Name: "joe"}, w, httptest.NewRequest("GET", "/test", nil)); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusFound, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "a", location.Query().Get("tenant"), "the location's parameters should be kept")
+	_, ok := location.Query()["RelayState"]
+	assert.False(t, ok, "RelayState is left out when the request doesn't have one")
+	artifact := location.Query().Get("SAMLart")
+	raw, err := base64.StdEncoding.DecodeString(artifact)
+	if assert.NoError(t, err) && assert.Len(t, raw, 44) {
+		assert.Equal(t, []byte{0, 4, 0, artifactResolutionIndex}, raw[:4], "type code and endpoint index")
+		source := sha1.Sum([]byte(i.entityID))
+		assert.Equal(t, source[:], raw[4:24], "source ID")
+	}
+	data, err := i.ArtifactCache.Get(artifact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &model.ArtifactResponse{}
+	if assert.NoError(t, proto.Unmarshal(data, response)) {
+		assert.Equal(t, "joe", response.User.Name)
+		assert.Equal(t, "request", response.Request.ID)
+	}
+	assert.NotEqual(t, artifact, getArtifact(i.entityID), "message handles are random")
 }
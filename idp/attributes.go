@@ -15,10 +15,21 @@
 package idp
 
 import (
+	"errors"
+	"sort"
+
 	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
 	"github.com/spf13/viper"
 )
 
+// NameFormats of attributes in assertions
+const (
+	attrNameFormatBasic       = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+	attrNameFormatURI         = "urn:oasis:names:tc:SAML:2.0:attrname-format:uri"
+	attrNameFormatUnspecified = "urn:oasis:names:tc:SAML:2.0:attrname-format:unspecified"
+)
+
 // AttributeSource allows implementations to retrieve user attributes from any upstream source such as a database, LDAP, or Web service.
 type AttributeSource interface {
 	AddAttributes(*model.User, *model.AuthnRequest) error
@@ -43,20 +54,158 @@ func (ss *simpleSource) AddAttributes(user *model.User, _ *model.AuthnRequest) e
 
 // NewAttributeSource provides a default SAML attribute source that reads user information from the users key in the viper configuration
 func NewAttributeSource() (AttributeSource, error) {
+	return newAttributeSource(viper.GetViper())
+}
+
+func newAttributeSource(settings *viper.Viper) (AttributeSource, error) {
 	userAttributes := []UserAttributes{}
-	err := viper.UnmarshalKey("users", &userAttributes)
+	err := settings.UnmarshalKey("users", &userAttributes)
 	if err != nil {
 		return nil, err
 	}
 	users := make(map[string][]*model.Attribute)
 	for i := range userAttributes {
-		user := userAttributes[i]
-		atts := []*model.Attribute{}
-		for key, value := range user.Attributes {
-			att := &model.Attribute{Name: key, Value: value}
-			atts = append(atts, att)
-		}
-		users[user.Name] = atts
+		users[userAttributes[i].Name] = configuredAttributes(userAttributes[i].Attributes)
 	}
 	return &simpleSource{users}, nil
 }
+
+// configuredAttributes converts attributes from the configuration. They're listed by name, so assertions don't
+// depend on the order of map iteration.
+func configuredAttributes(attributes map[string][]string) []*model.Attribute {
+	names := make([]string, 0, len(attributes))
+	for key := range attributes {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	atts := []*model.Attribute{}
+	for _, key := range names {
+		atts = append(atts, &model.Attribute{Name: key, Value: attributes[key]})
+	}
+	return atts
+}
+
+// AttributeDefinition describes how an attribute from the attribute sources is named in assertions
+type AttributeDefinition struct {
+	// Name of the attribute provided by the attribute sources
+	Attribute string
+	// Name in the assertion, the attribute's own name if it's empty
+	Name string
+	// basic, uri, unspecified, or a NameFormat URI. Defaults to basic.
+	NameFormat string
+	// Optional FriendlyName in the assertion
+	FriendlyName string
+}
+
+// attributeDefinitions indexes definitions by the attribute they apply to. An attribute
+// with several definitions is released under each of them.
+type attributeDefinitions map[string][]AttributeDefinition
+
+func newAttributeDefinitions(definitions []AttributeDefinition) (attributeDefinitions, error) {
+	index := attributeDefinitions{}
+	for _, def := range definitions {
+		if def.Attribute == "" {
+			return nil, errors.New("attribute definitions must name an attribute")
+		}
+		if def.Name == "" {
+			def.Name = def.Attribute
+		}
+		switch def.NameFormat {
+		case "", "basic":
+			def.NameFormat = attrNameFormatBasic
+		case "uri":
+			def.NameFormat = attrNameFormatURI
+		case "unspecified":
+			def.NameFormat = attrNameFormatUnspecified
+		}
+		index[def.Attribute] = append(index[def.Attribute], def)
+	}
+	return index, nil
+}
+
+// configureAttributeDefinitions reads the attribute-definitions and attribute-order used for service providers without their own
+func (i *IDP) configureAttributeDefinitions() error {
+	definitions := []AttributeDefinition{}
+	if err := i.settings.UnmarshalKey("attribute-definitions", &definitions); err != nil {
+		return err
+	}
+	index, err := newAttributeDefinitions(definitions)
+	if err != nil {
+		return err
+	}
+	i.attributeDefinitions = index
+	i.attributeOrder = i.settings.GetStringSlice("attribute-order")
+	return nil
+}
+
+// orderAttributes puts the attributes named in order first, in the order they're listed. The others follow sorted by
+// Name. Attributes with the same Name keep their relative order. Nothing is reordered if order is empty.
+func orderAttributes(atts []saml.Attribute, order []string) {
+	if len(order) == 0 {
+		return
+	}
+	rank := make(map[string]int, len(order))
+	for n, name := range order {
+		if _, ok := rank[name]; !ok {
+			rank[name] = n
+		}
+	}
+	sort.SliceStable(atts, func(a, b int) bool {
+		rankA, listedA := rank[atts[a].Name]
+		rankB, listedB := rank[atts[b].Name]
+		switch {
+		case listedA && listedB:
+			return rankA < rankB
+		case listedA != listedB:
+			return listedA
+		}
+		return atts[a].Name < atts[b].Name
+	})
+}
+
+// attributeStatement returns the user's attributes that may be released to the service provider named for it. Its own definition of an attribute
+// takes precedence over attribute-definitions, and attributes without a definition keep their name with the basic format.
+// Attributes are in the order of the attribute sources unless the service provider's AttributeOrder or attribute-order is set.
+func (i *IDP) attributeStatement(user *model.User, entityID string) *saml.AttributeStatement {
+	released := i.releasedAttributes(user, entityID)
+	if len(released) == 0 {
+		return nil
+	}
+	var spDefinitions attributeDefinitions
+	order := i.attributeOrder
+	if sp, ok := i.sps.get(entityID); ok {
+		spDefinitions = sp.attributeDefinitions
+		if sp.AttributeOrder != nil {
+			order = sp.AttributeOrder
+		}
+	}
+	stmt := &saml.AttributeStatement{}
+	for _, att := range released {
+		definitions, ok := spDefinitions[att.Name]
+		if !ok {
+			definitions, ok = i.attributeDefinitions[att.Name]
+		}
+		if !ok {
+			definitions = []AttributeDefinition{{
+				Attribute:    att.Name,
+				Name:         att.Name,
+				NameFormat:   attrNameFormatBasic,
+				FriendlyName: att.Name,
+			}}
+		}
+		values := make([]saml.AttributeValue, len(att.Value))
+		for n := range att.Value {
+			values[n] = saml.AttributeValue{Value: att.Value[n]}
+		}
+		for _, def := range definitions {
+			stmt.Attribute = append(stmt.Attribute, saml.Attribute{
+				FriendlyName:   def.FriendlyName,
+				Name:           def.Name,
+				NameFormat:     def.NameFormat,
+				AttributeValue: values,
+			})
+		}
+	}
+	orderAttributes(stmt.Attribute, order)
+	return stmt
+}
@@ -15,11 +15,13 @@
 package idp
 
 import (
+	"encoding/xml"
 	"os"
 	"path/filepath"
 	"testing"
 
 	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
@@ -43,5 +45,98 @@ func TestNewAttributeSource(t *testing.T) {
 	if err = attSrc.AddAttributes(user, nil); err != nil {
 		t.Fatal(err)
 	}
-	assert.Equal(t, 3, len(user.Attributes), "expected 3 attributes")
+	if assert.Equal(t, 3, len(user.Attributes), "expected 3 attributes") {
+		for n, name := range []string{"FirstName", "FullName", "SurName"} {
+			assert.Equal(t, name, user.Attributes[n].Name, "attributes should be sorted by name")
+		}
+	}
+}
+
+func TestIDP_attributeStatement(t *testing.T) {
+	eppn := AttributeDefinition{
+		Attribute:    "uid",
+		Name:         "urn:oid:1.3.6.1.4.1.5923.1.1.1.6",
+		NameFormat:   "uri",
+		FriendlyName: "eduPersonPrincipalName",
+	}
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.sps.get("dex")
+	sps := []ServiceProvider{*dex}
+	sps[0].AttributeDefinitions = []AttributeDefinition{{Attribute: "uid"}}
+	viper.Set("sps", sps)
+	viper.Set("attribute-definitions", []AttributeDefinition{eppn, {Attribute: "mail", Name: "urn:oid:0.9.2342.19200300.100.1.3", NameFormat: "uri"}})
+	defer viper.Set("sps", nil)
+	defer viper.Set("attribute-definitions", nil)
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	user := &model.User{Name: "joe", Attributes: []*model.Attribute{
+		{Name: "uid", Value: []string{"joe"}},
+		{Name: "mail", Value: []string{"joe@example.com"}},
+		{Name: "sn", Value: []string{"Smith"}},
+	}}
+	values := func(v string) []saml.AttributeValue { return []saml.AttributeValue{{Value: v}} }
+
+	assert.Equal(t, []saml.Attribute{
+		{Name: eppn.Name, NameFormat: attrNameFormatURI, FriendlyName: eppn.FriendlyName, AttributeValue: values("joe")},
+		{Name: "urn:oid:0.9.2342.19200300.100.1.3", NameFormat: attrNameFormatURI, AttributeValue: values("joe@example.com")},
+		{Name: "sn", NameFormat: attrNameFormatBasic, FriendlyName: "sn", AttributeValue: values("Smith")},
+	}, i.attributeStatement(user, "other").Attribute, "attribute-definitions should rename attributes")
+
+	statement := i.attributeStatement(user, "dex")
+	assert.Equal(t, saml.Attribute{Name: "uid", NameFormat: attrNameFormatBasic, AttributeValue: values("joe")},
+		statement.Attribute[0], "the service provider's definition should take precedence")
+	assert.Equal(t, "urn:oid:0.9.2342.19200300.100.1.3", statement.Attribute[1].Name)
+}
+
+func TestIDP_attributeStatement_order(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.sps.get("dex")
+	sps := []ServiceProvider{*dex}
+	sps[0].AttributeOrder = []string{"sn", "uid"}
+	viper.Set("sps", sps)
+	viper.Set("attribute-order", []string{"mail"})
+	defer viper.Set("sps", nil)
+	defer viper.Set("attribute-order", nil)
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	user := &model.User{Name: "joe", Attributes: []*model.Attribute{
+		{Name: "uid", Value: []string{"joe"}},
+		{Name: "sn", Value: []string{"Smith"}},
+		{Name: "mail", Value: []string{"joe@example.com"}},
+		{Name: "givenName", Value: []string{"Joe"}},
+	}}
+	names := func(stmt *saml.AttributeStatement) []string {
+		names := []string{}
+		for _, att := range stmt.Attribute {
+			names = append(names, att.Name)
+		}
+		return names
+	}
+	assert.Equal(t, []string{"mail", "givenName", "sn", "uid"}, names(i.attributeStatement(user, "other")),
+		"listed attributes should come first and the others sorted by name")
+	assert.Equal(t, []string{"sn", "uid", "givenName", "mail"}, names(i.attributeStatement(user, "dex")),
+		"the service provider's order should take precedence")
+
+	first, err := xml.Marshal(i.attributeStatement(user, "other"))
+	if assert.NoError(t, err) {
+		user.Attributes[0], user.Attributes[3] = user.Attributes[3], user.Attributes[0]
+		second, err := xml.Marshal(i.attributeStatement(user, "other"))
+		assert.NoError(t, err)
+		assert.Equal(t, string(first), string(second), "the statement shouldn't depend on the order of the sources")
+	}
+}
+
+func Test_newAttributeDefinitions(t *testing.T) {
+	_, err := newAttributeDefinitions([]AttributeDefinition{{Name: "urn:oid:2.5.4.4"}})
+	assert.Error(t, err, "definitions need an attribute")
+	index, err := newAttributeDefinitions([]AttributeDefinition{
+		{Attribute: "mail", Name: "urn:oid:0.9.2342.19200300.100.1.3", NameFormat: "uri"},
+		{Attribute: "mail", NameFormat: "urn:example:format"},
+	})
+	if assert.NoError(t, err) && assert.Len(t, index["mail"], 2, "attributes can be released under several names") {
+		assert.Equal(t, "mail", index["mail"][1].Name)
+		assert.Equal(t, "urn:example:format", index["mail"][1].NameFormat)
+	}
 }
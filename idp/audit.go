@@ -12,8 +12,25 @@ const (
 	CertificateLogin LoginType = iota
 	// PasswordLogin user logged in via password
 	PasswordLogin
+	// TOTPLogin user entered a one-time code after their password
+	TOTPLogin
+	// KerberosLogin user's browser sent a Kerberos ticket
+	KerberosLogin
 )
 
+// method names the login type in metrics and the audit log
+func (t LoginType) method() string {
+	switch t {
+	case CertificateLogin:
+		return "certificate"
+	case TOTPLogin:
+		return "totp"
+	case KerberosLogin:
+		return "kerberos"
+	}
+	return "password"
+}
+
 // Auditor is responsible for capturing login events
 type Auditor interface {
 	LogSuccess(*model.User, *model.AuthnRequest, LoginType)
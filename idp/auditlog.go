@@ -0,0 +1,294 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// events written to the audit log
+	auditAuthentication = "authentication"
+	auditAssertion      = "assertion"
+)
+
+// auditEvent is written to the audit log as a line of JSON. The correlation ID links the authentication for a
+// request to the assertion issued for it.
+type auditEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+	// success, failure, error, or throttled for authentications
+	Result          string `json:"result,omitempty"`
+	User            string `json:"user,omitempty"`
+	IP              string `json:"ip,omitempty"`
+	ServiceProvider string `json:"sp,omitempty"`
+	Method          string `json:"method,omitempty"`
+	CorrelationID   string `json:"correlation_id,omitempty"`
+	RequestID       string `json:"request_id,omitempty"`
+	ResponseID      string `json:"response_id,omitempty"`
+	AssertionID     string `json:"assertion_id,omitempty"`
+	SessionIndex    string `json:"session_index,omitempty"`
+	AuthnContext    string `json:"authn_context,omitempty"`
+	// service providers a proxy sent the request for
+	RequesterIDs []string `json:"requester_ids,omitempty"`
+}
+
+type auditLogConfig struct {
+	// a file, syslog for the local syslog daemon, or syslog://host:port for a remote one over TCP
+	destination string
+	maxSize     int64
+	maxBackups  int
+	sync        bool
+}
+
+// auditLog writes each event before the request continues, so events aren't buffered where a crash would lose
+// them. It's shared with reloaded IDPs that write to the same destination and closed when the last one is.
+type auditLog struct {
+	config auditLogConfig
+	mu     sync.Mutex
+	out    io.WriteCloser
+	refs   int
+}
+
+// configureAuditLog opens the audit-log, or keeps using the previous configuration's if its settings didn't change
+func (i *IDP) configureAuditLog() error {
+	config := auditLogConfig{
+		destination: i.settings.GetString("audit-log"),
+		maxSize:     i.settings.GetInt64("audit-log-max-size"),
+		maxBackups:  i.settings.GetInt("audit-log-max-backups"),
+		sync:        i.settings.GetBool("audit-log-sync"),
+	}
+	i.auditRequired = i.settings.GetBool("audit-log-required")
+	if config.maxSize < 0 || config.maxBackups < 0 {
+		return errors.New("audit-log-max-size and audit-log-max-backups can't be negative")
+	}
+	previous := i.auditLog
+	i.auditLog = nil
+	if previous != nil && previous.config == config {
+		i.auditLog = previous.retain()
+		return nil
+	}
+	if config.destination == "" {
+		if i.auditRequired {
+			return errors.New("audit-log-required is set, but audit-log isn't")
+		}
+		return nil
+	}
+	out, err := openAuditDestination(config)
+	if err != nil {
+		return fmt.Errorf("failed to open audit-log: %v", err)
+	}
+	i.auditLog = &auditLog{config: config, out: out, refs: 1}
+	return nil
+}
+
+func openAuditDestination(config auditLogConfig) (io.WriteCloser, error) {
+	switch {
+	case config.destination == "syslog":
+		return dialSyslog("", "")
+	case strings.HasPrefix(config.destination, "syslog://"):
+		return dialSyslog("tcp", strings.TrimPrefix(config.destination, "syslog://"))
+	}
+	return openRotatingFile(config.destination, config.maxSize, config.maxBackups, config.sync)
+}
+
+func (l *auditLog) retain() *auditLog {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refs++
+	return l
+}
+
+func (l *auditLog) write(event auditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.refs == 0 {
+		return errors.New("audit log is closed")
+	}
+	_, err = l.out.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the destination once every IDP that shares the audit log has closed it
+func (l *auditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.refs == 0 {
+		return nil
+	}
+	l.refs--
+	if l.refs > 0 {
+		return nil
+	}
+	return l.out.Close()
+}
+
+// audit writes the event to the audit-log if there is one. Events that can't be written are logged and counted in
+// lite_idp_audit_failures_total, so they're never lost without a trace.
+func (i *IDP) audit(event auditEvent) error {
+	if i.auditLog == nil {
+		return nil
+	}
+	event.Time = time.Now().UTC()
+	err := i.auditLog.write(event)
+	if err != nil {
+		i.metrics.auditFailures.Inc(event.Event)
+		data, _ := json.Marshal(event)
+		log.WithField("event", "audit_failed").Errorf("failed to write to the audit log: %v: %s", err, data)
+	}
+	return err
+}
+
+// recordAuthentication counts the login attempt and writes it to the audit log. The name is empty if the user
+// couldn't be identified, such as when a Kerberos ticket isn't valid.
+func (i *IDP) recordAuthentication(r *http.Request, req *model.AuthnRequest, name string, loginType LoginType, result string) {
+	i.countAuthentication(req, loginType, result)
+	event := auditEvent{
+		Event:  auditAuthentication,
+		Result: result,
+		User:   name,
+		IP:     getIP(r).String(),
+		Method: loginType.method(),
+	}
+	if req != nil {
+		event.ServiceProvider = req.Issuer
+		event.CorrelationID = req.CorrelationID
+		event.RequestID = req.ID
+		event.RequesterIDs = req.RequesterIDs
+	}
+	i.audit(event)
+}
+
+// auditAssertion writes the assertion in the response to the audit log. The assertion can't be sent if that fails
+// and audit-log-required is set.
+func (i *IDP) auditAssertion(request *model.AuthnRequest, user *model.User, response *saml.Response) error {
+	event := auditEvent{
+		Event:           auditAssertion,
+		Result:          resultSuccess,
+		User:            user.Name,
+		IP:              user.IP,
+		ServiceProvider: request.Issuer,
+		CorrelationID:   request.CorrelationID,
+		RequestID:       request.ID,
+		ResponseID:      response.ID,
+		AssertionID:     response.Assertion.ID,
+		AuthnContext:    user.Context,
+		RequesterIDs:    request.RequesterIDs,
+	}
+	if statement := response.Assertion.AuthnStatement; statement != nil {
+		event.SessionIndex = statement.SessionIndex
+	}
+	if err := i.audit(event); err != nil && i.auditRequired {
+		return fmt.Errorf("assertion for %s withheld because it couldn't be audited: %v", request.Issuer, err)
+	}
+	return nil
+}
+
+// rotatingFile appends to a file and renames it to path.1 when it would grow past maxSize, shifting older files
+// up to path.maxBackups and removing the oldest
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	sync       bool
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int, sync bool) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups, sync: sync}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// rotate starts a new file. The current one is reopened if it can't be renamed, so events are still written.
+func (f *rotatingFile) rotate() error {
+	err := f.file.Close()
+	if err != nil {
+		// Keep going, since the file may still be renamed and a new one opened
+		log.Errorf("failed to close the audit log: %v", err)
+	}
+	if f.maxBackups == 0 {
+		err = os.Remove(f.path)
+	} else {
+		for n := f.maxBackups - 1; n > 0 && err == nil; n-- {
+			if err = os.Rename(fmt.Sprintf("%s.%d", f.path, n), fmt.Sprintf("%s.%d", f.path, n+1)); os.IsNotExist(err) {
+				err = nil
+			}
+		}
+		if err == nil {
+			err = os.Rename(f.path, f.path+".1")
+		}
+	}
+	if err != nil {
+		log.Errorf("failed to rotate the audit log: %v", err)
+	}
+	return f.open()
+}
+
+// Write appends a whole event, rotating first if the file would grow too large, and flushes it to disk if sync is set
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if f.sync {
+		err = f.file.Sync()
+	}
+	return n, err
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
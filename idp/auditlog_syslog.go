@@ -0,0 +1,28 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !windows && !plan9
+
+package idp
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// dialSyslog connects to the local syslog daemon if network and address are empty. Events are logged with the
+// auth facility so they can be kept apart from other messages.
+func dialSyslog(network, address string) (io.WriteCloser, error) {
+	return syslog.Dial(network, address, syslog.LOG_AUTH|syslog.LOG_INFO, "lite-idp")
+}
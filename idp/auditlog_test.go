@@ -0,0 +1,156 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func readAuditLog(t *testing.T, file string) []auditEvent {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	events := []auditEvent{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event auditEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestIDP_auditLog(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	viper.Set("audit-log", file)
+	defer viper.Set("audit-log", "")
+	defer viper.Set("sps", nil)
+	i := getTestIDPWithECP(t)
+	defer i.Close()
+	req := &model.AuthnRequest{ID: "request", Issuer: "dex", CorrelationID: "correlation",
+		RequesterIDs: []string{"wiki"}}
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+
+	_, err := i.loginWithPassword(r, "joe", "wrong", req)
+	assert.Error(t, err)
+	user, err := i.loginWithPassword(r, "joe", "password", req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.SessionIndex = "session"
+	response, err := i.makeAuthnResponse(req, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := readAuditLog(t, file)
+	if !assert.Len(t, events, 3) {
+		return
+	}
+	for _, event := range events {
+		assert.Equal(t, "joe", event.User)
+		assert.Equal(t, "192.0.2.1", event.IP)
+		assert.Equal(t, "dex", event.ServiceProvider)
+		assert.Equal(t, "correlation", event.CorrelationID, "events for the request should be linked")
+		assert.Equal(t, "request", event.RequestID)
+		assert.Equal(t, []string{"wiki"}, event.RequesterIDs)
+		assert.False(t, event.Time.IsZero())
+	}
+	assert.Equal(t, auditAuthentication, events[0].Event)
+	assert.Equal(t, resultFailure, events[0].Result)
+	assert.Equal(t, "password", events[0].Method)
+	assert.Equal(t, resultSuccess, events[1].Result)
+	assert.Equal(t, auditAssertion, events[2].Event)
+	assert.Equal(t, response.ID, events[2].ResponseID)
+	assert.Equal(t, response.Assertion.ID, events[2].AssertionID)
+	assert.Equal(t, "session", events[2].SessionIndex)
+	assert.Equal(t, user.Context, events[2].AuthnContext)
+
+	// Reloads with the same settings keep writing to the audit log
+	next, err := i.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, i.auditLog, next.auditLog)
+	assert.NoError(t, i.Close())
+	_, err = next.makeAuthnResponse(req, user)
+	assert.NoError(t, err)
+	assert.Len(t, readAuditLog(t, file), 4)
+
+	// Assertions are only withheld when audit-log-required is set
+	next.auditLog.Close()
+	_, err = next.makeAuthnResponse(req, user)
+	assert.NoError(t, err, "failures are logged and counted")
+	next.auditRequired = true
+	_, err = next.makeAuthnResponse(req, user)
+	assert.Error(t, err, "the assertion couldn't be audited")
+	assert.Len(t, readAuditLog(t, file), 4)
+}
+
+func TestIDP_configureAuditLog(t *testing.T) {
+	defer viper.Set("audit-log-required", false)
+	viper.Set("audit-log-required", true)
+	_, err := (&IDP{}).Handler()
+	assert.Error(t, err, "an audit log is required without one")
+
+	viper.Set("audit-log", filepath.Join(t.TempDir(), "missing", "audit.log"))
+	defer viper.Set("audit-log", "")
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err, "the directory doesn't exist")
+}
+
+func Test_rotatingFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.log")
+	f, err := openRotatingFile(file, 10, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err = f.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, f.Close())
+	for name, want := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+		data, err := os.ReadFile(file + name)
+		assert.NoError(t, err)
+		assert.Equal(t, want, string(data), "events aren't split across files")
+	}
+	_, err = os.Stat(file + ".3")
+	assert.True(t, os.IsNotExist(err), "only maxBackups files are kept")
+
+	// Existing files are appended to
+	f, err = openRotatingFile(file, 0, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("fifth\n"))
+	f.Close()
+	data, _ := os.ReadFile(file)
+	assert.Equal(t, "fourth\nfifth\n", string(data))
+}
@@ -0,0 +1,161 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+)
+
+const (
+	authnContextUnspecified                = "urn:oasis:names:tc:SAML:2.0:ac:classes:unspecified"
+	authnContextPassword                   = "urn:oasis:names:tc:SAML:2.0:ac:classes:Password"
+	authnContextPasswordProtectedTransport = "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+	authnContextKerberos                   = "urn:oasis:names:tc:SAML:2.0:ac:classes:Kerberos"
+	authnContextTimeSyncToken              = "urn:oasis:names:tc:SAML:2.0:ac:classes:TimeSyncToken"
+	authnContextX509                       = "urn:oasis:names:tc:SAML:2.0:ac:classes:X509"
+	authnContextSmartcardPKI               = "urn:oasis:names:tc:SAML:2.0:ac:classes:SmartcardPKI"
+)
+
+// authnContextStrength orders the classes the IdP can compare for minimum, maximum, and better
+// requests. Other classes only satisfy requests that list them.
+var authnContextStrength = map[string]int{
+	authnContextUnspecified:                0,
+	authnContextPassword:                   1,
+	authnContextPasswordProtectedTransport: 2,
+	authnContextKerberos:                   2,
+	authnContextTimeSyncToken:              3,
+	authnContextX509:                       4,
+	authnContextSmartcardPKI:               4,
+}
+
+// noAuthnContextStatus tells a service provider that the user can't log in the way it asked for
+var noAuthnContextStatus = &saml.Status{
+	StatusCode: saml.StatusCode{
+		Value: "urn:oasis:names:tc:SAML:2.0:status:Requester",
+		StatusCode: &saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:NoAuthnContext",
+		},
+	},
+}
+
+// noPassiveStatus tells a service provider that the user would have to log in to answer its passive request
+var noPassiveStatus = &saml.Status{
+	StatusCode: saml.StatusCode{
+		Value: "urn:oasis:names:tc:SAML:2.0:status:Responder",
+		StatusCode: &saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:NoPassive",
+		},
+	},
+}
+
+// noAuthnContextError is returned for AuthnRequests with a RequestedAuthnContext no login method satisfies
+type noAuthnContextError struct {
+	entityID   string
+	comparison string
+	classRefs  []string
+}
+
+func (e *noAuthnContextError) Error() string {
+	return fmt.Sprintf("%s requested an authentication context %s %s that no login method satisfies",
+		e.entityID, e.comparison, strings.Join(e.classRefs, ", "))
+}
+
+func (i *IDP) configureAuthnContexts() {
+	i.passwordAuthnContext = i.settings.GetString("authn-context.password")
+	i.certificateAuthnContext = i.settings.GetString("authn-context.certificate")
+	i.mfaAuthnContext = i.settings.GetString("authn-context.mfa")
+	i.kerberosAuthnContext = i.settings.GetString("authn-context.kerberos")
+}
+
+// loginAuthnContexts are the classes of the login methods that are turned on
+func (i *IDP) loginAuthnContexts() []string {
+	contexts := []string{i.passwordAuthnContext}
+	if i.totpEnabled {
+		contexts = append(contexts, i.mfaAuthnContext)
+	}
+	if i.certLogin {
+		contexts = append(contexts, i.certificateAuthnContext)
+	}
+	if i.kerberos != nil {
+		contexts = append(contexts, i.kerberosAuthnContext)
+	}
+	return contexts
+}
+
+// satisfiesRequest reports whether the way the user logged in meets the authentication context the request asked for
+func (i *IDP) satisfiesRequest(req *model.AuthnRequest, user *model.User) bool {
+	return authnContextSatisfies(user.Context, req.AuthnContextClassRefs, req.AuthnContextComparison)
+}
+
+// checkRequestedAuthnContext returns a noAuthnContextError if none of the login methods can satisfy the request
+func (i *IDP) checkRequestedAuthnContext(entityID string, requested *saml.RequestedAuthnContext) error {
+	if requested == nil {
+		return nil
+	}
+	for _, classRef := range i.loginAuthnContexts() {
+		if authnContextSatisfies(classRef, requested.AuthnContextClassRef, requested.Comparison) {
+			return nil
+		}
+	}
+	return &noAuthnContextError{entityID, comparison(requested.Comparison), requested.AuthnContextClassRef}
+}
+
+// authnContextSatisfies reports whether logging in with classRef meets a RequestedAuthnContext. Minimum,
+// maximum, and better are satisfied when the comparison holds against at least one of the requested classes.
+func authnContextSatisfies(classRef string, requested []string, comparisonType string) bool {
+	if len(requested) == 0 {
+		return true
+	}
+	if comparisonType != "better" && containsString(requested, classRef) {
+		return true
+	}
+	strength, ok := authnContextStrength[classRef]
+	if !ok {
+		return false
+	}
+	for _, want := range requested {
+		wanted, ok := authnContextStrength[want]
+		if !ok {
+			continue
+		}
+		switch comparison(comparisonType) {
+		case "minimum":
+			if strength >= wanted {
+				return true
+			}
+		case "maximum":
+			if strength <= wanted {
+				return true
+			}
+		case "better":
+			if strength > wanted {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// comparison returns the comparison type with the schema's default
+func comparison(comparisonType string) string {
+	if comparisonType == "" {
+		return "exact"
+	}
+	return comparisonType
+}
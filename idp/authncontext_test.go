@@ -0,0 +1,155 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_authnContextSatisfies(t *testing.T) {
+	password := []string{authnContextPasswordProtectedTransport}
+	x509 := []string{authnContextX509}
+	tests := []struct {
+		name       string
+		classRef   string
+		requested  []string
+		comparison string
+		want       bool
+	}{
+		{"nothing requested", authnContextPasswordProtectedTransport, nil, "", true},
+		{"exact by default", authnContextPasswordProtectedTransport, password, "", true},
+		{"exact mismatch", authnContextX509, password, "exact", false},
+		{"any listed class", authnContextX509, []string{authnContextTimeSyncToken, authnContextX509}, "exact", true},
+		{"minimum met", authnContextX509, password, "minimum", true},
+		{"minimum equal", authnContextPasswordProtectedTransport, password, "minimum", true},
+		{"minimum not met", authnContextPasswordProtectedTransport, x509, "minimum", false},
+		{"maximum met", authnContextPasswordProtectedTransport, x509, "maximum", true},
+		{"maximum exceeded", authnContextX509, password, "maximum", false},
+		{"better met", authnContextX509, password, "better", true},
+		{"better than itself", authnContextX509, x509, "better", false},
+		{"unknown classes only match exactly", "urn:example:ac:custom", password, "minimum", false},
+		{"unknown requested class", authnContextX509, []string{"urn:example:ac:custom"}, "minimum", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, authnContextSatisfies(tt.classRef, tt.requested, tt.comparison))
+		})
+	}
+}
+
+func TestIDP_DefaultPostSSOHandler_noAuthnContext(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	dex, _ := i.ServiceProvider("dex")
+	dex.AssertionConsumerServices = append(dex.AssertionConsumerServices, AssertionConsumerService{
+		Index:    1,
+		Binding:  postBinding,
+		Location: "https://dex.example.com/acs",
+	})
+	loginReq := newTestAuthnRequest()
+	loginReq.ProtocolBinding = postBinding
+	loginReq.RequestedAuthnContext = &saml.RequestedAuthnContext{
+		AuthnContextClassRef: []string{authnContextTimeSyncToken},
+	}
+	w := postAuthnRequest(t, i, loginReq, true)
+	assert.Equal(t, http.StatusOK, w.Code, "expected a form posting the response")
+	doc, err := goquery.NewDocumentFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := doc.Find("input[name=SAMLResponse]").Attr("value")
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &saml.Response{}
+	if err = xml.Unmarshal(data, response); err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, response.Status.StatusCode.StatusCode) {
+		assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:NoAuthnContext", response.Status.StatusCode.StatusCode.Value)
+	}
+	assert.Nil(t, response.Assertion)
+}
+
+func TestIDP_DefaultPostSSOHandler_stepUp(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	user := newTestUser()
+	user.Context = authnContextPasswordProtectedTransport
+	cookie := addTestSession(t, i, "session", user)
+	loginReq := newTestAuthnRequest()
+	loginReq.RequestedAuthnContext = &saml.RequestedAuthnContext{
+		Comparison:           "minimum",
+		AuthnContextClassRef: []string{authnContextX509},
+	}
+	signature, err := i.signer.CreateSignature(loginReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginReq.Signature = signature
+	data, err := xml.Marshal(loginReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(data)}}
+	r := httptest.NewRequest("POST", viper.GetString("sso-service-path"), strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	i.PostSSOHandler(w, r)
+	assert.Equal(t, http.StatusSeeOther, w.Code, "a password session shouldn't satisfy a request for a certificate login")
+	assert.Contains(t, w.Header().Get("Location"), "/ui/login.html")
+}
+
+func TestIDP_makeAuthnResponse_noAuthnContext(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	user := newTestUser()
+	user.Context = authnContextPasswordProtectedTransport
+	response, err := i.makeAuthnResponse(&model.AuthnRequest{
+		Issuer:                "dex",
+		AuthnContextClassRefs: []string{authnContextX509},
+	}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, response.Assertion)
+	assert.Equal(t, noAuthnContextStatus, response.Status)
+
+	user.Context = authnContextX509
+	response, err = i.makeAuthnResponse(&model.AuthnRequest{
+		Issuer:                 "dex",
+		AuthnContextClassRefs:  []string{authnContextPasswordProtectedTransport},
+		AuthnContextComparison: "minimum",
+	}, user)
+	if assert.NoError(t, err) && assert.NotNil(t, response.Assertion) {
+		assert.Equal(t, authnContextX509, response.Assertion.AuthnStatement.AuthnContext.AuthnContextClassRef)
+	}
+}
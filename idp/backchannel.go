@@ -0,0 +1,173 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxLogoutResponseSize limits how much of a service provider's SOAP response is read
+const maxLogoutResponseSize = 1 << 20
+
+// partialLogoutStatus tells the service provider that requested logout that some service providers weren't logged out
+var partialLogoutStatus = &saml.Status{
+	StatusCode: saml.StatusCode{
+		Value: "urn:oasis:names:tc:SAML:2.0:status:Success",
+		StatusCode: &saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:PartialLogout",
+		},
+	},
+}
+
+// configureBackChannelLogout reads how service providers are notified of logouts over SOAP and creates the LogoutClient
+func (i *IDP) configureBackChannelLogout() error {
+	i.backChannelTimeout = i.settings.GetDuration("slo-backchannel-timeout")
+	if i.backChannelTimeout <= 0 {
+		return errors.New("slo-backchannel-timeout must be a positive duration")
+	}
+	i.backChannelParallelism = i.settings.GetInt("slo-backchannel-parallelism")
+	if i.backChannelParallelism < 1 {
+		return errors.New("slo-backchannel-parallelism must be at least 1")
+	}
+	if i.LogoutClient == nil {
+		// Service providers can authenticate the IdP with its TLS certificate
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{Certificates: i.TLSConfig.Certificates}
+		i.LogoutClient = &http.Client{Transport: transport}
+	}
+	return nil
+}
+
+// backChannelLogout sends LogoutRequests over SOAP to the service providers with a SOAP single logout service that
+// received assertions during the session, other than the requester. It returns those that didn't confirm the logout.
+func (i *IDP) backChannelLogout(ctx context.Context, user *model.User, requester string) []string {
+	var (
+		mu     sync.Mutex
+		failed []string
+		wg     sync.WaitGroup
+	)
+	limit := make(chan struct{}, i.backChannelParallelism)
+	for _, entityID := range user.ServiceProviders {
+		if entityID == requester {
+			continue
+		}
+		sp, ok := i.sps.get(entityID)
+		if !ok {
+			continue
+		}
+		slo := sp.singleLogoutService(soapBinding)
+		if slo == nil {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+			if err := i.sendBackChannelLogout(ctx, user, sp, slo.Location); err != nil {
+				log.Warnf("failed to log %s out of %s: %v", user.Name, sp.EntityID, err)
+				mu.Lock()
+				failed = append(failed, sp.EntityID)
+				mu.Unlock()
+				return
+			}
+			log.Infof("logged %s out of %s", user.Name, sp.EntityID)
+		}()
+	}
+	wg.Wait()
+	return failed
+}
+
+// sendBackChannelLogout posts a signed LogoutRequest for the session to the service provider and checks that its
+// LogoutResponse reports success
+func (i *IDP) sendBackChannelLogout(ctx context.Context, user *model.User, sp *ServiceProvider, location string) error {
+	nameID, err := i.makeNameID(user, sp.EntityID, "")
+	if err != nil {
+		return err
+	}
+	logoutReq := saml.LogoutRequest{
+		RequestAbstractType: saml.RequestAbstractType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now(),
+			Issuer:       i.entityID,
+			Destination:  location,
+		},
+		NameID:       nameID,
+		SessionIndex: []string{user.SessionIndex},
+	}
+	if logoutReq.Signature, err = i.signerFor(sp.EntityID).CreateSignature(logoutReq); err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	if err = xml.NewEncoder(&b).Encode(saml.LogoutRequestEnv{
+		Body: saml.LogoutRequestBody{Request: logoutReq},
+	}); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, i.backChannelTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, location, &b)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	req.Header.Set("SOAPAction", "http://www.oasis-open.org/committees/security")
+	resp, err := i.LogoutClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	var env saml.LogoutResponseEnv
+	if err = xml.NewDecoder(io.LimitReader(resp.Body, maxLogoutResponseSize)).Decode(&env); err != nil {
+		return err
+	}
+	// The response came over TLS from the service provider's endpoint, so a signature is only checked if it has one
+	if err = dsig.Verify([]byte(strings.TrimSpace(env.Body.RawResponse)), sp.publicKey); err != nil && err != dsig.ErrNoSignature {
+		i.metrics.signatureFailures.Inc(sp.EntityID)
+		return err
+	}
+	response := env.Body.Response
+	if response.InResponseTo != logoutReq.ID {
+		return errors.New("logout response is not in response to the request")
+	}
+	if response.Status == nil || response.Status.StatusCode.Value != "urn:oasis:names:tc:SAML:2.0:status:Success" {
+		status := ""
+		if response.Status != nil {
+			status = response.Status.StatusCode.Value
+		}
+		return fmt.Errorf("logout response has status %s", status)
+	}
+	return nil
+}
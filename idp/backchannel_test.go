@@ -0,0 +1,174 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// soapLogoutService is a service provider's SOAP single logout service that answers with status
+type soapLogoutService struct {
+	t      *testing.T
+	key    crypto.PublicKey
+	status string
+	delay  time.Duration
+	mu     sync.Mutex
+	// sessions that were logged out and the most requests handled at once
+	sessions    []string
+	active, max int
+}
+
+func (s *soapLogoutService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.active++
+	if s.active > s.max {
+		s.max = s.active
+	}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}()
+	var env saml.LogoutRequestEnv
+	if err := xml.NewDecoder(r.Body).Decode(&env); err != nil {
+		s.t.Error(err)
+		return
+	}
+	assert.NoError(s.t, dsig.Verify([]byte(strings.TrimSpace(env.Body.RawRequest)), s.key), "the request should be signed")
+	select {
+	case <-time.After(s.delay):
+	case <-r.Context().Done():
+		return
+	}
+	s.mu.Lock()
+	s.sessions = append(s.sessions, env.Body.Request.SessionIndex...)
+	s.mu.Unlock()
+	xml.NewEncoder(w).Encode(saml.LogoutResponseEnv{Body: saml.LogoutResponseBody{Response: saml.LogoutResponse{
+		StatusResponseType: saml.StatusResponseType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now(),
+			InResponseTo: env.Body.Request.ID,
+			Status:       &saml.Status{StatusCode: saml.StatusCode{Value: s.status}},
+		},
+	}}})
+}
+
+// getTestIDPWithLogoutServices registers the service provider from testdata and one for each SOAP single logout service
+func getTestIDPWithLogoutServices(t *testing.T, i *IDP, services map[string]*httptest.Server) {
+	base := &IDP{}
+	getTestIDPWithSP(t, base).Close()
+	dex, _ := base.sps.get("dex")
+	sps := []ServiceProvider{*dex}
+	for entityID, ts := range services {
+		sp := *dex
+		sp.EntityID = entityID
+		sp.SingleLogoutServices = []SingleLogoutService{{Binding: soapBinding, Location: ts.URL}}
+		sps = append(sps, sp)
+	}
+	viper.Set("sps", sps)
+	getTestIDP(t, i).Close()
+	for _, ts := range services {
+		// The test servers share a certificate
+		i.LogoutClient = ts.Client()
+	}
+}
+
+func TestIDP_backChannelLogout(t *testing.T) {
+	viper.Set("slo-backchannel-timeout", "200ms")
+	defer viper.Set("slo-backchannel-timeout", "5s")
+	defer viper.Set("sps", nil)
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	key := i.TLSConfig.Certificates[0].PrivateKey.(crypto.Signer).Public()
+	wiki := &soapLogoutService{t: t, key: key, status: "urn:oasis:names:tc:SAML:2.0:status:Success"}
+	mail := &soapLogoutService{t: t, key: key, status: "urn:oasis:names:tc:SAML:2.0:status:Responder"}
+	slow := &soapLogoutService{t: t, key: key, status: "urn:oasis:names:tc:SAML:2.0:status:Success", delay: time.Second}
+	services := map[string]*httptest.Server{
+		"wiki": httptest.NewTLSServer(wiki),
+		"mail": httptest.NewTLSServer(mail),
+		"slow": httptest.NewTLSServer(slow),
+	}
+	for _, ts := range services {
+		defer ts.Close()
+	}
+	i = &IDP{}
+	getTestIDPWithLogoutServices(t, i, services)
+
+	cookie := addTestSession(t, i, "12345", &model.User{Name: "joe", SessionIndex: "index",
+		ServiceProviders: []string{"dex", "wiki", "mail", "slow"}})
+	w, resp := sendLogoutRequest(t, i, "dex", "joe", cookie)
+	assert.Equal(t, http.StatusFound, w.Code, "service providers with a SOAP service aren't sent front-channel requests")
+	if !assert.NotNil(t, resp, "expected a logout response") {
+		return
+	}
+	assert.Equal(t, []string{"index"}, wiki.sessions)
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", resp.Status.StatusCode.Value)
+	if assert.NotNil(t, resp.Status.StatusCode.StatusCode, "failed and timed out notifications should be reported") {
+		assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:PartialLogout", resp.Status.StatusCode.StatusCode.Value)
+	}
+	_, err := i.UserCache.Get("12345")
+	assert.Error(t, err, "the session should end even if some service providers weren't logged out")
+
+	cookie = addTestSession(t, i, "67890", &model.User{Name: "joe", SessionIndex: "index-2",
+		ServiceProviders: []string{"dex", "wiki"}})
+	_, resp = sendLogoutRequest(t, i, "dex", "joe", cookie)
+	if assert.NotNil(t, resp, "expected a logout response") {
+		assert.Nil(t, resp.Status.StatusCode.StatusCode)
+	}
+	assert.Equal(t, []string{"index", "index-2"}, wiki.sessions)
+}
+
+func TestIDP_backChannelLogout_parallelism(t *testing.T) {
+	viper.Set("slo-backchannel-parallelism", 1)
+	defer viper.Set("slo-backchannel-parallelism", 4)
+	defer viper.Set("sps", nil)
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	key := i.TLSConfig.Certificates[0].PrivateKey.(crypto.Signer).Public()
+	service := &soapLogoutService{t: t, key: key, status: "urn:oasis:names:tc:SAML:2.0:status:Success", delay: 20 * time.Millisecond}
+	ts := httptest.NewTLSServer(service)
+	defer ts.Close()
+	services := map[string]*httptest.Server{}
+	user := &model.User{Name: "joe", SessionIndex: "index"}
+	for _, entityID := range []string{"a", "b", "c"} {
+		services[entityID] = ts
+		user.ServiceProviders = append(user.ServiceProviders, entityID)
+	}
+	i = &IDP{}
+	getTestIDPWithLogoutServices(t, i, services)
+
+	assert.Empty(t, i.backChannelLogout(httptest.NewRequest("GET", "/", nil).Context(), user, "dex"))
+	assert.Len(t, service.sessions, 3)
+	assert.Equal(t, 1, service.max, "service providers should be notified one at a time")
+
+	viper.Set("slo-backchannel-parallelism", 0)
+	_, err := (&IDP{}).Handler()
+	assert.Error(t, err)
+}
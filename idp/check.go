@@ -0,0 +1,105 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/saml"
+)
+
+// CheckResult is the outcome of one of the checks run by Check. Err is nil if it passed.
+type CheckResult struct {
+	Name string
+	Err  error
+}
+
+// Check tests the IDP's certificates and keys and the services it depends on, so a configuration can be validated
+// before it's deployed. The IDP must have been configured by Handler, which loads the configuration and service
+// providers. All checks are run even if some fail.
+func (i *IDP) Check(ctx context.Context) []CheckResult {
+	if i.handler == nil {
+		return []CheckResult{{"configuration", errors.New("IDP has not been configured")}}
+	}
+	results := []CheckResult{
+		{"TLS certificate", checkCertificate(i.TLSConfig.Certificates[0])},
+		{"signing certificate", checkCertificate(*i.SigningCertificate)},
+		{"signing key", i.checkSigningKey()},
+		{fmt.Sprintf("service providers (%d loaded)", i.sps.count()), nil},
+		{"session store", i.checkSessionStore()},
+	}
+	results = append(results, i.sps.sourceErrors()...)
+	if checker, ok := i.PasswordValidator.(HealthChecker); ok {
+		results = append(results, CheckResult{"password validator", checker.CheckHealth(ctx)})
+	}
+	for n, source := range i.AttributeSources {
+		if checker, ok := source.(HealthChecker); ok {
+			results = append(results, CheckResult{fmt.Sprintf("attribute source %d", n+1), checker.CheckHealth(ctx)})
+		}
+	}
+	return results
+}
+
+// checkCertificate ensures the certificate is currently valid
+func checkCertificate(cert tls.Certificate) error {
+	if len(cert.Certificate) == 0 {
+		return errors.New("no certificate")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("not valid until %s", leaf.NotBefore)
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("expired %s", leaf.NotAfter)
+	}
+	return nil
+}
+
+// checkSigningKey signs an assertion and verifies it with the signing certificate, which fails if the key doesn't
+// match the certificate
+func (i *IDP) checkSigningKey() error {
+	leaf, err := x509.ParseCertificate(i.SigningCertificate.Certificate[0])
+	if err != nil {
+		return err
+	}
+	assertion := &saml.Assertion{
+		ID:           saml.NewID(),
+		IssueInstant: time.Now(),
+		Issuer:       saml.NewIssuer(i.entityID),
+		Version:      "2.0",
+	}
+	if assertion.Signature, err = i.signer.CreateSignature(assertion); err != nil {
+		return err
+	}
+	data, err := xml.Marshal(assertion)
+	if err != nil {
+		return err
+	}
+	if err = dsig.Verify(data, leaf.PublicKey); err != nil {
+		return fmt.Errorf("key doesn't match the certificate: %v", err)
+	}
+	return nil
+}
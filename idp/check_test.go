@@ -0,0 +1,96 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func checkFailures(results []CheckResult) map[string]bool {
+	failures := map[string]bool{}
+	for _, result := range results {
+		if result.Err != nil {
+			failures[result.Name] = true
+		}
+	}
+	return failures
+}
+
+func TestIDP_Check(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	defer i.Close()
+	results := i.Check(context.Background())
+	assert.Empty(t, checkFailures(results))
+	assert.Contains(t, results, CheckResult{Name: "service providers (1 loaded)"})
+
+	i = &IDP{UserCache: failingCache{}}
+	getTestIDP(t, i).Close()
+	defer i.Close()
+	assert.Equal(t, map[string]bool{"session store": true}, checkFailures(i.Check(context.Background())))
+
+	assert.Error(t, (&IDP{}).Check(context.Background())[0].Err, "IDPs must be configured first")
+}
+
+func TestIDP_Check_signingKey(t *testing.T) {
+	cert, err := tls.LoadX509KeyPair(filepath.Join("testdata", "certificate.pem"), filepath.Join("testdata", "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.PrivateKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		t.Fatal(err)
+	}
+	i := &IDP{SigningCertificate: &cert}
+	getTestIDP(t, i).Close()
+	defer i.Close()
+	assert.Equal(t, map[string]bool{"signing key": true}, checkFailures(i.Check(context.Background())),
+		"keys that don't match the certificate should fail")
+}
+
+func Test_checkCertificate(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate := func(notBefore, notAfter time.Time) tls.Certificate {
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "idp.example.com"},
+			NotBefore:    notBefore,
+			NotAfter:     notAfter,
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+	}
+	now := time.Now()
+	assert.NoError(t, checkCertificate(certificate(now.Add(-time.Hour), now.Add(time.Hour))))
+	assert.Error(t, checkCertificate(certificate(now.Add(-2*time.Hour), now.Add(-time.Hour))), "expired")
+	assert.Error(t, checkCertificate(certificate(now.Add(time.Hour), now.Add(2*time.Hour))), "not yet valid")
+	assert.Error(t, checkCertificate(tls.Certificate{}))
+}
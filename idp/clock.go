@@ -0,0 +1,69 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/amdonov/lite-idp/store"
+)
+
+func (i *IDP) configureClockSkew() error {
+	i.clockSkew = i.settings.GetDuration("clock-skew")
+	if i.clockSkew <= 0 {
+		return errors.New("clock-skew must be a positive duration")
+	}
+	return nil
+}
+
+// checkIssueInstant rejects messages issued more than clock-skew before or after the current time. Messages
+// are sent as soon as they're created, so anything older was delayed or is being replayed.
+func (i *IDP) checkIssueInstant(issued time.Time) error {
+	if issued.IsZero() {
+		return errors.New("message does not have an IssueInstant")
+	}
+	now := time.Now()
+	if issued.Before(now.Add(-i.clockSkew)) || issued.After(now.Add(i.clockSkew)) {
+		return fmt.Errorf("message issued at %s is more than %s from the current time",
+			issued.UTC().Format(time.RFC3339), i.clockSkew)
+	}
+	return nil
+}
+
+// checkNotOnOrAfter rejects messages that expired more than clock-skew ago
+func (i *IDP) checkNotOnOrAfter(expires *time.Time) error {
+	if expires != nil && !time.Now().Before(expires.Add(i.clockSkew)) {
+		return fmt.Errorf("message expired at %s", expires.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkReplay records the ID of an accepted request and denies IDs the issuer already used. IDs are kept for
+// twice clock-skew, which covers every IssueInstant checkIssueInstant accepts.
+func (i *IDP) checkReplay(issuer, id string) error {
+	if id == "" {
+		return &requestDeniedError{issuer, errors.New("request does not have an ID")}
+	}
+	added, err := store.Add(i.ReplayCache, issuer+" "+id, []byte{1})
+	if err != nil {
+		return err
+	}
+	if !added {
+		return &requestDeniedError{issuer, fmt.Errorf("request %s has already been used", id)}
+	}
+	return nil
+}
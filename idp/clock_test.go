@@ -0,0 +1,102 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_checkIssueInstant(t *testing.T) {
+	i := &IDP{clockSkew: time.Minute, settings: viper.GetViper()}
+	now := time.Now()
+	assert.NoError(t, i.checkIssueInstant(now.Add(-50*time.Second)))
+	assert.NoError(t, i.checkIssueInstant(now.Add(50*time.Second)), "service providers with fast clocks should be accepted")
+	assert.Error(t, i.checkIssueInstant(now.Add(-2*time.Minute)))
+	assert.Error(t, i.checkIssueInstant(now.Add(2*time.Minute)))
+	assert.Error(t, i.checkIssueInstant(time.Time{}), "IssueInstant is required")
+
+	expired := now.Add(-30 * time.Second)
+	assert.NoError(t, i.checkNotOnOrAfter(&expired), "messages should be accepted within the skew of expiring")
+	expired = now.Add(-2 * time.Minute)
+	assert.Error(t, i.checkNotOnOrAfter(&expired))
+	assert.NoError(t, i.checkNotOnOrAfter(nil))
+
+	defer viper.Set("clock-skew", "3m")
+	viper.Set("clock-skew", "-1m")
+	assert.Error(t, i.configureClockSkew())
+	viper.Set("clock-skew", "0s")
+	assert.Error(t, i.configureClockSkew(), "request IDs couldn't be remembered without a skew")
+}
+
+func TestIDP_DefaultQueryHandler_stale(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	in, err := os.Open(filepath.Join("testdata", "attribute-query-request.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	resp, err := ts.Client().Post(ts.URL+viper.GetString("attribute-service-path"), "text/xml", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "old queries should be rejected")
+}
+
+func TestIDP_DefaultPostSSOHandler_stale(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	loginReq := newTestAuthnRequest()
+	loginReq.IssueInstant = time.Now().Add(-time.Hour)
+	w := postAuthnRequest(t, i, loginReq, true)
+	assert.Equal(t, requestDeniedStatus, redirectedStatus(t, i, w), "old requests should be denied")
+}
+
+func TestIDP_DefaultPostSSOHandler_replay(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	loginReq := newTestAuthnRequest()
+	w := postAuthnRequest(t, i, loginReq, true)
+	assert.Equal(t, http.StatusSeeOther, w.Code, "expected redirect to login page")
+	w = postAuthnRequest(t, i, loginReq, true)
+	assert.Equal(t, requestDeniedStatus, redirectedStatus(t, i, w), "replayed requests should be denied")
+
+	loginReq = newTestAuthnRequest()
+	loginReq.ID = ""
+	w = postAuthnRequest(t, i, loginReq, true)
+	assert.Equal(t, requestDeniedStatus, redirectedStatus(t, i, w), "requests without IDs can't be checked for replay")
+}
+
+func TestIDP_checkReplay(t *testing.T) {
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	assert.NoError(t, i.checkReplay("dex", "_1"))
+	assert.NoError(t, i.checkReplay("other", "_1"), "IDs only need to be unique for each service provider")
+	err := i.checkReplay("dex", "_1")
+	if assert.IsType(t, &requestDeniedError{}, err) {
+		assert.Contains(t, err.Error(), "already been used")
+	}
+}
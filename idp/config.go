@@ -0,0 +1,365 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Config holds the settings of an IDP embedded in another application. Each field corresponds to the configuration
+// key in its mapstructure tag, which is documented in the README. Start from DefaultConfig, since zero values are
+// used as they are rather than replaced by defaults. Settings for the listeners, such as listen-address, belong to
+// the application serving the IDP and aren't included.
+type Config struct {
+	ServerName string `mapstructure:"server-name"`
+	EntityID   string `mapstructure:"entity-id"`
+	// Path the IDP's Handler is mounted under, such as /idp. Requests must include it, and the IDP includes it
+	// in the locations it advertises and redirects to.
+	BasePath   string `mapstructure:"base-path"`
+	CookieName string `mapstructure:"cookie-name"`
+	// Attributes of the session cookie. The path defaults to the base path.
+	CookieSecure   bool   `mapstructure:"cookie-secure"`
+	CookieHTTPOnly bool   `mapstructure:"cookie-http-only"`
+	CookieSameSite string `mapstructure:"cookie-same-site"`
+	CookiePath     string `mapstructure:"cookie-path"`
+	CookieDomain   string `mapstructure:"cookie-domain"`
+
+	TLSCertificate     string `mapstructure:"tls-certificate"`
+	TLSPrivateKey      string `mapstructure:"tls-private-key"`
+	TLSCA              string `mapstructure:"tls-ca"`
+	SigningCertificate string `mapstructure:"signing-certificate"`
+	SigningPrivateKey  string `mapstructure:"signing-private-key"`
+	SigningPIN         string `mapstructure:"signing-pin"`
+	SignatureAlgorithm string `mapstructure:"signature-algorithm"`
+	DigestAlgorithm    string `mapstructure:"digest-algorithm"`
+	// Default content encryption algorithm for service providers that encrypt assertions
+	EncryptionAlgorithm string `mapstructure:"encryption-algorithm"`
+	// Certificate files published in the metadata along with the signing certificate during a key rollover
+	AdditionalSigningCertificates []string `mapstructure:"additional-signing-certificates"`
+	// Minimum TLS version, 1.2 or 1.3, and the TLS 1.2 cipher suites to offer instead of Go's defaults
+	TLSMinVersion   string   `mapstructure:"tls-min-version"`
+	TLSCipherSuites []string `mapstructure:"tls-cipher-suites"`
+	// Staple the OCSP response for the TLS certificate to handshakes
+	TLSOCSPStapling bool `mapstructure:"tls-ocsp-stapling"`
+
+	MetadataPath string `mapstructure:"metadata-path"`
+	SignMetadata bool   `mapstructure:"sign-metadata"`
+	// How long published metadata is valid, counted from each time it's served, and how long it can be cached
+	MetadataValidUntil    time.Duration `mapstructure:"metadata-valid-until"`
+	MetadataCacheDuration time.Duration `mapstructure:"metadata-cache-duration"`
+	// Organization in each language and contacts published in the metadata
+	Organization            []OrganizationConfig `mapstructure:"organization"`
+	Contacts                []ContactConfig      `mapstructure:"contacts"`
+	SSOServicePath          string               `mapstructure:"sso-service-path"`
+	UnsolicitedSSOEnabled   bool                 `mapstructure:"unsolicited-sso-enabled"`
+	UnsolicitedSSOPath      string               `mapstructure:"unsolicited-sso-path"`
+	ScopingEnforced         bool                 `mapstructure:"scoping-enforced"`
+	ArtifactServicePath     string               `mapstructure:"artifact-service-path"`
+	AttributeServicePath    string               `mapstructure:"attribute-service-path"`
+	SLOEnabled              bool                 `mapstructure:"slo-enabled"`
+	SLOServicePath          string               `mapstructure:"slo-service-path"`
+	ManageNameIDEnabled     bool                 `mapstructure:"manage-nameid-enabled"`
+	ManageNameIDServicePath string               `mapstructure:"manage-nameid-service-path"`
+	WantAuthnRequestsSigned bool                 `mapstructure:"want-authn-requests-signed"`
+	// Reject ArtifactResolves that aren't signed unless a service provider overrides it
+	WantArtifactResolveSigned bool `mapstructure:"want-artifact-resolve-signed"`
+	// How long to wait for each service provider notified of a logout over SOAP, and how many are notified at once
+	SLOBackChannelTimeout     time.Duration `mapstructure:"slo-backchannel-timeout"`
+	SLOBackChannelParallelism int           `mapstructure:"slo-backchannel-parallelism"`
+	// Entity attributes and user interface information published in the metadata
+	EntityCategories        []string       `mapstructure:"entity-categories"`
+	EntityCategorySupport   []string       `mapstructure:"entity-category-support"`
+	AssuranceCertifications []string       `mapstructure:"assurance-certifications"`
+	UIInfo                  []UIInfoConfig `mapstructure:"ui-info"`
+
+	ServiceProviders        []ServiceProvider `mapstructure:"sps"`
+	MetadataDirectory       string            `mapstructure:"metadata-directory"`
+	MetadataRefreshInterval time.Duration     `mapstructure:"metadata-refresh-interval"`
+	// Signed metadata aggregates, such as a federation's, fetched at startup and every refresh interval
+	MetadataURLs               []MetadataURL `mapstructure:"metadata-urls"`
+	MetadataURLRefreshInterval time.Duration `mapstructure:"metadata-url-refresh-interval"`
+	MetadataURLTimeout         time.Duration `mapstructure:"metadata-url-timeout"`
+
+	TempCacheDuration time.Duration `mapstructure:"temp-cache-duration"`
+	AssertionLifetime time.Duration `mapstructure:"assertion-lifetime"`
+	SessionLifetime   time.Duration `mapstructure:"session-lifetime"`
+	ArtifactLifetime  time.Duration `mapstructure:"artifact-lifetime"`
+	ClockSkew         time.Duration `mapstructure:"clock-skew"`
+	// Sessions end after this long without being used, or only after the absolute timeout if it's 0
+	SessionIdleTimeout time.Duration `mapstructure:"session-idle-timeout"`
+	// Longest a session lasts after the user logs in, session-lifetime if it's 0
+	SessionAbsoluteTimeout time.Duration `mapstructure:"session-absolute-timeout"`
+	// Where state such as sessions and artifacts is kept, memory or redis
+	Store string      `mapstructure:"store"`
+	Redis RedisConfig `mapstructure:"redis"`
+	// Largest request body accepted in bytes, or 0 for no limit
+	MaxRequestSize int64 `mapstructure:"max-request-size"`
+	// Largest size in bytes that a deflated SAML message may inflate to, or 0 for no limit
+	MaxInflatedSize int64 `mapstructure:"max-inflated-size"`
+	// Addresses and CIDR blocks of proxies trusted to report the client's address
+	TrustedProxies []string `mapstructure:"trusted-proxies"`
+	// Addresses that can reach endpoints such as the artifact resolution service
+	AccessRules []AccessRule `mapstructure:"access-rules"`
+	// Log the SAML messages that are received and sent at debug level, and write them to the directory if it's set
+	DebugSAML          bool   `mapstructure:"debug-saml"`
+	DebugSAMLDirectory string `mapstructure:"debug-saml-directory"`
+	// Where authentications and issued assertions are written as JSON: a file, syslog, or syslog://host:port
+	AuditLog string `mapstructure:"audit-log"`
+	// Size in bytes at which the audit log file is rotated, or 0 to never rotate it, and how many old files are kept
+	AuditLogMaxSize    int64 `mapstructure:"audit-log-max-size"`
+	AuditLogMaxBackups int   `mapstructure:"audit-log-max-backups"`
+	// Flush each event to disk before continuing
+	AuditLogSync bool `mapstructure:"audit-log-sync"`
+	// Withhold assertions that can't be written to the audit log
+	AuditLogRequired bool `mapstructure:"audit-log-required"`
+
+	CertLoginEnabled   bool   `mapstructure:"cert-login-enabled"`
+	CertLoginPrincipal string `mapstructure:"cert-login-principal"`
+	CertLoginNameID    string `mapstructure:"cert-login-nameid"`
+	LoginTemplate      string `mapstructure:"login-template"`
+	LoginAssets        string `mapstructure:"login-assets-directory"`
+	PostTemplate       string `mapstructure:"post-template"`
+	ErrorTemplate      string `mapstructure:"error-template"`
+	LandingPage        string `mapstructure:"landing-page"`
+	LandingTemplate    string `mapstructure:"landing-template"`
+	// Message catalogs for the login, consent, and error pages, and the language shown when none of a user's match
+	LocaleDirectory string `mapstructure:"locale-directory"`
+	DefaultLocale   string `mapstructure:"default-locale"`
+
+	// Checks of client certificates with OCSP and CRLs, tried in order, and how long answers are remembered
+	CertRevocationMethods  []string      `mapstructure:"cert-revocation-methods"`
+	CertOCSPResponder      string        `mapstructure:"cert-ocsp-responder"`
+	CertCRLURLs            []string      `mapstructure:"cert-crl-urls"`
+	CertRevocationCacheTTL time.Duration `mapstructure:"cert-revocation-cache-ttl"`
+	CertRevocationTimeout  time.Duration `mapstructure:"cert-revocation-timeout"`
+
+	KerberosEnabled          bool   `mapstructure:"kerberos-enabled"`
+	KerberosKeytab           string `mapstructure:"kerberos-keytab"`
+	KerberosServicePrincipal string `mapstructure:"kerberos-service-principal"`
+	KerberosNameID           string `mapstructure:"kerberos-nameid"`
+
+	AuthRateLimit        float64       `mapstructure:"auth-rate-limit"`
+	AuthLockoutThreshold int           `mapstructure:"auth-lockout-threshold"`
+	AuthLockoutWindow    time.Duration `mapstructure:"auth-lockout-window"`
+
+	TOTPEnabled     bool `mapstructure:"totp-enabled"`
+	TOTPRequired    bool `mapstructure:"totp-required"`
+	TOTPSkew        int  `mapstructure:"totp-skew"`
+	TOTPMaxAttempts int  `mapstructure:"totp-max-attempts"`
+
+	ConsentEnabled  bool   `mapstructure:"consent-enabled"`
+	ConsentTemplate string `mapstructure:"consent-template"`
+
+	EmailAttribute          string                `mapstructure:"email-attribute"`
+	AttributeDefinitions    []AttributeDefinition `mapstructure:"attribute-definitions"`
+	AttributeOrder          []string              `mapstructure:"attribute-order"`
+	AttributeTransforms     []AttributeTransform  `mapstructure:"attribute-transforms"`
+	AttributeReleaseDefault string                `mapstructure:"attribute-release-default"`
+	AttributeBundles        []AttributeBundle     `mapstructure:"attribute-bundles"`
+	EntityCategoryRelease   []CategoryRelease     `mapstructure:"entity-category-release"`
+	AuthnContext            AuthnContextConfig    `mapstructure:"authn-context"`
+	// Users checked by the default password validator and attribute source
+	Users []UserConfig `mapstructure:"users"`
+	LDAP  LDAPConfig   `mapstructure:"ldap"`
+	SQL   SQLConfig    `mapstructure:"sql"`
+	OIDC  OIDCConfig   `mapstructure:"oidc"`
+	// Replace the configured password validators and attribute sources with dev-users, whose passwords are plain
+	// text, or accept any credentials if there are none. Only for local development.
+	DevMode  bool         `mapstructure:"dev-mode"`
+	DevUsers []UserConfig `mapstructure:"dev-users"`
+	// Origins that can read the metadata, OpenID Connect discovery document, and JWKS from browsers
+	CORS CORSConfig `mapstructure:"cors"`
+	// Headers added to every response, replacing the defaults of the same name. An empty value removes a header.
+	SecurityHeaders map[string]string `mapstructure:"security-headers"`
+	// Format of the Issuer in responses and assertions, or none to leave it out. Service providers can override it.
+	IssuerFormat string `mapstructure:"issuer-format"`
+	// Password validators tried in order, users and ldap. Defaults to ldap if ldap.url is set and users otherwise.
+	PasswordValidators []string `mapstructure:"password-validators"`
+
+	MetricsPath        string `mapstructure:"metrics-path"`
+	MetricsAddress     string `mapstructure:"metrics-address"`
+	AdminListenAddress string `mapstructure:"admin-listen-address"`
+	AdminMetadata      bool   `mapstructure:"admin-metadata"`
+	HealthPath         string `mapstructure:"health-path"`
+	ReadinessPath      string `mapstructure:"readiness-path"`
+	// Report the version, commit, and build date at version-path
+	VersionEnabled     bool   `mapstructure:"version-enabled"`
+	VersionPath        string `mapstructure:"version-path"`
+	TracingEnabled     bool   `mapstructure:"tracing-enabled"`
+	TracingEndpoint    string `mapstructure:"tracing-endpoint"`
+	TracingServiceName string `mapstructure:"tracing-service-name"`
+	// Bearer token or client certificate CA that protect the session API on the admin listener
+	AdminAPIToken     string `mapstructure:"admin-api-token"`
+	AdminClientCA     string `mapstructure:"admin-client-ca"`
+	AdminSessionsPath string `mapstructure:"admin-sessions-path"`
+}
+
+// AuthnContextConfig holds the authentication context classes reported for each login method
+type AuthnContextConfig struct {
+	Password    string `mapstructure:"password"`
+	Certificate string `mapstructure:"certificate"`
+	MFA         string `mapstructure:"mfa"`
+	Kerberos    string `mapstructure:"kerberos"`
+}
+
+// UserConfig is a user of the default password validator and attribute source. Password is a bcrypt hash.
+type UserConfig struct {
+	Name       string
+	Password   string
+	Attributes map[string][]string
+}
+
+// LDAPConfig holds the settings of the LDAP password validator and attribute source
+type LDAPConfig struct {
+	URL             string            `mapstructure:"url"`
+	StartTLS        bool              `mapstructure:"start-tls"`
+	CA              string            `mapstructure:"ca"`
+	BindDN          string            `mapstructure:"bind-dn"`
+	BindPassword    string            `mapstructure:"bind-password"`
+	BaseDN          string            `mapstructure:"base-dn"`
+	UserFilter      string            `mapstructure:"user-filter"`
+	Attributes      []string          `mapstructure:"attributes"`
+	AttributeFilter string            `mapstructure:"attribute-filter"`
+	AttributeMap    map[string]string `mapstructure:"attribute-map"`
+	Timeout         time.Duration     `mapstructure:"timeout"`
+	PoolSize        int               `mapstructure:"pool-size"`
+	CacheDuration   time.Duration     `mapstructure:"cache-duration"`
+	// Limits of the connection pool and retries of operations that fail with network errors
+	PoolMaxOpen     int           `mapstructure:"pool-max-open"`
+	PoolIdleTimeout time.Duration `mapstructure:"pool-idle-timeout"`
+	Retries         int           `mapstructure:"retries"`
+	RetryBackoff    time.Duration `mapstructure:"retry-backoff"`
+}
+
+// SQLConfig holds the settings of the SQL attribute source
+type SQLConfig struct {
+	Driver       string            `mapstructure:"driver"`
+	DSN          string            `mapstructure:"dsn"`
+	Query        string            `mapstructure:"query"`
+	AttributeMap map[string]string `mapstructure:"attribute-map"`
+	Timeout      time.Duration     `mapstructure:"timeout"`
+	PoolSize     int               `mapstructure:"pool-size"`
+}
+
+// RedisConfig holds the settings of the Redis server used when store is redis
+type RedisConfig struct {
+	Address  string `mapstructure:"address"`
+	Password string `mapstructure:"password"`
+	DB       int    `mapstructure:"db"`
+}
+
+// OIDCConfig holds the OpenID Connect settings
+type OIDCConfig struct {
+	Enabled           bool              `mapstructure:"enabled"`
+	AuthorizationPath string            `mapstructure:"authorization-path"`
+	TokenPath         string            `mapstructure:"token-path"`
+	JWKSPath          string            `mapstructure:"jwks-path"`
+	TokenLifetime     time.Duration     `mapstructure:"token-lifetime"`
+	ClaimMap          map[string]string `mapstructure:"claim-map"`
+	Clients           []OIDCClient      `mapstructure:"clients"`
+}
+
+// CORSConfig holds the policy for cross-origin reads of the metadata, OpenID Connect discovery document, and JWKS
+type CORSConfig struct {
+	// Origins such as https://tools.example.com, or * for any origin. CORS is off when it's empty.
+	AllowedOrigins []string      `mapstructure:"allowed-origins"`
+	AllowedMethods []string      `mapstructure:"allowed-methods"`
+	AllowedHeaders []string      `mapstructure:"allowed-headers"`
+	MaxAge         time.Duration `mapstructure:"max-age"`
+}
+
+// DefaultConfig returns a Config with the default value of every setting
+func DefaultConfig() Config {
+	settings := viper.New()
+	setDefaults(settings)
+	config := Config{}
+	// The defaults are all valid, so they always decode
+	settings.Unmarshal(&config)
+	return config
+}
+
+// New returns an IDP configured by config instead of the global viper configuration and builds its Handler.
+// To customize the IDP's public fields, set them on an IDP with Config set and call Handler instead.
+func New(config Config) (*IDP, error) {
+	i := &IDP{Config: &config}
+	if _, err := i.Handler(); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+// settings loads the config into a viper instance so it's read the same way as the global configuration
+func (c *Config) settings() *viper.Viper {
+	settings := viper.New()
+	setDefaults(settings)
+	setSettings(settings, "", reflect.ValueOf(*c))
+	return settings
+}
+
+// setSettings sets a key for each field of the section, descending into nested sections like ldap
+func setSettings(settings *viper.Viper, prefix string, section reflect.Value) {
+	for n := 0; n < section.NumField(); n++ {
+		field := section.Type().Field(n)
+		key := prefix + field.Tag.Get("mapstructure")
+		if field.Type.Kind() == reflect.Struct {
+			setSettings(settings, key+".", section.Field(n))
+			continue
+		}
+		settings.Set(key, settingValue(section.Field(n)))
+	}
+}
+
+// settingValue converts structs to the maps that are read from configuration files, since that's all
+// UnmarshalKey can decode. Slices and maps are converted because they may contain structs.
+func settingValue(value reflect.Value) interface{} {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return nil
+		}
+		return settingValue(value.Elem())
+	case reflect.Struct:
+		m := map[string]interface{}{}
+		for n := 0; n < value.NumField(); n++ {
+			if field := value.Type().Field(n); field.PkgPath == "" {
+				m[strings.ToLower(field.Name)] = settingValue(value.Field(n))
+			}
+		}
+		return m
+	case reflect.Slice:
+		if value.IsNil() {
+			return nil
+		}
+		s := make([]interface{}, value.Len())
+		for n := range s {
+			s[n] = settingValue(value.Index(n))
+		}
+		return s
+	case reflect.Map:
+		if value.IsNil() {
+			return nil
+		}
+		m := map[string]interface{}{}
+		for _, key := range value.MapKeys() {
+			m[key.String()] = settingValue(value.MapIndex(key))
+		}
+		return m
+	}
+	return value.Interface()
+}
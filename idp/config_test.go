@@ -0,0 +1,135 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func testConfig(t *testing.T) Config {
+	config := DefaultConfig()
+	config.TLSCertificate = filepath.Join("testdata", "certificate.pem")
+	config.TLSPrivateKey = filepath.Join("testdata", "key.pem")
+	config.TLSCA = filepath.Join("testdata", "certificate.pem")
+	f, err := os.Open(filepath.Join("testdata", "sp-metadata.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sp, err := ReadSPMetadata(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.ServiceProviders = []ServiceProvider{*sp}
+	return config
+}
+
+func TestDefaultConfig(t *testing.T) {
+	config := DefaultConfig()
+	assert.Equal(t, "/SAML2/Redirect/SSO", config.SSOServicePath)
+	assert.Equal(t, 3*time.Minute, config.ClockSkew)
+	assert.Equal(t, "(uid=%s)", config.LDAP.UserFilter)
+	assert.Equal(t, time.Hour, config.OIDC.TokenLifetime)
+	assert.True(t, config.WantAuthnRequestsSigned)
+}
+
+func TestNew(t *testing.T) {
+	config := testConfig(t)
+	config.EntityID = "https://embedded.example.com/"
+	config.AssertionLifetime = 2 * time.Minute
+	// The global configuration shouldn't be used
+	viper.Set("assertion-lifetime", "-1m")
+	defer viper.Set("assertion-lifetime", "5m")
+	i, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+	assert.Equal(t, "https://embedded.example.com/", i.entityID)
+	assert.Equal(t, 2*time.Minute, i.assertionLifetime)
+	if _, ok := i.sps.get("dex"); !ok {
+		t.Error("service providers should be registered from the config")
+	}
+
+	config.SessionLifetime = 0
+	_, err = New(config)
+	assert.Error(t, err, "configuration errors should be returned")
+}
+
+func TestNew_basePath(t *testing.T) {
+	config := testConfig(t)
+	config.BasePath = "/idp/"
+	i, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer i.Close()
+	handler, _ := i.Handler()
+	mux := http.NewServeMux()
+	mux.Handle("/idp/", handler)
+	ts := httptest.NewTLSServer(mux)
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "/idp/metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "routes should be served under the base path")
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(data), `entityID="https://idp.example.com:9443/idp/"`)
+	assert.Contains(t, string(data), `Location="https://idp.example.com:9443/idp/SAML2/Redirect/SSO"`)
+
+	req, err := i.unsolicitedRequest("dex", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	i.authenticate(req, w, httptest.NewRequest("GET", "/idp/SAML2/Unsolicited/SSO", nil))
+	assert.Regexp(t, "^/idp/ui/login.html", w.Header().Get("Location"), "the login page is under the base path")
+
+	config.BasePath = "idp"
+	_, err = New(config)
+	assert.Error(t, err, "base paths must be absolute")
+}
+
+func TestIDP_ReloadConfig(t *testing.T) {
+	i, err := New(testConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := testConfig(t)
+	config.EntityID = "https://reloaded.example.com/"
+	next, err := i.ReloadConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, i.Close())
+	defer next.Close()
+	assert.Equal(t, "https://reloaded.example.com/", next.entityID)
+	assert.Equal(t, i.TempCache, next.TempCache, "caches should be shared")
+}
@@ -0,0 +1,84 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/xmlsig"
+)
+
+const (
+	// how the subject of assertions is confirmed for service providers
+	subjectConfirmationBearer      = "bearer"
+	subjectConfirmationHolderOfKey = "holder-of-key"
+)
+
+// noConfirmationKeyStatus tells a service provider that wants holder-of-key confirmation that the user didn't log in
+// with a certificate
+var noConfirmationKeyStatus = &saml.Status{
+	StatusCode: saml.StatusCode{
+		Value: "urn:oasis:names:tc:SAML:2.0:status:Responder",
+		StatusCode: &saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:AuthnFailed",
+		},
+	},
+}
+
+// validateSubjectConfirmation ensures the service provider's subject confirmation method is supported
+func (sp *ServiceProvider) validateSubjectConfirmation() error {
+	switch sp.SubjectConfirmation {
+	case "", subjectConfirmationBearer, subjectConfirmationHolderOfKey:
+		return nil
+	}
+	return fmt.Errorf("subject confirmation for service provider %s must be bearer or holder-of-key, not %q",
+		sp.EntityID, sp.SubjectConfirmation)
+}
+
+// holderOfKey reports whether the service provider wants holder-of-key subject confirmation
+func (i *IDP) holderOfKey(entityID string) bool {
+	sp, ok := i.sps.get(entityID)
+	return ok && sp.SubjectConfirmation == subjectConfirmationHolderOfKey
+}
+
+// subjectConfirmation confirms the subject of the assertion for the request. Holder-of-key confirmation names the
+// certificate the user logged in with, so only the client that holds its private key can present the assertion.
+func (i *IDP) subjectConfirmation(request *model.AuthnRequest, user *model.User, notOnOrAfter time.Time) *saml.SubjectConfirmation {
+	confirmation := &saml.SubjectConfirmation{
+		Method: "urn:oasis:names:tc:SAML:2.0:cm:bearer",
+		SubjectConfirmationData: &saml.SubjectConfirmationData{
+			Address:      net.ParseIP(user.IP),
+			InResponseTo: request.ID,
+			Recipient:    request.AssertionConsumerServiceURL,
+			NotOnOrAfter: notOnOrAfter,
+		},
+	}
+	if i.holderOfKey(request.Issuer) {
+		confirmation.Method = "urn:oasis:names:tc:SAML:2.0:cm:holder-of-key"
+		data := confirmation.SubjectConfirmationData
+		// The type is in the SAML assertion namespace, which is the element's default namespace
+		data.XMLNSXSI = "http://www.w3.org/2001/XMLSchema-instance"
+		data.Type = "KeyInfoConfirmationDataType"
+		data.KeyInfo = &xmlsig.KeyInfo{X509Data: &xmlsig.X509Data{
+			X509Certificate: base64.StdEncoding.EncodeToString(user.Certificate),
+		}}
+	}
+	return confirmation
+}
@@ -0,0 +1,84 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"crypto"
+	"encoding/base64"
+	"encoding/xml"
+	"testing"
+
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_makeAuthnResponse_holderOfKey(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.sps.get("dex")
+	sps := []ServiceProvider{*dex}
+	sps[0].SubjectConfirmation = subjectConfirmationHolderOfKey
+	viper.Set("sps", sps)
+	defer viper.Set("sps", nil)
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	cert := newClientCertificate(t)
+	user := &model.User{Name: "joe", IP: "127.0.0.1", Certificate: cert.Raw}
+
+	response, err := i.makeAuthnResponse(&model.AuthnRequest{ID: "request", Issuer: "dex"}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirmation := response.Assertion.Subject.SubjectConfirmation
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:cm:holder-of-key", confirmation.Method)
+	data := confirmation.SubjectConfirmationData
+	assert.Equal(t, "request", data.InResponseTo)
+	if assert.NotNil(t, data.KeyInfo) && assert.NotNil(t, data.KeyInfo.X509Data) {
+		assert.Equal(t, base64.StdEncoding.EncodeToString(cert.Raw), data.KeyInfo.X509Data.X509Certificate)
+	}
+	if err = i.signResponse(context.Background(), response, "dex"); err != nil {
+		t.Fatal(err)
+	}
+	assertion, err := xml.Marshal(response.Assertion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(assertion), `xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance" xsi:type="KeyInfoConfirmationDataType"`)
+	assert.NoError(t, dsig.Verify(assertion, i.SigningCertificate.PrivateKey.(crypto.Signer).Public()))
+
+	response, err = i.makeAuthnResponse(&model.AuthnRequest{ID: "request", Issuer: "other"}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	confirmation = response.Assertion.Subject.SubjectConfirmation
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:cm:bearer", confirmation.Method, "bearer is the default")
+	assert.Nil(t, confirmation.SubjectConfirmationData.KeyInfo)
+
+	// Users who logged in with a password don't have a key to confirm
+	response, err = i.makeAuthnResponse(&model.AuthnRequest{ID: "request", Issuer: "dex"}, &model.User{Name: "joe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, response.Assertion)
+	assert.Equal(t, noConfirmationKeyStatus, response.Status)
+
+	sps[0].SubjectConfirmation = "sender-vouches"
+	viper.Set("sps", sps)
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err)
+}
@@ -0,0 +1,292 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// consentPagePath is where users approve the attributes released to a service provider
+	consentPagePath = "/ui/consent.html"
+	// consentAccept is the value of the consent field when the user approves the release
+	consentAccept = "accept"
+)
+
+// ConsentPage is passed to the consent-template
+type ConsentPage struct {
+	// Name of the service provider, its entity ID if it doesn't have one
+	ServiceProvider string
+	// Attributes that will be released if the user approves
+	Attributes   []ConsentAttribute
+	Error        string
+	HiddenFields []HiddenField
+	// Language the page is shown in and its messages, such as .Messages.consentAccept
+	Lang     string
+	Messages Messages
+}
+
+// ConsentAttribute is an attribute listed on the consent page
+type ConsentAttribute struct {
+	Name   string
+	Values []string
+}
+
+// configureConsent parses the consent-template if one is set, otherwise the built-in page is used
+func (i *IDP) configureConsent() error {
+	i.consentEnabled = i.settings.GetBool("consent-enabled")
+	if i.ConsentCache == nil {
+		cache, err := i.newCache("consent:", 0)
+		if err != nil {
+			return err
+		}
+		i.ConsentCache = cache
+	}
+	if file := i.settings.GetString("consent-template"); file != "" {
+		templ, err := htmltemplate.ParseFiles(file)
+		if err != nil {
+			return err
+		}
+		i.consentTemplate = templ
+		return nil
+	}
+	templ, err := htmltemplate.New("consent").Parse(consentTemplate)
+	if err != nil {
+		return err
+	}
+	i.consentTemplate = templ
+	return nil
+}
+
+// consentRequired reports whether users approve the attributes released to the service provider or client.
+// The service provider's Consent takes precedence over consent-enabled.
+func (i *IDP) consentRequired(entityID string) bool {
+	if sp, ok := i.sps.get(entityID); ok && sp.Consent != nil {
+		return *sp.Consent
+	}
+	return i.consentEnabled
+}
+
+// consentKey identifies the user's decision for the service provider in the ConsentCache
+func consentKey(user, entityID string) string {
+	sum := sha256.Sum256([]byte(user + "\x00" + entityID))
+	return "consent:" + hex.EncodeToString(sum[:])
+}
+
+// consentFingerprint summarizes the released attributes and their values, so users are asked again when they change
+func consentFingerprint(atts []*model.Attribute) string {
+	entries := make([]string, len(atts))
+	for n, att := range atts {
+		values := append([]string(nil), att.Value...)
+		sort.Strings(values)
+		entries[n] = att.Name + "\x00" + strings.Join(values, "\x00")
+	}
+	sort.Strings(entries)
+	sum := sha256.Sum256([]byte(strings.Join(entries, "\x01")))
+	return hex.EncodeToString(sum[:])
+}
+
+// askConsent sends the user to the consent page if they haven't approved the attributes that would be released to
+// the service provider. Passive requests get a NoPassive status instead. It returns false without writing a
+// response if the user already approved them, nothing would be released, or consent isn't required.
+func (i *IDP) askConsent(authRequest *model.AuthnRequest, user *model.User,
+	w http.ResponseWriter, r *http.Request) (bool, error) {
+	if !i.consentRequired(authRequest.Issuer) {
+		return false, nil
+	}
+	released := i.releasedAttributes(user, authRequest.Issuer)
+	if len(released) == 0 {
+		return false, nil
+	}
+	data, err := i.ConsentCache.Get(consentKey(user.Name, authRequest.Issuer))
+	if err == nil && string(data) == consentFingerprint(released) {
+		return false, nil
+	}
+	if err != nil && err != store.ErrNotFound {
+		return false, err
+	}
+	if authRequest.IsPassive && authRequest.ProtocolBinding != oidcBinding {
+		log.Infof("unable to respond to passive request from %s until %s approves the release of attributes",
+			authRequest.Issuer, user.Name)
+		return true, i.sendNoPassive(authRequest, w, r)
+	}
+	id := uuid.New().String()
+	if err = i.savePendingLogin(id, &model.PendingLogin{User: user, Request: authRequest}); err != nil {
+		return false, err
+	}
+	http.Redirect(w, r, keepLocale(r, fmt.Sprintf("%s%s?requestId=%s", i.basePath, consentPagePath, url.QueryEscape(id))), http.StatusFound)
+	return true, nil
+}
+
+// pendingConsent returns the login waiting for the user's approval
+func (i *IDP) pendingConsent(id string) (*model.PendingLogin, error) {
+	data, err := i.TempCache.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	pending := &model.PendingLogin{}
+	if err = proto.Unmarshal(data, pending); err != nil {
+		return nil, err
+	}
+	if pending.User == nil || pending.Request == nil {
+		return nil, errors.New("pending login is missing the user or request")
+	}
+	return pending, nil
+}
+
+// DefaultConsentPageHandler is the default implementation for the consent page handler. It lists the attributes that
+// will be released to the service provider for the user to approve. It can be used as is, wrapped in other handlers,
+// or replaced completely.
+func (i *IDP) DefaultConsentPageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get("requestId")
+		pending, err := i.pendingConsent(id)
+		if err != nil {
+			i.writeError(w, r, err, http.StatusBadRequest)
+			return
+		}
+		i.renderConsentPage(w, r, id, pending, "", http.StatusOK)
+	}
+}
+
+func (i *IDP) renderConsentPage(w http.ResponseWriter, r *http.Request, id string, pending *model.PendingLogin,
+	message string, status int) {
+	entityID := pending.Request.Issuer
+	lang, messages := i.messages(r)
+	page := ConsentPage{
+		ServiceProvider: i.spDisplayName(entityID, lang),
+		Attributes:      []ConsentAttribute{},
+		Error:           messages.text(message),
+		HiddenFields:    []HiddenField{{"requestId", id}, {csrfField, csrfToken(i.setLoginCookie(w, r), id)}},
+		Lang:            lang,
+		Messages:        messages,
+	}
+	for _, att := range i.releasedAttributes(pending.User, entityID) {
+		page.Attributes = append(page.Attributes, ConsentAttribute{Name: att.Name, Values: att.Value})
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", lang)
+	w.WriteHeader(status)
+	if err := i.consentTemplate.Execute(w, page); err != nil {
+		log.Error(err)
+	}
+}
+
+// DefaultConsentHandler is the default implementation for the consent handler. It records the user's approval and
+// sends the response to the service provider, or shows the user that they can't log in if they decline. It can be
+// used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultConsentHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			err := r.ParseForm()
+			if err != nil {
+				return err
+			}
+			id := r.Form.Get("requestId")
+			pending, err := i.pendingConsent(id)
+			if err != nil {
+				return err
+			}
+			if err = i.checkCSRFToken(r); err != nil {
+				log.Warnf("rejecting consent form from %s: %v", getIP(r), err)
+				i.renderConsentPage(w, r, id, pending, "Your form expired. Please try again.", http.StatusForbidden)
+				return nil
+			}
+			if err = i.TempCache.Delete(id); err != nil {
+				return err
+			}
+			user, req := pending.User, pending.Request
+			recordServiceProvider(r, i.spLabel(req.Issuer))
+			released := i.releasedAttributes(user, req.Issuer)
+			names := make([]string, len(released))
+			for n, att := range released {
+				names[n] = att.Name
+			}
+			if r.Form.Get("consent") != consentAccept {
+				correlationID := uuid.New().String()
+				log.WithFields(log.Fields{
+					"event":          "consent_declined",
+					"user":           user.Name,
+					"sp":             req.Issuer,
+					"attributes":     names,
+					"correlation_id": correlationID,
+				}).Info("user declined the release of attributes")
+				recordCorrelationID(r, correlationID)
+				lang, messages := i.messages(r)
+				i.renderErrorPage(w, ErrorPage{
+					Status:        http.StatusForbidden,
+					Title:         messages.text("consentDeclinedTitle"),
+					Message:       messages.text("consentDeclinedMessage"),
+					CorrelationID: correlationID,
+					Lang:          lang,
+					Messages:      messages,
+				})
+				return nil
+			}
+			if err = i.ConsentCache.Set(consentKey(user.Name, req.Issuer), []byte(consentFingerprint(released))); err != nil {
+				return err
+			}
+			log.WithFields(log.Fields{
+				"event":      "consent_given",
+				"user":       user.Name,
+				"sp":         req.Issuer,
+				"attributes": names,
+			}).Info("user approved the release of attributes")
+			return i.reportFailure(req, i.sendResponse(req, user, w, r), w, r)
+		}()
+		if err != nil {
+			i.writeError(w, r, err, http.StatusInternalServerError)
+		}
+	}
+}
+
+const consentTemplate = `<!DOCTYPE html>
+<html lang="{{ .Lang }}" class="login-pf">
+<head><meta charset="UTF-8"><title>{{ .Messages.consentTitle }}</title><link href="styles-9b468590c18b8fbba512.css" rel="stylesheet"></head>
+<body>
+<div class="container"><div class="row">
+<div class="col-sm-12">{{ if .Error }}<div class="alert alert-danger"><span class="pficon pficon-error-circle-o"></span> {{ .Error }}</div>{{ end }}</div>
+<div class="col-sm-12">
+<p>{{ printf .Messages.consentIntro .ServiceProvider }}</p>
+<table class="table">
+{{ range .Attributes }}<tr><th>{{ .Name }}</th><td>{{ range $n, $v := .Values }}{{ if $n }}<br>{{ end }}{{ $v }}{{ end }}</td></tr>
+{{ end }}</table>
+<form class="form-horizontal" role="form" method="POST">
+{{ range .HiddenFields }}<input type="hidden" name="{{ .Name }}" value="{{ .Value }}">
+{{ end }}<div class="form-group"><div class="col-sm-12 submit">
+<button type="submit" name="consent" value="decline" class="btn btn-default btn-lg">{{ .Messages.consentDecline }}</button>
+<button type="submit" name="consent" value="accept" class="btn btn-primary btn-lg" autofocus>{{ .Messages.consentAccept }}</button>
+</div></div>
+</form>
+</div>
+<div class="col-sm-12 details"><p>{{ .Messages.consentRemembered }}</p></div>
+</div></div>
+</body>
+</html>`
@@ -0,0 +1,133 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// mailSource gives every user the mail address
+type mailSource struct {
+	mail *string
+}
+
+func (s mailSource) AddAttributes(user *model.User, _ *model.AuthnRequest) error {
+	user.AppendAttributes([]*model.Attribute{{Name: "mail", Value: []string{*s.mail}}})
+	return nil
+}
+
+func TestIDP_DefaultConsentHandler(t *testing.T) {
+	viper.Set("consent-enabled", true)
+	defer viper.Set("consent-enabled", false)
+	mail := "joe@example.com"
+	i := &IDP{PasswordValidator: acceptingValidator{}, AttributeSources: []AttributeSource{mailSource{&mail}}}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	data, err := proto.Marshal(&model.AuthnRequest{
+		ID:                          "2134",
+		Issuer:                      "dex",
+		AssertionConsumerServiceURL: "http://127.0.0.1:5556/dex/callback",
+		ProtocolBinding:             artifactBinding,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := ts.Client()
+	client.CheckRedirect = func(r *http.Request, old []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	// login returns the location users are sent to after entering their password
+	login := func() *url.URL {
+		i.TempCache.Set("1234", data)
+		resp, err := postLoginForm(client, i, ts.URL+"/ui/login.html",
+			url.Values{"requestId": {"1234"}, "username": {"joe"}, "password": {"password"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return location
+	}
+	consent := func(id, decision string) *http.Response {
+		resp, err := postLoginForm(client, i, ts.URL+consentPagePath, url.Values{"requestId": {id}, "consent": {decision}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	location := login()
+	if !assert.Equal(t, consentPagePath, location.Path, "users should approve the release of attributes") {
+		return
+	}
+	id := location.Query().Get("requestId")
+	resp, err := client.Get(ts.URL + consentPagePath + "?requestId=" + url.QueryEscape(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "mail", doc.Find("th").First().Text())
+	assert.Equal(t, mail, doc.Find("td").First().Text())
+	_, ok := doc.Find("form input[name=csrfToken]").Attr("value")
+	assert.True(t, ok, "the form should include a CSRF token")
+
+	resp = consent(id, "decline")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	_, err = i.TempCache.Get(id)
+	assert.Error(t, err, "the pending login should be discarded")
+
+	id = login().Query().Get("requestId")
+	resp = consent(id, consentAccept)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Location"), "http://127.0.0.1:5556/dex/callback"))
+
+	location = login()
+	assert.Equal(t, "http://127.0.0.1:5556/dex/callback", location.Scheme+"://"+location.Host+location.Path,
+		"users shouldn't be asked again")
+
+	mail = "joe@example.org"
+	assert.Equal(t, consentPagePath, login().Path, "users should be asked again when the attributes change")
+
+	sps := []ServiceProvider{*i.sps.list()[0]}
+	declined := false
+	sps[0].Consent = &declined
+	viper.Set("sps", sps)
+	defer viper.Set("sps", nil)
+	i = &IDP{PasswordValidator: acceptingValidator{}, AttributeSources: []AttributeSource{mailSource{&mail}}}
+	ts = getTestIDP(t, i)
+	defer ts.Close()
+	client = ts.Client()
+	client.CheckRedirect = func(r *http.Request, old []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	assert.NotEqual(t, consentPagePath, login().Path, "the service provider's setting should take precedence")
+}
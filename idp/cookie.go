@@ -0,0 +1,65 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+var sameSiteModes = map[string]http.SameSite{
+	"none":   http.SameSiteNoneMode,
+	"lax":    http.SameSiteLaxMode,
+	"strict": http.SameSiteStrictMode,
+}
+
+// configureSessionCookie reads the name and attributes of the session cookie
+func (i *IDP) configureSessionCookie() error {
+	i.cookieName = i.settings.GetString("cookie-name")
+	if i.cookieName == "" {
+		return errors.New("cookie-name is required")
+	}
+	sameSite, ok := sameSiteModes[strings.ToLower(i.settings.GetString("cookie-same-site"))]
+	if !ok {
+		return fmt.Errorf("cookie-same-site must be none, lax, or strict, not %s", i.settings.GetString("cookie-same-site"))
+	}
+	secure := i.settings.GetBool("cookie-secure")
+	// Browsers drop SameSite=None cookies that aren't Secure
+	if sameSite == http.SameSiteNoneMode && !secure {
+		return errors.New("cookie-secure must be set when cookie-same-site is none")
+	}
+	path := i.settings.GetString("cookie-path")
+	if path == "" {
+		path = i.basePath + "/"
+	}
+	i.sessionCookieAttributes = http.Cookie{
+		Name:     i.cookieName,
+		Path:     path,
+		Domain:   i.settings.GetString("cookie-domain"),
+		Secure:   secure,
+		HttpOnly: i.settings.GetBool("cookie-http-only"),
+		SameSite: sameSite,
+	}
+	return nil
+}
+
+// sessionCookie returns the session cookie with the configured attributes holding value
+func (i *IDP) sessionCookie(value string) *http.Cookie {
+	cookie := i.sessionCookieAttributes
+	cookie.Value = value
+	return &cookie
+}
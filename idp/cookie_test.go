@@ -0,0 +1,75 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_sessionCookie(t *testing.T) {
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	w := httptest.NewRecorder()
+	req := &model.AuthnRequest{ProtocolBinding: postBinding}
+	if err := i.respond(req, &model.User{}, w, httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		cookie := cookies[0]
+		assert.Equal(t, "lite-idp-sess", cookie.Name)
+		assert.True(t, cookie.Secure)
+		assert.True(t, cookie.HttpOnly)
+		assert.Equal(t, http.SameSiteNoneMode, cookie.SameSite, "cross-site posts need SameSite=None")
+		assert.Equal(t, "/", cookie.Path)
+	}
+
+	viper.Set("cookie-name", "sso")
+	viper.Set("cookie-same-site", "Lax")
+	viper.Set("cookie-domain", "example.com")
+	viper.Set("cookie-path", "/saml/")
+	defer func() {
+		viper.Set("cookie-name", "lite-idp-sess")
+		viper.Set("cookie-same-site", "none")
+		viper.Set("cookie-domain", "")
+		viper.Set("cookie-path", "")
+	}()
+	i = &IDP{settings: viper.GetViper()}
+	if assert.NoError(t, i.configureSessionCookie()) {
+		cookie := i.sessionCookie("value")
+		assert.Equal(t, "sso", cookie.Name)
+		assert.Equal(t, "value", cookie.Value)
+		assert.Equal(t, http.SameSiteLaxMode, cookie.SameSite)
+		assert.Equal(t, "example.com", cookie.Domain)
+		assert.Equal(t, "/saml/", cookie.Path)
+	}
+}
+
+func TestIDP_configureSessionCookie_invalid(t *testing.T) {
+	defer viper.Set("cookie-secure", true)
+	defer viper.Set("cookie-same-site", "none")
+	viper.Set("cookie-secure", false)
+	assert.Error(t, (&IDP{settings: viper.GetViper()}).configureSessionCookie(), "SameSite=None requires Secure")
+	viper.Set("cookie-same-site", "strict")
+	assert.NoError(t, (&IDP{settings: viper.GetViper()}).configureSessionCookie())
+	viper.Set("cookie-same-site", "sometimes")
+	assert.Error(t, (&IDP{settings: viper.GetViper()}).configureSessionCookie())
+}
@@ -0,0 +1,117 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// corsPolicy lets browser tools on other origins read documents that are public anyway, such as the metadata
+type corsPolicy struct {
+	anyOrigin bool
+	origins   map[string]bool
+	methods   string
+	headers   string
+	maxAge    string
+}
+
+// configureCORS reads the origins allowed to read the metadata, OpenID Connect discovery document, and JWKS.
+// There's no policy unless cors.allowed-origins is set.
+func (i *IDP) configureCORS() error {
+	i.cors = nil
+	origins := i.settings.GetStringSlice("cors.allowed-origins")
+	if len(origins) == 0 {
+		return nil
+	}
+	policy := &corsPolicy{origins: map[string]bool{}}
+	for _, origin := range origins {
+		if origin == "*" {
+			policy.anyOrigin = true
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return fmt.Errorf("cors.allowed-origins %q must be a scheme and host such as https://tools.example.com", origin)
+		}
+		policy.origins[strings.ToLower(origin)] = true
+	}
+	methods := []string{}
+	for _, method := range i.settings.GetStringSlice("cors.allowed-methods") {
+		methods = append(methods, strings.ToUpper(method))
+	}
+	if len(methods) == 0 {
+		return fmt.Errorf("cors.allowed-methods can't be empty when cors.allowed-origins is set")
+	}
+	policy.methods = strings.Join(methods, ", ")
+	policy.headers = strings.Join(i.settings.GetStringSlice("cors.allowed-headers"), ", ")
+	maxAge := i.settings.GetDuration("cors.max-age")
+	if maxAge < 0 {
+		return fmt.Errorf("cors.max-age can't be negative")
+	}
+	policy.maxAge = strconv.Itoa(int(maxAge.Seconds()))
+	i.cors = policy
+	return nil
+}
+
+// allowedOrigin returns the Access-Control-Allow-Origin for a request from origin, or an empty string if the
+// origin isn't allowed
+func (p *corsPolicy) allowedOrigin(origin string) string {
+	switch {
+	case origin == "":
+		return ""
+	case p.anyOrigin:
+		return "*"
+	case p.origins[strings.ToLower(origin)]:
+		return origin
+	}
+	return ""
+}
+
+// handleCORS routes GET requests for path to handler and lets the origins in the CORS policy read the responses.
+// Preflight requests are answered with the allowed methods and headers. Credentials are never allowed, so the
+// session cookie isn't sent with cross-origin requests.
+func (i *IDP) handleCORS(r *httprouter.Router, path string, handler http.HandlerFunc) {
+	if i.cors == nil {
+		r.HandlerFunc("GET", path, handler)
+		return
+	}
+	policy := i.cors
+	r.HandlerFunc("GET", path, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		if origin := policy.allowedOrigin(req.Header.Get("Origin")); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+		handler(w, req)
+	})
+	r.HandlerFunc("OPTIONS", path, func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		// Browsers don't read the response of a preflight for an origin that isn't allowed
+		if origin := policy.allowedOrigin(req.Header.Get("Origin")); origin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", policy.methods)
+			if policy.headers != "" {
+				w.Header().Set("Access-Control-Allow-Headers", policy.headers)
+			}
+			w.Header().Set("Access-Control-Max-Age", policy.maxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
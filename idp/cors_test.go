@@ -0,0 +1,90 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_handleCORS(t *testing.T) {
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	r := httptest.NewRequest("GET", "/metadata", nil)
+	r.Header.Set("Origin", "https://tools.example.com")
+	w := httptest.NewRecorder()
+	i.Router.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"), "there's no CORS by default")
+
+	viper.Set("cors.allowed-origins", []string{"https://tools.example.com"})
+	viper.Set("cors.allowed-headers", []string{"Accept"})
+	defer viper.Set("cors.allowed-origins", []string{})
+	defer viper.Set("cors.allowed-headers", []string{})
+	viper.Set("oidc.enabled", true)
+	defer viper.Set("oidc.enabled", false)
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	for _, path := range []string{"/metadata", oidcDiscoveryPath, "/oidc/jwks"} {
+		r = httptest.NewRequest("GET", path, nil)
+		r.Header.Set("Origin", "https://TOOLS.example.com")
+		w = httptest.NewRecorder()
+		i.Router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Equal(t, "https://TOOLS.example.com", w.Header().Get("Access-Control-Allow-Origin"), path)
+		assert.Equal(t, "Origin", w.Header().Get("Vary"), path)
+
+		r = httptest.NewRequest("OPTIONS", path, nil)
+		r.Header.Set("Origin", "https://tools.example.com")
+		r.Header.Set("Access-Control-Request-Method", "GET")
+		w = httptest.NewRecorder()
+		i.Router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNoContent, w.Code, path)
+		assert.Equal(t, "GET", w.Header().Get("Access-Control-Allow-Methods"), path)
+		assert.Equal(t, "Accept", w.Header().Get("Access-Control-Allow-Headers"), path)
+		assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"), path)
+		assert.Empty(t, w.Header().Get("Access-Control-Allow-Credentials"), path)
+	}
+
+	r = httptest.NewRequest("OPTIONS", "/metadata", nil)
+	r.Header.Set("Origin", "https://evil.example.com")
+	w = httptest.NewRecorder()
+	i.Router.ServeHTTP(w, r)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"), "other origins aren't allowed")
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Methods"))
+
+	r = httptest.NewRequest("GET", "/SAML2/Redirect/SSO", nil)
+	r.Header.Set("Origin", "https://tools.example.com")
+	w = httptest.NewRecorder()
+	i.Router.ServeHTTP(w, r)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"), "CORS doesn't apply to single sign-on")
+
+	viper.Set("cors.allowed-origins", []string{"*"})
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	r = httptest.NewRequest("GET", "/metadata", nil)
+	r.Header.Set("Origin", "https://any.example.com")
+	w = httptest.NewRecorder()
+	i.Router.ServeHTTP(w, r)
+	assert.Equal(t, "*", w.Header().Get("Access-Control-Allow-Origin"))
+
+	viper.Set("cors.allowed-origins", []string{"https://tools.example.com/path"})
+	_, err := (&IDP{}).Handler()
+	assert.Error(t, err, "origins don't have a path")
+}
@@ -0,0 +1,73 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+)
+
+// csrfField is the name of the hidden login form field holding the CSRF token
+const csrfField = "csrfToken"
+
+// errCSRFToken is returned when a login form is submitted without the token issued with it
+var errCSRFToken = errors.New("missing or invalid CSRF token")
+
+// loginCookieName is the cookie tying login forms to the browser that was sent to them. It's
+// separate from the session cookie because it's issued before the user is authenticated.
+func (i *IDP) loginCookieName() string {
+	return i.cookieName + "-login"
+}
+
+// setLoginCookie returns the browser's login cookie value, issuing a new one if it doesn't have one
+func (i *IDP) setLoginCookie(w http.ResponseWriter, r *http.Request) string {
+	if cookie, err := r.Cookie(i.loginCookieName()); err == nil && cookie.Value != "" {
+		return cookie.Value
+	}
+	data := make([]byte, 32)
+	rand.Read(data)
+	value := base64.RawURLEncoding.EncodeToString(data)
+	http.SetCookie(w, &http.Cookie{
+		Name:     i.loginCookieName(),
+		Path:     i.basePath + "/ui/",
+		Value:    value,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return value
+}
+
+// csrfToken derives the token for a pending request from the login cookie, so a form can only be
+// submitted by the browser it was rendered for and only for the request it was rendered with
+func csrfToken(loginCookie, requestID string) string {
+	return opaqueID([]byte(loginCookie), requestID)
+}
+
+// checkCSRFToken verifies the token submitted with a login form
+func (i *IDP) checkCSRFToken(r *http.Request) error {
+	cookie, err := r.Cookie(i.loginCookieName())
+	if err != nil || cookie.Value == "" {
+		return errCSRFToken
+	}
+	expected := csrfToken(cookie.Value, r.Form.Get("requestId"))
+	if !hmac.Equal([]byte(expected), []byte(r.Form.Get(csrfField))) {
+		return errCSRFToken
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+const testLoginCookie = "login-cookie"
+
+// postLoginForm submits the login form the way a browser that loaded the login page would
+func postLoginForm(client *http.Client, i *IDP, location string, form url.Values) (*http.Response, error) {
+	form.Set(csrfField, csrfToken(testLoginCookie, form.Get("requestId")))
+	req, err := http.NewRequest("POST", location, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: i.loginCookieName(), Value: testLoginCookie})
+	return client.Do(req)
+}
+
+func TestIDP_DefaultLoginPageHandler(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL + "/ui/login.html?requestId=1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "no-store", resp.Header.Get("Cache-Control"))
+	var cookie *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == i.loginCookieName() {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("login cookie should be set")
+	}
+	assert.True(t, cookie.HttpOnly && cookie.Secure)
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, ok := doc.Find("form input[name=csrfToken]").Attr("value")
+	assert.True(t, ok, "login form should include a CSRF token")
+	assert.Equal(t, csrfToken(cookie.Value, "1234"), token)
+}
+
+func TestIDP_DefaultPasswordLoginHandler_csrf(t *testing.T) {
+	i := &IDP{PasswordValidator: acceptingValidator{}}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	data, err := proto.Marshal(&model.AuthnRequest{ID: "2134"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.TempCache.Set("1234", data)
+	tests := []struct {
+		name   string
+		cookie string
+		token  string
+	}{
+		{"missing token", testLoginCookie, ""},
+		{"missing cookie", "", csrfToken(testLoginCookie, "1234")},
+		{"other request", testLoginCookie, csrfToken(testLoginCookie, "5678")},
+		{"other browser", "other-cookie", csrfToken(testLoginCookie, "1234")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"requestId": {"1234"}, "username": {"joe"}, "password": {"password"}, csrfField: {tt.token}}
+			req, err := http.NewRequest("POST", ts.URL+"/ui/login.html", strings.NewReader(form.Encode()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: i.loginCookieName(), Value: tt.cookie})
+			}
+			resp, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+			doc, err := goquery.NewDocumentFromReader(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, ok := doc.Find("form input[name=csrfToken]").Attr("value")
+			assert.True(t, ok, "the login form should be rendered again")
+			assert.Equal(t, "Your login form expired. Please try again.", doc.Find("#errorMsg").Text())
+		})
+	}
+	_, err = i.TempCache.Get("1234")
+	assert.NoError(t, err, "the pending request should be kept so the user can try again")
+}
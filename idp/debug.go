@@ -0,0 +1,114 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	messageReceived = "received"
+	messageSent     = "sent"
+)
+
+var (
+	// passwordElement matches elements such as the Password of a WS-Security UsernameToken
+	passwordElement = regexp.MustCompile(`(?is)(<(?:[\w.-]+:)?Password\b[^>]*>).*?(</(?:[\w.-]+:)?Password>)`)
+	// passwordAttribute matches SAML attributes whose name mentions a password, such as userPassword
+	passwordAttribute = regexp.MustCompile(`(?is)<(?:[\w.-]+:)?Attribute\b[^>]*Name="[^"]*password[^"]*"[^>]*>.*?</(?:[\w.-]+:)?Attribute>`)
+	attributeValue    = regexp.MustCompile(`(?is)(<(?:[\w.-]+:)?AttributeValue\b[^>]*>).*?(</(?:[\w.-]+:)?AttributeValue>)`)
+)
+
+// configureDebugSAML reads whether SAML messages are logged and checks that the debug-saml-directory exists
+func (i *IDP) configureDebugSAML() error {
+	i.debugSAML = i.settings.GetBool("debug-saml")
+	i.debugSAMLDirectory = i.settings.GetString("debug-saml-directory")
+	if !i.debugSAML || i.debugSAMLDirectory == "" {
+		return nil
+	}
+	info, err := os.Stat(i.debugSAMLDirectory)
+	if err != nil {
+		return fmt.Errorf("debug-saml-directory is unusable: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("debug-saml-directory %s is not a directory", i.debugSAMLDirectory)
+	}
+	return nil
+}
+
+// debugMessage logs the XML of a SAML message that was received or sent when debug-saml is true, and writes it to
+// the debug-saml-directory if one is set. Passwords are redacted from both.
+func (i *IDP) debugMessage(direction string, message []byte) {
+	if !i.debugSAML {
+		return
+	}
+	name := messageName(message)
+	redacted := redactMessage(message)
+	log.WithFields(log.Fields{
+		"event":     "saml_message",
+		"direction": direction,
+		"message":   name,
+	}).Debug(string(redacted))
+	if i.debugSAMLDirectory == "" {
+		return
+	}
+	file := filepath.Join(i.debugSAMLDirectory,
+		fmt.Sprintf("%s-%s-%s.xml", time.Now().UTC().Format("20060102T150405.000000000Z"), direction, name))
+	if err := ioutil.WriteFile(file, redacted, 0600); err != nil {
+		log.Warnf("failed to write SAML message to %s: %v", file, err)
+	}
+}
+
+// messageName returns the local name of the SAML message's root element, or of the first element in the body of a
+// SOAP envelope
+func messageName(message []byte) string {
+	decoder := xml.NewDecoder(bytes.NewReader(message))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "unknown"
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "Envelope", "Body":
+		case "Header":
+			if err = decoder.Skip(); err != nil {
+				return "unknown"
+			}
+		default:
+			return start.Name.Local
+		}
+	}
+}
+
+// redactMessage replaces the values of password elements and attributes. Everything else is left as it was sent.
+func redactMessage(message []byte) []byte {
+	redacted := passwordElement.ReplaceAll(message, []byte("${1}REDACTED${2}"))
+	return passwordAttribute.ReplaceAllFunc(redacted, func(attribute []byte) []byte {
+		return attributeValue.ReplaceAll(attribute, []byte("${1}REDACTED${2}"))
+	})
+}
@@ -0,0 +1,86 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageName(t *testing.T) {
+	assert.Equal(t, "AuthnRequest", messageName([]byte(`<?xml version="1.0"?><samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol"/>`)))
+	assert.Equal(t, "ArtifactResolve", messageName([]byte(`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/">`+
+		`<s:Header><ecp:Request xmlns:ecp="urn:ecp"/></s:Header><s:Body><ArtifactResolve/></s:Body></s:Envelope>`)))
+	assert.Equal(t, "unknown", messageName([]byte("not xml")))
+}
+
+func TestRedactMessage(t *testing.T) {
+	message := `<Envelope><Header><wsse:UsernameToken><wsse:Username>joe</wsse:Username>` +
+		`<wsse:Password Type="text">secret</wsse:Password></wsse:UsernameToken></Header>` +
+		`<saml:Attribute Name="userPassword"><saml:AttributeValue>hunter2</saml:AttributeValue></saml:Attribute>` +
+		`<saml:Attribute Name="mail"><saml:AttributeValue>joe@example.com</saml:AttributeValue></saml:Attribute></Envelope>`
+	redacted := string(redactMessage([]byte(message)))
+	assert.NotContains(t, redacted, "secret")
+	assert.NotContains(t, redacted, "hunter2")
+	assert.Contains(t, redacted, `<wsse:Password Type="text">REDACTED</wsse:Password>`)
+	assert.Contains(t, redacted, "<saml:AttributeValue>joe@example.com</saml:AttributeValue>", "other attributes should be kept")
+	assert.Contains(t, redacted, "<wsse:Username>joe</wsse:Username>")
+}
+
+func TestIDP_debugMessage(t *testing.T) {
+	dir := t.TempDir()
+	viper.Set("debug-saml", true)
+	defer viper.Set("debug-saml", false)
+	viper.Set("debug-saml-directory", dir)
+	defer viper.Set("debug-saml-directory", "")
+	viper.Set("clock-skew", "876000h")
+	defer viper.Set("clock-skew", "3m")
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	in, err := os.Open(filepath.Join("testdata", "attribute-query-request.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer in.Close()
+	resp, err := ts.Client().Post(ts.URL+viper.GetString("attribute-service-path"), "text/xml", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, files, 2, "the query and the response should be written") {
+		assert.True(t, strings.HasSuffix(files[0], "-received-AttributeQuery.xml"), files[0])
+		assert.True(t, strings.HasSuffix(files[1], "-sent-Response.xml"), files[1])
+		data, err := os.ReadFile(files[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Contains(t, string(data), "_f89f4578-fcc9-4348-9b87-f7fe25f7aff3", "the request should be written as it was received")
+	}
+
+	viper.Set("debug-saml-directory", filepath.Join(dir, "missing"))
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err, "the directory must exist")
+}
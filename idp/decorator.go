@@ -0,0 +1,42 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"fmt"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+)
+
+// AssertionDecorator allows implementations to change assertions in ways settings can't express, such as adding
+// Advice or an attribute derived from several sources. It receives the assertion once it's complete, along with the
+// authenticated user, whose Context and AuthnInstant describe how they logged in, and the request it answers.
+// Decorators run before the assertion is signed and encrypted, so their changes are covered by the signature.
+// Returning an error that wraps ErrAuthnFailed, ErrRequestDenied, or ErrUnknownPrincipal sends the service provider
+// that status instead of an assertion.
+type AssertionDecorator interface {
+	DecorateAssertion(*saml.Assertion, *model.User, *model.AuthnRequest) error
+}
+
+// decorateAssertion runs the AssertionDecorators in order. An error from one of them withholds the assertion.
+func (i *IDP) decorateAssertion(assertion *saml.Assertion, user *model.User, request *model.AuthnRequest) error {
+	for n, decorator := range i.AssertionDecorators {
+		if err := decorator.DecorateAssertion(assertion, user, request); err != nil {
+			return fmt.Errorf("assertion decorator %d failed for %s: %w", n, request.Issuer, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"crypto"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/stretchr/testify/assert"
+)
+
+// adviceDecorator adds an Advice element
+type adviceDecorator struct{}
+
+func (adviceDecorator) DecorateAssertion(assertion *saml.Assertion, user *model.User, request *model.AuthnRequest) error {
+	assertion.Advice = &saml.Advice{
+		AssertionIDRef: []string{"_previous"},
+		Other:          `<ex:Note xmlns:ex="urn:example:advice">` + user.Context + `</ex:Note>`,
+	}
+	return nil
+}
+
+// derivedAttributeDecorator adds an attribute derived from the others and the Advice added before it
+type derivedAttributeDecorator struct{}
+
+func (derivedAttributeDecorator) DecorateAssertion(assertion *saml.Assertion, user *model.User, request *model.AuthnRequest) error {
+	if assertion.Advice == nil {
+		return errors.New("advice is missing")
+	}
+	if assertion.AttributeStatement == nil {
+		assertion.AttributeStatement = &saml.AttributeStatement{}
+	}
+	names := []string{}
+	for _, att := range assertion.AttributeStatement.Attribute {
+		names = append(names, att.Name)
+	}
+	assertion.AttributeStatement.Attribute = append(assertion.AttributeStatement.Attribute, saml.Attribute{
+		Name:           "released",
+		NameFormat:     attrNameFormatBasic,
+		AttributeValue: []saml.AttributeValue{{Value: strings.Join(names, " ")}},
+	})
+	return nil
+}
+
+type failingDecorator struct{}
+
+func (failingDecorator) DecorateAssertion(*saml.Assertion, *model.User, *model.AuthnRequest) error {
+	return errors.New("directory is down")
+}
+
+func TestIDP_decorateAssertion(t *testing.T) {
+	i := &IDP{AssertionDecorators: []AssertionDecorator{adviceDecorator{}, derivedAttributeDecorator{}}}
+	getTestIDPWithSP(t, i).Close()
+	user := &model.User{Name: "joe", Context: "urn:oasis:names:tc:SAML:2.0:ac:classes:Password",
+		Attributes: []*model.Attribute{{Name: "mail", Value: []string{"joe@example.com"}}}}
+
+	response, err := i.makeAuthnResponse(&model.AuthnRequest{ID: "request", Issuer: "dex"}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attributes := response.Assertion.AttributeStatement.Attribute
+	if assert.NotEmpty(t, attributes) {
+		assert.Equal(t, "released", attributes[len(attributes)-1].Name, "decorators should run in order")
+	}
+	if err = i.signResponse(context.Background(), response, "dex"); err != nil {
+		t.Fatal(err)
+	}
+	assertion, err := xml.Marshal(response.Assertion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(assertion), `<AssertionIDRef xmlns="urn:oasis:names:tc:SAML:2.0:assertion">_previous</AssertionIDRef>`+
+		`<ex:Note xmlns:ex="urn:example:advice">urn:oasis:names:tc:SAML:2.0:ac:classes:Password</ex:Note></Advice><AuthnStatement`,
+		"the Advice should follow the Conditions")
+	assert.NoError(t, dsig.Verify(assertion, i.SigningCertificate.PrivateKey.(crypto.Signer).Public()),
+		"the signature should cover the decorators' changes")
+
+	i.AssertionDecorators = []AssertionDecorator{failingDecorator{}, adviceDecorator{}}
+	_, err = i.makeAuthnResponse(&model.AuthnRequest{ID: "request", Issuer: "dex"}, user)
+	assert.Error(t, err, "the assertion should be withheld")
+}
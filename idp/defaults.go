@@ -19,18 +19,157 @@ import (
 )
 
 func init() {
-	viper.SetDefault("cookie-name", "lite-idp-sess")
-	viper.SetDefault("tls-certificate", "/etc/lite-idp/cert.pem")
-	viper.SetDefault("tls-private-key", "/etc/lite-idp/key.pem")
-	viper.SetDefault("tls-ca", "")
-	viper.SetDefault("listen-address", "127.0.0.1:9443")
-	viper.SetDefault("server-name", "idp.example.com:9443")
-	viper.SetDefault("metadata-path", "/metadata")
-	viper.SetDefault("sso-service-path", "/SAML2/Redirect/SSO")
-	viper.SetDefault("artifact-service-path", "/SAML2/SOAP/ArtifactResolution")
-	viper.SetDefault("attribute-service-path", "/SAML2/SOAP/AttributeQuery")
-	viper.SetDefault("temp-cache-duration", "5m")
-	viper.SetDefault("user-cache-duration", "8h")
-	viper.SetDefault("signature-algorithm", "")
-	viper.SetDefault("digest-algorithm", "http://www.w3.org/2001/04/xmlenc#sha256")
+	setDefaults(viper.GetViper())
+}
+
+// setDefaults registers the default value of every setting with settings
+func setDefaults(settings *viper.Viper) {
+	settings.SetDefault("cookie-name", "lite-idp-sess")
+	settings.SetDefault("cookie-secure", true)
+	settings.SetDefault("cookie-http-only", true)
+	settings.SetDefault("cookie-same-site", "none")
+	settings.SetDefault("cookie-path", "")
+	settings.SetDefault("cookie-domain", "")
+	settings.SetDefault("tls-certificate", "/etc/lite-idp/cert.pem")
+	settings.SetDefault("tls-private-key", "/etc/lite-idp/key.pem")
+	settings.SetDefault("tls-ca", "")
+	settings.SetDefault("tls-min-version", "1.2")
+	settings.SetDefault("tls-cipher-suites", []string{})
+	settings.SetDefault("tls-ocsp-stapling", false)
+	settings.SetDefault("signing-certificate", "")
+	settings.SetDefault("signing-private-key", "")
+	settings.SetDefault("signing-pin", "")
+	settings.SetDefault("additional-signing-certificates", []string{})
+	settings.SetDefault("listen-address", "127.0.0.1:9443")
+	settings.SetDefault("dev-mode", false)
+	settings.SetDefault("dev-mode-allow-remote", false)
+	settings.SetDefault("dev-users", []UserConfig{})
+	settings.SetDefault("shutdown-timeout", "30s")
+	settings.SetDefault("read-header-timeout", "10s")
+	settings.SetDefault("read-timeout", "30s")
+	settings.SetDefault("write-timeout", "30s")
+	settings.SetDefault("idle-timeout", "2m")
+	settings.SetDefault("max-request-size", 1048576)
+	settings.SetDefault("max-inflated-size", 1048576)
+	settings.SetDefault("log-format", "text")
+	settings.SetDefault("log-level", "info")
+	settings.SetDefault("debug-saml", false)
+	settings.SetDefault("debug-saml-directory", "")
+	settings.SetDefault("audit-log", "")
+	settings.SetDefault("audit-log-max-size", 104857600)
+	settings.SetDefault("audit-log-max-backups", 10)
+	settings.SetDefault("audit-log-sync", true)
+	settings.SetDefault("audit-log-required", false)
+	settings.SetDefault("server-name", "idp.example.com:9443")
+	settings.SetDefault("base-path", "")
+	settings.SetDefault("metadata-path", "/metadata")
+	settings.SetDefault("sign-metadata", true)
+	settings.SetDefault("metadata-valid-until", "168h")
+	settings.SetDefault("metadata-cache-duration", "24h")
+	settings.SetDefault("sso-service-path", "/SAML2/Redirect/SSO")
+	settings.SetDefault("unsolicited-sso-enabled", true)
+	settings.SetDefault("unsolicited-sso-path", "/SAML2/Unsolicited/SSO")
+	settings.SetDefault("scoping-enforced", true)
+	settings.SetDefault("artifact-service-path", "/SAML2/SOAP/ArtifactResolution")
+	settings.SetDefault("attribute-service-path", "/SAML2/SOAP/AttributeQuery")
+	settings.SetDefault("want-authn-requests-signed", true)
+	settings.SetDefault("want-artifact-resolve-signed", false)
+	settings.SetDefault("cert-login-enabled", true)
+	settings.SetDefault("cert-login-principal", "subject")
+	settings.SetDefault("cert-login-nameid", "{{.Principal}}")
+	settings.SetDefault("cert-revocation-methods", []string{})
+	settings.SetDefault("cert-ocsp-responder", "")
+	settings.SetDefault("cert-crl-urls", []string{})
+	settings.SetDefault("cert-revocation-cache-ttl", "1h")
+	settings.SetDefault("cert-revocation-timeout", "10s")
+	settings.SetDefault("kerberos-enabled", false)
+	settings.SetDefault("kerberos-keytab", "")
+	settings.SetDefault("kerberos-service-principal", "")
+	settings.SetDefault("kerberos-nameid", "{{.Principal}}")
+	settings.SetDefault("email-attribute", "mail")
+	settings.SetDefault("attribute-release-default", "allow")
+	settings.SetDefault("authn-context.password", "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport")
+	settings.SetDefault("authn-context.certificate", "urn:oasis:names:tc:SAML:2.0:ac:classes:X509")
+	settings.SetDefault("authn-context.mfa", "urn:oasis:names:tc:SAML:2.0:ac:classes:TimeSyncToken")
+	settings.SetDefault("authn-context.kerberos", "urn:oasis:names:tc:SAML:2.0:ac:classes:Kerberos")
+	settings.SetDefault("auth-rate-limit", 10)
+	settings.SetDefault("auth-lockout-threshold", 5)
+	settings.SetDefault("auth-lockout-window", "15m")
+	settings.SetDefault("totp-enabled", false)
+	settings.SetDefault("totp-required", false)
+	settings.SetDefault("totp-skew", 1)
+	settings.SetDefault("totp-max-attempts", 3)
+	settings.SetDefault("totp-issuer", "lite-idp")
+	settings.SetDefault("consent-enabled", false)
+	settings.SetDefault("consent-template", "")
+	settings.SetDefault("login-template", "")
+	settings.SetDefault("login-assets-directory", "")
+	settings.SetDefault("post-template", "")
+	settings.SetDefault("error-template", "")
+	settings.SetDefault("landing-page", "")
+	settings.SetDefault("landing-template", "")
+	settings.SetDefault("locale-directory", "")
+	settings.SetDefault("default-locale", "en")
+	settings.SetDefault("oidc.enabled", false)
+	settings.SetDefault("oidc.authorization-path", "/oidc/authorize")
+	settings.SetDefault("oidc.token-path", "/oidc/token")
+	settings.SetDefault("oidc.jwks-path", "/oidc/jwks")
+	settings.SetDefault("oidc.token-lifetime", "1h")
+	settings.SetDefault("cors.allowed-origins", []string{})
+	settings.SetDefault("cors.allowed-methods", []string{"GET"})
+	settings.SetDefault("cors.allowed-headers", []string{})
+	settings.SetDefault("cors.max-age", "10m")
+	settings.SetDefault("security-headers", map[string]string{})
+	settings.SetDefault("issuer-format", issuerFormatEntity)
+	settings.SetDefault("slo-enabled", true)
+	settings.SetDefault("slo-service-path", "/SAML2/Redirect/SLO")
+	settings.SetDefault("slo-backchannel-timeout", "5s")
+	settings.SetDefault("slo-backchannel-parallelism", 4)
+	settings.SetDefault("manage-nameid-enabled", false)
+	settings.SetDefault("manage-nameid-service-path", "/SAML2/ManageNameID")
+	settings.SetDefault("metadata-directory", "")
+	settings.SetDefault("metadata-refresh-interval", "1m")
+	settings.SetDefault("metadata-urls", []MetadataURL{})
+	settings.SetDefault("metadata-url-refresh-interval", "1h")
+	settings.SetDefault("metadata-url-timeout", "30s")
+	settings.SetDefault("metrics-path", "/metrics")
+	settings.SetDefault("metrics-address", "")
+	settings.SetDefault("admin-listen-address", "")
+	settings.SetDefault("admin-metadata", false)
+	settings.SetDefault("admin-tls-certificate", "")
+	settings.SetDefault("admin-tls-private-key", "")
+	settings.SetDefault("admin-api-token", "")
+	settings.SetDefault("admin-client-ca", "")
+	settings.SetDefault("admin-sessions-path", "/admin/sessions")
+	settings.SetDefault("tracing-enabled", false)
+	settings.SetDefault("tracing-endpoint", "http://localhost:4318/v1/traces")
+	settings.SetDefault("tracing-service-name", "lite-idp")
+	settings.SetDefault("health-path", "/healthz")
+	settings.SetDefault("readiness-path", "/readyz")
+	settings.SetDefault("version-enabled", false)
+	settings.SetDefault("version-path", "/version")
+	settings.SetDefault("temp-cache-duration", "5m")
+	settings.SetDefault("store", "memory")
+	settings.SetDefault("redis.address", "127.0.0.1:6379")
+	settings.SetDefault("redis.password", "")
+	settings.SetDefault("redis.db", 0)
+	settings.SetDefault("assertion-lifetime", "5m")
+	settings.SetDefault("clock-skew", "3m")
+	settings.SetDefault("session-lifetime", "8h")
+	settings.SetDefault("session-idle-timeout", "0s")
+	settings.SetDefault("session-absolute-timeout", "0s")
+	settings.SetDefault("artifact-lifetime", "5m")
+	settings.SetDefault("signature-algorithm", "")
+	settings.SetDefault("digest-algorithm", "")
+	settings.SetDefault("encryption-algorithm", "http://www.w3.org/2009/xmlenc11#aes128-gcm")
+	settings.SetDefault("ldap.user-filter", "(uid=%s)")
+	settings.SetDefault("ldap.timeout", "10s")
+	settings.SetDefault("ldap.pool-size", 5)
+	settings.SetDefault("ldap.pool-max-open", 20)
+	settings.SetDefault("ldap.pool-idle-timeout", "5m")
+	settings.SetDefault("ldap.retries", 2)
+	settings.SetDefault("ldap.retry-backoff", "100ms")
+	settings.SetDefault("ldap.cache-duration", "5m")
+	settings.SetDefault("sql.timeout", "10s")
+	settings.SetDefault("sql.pool-size", 5)
 }
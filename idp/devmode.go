@@ -0,0 +1,82 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"crypto/subtle"
+	"strings"
+
+	"github.com/amdonov/lite-idp/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// devModeWarning is logged whenever an IDP is configured with dev-mode
+const devModeWarning = "DEV-MODE IS ENABLED: logins are checked against dev-users, or any credentials are accepted " +
+	"if there are none. NEVER enable dev-mode in production."
+
+// devValidator checks logins against the dev-users. It accepts any user name and password when there are no
+// dev-users, so the whole SSO flow can be tried without a directory.
+type devValidator struct {
+	users map[string]UserConfig
+}
+
+func (dv *devValidator) Validate(ctx context.Context, user, password string) error {
+	_, err := dv.ValidateAndFetch(ctx, user, password)
+	return err
+}
+
+// ValidateAndFetch returns the dev-user's attributes, since no attribute sources are used in dev-mode
+func (dv *devValidator) ValidateAndFetch(_ context.Context, user, password string) ([]*model.Attribute, error) {
+	if strings.TrimSpace(user) == "" {
+		return nil, ErrInvalidPassword
+	}
+	if len(dv.users) == 0 {
+		return nil, nil
+	}
+	configured, ok := dv.users[user]
+	if !ok {
+		return nil, ErrUnknownUser
+	}
+	// The dev-users' passwords are plain text, unlike those of users
+	if subtle.ConstantTimeCompare([]byte(configured.Password), []byte(password)) != 1 {
+		return nil, ErrInvalidPassword
+	}
+	return configuredAttributes(configured.Attributes), nil
+}
+
+// configureDevMode replaces the password validators and attribute sources from the configuration with the
+// dev-users when dev-mode is set. Validators and sources set by an embedding application are kept.
+func (i *IDP) configureDevMode() error {
+	if !i.settings.GetBool("dev-mode") {
+		return nil
+	}
+	log.WithField("event", "dev_mode").Warn(devModeWarning)
+	users := []UserConfig{}
+	if err := i.settings.UnmarshalKey("dev-users", &users); err != nil {
+		return err
+	}
+	validator := &devValidator{users: map[string]UserConfig{}}
+	for _, user := range users {
+		validator.users[user.Name] = user
+	}
+	if i.PasswordValidator == nil {
+		i.PasswordValidator = validator
+	}
+	if i.AttributeSources == nil {
+		i.AttributeSources = []AttributeSource{}
+	}
+	return nil
+}
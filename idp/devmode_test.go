@@ -0,0 +1,74 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_devValidator(t *testing.T) {
+	ctx := context.Background()
+	anyone := &devValidator{}
+	assert.NoError(t, anyone.Validate(ctx, "joe", "anything"), "any credentials are accepted without dev-users")
+	assert.True(t, errors.Is(anyone.Validate(ctx, " ", "anything"), ErrInvalidPassword), "a user name is still required")
+
+	configured := &devValidator{users: map[string]UserConfig{
+		"joe": {Name: "joe", Password: "secret", Attributes: map[string][]string{"mail": {"joe@example.com"}}},
+	}}
+	atts, err := configured.ValidateAndFetch(ctx, "joe", "secret")
+	if assert.NoError(t, err) {
+		assert.Equal(t, []*model.Attribute{{Name: "mail", Value: []string{"joe@example.com"}}}, atts)
+	}
+	assert.True(t, errors.Is(configured.Validate(ctx, "joe", "wrong"), ErrInvalidPassword))
+	assert.True(t, errors.Is(configured.Validate(ctx, "jane", "secret"), ErrUnknownUser))
+}
+
+func TestIDP_configureDevMode(t *testing.T) {
+	viper.Set("dev-mode", true)
+	viper.Set("dev-users", []UserConfig{{Name: "dev", Password: "dev", Attributes: map[string][]string{"role": {"admin"}}}})
+	// Dev-mode shouldn't contact the directory
+	viper.Set("ldap.url", "ldap://ldap.example.com")
+	viper.Set("ldap.attribute-map", map[string]string{"mail": "mail"})
+	defer viper.Set("dev-mode", false)
+	defer viper.Set("dev-users", []UserConfig{})
+	defer viper.Set("ldap.url", "")
+	defer viper.Set("ldap.attribute-map", map[string]string{})
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	assert.IsType(t, &devValidator{}, i.PasswordValidator)
+	assert.Empty(t, i.AttributeSources)
+
+	req := &model.AuthnRequest{ID: "request", Issuer: "dex"}
+	user, err := i.loginWithPassword(httptest.NewRequest("POST", "/", nil), "dev", "dev", req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "dev", user.Name)
+		assert.Equal(t, []*model.Attribute{{Name: "role", Value: []string{"admin"}}}, user.Attributes)
+	}
+	_, err = i.loginWithPassword(httptest.NewRequest("POST", "/", nil), "dev", "wrong", req)
+	assert.Error(t, err)
+
+	// Validators set by an embedding application are kept
+	validator := acceptingValidator{}
+	i = &IDP{PasswordValidator: validator}
+	getTestIDP(t, i).Close()
+	assert.Equal(t, validator, i.PasswordValidator)
+}
@@ -0,0 +1,186 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	soapBinding = "urn:oasis:names:tc:SAML:2.0:bindings:SOAP"
+	paosBinding = "urn:oasis:names:tc:SAML:2.0:bindings:PAOS"
+	// paosMediaType is included in the Accept header of ECP clients
+	paosMediaType = "application/vnd.paos+xml"
+)
+
+// isECPRequest reports whether a request to the single sign-on service comes from an ECP client. Clients advertise
+// PAOS support with the Accept and PAOS headers or post the AuthnRequest as a SOAP message.
+func isECPRequest(r *http.Request) bool {
+	if r.Header.Get("PAOS") != "" || strings.Contains(r.Header.Get("Accept"), paosMediaType) {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "text/xml"
+}
+
+// ssoPostHandler sends POSTs to the single sign-on service from ECP clients to the ECP handler and the rest to the POST handler
+func (i *IDP) ssoPostHandler() http.HandlerFunc {
+	post, ecp := i.PostSSOHandler, i.ECPHandler
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isECPRequest(r) {
+			ecp(w, r)
+			return
+		}
+		post(w, r)
+	}
+}
+
+// DefaultECPHandler is the default implementation for the ECP handler. It authenticates clients with a certificate or
+// HTTP Basic credentials and returns the response in a SOAP message. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultECPHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return err
+			}
+			i.debugMessage(messageReceived, data)
+			var env saml.ECPRequestEnvelope
+			if err = xml.Unmarshal(data, &env); err != nil {
+				return err
+			}
+			loginReq := &saml.AuthnRequest{}
+			message, err := unmarshalSOAPRequest(env.Body.RawRequest, loginReq)
+			if err != nil {
+				return err
+			}
+			recordBinding(r, soapBinding)
+			// The response is returned to the client, so only PAOS assertion consumer services can be used
+			if loginReq.ProtocolBinding == "" {
+				loginReq.ProtocolBinding = paosBinding
+			}
+			if loginReq.ProtocolBinding != paosBinding {
+				return errors.New("ECP requests must use the PAOS protocol binding")
+			}
+			if err = i.validateRequest(loginReq, soapBinding, message, r); err != nil {
+				return err
+			}
+			recordServiceProvider(r, loginReq.Issuer)
+			i.metrics.authnRequests.Inc(loginReq.Issuer, "SOAP")
+			authnReq, err := model.NewAuthnRequest(loginReq, "")
+			if err != nil {
+				return err
+			}
+			authnReq.RequestBinding = soapBinding
+			user, err := i.loginECPClient(r, authnReq)
+			var limited *tooManyAttemptsError
+			if user == nil {
+				switch {
+				case errors.As(err, &limited):
+					writeTooManyAttempts(w, limited)
+					return nil
+				case err == nil:
+					w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", i.entityID))
+					http.Error(w, "authentication required", http.StatusUnauthorized)
+					return nil
+				case errors.Is(err, ErrInvalidPassword):
+					w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", i.entityID))
+					http.Error(w, err.Error(), http.StatusUnauthorized)
+					return nil
+				case err == errTOTPRequired:
+					http.Error(w, err.Error(), http.StatusForbidden)
+					return nil
+				case errors.Is(err, ErrServiceUnavailable):
+					log.Error(err)
+					http.Error(w, err.Error(), http.StatusServiceUnavailable)
+					return nil
+				}
+				return err
+			}
+			return i.sendECPResponse(r.Context(), authnReq, user, w)
+		}()
+		if err != nil {
+			log.Error(err)
+			http.Error(w, err.Error(), ssoErrorStatus(err))
+		}
+	}
+}
+
+// loginECPClient authenticates an ECP client with its certificate or HTTP Basic credentials. There's no
+// session, so the user and error are both nil if the client didn't send credentials.
+func (i *IDP) loginECPClient(r *http.Request, authnReq *model.AuthnRequest) (*model.User, error) {
+	if user, err := i.loginWithCert(r, authnReq); user != nil || err != nil {
+		return user, err
+	}
+	userName, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, nil
+	}
+	user, err := i.loginWithPassword(r, userName, password, authnReq)
+	if err != nil {
+		return nil, err
+	}
+	// Clients can't be prompted for a one-time code
+	if required, err := i.requiresTOTP(r.Context(), userName); err != nil || required {
+		if err == nil {
+			err = errTOTPRequired
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+func (i *IDP) sendECPResponse(ctx context.Context, authRequest *model.AuthnRequest, user *model.User, w http.ResponseWriter) error {
+	response, err := i.makeAuthnResponse(authRequest, user)
+	if err != nil {
+		return err
+	}
+	if err = i.signResponse(ctx, response, authRequest.Issuer); err != nil {
+		return err
+	}
+	env := saml.ECPResponseEnvelope{
+		Header: saml.ECPResponseHeader{
+			Response: saml.ECPResponse{
+				MustUnderstand:              "1",
+				Actor:                       "http://schemas.xmlsoap.org/soap/actor/next",
+				AssertionConsumerServiceURL: authRequest.AssertionConsumerServiceURL,
+			},
+		},
+		Body: saml.ECPResponseBody{
+			Response: *response,
+		},
+	}
+	var b bytes.Buffer
+	b.Write([]byte(xml.Header))
+	if err = xml.NewEncoder(&b).Encode(env); err != nil {
+		return err
+	}
+	i.debugMessage(messageSent, b.Bytes())
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	_, err = w.Write(b.Bytes())
+	return err
+}
@@ -0,0 +1,174 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const testECPLocation = "https://dex.example.com/ecp"
+
+// getTestIDPWithECP returns an IdP that accepts joe's password and trusts an SP with a PAOS assertion consumer service
+func getTestIDPWithECP(t *testing.T) *IDP {
+	i := &IDP{PasswordValidator: &simpleValidator{
+		map[string][]byte{"joe": []byte("$2a$10$FNvHN.0e5LcLUonmGX0CIOAAEKYYSrlZkyibHgq3sLo0SizPtRhEG")},
+	}}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.ServiceProvider("dex")
+	dex.AssertionConsumerServices = append(dex.AssertionConsumerServices, AssertionConsumerService{
+		Index:    1,
+		Binding:  paosBinding,
+		Location: testECPLocation,
+	})
+	return i
+}
+
+// sendECPRequest posts a signed AuthnRequest in a SOAP message to the IdP's router
+func sendECPRequest(t *testing.T, i *IDP, loginReq *saml.AuthnRequest, header http.Header) *httptest.ResponseRecorder {
+	signature, err := i.signer.CreateSignature(loginReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginReq.Signature = signature
+	data, err := xml.Marshal(loginReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `<S:Envelope xmlns:S="http://schemas.xmlsoap.org/soap/envelope/"><S:Body>` + string(data) + `</S:Body></S:Envelope>`
+	r := httptest.NewRequest("POST", viper.GetString("sso-service-path"), strings.NewReader(body))
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	i.Router.ServeHTTP(w, r)
+	return w
+}
+
+func TestIDP_DefaultECPHandler(t *testing.T) {
+	i := getTestIDPWithECP(t)
+	header := http.Header{}
+	header.Set("Content-Type", "text/xml")
+	header.Set("Authorization", "Basic am9lOnBhc3N3b3Jk") // joe:password
+	loginReq := newTestAuthnRequest()
+	w := sendECPRequest(t, i, loginReq, header)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "text/xml; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Empty(t, w.Header().Get("Set-Cookie"), "ECP clients shouldn't get a session")
+	var env saml.ECPResponseEnvelope
+	if err := xml.Unmarshal(w.Body.Bytes(), &env); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, testECPLocation, env.Header.Response.AssertionConsumerServiceURL)
+	response := env.Body.Response
+	assert.Equal(t, loginReq.ID, response.InResponseTo)
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", response.Status.StatusCode.Value)
+	if assert.NotNil(t, response.Assertion) {
+		assert.Equal(t, "joe", response.Assertion.Subject.NameID.Value)
+		assert.NotNil(t, response.Assertion.Signature, "assertion should be signed")
+	}
+}
+
+func TestIDP_DefaultECPHandler_authentication(t *testing.T) {
+	i := getTestIDPWithECP(t)
+	// Clients can also be detected by their PAOS headers
+	header := http.Header{}
+	header.Set("Accept", "text/html; application/vnd.paos+xml")
+	header.Set("PAOS", `ver="urn:liberty:paos:2003-08";"urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp"`)
+	w := sendECPRequest(t, i, newTestAuthnRequest(), header)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "credentials should be required")
+	assert.Contains(t, w.Header().Get("WWW-Authenticate"), "Basic")
+
+	header.Set("Authorization", "Basic am9lOndyb25n") // joe:wrong
+	assert.Equal(t, http.StatusUnauthorized, sendECPRequest(t, i, newTestAuthnRequest(), header).Code,
+		"the wrong password should be rejected")
+}
+
+func TestIDP_DefaultECPHandler_binding(t *testing.T) {
+	i := getTestIDPWithECP(t)
+	header := http.Header{}
+	header.Set("Content-Type", "text/xml")
+	header.Set("Authorization", "Basic am9lOnBhc3N3b3Jk")
+	loginReq := newTestAuthnRequest()
+	loginReq.ProtocolBinding = postBinding
+	assert.Equal(t, http.StatusBadRequest, sendECPRequest(t, i, loginReq, header).Code,
+		"responses can only be returned with PAOS")
+
+	dex, _ := i.ServiceProvider("dex")
+	dex.AssertionConsumerServices = dex.AssertionConsumerServices[:1]
+	assert.Equal(t, http.StatusBadRequest, sendECPRequest(t, i, newTestAuthnRequest(), header).Code,
+		"service providers need a PAOS assertion consumer service")
+}
+
+func TestIDP_DefaultECPHandler_signedElement(t *testing.T) {
+	i := getTestIDPWithECP(t)
+	// Another message signed by the service provider can't vouch for an AuthnRequest after it
+	resolve := &saml.ArtifactResolve{
+		RequestAbstractType: saml.RequestAbstractType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now(),
+			Issuer:       "dex",
+		},
+		Artifact: "artifact",
+	}
+	signature, err := i.signer.CreateSignature(resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolve.Signature = signature
+	signed, err := xml.Marshal(resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := xml.Marshal(newTestAuthnRequest())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"signed element only", string(signed)},
+		{"forged request after", string(signed) + string(forged)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `<S:Envelope xmlns:S="http://schemas.xmlsoap.org/soap/envelope/"><S:Body>` + tt.body + `</S:Body></S:Envelope>`
+			r := httptest.NewRequest("POST", viper.GetString("sso-service-path"), strings.NewReader(body))
+			r.Header.Set("Content-Type", "text/xml")
+			r.Header.Set("Authorization", "Basic am9lOnBhc3N3b3Jk")
+			w := httptest.NewRecorder()
+			i.Router.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		})
+	}
+}
+
+func Test_isECPRequest(t *testing.T) {
+	r := httptest.NewRequest("POST", "/SAML2/SSO", nil)
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	assert.False(t, isECPRequest(r), "browser posts should go to the POST handler")
+	r.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	assert.True(t, isECPRequest(r))
+}
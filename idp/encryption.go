@@ -0,0 +1,292 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/xmlsig"
+)
+
+// Content and key transport algorithms supported for EncryptedAssertions and EncryptedIDs
+const (
+	aes128GCM        = "http://www.w3.org/2009/xmlenc11#aes128-gcm"
+	aes256GCM        = "http://www.w3.org/2009/xmlenc11#aes256-gcm"
+	aes128CBC        = "http://www.w3.org/2001/04/xmlenc#aes128-cbc"
+	aes256CBC        = "http://www.w3.org/2001/04/xmlenc#aes256-cbc"
+	rsaOAEP          = "http://www.w3.org/2001/04/xmlenc#rsa-oaep-mgf1p"
+	digestSHA1       = "http://www.w3.org/2000/09/xmldsig#sha1"
+	encryptedElement = "http://www.w3.org/2001/04/xmlenc#Element"
+)
+
+var contentKeySizes = map[string]int{
+	aes128GCM: 16,
+	aes256GCM: 32,
+	aes128CBC: 16,
+	aes256CBC: 32,
+}
+
+// configureEncryption checks that service providers requiring encrypted assertions or NameIDs can be sent them
+func (sp *ServiceProvider) configureEncryption(defaultAlgorithm string) error {
+	if !sp.EncryptAssertions && !sp.EncryptNameID {
+		return nil
+	}
+	if sp.EncryptionAlgorithm == "" {
+		sp.EncryptionAlgorithm = defaultAlgorithm
+	}
+	if _, ok := contentKeySizes[sp.EncryptionAlgorithm]; !ok {
+		return fmt.Errorf("unsupported encryption algorithm %s for service provider %s", sp.EncryptionAlgorithm, sp.EntityID)
+	}
+	if _, _, err := sp.assertionEncryptionKey(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// assertionEncryptionKey returns the key and certificate used to encrypt assertions and NameIDs. The signing
+// certificate is used when the service provider doesn't have a separate encryption certificate.
+func (sp *ServiceProvider) assertionEncryptionKey() (*rsa.PublicKey, string, error) {
+	key, cert := sp.encryptionKey, sp.EncryptionCertificate
+	if key == nil {
+		key, cert = sp.publicKey, sp.Certificate
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, "", fmt.Errorf("service provider %s requires encryption but does not have an RSA encryption key", sp.EntityID)
+	}
+	return rsaKey, cert, nil
+}
+
+// encryptAssertion replaces the signed assertion in the response with an EncryptedAssertion for the service provider
+func encryptAssertion(response *saml.Response, sp *ServiceProvider) error {
+	data, err := encryptElement(response.Assertion, sp)
+	if err != nil {
+		return err
+	}
+	response.EncryptedAssertion = &saml.EncryptedAssertion{EncryptedData: *data}
+	response.Assertion = nil
+	return nil
+}
+
+// encryptNameID replaces the NameID in the assertion's subject with an EncryptedID for the service provider
+func encryptNameID(assertion *saml.Assertion, sp *ServiceProvider) error {
+	if assertion.Subject == nil || assertion.Subject.NameID == nil {
+		return nil
+	}
+	data, err := encryptElement(assertion.Subject.NameID, sp)
+	if err != nil {
+		return err
+	}
+	assertion.Subject.EncryptedID = &saml.EncryptedID{EncryptedData: *data}
+	assertion.Subject.NameID = nil
+	return nil
+}
+
+// encryptElement encrypts the element with a random content key that's wrapped with the service provider's key
+func encryptElement(element interface{}, sp *ServiceProvider) (*saml.EncryptedData, error) {
+	publicKey, cert, err := sp.assertionEncryptionKey()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := xml.Marshal(element)
+	if err != nil {
+		return nil, err
+	}
+	key := make([]byte, contentKeySizes[sp.EncryptionAlgorithm])
+	if _, err = io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	ciphertext, err := encryptContent(sp.EncryptionAlgorithm, key, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, publicKey, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &saml.EncryptedData{
+		ID:   saml.NewID(),
+		Type: encryptedElement,
+		EncryptionMethod: saml.EncryptionMethod{
+			Algorithm: sp.EncryptionAlgorithm,
+		},
+		KeyInfo: &saml.EncryptedKeyInfo{
+			EncryptedKey: &saml.EncryptedKey{
+				ID:        saml.NewID(),
+				Recipient: sp.EntityID,
+				EncryptionMethod: saml.EncryptionMethod{
+					Algorithm:    rsaOAEP,
+					DigestMethod: &saml.DigestMethod{Algorithm: digestSHA1},
+				},
+				KeyInfo: &xmlsig.KeyInfo{
+					X509Data: &xmlsig.X509Data{X509Certificate: cert},
+				},
+				CipherData: saml.CipherData{
+					CipherValue: base64.StdEncoding.EncodeToString(encryptedKey),
+				},
+			},
+		},
+		CipherData: saml.CipherData{
+			CipherValue: base64.StdEncoding.EncodeToString(ciphertext),
+		},
+	}, nil
+}
+
+// decryptNameID returns the NameID in an EncryptedID that a service provider encrypted with the IdP's signing key
+func (i *IDP) decryptNameID(encrypted *saml.EncryptedID) (*saml.NameID, error) {
+	plaintext, err := i.decryptID(encrypted.EncryptedData, encrypted.EncryptedKey)
+	if err != nil {
+		return nil, err
+	}
+	nameID := &saml.NameID{}
+	if err = xml.Unmarshal(plaintext, nameID); err != nil {
+		return nil, err
+	}
+	return nameID, nil
+}
+
+// decryptNewID returns the NewID in a NewEncryptedID that a service provider encrypted with the IdP's signing key
+func (i *IDP) decryptNewID(encrypted *saml.NewEncryptedID) (string, error) {
+	plaintext, err := i.decryptID(encrypted.EncryptedData, encrypted.EncryptedKey)
+	if err != nil {
+		return "", err
+	}
+	newID := struct {
+		XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NewID"`
+		Value   string   `xml:",chardata"`
+	}{}
+	if err = xml.Unmarshal(plaintext, &newID); err != nil {
+		return "", err
+	}
+	return newID.Value, nil
+}
+
+// decryptID decrypts an identifier with the EncryptedKey in its KeyInfo or the first one that follows it
+func (i *IDP) decryptID(data saml.EncryptedData, keys []saml.EncryptedKey) ([]byte, error) {
+	privateKey, ok := i.SigningCertificate.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("EncryptedIDs can only be decrypted with an RSA key")
+	}
+	var encryptedKey *saml.EncryptedKey
+	if data.KeyInfo != nil && data.KeyInfo.EncryptedKey != nil {
+		encryptedKey = data.KeyInfo.EncryptedKey
+	} else if len(keys) > 0 {
+		encryptedKey = &keys[0]
+	} else {
+		return nil, errors.New("EncryptedID doesn't have an EncryptedKey")
+	}
+	if encryptedKey.EncryptionMethod.Algorithm != rsaOAEP {
+		return nil, fmt.Errorf("unsupported key transport algorithm %s", encryptedKey.EncryptionMethod.Algorithm)
+	}
+	size, ok := contentKeySizes[data.EncryptionMethod.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unsupported encryption algorithm %s", data.EncryptionMethod.Algorithm)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(encryptedKey.CipherData.CipherValue)
+	if err != nil {
+		return nil, err
+	}
+	key, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, privateKey, wrapped, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != size {
+		return nil, errors.New("EncryptedKey has the wrong size for the encryption algorithm")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(data.CipherData.CipherValue)
+	if err != nil {
+		return nil, err
+	}
+	return decryptContent(data.EncryptionMethod.Algorithm, key, ciphertext)
+}
+
+// encryptContent returns the IV followed by the ciphertext as described in XML Encryption 1.1
+func encryptContent(algorithm string, key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	switch algorithm {
+	case aes128GCM, aes256GCM:
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+			return nil, err
+		}
+		return gcm.Seal(nonce, nonce, plaintext, nil), nil
+	case aes128CBC, aes256CBC:
+		// Padding as required by XML Encryption, the last byte is the length of the padding
+		padding := aes.BlockSize - len(plaintext)%aes.BlockSize
+		padded := make([]byte, len(plaintext)+padding)
+		copy(padded, plaintext)
+		for i := len(plaintext); i < len(padded); i++ {
+			padded[i] = byte(padding)
+		}
+		out := make([]byte, aes.BlockSize+len(padded))
+		iv := out[:aes.BlockSize]
+		if _, err = io.ReadFull(rand.Reader, iv); err != nil {
+			return nil, err
+		}
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(out[aes.BlockSize:], padded)
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported encryption algorithm %s", algorithm)
+	}
+}
+
+// decryptContent reverses encryptContent
+func decryptContent(algorithm string, key, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	switch algorithm {
+	case aes128GCM, aes256GCM:
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		if len(ciphertext) < gcm.NonceSize() {
+			return nil, errors.New("ciphertext is too short")
+		}
+		return gcm.Open(nil, ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():], nil)
+	case aes128CBC, aes256CBC:
+		if len(ciphertext) < 2*aes.BlockSize || len(ciphertext)%aes.BlockSize != 0 {
+			return nil, errors.New("ciphertext isn't a whole number of blocks")
+		}
+		plaintext := make([]byte, len(ciphertext)-aes.BlockSize)
+		cipher.NewCBCDecrypter(block, ciphertext[:aes.BlockSize]).CryptBlocks(plaintext, ciphertext[aes.BlockSize:])
+		padding := int(plaintext[len(plaintext)-1])
+		if padding == 0 || padding > aes.BlockSize {
+			return nil, errors.New("invalid padding")
+		}
+		return plaintext[:len(plaintext)-padding], nil
+	default:
+		return nil, fmt.Errorf("unsupported encryption algorithm %s", algorithm)
+	}
+}
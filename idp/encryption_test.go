@@ -0,0 +1,182 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/xml"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/stretchr/testify/assert"
+)
+
+func decryptAssertion(t *testing.T, key *rsa.PrivateKey, encrypted *saml.EncryptedAssertion) *saml.Assertion {
+	data := encrypted.EncryptedData
+	wrapped, _ := base64.StdEncoding.DecodeString(data.KeyInfo.EncryptedKey.CipherData.CipherValue)
+	contentKey, err := rsa.DecryptOAEP(sha1.New(), rand.Reader, key, wrapped, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, _ := base64.StdEncoding.DecodeString(data.CipherData.CipherValue)
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plaintext []byte
+	switch data.EncryptionMethod.Algorithm {
+	case aes128GCM, aes256GCM:
+		gcm, _ := cipher.NewGCM(block)
+		nonce := ciphertext[:gcm.NonceSize()]
+		if plaintext, err = gcm.Open(nil, nonce, ciphertext[gcm.NonceSize():], nil); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		plaintext = make([]byte, len(ciphertext)-aes.BlockSize)
+		cipher.NewCBCDecrypter(block, ciphertext[:aes.BlockSize]).CryptBlocks(plaintext, ciphertext[aes.BlockSize:])
+		plaintext = plaintext[:len(plaintext)-int(plaintext[len(plaintext)-1])]
+	}
+	assertion := &saml.Assertion{}
+	if err = xml.Unmarshal(plaintext, assertion); err != nil {
+		t.Fatal(err)
+	}
+	return assertion
+}
+
+func TestIDP_sendPostResponse_encrypted(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i)
+	key := i.TLSConfig.Certificates[0].PrivateKey.(*rsa.PrivateKey)
+	sp, _ := i.sps.get("dex")
+	sp.EncryptAssertions = true
+	for _, algorithm := range []string{aes128GCM, aes256GCM, aes128CBC, aes256CBC} {
+		sp.EncryptionAlgorithm = algorithm
+		var b bytes.Buffer
+		if err := i.sendPostResponse(&model.AuthnRequest{
+			Issuer:                      "dex",
+			AssertionConsumerServiceURL: "testsvc",
+		}, &model.User{Name: "joe"}, &b, httptest.NewRequest("POST", "/SAML2/Redirect/SSO", nil)); err != nil {
+			t.Fatal(err)
+		}
+		doc, err := goquery.NewDocumentFromReader(&b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _ := doc.Find("input[name=SAMLResponse]").Attr("value")
+		data, _ := base64.StdEncoding.DecodeString(value)
+		response := &saml.Response{}
+		if err = xml.Unmarshal(data, response); err != nil {
+			t.Fatal(err)
+		}
+		assert.Nil(t, response.Assertion, "plaintext assertion should not be sent")
+		if assert.NotNil(t, response.EncryptedAssertion, "expected an encrypted assertion") {
+			assert.Equal(t, algorithm, response.EncryptedAssertion.EncryptedData.EncryptionMethod.Algorithm)
+			assertion := decryptAssertion(t, key, response.EncryptedAssertion)
+			assert.Equal(t, "joe", assertion.Subject.NameID.Value)
+			assert.NotNil(t, assertion.Signature, "assertion should be signed before it's encrypted")
+		}
+	}
+	sp.EncryptAssertions = false
+}
+
+func TestServiceProvider_configureEncryption(t *testing.T) {
+	sp := &ServiceProvider{EntityID: "test", EncryptAssertions: true}
+	assert.Error(t, sp.configureEncryption(aes128GCM), "a key is required")
+	sp.publicKey = &rsa.PublicKey{}
+	assert.NoError(t, sp.configureEncryption(aes128GCM), "signing key should be used when there's no encryption key")
+	assert.Equal(t, aes128GCM, sp.EncryptionAlgorithm)
+	sp.EncryptionAlgorithm = "http://www.w3.org/2001/04/xmlenc#tripledes-cbc"
+	assert.Error(t, sp.configureEncryption(aes128GCM), "algorithm should be rejected")
+}
+
+func Test_decryptContent(t *testing.T) {
+	for algorithm, size := range contentKeySizes {
+		key := make([]byte, size)
+		rand.Read(key)
+		ciphertext, err := encryptContent(algorithm, key, []byte("joe"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, err := decryptContent(algorithm, key, ciphertext)
+		if assert.NoError(t, err, algorithm) {
+			assert.Equal(t, "joe", string(plaintext), algorithm)
+		}
+	}
+	_, err := decryptContent(aes128CBC, make([]byte, 16), make([]byte, 20))
+	assert.Error(t, err, "partial blocks should be rejected")
+}
+
+func TestIDP_signResponse_encryptedNameID(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	sp, _ := i.sps.get("dex")
+	sp.EncryptNameID = true
+	sp.EncryptionAlgorithm = aes128GCM
+	defer func() { sp.EncryptNameID = false }()
+	response := i.makeResponse("request", "dex", &model.User{Name: "joe"})
+	if err := i.signResponse(context.Background(), response, "dex"); err != nil {
+		t.Fatal(err)
+	}
+	subject := response.Assertion.Subject
+	assert.Nil(t, subject.NameID, "plaintext NameID should not be sent")
+	assert.NotNil(t, response.Assertion.Signature)
+	if assert.NotNil(t, subject.EncryptedID, "expected an EncryptedID") {
+		assert.Equal(t, sp.EncryptionAlgorithm, subject.EncryptedID.EncryptedData.EncryptionMethod.Algorithm)
+		// The test service provider shares the IdP's key
+		nameID, err := i.decryptNameID(subject.EncryptedID)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "joe", nameID.Value)
+		}
+	}
+}
+
+func TestIDP_decryptNameID(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	sp, _ := i.sps.get("dex")
+	sp.EncryptionAlgorithm = aes256CBC
+	data, err := encryptElement(&saml.NameID{Format: nameIDFormatUnspecified, Value: "joe"}, sp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Keys can also follow the EncryptedData
+	encrypted := &saml.EncryptedID{EncryptedData: *data, EncryptedKey: []saml.EncryptedKey{*data.KeyInfo.EncryptedKey}}
+	encrypted.EncryptedData.KeyInfo = nil
+	nameID, err := i.decryptNameID(encrypted)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "joe", nameID.Value)
+	}
+	response, err := i.makeQueryResponse(context.Background(), &saml.AttributeQuery{
+		RequestAbstractType: saml.RequestAbstractType{ID: "query", Issuer: "dex"},
+		Subject:             saml.Subject{EncryptedID: encrypted},
+	})
+	if assert.NoError(t, err, "attribute queries can have EncryptedIDs") {
+		assert.Equal(t, "joe", response.Assertion.Subject.NameID.Value)
+	}
+
+	encrypted.EncryptedKey = nil
+	_, err = i.decryptNameID(encrypted)
+	assert.Error(t, err, "a key is required")
+}
@@ -0,0 +1,121 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+
+	"github.com/amdonov/lite-idp/tracing"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrorPage is passed to the error-template
+type ErrorPage struct {
+	// HTTP status of the response
+	Status int
+	// Short description of the problem, such as Access denied
+	Title string
+	// What the user can do about it. It never includes details of the error, which are only logged.
+	Message string
+	// Identifies the log entry for the error so the helpdesk can find it
+	CorrelationID string
+	// Language the page is shown in and its messages, such as .Messages.errorReference
+	Lang     string
+	Messages Messages
+}
+
+// configureErrorPage parses the error-template if one is set, otherwise the built-in page is used
+func (i *IDP) configureErrorPage() error {
+	if file := i.settings.GetString("error-template"); file != "" {
+		templ, err := htmltemplate.ParseFiles(file)
+		if err != nil {
+			return err
+		}
+		i.errorTemplate = templ
+		return nil
+	}
+	templ, err := htmltemplate.New("error").Parse(errorTemplate)
+	if err != nil {
+		return err
+	}
+	i.errorTemplate = templ
+	return nil
+}
+
+// newErrorPage describes the status in the language without revealing why the request failed
+func newErrorPage(status int, lang string, messages Messages) ErrorPage {
+	page := ErrorPage{Status: status, Lang: lang, Messages: messages}
+	switch {
+	case status == http.StatusForbidden:
+		page.Title = messages.text("errorAccessDeniedTitle")
+		page.Message = messages.text("errorAccessDeniedMessage")
+	case status < http.StatusInternalServerError:
+		page.Title = messages.text("errorInvalidRequestTitle")
+		page.Message = messages.text("errorInvalidRequestMessage")
+	default:
+		page.Title = messages.text("errorServerTitle")
+		page.Message = messages.text("errorServerMessage")
+	}
+	return page
+}
+
+// writeError logs the error with a new correlation ID and shows the user the error page with the ID.
+// The ID is also recorded for access logs, which can read it with CorrelationIDFor.
+func (i *IDP) writeError(w http.ResponseWriter, r *http.Request, err error, status int) {
+	id := uuid.New().String()
+	log.WithField("correlation_id", id).Error(err)
+	recordCorrelationID(r, id)
+	tracing.SpanFromContext(r.Context()).SetAttributes(tracing.String("error.correlation_id", id))
+	lang, messages := i.messages(r)
+	page := newErrorPage(status, lang, messages)
+	page.CorrelationID = id
+	i.renderErrorPage(w, page)
+}
+
+// renderErrorPage shows the user the error page, or a plain text version of it if the error-template fails
+func (i *IDP) renderErrorPage(w http.ResponseWriter, page ErrorPage) {
+	var buf bytes.Buffer
+	var err error
+	if i.errorTemplate != nil {
+		if err = i.errorTemplate.Execute(&buf, page); err != nil {
+			log.WithField("correlation_id", page.CorrelationID).Errorf("failed to render error page: %v", err)
+		}
+	}
+	if i.errorTemplate == nil || err != nil {
+		http.Error(w, fmt.Sprintf("%s. Reference: %s", page.Title, page.CorrelationID), page.Status)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if page.Lang != "" {
+		w.Header().Set("Content-Language", page.Lang)
+	}
+	w.WriteHeader(page.Status)
+	w.Write(buf.Bytes())
+}
+
+const errorTemplate = `<!DOCTYPE html>
+<html lang="{{ .Lang }}">
+<head><title>{{ .Title }}</title></head>
+<body>
+<h1>{{ .Title }}</h1>
+<p>{{ .Message }}</p>
+<p>{{ .Messages.errorReference }} <code>{{ .CorrelationID }}</code></p>
+</body>
+</html>`
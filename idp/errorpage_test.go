@@ -0,0 +1,83 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_writeError(t *testing.T) {
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	r := WithRequestInfo(httptest.NewRequest("GET", "/SAML2/Redirect/SSO", nil))
+	w := httptest.NewRecorder()
+	i.writeError(w, r, errors.New("signature of <samlp:AuthnRequest> is invalid"), http.StatusBadRequest)
+	id := CorrelationIDFor(r)
+	assert.NotEmpty(t, id)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), id, "the page should show the correlation ID")
+	assert.NotContains(t, w.Body.String(), "samlp", "the error should only be logged")
+	assert.Contains(t, logs.String(), "correlation_id="+id)
+	assert.Contains(t, logs.String(), "signature of <samlp:AuthnRequest> is invalid")
+
+	r = WithRequestInfo(httptest.NewRequest("GET", "/", nil))
+	w = httptest.NewRecorder()
+	i.writeError(w, r, errors.New("database is down"), http.StatusInternalServerError)
+	assert.Contains(t, w.Body.String(), "Something went wrong")
+	assert.NotContains(t, w.Body.String(), "database")
+	assert.NotEqual(t, id, CorrelationIDFor(r), "each error gets its own ID")
+}
+
+func TestIDP_errorTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "error")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "error.html")
+	if err = ioutil.WriteFile(file, []byte(`<p class="brand">{{.Status}} {{.Title}} ref={{.CorrelationID}}</p>`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("error-template", file)
+	defer viper.Set("error-template", "")
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+
+	r := WithRequestInfo(httptest.NewRequest("GET", "/", nil))
+	w := httptest.NewRecorder()
+	i.writeError(w, r, errors.New("unknown service provider"), http.StatusForbidden)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, `<p class="brand">403 Access denied ref=`+CorrelationIDFor(r)+`</p>`, w.Body.String())
+
+	viper.Set("error-template", filepath.Join(dir, "missing.html"))
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err)
+}
@@ -0,0 +1,106 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/amdonov/lite-idp/saml"
+)
+
+// Names of the entity attributes for entity categories and assurance certifications
+const (
+	entityCategoryAttribute         = "http://macedir.org/entity-category"
+	entityCategorySupportAttribute  = "http://macedir.org/entity-category-support"
+	assuranceCertificationAttribute = "urn:oasis:names:tc:SAML:attribute:assurance-certification"
+)
+
+// UIInfoConfig describes the IdP to users in one language, for example on a federation's discovery service
+type UIInfoConfig struct {
+	// Value of xml:lang, en if it's empty
+	Lang                string
+	DisplayName         string
+	Description         string
+	InformationURL      string
+	PrivacyStatementURL string
+	// Location of a logo and its size in pixels
+	Logo       string
+	LogoWidth  uint
+	LogoHeight uint
+}
+
+// configureEntityAttributes reads the entity attributes and user interface information published in the metadata
+func (i *IDP) configureEntityAttributes() error {
+	i.entityAttributes = nil
+	attributes := []saml.Attribute{}
+	for _, att := range []struct{ setting, name string }{
+		{"entity-categories", entityCategoryAttribute},
+		{"entity-category-support", entityCategorySupportAttribute},
+		{"assurance-certifications", assuranceCertificationAttribute},
+	} {
+		values := i.settings.GetStringSlice(att.setting)
+		if len(values) == 0 {
+			continue
+		}
+		attribute := saml.Attribute{Name: att.name, NameFormat: attrNameFormatURI}
+		for _, value := range values {
+			if value == "" {
+				return fmt.Errorf("%s can't include an empty URI", att.setting)
+			}
+			attribute.AttributeValue = append(attribute.AttributeValue, saml.AttributeValue{Value: value})
+		}
+		attributes = append(attributes, attribute)
+	}
+	if len(attributes) > 0 {
+		i.entityAttributes = &saml.EntityAttributes{Attribute: attributes}
+	}
+
+	infos := []UIInfoConfig{}
+	if err := i.settings.UnmarshalKey("ui-info", &infos); err != nil {
+		return err
+	}
+	i.uiInfo = nil
+	if len(infos) > 0 {
+		i.uiInfo = &saml.UIInfo{}
+	}
+	for _, info := range infos {
+		if info.Lang == "" {
+			info.Lang = "en"
+		}
+		localized := func(names []saml.LocalizedName, value string) []saml.LocalizedName {
+			if value == "" {
+				return names
+			}
+			return append(names, saml.LocalizedName{Lang: info.Lang, Value: value})
+		}
+		i.uiInfo.DisplayName = localized(i.uiInfo.DisplayName, info.DisplayName)
+		i.uiInfo.Description = localized(i.uiInfo.Description, info.Description)
+		i.uiInfo.InformationURL = localized(i.uiInfo.InformationURL, info.InformationURL)
+		i.uiInfo.PrivacyStatementURL = localized(i.uiInfo.PrivacyStatementURL, info.PrivacyStatementURL)
+		if info.Logo != "" {
+			if info.LogoWidth == 0 || info.LogoHeight == 0 {
+				return errors.New("ui-info logos need a logowidth and logoheight")
+			}
+			i.uiInfo.Logo = append(i.uiInfo.Logo, saml.Logo{
+				Lang:   info.Lang,
+				Width:  info.LogoWidth,
+				Height: info.LogoHeight,
+				Value:  info.Logo,
+			})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto"
+	"encoding/xml"
+	"testing"
+
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_Metadata_extensions(t *testing.T) {
+	viper.Set("entity-categories", []string{"http://refeds.org/category/research-and-scholarship"})
+	viper.Set("assurance-certifications", []string{"https://refeds.org/sirtfi"})
+	viper.Set("ui-info", []UIInfoConfig{
+		{DisplayName: "Example", Logo: "https://example.com/logo.png", LogoWidth: 80, LogoHeight: 60},
+		{Lang: "fr", DisplayName: "Exemple", PrivacyStatementURL: "https://example.com/fr/privacy"},
+	})
+	defer viper.Set("entity-categories", nil)
+	defer viper.Set("assurance-certifications", nil)
+	defer viper.Set("ui-info", nil)
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	metadata, err := i.Metadata("  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := i.TLSConfig.Certificates[0].PrivateKey.(crypto.Signer).Public()
+	assert.NoError(t, dsig.Verify(metadata, key), "metadata signature should cover the extensions")
+	assert.Contains(t, string(metadata), `xmlns="urn:oasis:names:tc:SAML:metadata:attribute"`)
+	assert.Contains(t, string(metadata), `xmlns="urn:oasis:names:tc:SAML:metadata:ui"`)
+
+	ed := &saml.IDPEntityDescriptor{}
+	if err = xml.Unmarshal(metadata, ed); err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, ed.Extensions.EntityAttributes) {
+		attributes := ed.Extensions.EntityAttributes.Attribute
+		if assert.Len(t, attributes, 2) {
+			assert.Equal(t, entityCategoryAttribute, attributes[0].Name)
+			assert.Equal(t, attrNameFormatURI, attributes[0].NameFormat)
+			assert.Equal(t, "http://refeds.org/category/research-and-scholarship", attributes[0].AttributeValue[0].Value)
+			assert.Equal(t, assuranceCertificationAttribute, attributes[1].Name)
+			assert.Equal(t, "https://refeds.org/sirtfi", attributes[1].AttributeValue[0].Value)
+		}
+	}
+	if assert.NotNil(t, ed.IDPSSODescriptor.Extensions) && assert.NotNil(t, ed.IDPSSODescriptor.Extensions.UIInfo) {
+		info := ed.IDPSSODescriptor.Extensions.UIInfo
+		assert.Equal(t, []saml.LocalizedName{{Lang: "en", Value: "Example"}, {Lang: "fr", Value: "Exemple"}},
+			info.DisplayName, "the language defaults to en")
+		assert.Equal(t, []saml.LocalizedName{{Lang: "fr", Value: "https://example.com/fr/privacy"}},
+			info.PrivacyStatementURL)
+		assert.Empty(t, info.Description)
+		if assert.Len(t, info.Logo, 1) {
+			assert.Equal(t, "en", info.Logo[0].Lang)
+			assert.Equal(t, uint(80), info.Logo[0].Width)
+			assert.Equal(t, uint(60), info.Logo[0].Height)
+			assert.Equal(t, "https://example.com/logo.png", info.Logo[0].Value)
+		}
+	}
+}
+
+func TestIDP_configureEntityAttributes(t *testing.T) {
+	i := &IDP{settings: viper.GetViper()}
+	assert.NoError(t, i.configureEntityAttributes())
+	assert.Nil(t, i.entityAttributes, "entity attributes should be left out unless they're configured")
+	assert.Nil(t, i.uiInfo, "UI information should be left out unless it's configured")
+
+	viper.Set("entity-category-support", []string{""})
+	assert.Error(t, i.configureEntityAttributes(), "entity attribute values can't be empty")
+	viper.Set("entity-category-support", nil)
+
+	viper.Set("ui-info", []UIInfoConfig{{DisplayName: "Example", Logo: "https://example.com/logo.png"}})
+	defer viper.Set("ui-info", nil)
+	assert.Error(t, i.configureEntityAttributes(), "logos need a size")
+}
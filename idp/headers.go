@@ -0,0 +1,72 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// defaultSecurityHeaders are added to every response unless security-headers overrides them. The policies keep the
+// login form from being framed and don't interfere with the pages that post responses or log users out.
+var defaultSecurityHeaders = map[string]string{
+	"Strict-Transport-Security": "max-age=63072000; includeSubDomains",
+	"X-Frame-Options":           "DENY",
+	"Content-Security-Policy":   "frame-ancestors 'none'",
+	"X-Content-Type-Options":    "nosniff",
+	"Referrer-Policy":           "no-referrer",
+}
+
+// headerName matches the characters allowed in an HTTP header name
+var headerName = regexp.MustCompile("^[A-Za-z0-9!#$%&'*+.^_`|~-]+$")
+
+// configureSecurityHeaders merges security-headers over the defaults. A header set to an empty value isn't sent.
+func (i *IDP) configureSecurityHeaders() error {
+	headers := map[string]string{}
+	for name, value := range defaultSecurityHeaders {
+		headers[name] = value
+	}
+	for name, value := range i.settings.GetStringMapString("security-headers") {
+		if !headerName.MatchString(name) {
+			return fmt.Errorf("security-headers %q isn't a valid header name", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("security-headers %s can't span lines", name)
+		}
+		// Names are lowercased when the configuration is read
+		name = http.CanonicalHeaderKey(name)
+		if value == "" {
+			delete(headers, name)
+			continue
+		}
+		headers[name] = value
+	}
+	i.securityHeaders = headers
+	return nil
+}
+
+// addSecurityHeaders sets the security headers before the handler runs, so pages that need a different policy can
+// replace them
+func (i *IDP) addSecurityHeaders(handler http.Handler) http.Handler {
+	headers := i.securityHeaders
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for name, value := range headers {
+			w.Header().Set(name, value)
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
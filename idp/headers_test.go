@@ -0,0 +1,66 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_addSecurityHeaders(t *testing.T) {
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	for _, path := range []string{"/metadata", "/ui/login.html", "/missing"} {
+		w := httptest.NewRecorder()
+		i.handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		for name, value := range defaultSecurityHeaders {
+			assert.Equal(t, value, w.Header().Get(name), path)
+		}
+	}
+	assert.Equal(t, "DENY", defaultSecurityHeaders["X-Frame-Options"], "the login form shouldn't be framed by default")
+
+	viper.Set("security-headers", map[string]string{
+		"content-security-policy": "default-src 'self'; frame-ancestors 'none'",
+		"referrer-policy":         "",
+		"permissions-policy":      "camera=()",
+	})
+	defer viper.Set("security-headers", map[string]string{})
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	w := httptest.NewRecorder()
+	i.handler.ServeHTTP(w, httptest.NewRequest("GET", "/metadata", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "default-src 'self'; frame-ancestors 'none'", w.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "camera=()", w.Header().Get("Permissions-Policy"))
+	assert.Equal(t, "DENY", w.Header().Get("X-Frame-Options"), "headers that aren't overridden keep their defaults")
+	_, ok := w.Header()["Referrer-Policy"]
+	assert.False(t, ok, "an empty value should remove the header")
+}
+
+func TestIDP_configureSecurityHeaders(t *testing.T) {
+	defer viper.Set("security-headers", map[string]string{})
+	for _, headers := range []map[string]string{
+		{"x frame options": "DENY"},
+		{"x-frame-options": "DENY\r\nSet-Cookie: a=b"},
+	} {
+		viper.Set("security-headers", headers)
+		_, err := (&IDP{}).Handler()
+		assert.Error(t, err, "%v", headers)
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/version"
+	log "github.com/sirupsen/logrus"
+)
+
+// HealthChecker can be implemented by password validators and attribute sources that depend on
+// other services. The readiness handler reports the IdP as not ready while CheckHealth fails.
+type HealthChecker interface {
+	CheckHealth(ctx context.Context) error
+}
+
+// DefaultHealthHandler is the default implementation for the liveness handler. It always succeeds once the server is running.
+func (i *IDP) DefaultHealthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok\n")
+	}
+}
+
+// DefaultReadinessHandler is the default implementation for the readiness handler. It succeeds when the session store,
+// signing key, and any password validator or attribute sources that implement HealthChecker are working.
+func (i *IDP) DefaultReadinessHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := i.checkReadiness(r.Context()); err != nil {
+			log.Warnf("readiness check failed: %v", err)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, "ok\n")
+	}
+}
+
+// DefaultVersionHandler is the default implementation for the version handler. It writes the version, git commit, and
+// build date as JSON.
+func (i *IDP) DefaultVersionHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(version.Get())
+	}
+}
+
+func (i *IDP) checkReadiness(ctx context.Context) error {
+	if err := i.checkSessionStore(); err != nil {
+		return fmt.Errorf("session store: %v", err)
+	}
+	if _, err := i.signer.Sign([]byte("readiness")); err != nil {
+		return fmt.Errorf("signing key: %v", err)
+	}
+	if checker, ok := i.PasswordValidator.(HealthChecker); ok {
+		if err := checker.CheckHealth(ctx); err != nil {
+			return fmt.Errorf("password validator: %v", err)
+		}
+	}
+	for _, source := range i.AttributeSources {
+		if checker, ok := source.(HealthChecker); ok {
+			if err := checker.CheckHealth(ctx); err != nil {
+				return fmt.Errorf("attribute source: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkSessionStore writes, reads, and removes an entry so stores backed by other services are actually contacted
+func (i *IDP) checkSessionStore() error {
+	// Concurrent probes use their own keys
+	key := "readiness-" + saml.NewID()
+	probe := []byte(key)
+	if err := i.UserCache.Set(key, probe); err != nil {
+		return err
+	}
+	data, err := i.UserCache.Get(key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(data, probe) {
+		return errors.New("stored entry could not be read back")
+	}
+	return i.UserCache.Delete(key)
+}
@@ -0,0 +1,124 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/version"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+type failingCache struct {
+	store.Cache
+}
+
+func (failingCache) Set(key string, entry []byte) error {
+	return errors.New("store is down")
+}
+
+func TestIDP_health(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	for _, path := range []string{"health-path", "readiness-path"} {
+		resp, err := ts.Client().Get(ts.URL + viper.GetString(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode, path)
+	}
+}
+
+func TestIDP_version(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	resp, err := ts.Client().Get(ts.URL + "/version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	ts.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "the version shouldn't be reported unless it's enabled")
+
+	viper.Set("version-enabled", true)
+	defer viper.Set("version-enabled", false)
+	viper.Set("admin-listen-address", "127.0.0.1:9090")
+	defer viper.Set("admin-listen-address", "")
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	w := httptest.NewRecorder()
+	i.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	var info version.Info
+	if assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &info)) {
+		assert.Equal(t, version.Get(), info)
+	}
+	handler, _ := i.Handler()
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/version", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, "the version should only be on the admin listener when there is one")
+}
+
+func TestIDP_readiness_sessionStore(t *testing.T) {
+	i := &IDP{UserCache: failingCache{}}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL + viper.GetString("readiness-path"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode, "an unavailable session store should fail readiness")
+
+	resp, err = ts.Client().Get(ts.URL + viper.GetString("health-path"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "liveness should not depend on the session store")
+}
+
+func TestIDP_readiness_ldap(t *testing.T) {
+	s := newTestDirectory()
+	defer s.Close()
+	configureTestLDAP(s.URL)
+	defer viper.Set("ldap.url", "")
+	i := &IDP{}
+	getTestIDP(t, i)
+	assert.NoError(t, i.checkReadiness(context.Background()))
+}
+
+func TestLDAPDirectory_CheckHealth_unavailable(t *testing.T) {
+	s := newTestDirectory()
+	s.Close()
+	configureTestLDAP(s.URL)
+	defer viper.Set("ldap.url", "")
+	validator, err := NewLDAPValidator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = validator.(HealthChecker).CheckHealth(context.Background())
+	assert.True(t, errors.Is(err, ErrServiceUnavailable), "expected service unavailable")
+}
@@ -15,73 +15,264 @@
 package idp
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	htmltemplate "html/template"
+	"io"
 	"net"
 	"net/http"
 	"strings"
 	"text/template"
+	"time"
 
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/kerberos"
+	"github.com/amdonov/lite-idp/metrics"
 	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
 	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/store/redis"
+	"github.com/amdonov/lite-idp/tracing"
 	"github.com/amdonov/lite-idp/ui"
-	"github.com/amdonov/xmlsig"
 	"github.com/julienschmidt/httprouter"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
 // IDP is the main data structure for the IDP. Public members can be used to alter behavior. Otherwise defaults are fine.
 type IDP struct {
+	// Settings used instead of the global viper configuration when it's set. New sets it.
+	Config *Config
 	// You can include other routes by providing a router or
 	// one will be created. Alternatively, you can add routes and
 	// middleware to the Handler
 	Router *httprouter.Router
 	// Short term cache for saving state during authentication
 	TempCache store.Cache
+	// Cache of responses waiting for artifact resolution
+	ArtifactCache store.Cache
+	// IDs of accepted AuthnRequests. Entries should last twice clock-skew.
+	ReplayCache store.Cache
 	// Longer term cache of authenticated users
-	UserCache              store.Cache
+	UserCache store.Cache
+	// Persistent NameIDs issued to service providers. Entries shouldn't expire.
+	PairwiseIDCache store.Cache
+	// Login rate limits and failed login counts. Entries should last auth-lockout-window.
+	AuthLimitCache store.Cache
+	// Attribute releases users approved when consent is required. Entries shouldn't expire.
+	ConsentCache store.Cache
+	// TOTP secrets users are enrolled with. Entries shouldn't expire.
+	TOTPSecretCache        store.Cache
 	TLSConfig              *tls.Config
 	PasswordValidator      PasswordValidator
 	AttributeSources       []AttributeSource
 	MetadataHandler        http.HandlerFunc
 	ArtifactResolveHandler http.HandlerFunc
 	RedirectSSOHandler     http.HandlerFunc
+	PostSSOHandler         http.HandlerFunc
+	ECPHandler             http.HandlerFunc
+	UnsolicitedSSOHandler  http.HandlerFunc
+	LoginPageHandler       http.HandlerFunc
 	PasswordLoginHandler   http.HandlerFunc
+	TOTPPageHandler        http.HandlerFunc
+	TOTPLoginHandler       http.HandlerFunc
+	ConsentPageHandler     http.HandlerFunc
+	ConsentHandler         http.HandlerFunc
 	QueryHandler           http.HandlerFunc
-	Auditor                Auditor
-	handler                http.Handler
-	signer                 xmlsig.Signer
+	SingleLogoutHandler    http.HandlerFunc
+	ManageNameIDHandler    http.HandlerFunc
+	// OpenID Connect endpoints routed when oidc.enabled is set
+	OIDCConfigurationHandler http.HandlerFunc
+	OIDCKeysHandler          http.HandlerFunc
+	OIDCAuthorizationHandler http.HandlerFunc
+	OIDCTokenHandler         http.HandlerFunc
+	// Change assertions for service providers before they're signed. They run in order.
+	AssertionDecorators []AssertionDecorator
+	// Certificate and key used to sign SAML messages and OpenID Connect tokens. Loaded from signing-certificate and
+	// signing-private-key if they're set, otherwise the TLS certificate is used.
+	SigningCertificate *tls.Certificate
+	// Certificates published in the metadata for signing along with SigningCertificate so service providers trust
+	// both the old and new keys during a rollover. Loaded from additional-signing-certificates if it's nil.
+	AdditionalSigningCertificates []*x509.Certificate
+	// Metrics collected by the IDP. Applications can register their own metrics as well.
+	Metrics *metrics.Registry
+	// Serves Metrics. It's routed at metrics-path unless metrics-address is set,
+	// in which case the caller is expected to serve it on a separate listener.
+	MetricsHandler http.HandlerFunc
+	// Liveness and readiness probes routed at health-path and readiness-path. They're routed by AdminHandler
+	// along with metrics when admin-listen-address is set.
+	HealthHandler    http.HandlerFunc
+	ReadinessHandler http.HandlerFunc
+	// Reports the running build at version-path when version-enabled is set. It's routed by AdminHandler
+	// when admin-listen-address is set.
+	VersionHandler http.HandlerFunc
+	// Lists and revokes sessions at admin-sessions-path on the admin listener when admin-api-token or
+	// admin-client-ca is set
+	SessionsHandler http.HandlerFunc
+	// Sends LogoutRequests to service providers with a SOAP single logout service. It's created with the TLS
+	// certificate as its client certificate if it's nil.
+	LogoutClient *http.Client
+	// Records spans for requests. It's created from tracing-endpoint when tracing-enabled is set and
+	// shared with reloaded IDPs. Applications can start their own spans from request contexts.
+	Tracer  *tracing.Tracer
+	Auditor Auditor
+	handler http.Handler
+	// serves metrics, probes, and optionally metadata when admin-listen-address is set
+	adminRouter *httprouter.Router
+	signer      dsig.Signer
+	// signature algorithms supported by the signing key
+	signatureAlgorithms []string
+	metrics             *idpMetrics
+	// the IDP as provided by the caller, used to rebuild it when the configuration is reloaded
+	template *IDP
+	// set once the shared caches and the caller's validator and sources belong to another IDP
+	handedOff bool
+	// Config or the global configuration, read while the IDP is built
+	settings *viper.Viper
 
 	// properties set or derived from configuration settings
 	cookieName                        string
+	sessionCookieAttributes           http.Cookie
 	serverName                        string
+	basePath                          string
 	entityID                          string
 	artifactResolutionServiceLocation string
 	attributeServiceLocation          string
 	singleSignOnServiceLocation       string
-	postTemplate                      *template.Template
-	sps                               map[string]*ServiceProvider
+	singleLogoutServiceLocation       string
+	manageNameIDServiceLocation       string
+	wantAuthnRequestsSigned           bool
+	wantArtifactResolveSigned         bool
+	backChannelTimeout                time.Duration
+	backChannelParallelism            int
+	debugSAML                         bool
+	debugSAMLDirectory                string
+	organization                      *saml.Organization
+	contacts                          []saml.ContactPerson
+	entityAttributes                  *saml.EntityAttributes
+	uiInfo                            *saml.UIInfo
+	assertionLifetime                 time.Duration
+	sessionLifetime                   time.Duration
+	sessionIdleTimeout                time.Duration
+	clockSkew                         time.Duration
+	maxRequestSize                    int64
+	maxInflatedSize                   int64
+	trustedProxies                    []*net.IPNet
+	accessRules                       []accessRule
+	adminAPIToken                     string
+	certLogin                         bool
+	certPrincipal                     string
+	certNameIDTemplate                *template.Template
+	revocation                        *revocationChecker
+	kerberos                          *kerberos.Acceptor
+	kerberosNameIDTemplate            *template.Template
+	negotiateTemplate                 *htmltemplate.Template
+	emailAttribute                    string
+	attributeDefinitions              attributeDefinitions
+	attributeOrder                    []string
+	attributeTransforms               attributeTransforms
+	releaseByDefault                  bool
+	categoryRelease                   map[string][]AttributeRelease
+	passwordAuthnContext              string
+	certificateAuthnContext           string
+	mfaAuthnContext                   string
+	kerberosAuthnContext              string
+	totpEnabled                       bool
+	totpRequired                      bool
+	totpSkew                          int
+	totpMaxAttempts                   int
+	totpSecrets                       *TOTPSecretStore
+	totpTemplate                      *htmltemplate.Template
+	consentEnabled                    bool
+	consentTemplate                   *htmltemplate.Template
+	auditLog                          *auditLog
+	auditRequired                     bool
+	cors                              *corsPolicy
+	securityHeaders                   map[string]string
+	issuerFormat                      string
+	oidcEnabled                       bool
+	oidcClients                       map[string]*OIDCClient
+	oidcClaimMap                      map[string]string
+	oidcTokenLifetime                 time.Duration
+	jwtSigner                         *jwtSigner
+	pairwiseIDs                       *PairwiseIDStore
+	authLimiter                       *authLimiter
+	postTemplate                      pageTemplate
+	errorTemplate                     *htmltemplate.Template
+	catalogs                          map[string]Messages
+	defaultLocale                     string
+	logoutTemplate                    *htmltemplate.Template
+	loginTemplate                     *htmltemplate.Template
+	landingTemplate                   *htmltemplate.Template
+	sps                               *registry
+}
+
+// AdminHandler returns the http.Handler for the listener at admin-listen-address once Handler has been called.
+// It serves metrics, health checks, and metadata if admin-metadata is set. It's nil when admin-listen-address
+// isn't set, and those endpoints are served by Handler instead.
+func (i *IDP) AdminHandler() http.Handler {
+	if i.adminRouter == nil {
+		return nil
+	}
+	return i.adminRouter
 }
 
 // Handler returns the IDP's http.Handler including all sub routes or an error
 func (i *IDP) Handler() (http.Handler, error) {
 	if i.handler == nil {
+		template := *i
+		i.template = &template
+		i.settings = viper.GetViper()
+		if i.Config != nil {
+			i.settings = i.Config.settings()
+		}
 		if i.Auditor == nil {
 			i.Auditor = DefaultAuditor()
 		}
 		if err := i.configureConstants(); err != nil {
 			return nil, err
 		}
-		if err := i.configureSPs(); err != nil {
+		i.configureMetrics()
+		i.configureTracing()
+		if err := i.configureAuditLog(); err != nil {
 			return nil, err
 		}
 		if err := i.configureCrypto(); err != nil {
 			return nil, err
 		}
+		if err := i.configureBackChannelLogout(); err != nil {
+			return nil, err
+		}
+		if err := i.configureCertLogin(); err != nil {
+			return nil, err
+		}
+		if err := i.configureSPs(); err != nil {
+			return nil, err
+		}
+		if err := i.configureOIDC(); err != nil {
+			return nil, err
+		}
 		if err := i.configureStores(); err != nil {
 			return nil, err
 		}
+		if err := i.configureKerberos(); err != nil {
+			return nil, err
+		}
+		if err := i.configureAuthLimits(); err != nil {
+			return nil, err
+		}
+		if err := i.configureTOTP(); err != nil {
+			return nil, err
+		}
+		if err := i.configureConsent(); err != nil {
+			return nil, err
+		}
+		if err := i.configureDevMode(); err != nil {
+			return nil, err
+		}
 		if err := i.configureValidator(); err != nil {
 			return nil, err
 		}
@@ -91,49 +282,341 @@ func (i *IDP) Handler() (http.Handler, error) {
 		if err := i.buildRoutes(); err != nil {
 			return nil, err
 		}
-		i.handler = i.Router
+		i.handler = i.addSecurityHeaders(i.restrictAccess(limitRequestSize(i.maxRequestSize, i.Router)))
+		if i.basePath != "" {
+			i.handler = http.StripPrefix(i.basePath, i.handler)
+		}
+		if i.Tracer != nil {
+			i.handler = i.Tracer.Handler(i.handler)
+		}
+		i.handler = i.forwardedFor(i.handler)
 	}
 	return i.handler, nil
 }
 
 func (i *IDP) configureConstants() error {
-	templ, err := template.New("post").Parse(postTemplate)
+	if err := i.configurePostPage(); err != nil {
+		return err
+	}
+	if err := i.configureLocales(); err != nil {
+		return err
+	}
+	if err := i.configureErrorPage(); err != nil {
+		return err
+	}
+	logoutTempl, err := htmltemplate.New("logout").Parse(logoutTemplate)
 	if err != nil {
 		return err
 	}
-	i.postTemplate = templ
-	i.cookieName = viper.GetString("cookie-name")
-	serverName := viper.GetString("server-name")
-	i.entityID = viper.GetString("entity-id")
+	i.logoutTemplate = logoutTempl
+	if err := i.configureLoginPage(); err != nil {
+		return err
+	}
+	if err := i.configureLandingPage(); err != nil {
+		return err
+	}
+	serverName := i.settings.GetString("server-name")
+	i.basePath = strings.TrimSuffix(i.settings.GetString("base-path"), "/")
+	if i.basePath != "" && !strings.HasPrefix(i.basePath, "/") {
+		return fmt.Errorf("base-path %s must start with /", i.basePath)
+	}
+	if err := i.configureSessionCookie(); err != nil {
+		return err
+	}
+	i.entityID = i.settings.GetString("entity-id")
 	if i.entityID == "" {
-		i.entityID = fmt.Sprintf("https://%s/", serverName)
+		i.entityID = fmt.Sprintf("https://%s%s/", serverName, i.basePath)
 	}
 	i.serverName = serverName
-	i.artifactResolutionServiceLocation = fmt.Sprintf("https://%s%s", serverName, viper.GetString("artifact-service-path"))
-	i.attributeServiceLocation = fmt.Sprintf("https://%s%s", serverName, viper.GetString("attribute-service-path"))
-	i.singleSignOnServiceLocation = fmt.Sprintf("https://%s%s", serverName, viper.GetString("sso-service-path"))
+	i.artifactResolutionServiceLocation = i.location(i.settings.GetString("artifact-service-path"))
+	i.attributeServiceLocation = i.location(i.settings.GetString("attribute-service-path"))
+	i.singleSignOnServiceLocation = i.location(i.settings.GetString("sso-service-path"))
+	i.wantAuthnRequestsSigned = i.settings.GetBool("want-authn-requests-signed")
+	i.wantArtifactResolveSigned = i.settings.GetBool("want-artifact-resolve-signed")
+	if err := i.configureLifetimes(); err != nil {
+		return err
+	}
+	if err := i.configureClockSkew(); err != nil {
+		return err
+	}
+	if err := i.configureRequestSize(); err != nil {
+		return err
+	}
+	if err := i.configureTrustedProxies(); err != nil {
+		return err
+	}
+	if err := i.configureDebugSAML(); err != nil {
+		return err
+	}
+	if err := i.configureAccessRules(); err != nil {
+		return err
+	}
+	if err := i.configureCORS(); err != nil {
+		return err
+	}
+	if err := i.configureIssuer(); err != nil {
+		return err
+	}
+	if err := i.configureSecurityHeaders(); err != nil {
+		return err
+	}
+	if err := i.configureSessionAPI(); err != nil {
+		return err
+	}
+	i.configureNameIDs()
+	if err := i.configureAttributeDefinitions(); err != nil {
+		return err
+	}
+	if err := i.configureAttributeTransforms(); err != nil {
+		return err
+	}
+	if err := i.configureAttributeRelease(); err != nil {
+		return err
+	}
+	i.configureAuthnContexts()
+	if err := i.configureOrganization(); err != nil {
+		return err
+	}
+	if err := i.configureEntityAttributes(); err != nil {
+		return err
+	}
+	if i.settings.GetBool("slo-enabled") {
+		i.singleLogoutServiceLocation = i.location(i.settings.GetString("slo-service-path"))
+	}
+	if i.settings.GetBool("manage-nameid-enabled") {
+		i.manageNameIDServiceLocation = i.location(i.settings.GetString("manage-nameid-service-path"))
+	}
 	return nil
 }
 
+// location is the URL of a path routed by the IDP
+func (i *IDP) location(path string) string {
+	return fmt.Sprintf("https://%s%s%s", i.serverName, i.basePath, path)
+}
+
+// Reload returns a new IDP built from the current configuration with the same customizations as i.
+// Caches and metrics are shared with i so existing sessions survive. i can keep serving requests
+// until the caller switches to the new IDP and closes i. IDPs with a Config keep it, so they only
+// pick up changes to files it names such as certificates.
+func (i *IDP) Reload() (*IDP, error) {
+	if i.template == nil {
+		return nil, errors.New("IDP has not been configured")
+	}
+	return i.reload(i.template.Config)
+}
+
+// ReloadConfig is like Reload, but the new IDP is built from config.
+func (i *IDP) ReloadConfig(config Config) (*IDP, error) {
+	if i.template == nil {
+		return nil, errors.New("IDP has not been configured")
+	}
+	return i.reload(&config)
+}
+
+func (i *IDP) reload(config *Config) (*IDP, error) {
+	if i.template.Router != nil {
+		return nil, errors.New("an IDP with a custom Router cannot be reloaded")
+	}
+	next := *i.template
+	next.Config = config
+	next.TempCache = i.TempCache
+	next.ArtifactCache = i.ArtifactCache
+	next.ReplayCache = i.ReplayCache
+	next.UserCache = i.UserCache
+	next.PairwiseIDCache = i.PairwiseIDCache
+	next.AuthLimitCache = i.AuthLimitCache
+	next.TOTPSecretCache = i.TOTPSecretCache
+	next.ConsentCache = i.ConsentCache
+	next.Metrics = i.Metrics
+	next.metrics = i.metrics
+	next.Tracer = i.Tracer
+	// The audit log is kept if its settings don't change
+	next.auditLog = i.auditLog
+	if _, err := next.Handler(); err != nil {
+		return nil, err
+	}
+	for _, cert := range []*tls.Certificate{&next.TLSConfig.Certificates[0], next.SigningCertificate} {
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err == nil && time.Now().After(leaf.NotAfter) {
+			err = fmt.Errorf("certificate expired on %s", leaf.NotAfter)
+		}
+		if err != nil {
+			// Only release what the rejected IDP created for itself
+			next.handedOff = true
+			next.Close()
+			return nil, err
+		}
+	}
+	i.handedOff = true
+	return &next, nil
+}
+
+func (i *IDP) configureMetrics() {
+	if i.Metrics == nil {
+		i.Metrics = metrics.NewRegistry()
+	}
+	if i.metrics == nil {
+		i.metrics = newIDPMetrics(i.Metrics)
+	}
+}
+
 func (i *IDP) configureSPs() error {
 	sps := []*ServiceProvider{}
-	if err := viper.UnmarshalKey("sps", &sps); err != nil {
+	if err := i.settings.UnmarshalKey("sps", &sps); err != nil {
 		return err
 	}
-	i.sps = make(map[string]*ServiceProvider, len(sps))
-	for j, sp := range sps {
-		if err := sp.parseCertificate(); err != nil {
-			return err
-		}
-		i.sps[sp.EntityID] = sps[j]
+	sources, err := i.configureMetadataSources()
+	if err != nil {
+		return err
 	}
+	registry, err := newRegistry(sps, i.settings.GetString("metadata-directory"), sources, i.prepareSP)
+	if err != nil {
+		return err
+	}
+	if interval := i.settings.GetDuration("metadata-refresh-interval"); registry.directory != "" && interval > 0 {
+		registry.watch(interval)
+	}
+	if interval := i.settings.GetDuration("metadata-url-refresh-interval"); len(sources) > 0 && interval > 0 {
+		registry.watchSources(interval)
+	}
+	i.sps = registry
+	return nil
+}
 
+// prepareSP parses the service provider's keys and chooses how assertions are signed and encrypted for it
+func (i *IDP) prepareSP(sp *ServiceProvider) error {
+	if err := sp.parseCertificate(); err != nil {
+		return err
+	}
+	definitions, err := newAttributeDefinitions(sp.AttributeDefinitions)
+	if err != nil {
+		return fmt.Errorf("%s: %v", sp.EntityID, err)
+	}
+	sp.attributeDefinitions = definitions
+	if err := sp.validateAudiences(); err != nil {
+		return err
+	}
+	if sp.releasePolicy, err = newReleasePolicy(i.releaseRules(sp)); err != nil {
+		return fmt.Errorf("%s: %v", sp.EntityID, err)
+	}
+	if err := sp.configureEncryption(i.settings.GetString("encryption-algorithm")); err != nil {
+		return err
+	}
+	if err := sp.validateSignatureLocation(); err != nil {
+		return err
+	}
+	if err := sp.validateSubjectConfirmation(); err != nil {
+		return err
+	}
+	if err := sp.validateIssuerFormat(); err != nil {
+		return err
+	}
+	if len(sp.DefaultRelayState) > maxRelayStateLength {
+		return fmt.Errorf("%s: defaultrelaystate cannot be longer than %d bytes", sp.EntityID, maxRelayStateLength)
+	}
+	if sp.AuthnRequestsSigned == nil {
+		signed := i.wantAuthnRequestsSigned
+		sp.AuthnRequestsSigned = &signed
+	}
+	if sp.ArtifactResolveSigned == nil {
+		signed := i.wantArtifactResolveSigned
+		sp.ArtifactResolveSigned = &signed
+	}
+	canonicalization, err := sp.canonicalizationAlgorithm()
+	if err != nil {
+		return err
+	}
+	options := dsig.SignerOptions{
+		SignatureAlgorithm:  firstSupported(sp.SigningMethods, i.signatureAlgorithms),
+		DigestAlgorithm:     firstSupported(sp.DigestMethods, dsig.DigestAlgorithms()),
+		Canonicalization:    canonicalization,
+		InclusiveNamespaces: sp.InclusiveNamespaces,
+	}
+	if options.SignatureAlgorithm == "" && options.DigestAlgorithm == "" &&
+		canonicalization == dsig.ExclusiveC14N && len(sp.InclusiveNamespaces) == 0 {
+		return nil
+	}
+	if options.SignatureAlgorithm == "" {
+		options.SignatureAlgorithm = i.signer.Algorithm()
+		if options.DigestAlgorithm == "" {
+			// Only the canonicalization differs from the IdP's default signer
+			options.DigestAlgorithm = i.settings.GetString("digest-algorithm")
+		}
+	}
+	signer, err := dsig.NewSigner(*i.SigningCertificate, options)
+	if err != nil {
+		return err
+	}
+	sp.signer = signer
 	return nil
 }
 
+// ServiceProvider returns the trusted service provider with the entity ID. It includes the
+// service provider's assertion consumer services, certificates, and NameID formats. The returned
+// value is shared by concurrent requests and must not be modified.
+func (i *IDP) ServiceProvider(entityID string) (*ServiceProvider, bool) {
+	return i.sps.get(entityID)
+}
+
+// Close stops rescanning the metadata directory and closes the caches, password validator, attribute
+// sources, and signing key that implement io.Closer. After a successful Reload the caches and the validator and sources
+// provided by the caller belong to the new IDP and are left open. Requests shouldn't be served afterwards.
+func (i *IDP) Close() error {
+	if i.sps != nil {
+		i.sps.close()
+	}
+	if i.template == nil {
+		return nil
+	}
+	resources := []interface{}{}
+	// The audit log is closed when the last IDP that shares it is
+	if i.auditLog != nil {
+		resources = append(resources, i.auditLog)
+	}
+	// Validators and sources created from the configuration aren't shared with reloaded IDPs
+	if i.template.PasswordValidator == nil {
+		resources = append(resources, i.PasswordValidator)
+	}
+	if i.template.AttributeSources == nil {
+		for _, source := range i.AttributeSources {
+			resources = append(resources, source)
+		}
+	}
+	// Such as the session with an HSM
+	if i.template.SigningCertificate == nil && i.SigningCertificate != nil {
+		resources = append(resources, i.SigningCertificate.PrivateKey)
+	}
+	if !i.handedOff {
+		resources = append(resources, i.UserCache, i.TempCache, i.PairwiseIDCache, i.AuthLimitCache, i.TOTPSecretCache,
+			i.ConsentCache)
+		if i.ArtifactCache != i.TempCache {
+			resources = append(resources, i.ArtifactCache)
+		}
+		resources = append(resources, i.ReplayCache)
+		if i.template.PasswordValidator != nil {
+			resources = append(resources, i.PasswordValidator)
+		}
+		if i.template.Tracer == nil && i.Tracer != nil {
+			resources = append(resources, i.Tracer)
+		}
+		for _, source := range i.template.AttributeSources {
+			resources = append(resources, source)
+		}
+	}
+	var err error
+	for _, resource := range resources {
+		if closer, ok := resource.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
 func (i *IDP) configureCrypto() error {
 	if i.TLSConfig == nil {
-		tlsConfig, err := ConfigureTLS()
+		tlsConfig, err := configureTLS(i.settings)
 		if err != nil {
 			return err
 		}
@@ -142,51 +625,216 @@ func (i *IDP) configureCrypto() error {
 	if len(i.TLSConfig.Certificates) == 0 {
 		return errors.New("tlsConfig does not contain a certificate")
 	}
-	cert := i.TLSConfig.Certificates[0]
-	signer, err := xmlsig.NewSignerWithOptions(cert, xmlsig.SignerOptions{
-		SignatureAlgorithm: viper.GetString("signature-algorithm"),
-		DigestAlgorithm:    viper.GetString("digest-algorithm"),
+	if i.SigningCertificate == nil {
+		cert, err := loadSigningCertificate(i.settings)
+		if err != nil {
+			return err
+		}
+		if cert == nil {
+			// Sign with the TLS key for compatibility with existing trust relationships
+			cert = &i.TLSConfig.Certificates[0]
+		}
+		i.SigningCertificate = cert
+	}
+	if i.AdditionalSigningCertificates == nil {
+		certs, err := loadAdditionalSigningCertificates(i.settings)
+		if err != nil {
+			return err
+		}
+		i.AdditionalSigningCertificates = certs
+	}
+	cert := *i.SigningCertificate
+	signer, err := dsig.NewSigner(cert, dsig.SignerOptions{
+		SignatureAlgorithm: i.settings.GetString("signature-algorithm"),
+		DigestAlgorithm:    i.settings.GetString("digest-algorithm"),
 	})
+	if err != nil {
+		return err
+	}
 	i.signer = signer
-	return err
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	i.signatureAlgorithms = dsig.SignatureAlgorithms(leaf.PublicKey)
+	return nil
+}
+
+// audiences lists the audiences of assertions for the service provider, just its entity ID if it isn't trusted
+func (i *IDP) audiences(entityID string) []string {
+	if sp, ok := i.sps.get(entityID); ok {
+		return sp.audiences()
+	}
+	return []string{entityID}
+}
+
+// signerFor returns the signer for messages sent to the service provider
+func (i *IDP) signerFor(entityID string) dsig.Signer {
+	if sp, ok := i.sps.get(entityID); ok && sp.signer != nil {
+		return sp.signer
+	}
+	return i.signer
+}
+
+func firstSupported(preferred, supported []string) string {
+	for _, alg := range preferred {
+		if containsString(supported, alg) {
+			return alg
+		}
+	}
+	return ""
+}
+
+// newCache creates a cache in the store setting whose entries expire after duration, or never if it's zero. In Redis
+// the entries are kept under keys starting with prefix.
+func (i *IDP) newCache(prefix string, duration time.Duration) (store.Cache, error) {
+	switch i.settings.GetString("store") {
+	case "memory":
+		if duration == 0 {
+			duration = persistentLifetime
+		}
+		return store.New(duration)
+	case "redis":
+		password, err := resolveSecret(i.settings, "redis.password")
+		if err != nil {
+			return nil, err
+		}
+		return redis.NewWithOptions(redis.Options{
+			Address:  i.settings.GetString("redis.address"),
+			Password: password,
+			DB:       i.settings.GetInt("redis.db"),
+		}, prefix, duration), nil
+	default:
+		return nil, fmt.Errorf("unsupported store %s, must be memory or redis", i.settings.GetString("store"))
+	}
 }
 
 func (i *IDP) configureStores() error {
+	// Each cache has its own prefix, so a key that's looked up in one can't find another's entries when they share
+	// a Redis database
 	if i.TempCache == nil {
-		cache, err := store.New(viper.GetDuration("temp-cache-duration"))
+		cache, err := i.newCache("temp:", i.settings.GetDuration("temp-cache-duration"))
 		if err != nil {
 			return err
 		}
 		i.TempCache = cache
 	}
+	if i.ArtifactCache == nil {
+		cache, err := i.newCache("artifact:", i.settings.GetDuration("artifact-lifetime"))
+		if err != nil {
+			return err
+		}
+		i.ArtifactCache = cache
+	}
+	// Requests are accepted for clock-skew either side of their IssueInstant
+	if i.ReplayCache == nil {
+		cache, err := i.newCache("replay:", 2*i.clockSkew)
+		if err != nil {
+			return err
+		}
+		i.ReplayCache = cache
+	}
+	// The session API lists the sessions under their prefix
 	if i.UserCache == nil {
-		cache, err := store.New(viper.GetDuration("user-cache-duration"))
+		cache, err := i.newCache("session:", i.sessionLifetime)
 		if err != nil {
 			return err
 		}
 		i.UserCache = cache
 	}
+	// Persistent NameIDs must not expire
+	if i.PairwiseIDCache == nil {
+		cache, err := i.newCache("pairwise:", 0)
+		if err != nil {
+			return err
+		}
+		i.PairwiseIDCache = cache
+	}
+	i.pairwiseIDs = NewPairwiseIDStore(i.PairwiseIDCache)
+	return nil
+}
+
+// configureLifetimes reads how long assertions, sessions, and artifacts are valid
+func (i *IDP) configureLifetimes() error {
+	for _, key := range []string{"assertion-lifetime", "session-lifetime", "artifact-lifetime"} {
+		if i.settings.GetDuration(key) <= 0 {
+			return fmt.Errorf("%s must be a positive duration", key)
+		}
+	}
+	i.assertionLifetime = i.settings.GetDuration("assertion-lifetime")
+	i.sessionLifetime = i.settings.GetDuration("session-lifetime")
+	// session-absolute-timeout is the same limit under the name that goes with session-idle-timeout
+	if absolute := i.settings.GetDuration("session-absolute-timeout"); absolute != 0 {
+		if absolute < 0 {
+			return errors.New("session-absolute-timeout must be a positive duration")
+		}
+		i.sessionLifetime = absolute
+	}
+	i.sessionIdleTimeout = i.settings.GetDuration("session-idle-timeout")
+	if i.sessionIdleTimeout < 0 {
+		return errors.New("session-idle-timeout can't be negative")
+	}
+	if i.sessionIdleTimeout > i.sessionLifetime {
+		log.Warnf("session-idle-timeout %s is longer than the absolute session timeout %s", i.sessionIdleTimeout, i.sessionLifetime)
+	}
+	if i.assertionLifetime > i.sessionLifetime {
+		log.Warnf("assertion-lifetime %s is longer than session-lifetime %s", i.assertionLifetime, i.sessionLifetime)
+	}
+	if i.settings.IsSet("user-cache-duration") {
+		log.Warn("user-cache-duration is no longer used, set session-lifetime instead")
+	}
 	return nil
 }
 
 func (i *IDP) configureValidator() error {
-	if i.PasswordValidator == nil {
-		validator, err := NewValidator()
+	if i.PasswordValidator != nil {
+		return nil
+	}
+	names := i.settings.GetStringSlice("password-validators")
+	if len(names) == 0 {
+		names = []string{"users"}
+		if i.settings.GetString("ldap.url") != "" {
+			names = []string{"ldap"}
+		}
+	}
+	validators := make([]PasswordValidator, 0, len(names))
+	for _, name := range names {
+		validator, err := newPasswordValidator(i.settings, name)
 		if err != nil {
+			(&fallbackValidator{validators}).Close()
 			return err
 		}
-		i.PasswordValidator = validator
+		validators = append(validators, validator)
+	}
+	if len(validators) == 1 {
+		i.PasswordValidator = validators[0]
+		return nil
 	}
+	i.PasswordValidator = NewFallbackValidator(validators...)
 	return nil
 }
 
 func (i *IDP) configureAttributeSources() error {
 	if i.AttributeSources == nil {
-		source, err := NewAttributeSource()
+		source, err := newAttributeSource(i.settings)
 		if err != nil {
 			return err
 		}
 		i.AttributeSources = []AttributeSource{source}
+		if i.settings.GetString("ldap.url") != "" && len(i.settings.GetStringMapString("ldap.attribute-map")) > 0 {
+			ldapSource, err := newLDAPAttributeSource(i.settings)
+			if err != nil {
+				return err
+			}
+			i.AttributeSources = append(i.AttributeSources, ldapSource)
+		}
+		if i.settings.GetString("sql.driver") != "" {
+			sqlSource, err := newSQLAttributeSource(i.settings)
+			if err != nil {
+				return err
+			}
+			i.AttributeSources = append(i.AttributeSources, sqlSource)
+		}
 	}
 	return nil
 }
@@ -196,6 +844,13 @@ func (i *IDP) buildRoutes() error {
 		i.Router = httprouter.New()
 	}
 	r := i.Router
+	// Operational endpoints are kept off the public port when there's an admin listener
+	admin := r
+	i.adminRouter = nil
+	if i.settings.GetString("admin-listen-address") != "" {
+		i.adminRouter = httprouter.New()
+		admin = i.adminRouter
+	}
 
 	// Handle requests for metadata
 	if i.MetadataHandler == nil {
@@ -205,53 +860,163 @@ func (i *IDP) buildRoutes() error {
 		}
 		i.MetadataHandler = metadata
 	}
-	r.HandlerFunc("GET", viper.GetString("metadata-path"), i.MetadataHandler)
+	if i.settings.GetBool("admin-metadata") {
+		i.handleCORS(admin, i.settings.GetString("metadata-path"), i.MetadataHandler)
+	} else {
+		i.handleCORS(r, i.settings.GetString("metadata-path"), i.MetadataHandler)
+	}
 
 	// Handle artifact resolution
 	if i.ArtifactResolveHandler == nil {
 		i.ArtifactResolveHandler = i.DefaultArtifactResolveHandler()
 	}
-	r.HandlerFunc("POST", viper.GetString("artifact-service-path"), i.ArtifactResolveHandler)
+	r.HandlerFunc("POST", i.settings.GetString("artifact-service-path"), i.ArtifactResolveHandler)
 
 	// Handle redirect SSO requests
 	if i.RedirectSSOHandler == nil {
 		i.RedirectSSOHandler = i.DefaultRedirectSSOHandler()
 	}
-	r.HandlerFunc("GET", viper.GetString("sso-service-path"), i.RedirectSSOHandler)
+	r.HandlerFunc("GET", i.settings.GetString("sso-service-path"), i.RedirectSSOHandler)
+
+	// Handle POST SSO requests
+	if i.PostSSOHandler == nil {
+		i.PostSSOHandler = i.DefaultPostSSOHandler()
+	}
+	// ECP clients post to the same location
+	if i.ECPHandler == nil {
+		i.ECPHandler = i.DefaultECPHandler()
+	}
+	r.HandlerFunc("POST", i.settings.GetString("sso-service-path"), i.ssoPostHandler())
+
+	// Handle IdP-initiated SSO
+	if i.settings.GetBool("unsolicited-sso-enabled") {
+		if i.UnsolicitedSSOHandler == nil {
+			i.UnsolicitedSSOHandler = i.DefaultUnsolicitedSSOHandler()
+		}
+		r.HandlerFunc("GET", i.settings.GetString("unsolicited-sso-path"), i.UnsolicitedSSOHandler)
+	}
 
 	// Handle password logins
+	if i.LoginPageHandler == nil {
+		i.LoginPageHandler = i.DefaultLoginPageHandler()
+	}
 	if i.PasswordLoginHandler == nil {
 		i.PasswordLoginHandler = i.DefaultPasswordLoginHandler()
 	}
 	r.HandlerFunc("POST", "/ui/login.html", i.PasswordLoginHandler)
+	if i.TOTPPageHandler == nil {
+		i.TOTPPageHandler = i.DefaultTOTPPageHandler()
+	}
+	if i.TOTPLoginHandler == nil {
+		i.TOTPLoginHandler = i.DefaultTOTPLoginHandler()
+	}
+	r.HandlerFunc("POST", totpPagePath, i.TOTPLoginHandler)
+	if i.ConsentPageHandler == nil {
+		i.ConsentPageHandler = i.DefaultConsentPageHandler()
+	}
+	if i.ConsentHandler == nil {
+		i.ConsentHandler = i.DefaultConsentHandler()
+	}
+	r.HandlerFunc("POST", consentPagePath, i.ConsentHandler)
 
 	// Handle attribute query
 	if i.QueryHandler == nil {
 		i.QueryHandler = i.DefaultQueryHandler()
 	}
-	r.HandlerFunc("POST", viper.GetString("attribute-service-path"), i.QueryHandler)
+	r.HandlerFunc("POST", i.settings.GetString("attribute-service-path"), i.QueryHandler)
 
-	// Serve up UI
-	userInterface := ui.UI()
-	r.Handler("GET", "/ui/*path", userInterface)
-	r.Handler("GET", "/favicon.ico", userInterface)
+	// Handle redirect single logout
+	if i.singleLogoutServiceLocation != "" {
+		if i.SingleLogoutHandler == nil {
+			i.SingleLogoutHandler = i.DefaultSingleLogoutHandler()
+		}
+		r.HandlerFunc("GET", i.settings.GetString("slo-service-path"), i.SingleLogoutHandler)
+	}
 
-	return nil
-}
+	// Handle name identifier management over SOAP and the redirect binding
+	if i.manageNameIDServiceLocation != "" {
+		if i.ManageNameIDHandler == nil {
+			i.ManageNameIDHandler = i.DefaultManageNameIDHandler()
+		}
+		r.HandlerFunc("GET", i.settings.GetString("manage-nameid-service-path"), i.ManageNameIDHandler)
+		r.HandlerFunc("POST", i.settings.GetString("manage-nameid-service-path"), i.ManageNameIDHandler)
+	}
+
+	// Handle OpenID Connect clients
+	if i.oidcEnabled {
+		if i.OIDCConfigurationHandler == nil {
+			i.OIDCConfigurationHandler = i.DefaultOIDCConfigurationHandler()
+		}
+		i.handleCORS(r, oidcDiscoveryPath, i.OIDCConfigurationHandler)
+		if i.OIDCKeysHandler == nil {
+			i.OIDCKeysHandler = i.DefaultOIDCKeysHandler()
+		}
+		i.handleCORS(r, i.settings.GetString("oidc.jwks-path"), i.OIDCKeysHandler)
+		if i.OIDCAuthorizationHandler == nil {
+			i.OIDCAuthorizationHandler = i.DefaultOIDCAuthorizationHandler()
+		}
+		r.HandlerFunc("GET", i.settings.GetString("oidc.authorization-path"), i.OIDCAuthorizationHandler)
+		r.HandlerFunc("POST", i.settings.GetString("oidc.authorization-path"), i.OIDCAuthorizationHandler)
+		if i.OIDCTokenHandler == nil {
+			i.OIDCTokenHandler = i.DefaultOIDCTokenHandler()
+		}
+		r.HandlerFunc("POST", i.settings.GetString("oidc.token-path"), i.OIDCTokenHandler)
+	}
 
-func getIP(request *http.Request) net.IP {
-	addr := request.RemoteAddr
-	if strings.Contains(addr, ":") {
-		addr = strings.Split(addr, ":")[0]
+	// Expose metrics unless they are served on a separate listener
+	if i.MetricsHandler == nil {
+		i.MetricsHandler = i.Metrics.Handler().ServeHTTP
 	}
-	return net.ParseIP(addr)
+	if i.settings.GetString("metrics-address") == "" {
+		admin.HandlerFunc("GET", i.settings.GetString("metrics-path"), i.MetricsHandler)
+	}
+
+	// Handle liveness and readiness probes
+	if i.HealthHandler == nil {
+		i.HealthHandler = i.DefaultHealthHandler()
+	}
+	admin.HandlerFunc("GET", i.settings.GetString("health-path"), i.HealthHandler)
+	if i.ReadinessHandler == nil {
+		i.ReadinessHandler = i.DefaultReadinessHandler()
+	}
+	admin.HandlerFunc("GET", i.settings.GetString("readiness-path"), i.ReadinessHandler)
+
+	// Report the running build
+	if i.settings.GetBool("version-enabled") {
+		if i.VersionHandler == nil {
+			i.VersionHandler = i.DefaultVersionHandler()
+		}
+		admin.HandlerFunc("GET", i.settings.GetString("version-path"), i.VersionHandler)
+	}
+
+	// Handle the session API
+	if i.sessionAPIEnabled() {
+		if i.SessionsHandler == nil {
+			i.SessionsHandler = i.DefaultSessionsHandler()
+		}
+		path := i.settings.GetString("admin-sessions-path")
+		admin.HandlerFunc("GET", path, i.SessionsHandler)
+		admin.HandlerFunc("DELETE", path, i.SessionsHandler)
+		admin.HandlerFunc("DELETE", path+"/:id", i.SessionsHandler)
+	}
+
+	// Serve up UI
+	r.HandlerFunc("GET", "/ui/*path", i.uiHandler())
+	r.Handler("GET", "/favicon.ico", ui.UI())
+
+	return nil
 }
 
-func (i *IDP) setUserAttributes(user *model.User, req *model.AuthnRequest) error {
+func (i *IDP) setUserAttributes(ctx context.Context, user *model.User, req *model.AuthnRequest) (err error) {
+	_, span := tracing.Start(ctx, "resolve_attributes", tracing.Int("idp.attribute_sources", len(i.AttributeSources)))
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
 	for _, source := range i.AttributeSources {
 		if err := source.AddAttributes(user, req); err != nil {
 			return err
 		}
 	}
-	return nil
+	return i.attributeTransforms.apply(user)
 }
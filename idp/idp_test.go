@@ -15,14 +15,28 @@
 package idp
 
 import (
+	"net/http"
 	"net/http/httptest"
+	"os"
 	"path/filepath"
+	"runtime/debug"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis"
+	"github.com/amdonov/lite-idp/store"
 	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
 )
 
-func getTestIDP(t *testing.T, i *IDP) *httptest.Server {
+func TestMain(m *testing.M) {
+	// Every IDP preallocates a few hundred megabytes of cache. Collect the ones from
+	// earlier tests before the heap doubles so the package fits in a small CI machine.
+	debug.SetMemoryLimit(2 << 30)
+	os.Exit(m.Run())
+}
+
+func getTestIDP(t testing.TB, i *IDP) *httptest.Server {
 	viper.Set("tls-certificate", filepath.Join("testdata", "certificate.pem"))
 	viper.Set("tls-private-key", filepath.Join("testdata", "key.pem"))
 	viper.Set("tls-ca", filepath.Join("testdata", "certificate.pem"))
@@ -32,3 +46,175 @@ func getTestIDP(t *testing.T, i *IDP) *httptest.Server {
 	}
 	return httptest.NewTLSServer(handler)
 }
+
+// getTestIDPWithSP registers the service provider from testdata, which shares the IdP's key
+func getTestIDPWithSP(t testing.TB, i *IDP) *httptest.Server {
+	f, err := os.Open(filepath.Join("testdata", "sp-metadata.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	sp, err := ReadSPMetadata(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp.SingleLogoutServices = []SingleLogoutService{{
+		Binding:  redirectBinding,
+		Location: testSLOLocation,
+	}}
+	viper.Set("sps", []ServiceProvider{*sp})
+	return getTestIDP(t, i)
+}
+
+func TestIDP_Reload(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	i.TempCache.Set("session", []byte("data"))
+	entityID := i.entityID
+	defer viper.Set("entity-id", viper.GetString("entity-id"))
+	viper.Set("entity-id", "https://reloaded.example.com/")
+	next, err := i.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "https://reloaded.example.com/", next.entityID)
+	assert.Equal(t, entityID, i.entityID, "the running IDP should not change")
+	data, err := next.TempCache.Get("session")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("data"), data, "caches should be shared")
+
+	viper.Set("tls-certificate", filepath.Join("testdata", "missing.pem"))
+	defer viper.Set("tls-certificate", filepath.Join("testdata", "certificate.pem"))
+	_, err = next.Reload()
+	assert.Error(t, err, "an invalid certificate should be rejected")
+}
+
+func TestIDP_configureLifetimes(t *testing.T) {
+	defer viper.Set("session-lifetime", viper.GetString("session-lifetime"))
+	viper.Set("session-lifetime", "-1h")
+	_, err := (&IDP{}).Handler()
+	assert.Error(t, err, "negative lifetimes should be rejected")
+
+	viper.Set("session-lifetime", "1h")
+	i := &IDP{settings: viper.GetViper()}
+	assert.NoError(t, i.configureLifetimes())
+	assert.Equal(t, time.Hour, i.sessionLifetime)
+
+	defer viper.Set("session-absolute-timeout", "0s")
+	defer viper.Set("session-idle-timeout", "0s")
+	viper.Set("session-absolute-timeout", "8h")
+	viper.Set("session-idle-timeout", "30m")
+	assert.NoError(t, i.configureLifetimes())
+	assert.Equal(t, 8*time.Hour, i.sessionLifetime, "the absolute timeout should replace session-lifetime")
+	assert.Equal(t, 30*time.Minute, i.sessionIdleTimeout)
+
+	viper.Set("session-idle-timeout", "-30m")
+	assert.Error(t, i.configureLifetimes())
+	viper.Set("session-idle-timeout", "30m")
+	viper.Set("session-absolute-timeout", "-8h")
+	assert.Error(t, i.configureLifetimes())
+}
+
+func TestIDP_configureStores(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	defer viper.Set("store", "memory")
+	viper.Set("store", "redis")
+	viper.Set("redis.address", s.Addr())
+	defer viper.Set("redis.address", "127.0.0.1:6379")
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	defer i.Close()
+
+	assert.NoError(t, i.UserCache.Set("cookie", []byte("session")))
+	assert.True(t, s.Exists("session:cookie"), "sessions should be kept under their own prefix")
+	assert.True(t, s.TTL("session:cookie") > 0, "sessions should expire")
+	assert.NoError(t, i.PairwiseIDCache.Set("id", []byte("joe")))
+	assert.True(t, s.Exists("pairwise:id"))
+	assert.Equal(t, time.Duration(0), s.TTL("pairwise:id"), "pairwise identifiers shouldn't expire")
+	assert.NoError(t, i.ArtifactCache.Set("artifact", []byte("response")))
+	entry, err := store.Take(i.ArtifactCache, "artifact")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("response"), entry)
+	assert.False(t, s.Exists("artifact:artifact"), "taking an artifact should remove it from Redis")
+
+	// Keys looked up in one cache can't find the entries of another
+	caches := map[string]store.Cache{
+		"temp:":      i.TempCache,
+		"artifact:":  i.ArtifactCache,
+		"replay:":    i.ReplayCache,
+		"pairwise:":  i.PairwiseIDCache,
+		"authlimit:": i.AuthLimitCache,
+		"totp:":      i.TOTPSecretCache,
+		"consent:":   i.ConsentCache,
+	}
+	for prefix, cache := range caches {
+		assert.NoError(t, cache.Set("shared", []byte(prefix)))
+		assert.True(t, s.Exists(prefix+"shared"), "entries should be kept under %s", prefix)
+	}
+	for prefix, cache := range caches {
+		entry, err = cache.Get("shared")
+		assert.NoError(t, err)
+		assert.Equal(t, prefix, string(entry))
+	}
+
+	viper.Set("store", "etcd")
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err, "unknown stores should be rejected")
+}
+
+type closingCache struct {
+	store.Cache
+	closed bool
+}
+
+func (c *closingCache) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestIDP_Close(t *testing.T) {
+	cache := &closingCache{}
+	i := &IDP{UserCache: cache}
+	getTestIDP(t, i)
+	next, err := i.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, i.Close())
+	assert.False(t, cache.closed, "caches shared with the reloaded IDP should stay open")
+	assert.NoError(t, next.Close())
+	assert.True(t, cache.closed, "caches should be closed with the last IDP")
+}
+
+func TestIDP_AdminHandler(t *testing.T) {
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	assert.Nil(t, i.AdminHandler(), "there's no admin handler without an admin listener")
+
+	viper.Set("admin-listen-address", "127.0.0.1:9443")
+	viper.Set("admin-metadata", true)
+	defer viper.Set("admin-listen-address", "")
+	defer viper.Set("admin-metadata", false)
+	i = &IDP{}
+	handler, err := i.Handler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	admin := i.AdminHandler()
+	for _, path := range []string{"health-path", "readiness-path", "metrics-path", "metadata-path"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", viper.GetString(path), nil))
+		assert.Equal(t, http.StatusNotFound, w.Code, "%s should not be served on the main listener", path)
+		w = httptest.NewRecorder()
+		admin.ServeHTTP(w, httptest.NewRequest("GET", viper.GetString(path), nil))
+		assert.NotEqual(t, http.StatusNotFound, w.Code, "%s should be served on the admin listener", path)
+	}
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("GET", viper.GetString("sso-service-path"), nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, "SAML endpoints should not be served on the admin listener")
+}
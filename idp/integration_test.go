@@ -0,0 +1,321 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/idp"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/sp/sptest"
+	"github.com/stretchr/testify/assert"
+)
+
+// joe's password is password
+const joePassword = "$2a$10$FNvHN.0e5LcLUonmGX0CIOAAEKYYSrlZkyibHgq3sLo0SizPtRhEG"
+
+// spCertificate returns a self-signed certificate with the key for the mock service provider
+func spCertificate(t *testing.T, key crypto.Signer) tls.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// integration is an IdP serving a mock service provider
+type integration struct {
+	server *httptest.Server
+	idp    *idp.IDP
+	config idp.Config
+	cert   tls.Certificate
+}
+
+func newIntegration(t *testing.T) *integration {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newIntegrationWithKey(t, key, func(*idp.Config) {})
+}
+
+// newIntegrationWithKey returns an IdP serving a mock service provider with the key. configure can change the
+// IdP's configuration before it's built.
+func newIntegrationWithKey(t *testing.T, key crypto.Signer, configure func(*idp.Config)) *integration {
+	// Artifact resolution authenticates the service provider by its client certificate
+	ts := httptest.NewUnstartedServer(nil)
+	ts.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	ts.StartTLS()
+	in := &integration{server: ts, cert: spCertificate(t, key)}
+	sp := in.sp(t)
+	metadata, err := sp.Metadata()
+	if err != nil {
+		t.Fatal(err)
+	}
+	registration, err := idp.ReadSPMetadata(bytes.NewReader(metadata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	registration.ReleaseAttributes = []idp.AttributeRelease{{Attribute: "mail"}, {Attribute: "memberOf"}}
+
+	in.config = idp.DefaultConfig()
+	in.config.ServerName = ts.Listener.Addr().String()
+	in.config.TLSCertificate = filepath.Join("testdata", "certificate.pem")
+	in.config.TLSPrivateKey = filepath.Join("testdata", "key.pem")
+	in.config.TLSCA = filepath.Join("testdata", "certificate.pem")
+	in.config.ServiceProviders = []idp.ServiceProvider{*registration}
+	// The browser shares the SP's client certificate, so it would log in with it
+	in.config.CertLoginEnabled = false
+	in.config.Users = []idp.UserConfig{{
+		Name:     "joe",
+		Password: joePassword,
+		Attributes: map[string][]string{
+			"mail":     {"joe@example.com"},
+			"memberOf": {"admins", "users"},
+			"sn":       {"Smith"},
+		},
+	}}
+	configure(&in.config)
+	if in.idp, err = idp.New(in.config); err != nil {
+		ts.Close()
+		t.Fatal(err)
+	}
+	ts.Config.Handler, _ = in.idp.Handler()
+	return in
+}
+
+// sp returns the mock service provider with a browser that doesn't have a session
+func (in *integration) sp(t *testing.T) *sptest.SP {
+	sp, err := sptest.New("https://sp.example.com/", in.cert, in.server.Client(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sp.SSOURL = in.server.URL + in.config.SSOServicePath
+	sp.ArtifactURL = in.server.URL + in.config.ArtifactServicePath
+	sp.QueryURL = in.server.URL + in.config.AttributeServicePath
+	if in.idp != nil {
+		sp.IDPKey = in.idp.SigningCertificate.PrivateKey.(crypto.Signer).Public()
+	}
+	return sp
+}
+
+func (in *integration) Close() {
+	in.server.Close()
+	in.idp.Close()
+}
+
+// login sends the request with the binding, signs joe in, and returns the validated assertion
+func (in *integration) login(t *testing.T, sp *sptest.SP, requestBinding string, req *saml.AuthnRequest) *saml.Assertion {
+	responseBinding := req.ProtocolBinding
+	result, err := sp.Login(requestBinding, req, "state", "joe", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, responseBinding, result.Binding)
+	assert.Equal(t, "state", result.RelayState)
+	assertion, err := sp.Validate(result.Response, req.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return assertion
+}
+
+func TestIntegration_SSO(t *testing.T) {
+	in := newIntegration(t)
+	defer in.Close()
+	tests := []struct {
+		name            string
+		requestBinding  string
+		responseBinding string
+	}{
+		{"redirect with POST response", sptest.RedirectBinding, sptest.PostBinding},
+		{"POST with POST response", sptest.PostBinding, sptest.PostBinding},
+		{"redirect with artifact", sptest.RedirectBinding, sptest.ArtifactBinding},
+		{"POST with artifact", sptest.PostBinding, sptest.ArtifactBinding},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sp := in.sp(t)
+			assertion := in.login(t, sp, tt.requestBinding, sp.AuthnRequest(tt.responseBinding))
+			assert.Equal(t, "joe", assertion.Subject.NameID.Value)
+			assert.Equal(t, map[string][]string{
+				"mail":     {"joe@example.com"},
+				"memberOf": {"admins", "users"},
+			}, sptest.Attributes(assertion), "attributes should be released under the service provider's policy")
+
+			// The session is used for the next request
+			again := in.login(t, sp, tt.requestBinding, sp.AuthnRequest(tt.responseBinding))
+			assert.Equal(t, "joe", again.Subject.NameID.Value)
+		})
+	}
+}
+
+func TestIntegration_SSO_failures(t *testing.T) {
+	in := newIntegration(t)
+	defer in.Close()
+	sp := in.sp(t)
+	_, err := sp.Login(sptest.RedirectBinding, sp.AuthnRequest(sptest.PostBinding), "", "joe", "wrong")
+	assert.Error(t, err, "logins with the wrong password should fail")
+
+	req := sp.AuthnRequest(sptest.PostBinding)
+	result, err := sp.Login(sptest.PostBinding, req, "", "joe", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sp.Validate(result.Response, "other")
+	assert.Error(t, err, "responses to other requests should be rejected")
+	sp.IDPKey = in.cert.PrivateKey.(crypto.Signer).Public()
+	_, err = sp.Validate(result.Response, req.ID)
+	assert.Error(t, err, "assertions signed by other keys should be rejected")
+}
+
+func TestIntegration_AttributeQuery(t *testing.T) {
+	in := newIntegration(t)
+	defer in.Close()
+	sp := in.sp(t)
+	// Persistent NameIDs identify the user to later queries
+	req := sp.AuthnRequest(sptest.PostBinding)
+	req.NameIDPolicy = &saml.NameIDPolicy{Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"}
+	nameID := in.login(t, sp, sptest.RedirectBinding, req).Subject.NameID
+	tests := []struct {
+		name       string
+		nameID     *saml.NameID
+		requested  []saml.Attribute
+		attributes map[string][]string
+	}{
+		{"all attributes", nameID, nil, map[string][]string{
+			"mail":     {"joe@example.com"},
+			"memberOf": {"admins", "users"},
+		}},
+		{"requested attribute", nameID, []saml.Attribute{{Name: "mail"}}, map[string][]string{
+			"mail": {"joe@example.com"},
+		}},
+		{"requested value", nameID, []saml.Attribute{{Name: "memberOf", AttributeValue: []saml.AttributeValue{{Value: "users"}}}}, map[string][]string{
+			"memberOf": {"users"},
+		}},
+		{"withheld attribute", nameID, []saml.Attribute{{Name: "sn"}}, map[string][]string{}},
+		{"unknown subject", &saml.NameID{Value: "nobody"}, nil, map[string][]string{}},
+		{"unknown persistent identifier", &saml.NameID{Format: nameID.Format, Value: "unknown"}, nil, map[string][]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := sp.AttributeQuery(tt.nameID, tt.requested...)
+			response, err := sp.Query(query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertion, err := sp.Validate(response, query.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, tt.nameID.Value, assertion.Subject.NameID.Value)
+			assert.Equal(t, tt.attributes, sptest.Attributes(assertion))
+		})
+	}
+}
+
+// writeECDSAKeyPair writes a self-signed P-256 certificate and its key in PEM to dir
+func writeECDSAKeyPair(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := spCertificate(t, key)
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestIntegration_SSO_ecdsa(t *testing.T) {
+	spKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The IdP signs with its TLS key when it doesn't have a signing certificate
+	certFile, keyFile := writeECDSAKeyPair(t, t.TempDir())
+	in := newIntegrationWithKey(t, spKey, func(config *idp.Config) {
+		config.TLSCertificate = certFile
+		config.TLSPrivateKey = keyFile
+	})
+	defer in.Close()
+	_, ok := in.idp.SigningCertificate.PrivateKey.(*ecdsa.PrivateKey)
+	assert.True(t, ok, "the IdP should sign with the EC key")
+
+	metadata, err := in.idp.Metadata("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(metadata), dsig.ECDSASHA256, "the metadata should advertise ECDSA signatures")
+	assert.NotContains(t, string(metadata), `use="encryption"`, "EC keys can't decrypt NameIDs")
+
+	for _, binding := range []string{sptest.RedirectBinding, sptest.PostBinding} {
+		sp := in.sp(t)
+		req := sp.AuthnRequest(sptest.ArtifactBinding)
+		assertion := in.login(t, sp, binding, req)
+		assert.Equal(t, "joe", assertion.Subject.NameID.Value)
+		if assert.NotNil(t, assertion.Signature) {
+			assert.Equal(t, dsig.ECDSASHA256, assertion.Signature.SignedInfo.SignatureMethod.Algorithm)
+		}
+	}
+
+	// Requests signed with another key get an error response
+	sp := in.sp(t)
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor, err := sptest.New(sp.EntityID, spCertificate(t, other), in.server.Client(), sp.IDPKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	impostor.SSOURL = sp.SSOURL
+	req := impostor.AuthnRequest(sptest.PostBinding)
+	result, err := impostor.Login(sptest.RedirectBinding, req, "", "joe", "password")
+	if err == nil {
+		_, err = impostor.Validate(result.Response, req.ID)
+	}
+	assert.Error(t, err, "redirect requests signed by other EC keys should be rejected")
+}
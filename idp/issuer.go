@@ -0,0 +1,68 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/amdonov/lite-idp/saml"
+)
+
+const (
+	issuerFormatEntity = "urn:oasis:names:tc:SAML:2.0:nameid-format:entity"
+	// issuerFormatNone leaves the Format attribute out of the Issuer, which SAML reads as the entity format
+	issuerFormatNone = "none"
+)
+
+// validIssuerFormat reports whether the format is none or a URI
+func validIssuerFormat(format string) bool {
+	if format == issuerFormatNone {
+		return true
+	}
+	u, err := url.Parse(format)
+	return err == nil && u.Scheme != ""
+}
+
+// configureIssuer reads the format of the Issuer in responses and assertions
+func (i *IDP) configureIssuer() error {
+	i.issuerFormat = i.settings.GetString("issuer-format")
+	if !validIssuerFormat(i.issuerFormat) {
+		return fmt.Errorf("issuer-format must be a URI or none, not %q", i.issuerFormat)
+	}
+	return nil
+}
+
+// validateIssuerFormat ensures the service provider's Issuer format is none or a URI
+func (sp *ServiceProvider) validateIssuerFormat() error {
+	if sp.IssuerFormat != "" && !validIssuerFormat(sp.IssuerFormat) {
+		return fmt.Errorf("issuer format for service provider %s must be a URI or none, not %q",
+			sp.EntityID, sp.IssuerFormat)
+	}
+	return nil
+}
+
+// issuer identifies the IdP by its entity ID in messages sent to the service provider, with the service
+// provider's IssuerFormat if it has one and issuer-format otherwise
+func (i *IDP) issuer(entityID string) *saml.Issuer {
+	format := i.issuerFormat
+	if sp, ok := i.sps.get(entityID); ok && sp.IssuerFormat != "" {
+		format = sp.IssuerFormat
+	}
+	if format == issuerFormatNone {
+		format = ""
+	}
+	return &saml.Issuer{Format: format, Value: i.entityID}
+}
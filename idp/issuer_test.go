@@ -0,0 +1,115 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/xml"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// assertIssuer checks that a message from the IdP names its entity ID with the format
+func assertIssuer(t *testing.T, i *IDP, issuer *saml.Issuer, format, message string) {
+	if assert.NotNil(t, issuer, message) {
+		assert.Equal(t, i.entityID, issuer.Value, message)
+		assert.Equal(t, format, issuer.Format, message)
+	}
+}
+
+func TestIDP_issuer_messages(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	request := &model.AuthnRequest{ID: "request", Issuer: "dex", AssertionConsumerServiceURL: "http://127.0.0.1:5556/dex/callback"}
+	user := newTestUser()
+
+	response, err := i.makeAuthnResponse(request, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertIssuer(t, i, response.Issuer, issuerFormatEntity, "response")
+	assertIssuer(t, i, response.Assertion.Issuer, issuerFormatEntity, "assertion")
+	assertIssuer(t, i, i.makeStatusResponse(request, authnFailedStatus).Issuer, issuerFormatEntity, "status response")
+
+	w := httptest.NewRecorder()
+	if err = i.sendArtifactResponse(request, user, w, httptest.NewRequest("GET", "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if resolved := resolveRedirect(t, i, w); assert.NotNil(t, resolved) {
+		assertIssuer(t, i, resolved.Issuer, issuerFormatEntity, "artifact response")
+		assertIssuer(t, i, resolved.Response.Issuer, issuerFormatEntity, "resolved response")
+	}
+
+	cookie := addTestSession(t, i, "12345", &model.User{Name: "joe", ServiceProviders: []string{"dex"}})
+	if _, logout := sendLogoutRequest(t, i, "dex", "joe", cookie); assert.NotNil(t, logout) {
+		assertIssuer(t, i, logout.Issuer, issuerFormatEntity, "logout response")
+	}
+
+	// The Format attribute is written out, since some service providers reject an Issuer without it
+	data, err := xml.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, strings.Count(string(data), `Format="`+issuerFormatEntity+`">`+i.entityID+`</`))
+}
+
+func TestIDP_issuer(t *testing.T) {
+	defer viper.Set("sps", nil)
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.sps.get("dex")
+	none, custom := *dex, *dex
+	none.EntityID, none.IssuerFormat = "none", issuerFormatNone
+	custom.EntityID, custom.IssuerFormat = "custom", "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+	viper.Set("sps", []ServiceProvider{*dex, none, custom})
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+
+	assertIssuer(t, i, i.issuer("dex"), issuerFormatEntity, "default")
+	assertIssuer(t, i, i.issuer("unknown"), issuerFormatEntity, "unknown service provider")
+	assertIssuer(t, i, i.issuer("custom"), "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified", "overridden")
+	assertIssuer(t, i, i.issuer("none"), "", "left out")
+	response, err := i.makeAuthnResponse(&model.AuthnRequest{ID: "request", Issuer: "none"}, newTestUser())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(data), "Format=\"\"", "an empty format shouldn't be written")
+
+	viper.Set("issuer-format", "none")
+	defer viper.Set("issuer-format", issuerFormatEntity)
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	assertIssuer(t, i, i.issuer("dex"), "", "issuer-format")
+	assertIssuer(t, i, i.issuer("custom"), "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified", "service providers override issuer-format")
+
+	viper.Set("issuer-format", "entity")
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err, "the format should be a URI")
+	viper.Set("issuer-format", issuerFormatEntity)
+	custom.IssuerFormat = "entity"
+	viper.Set("sps", []ServiceProvider{custom})
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err, "the service provider's format should be a URI")
+}
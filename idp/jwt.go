@@ -0,0 +1,144 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+)
+
+// jwtSigner signs JSON Web Tokens with the IdP's signing key
+type jwtSigner struct {
+	key  crypto.Signer
+	alg  string
+	hash crypto.Hash
+	// size of each ECDSA signature component in bytes
+	size int
+	jwk  jsonWebKey
+}
+
+// jsonWebKey is the public half of the signing key as published in the JWKS
+type jsonWebKey struct {
+	Kty string   `json:"kty"`
+	Use string   `json:"use"`
+	Alg string   `json:"alg"`
+	Kid string   `json:"kid"`
+	N   string   `json:"n,omitempty"`
+	E   string   `json:"e,omitempty"`
+	Crv string   `json:"crv,omitempty"`
+	X   string   `json:"x,omitempty"`
+	Y   string   `json:"y,omitempty"`
+	X5c []string `json:"x5c"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// newJWTSigner chooses RS256 for RSA keys and the ES algorithm matching the curve for EC keys
+func newJWTSigner(cert *tls.Certificate) (*jwtSigner, error) {
+	key, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("signing key of type %T can't sign tokens", cert.PrivateKey)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	// The key ID is the certificate's SHA-256 thumbprint, so it changes when the certificate does
+	thumbprint := sha256.Sum256(leaf.Raw)
+	s := &jwtSigner{key: key, jwk: jsonWebKey{
+		Use: "sig",
+		Kid: base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+		X5c: []string{base64.StdEncoding.EncodeToString(leaf.Raw)},
+	}}
+	switch pub := leaf.PublicKey.(type) {
+	case *rsa.PublicKey:
+		s.alg, s.hash = "RS256", crypto.SHA256
+		s.jwk.Kty = "RSA"
+		s.jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		s.jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		switch pub.Curve {
+		case elliptic.P256():
+			s.alg, s.hash, s.jwk.Crv = "ES256", crypto.SHA256, "P-256"
+		case elliptic.P384():
+			s.alg, s.hash, s.jwk.Crv = "ES384", crypto.SHA384, "P-384"
+		case elliptic.P521():
+			s.alg, s.hash, s.jwk.Crv = "ES512", crypto.SHA512, "P-521"
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", pub.Curve.Params().Name)
+		}
+		s.size = (pub.Curve.Params().BitSize + 7) / 8
+		s.jwk.Kty = "EC"
+		s.jwk.X = base64.RawURLEncoding.EncodeToString(padBytes(pub.X.Bytes(), s.size))
+		s.jwk.Y = base64.RawURLEncoding.EncodeToString(padBytes(pub.Y.Bytes(), s.size))
+	default:
+		return nil, fmt.Errorf("signing key of type %T can't sign tokens", leaf.PublicKey)
+	}
+	s.jwk.Alg = s.alg
+	return s, nil
+}
+
+// sign returns the claims as a compact serialized JWS
+func (s *jwtSigner) sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "typ": "JWT", "kid": s.jwk.Kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := s.hash.New()
+	h.Write([]byte(input))
+	signature, err := s.key.Sign(rand.Reader, h.Sum(nil), s.hash)
+	if err != nil {
+		return "", err
+	}
+	if s.size > 0 {
+		// JWS uses the fixed size concatenation of R and S rather than the ASN.1 encoding
+		var sig dsaSignature
+		if _, err = asn1.Unmarshal(signature, &sig); err != nil {
+			return "", err
+		}
+		signature = append(padBytes(sig.R.Bytes(), s.size), padBytes(sig.S.Bytes(), s.size)...)
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func (s *jwtSigner) keySet() jsonWebKeySet {
+	return jsonWebKeySet{Keys: []jsonWebKey{s.jwk}}
+}
+
+// padBytes left pads a big-endian integer to size bytes
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	return append(make([]byte, size-len(b)), b...)
+}
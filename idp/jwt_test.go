@@ -0,0 +1,116 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// verifyJWT checks the token's signature with the certificate's key and returns its header and claims
+func verifyJWT(t *testing.T, token string, cert *x509.Certificate) (map[string]interface{}, map[string]interface{}) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed token %s", token)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch pub := cert.PublicKey.(type) {
+	case *rsa.PublicKey:
+		h := crypto.SHA256.New()
+		h.Write([]byte(parts[0] + "." + parts[1]))
+		if err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, h.Sum(nil), signature); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PublicKey:
+		h := crypto.SHA256.New()
+		h.Write([]byte(parts[0] + "." + parts[1]))
+		half := len(signature) / 2
+		r, s := new(big.Int).SetBytes(signature[:half]), new(big.Int).SetBytes(signature[half:])
+		if !ecdsa.Verify(pub, h.Sum(nil), r, s) {
+			t.Fatal("invalid ECDSA signature")
+		}
+	}
+	decode := func(part string) map[string]interface{} {
+		data, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := map[string]interface{}{}
+		if err = json.Unmarshal(data, &v); err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	return decode(parts[0]), decode(parts[1])
+}
+
+func Test_jwtSigner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeSigningCertificate(t, dir)
+	tests := []struct {
+		name, cert, key, alg, kty string
+	}{
+		{"RSA", filepath.Join("testdata", "certificate.pem"), filepath.Join("testdata", "key.pem"), "RS256", "RSA"},
+		{"EC", filepath.Join(dir, "signing.pem"), filepath.Join(dir, "signing-key.pem"), "ES256", "EC"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pair, err := tls.LoadX509KeyPair(tt.cert, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			leaf, err := x509.ParseCertificate(pair.Certificate[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			signer, err := newJWTSigner(&pair)
+			if err != nil {
+				t.Fatal(err)
+			}
+			token, err := signer.sign(map[string]interface{}{"sub": "joe"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			header, claims := verifyJWT(t, token, leaf)
+			assert.Equal(t, tt.alg, header["alg"])
+			assert.Equal(t, "joe", claims["sub"])
+			keys := signer.keySet().Keys
+			if assert.Len(t, keys, 1) {
+				assert.Equal(t, tt.kty, keys[0].Kty)
+				assert.Equal(t, header["kid"], keys[0].Kid, "the header should name the published key")
+			}
+		})
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/base64"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"strings"
+	"text/template"
+
+	"github.com/amdonov/lite-idp/kerberos"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/tracing"
+	log "github.com/sirupsen/logrus"
+)
+
+const negotiateScheme = "Negotiate"
+
+// kerberosNames are the values from a Kerberos ticket available to the kerberos-nameid template
+type kerberosNames struct {
+	// Principal is the client's name with the realm, such as jdoe@EXAMPLE.COM
+	Principal string
+	Name      string
+	Realm     string
+}
+
+// kerberosReplays keeps Kerberos authenticators in the ReplayCache so replays are detected across instances
+type kerberosReplays struct {
+	cache store.Cache
+}
+
+func (k kerberosReplays) Add(id string) (bool, error) {
+	return store.Add(k.cache, "kerberos "+id, []byte{1})
+}
+
+func (i *IDP) configureKerberos() error {
+	if !i.settings.GetBool("kerberos-enabled") {
+		return nil
+	}
+	templ, err := template.New("nameid").Option("missingkey=error").Parse(i.settings.GetString("kerberos-nameid"))
+	if err != nil {
+		return fmt.Errorf("invalid kerberos-nameid: %v", err)
+	}
+	keytab, err := kerberos.LoadKeytab(i.settings.GetString("kerberos-keytab"))
+	if err != nil {
+		return fmt.Errorf("failed to load kerberos-keytab: %v", err)
+	}
+	acceptor, err := kerberos.NewAcceptor(keytab, i.settings.GetString("kerberos-service-principal"),
+		i.clockSkew, kerberosReplays{i.ReplayCache})
+	if err != nil {
+		return err
+	}
+	negotiateTempl, err := htmltemplate.New("negotiate").Parse(negotiateTemplate)
+	if err != nil {
+		return err
+	}
+	i.kerberos = acceptor
+	i.kerberosNameIDTemplate = templ
+	i.negotiateTemplate = negotiateTempl
+	return nil
+}
+
+// negotiateToken returns the GSS-API token from an Authorization: Negotiate header
+func negotiateToken(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len(negotiateScheme) || !strings.EqualFold(auth[:len(negotiateScheme)], negotiateScheme) {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len(negotiateScheme):]), true
+}
+
+// loginWithKerberos logs in users whose browser sent a Kerberos ticket. Invalid tickets and other mechanisms,
+// such as NTLM, are logged and the user falls back to the password form.
+func (i *IDP) loginWithKerberos(w http.ResponseWriter, r *http.Request, authnReq *model.AuthnRequest) (*model.User, error) {
+	if i.kerberos == nil {
+		return nil, nil
+	}
+	token, ok := negotiateToken(r)
+	if !ok {
+		return nil, nil
+	}
+	_, span := tracing.Start(r.Context(), "authenticate", tracing.String("idp.login_method", "kerberos"))
+	name, response, err := i.acceptKerberos(token)
+	span.RecordError(err)
+	span.End()
+	if err != nil {
+		i.recordAuthentication(r, authnReq, "", KerberosLogin, resultFailure)
+		log.Warnf("falling back to password login: %v", err)
+		return nil, nil
+	}
+	if len(response) > 0 {
+		w.Header().Set("WWW-Authenticate", negotiateScheme+" "+base64.StdEncoding.EncodeToString(response))
+	}
+	user := &model.User{
+		Name:    name,
+		Format:  nameIDFormatUnspecified,
+		Context: i.kerberosAuthnContext,
+		IP:      getIP(r).String()}
+	// Add attributes
+	err = i.setUserAttributes(r.Context(), user, authnReq)
+	if err != nil {
+		i.recordAuthentication(r, authnReq, name, KerberosLogin, resultError)
+		return nil, err
+	}
+	i.recordAuthentication(r, authnReq, name, KerberosLogin, resultSuccess)
+	i.Auditor.LogSuccess(user, authnReq, KerberosLogin)
+	log.Infof("successful Kerberos login for %s", user.Name)
+	return user, nil
+}
+
+// acceptKerberos validates the token and returns the user's NameID and the token for the response
+func (i *IDP) acceptKerberos(token string) (string, []byte, error) {
+	data, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid Negotiate token: %v", err)
+	}
+	principal, response, err := i.kerberos.Accept(data)
+	if err != nil {
+		return "", nil, err
+	}
+	var b strings.Builder
+	if err = i.kerberosNameIDTemplate.Execute(&b, kerberosNames{
+		Principal: principal.String(),
+		Name:      principal.Name,
+		Realm:     principal.Realm,
+	}); err != nil {
+		return "", nil, err
+	}
+	return b.String(), response, nil
+}
+
+// challengeKerberos asks the browser for a Kerberos ticket. Browsers that can't get one show the page instead,
+// which sends the user to the login form.
+func (i *IDP) challengeKerberos(w http.ResponseWriter, loginURL string) error {
+	w.Header().Set("WWW-Authenticate", negotiateScheme)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusUnauthorized)
+	return i.negotiateTemplate.Execute(w, loginURL)
+}
+
+const negotiateTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head><meta http-equiv="refresh" content="0;url={{ . }}"></head>
+<body>
+<p><a href="{{ . }}">Continue to the login page</a></p>
+</body>
+</html>`
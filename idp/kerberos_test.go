@@ -0,0 +1,152 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/lite-idp/kerberos/kerberostest"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const kerberosService = "HTTP/idp.example.com@EXAMPLE.COM"
+
+// enableKerberos turns on Kerberos logins with a keytab for the KDC and returns a function that turns them off
+func enableKerberos(t *testing.T, kdc *kerberostest.KDC) func() {
+	dir, err := ioutil.TempDir("", "kerberos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keytab := filepath.Join(dir, "http.keytab")
+	if err = kdc.WriteKeytab(keytab); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("kerberos-enabled", true)
+	viper.Set("kerberos-keytab", keytab)
+	viper.Set("kerberos-service-principal", kdc.Service)
+	return func() {
+		viper.Set("kerberos-enabled", false)
+		viper.Set("kerberos-keytab", "")
+		viper.Set("kerberos-service-principal", "")
+		viper.Set("kerberos-nameid", "{{.Principal}}")
+		os.RemoveAll(dir)
+	}
+}
+
+// postNegotiate sends a signed AuthnRequest with the Authorization header
+func postNegotiate(t *testing.T, i *IDP, authorization string) *httptest.ResponseRecorder {
+	loginReq := newTestAuthnRequest()
+	signature, err := i.signer.CreateSignature(loginReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginReq.Signature = signature
+	data, err := xml.Marshal(loginReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{}
+	form.Set("SAMLRequest", base64.StdEncoding.EncodeToString(data))
+	r := httptest.NewRequest("POST", viper.GetString("sso-service-path"), strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if authorization != "" {
+		r.Header.Set("Authorization", authorization)
+	}
+	w := httptest.NewRecorder()
+	i.PostSSOHandler(w, r)
+	return w
+}
+
+func TestIDP_loginWithKerberos(t *testing.T) {
+	kdc := kerberostest.NewKDC(kerberosService)
+	defer enableKerberos(t, kdc)()
+	viper.Set("kerberos-nameid", "{{.Name}}")
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+
+	w := postNegotiate(t, i, kdc.Negotiate("jdoe"))
+	assert.Equal(t, http.StatusFound, w.Code, "the artifact should be sent to the service provider")
+	assert.NotContains(t, w.Header().Get("Location"), "/ui/login.html")
+	assert.True(t, strings.HasPrefix(w.Header().Get("WWW-Authenticate"), "Negotiate "),
+		"the browser asked for mutual authentication")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", kdc.Negotiate("jdoe"))
+	user, err := i.loginWithKerberos(httptest.NewRecorder(), req, nil)
+	if assert.NoError(t, err) && assert.NotNil(t, user) {
+		assert.Equal(t, "jdoe", user.Name)
+		assert.Equal(t, nameIDFormatUnspecified, user.Format)
+		assert.Equal(t, authnContextKerberos, user.Context)
+	}
+}
+
+func TestIDP_loginWithKerberos_fallback(t *testing.T) {
+	kdc := kerberostest.NewKDC(kerberosService)
+	defer enableKerberos(t, kdc)()
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+
+	// Browsers are asked for a ticket, and ones that can't get one follow the page to the login form
+	w := postNegotiate(t, i, "")
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Negotiate", w.Header().Get("WWW-Authenticate"))
+	assert.Contains(t, w.Body.String(), "/ui/login.html?requestId=")
+
+	// Tickets that can't be validated and other mechanisms go straight to the login form
+	for _, authorization := range []string{
+		kerberostest.NewKDC(kerberosService).Negotiate("jdoe"),
+		"Negotiate " + base64.StdEncoding.EncodeToString([]byte("NTLMSSP\x00\x01\x00\x00\x00")),
+		"Negotiate !!!",
+	} {
+		w = postNegotiate(t, i, authorization)
+		assert.Equal(t, http.StatusSeeOther, w.Code)
+		assert.Contains(t, w.Header().Get("Location"), "/ui/login.html?requestId=")
+	}
+
+	viper.Set("kerberos-enabled", false)
+	i = &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	w = postNegotiate(t, i, kdc.Negotiate("jdoe"))
+	assert.Contains(t, w.Header().Get("Location"), "/ui/login.html?requestId=", "Kerberos logins are disabled")
+	assert.Empty(t, w.Header().Get("WWW-Authenticate"))
+}
+
+func TestIDP_configureKerberos(t *testing.T) {
+	kdc := kerberostest.NewKDC(kerberosService)
+	defer enableKerberos(t, kdc)()
+	viper.Set("kerberos-service-principal", "HTTP/www.example.com@EXAMPLE.COM")
+	_, err := (&IDP{}).Handler()
+	assert.Error(t, err, "the keytab doesn't have a key for the service")
+
+	viper.Set("kerberos-service-principal", "")
+	viper.Set("kerberos-nameid", "{{.Principal")
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err, "the NameID template is invalid")
+
+	viper.Set("kerberos-nameid", "{{.Principal}}")
+	viper.Set("kerberos-keytab", "missing.keytab")
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err)
+}
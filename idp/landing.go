@@ -0,0 +1,103 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"net/http"
+	"net/url"
+)
+
+// LandingPage is passed to the landing-template
+type LandingPage struct {
+	// Service providers the user can log in to, empty if unsolicited-sso-enabled is false
+	ServiceProviders []LandingPageServiceProvider
+}
+
+// LandingPageServiceProvider is a service provider listed on the landing page
+type LandingPageServiceProvider struct {
+	// Name of the service provider, its entity ID if it doesn't have one
+	Name     string
+	EntityID string
+	// IdP-initiated login for the service provider
+	URL string
+}
+
+// configureLandingPage parses the landing-template if one is set, otherwise the built-in page is used
+func (i *IDP) configureLandingPage() error {
+	file := i.settings.GetString("landing-template")
+	if file == "" {
+		templ, err := htmltemplate.New("landing").Parse(landingTemplate)
+		if err != nil {
+			return err
+		}
+		i.landingTemplate = templ
+		return nil
+	}
+	templ, err := htmltemplate.ParseFiles(file)
+	if err != nil {
+		return err
+	}
+	i.landingTemplate = templ
+	return nil
+}
+
+// showLandingPage redirects users who open the SSO endpoint without an AuthnRequest to the landing-page, or shows
+// them the service providers they can log in to
+func (i *IDP) showLandingPage(w http.ResponseWriter, r *http.Request) {
+	if landing := i.settings.GetString("landing-page"); landing != "" {
+		http.Redirect(w, r, landing, http.StatusFound)
+		return
+	}
+	page := LandingPage{ServiceProviders: []LandingPageServiceProvider{}}
+	if i.settings.GetBool("unsolicited-sso-enabled") {
+		location := i.location(i.settings.GetString("unsolicited-sso-path"))
+		for _, sp := range i.sps.list() {
+			if !sp.ShowOnLandingPage {
+				continue
+			}
+			name := sp.Name
+			if name == "" {
+				name = sp.EntityID
+			}
+			page.ServiceProviders = append(page.ServiceProviders, LandingPageServiceProvider{
+				Name:     name,
+				EntityID: sp.EntityID,
+				URL:      location + "?" + url.Values{"sp": {sp.EntityID}}.Encode(),
+			})
+		}
+	}
+	var buf bytes.Buffer
+	if err := i.landingTemplate.Execute(&buf, page); err != nil {
+		i.writeError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+const landingTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head><title>Sign in</title></head>
+<body>
+<h1>Sign in</h1>
+{{ if .ServiceProviders }}<p>Choose the application to sign in to.</p>
+<ul>
+{{ range .ServiceProviders }}<li><a href="{{ .URL }}">{{ .Name }}</a></li>
+{{ end }}</ul>
+{{ else }}<p>To sign in, go to the application you want to use. It will send you here when you need to sign in.</p>
+{{ end }}</body>
+</html>`
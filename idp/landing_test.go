@@ -0,0 +1,96 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_showLandingPage(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.sps.get("dex")
+	hidden := *dex
+	hidden.EntityID = "https://hidden.example.com"
+	sps := []ServiceProvider{*dex, hidden}
+	sps[0].Name = "Dex & Friends"
+	sps[0].ShowOnLandingPage = true
+	viper.Set("sps", sps)
+	defer viper.Set("sps", nil)
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+
+	w := httptest.NewRecorder()
+	i.RedirectSSOHandler(w, httptest.NewRequest("GET", "/SAML2/Redirect/SSO", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "users without an AuthnRequest should get the landing page")
+	assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `<a href="https://idp.example.com:9443/SAML2/Unsolicited/SSO?sp=dex">Dex &amp; Friends</a>`)
+	assert.NotContains(t, w.Body.String(), "hidden.example.com", "only service providers with showonlandingpage are listed")
+
+	viper.Set("unsolicited-sso-enabled", false)
+	defer viper.Set("unsolicited-sso-enabled", true)
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	w = httptest.NewRecorder()
+	i.RedirectSSOHandler(w, httptest.NewRequest("GET", "/SAML2/Redirect/SSO", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "Dex", "service providers can't be launched without IdP-initiated login")
+
+	viper.Set("landing-page", "https://portal.example.com/")
+	defer viper.Set("landing-page", "")
+	w = httptest.NewRecorder()
+	i.RedirectSSOHandler(w, httptest.NewRequest("GET", "/SAML2/Redirect/SSO", nil))
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://portal.example.com/", w.Header().Get("Location"))
+}
+
+func TestIDP_landingTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "landing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "landing.html")
+	if err = ioutil.WriteFile(file, []byte(`{{range .ServiceProviders}}<a class="tile" href="{{.URL}}">{{.Name}}</a>{{end}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.sps.get("dex")
+	sps := []ServiceProvider{*dex}
+	sps[0].ShowOnLandingPage = true
+	viper.Set("sps", sps)
+	defer viper.Set("sps", nil)
+	viper.Set("landing-template", file)
+	defer viper.Set("landing-template", "")
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+
+	w := httptest.NewRecorder()
+	i.RedirectSSOHandler(w, httptest.NewRequest("GET", "/SAML2/Redirect/SSO", nil))
+	assert.Equal(t, `<a class="tile" href="https://idp.example.com:9443/SAML2/Unsolicited/SSO?sp=dex">dex</a>`, w.Body.String())
+
+	viper.Set("landing-template", filepath.Join(dir, "missing.html"))
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err)
+}
@@ -0,0 +1,333 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"time"
+
+	"github.com/amdonov/lite-idp/ldap"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// ldapDirectory holds the connection settings shared by the LDAP validator and attribute source
+type ldapDirectory struct {
+	pool         *ldap.Pool
+	bindDN       string
+	bindPassword string
+	baseDN       string
+	// operations that fail with transient errors are tried again up to retries times, waiting retryBackoff
+	// before the first retry and twice as long before each one after that
+	retries      int
+	retryBackoff time.Duration
+}
+
+func newLDAPDirectory(settings *viper.Viper) (*ldapDirectory, error) {
+	config, err := ldapConfig(settings)
+	if err != nil {
+		return nil, err
+	}
+	bindPassword, err := resolveSecret(settings, "ldap.bind-password")
+	if err != nil {
+		return nil, err
+	}
+	retries := settings.GetInt("ldap.retries")
+	if retries < 0 {
+		return nil, errors.New("ldap.retries must not be negative")
+	}
+	return &ldapDirectory{
+		pool: ldap.NewPool(config, ldap.PoolOptions{
+			MaxIdle:     settings.GetInt("ldap.pool-size"),
+			MaxOpen:     settings.GetInt("ldap.pool-max-open"),
+			IdleTimeout: settings.GetDuration("ldap.pool-idle-timeout"),
+		}),
+		bindDN:       settings.GetString("ldap.bind-dn"),
+		bindPassword: bindPassword,
+		baseDN:       settings.GetString("ldap.base-dn"),
+		retries:      retries,
+		retryBackoff: settings.GetDuration("ldap.retry-backoff"),
+	}, nil
+}
+
+// withConn runs op with a pooled connection. It's run again on another connection if it fails with a transient
+// error such as a connection the server dropped, as long as ctx isn't done and retries remain.
+func (d *ldapDirectory) withConn(ctx context.Context, op func(*ldap.Conn) error) error {
+	backoff := d.retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := d.try(op)
+		if err == nil || attempt == d.retries || !ldap.IsTransient(err) {
+			return err
+		}
+		log.Warnf("retrying ldap operation after %v: %v", backoff, err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+func (d *ldapDirectory) try(op func(*ldap.Conn) error) error {
+	conn, err := d.pool.Get()
+	if err != nil {
+		return unavailable(err)
+	}
+	defer d.pool.Put(conn)
+	return op(conn)
+}
+
+// search runs filter with the escaped user in place of %s while bound as the service account
+func (d *ldapDirectory) search(conn *ldap.Conn, filter, user string, attributes []string) ([]*ldap.Entry, error) {
+	// Pooled connections may still be bound as the last user
+	var err error
+	if d.bindDN != "" {
+		err = conn.Bind(d.bindDN, d.bindPassword)
+	} else {
+		err = conn.AnonymousBind()
+	}
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	entries, err := conn.Search(&ldap.SearchRequest{
+		BaseDN:     d.baseDN,
+		Scope:      ldap.ScopeWholeSubtree,
+		Filter:     fmt.Sprintf(filter, ldap.EscapeFilter(user)),
+		Attributes: attributes,
+	})
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	if len(entries) > 1 {
+		log.Warnf("ldap filter %s matched %d entries for %s", filter, len(entries), user)
+	}
+	return entries, nil
+}
+
+// CheckHealth binds as the service account to confirm the directory server is reachable
+func (d *ldapDirectory) CheckHealth(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.withConn(ctx, func(conn *ldap.Conn) error {
+		var err error
+		if d.bindDN != "" {
+			err = conn.Bind(d.bindDN, d.bindPassword)
+		} else {
+			err = conn.AnonymousBind()
+		}
+		if err != nil {
+			return unavailable(err)
+		}
+		return nil
+	})
+}
+
+// Close closes the idle connections to the directory server
+func (d *ldapDirectory) Close() error {
+	d.pool.Close()
+	return nil
+}
+
+type ldapValidator struct {
+	*ldapDirectory
+	userFilter string
+	attributes []string
+}
+
+// NewLDAPValidator returns a validator that checks passwords by binding to the directory server configured in the ldap key of the IDP's configuration.
+// Users are located with a search performed as bind-dn and their password is checked with a second bind as the user's entry.
+func NewLDAPValidator() (PasswordValidator, error) {
+	return newLDAPValidator(viper.GetViper())
+}
+
+func newLDAPValidator(settings *viper.Viper) (PasswordValidator, error) {
+	directory, err := newLDAPDirectory(settings)
+	if err != nil {
+		return nil, err
+	}
+	return &ldapValidator{
+		ldapDirectory: directory,
+		userFilter:    settings.GetString("ldap.user-filter"),
+		attributes:    settings.GetStringSlice("ldap.attributes"),
+	}, nil
+}
+
+func ldapConfig(settings *viper.Viper) (*ldap.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if ca := settings.GetString("ldap.ca"); ca != "" {
+		caCert, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, errors.New("no certificates found in ldap.ca")
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+	return &ldap.Config{
+		URL:       settings.GetString("ldap.url"),
+		StartTLS:  settings.GetBool("ldap.start-tls"),
+		TLSConfig: tlsConfig,
+		Timeout:   settings.GetDuration("ldap.timeout"),
+	}, nil
+}
+
+func (lv *ldapValidator) Validate(ctx context.Context, user, password string) error {
+	_, err := lv.ValidateAndFetch(ctx, user, password)
+	return err
+}
+
+func (lv *ldapValidator) ValidateAndFetch(ctx context.Context, user, password string) ([]*model.Attribute, error) {
+	if user == "" || password == "" {
+		return nil, ErrInvalidPassword
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var entry *ldap.Entry
+	err := lv.withConn(ctx, func(conn *ldap.Conn) error {
+		entries, err := lv.search(conn, lv.userFilter, user, lv.attributes)
+		if err != nil {
+			return err
+		}
+		switch len(entries) {
+		case 0:
+			return ErrUnknownUser
+		case 1:
+		default:
+			return ErrInvalidPassword
+		}
+		entry = entries[0]
+		if err = conn.Bind(entry.DN, password); err != nil {
+			if ldap.IsInvalidCredentials(err) {
+				return ErrInvalidPassword
+			}
+			return unavailable(err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	atts := []*model.Attribute{}
+	for _, name := range lv.attributes {
+		if values := entry.Values(name); len(values) > 0 {
+			atts = append(atts, &model.Attribute{Name: name, Value: values})
+		}
+	}
+	return atts, nil
+}
+
+type ldapSource struct {
+	*ldapDirectory
+	filter string
+	// LDAP attribute names to SAML attribute names
+	mapping    map[string]string
+	attributes []string
+	cache      store.Cache
+}
+
+// NewLDAPAttributeSource returns a source that adds the attributes named in ldap.attribute-map to users.
+// Entries are located with ldap.attribute-filter, or ldap.user-filter if it isn't set, and results are cached for ldap.cache-duration.
+func NewLDAPAttributeSource() (AttributeSource, error) {
+	return newLDAPAttributeSource(viper.GetViper())
+}
+
+func newLDAPAttributeSource(settings *viper.Viper) (AttributeSource, error) {
+	directory, err := newLDAPDirectory(settings)
+	if err != nil {
+		return nil, err
+	}
+	cache, err := store.New(settings.GetDuration("ldap.cache-duration"))
+	if err != nil {
+		return nil, err
+	}
+	filter := settings.GetString("ldap.attribute-filter")
+	if filter == "" {
+		filter = settings.GetString("ldap.user-filter")
+	}
+	mapping := settings.GetStringMapString("ldap.attribute-map")
+	attributes := make([]string, 0, len(mapping))
+	for name := range mapping {
+		attributes = append(attributes, name)
+	}
+	// Keep the order of attributes in assertions stable
+	sort.Strings(attributes)
+	return &ldapSource{
+		ldapDirectory: directory,
+		filter:        filter,
+		mapping:       mapping,
+		attributes:    attributes,
+		cache:         cache,
+	}, nil
+}
+
+func (ls *ldapSource) AddAttributes(user *model.User, _ *model.AuthnRequest) error {
+	if data, err := ls.cache.Get(user.Name); err == nil {
+		cached := &model.User{}
+		if err = proto.Unmarshal(data, cached); err == nil {
+			user.AppendAttributes(cached.Attributes)
+			return nil
+		}
+	}
+	atts, err := ls.lookup(user.Name)
+	if err != nil {
+		return err
+	}
+	if data, err := proto.Marshal(&model.User{Attributes: atts}); err == nil {
+		ls.cache.Set(user.Name, data)
+	}
+	user.AppendAttributes(atts)
+	return nil
+}
+
+func (ls *ldapSource) lookup(name string) ([]*model.Attribute, error) {
+	var entries []*ldap.Entry
+	err := ls.withConn(context.Background(), func(conn *ldap.Conn) (err error) {
+		entries, err = ls.search(conn, ls.filter, name, ls.attributes)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) != 1 {
+		return nil, nil
+	}
+	atts := []*model.Attribute{}
+	for _, attribute := range ls.attributes {
+		if values := entries[0].Values(attribute); len(values) > 0 {
+			atts = append(atts, &model.Attribute{Name: ls.mapping[attribute], Value: values})
+		}
+	}
+	return atts, nil
+}
+
+func unavailable(err error) error {
+	return fmt.Errorf("%w: %w", ErrServiceUnavailable, err)
+}
@@ -0,0 +1,177 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/lite-idp/ldap/ldaptest"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDirectory() *ldaptest.Server {
+	return ldaptest.NewServer(
+		ldaptest.Entry{
+			DN:       "cn=service,dc=example,dc=com",
+			Password: "service",
+		},
+		ldaptest.Entry{
+			DN:       "uid=joe,ou=people,dc=example,dc=com",
+			Password: "password",
+			Attributes: map[string][]string{
+				"uid":      {"joe"},
+				"mail":     {"joe@example.com"},
+				"memberOf": {"cn=admins,dc=example,dc=com", "cn=users,dc=example,dc=com"},
+			},
+		},
+	)
+}
+
+func configureTestLDAP(url string) {
+	viper.Set("ldap.url", url)
+	viper.Set("ldap.bind-dn", "cn=service,dc=example,dc=com")
+	viper.Set("ldap.bind-password", "service")
+	viper.Set("ldap.base-dn", "dc=example,dc=com")
+	viper.Set("ldap.attributes", []string{"mail", "memberOf"})
+}
+
+func TestLDAPValidator(t *testing.T) {
+	s := newTestDirectory()
+	defer s.Close()
+	configureTestLDAP(s.URL)
+	defer viper.Set("ldap.url", "")
+	validator, err := NewLDAPValidator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	assert.NoError(t, validator.Validate(ctx, "joe", "password"))
+	assert.Equal(t, ErrInvalidPassword, validator.Validate(ctx, "joe", "wrong"))
+	assert.Equal(t, ErrInvalidPassword, validator.Validate(ctx, "joe", ""))
+	assert.Equal(t, ErrUnknownUser, validator.Validate(ctx, "suzy", "password"))
+	assert.Equal(t, ErrUnknownUser, validator.Validate(ctx, "*", "password"), "filter characters must be escaped")
+
+	atts, err := validator.(AttributeValidator).ValidateAndFetch(ctx, "joe", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, atts, 2) {
+		assert.Equal(t, "mail", atts[0].Name)
+		assert.Equal(t, []string{"joe@example.com"}, atts[0].Value)
+		assert.Len(t, atts[1].Value, 2)
+	}
+	assert.Equal(t, 1, s.Connections(), "connections should be pooled")
+}
+
+func TestLDAPValidator_dropped(t *testing.T) {
+	s := newTestDirectory()
+	defer s.Close()
+	configureTestLDAP(s.URL)
+	viper.Set("ldap.retry-backoff", "10ms")
+	defer viper.Set("ldap.url", "")
+	defer viper.Set("ldap.retry-backoff", "100ms")
+	validator, err := NewLDAPValidator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	assert.NoError(t, validator.Validate(ctx, "joe", "password"))
+	s.DropConnections()
+	assert.NoError(t, validator.Validate(ctx, "joe", "password"), "dropped connections should be replaced")
+	assert.Equal(t, 2, s.Connections())
+
+	viper.Set("ldap.retries", -1)
+	defer viper.Set("ldap.retries", 2)
+	_, err = NewLDAPValidator()
+	assert.Error(t, err)
+}
+
+func TestLDAPValidator_unavailable(t *testing.T) {
+	s := newTestDirectory()
+	s.Close()
+	configureTestLDAP(s.URL)
+	defer viper.Set("ldap.url", "")
+	validator, err := NewLDAPValidator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = validator.Validate(context.Background(), "joe", "password")
+	assert.True(t, errors.Is(err, ErrServiceUnavailable), "expected service unavailable")
+}
+
+func TestLDAPAttributeSource(t *testing.T) {
+	s := newTestDirectory()
+	defer s.Close()
+	configureTestLDAP(s.URL)
+	viper.Set("ldap.attribute-map", map[string]string{"mail": "Email", "memberOf": "Groups"})
+	defer viper.Set("ldap.url", "")
+	source, err := NewLDAPAttributeSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &model.User{Name: "joe", Attributes: []*model.Attribute{{Name: "Email", Value: []string{"joe@gmail.com"}}}}
+	if err = source.AddAttributes(user, nil); err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, user.Attributes, 2) {
+		assert.Equal(t, []string{"joe@gmail.com", "joe@example.com"}, user.Attributes[0].Value, "values should be merged")
+		assert.Equal(t, "Groups", user.Attributes[1].Name)
+		assert.Len(t, user.Attributes[1].Value, 2, "expected multiple values")
+		statement := user.AttributeStatement()
+		assert.Len(t, statement.Attribute[1].AttributeValue, 2)
+	}
+	// The second lookup is served from the cache
+	binds := s.Binds()
+	other := &model.User{Name: "joe"}
+	assert.NoError(t, source.AddAttributes(other, nil))
+	assert.Len(t, other.Attributes, 2)
+	assert.Equal(t, binds, s.Binds(), "cached attributes should not query the directory")
+	unknown := &model.User{Name: "suzy"}
+	assert.NoError(t, source.AddAttributes(unknown, nil))
+	assert.Empty(t, unknown.Attributes)
+}
+
+func TestIDP_DefaultPasswordLoginHandler_unavailable(t *testing.T) {
+	s := newTestDirectory()
+	s.Close()
+	configureTestLDAP(s.URL)
+	defer viper.Set("ldap.url", "")
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	data, err := proto.Marshal(&model.AuthnRequest{ID: "2134"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.TempCache.Set("1234", data)
+	client := ts.Client()
+	client.CheckRedirect = func(r *http.Request, old []*http.Request) error {
+		return errors.New("no redirects allowed")
+	}
+	_, err = postLoginForm(client, i, ts.URL+"/ui/login.html", url.Values{
+		"requestId": {"1234"}, "username": {"joe"}, "password": {"password"}})
+	if err == nil {
+		t.Fatal("login should have failed")
+	}
+	assert.True(t, strings.Contains(err.Error(), "service+is+unavailable"), "login should have redirected to page with error")
+}
@@ -0,0 +1,135 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+func (i *IDP) configureRequestSize() error {
+	i.maxRequestSize = i.settings.GetInt64("max-request-size")
+	if i.maxRequestSize < 0 {
+		return fmt.Errorf("max-request-size %d can't be negative", i.maxRequestSize)
+	}
+	i.maxInflatedSize = i.settings.GetInt64("max-inflated-size")
+	if i.maxInflatedSize < 0 {
+		return fmt.Errorf("max-inflated-size %d can't be negative", i.maxInflatedSize)
+	}
+	return nil
+}
+
+// limitRequestSize rejects request bodies larger than max-request-size with 413 Request Entity Too Large. Bodies
+// without a length are cut off at the limit, and the error response of the handler reading them becomes a 413.
+func limitRequestSize(max int64, h http.Handler) http.Handler {
+	if max == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > max {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		body := &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Body, max)}
+		r.Body = body
+		h.ServeHTTP(&limitedWriter{ResponseWriter: w, body: body}, r)
+	})
+}
+
+// limitedBody notes when a request body goes over the limit
+type limitedBody struct {
+	io.ReadCloser
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		b.exceeded = true
+	}
+	return n, err
+}
+
+// limitedWriter reports errors caused by a body over the limit as 413 Request Entity Too Large
+type limitedWriter struct {
+	http.ResponseWriter
+	body *limitedBody
+}
+
+func (w *limitedWriter) WriteHeader(status int) {
+	if w.body.exceeded && status >= http.StatusBadRequest {
+		status = http.StatusRequestEntityTooLarge
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// errInflatedTooLarge is returned for deflated messages that inflate to more than max-inflated-size
+var errInflatedTooLarge = errors.New("inflated message is larger than max-inflated-size")
+
+// inflaters holds DEFLATE decompressors that finished reading a message, since each allocates tens of kilobytes
+var inflaters sync.Pool
+
+// inflate returns the content of a DEFLATE-compressed message. Reads fail with errInflatedTooLarge as soon as
+// more than max bytes come out, so a small message can't inflate to gigabytes. A max of 0 means no limit. Closing
+// the reader lets the next message reuse its decompressor.
+func inflate(data []byte, max int64) io.ReadCloser {
+	r, ok := inflaters.Get().(io.ReadCloser)
+	if ok {
+		// Resetting without a dictionary can't fail
+		r.(flate.Resetter).Reset(bytes.NewReader(data), nil)
+	} else {
+		r = flate.NewReader(bytes.NewReader(data))
+	}
+	return &limitedInflater{r: r, limited: max > 0, remaining: max}
+}
+
+// limitedInflater reads up to one byte past the limit to tell a message of exactly the limit from a larger one
+type limitedInflater struct {
+	r         io.ReadCloser
+	limited   bool
+	remaining int64
+}
+
+func (l *limitedInflater) Read(p []byte) (int, error) {
+	if !l.limited {
+		return l.r.Read(p)
+	}
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+		l.remaining = 0
+		return n, errInflatedTooLarge
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// Close returns the decompressor to the pool. The inflater can't be read afterwards.
+func (l *limitedInflater) Close() error {
+	if l.r != nil {
+		inflaters.Put(l.r)
+		l.r = nil
+	}
+	return nil
+}
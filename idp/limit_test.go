@@ -0,0 +1,146 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_maxRequestSize(t *testing.T) {
+	viper.Set("max-request-size", 1024)
+	defer viper.Set("max-request-size", 1048576)
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	large := strings.Repeat("a", 2048)
+	post := func(path string, body io.Reader) int {
+		resp, err := ts.Client().Post(ts.URL+viper.GetString(path), "text/xml", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for _, path := range []string{"attribute-service-path", "artifact-service-path", "sso-service-path"} {
+		assert.Equal(t, http.StatusRequestEntityTooLarge, post(path, strings.NewReader(large)), path)
+	}
+	// Wrapping the reader hides its length, so the body is chunked and only cut off while it's read
+	for _, path := range []string{"attribute-service-path", "sso-service-path"} {
+		assert.Equal(t, http.StatusRequestEntityTooLarge, post(path, io.MultiReader(strings.NewReader(large))), path)
+	}
+	assert.Equal(t, http.StatusBadRequest, post("attribute-service-path", strings.NewReader("<bad")),
+		"small requests should be handled as usual")
+}
+
+func TestLimitRequestSize(t *testing.T) {
+	var read []byte
+	h := limitRequestSize(0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		read, _ = ioutil.ReadAll(r.Body)
+	}))
+	body := bytes.Repeat([]byte("a"), 2048)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body)))
+	assert.Equal(t, body, read, "0 should disable the limit")
+}
+
+func TestIDP_configureRequestSize(t *testing.T) {
+	viper.Set("max-request-size", -1)
+	defer viper.Set("max-request-size", 1048576)
+	i := &IDP{settings: viper.GetViper()}
+	assert.Error(t, i.configureRequestSize())
+
+	viper.Set("max-request-size", 1048576)
+	viper.Set("max-inflated-size", -1)
+	defer viper.Set("max-inflated-size", 1048576)
+	assert.Error(t, i.configureRequestSize())
+}
+
+// deflate compresses the data like a service provider using the HTTP-Redirect binding
+func deflate(t testing.TB, data []byte) []byte {
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestInflate(t *testing.T) {
+	// 64 MiB of zeros deflate to about 64 KiB
+	bomb := deflate(t, make([]byte, 64<<20))
+	r := inflate(bomb, 1024)
+	n, err := io.Copy(ioutil.Discard, r)
+	assert.Equal(t, errInflatedTooLarge, err)
+	assert.Equal(t, int64(1024), n, "reading should stop at the limit")
+	r.Close()
+
+	data := bytes.Repeat([]byte("a"), 1024)
+	inflated, err := ioutil.ReadAll(inflate(deflate(t, data), 1024))
+	assert.NoError(t, err, "messages of exactly the limit are allowed")
+	assert.Equal(t, data, inflated)
+	inflated, err = ioutil.ReadAll(inflate(deflate(t, data), 0))
+	assert.NoError(t, err, "0 should disable the limit")
+	assert.Equal(t, data, inflated)
+
+	// Decompressors are reused once the message they read is closed
+	for _, message := range [][]byte{[]byte("first"), []byte("second")} {
+		r = inflate(deflate(t, message), 1024)
+		inflated, err = ioutil.ReadAll(r)
+		r.Close()
+		assert.NoError(t, err)
+		assert.Equal(t, message, inflated)
+	}
+}
+
+func TestIDP_maxInflatedSize(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	// A small request that inflates to 16 MiB
+	bomb := base64.StdEncoding.EncodeToString(deflate(t, append([]byte("<samlp:AuthnRequest xmlns:samlp=\"urn:oasis:names:tc:SAML:2.0:protocol\">"),
+		bytes.Repeat([]byte(" "), 16<<20)...)))
+	assert.True(t, len(bomb) < 64<<10)
+	w := httptest.NewRecorder()
+	i.RedirectSSOHandler(w, httptest.NewRequest("GET", "/SAML2/Redirect/SSO?SAMLRequest="+url.QueryEscape(bomb), nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	form := url.Values{"SAMLRequest": {bomb}}
+	r := httptest.NewRequest("POST", "/SAML2/POST/SSO", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = httptest.NewRecorder()
+	i.PostSSOHandler(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "deflated POST messages are limited as well")
+
+	_, err := i.readPostMessage(bomb)
+	assert.Equal(t, errInflatedTooLarge, err)
+	assert.Equal(t, errInflatedTooLarge, i.decodeRedirectMessage(bomb, &saml.AuthnRequest{}))
+}
@@ -0,0 +1,263 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// localeParameter is the query parameter that overrides the language picked from Accept-Language
+const localeParameter = "lang"
+
+// Messages is the text shown to users in one language, keyed by message ID. Catalogs in locale-directory
+// only need to include the messages they translate, the rest are shown in default-locale.
+type Messages map[string]string
+
+// defaultMessages are the built-in English messages
+var defaultMessages = Messages{
+	"loginUsername":              "Username",
+	"loginPassword":              "Password",
+	"loginSubmit":                "Log In",
+	"loginWelcome":               "Welcome to LITE-IDP.",
+	"loginFormExpired":           "Your login form expired. Please try again.",
+	"loginInvalid":               "Invalid login or password. Please try again.",
+	"loginUnavailable":           "The authentication service is unavailable. Please try again later.",
+	"formExpired":                "Your form expired. Please try again.",
+	"totpTitle":                  "Enter Code",
+	"totpCode":                   "Code",
+	"totpSubmit":                 "Verify",
+	"totpInstructions":           "Enter the code from your authenticator app.",
+	"totpInvalid":                "Invalid code. Please try again.",
+	"totpAttemptsExceeded":       "Too many invalid codes. Please log in again.",
+	"totpNotEnrolled":            "A one-time code is required, but your account isn't set up for one.",
+	"consentTitle":               "Release Information",
+	"consentIntro":               "%s will receive the following information about you.",
+	"consentDecline":             "Decline",
+	"consentAccept":              "Accept",
+	"consentRemembered":          "You won't be asked again unless the information changes.",
+	"consentDeclinedTitle":       "Information not released",
+	"consentDeclinedMessage":     "You chose not to release your information to the application, so you can't sign in to it. Return to the application to try again.",
+	"errorAccessDeniedTitle":     "Access denied",
+	"errorAccessDeniedMessage":   "The sign-in request from the application was rejected. Please return to the application and try again.",
+	"errorInvalidRequestTitle":   "Invalid request",
+	"errorInvalidRequestMessage": "The sign-in request couldn't be processed. Please return to the application and try again.",
+	"errorServerTitle":           "Something went wrong",
+	"errorServerMessage":         "The sign-in service had a problem. Please try again later.",
+	"errorReference":             "If you contact the helpdesk, please give them this reference:",
+}
+
+// defaultMessageIDs looks up the ID of a built-in English message, so errors passed to the login page in the query
+// string can be translated
+var defaultMessageIDs = func() map[string]string {
+	ids := make(map[string]string, len(defaultMessages))
+	for id, text := range defaultMessages {
+		ids[text] = id
+	}
+	return ids
+}()
+
+// text translates a message ID or built-in English message. Anything else, such as an error from a custom handler,
+// is returned as is.
+func (m Messages) text(message string) string {
+	if text, ok := m[message]; ok {
+		return text
+	}
+	if id, ok := defaultMessageIDs[message]; ok {
+		return m[id]
+	}
+	return message
+}
+
+// configureLocales reads the message catalogs in locale-directory. Each is a JSON object of message IDs and text
+// named for its language, such as de.json or pt-BR.json.
+func (i *IDP) configureLocales() error {
+	catalogs := map[string]Messages{"en": {}}
+	if dir := i.settings.GetString("locale-directory"); dir != "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return err
+		}
+		if len(files) == 0 {
+			return fmt.Errorf("locale-directory %s doesn't have any message catalogs", dir)
+		}
+		for _, file := range files {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			messages := Messages{}
+			if err = json.Unmarshal(data, &messages); err != nil {
+				return fmt.Errorf("failed to read message catalog %s: %v", file, err)
+			}
+			catalogs[normalizeLocale(strings.TrimSuffix(filepath.Base(file), ".json"))] = messages
+		}
+	}
+	i.defaultLocale = normalizeLocale(i.settings.GetString("default-locale"))
+	fallback, ok := catalogs[i.defaultLocale]
+	if !ok {
+		return fmt.Errorf("default-locale %s doesn't have a message catalog", i.defaultLocale)
+	}
+	// Messages missing from a catalog fall back to default-locale, then to the built-in English
+	i.catalogs = make(map[string]Messages, len(catalogs))
+	for lang, catalog := range catalogs {
+		messages := Messages{}
+		for _, layer := range []Messages{defaultMessages, catalogs["en"], fallback, catalog} {
+			for id, text := range layer {
+				messages[id] = text
+			}
+		}
+		i.catalogs[lang] = messages
+	}
+	return nil
+}
+
+// messages returns the language that pages for the request are shown in and its messages
+func (i *IDP) messages(r *http.Request) (string, Messages) {
+	lang := i.locale(r)
+	if messages, ok := i.catalogs[lang]; ok {
+		return lang, messages
+	}
+	return "en", defaultMessages
+}
+
+// locale picks the language in the lang query parameter if there's a catalog for it, otherwise the most preferred
+// language in Accept-Language that has one, otherwise default-locale
+func (i *IDP) locale(r *http.Request) string {
+	if lang := i.matchLocale(r.URL.Query().Get(localeParameter)); lang != "" {
+		return lang
+	}
+	for _, tag := range acceptedLanguages(r.Header.Get("Accept-Language")) {
+		if lang := i.matchLocale(tag); lang != "" {
+			return lang
+		}
+	}
+	return i.defaultLocale
+}
+
+// matchLocale returns the catalog for the language tag, or for its primary language if there isn't one, such as de
+// for de-AT. It's empty if neither has a catalog.
+func (i *IDP) matchLocale(tag string) string {
+	tag = normalizeLocale(tag)
+	if tag == "" {
+		return ""
+	}
+	if _, ok := i.catalogs[tag]; ok {
+		return tag
+	}
+	if n := strings.IndexByte(tag, '-'); n > 0 {
+		if _, ok := i.catalogs[tag[:n]]; ok {
+			return tag[:n]
+		}
+	}
+	return ""
+}
+
+// normalizeLocale lower cases the language tag and separates its subtags with hyphens, so pt_BR becomes pt-br
+func normalizeLocale(tag string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(tag), "_", "-", -1))
+}
+
+// acceptedLanguages returns the language tags in an Accept-Language header, most preferred first. Wildcards and
+// languages with a quality of 0 are left out.
+func acceptedLanguages(header string) []string {
+	type language struct {
+		tag     string
+		quality float64
+	}
+	var languages []language
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		tag := strings.TrimSpace(params[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			q, err := strconv.ParseFloat(param[2:], 64)
+			if err != nil {
+				q = 0
+			}
+			quality = q
+		}
+		if quality <= 0 {
+			continue
+		}
+		languages = append(languages, language{tag, quality})
+	}
+	sort.SliceStable(languages, func(a, b int) bool {
+		return languages[a].quality > languages[b].quality
+	})
+	tags := make([]string, len(languages))
+	for n, l := range languages {
+		tags[n] = l.tag
+	}
+	return tags
+}
+
+// spDisplayName is the name of the service provider or OIDC client shown to users in the language. It's the
+// service provider's DisplayNames entry for the language if there is one, otherwise its Name, otherwise the entity ID.
+func (i *IDP) spDisplayName(entityID, lang string) string {
+	if sp, ok := i.sps.get(entityID); ok {
+		if name := localizedName(sp.DisplayNames, lang); name != "" {
+			return name
+		}
+		if sp.Name != "" {
+			return sp.Name
+		}
+	}
+	if client, ok := i.oidcClients[entityID]; ok && client.Name != "" {
+		return client.Name
+	}
+	return entityID
+}
+
+// localizedName returns the name for the language, or for its primary language
+func localizedName(names map[string]string, lang string) string {
+	for tag, name := range names {
+		if normalizeLocale(tag) == lang {
+			return name
+		}
+	}
+	if n := strings.IndexByte(lang, '-'); n > 0 {
+		return localizedName(names, lang[:n])
+	}
+	return ""
+}
+
+// keepLocale adds the lang query parameter of the request to a location on the IdP, so users who picked a language
+// keep seeing pages in it
+func keepLocale(r *http.Request, location string) string {
+	lang := r.URL.Query().Get(localeParameter)
+	if lang == "" {
+		return location
+	}
+	separator := "?"
+	if strings.Contains(location, "?") {
+		separator = "&"
+	}
+	return location + separator + url.Values{localeParameter: {lang}}.Encode()
+}
@@ -0,0 +1,182 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestCatalogs writes German and French message catalogs to a new locale-directory
+func writeTestCatalogs(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "locales")
+	if err != nil {
+		t.Fatal(err)
+	}
+	catalogs := map[string]string{
+		"de.json": `{"loginSubmit": "Anmelden", "loginInvalid": "Ungültige Anmeldung.", "consentAccept": "Zustimmen",
+			"consentIntro": "%s erhält die folgenden Informationen über Sie.", "errorServerTitle": "Etwas ist schiefgelaufen"}`,
+		"fr-CA.json": `{"loginSubmit": "Connexion"}`,
+	}
+	for name, catalog := range catalogs {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), []byte(catalog), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func Test_acceptedLanguages(t *testing.T) {
+	assert.Equal(t, []string{"de-AT", "de", "en"}, acceptedLanguages("de-AT,de;q=0.9, en;q=0.8"))
+	assert.Equal(t, []string{"de", "fr"}, acceptedLanguages("fr;q=0.2, de;q=0.5"))
+	assert.Equal(t, []string{"en"}, acceptedLanguages("*, es;q=0, en;q=0.1"), "wildcards and refused languages are left out")
+	assert.Empty(t, acceptedLanguages(""))
+}
+
+func TestIDP_locale(t *testing.T) {
+	dir := writeTestCatalogs(t)
+	defer os.RemoveAll(dir)
+	viper.Set("locale-directory", dir)
+	defer viper.Set("locale-directory", "")
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+
+	request := func(query, acceptLanguage string) *http.Request {
+		r := httptest.NewRequest("GET", "/ui/login.html"+query, nil)
+		r.Header.Set("Accept-Language", acceptLanguage)
+		return r
+	}
+	lang, messages := i.messages(request("", "de-AT,de;q=0.9,en;q=0.8"))
+	assert.Equal(t, "de", lang, "regional variants should fall back to the language")
+	assert.Equal(t, "Anmelden", messages["loginSubmit"])
+	assert.Equal(t, "Username", messages["loginUsername"], "missing messages should fall back to default-locale")
+	assert.Equal(t, "Ungültige Anmeldung.", messages.text("Invalid login or password. Please try again."))
+	assert.Equal(t, "Unknown problem", messages.text("Unknown problem"))
+
+	lang, _ = i.messages(request("", "es, fr-CA;q=0.5"))
+	assert.Equal(t, "fr-ca", lang)
+	lang, _ = i.messages(request("?lang=fr_CA", "de"))
+	assert.Equal(t, "fr-ca", lang, "the query parameter should take precedence")
+	lang, _ = i.messages(request("?lang=es", "de"))
+	assert.Equal(t, "de", lang, "languages without a catalog should be ignored")
+	lang, messages = i.messages(request("", "es"))
+	assert.Equal(t, "en", lang)
+	assert.Equal(t, "Log In", messages["loginSubmit"])
+
+	viper.Set("default-locale", "de")
+	defer viper.Set("default-locale", "en")
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	lang, messages = i.messages(request("", "fr-CA"))
+	assert.Equal(t, "fr-ca", lang)
+	assert.Equal(t, "Zustimmen", messages["consentAccept"], "French should fall back to German")
+
+	viper.Set("default-locale", "es")
+	_, err := (&IDP{}).Handler()
+	assert.Error(t, err, "default-locale should have a catalog")
+	viper.Set("default-locale", "en")
+	if err = ioutil.WriteFile(filepath.Join(dir, "it.json"), []byte(`["Accedi"]`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err, "catalogs should be JSON objects")
+}
+
+func TestIDP_locale_pages(t *testing.T) {
+	dir := writeTestCatalogs(t)
+	defer os.RemoveAll(dir)
+	viper.Set("locale-directory", dir)
+	defer viper.Set("locale-directory", "")
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	dex, _ := i.ServiceProvider("dex")
+	dex.Name = "Dex"
+	dex.DisplayNames = map[string]string{"de": "Dex auf Deutsch"}
+
+	req, err := http.NewRequest("GET", ts.URL+"/ui/login.html?requestId=1234&error="+
+		url.QueryEscape("Invalid login or password. Please try again."), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Language", "de")
+	resp, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "de", resp.Header.Get("Content-Language"))
+	lang, _ := doc.Find("html").Attr("lang")
+	assert.Equal(t, "de", lang)
+	assert.Equal(t, "Anmelden", doc.Find("button[type=submit]").Text())
+	assert.Equal(t, "Ungültige Anmeldung.", doc.Find("#errorMsg").Text())
+	assert.Equal(t, "Username", doc.Find("label[for=inputUsername]").Text())
+
+	r := httptest.NewRequest("GET", consentPagePath+"?lang=de", nil)
+	w := httptest.NewRecorder()
+	i.renderConsentPage(w, r, "5678", &model.PendingLogin{
+		User:    &model.User{Name: "joe"},
+		Request: &model.AuthnRequest{Issuer: "dex"},
+	}, "", http.StatusOK)
+	doc, err = goquery.NewDocumentFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Dex auf Deutsch erhält die folgenden Informationen über Sie.", doc.Find("p").First().Text())
+	assert.Equal(t, "Zustimmen", doc.Find("button[value=accept]").Text())
+
+	r = WithRequestInfo(httptest.NewRequest("GET", "/", nil))
+	r.Header.Set("Accept-Language", "de")
+	w = httptest.NewRecorder()
+	i.writeError(w, r, errors.New("database is down"), http.StatusInternalServerError)
+	assert.Contains(t, w.Body.String(), "Etwas ist schiefgelaufen")
+	assert.Contains(t, w.Body.String(), `<html lang="de">`)
+}
+
+func TestIDP_spDisplayName(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.ServiceProvider("dex")
+	dex.Name = ""
+	assert.Equal(t, "dex", i.spDisplayName("dex", "de"), "the entity ID should be shown without a name")
+	dex.Name = "Dex"
+	dex.DisplayNames = map[string]string{"de": "Dex auf Deutsch", "pt-br": "Dex em português"}
+	assert.Equal(t, "Dex auf Deutsch", i.spDisplayName("dex", "de-at"))
+	assert.Equal(t, "Dex em português", i.spDisplayName("dex", "pt-br"))
+	assert.Equal(t, "Dex", i.spDisplayName("dex", "fr"))
+	assert.Equal(t, "unknown", i.spDisplayName("unknown", "de"))
+}
+
+func Test_keepLocale(t *testing.T) {
+	r := httptest.NewRequest("POST", "/ui/login.html?lang=de", nil)
+	assert.Equal(t, "/ui/login.html?requestId=1&lang=de", keepLocale(r, "/ui/login.html?requestId=1"))
+	r = httptest.NewRequest("POST", "/ui/login.html", nil)
+	assert.Equal(t, "/ui/login.html?requestId=1", keepLocale(r, "/ui/login.html?requestId=1"))
+}
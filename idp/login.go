@@ -0,0 +1,169 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"html"
+	htmltemplate "html/template"
+	"net/http"
+	"strings"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/ui"
+	"github.com/golang/protobuf/proto"
+)
+
+// loginAssetsPath is where files from login-assets-directory are served
+const loginAssetsPath = "/ui/assets/"
+
+// LoginPage is passed to the login-template
+type LoginPage struct {
+	// Name of the service provider the user is logging in to, its entity ID if it doesn't have one
+	ServiceProvider string
+	// Message to display when the last attempt failed
+	Error     string
+	RequestID string
+	CSRFToken string
+	// Fields the form has to post along with username and password
+	HiddenFields []HiddenField
+	// Language the page is shown in and its messages, such as .Messages.loginUsername
+	Lang     string
+	Messages Messages
+}
+
+// HiddenField is a hidden input on the login form
+type HiddenField struct {
+	Name  string
+	Value string
+}
+
+// configureLoginPage parses the login-template if one is set
+func (i *IDP) configureLoginPage() error {
+	i.loginTemplate = nil
+	if file := i.settings.GetString("login-template"); file != "" {
+		templ, err := htmltemplate.ParseFiles(file)
+		if err != nil {
+			return err
+		}
+		i.loginTemplate = templ
+	}
+	return nil
+}
+
+// DefaultLoginPageHandler is the default implementation for the login page handler. It serves the login form
+// with a CSRF token for the pending request. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultLoginPageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		i.renderLoginPage(w, r, query.Get("requestId"), query.Get("error"), http.StatusOK)
+	}
+}
+
+// renderLoginPage writes the login form for the pending request with an optional error message, which can be
+// the ID of a message to show in the user's language
+func (i *IDP) renderLoginPage(w http.ResponseWriter, r *http.Request, requestID, message string, status int) {
+	token := csrfToken(i.setLoginCookie(w, r), requestID)
+	lang, messages := i.messages(r)
+	message = messages.text(message)
+	var body []byte
+	var err error
+	if i.loginTemplate != nil {
+		body, err = i.executeLoginTemplate(requestID, message, token, lang, messages)
+	} else {
+		body, err = defaultLoginPage(message, token, lang, messages)
+	}
+	if err != nil {
+		i.writeError(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	// Tokens are tied to the request, so the page can't be cached like the rest of the UI
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", lang)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (i *IDP) executeLoginTemplate(requestID, message, token, lang string, messages Messages) ([]byte, error) {
+	page := LoginPage{
+		Error:     message,
+		RequestID: requestID,
+		CSRFToken: token,
+		HiddenFields: []HiddenField{
+			{"requestId", requestID},
+			{csrfField, token},
+		},
+		Lang:     lang,
+		Messages: messages,
+	}
+	if data, err := i.TempCache.Get(requestID); err == nil {
+		req := &model.AuthnRequest{}
+		if err = proto.Unmarshal(data, req); err == nil {
+			page.ServiceProvider = i.spDisplayName(req.Issuer, lang)
+		}
+	}
+	var buf bytes.Buffer
+	if err := i.loginTemplate.Execute(&buf, page); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// defaultLoginPage translates the login page bundled in the ui package and adds the CSRF token and message to it
+func defaultLoginPage(message, token, lang string, messages Messages) ([]byte, error) {
+	page, err := ui.Asset("dist/login.html")
+	if err != nil {
+		return nil, err
+	}
+	body := strings.NewReplacer(
+		`<html lang="en"`, `<html lang="`+html.EscapeString(lang)+`"`,
+		`>Username</label>`, `>`+html.EscapeString(messages.text("loginUsername"))+`</label>`,
+		`>Password</label>`, `>`+html.EscapeString(messages.text("loginPassword"))+`</label>`,
+		`>Log In</button>`, `>`+html.EscapeString(messages.text("loginSubmit"))+`</button>`,
+		`<strong>Welcome to LITE-IDP.</strong>`, `<strong>`+html.EscapeString(messages.text("loginWelcome"))+`</strong>`,
+	).Replace(string(page))
+	body = strings.Replace(body, "</form>",
+		`<input type="hidden" name="`+csrfField+`" value="`+html.EscapeString(token)+`"></form>`, 1)
+	if message != "" {
+		body = strings.Replace(body, `class="alert alert-danger hidden"`, `class="alert alert-danger"`, 1)
+		body = strings.Replace(body, `<span id="errorMsg">test</span>`,
+			`<span id="errorMsg">`+html.EscapeString(message)+`</span>`, 1)
+	}
+	return []byte(body), nil
+}
+
+// uiHandler serves the login, TOTP, and consent pages and login assets ahead of the bundled UI, which owns the rest of /ui/
+func (i *IDP) uiHandler() http.HandlerFunc {
+	userInterface := ui.UI()
+	var assets http.Handler
+	if dir := i.settings.GetString("login-assets-directory"); dir != "" {
+		assets = http.StripPrefix(loginAssetsPath, http.FileServer(http.Dir(dir)))
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/ui/login.html":
+			i.LoginPageHandler(w, r)
+		case r.URL.Path == totpPagePath:
+			i.TOTPPageHandler(w, r)
+		case r.URL.Path == consentPagePath:
+			i.ConsentPageHandler(w, r)
+		case assets != nil && strings.HasPrefix(r.URL.Path, loginAssetsPath):
+			assets.ServeHTTP(w, r)
+		default:
+			userInterface.ServeHTTP(w, r)
+		}
+	}
+}
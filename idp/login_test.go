@@ -0,0 +1,109 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const testLoginTemplate = `<html><body>
+<h1 id="sp">{{.ServiceProvider}}</h1>
+{{if .Error}}<p id="error">{{.Error}}</p>{{end}}
+<form method="POST">
+{{range .HiddenFields}}<input type="hidden" name="{{.Name}}" value="{{.Value}}">{{end}}
+<input name="username"><input name="password" type="password">
+</form>
+<img src="assets/logo.png">
+</body></html>`
+
+func TestIDP_DefaultLoginPageHandler_template(t *testing.T) {
+	dir, err := ioutil.TempDir("", "login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err = ioutil.WriteFile(filepath.Join(dir, "login.html"), []byte(testLoginTemplate), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "logo.png"), []byte("logo"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("login-template", filepath.Join(dir, "login.html"))
+	viper.Set("login-assets-directory", dir)
+	defer viper.Set("login-template", "")
+	defer viper.Set("login-assets-directory", "")
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	dex, _ := i.ServiceProvider("dex")
+	dex.Name = "Dex <Example>"
+	data, err := proto.Marshal(&model.AuthnRequest{ID: "2134", Issuer: "dex"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.TempCache.Set("1234", data)
+
+	resp, err := ts.Client().Get(ts.URL + "/ui/login.html?requestId=1234&error=" + url.QueryEscape("Invalid login"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Dex <Example>", doc.Find("#sp").Text())
+	assert.Equal(t, "Invalid login", doc.Find("#error").Text())
+	requestID, _ := doc.Find("input[name=requestId]").Attr("value")
+	assert.Equal(t, "1234", requestID)
+	token, _ := doc.Find("input[name=csrfToken]").Attr("value")
+	var cookie string
+	for _, c := range resp.Cookies() {
+		if c.Name == i.loginCookieName() {
+			cookie = c.Value
+		}
+	}
+	assert.Equal(t, csrfToken(cookie, "1234"), token)
+
+	resp, err = ts.Client().Get(ts.URL + "/ui/assets/logo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "logo", string(body), "assets should be served from login-assets-directory")
+}
+
+func TestIDP_Handler_badLoginTemplate(t *testing.T) {
+	viper.Set("login-template", filepath.Join("testdata", "missing.html"))
+	defer viper.Set("login-template", "")
+	i := &IDP{}
+	_, err := i.Handler()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "missing.html")
+	}
+}
@@ -0,0 +1,227 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxNewIDLength is the longest NewID allowed by SAML core
+const maxNewIDLength = 256
+
+// unknownPrincipalStatus tells a service provider that the NameID in its request doesn't identify a user
+var unknownPrincipalStatus = &saml.Status{
+	StatusCode: saml.StatusCode{
+		Value: "urn:oasis:names:tc:SAML:2.0:status:Requester",
+		StatusCode: &saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:UnknownPrincipal",
+		},
+	},
+}
+
+// DefaultManageNameIDHandler is the default implementation for the name identifier management handler. Requests
+// are accepted with the SOAP binding, which reports errors as SOAP faults, and with the HTTP-Redirect binding.
+// It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultManageNameIDHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			if err := i.processManageNameIDSOAP(w, r); err != nil {
+				writeSOAPFault(w, err)
+			}
+			return
+		}
+		if err := i.processManageNameIDRedirect(w, r); err != nil {
+			i.writeError(w, r, err, ssoErrorStatus(err))
+		}
+	}
+}
+
+func (i *IDP) processManageNameIDSOAP(w http.ResponseWriter, r *http.Request) error {
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	i.debugMessage(messageReceived, data)
+	var env saml.ManageNameIDRequestEnv
+	if err = xml.Unmarshal(data, &env); err != nil {
+		return clientFault(err)
+	}
+	req := &saml.ManageNameIDRequest{}
+	message, err := unmarshalSOAPRequest(env.Body.RawRequest, req)
+	if err != nil {
+		return clientFault(err)
+	}
+	sp, ok := i.sps.get(req.Issuer)
+	if !ok {
+		return deniedFault(http.StatusForbidden, &UnknownServiceProviderError{req.Issuer})
+	}
+	recordServiceProvider(r, sp.EntityID)
+	recordBinding(r, soapBinding)
+	// The request has an enveloped signature, which is required since it changes the user's identifiers
+	if err = dsig.Verify(message, sp.publicKey); err != nil {
+		i.metrics.signatureFailures.Inc(sp.EntityID)
+		return deniedFault(http.StatusForbidden, err)
+	}
+	if err = i.checkIssueInstant(req.IssueInstant); err != nil {
+		return deniedFault(http.StatusBadRequest, err)
+	}
+	if err = i.checkReplay(sp.EntityID, req.ID); err != nil {
+		var denied *requestDeniedError
+		if errors.As(err, &denied) {
+			return deniedFault(http.StatusBadRequest, err)
+		}
+		return err
+	}
+	response, err := i.manageNameID(req, sp)
+	if err != nil {
+		return err
+	}
+	if response.Signature, err = i.signer.CreateSignature(response); err != nil {
+		return err
+	}
+	respEnv := saml.ManageNameIDResponseEnv{
+		Body: saml.ManageNameIDResponseBody{
+			Response: *response,
+		},
+	}
+	// Encode before writing so failures can still be reported as faults
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	if err = xml.NewEncoder(&b).Encode(respEnv); err != nil {
+		return err
+	}
+	i.debugMessage(messageSent, b.Bytes())
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	if _, err = w.Write(b.Bytes()); err != nil {
+		log.Errorf("failed to write name identifier management response: %v", err)
+	}
+	return nil
+}
+
+func (i *IDP) processManageNameIDRedirect(w http.ResponseWriter, r *http.Request) error {
+	query, err := parseRedirectQuery(r)
+	if err != nil {
+		return err
+	}
+	req := &saml.ManageNameIDRequest{}
+	if err = i.decodeRedirectMessage(query.get("SAMLRequest"), req); err != nil {
+		return err
+	}
+	sp, err := i.validateRedirectMessage(req.Issuer, req.IssueInstant, query, r)
+	if err != nil {
+		return err
+	}
+	recordBinding(r, redirectBinding)
+	service := sp.manageNameIDService(redirectBinding)
+	if service == nil {
+		return errors.New("service provider does not support redirect name identifier management")
+	}
+	if err = i.checkReplay(sp.EntityID, req.ID); err != nil {
+		return err
+	}
+	response, err := i.manageNameID(req, sp)
+	if err != nil {
+		return err
+	}
+	response.Destination = service.ResponseLocation
+	if response.Destination == "" {
+		response.Destination = service.Location
+	}
+	target, err := i.redirectURL(response.Destination, "SAMLResponse", response, query.get("RelayState"))
+	if err != nil {
+		return err
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+	return nil
+}
+
+// manageNameID applies a validated request to the persistent NameID it names. NewID is saved as the NameID's
+// SPProvidedID, and Terminate revokes the NameID so the user gets a new one at their next login.
+func (i *IDP) manageNameID(req *saml.ManageNameIDRequest, sp *ServiceProvider) (*saml.ManageNameIDResponse, error) {
+	nameID := req.NameID
+	if nameID == nil && req.EncryptedID != nil {
+		var err error
+		if nameID, err = i.decryptNameID(req.EncryptedID); err != nil {
+			return nil, clientFault(err)
+		}
+	}
+	if nameID == nil {
+		return nil, clientFault(errors.New("ManageNameIDRequest doesn't have a NameID"))
+	}
+	newID := req.NewID
+	if newID == nil && req.NewEncryptedID != nil {
+		decrypted, err := i.decryptNewID(req.NewEncryptedID)
+		if err != nil {
+			return nil, clientFault(err)
+		}
+		newID = &decrypted
+	}
+	if newID == nil && req.Terminate == nil {
+		return nil, clientFault(errors.New("ManageNameIDRequest must have a NewID or Terminate"))
+	}
+	if newID != nil && len(*newID) > maxNewIDLength {
+		return nil, clientFault(fmt.Errorf("NewID cannot be longer than %d characters", maxNewIDLength))
+	}
+
+	status := &saml.Status{
+		StatusCode: saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:Success",
+		},
+	}
+	// Only persistent NameIDs are kept by the IdP
+	user := ""
+	if nameID.Format == nameIDFormatPersistent {
+		var err error
+		if user, err = i.pairwiseIDs.User(sp.EntityID, nameID.Value); err != nil && err != store.ErrNotFound {
+			return nil, err
+		}
+	}
+	switch {
+	case user == "":
+		log.Warnf("name identifier management request from %s does not match a persistent NameID", sp.EntityID)
+		status = unknownPrincipalStatus
+	case req.Terminate != nil:
+		if err := i.pairwiseIDs.Revoke(sp.EntityID, user); err != nil {
+			return nil, err
+		}
+		log.Infof("%s terminated the persistent NameID of %s", sp.EntityID, user)
+	default:
+		if err := i.pairwiseIDs.SetSPProvidedID(sp.EntityID, user, *newID); err != nil {
+			return nil, err
+		}
+		log.Infof("%s changed the SPProvidedID of %s", sp.EntityID, user)
+	}
+	return &saml.ManageNameIDResponse{
+		StatusResponseType: saml.StatusResponseType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now(),
+			Issuer:       i.issuer(sp.EntityID),
+			InResponseTo: req.ID,
+			Status:       status,
+		},
+	}, nil
+}
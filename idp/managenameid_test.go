@@ -0,0 +1,257 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const testManageNameIDLocation = "https://sp.example.com/saml/mni"
+
+// getTestIDPWithManageNameID returns an IdP with name identifier management enabled and joe's persistent NameID for dex
+func getTestIDPWithManageNameID(t *testing.T) (*IDP, string) {
+	viper.Set("manage-nameid-enabled", true)
+	defer viper.Set("manage-nameid-enabled", false)
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	id, err := i.pairwiseIDs.Get("dex", "joe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return i, id
+}
+
+func newTestManageNameIDRequest(id string) *saml.ManageNameIDRequest {
+	return &saml.ManageNameIDRequest{
+		RequestAbstractType: saml.RequestAbstractType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now(),
+			Issuer:       "dex",
+		},
+		NameID: &saml.NameID{Format: nameIDFormatPersistent, Value: id},
+	}
+}
+
+// sendManageNameIDSOAP posts the request in a SOAP message, signed by the test service provider if sign is set
+func sendManageNameIDSOAP(t *testing.T, i *IDP, req *saml.ManageNameIDRequest, sign bool) (*httptest.ResponseRecorder, *saml.ManageNameIDResponse) {
+	if sign {
+		signature, err := i.signer.CreateSignature(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Signature = signature
+	}
+	data, err := xml.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := `<S:Envelope xmlns:S="http://schemas.xmlsoap.org/soap/envelope/"><S:Body>` + string(data) + `</S:Body></S:Envelope>`
+	r := httptest.NewRequest("POST", viper.GetString("manage-nameid-service-path"), strings.NewReader(body))
+	w := httptest.NewRecorder()
+	i.Router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		return w, nil
+	}
+	env := &saml.ManageNameIDResponseEnv{}
+	if err = xml.Unmarshal(w.Body.Bytes(), env); err != nil {
+		t.Fatal(err)
+	}
+	return w, &env.Body.Response
+}
+
+func TestIDP_DefaultManageNameIDHandler_soap(t *testing.T) {
+	i, id := getTestIDPWithManageNameID(t)
+
+	newID := "sp-joe"
+	req := newTestManageNameIDRequest(id)
+	req.NewID = &newID
+	_, resp := sendManageNameIDSOAP(t, i, req, true)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", resp.Status.StatusCode.Value)
+		assert.Equal(t, req.ID, resp.InResponseTo)
+		assert.NotNil(t, resp.Signature, "the response should be signed")
+		assertIssuer(t, i, resp.Issuer, issuerFormatEntity, "manage NameID response")
+	}
+	nameID, err := i.makeNameID(&model.User{Name: "joe"}, "dex", nameIDFormatPersistent)
+	if assert.NoError(t, err) {
+		assert.Equal(t, id, nameID.Value, "the IdP's identifier doesn't change")
+		assert.Equal(t, "sp-joe", nameID.SPProvidedID)
+	}
+
+	req = newTestManageNameIDRequest("unknown")
+	req.Terminate = &saml.Terminate{}
+	_, resp = sendManageNameIDSOAP(t, i, req, true)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Requester", resp.Status.StatusCode.Value)
+		assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:UnknownPrincipal", resp.Status.StatusCode.StatusCode.Value)
+	}
+
+	req = newTestManageNameIDRequest(id)
+	req.Terminate = &saml.Terminate{}
+	_, resp = sendManageNameIDSOAP(t, i, req, true)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", resp.Status.StatusCode.Value)
+	}
+	_, err = i.pairwiseIDs.User("dex", id)
+	assert.Equal(t, store.ErrNotFound, err, "the NameID should be revoked")
+	_, err = i.pairwiseIDs.SPProvidedID("dex", "joe")
+	assert.Equal(t, store.ErrNotFound, err)
+}
+
+func TestIDP_DefaultManageNameIDHandler_soapRejected(t *testing.T) {
+	i, id := getTestIDPWithManageNameID(t)
+	req := newTestManageNameIDRequest(id)
+	req.Terminate = &saml.Terminate{}
+	w, _ := sendManageNameIDSOAP(t, i, req, false)
+	assert.Equal(t, http.StatusForbidden, w.Code, "requests must be signed")
+	assert.Contains(t, w.Body.String(), "<faultcode>soap:Client</faultcode>")
+
+	req.Issuer = "https://unknown.example.com/"
+	w, _ = sendManageNameIDSOAP(t, i, req, true)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	req = newTestManageNameIDRequest(id)
+	w, _ = sendManageNameIDSOAP(t, i, req, true)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "the request doesn't have NewID or Terminate")
+
+	req = newTestManageNameIDRequest(id)
+	req.Terminate = &saml.Terminate{}
+	req.IssueInstant = time.Now().Add(-time.Hour)
+	w, _ = sendManageNameIDSOAP(t, i, req, true)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	_, err := i.pairwiseIDs.User("dex", id)
+	assert.NoError(t, err, "rejected requests shouldn't change the NameID")
+}
+
+func TestIDP_DefaultManageNameIDHandler_signedElement(t *testing.T) {
+	i, id := getTestIDPWithManageNameID(t)
+	// An AuthnRequest signed by the service provider, which a user could copy from their browser, can't vouch for
+	// a ManageNameIDRequest
+	loginReq := newTestAuthnRequest()
+	signature, err := i.signer.CreateSignature(loginReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginReq.Signature = signature
+	signed, err := xml.Marshal(loginReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := newTestManageNameIDRequest(id)
+	req.Terminate = &saml.Terminate{}
+	forged, err := xml.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"signed element only", string(signed)},
+		{"forged request after", string(signed) + string(forged)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `<S:Envelope xmlns:S="http://schemas.xmlsoap.org/soap/envelope/"><S:Body>` + tt.body + `</S:Body></S:Envelope>`
+			r := httptest.NewRequest("POST", viper.GetString("manage-nameid-service-path"), strings.NewReader(body))
+			w := httptest.NewRecorder()
+			i.Router.ServeHTTP(w, r)
+			assert.Equal(t, http.StatusBadRequest, w.Code, w.Body.String())
+		})
+	}
+	_, err = i.pairwiseIDs.User("dex", id)
+	assert.NoError(t, err, "rejected requests shouldn't change the NameID")
+}
+
+func TestIDP_DefaultManageNameIDHandler_redirect(t *testing.T) {
+	i, id := getTestIDPWithManageNameID(t)
+	newID := "sp-joe"
+	req := newTestManageNameIDRequest(id)
+	req.NewID = &newID
+	// The test service provider shares the IdP's key so its requests can be signed here
+	target, err := i.redirectURL(i.manageNameIDServiceLocation, "SAMLRequest", req, "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	i.Router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "the service provider doesn't have a redirect endpoint")
+
+	dex, _ := i.ServiceProvider("dex")
+	dex.ManageNameIDServices = []ManageNameIDService{{Binding: redirectBinding, Location: testManageNameIDLocation}}
+	w = httptest.NewRecorder()
+	i.Router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	if !assert.Equal(t, http.StatusFound, w.Code) {
+		return
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(location.String(), testManageNameIDLocation), "should redirect to the service provider")
+	assert.Equal(t, "state", location.Query().Get("RelayState"))
+	resp := &saml.ManageNameIDResponse{}
+	if err = i.decodeRedirectMessage(location.Query().Get("SAMLResponse"), resp); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", resp.Status.StatusCode.Value)
+	assert.Equal(t, testManageNameIDLocation, resp.Destination)
+	spProvided, _ := i.pairwiseIDs.SPProvidedID("dex", "joe")
+	assert.Equal(t, "sp-joe", spProvided)
+
+	w = httptest.NewRecorder()
+	i.Router.ServeHTTP(w, httptest.NewRequest("GET", target, nil))
+	assert.Equal(t, http.StatusForbidden, w.Code, "requests can't be replayed")
+
+	w = httptest.NewRecorder()
+	i.Router.ServeHTTP(w, httptest.NewRequest("GET", strings.Replace(target, "Signature=", "Signature=AA", 1), nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code, "the signature is invalid")
+}
+
+func TestIDP_Metadata_manageNameID(t *testing.T) {
+	i, _ := getTestIDPWithManageNameID(t)
+	metadata, err := i.Metadata("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed := &saml.IDPEntityDescriptor{}
+	if err = xml.Unmarshal(metadata, ed); err != nil {
+		t.Fatal(err)
+	}
+	services := ed.IDPSSODescriptor.ManageNameIDService
+	if assert.Len(t, services, 2) {
+		assert.Equal(t, soapBinding, services[0].Binding)
+		assert.Equal(t, redirectBinding, services[1].Binding)
+		assert.Equal(t, i.manageNameIDServiceLocation, services[0].Location)
+	}
+
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	metadata, _ = i.Metadata("")
+	assert.NotContains(t, string(metadata), "ManageNameIDService", "name identifier management is off by default")
+}
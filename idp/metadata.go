@@ -16,62 +16,205 @@ package idp
 
 import (
 	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/xml"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
+	"github.com/amdonov/lite-idp/dsig"
 	"github.com/amdonov/lite-idp/saml"
 	"github.com/amdonov/xmlsig"
 )
 
 // DefaultMetadataHandler is the default implementation for the metadata display handler. It can be used as is, wrapped in other handlers, or replaced completely.
 func (i *IDP) DefaultMetadataHandler() (http.HandlerFunc, error) {
-	certData := i.TLSConfig.Certificates[0].Certificate[0]
-	keyDescriptor := saml.KeyDescriptor{
-		Use: "signing",
-		KeyInfo: xmlsig.KeyInfo{
-			X509Data: &xmlsig.X509Data{
-				X509Certificate: base64.StdEncoding.EncodeToString(certData),
-			},
+	metadata, err := i.Metadata("")
+	if err != nil {
+		return nil, err
+	}
+	if i.settings.GetDuration("metadata-valid-until") > 0 {
+		// The validUntil is counted from when the metadata is served, so it's rebuilt for each request
+		return func(w http.ResponseWriter, r *http.Request) {
+			metadata, err := i.Metadata("")
+			if err != nil {
+				i.writeError(w, r, err, http.StatusInternalServerError)
+				return
+			}
+			w.Write(metadata)
+		}, nil
+	}
+
+	// return handler
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Write(metadata)
+	}, nil
+}
+
+// Metadata returns the IdP's metadata, which is signed unless sign-metadata is false. The signature's KeyInfo
+// holds the signing certificate. Elements are placed on separate lines and indented with indent
+// unless it's empty. The IDP must be configured with Handler first.
+func (i *IDP) Metadata(indent string) ([]byte, error) {
+	if i.signer == nil {
+		return nil, errors.New("IDP has not been configured")
+	}
+	certData := i.SigningCertificate.Certificate[0]
+	keyInfo := xmlsig.KeyInfo{
+		X509Data: &xmlsig.X509Data{
+			X509Certificate: base64.StdEncoding.EncodeToString(certData),
 		},
 	}
+	keyDescriptors := []saml.KeyDescriptor{{Use: "signing", KeyInfo: keyInfo}}
+	// Service providers accept signatures from any of the keys while they switch to a new one
+	for _, cert := range i.AdditionalSigningCertificates {
+		if bytes.Equal(cert.Raw, certData) {
+			continue
+		}
+		keyDescriptors = append(keyDescriptors, saml.KeyDescriptor{
+			Use: "signing",
+			KeyInfo: xmlsig.KeyInfo{
+				X509Data: &xmlsig.X509Data{
+					X509Certificate: base64.StdEncoding.EncodeToString(cert.Raw),
+				},
+			},
+		})
+	}
+	// Service providers can encrypt NameIDs in attribute queries with RSA keys
+	if _, ok := i.SigningCertificate.PrivateKey.(*rsa.PrivateKey); ok {
+		keyDescriptors = append(keyDescriptors, saml.KeyDescriptor{Use: "encryption", KeyInfo: keyInfo})
+	}
+
+	// Advertise the algorithms the IdP signs with, preferred first
+	cert, err := x509.ParseCertificate(certData)
+	if err != nil {
+		return nil, err
+	}
+	extensions := &saml.Extensions{EntityAttributes: i.entityAttributes}
+	for _, alg := range preferred(i.signer.Algorithm(), dsig.SignatureAlgorithms(cert.PublicKey)) {
+		extensions.SigningMethod = append(extensions.SigningMethod, saml.AlgorithmMethod{Algorithm: alg})
+	}
+	digest := i.settings.GetString("digest-algorithm")
+	if digest == "" {
+		digest = dsig.DigestAlgorithm(i.signer.Algorithm())
+	}
+	for _, alg := range preferred(digest, dsig.DigestAlgorithms()) {
+		extensions.DigestMethod = append(extensions.DigestMethod, saml.AlgorithmMethod{Algorithm: alg})
+	}
+
+	validUntil := i.settings.GetDuration("metadata-valid-until")
+	cacheDuration := i.settings.GetDuration("metadata-cache-duration")
+	if validUntil < 0 || cacheDuration < 0 {
+		return nil, errors.New("metadata-valid-until and metadata-cache-duration can't be negative")
+	}
 
 	// build EntityDescriptor
 	ed := &saml.IDPEntityDescriptor{
 		EntityDescriptor: saml.EntityDescriptor{
-			ID:       saml.NewID(),
-			EntityID: i.entityID,
+			ID:            saml.NewID(),
+			EntityID:      i.entityID,
+			CacheDuration: xsDuration(cacheDuration),
+			Extensions:    extensions,
 		},
 		IDPSSODescriptor: saml.IDPSSODescriptor{
 			ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
-			KeyDescriptor:              keyDescriptor,
-			WantAuthnRequestsSigned:    true,
+			KeyDescriptor:              keyDescriptors,
+			WantAuthnRequestsSigned:    i.wantAuthnRequestsSigned,
 			ArtifactResolutionService: saml.ArtifactResolutionService{
 				Service: saml.Service{
 					Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:SOAP",
 					Location: i.artifactResolutionServiceLocation,
 				},
-				Index: 1,
+				Index: artifactResolutionIndex,
 			},
-			NameIDFormat: "urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName",
-			SingleSignOnService: saml.SingleSignOnService{
-				Service: saml.Service{
-					Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect",
-					Location: i.singleSignOnServiceLocation,
+			NameIDFormat: nameIDFormats,
+			SingleSignOnService: []saml.SingleSignOnService{
+				{
+					Service: saml.Service{
+						Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect",
+						Location: i.singleSignOnServiceLocation,
+					},
+				},
+				{
+					Service: saml.Service{
+						Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST",
+						Location: i.singleSignOnServiceLocation,
+					},
+				},
+				{
+					// ECP clients post requests to the same location
+					Service: saml.Service{
+						Binding:  soapBinding,
+						Location: i.singleSignOnServiceLocation,
+					},
 				},
 			},
 		},
 		AttributeAuthorityDescriptor: saml.AttributeAuthorityDescriptor{
 			ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
-			KeyDescriptor:              keyDescriptor,
+			KeyDescriptor:              keyDescriptors,
 			AttributeService: saml.AttributeService{
 				Service: saml.Service{
 					Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:SOAP",
 					Location: i.attributeServiceLocation,
 				},
 			},
-			NameIDFormat: "urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName",
+			NameIDFormat: nameIDFormatX509,
 		},
+		Organization:  i.organization,
+		ContactPerson: i.contacts,
+	}
+	if validUntil > 0 {
+		expires := time.Now().Add(validUntil).UTC().Truncate(time.Second)
+		ed.ValidUntil = &expires
+	}
+	if i.uiInfo != nil {
+		ed.IDPSSODescriptor.Extensions = &saml.Extensions{UIInfo: i.uiInfo}
+	}
+	if i.singleLogoutServiceLocation != "" {
+		ed.IDPSSODescriptor.SingleLogoutService = []saml.SingleLogoutService{{
+			Service: saml.Service{
+				Binding:  "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect",
+				Location: i.singleLogoutServiceLocation,
+			},
+		}}
+	}
+	if i.manageNameIDServiceLocation != "" {
+		for _, binding := range []string{soapBinding, redirectBinding} {
+			ed.IDPSSODescriptor.ManageNameIDService = append(ed.IDPSSODescriptor.ManageNameIDService, saml.ManageNameIDService{
+				Service: saml.Service{
+					Binding:  binding,
+					Location: i.manageNameIDServiceLocation,
+				},
+			})
+		}
+	}
+	var b bytes.Buffer
+	b.Write([]byte(xml.Header))
+	if !i.settings.GetBool("sign-metadata") {
+		encoder := xml.NewEncoder(&b)
+		if indent != "" {
+			encoder.Indent("", indent)
+		}
+		if err = encoder.Encode(ed); err != nil {
+			return nil, err
+		}
+		if indent != "" {
+			b.WriteByte('\n')
+		}
+		return b.Bytes(), nil
+	}
+	if indent != "" {
+		data, err := dsig.MarshalIndentSigned(i.signer, ed, func(sig *dsig.Signature) { ed.Signature = sig }, "", indent)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(data)
+		b.WriteByte('\n')
+		return b.Bytes(), nil
 	}
 	sig, err := i.signer.CreateSignature(ed)
 	if err != nil {
@@ -80,17 +223,41 @@ func (i *IDP) DefaultMetadataHandler() (http.HandlerFunc, error) {
 	ed.Signature = sig
 
 	// save it into byte slice
-	var b bytes.Buffer
-	b.Write([]byte(xml.Header))
 	encoder := xml.NewEncoder(&b)
-	err = encoder.Encode(ed)
-	if err != nil {
+	if err = encoder.Encode(ed); err != nil {
 		return nil, err
 	}
-	metadata := b.Bytes()
+	return b.Bytes(), nil
+}
 
-	// return handler
-	return func(w http.ResponseWriter, r *http.Request) {
-		w.Write(metadata)
-	}, nil
+// xsDuration formats a duration as an xs:duration such as PT24H, or returns an empty string if it's 0. Fractions
+// of a second are dropped.
+func xsDuration(d time.Duration) string {
+	d = d.Truncate(time.Second)
+	if d <= 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("PT")
+	if hours := d / time.Hour; hours > 0 {
+		fmt.Fprintf(&b, "%dH", hours)
+	}
+	if minutes := d % time.Hour / time.Minute; minutes > 0 {
+		fmt.Fprintf(&b, "%dM", minutes)
+	}
+	if seconds := d % time.Minute / time.Second; seconds > 0 {
+		fmt.Fprintf(&b, "%dS", seconds)
+	}
+	return b.String()
+}
+
+// preferred moves first to the front of algorithms
+func preferred(first string, algorithms []string) []string {
+	ordered := []string{first}
+	for _, alg := range algorithms {
+		if alg != first {
+			ordered = append(ordered, alg)
+		}
+	}
+	return ordered
 }
@@ -15,8 +15,15 @@
 package idp
 
 import (
+	"crypto"
+	"encoding/xml"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -30,3 +37,120 @@ func TestIDP_DefaultMetadataHandler(t *testing.T) {
 	defer resp.Body.Close()
 	assert.Equal(t, 200, resp.StatusCode, "metadata not found")
 }
+
+func TestIDP_DefaultMetadataHandler_algorithms(t *testing.T) {
+	ts := getTestIDP(t, &IDP{})
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL + "/metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	ed := &saml.IDPEntityDescriptor{}
+	if err = xml.NewDecoder(resp.Body).Decode(ed); err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, ed.Extensions, "metadata should advertise algorithms") {
+		assert.Equal(t, dsig.RSASHA256, ed.Extensions.SigningMethod[0].Algorithm, "configured algorithm should be listed first")
+		assert.Equal(t, dsig.SHA256, ed.Extensions.DigestMethod[0].Algorithm)
+	}
+	assert.Equal(t, dsig.RSASHA256, ed.Signature.SignedInfo.SignatureMethod.Algorithm)
+}
+
+func TestIDP_Metadata(t *testing.T) {
+	i := &IDP{}
+	_, err := i.Metadata("")
+	assert.Error(t, err, "metadata requires a configured IDP")
+	getTestIDP(t, i)
+	key := i.TLSConfig.Certificates[0].PrivateKey.(crypto.Signer).Public()
+	for _, indent := range []string{"", "  "} {
+		metadata, err := i.Metadata(indent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, indent != "", strings.Contains(string(metadata), "\n  <IDPSSODescriptor"))
+		assert.NoError(t, dsig.Verify(metadata, key), "metadata signature should be valid")
+	}
+}
+
+func TestIDP_Metadata_signature(t *testing.T) {
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	metadata, err := i.Metadata("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed := &saml.IDPEntityDescriptor{}
+	if err = xml.Unmarshal(metadata, ed); err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, ed.Signature, "metadata should be signed by default") &&
+		assert.NotNil(t, ed.Signature.KeyInfo.X509Data, "the signing certificate should be in the KeyInfo") {
+		assert.NotEmpty(t, ed.Signature.KeyInfo.X509Data.X509Certificate)
+	}
+
+	viper.Set("sign-metadata", false)
+	defer viper.Set("sign-metadata", true)
+	for _, indent := range []string{"", "  "} {
+		metadata, err = i.Metadata(indent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NotContains(t, string(metadata), "Signature>", "metadata shouldn't be signed when sign-metadata is false")
+		ed = &saml.IDPEntityDescriptor{}
+		assert.NoError(t, xml.Unmarshal(metadata, ed))
+		assert.Equal(t, indent != "", strings.Contains(string(metadata), "\n  <IDPSSODescriptor"))
+	}
+}
+
+func TestIDP_Metadata_validity(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	before := time.Now().Truncate(time.Second)
+	resp, err := ts.Client().Get(ts.URL + "/metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	ed := &saml.IDPEntityDescriptor{}
+	if err = xml.NewDecoder(resp.Body).Decode(ed); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "PT24H", ed.CacheDuration)
+	if assert.NotNil(t, ed.ValidUntil, "metadata should have a validUntil by default") {
+		assert.False(t, ed.ValidUntil.Before(before.Add(168*time.Hour)), "validUntil should be counted from when the metadata is served")
+		assert.True(t, ed.ValidUntil.Before(time.Now().Add(169*time.Hour)))
+	}
+
+	viper.Set("metadata-valid-until", 0)
+	viper.Set("metadata-cache-duration", 0)
+	defer viper.Set("metadata-valid-until", "168h")
+	defer viper.Set("metadata-cache-duration", "24h")
+	metadata, err := i.Metadata("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(metadata), "validUntil")
+	assert.NotContains(t, string(metadata), "cacheDuration")
+
+	viper.Set("metadata-cache-duration", "-1h")
+	_, err = i.Metadata("")
+	assert.Error(t, err)
+}
+
+func Test_xsDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, ""},
+		{24 * time.Hour, "PT24H"},
+		{90 * time.Minute, "PT1H30M"},
+		{time.Minute + 1500*time.Millisecond, "PT1M1S"},
+		{45 * time.Second, "PT45S"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, xsDuration(tt.d), tt.d.String())
+	}
+}
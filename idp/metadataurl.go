@@ -0,0 +1,237 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/saml"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxMetadataSize limits how much metadata is read from a URL. Large federations publish aggregates of tens of megabytes.
+const maxMetadataSize = 256 << 20
+
+// MetadataURL is metadata published at a URL, usually a federation's aggregate of its members' metadata
+type MetadataURL struct {
+	URL string
+	// PEM file with the certificate that signs the metadata. It can hold several during a key rollover.
+	Certificate string
+}
+
+// metadataSource fetches metadata from a URL and holds the service providers from the last copy that was accepted
+type metadataSource struct {
+	url    string
+	keys   []crypto.PublicKey
+	client *http.Client
+	// validators of the last copy that was accepted, sent so unchanged metadata isn't downloaded again
+	etag, lastModified string
+	// guarded by the registry's mu
+	sps map[string]*ServiceProvider
+	err error
+}
+
+// configureMetadataSources reads the metadata-urls and the certificates their metadata has to be signed with
+func (i *IDP) configureMetadataSources() ([]*metadataSource, error) {
+	urls := []MetadataURL{}
+	if err := i.settings.UnmarshalKey("metadata-urls", &urls); err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: i.settings.GetDuration("metadata-url-timeout")}
+	sources := make([]*metadataSource, 0, len(urls))
+	for _, u := range urls {
+		if u.URL == "" {
+			return nil, errors.New("metadata-urls can't include an entry without a url")
+		}
+		if u.Certificate == "" {
+			return nil, fmt.Errorf("metadata-urls entry %s needs the certificate its metadata is signed with", u.URL)
+		}
+		ders, err := readCertificates(u.Certificate)
+		if err != nil {
+			return nil, fmt.Errorf("metadata-urls entry %s: %v", u.URL, err)
+		}
+		source := &metadataSource{url: u.URL, client: client}
+		for _, der := range ders {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("metadata-urls entry %s: %v", u.URL, err)
+			}
+			source.keys = append(source.keys, cert.PublicKey)
+		}
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// refresh fetches the source's metadata and replaces its service providers if it changed. The last good copy is
+// kept if the metadata can't be fetched, isn't signed with the source's certificate, has expired, or describes a
+// service provider that can't be loaded.
+func (r *registry) refresh(source *metadataSource) error {
+	sps, err := r.fetch(source)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	source.err = err
+	if err != nil || sps == nil {
+		return err
+	}
+	source.sps = sps
+	r.merge()
+	log.Infof("loaded %d service providers from %s", len(sps), source.url)
+	return nil
+}
+
+// fetch downloads and checks the source's metadata. It returns nil without an error if the metadata hasn't changed.
+func (r *registry) fetch(source *metadataSource) (map[string]*ServiceProvider, error) {
+	req, err := http.NewRequest(http.MethodGet, source.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if source.etag != "" {
+		req.Header.Set("If-None-Match", source.etag)
+	}
+	if source.lastModified != "" {
+		req.Header.Set("If-Modified-Since", source.lastModified)
+	}
+	resp, err := source.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxMetadataSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxMetadataSize {
+		return nil, fmt.Errorf("metadata is larger than %d bytes", maxMetadataSize)
+	}
+	if err = verifyMetadata(data, source.keys); err != nil {
+		return nil, err
+	}
+	sps, err := r.readAggregate(data, source.url)
+	if err != nil {
+		return nil, err
+	}
+	source.etag = resp.Header.Get("ETag")
+	source.lastModified = resp.Header.Get("Last-Modified")
+	return sps, nil
+}
+
+// verifyMetadata checks that the metadata is signed with one of the keys
+func verifyMetadata(data []byte, keys []crypto.PublicKey) error {
+	var err error
+	for _, key := range keys {
+		if err = dsig.Verify(data, key); err == nil {
+			return nil
+		}
+	}
+	if err == dsig.ErrNoSignature {
+		return errors.New("metadata isn't signed")
+	}
+	return fmt.Errorf("metadata signature is invalid: %v", err)
+}
+
+// readAggregate reads the service providers from an EntitiesDescriptor or a single EntityDescriptor. Entities that
+// aren't service providers are skipped, as are groups and entities whose validUntil has passed.
+func (r *registry) readAggregate(data []byte, source string) (map[string]*ServiceProvider, error) {
+	root, err := rootElement(data)
+	if err != nil {
+		return nil, err
+	}
+	aggregate := saml.EntitiesDescriptor{}
+	switch root {
+	case "EntitiesDescriptor":
+		err = xml.Unmarshal(data, &aggregate)
+	case "EntityDescriptor":
+		aggregate.EntityDescriptor = make([]saml.SPEntityDescriptor, 1)
+		err = xml.Unmarshal(data, &aggregate.EntityDescriptor[0])
+	default:
+		err = fmt.Errorf("metadata is a %s rather than an EntitiesDescriptor or EntityDescriptor", root)
+	}
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if aggregate.ValidUntil != nil && now.After(*aggregate.ValidUntil) {
+		return nil, fmt.Errorf("metadata expired at %s", aggregate.ValidUntil)
+	}
+	sps := map[string]*ServiceProvider{}
+	var add func(group *saml.EntitiesDescriptor) error
+	add = func(group *saml.EntitiesDescriptor) error {
+		for n := range group.EntityDescriptor {
+			entity := &group.EntityDescriptor[n]
+			if entity.SPSSODescriptor.XMLName.Local == "" || entity.EntityID == "" {
+				continue
+			}
+			if entity.ValidUntil != nil && now.After(*entity.ValidUntil) {
+				log.Debugf("skipping %s from %s, its metadata expired at %s", entity.EntityID, source, entity.ValidUntil)
+				continue
+			}
+			if _, ok := sps[entity.EntityID]; ok {
+				return fmt.Errorf("%s is described more than once", entity.EntityID)
+			}
+			sp := convertMetadata(entity)
+			sp.source = source
+			if err := r.prepare(sp); err != nil {
+				return fmt.Errorf("failed to load %s: %v", entity.EntityID, err)
+			}
+			sps[entity.EntityID] = sp
+		}
+		for n := range group.EntitiesDescriptor {
+			nested := &group.EntitiesDescriptor[n]
+			if nested.ValidUntil != nil && now.After(*nested.ValidUntil) {
+				log.Debugf("skipping %s from %s, its metadata expired at %s", nested.Name, source, nested.ValidUntil)
+				continue
+			}
+			if err := add(nested); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err = add(&aggregate); err != nil {
+		return nil, err
+	}
+	return sps, nil
+}
+
+// rootElement returns the local name of the document's root element
+func rootElement(data []byte) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return "", err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local, nil
+		}
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// metadataServer publishes metadata with an ETag and fails every request while broken is set
+type metadataServer struct {
+	mu       sync.Mutex
+	metadata []byte
+	etag     string
+	broken   bool
+	requests int
+}
+
+func (s *metadataServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if s.broken {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	if r.Header.Get("If-None-Match") == s.etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", s.etag)
+	w.Write(s.metadata)
+}
+
+func (s *metadataServer) publish(metadata []byte, etag string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metadata = metadata
+	s.etag = etag
+}
+
+// signedAggregate returns an aggregate of the testdata service provider's metadata under each entity ID, signed
+// with the IdP's test key. Entities in the expired group are past their validUntil.
+func signedAggregate(t *testing.T, validUntil time.Time, entityIDs []string, expired []string) []byte {
+	f, err := os.Open(filepath.Join("testdata", "sp-metadata.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entity := saml.SPEntityDescriptor{}
+	if err = xml.NewDecoder(f).Decode(&entity); err != nil {
+		t.Fatal(err)
+	}
+	entity.Signature = nil
+	entity.ID = ""
+	entities := func(ids []string) []saml.SPEntityDescriptor {
+		descriptors := []saml.SPEntityDescriptor{}
+		for _, id := range ids {
+			e := entity
+			e.EntityID = id
+			descriptors = append(descriptors, e)
+		}
+		return descriptors
+	}
+	past := time.Now().Add(-time.Hour).UTC()
+	aggregate := saml.EntitiesDescriptor{
+		ID:               saml.NewID(),
+		Name:             "https://federation.example.com/",
+		ValidUntil:       &validUntil,
+		EntityDescriptor: entities(entityIDs),
+		EntitiesDescriptor: []saml.EntitiesDescriptor{
+			{Name: "expired", ValidUntil: &past, EntityDescriptor: entities(expired)},
+		},
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join("testdata", "certificate.pem"), filepath.Join("testdata", "key.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := dsig.NewSigner(cert, dsig.SignerOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if aggregate.Signature, err = signer.CreateSignature(aggregate); err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(aggregate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func setMetadataURL(url string) {
+	viper.Set("metadata-urls", []MetadataURL{{URL: url, Certificate: filepath.Join("testdata", "certificate.pem")}})
+}
+
+func TestIDP_ServiceProvider_metadataURL(t *testing.T) {
+	server := &metadataServer{}
+	server.publish(signedAggregate(t, time.Now().Add(time.Hour).UTC(), []string{"wiki", "mail"}, []string{"old"}), `"1"`)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	setMetadataURL(ts.URL)
+	defer viper.Set("metadata-urls", []MetadataURL{})
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	defer i.Close()
+
+	for _, entityID := range []string{"wiki", "mail"} {
+		sp, ok := i.ServiceProvider(entityID)
+		if assert.True(t, ok, "%s from the aggregate should be registered", entityID) {
+			assert.Equal(t, "http://127.0.0.1:5556/dex/callback", sp.AssertionConsumerServices[0].Location)
+		}
+	}
+	_, ok := i.ServiceProvider("old")
+	assert.False(t, ok, "entities in an expired group should be skipped")
+
+	// Unchanged metadata isn't downloaded again
+	source := i.sps.sources[0]
+	assert.NoError(t, i.sps.refresh(source))
+	assert.Equal(t, 2, server.requests)
+	_, ok = i.ServiceProvider("wiki")
+	assert.True(t, ok)
+
+	// The last good copy is kept when the metadata can't be fetched
+	server.broken = true
+	assert.Error(t, i.sps.refresh(source))
+	_, ok = i.ServiceProvider("wiki")
+	assert.True(t, ok, "service providers should be kept when a refresh fails")
+	results := i.Check(context.Background())
+	assert.Contains(t, results, CheckResult{"metadata from " + ts.URL + " (2 loaded)", source.err})
+	assert.Error(t, source.err)
+
+	// New metadata replaces the old copy
+	server.broken = false
+	server.publish(signedAggregate(t, time.Now().Add(time.Hour).UTC(), []string{"wiki"}, nil), `"2"`)
+	assert.NoError(t, i.sps.refresh(source))
+	_, ok = i.ServiceProvider("mail")
+	assert.False(t, ok, "service providers removed from the aggregate should be removed")
+	assert.NoError(t, source.err)
+}
+
+func TestIDP_ServiceProvider_metadataURLRejected(t *testing.T) {
+	valid := signedAggregate(t, time.Now().Add(time.Hour).UTC(), []string{"wiki"}, nil)
+	tests := []struct {
+		name     string
+		metadata []byte
+	}{
+		{"tampered", bytes.Replace(valid, []byte(`entityID="wiki"`), []byte(`entityID="evil"`), 1)},
+		{"unsigned", []byte(`<EntitiesDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata"></EntitiesDescriptor>`)},
+		{"expired", signedAggregate(t, time.Now().Add(-time.Minute).UTC(), []string{"wiki"}, nil)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := &metadataServer{}
+			server.publish(tt.metadata, `"1"`)
+			ts := httptest.NewServer(server)
+			defer ts.Close()
+			setMetadataURL(ts.URL)
+			defer viper.Set("metadata-urls", []MetadataURL{})
+			i := &IDP{}
+			getTestIDP(t, i).Close()
+			defer i.Close()
+			assert.Empty(t, i.sps.sources[0].sps, "the IdP should start without the rejected metadata")
+			_, ok := i.ServiceProvider("wiki")
+			assert.False(t, ok)
+			assert.Error(t, i.sps.sources[0].err)
+		})
+	}
+}
+
+func TestIDP_configureMetadataSources(t *testing.T) {
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	defer i.Close()
+	defer viper.Set("metadata-urls", []MetadataURL{})
+	viper.Set("metadata-urls", []MetadataURL{{URL: "https://federation.example.com/metadata.xml"}})
+	_, err := i.configureMetadataSources()
+	assert.Error(t, err, "metadata can't be trusted without a certificate")
+	setMetadataURL("https://federation.example.com/metadata.xml")
+	sources, err := i.configureMetadataSources()
+	if assert.NoError(t, err) && assert.Len(t, sources, 1) {
+		assert.Len(t, sources[0].keys, 1)
+	}
+}
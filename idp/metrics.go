@@ -0,0 +1,80 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"time"
+
+	"github.com/amdonov/lite-idp/metrics"
+	"github.com/amdonov/lite-idp/model"
+)
+
+// Values of the result label on lite_idp_authentications_total
+const (
+	resultSuccess   = "success"
+	resultFailure   = "failure"
+	resultError     = "error"
+	resultThrottled = "throttled"
+)
+
+type idpMetrics struct {
+	authentications   *metrics.CounterVec
+	authnRequests     *metrics.CounterVec
+	signatureFailures *metrics.CounterVec
+	artifactResolve   *metrics.HistogramVec
+	attributeQuery    *metrics.HistogramVec
+	auditFailures     *metrics.CounterVec
+}
+
+func newIDPMetrics(r *metrics.Registry) *idpMetrics {
+	return &idpMetrics{
+		authentications: r.NewCounterVec("lite_idp_authentications_total",
+			"Authentication attempts by service provider, login method, and result.", "sp", "method", "result"),
+		authnRequests: r.NewCounterVec("lite_idp_authn_requests_total",
+			"AuthnRequests accepted by service provider and binding.", "sp", "binding"),
+		signatureFailures: r.NewCounterVec("lite_idp_signature_validation_failures_total",
+			"Messages rejected because their signature could not be validated.", "sp"),
+		artifactResolve: r.NewHistogramVec("lite_idp_artifact_resolve_duration_seconds",
+			"Time taken to resolve artifacts.", nil, "sp"),
+		attributeQuery: r.NewHistogramVec("lite_idp_attribute_query_duration_seconds",
+			"Time taken to answer attribute queries.", nil, "sp"),
+		auditFailures: r.NewCounterVec("lite_idp_audit_failures_total",
+			"Audit events that could not be written to the audit log.", "event"),
+	}
+}
+
+// spLabel limits label values to registered service providers and OpenID Connect clients so
+// unauthenticated requests can't create arbitrary series
+func (i *IDP) spLabel(entityID string) string {
+	if _, ok := i.sps.get(entityID); ok {
+		return entityID
+	}
+	if _, ok := i.oidcClients[entityID]; ok {
+		return entityID
+	}
+	return ""
+}
+
+func (i *IDP) countAuthentication(req *model.AuthnRequest, loginType LoginType, result string) {
+	sp := ""
+	if req != nil {
+		sp = i.spLabel(req.Issuer)
+	}
+	i.metrics.authentications.Inc(sp, loginType.method(), result)
+}
+
+func since(start time.Time) float64 {
+	return time.Since(start).Seconds()
+}
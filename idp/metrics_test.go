@@ -0,0 +1,70 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_metrics(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	data, err := proto.Marshal(&model.AuthnRequest{ID: "2134", Issuer: "dex"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.TempCache.Set("1234", data)
+	client := ts.Client()
+	client.CheckRedirect = func(r *http.Request, old []*http.Request) error {
+		return errors.New("no redirects allowed")
+	}
+	postLoginForm(client, i, ts.URL+"/ui/login.html", url.Values{"requestId": {"1234"}, "username": {"joe"}})
+	assert.Equal(t, float64(1), i.metrics.authentications.Value("dex", "password", resultFailure))
+
+	resp, err := client.Get(ts.URL + viper.GetString("metrics-path"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.True(t, strings.Contains(string(body),
+		`lite_idp_authentications_total{sp="dex",method="password",result="failure"} 1`), "failed login should be counted")
+}
+
+func TestIDP_metricsAddress(t *testing.T) {
+	viper.Set("metrics-address", "127.0.0.1:9090")
+	defer viper.Set("metrics-address", "")
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL + viper.GetString("metrics-path"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "metrics should not be served on the main listener")
+	assert.NotNil(t, i.MetricsHandler)
+}
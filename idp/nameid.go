@@ -0,0 +1,165 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/store"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	nameIDFormatUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+	nameIDFormatEmail       = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	nameIDFormatX509        = "urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName"
+	nameIDFormatPersistent  = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	nameIDFormatTransient   = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+)
+
+// invalidNameIDPolicyStatus tells a service provider that the IdP can't issue the NameID format it asked for
+var invalidNameIDPolicyStatus = &saml.Status{
+	StatusCode: saml.StatusCode{
+		Value: "urn:oasis:names:tc:SAML:2.0:status:Requester",
+		StatusCode: &saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:InvalidNameIDPolicy",
+		},
+	},
+}
+
+// invalidNameIDPolicyError is returned for AuthnRequests with a NameIDPolicy the IdP can't satisfy
+type invalidNameIDPolicyError struct {
+	entityID string
+	format   string
+}
+
+func (e *invalidNameIDPolicyError) Error() string {
+	return fmt.Sprintf("%s can't be sent a NameID with format %s", e.entityID, e.format)
+}
+
+// nameIDFormats are the NameID formats the IdP can issue
+var nameIDFormats = []string{nameIDFormatUnspecified, nameIDFormatX509, nameIDFormatEmail, nameIDFormatPersistent, nameIDFormatTransient}
+
+func (i *IDP) configureNameIDs() {
+	i.emailAttribute = i.settings.GetString("email-attribute")
+}
+
+// nameIDFormat chooses the format of the NameID sent to the service provider. Service providers can request
+// any format listed in their metadata, or any format the IdP supports if the metadata doesn't list any.
+// Otherwise the first listed format the IdP supports is used. An empty format means the user's own.
+func (i *IDP) nameIDFormat(sp *ServiceProvider, requested string) (string, error) {
+	if requested != "" && requested != nameIDFormatUnspecified {
+		if !containsString(nameIDFormats, requested) ||
+			(len(sp.NameIDFormats) > 0 && !containsString(sp.NameIDFormats, requested)) {
+			return "", &invalidNameIDPolicyError{sp.EntityID, requested}
+		}
+		return requested, nil
+	}
+	for _, format := range sp.NameIDFormats {
+		if format == nameIDFormatUnspecified {
+			break
+		}
+		if containsString(nameIDFormats, format) {
+			return format, nil
+		}
+	}
+	return "", nil
+}
+
+// makeNameID returns the user's NameID for the service provider in the requested format. An invalidNameIDPolicyError
+// is returned if the format can't be used. The NameID is qualified with the IdP's and the service provider's entity
+// IDs unless the service provider overrides them.
+func (i *IDP) makeNameID(user *model.User, entityID, requested string) (*saml.NameID, error) {
+	nameID := &saml.NameID{
+		Format:          user.Format,
+		NameQualifier:   i.entityID,
+		SPNameQualifier: entityID,
+		Value:           user.Name,
+	}
+	sp, ok := i.sps.get(entityID)
+	if !ok {
+		return nameID, nil
+	}
+	if sp.NameQualifier != "" {
+		nameID.NameQualifier = sp.NameQualifier
+	}
+	if sp.SPNameQualifier != "" {
+		nameID.SPNameQualifier = sp.SPNameQualifier
+	}
+	format, err := i.nameIDFormat(sp, requested)
+	if err != nil || format == "" || format == user.Format {
+		return nameID, err
+	}
+	nameID.Format = format
+	switch format {
+	case nameIDFormatEmail:
+		for _, att := range user.Attributes {
+			if att.Name == i.emailAttribute && len(att.Value) > 0 {
+				nameID.Value = att.Value[0]
+				return nameID, nil
+			}
+		}
+		log.Warnf("%s doesn't have a %s attribute for an email NameID", user.Name, i.emailAttribute)
+		return nil, &invalidNameIDPolicyError{entityID, format}
+	case nameIDFormatPersistent:
+		if nameID.Value, err = i.pairwiseIDs.Get(entityID, user.Name); err != nil {
+			return nil, err
+		}
+		// Set by the service provider with a ManageNameIDRequest
+		if nameID.SPProvidedID, err = i.pairwiseIDs.SPProvidedID(entityID, user.Name); err != nil && err != store.ErrNotFound {
+			return nil, err
+		}
+	case nameIDFormatTransient:
+		if user.TransientKey == "" {
+			user.TransientKey = newTransientKey()
+		}
+		nameID.Value = opaqueID([]byte(user.TransientKey), entityID)
+	default:
+		return nil, &invalidNameIDPolicyError{entityID, format}
+	}
+	return nameID, nil
+}
+
+// matchesNameID reports whether a NameID sent by the service provider identifies the user
+func (i *IDP) matchesNameID(nameID *saml.NameID, user *model.User, entityID string) bool {
+	if nameID == nil {
+		return false
+	}
+	if nameID.Value == user.Name {
+		return true
+	}
+	expected, err := i.makeNameID(user, entityID, nameID.Format)
+	return err == nil && expected.Value == nameID.Value
+}
+
+// opaqueID derives an identifier from the value that can't be reversed without the key
+func opaqueID(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// newTransientKey returns a random key for the transient NameIDs issued during a session
+func newTransientKey() string {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return base64.StdEncoding.EncodeToString(key)
+}
@@ -0,0 +1,207 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"net/http"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestUser() *model.User {
+	return &model.User{
+		Name:         "joe",
+		Format:       nameIDFormatUnspecified,
+		Attributes:   []*model.Attribute{{Name: "mail", Value: []string{"joe@example.com"}}},
+		SessionIndex: "session",
+		TransientKey: newTransientKey(),
+	}
+}
+
+func TestIDP_makeNameID(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.ServiceProvider("dex")
+	user := newTestUser()
+
+	nameID, err := i.makeNameID(user, "dex", "")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "joe", nameID.Value, "the user's own NameID should be sent by default")
+	}
+	nameID, err = i.makeNameID(user, "dex", nameIDFormatEmail)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "joe@example.com", nameID.Value)
+		assert.Equal(t, nameIDFormatEmail, nameID.Format)
+	}
+
+	persistent, err := i.makeNameID(user, "dex", nameIDFormatPersistent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := newTestUser()
+	again, _ := i.makeNameID(other, "dex", nameIDFormatPersistent)
+	assert.Equal(t, persistent.Value, again.Value, "persistent NameIDs should be stable across sessions")
+	assert.NotContains(t, persistent.Value, "joe")
+
+	transient, err := i.makeNameID(user, "dex", nameIDFormatTransient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ = i.makeNameID(user, "dex", nameIDFormatTransient)
+	assert.Equal(t, transient.Value, again.Value, "transient NameIDs should be stable during a session")
+	again, _ = i.makeNameID(other, "dex", nameIDFormatTransient)
+	assert.NotEqual(t, transient.Value, again.Value, "transient NameIDs should change with the session")
+
+	// The metadata limits the formats and picks the default
+	dex.NameIDFormats = []string{nameIDFormatTransient, nameIDFormatEmail}
+	nameID, _ = i.makeNameID(user, "dex", "")
+	assert.Equal(t, nameIDFormatTransient, nameID.Format)
+	_, err = i.makeNameID(user, "dex", nameIDFormatPersistent)
+	assert.IsType(t, &invalidNameIDPolicyError{}, err, "formats missing from the metadata can't be requested")
+
+	user.Attributes = nil
+	_, err = i.makeNameID(user, "dex", nameIDFormatEmail)
+	assert.Error(t, err, "users without an email address can't get an email NameID")
+}
+
+func TestIDP_makeNameID_qualifiers(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.sps.get("dex")
+	sps := []ServiceProvider{*dex, *dex}
+	sps[1].EntityID = "affiliate"
+	sps[1].NameQualifier = "https://idp.example.com/"
+	sps[1].SPNameQualifier = "https://affiliation.example.com/"
+	viper.Set("sps", sps)
+	defer viper.Set("sps", nil)
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	user := newTestUser()
+	want := map[string][2]string{
+		"dex":       {i.entityID, "dex"},
+		"affiliate": {"https://idp.example.com/", "https://affiliation.example.com/"},
+		"other":     {i.entityID, "other"},
+	}
+	for entityID, qualifiers := range want {
+		for _, format := range []string{nameIDFormatUnspecified, nameIDFormatEmail, nameIDFormatPersistent, nameIDFormatTransient} {
+			nameID, err := i.makeNameID(user, entityID, format)
+			if !assert.NoError(t, err, "%s %s", entityID, format) {
+				continue
+			}
+			assert.Equal(t, qualifiers[0], nameID.NameQualifier, "%s %s", entityID, format)
+			assert.Equal(t, qualifiers[1], nameID.SPNameQualifier, "%s %s", entityID, format)
+		}
+	}
+
+	response, err := i.makeAuthnResponse(&model.AuthnRequest{Issuer: "affiliate", NameIDFormat: nameIDFormatTransient}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(response.Assertion.Subject.NameID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(data), `NameQualifier="https://idp.example.com/"`)
+	assert.Contains(t, string(data), `SPNameQualifier="https://affiliation.example.com/"`)
+}
+
+func TestIDP_nameIDFormat_unsupported(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.ServiceProvider("dex")
+	_, err := i.nameIDFormat(dex, "urn:oasis:names:tc:SAML:2.0:nameid-format:kerberos")
+	assert.IsType(t, &invalidNameIDPolicyError{}, err)
+	dex.NameIDFormats = []string{"urn:oasis:names:tc:SAML:2.0:nameid-format:kerberos", nameIDFormatPersistent}
+	format, err := i.nameIDFormat(dex, "")
+	assert.NoError(t, err)
+	assert.Equal(t, nameIDFormatPersistent, format, "the first supported format should be the default")
+}
+
+func TestIDP_DefaultPostSSOHandler_invalidNameIDPolicy(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	dex, _ := i.ServiceProvider("dex")
+	dex.AssertionConsumerServices = append(dex.AssertionConsumerServices, AssertionConsumerService{
+		Index:    1,
+		Binding:  postBinding,
+		Location: "https://dex.example.com/acs",
+	})
+	loginReq := newTestAuthnRequest()
+	loginReq.ProtocolBinding = postBinding
+	loginReq.NameIDPolicy = &saml.NameIDPolicy{Format: "urn:oasis:names:tc:SAML:2.0:nameid-format:kerberos"}
+	w := postAuthnRequest(t, i, loginReq, true)
+	assert.Equal(t, http.StatusOK, w.Code, "expected a form posting the response")
+	doc, err := goquery.NewDocumentFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := doc.Find("input[name=SAMLResponse]").Attr("value")
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &saml.Response{}
+	if err = xml.Unmarshal(data, response); err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, response.Status.StatusCode.StatusCode) {
+		assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:InvalidNameIDPolicy", response.Status.StatusCode.StatusCode.Value)
+	}
+	assert.Nil(t, response.Assertion)
+}
+
+func TestIDP_makeAuthnResponse_invalidNameIDPolicy(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	user := newTestUser()
+	user.Attributes = nil
+	response, err := i.makeAuthnResponse(&model.AuthnRequest{Issuer: "dex", NameIDFormat: nameIDFormatEmail}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, response.Assertion)
+	assert.Equal(t, invalidNameIDPolicyStatus, response.Status)
+	if assert.NoError(t, i.signResponse(context.Background(), response, "dex")) {
+		assert.NotNil(t, response.Signature, "responses without an assertion should be signed")
+	}
+}
+
+func TestIDP_DefaultSingleLogoutHandler_transient(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	user := newTestUser()
+	user.ServiceProviders = []string{"dex"}
+	session := addTestSession(t, i, "transient", user)
+	nameID, err := i.makeNameID(user, "dex", nameIDFormatTransient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, resp := sendLogoutRequestWithNameID(t, i, "dex", nameID, session)
+	assert.Equal(t, http.StatusFound, w.Code)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", resp.Status.StatusCode.Value,
+			"the transient NameID should identify the session")
+	}
+}
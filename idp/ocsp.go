@@ -0,0 +1,283 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"time"
+
+	// Hash functions for OCSP certificate IDs
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+)
+
+// maxOCSPResponseSize limits how much of a responder's answer is read
+const maxOCSPResponseSize = 1 << 20
+
+var (
+	oidOCSPBasic = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+	// Hash algorithms of certificate IDs. Requests use SHA-1, which all responders support.
+	ocspHashes = map[string]crypto.Hash{
+		"1.3.14.3.2.26":          crypto.SHA1,
+		"2.16.840.1.101.3.4.2.1": crypto.SHA256,
+	}
+	oidSHA1 = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	// Algorithms responders sign with
+	ocspSignatureAlgorithms = map[string]x509.SignatureAlgorithm{
+		"1.2.840.113549.1.1.5":  x509.SHA1WithRSA,
+		"1.2.840.113549.1.1.11": x509.SHA256WithRSA,
+		"1.2.840.113549.1.1.12": x509.SHA384WithRSA,
+		"1.2.840.113549.1.1.13": x509.SHA512WithRSA,
+		"1.2.840.10045.4.1":     x509.ECDSAWithSHA1,
+		"1.2.840.10045.4.3.2":   x509.ECDSAWithSHA256,
+		"1.2.840.10045.4.3.3":   x509.ECDSAWithSHA384,
+		"1.2.840.10045.4.3.4":   x509.ECDSAWithSHA512,
+		"1.3.101.112":           x509.PureEd25519,
+	}
+)
+
+// The OCSP messages of RFC 6960 that the IdP sends and reads
+type ocspCertID struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	NameHash      []byte
+	KeyHash       []byte
+	SerialNumber  *big.Int
+}
+
+type ocspRequest struct {
+	TBSRequest ocspTBSRequest
+}
+
+type ocspTBSRequest struct {
+	Version     int `asn1:"explicit,tag:0,default:0,optional"`
+	RequestList []ocspSingleRequest
+}
+
+type ocspSingleRequest struct {
+	CertID ocspCertID
+}
+
+type ocspResponse struct {
+	Status        asn1.Enumerated
+	ResponseBytes ocspResponseBytes `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseBytes struct {
+	ResponseType asn1.ObjectIdentifier
+	Response     []byte
+}
+
+type ocspBasicResponse struct {
+	TBSResponseData    asn1.RawValue
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          asn1.BitString
+	Certificates       []asn1.RawValue `asn1:"explicit,tag:0,optional"`
+}
+
+type ocspResponseData struct {
+	Version     int `asn1:"optional,default:0,explicit,tag:0"`
+	ResponderID asn1.RawValue
+	ProducedAt  time.Time `asn1:"generalized"`
+	Responses   []ocspSingleResponse
+}
+
+type ocspSingleResponse struct {
+	CertID     ocspCertID
+	Good       asn1.Flag       `asn1:"tag:0,optional"`
+	Revoked    ocspRevokedInfo `asn1:"tag:1,optional"`
+	Unknown    asn1.Flag       `asn1:"tag:2,optional"`
+	ThisUpdate time.Time       `asn1:"generalized"`
+	NextUpdate time.Time       `asn1:"generalized,explicit,tag:0,optional"`
+}
+
+type ocspRevokedInfo struct {
+	RevocationTime time.Time       `asn1:"generalized"`
+	Reason         asn1.Enumerated `asn1:"explicit,tag:0,optional"`
+}
+
+// ocspStatus is a responder's answer for a certificate
+type ocspStatus struct {
+	revoked bool
+	// when the answer should be checked again, zero if the responder didn't say
+	nextUpdate time.Time
+	// the DER response, which can be stapled to the TLS handshake
+	raw []byte
+}
+
+// newOCSPCertID identifies the certificate to a responder by its issuer and serial number
+func newOCSPCertID(cert, issuer *x509.Certificate, hash crypto.Hash, algorithm asn1.ObjectIdentifier) (ocspCertID, error) {
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return ocspCertID{}, err
+	}
+	h := hash.New()
+	h.Write(issuer.RawSubject)
+	nameHash := h.Sum(nil)
+	h.Reset()
+	h.Write(publicKeyInfo.PublicKey.RightAlign())
+	return ocspCertID{
+		HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: algorithm, Parameters: asn1.NullRawValue},
+		NameHash:      nameHash,
+		KeyHash:       h.Sum(nil),
+		SerialNumber:  cert.SerialNumber,
+	}, nil
+}
+
+// fetchOCSP asks the responder whether the certificate is revoked and checks that the answer was signed by the
+// issuer or a responder the issuer delegated to. Responses that aren't current or don't know the certificate are errors.
+func fetchOCSP(ctx context.Context, client *http.Client, responder string, cert, issuer *x509.Certificate) (*ocspStatus, error) {
+	id, err := newOCSPCertID(cert, issuer, crypto.SHA1, oidSHA1)
+	if err != nil {
+		return nil, err
+	}
+	body, err := asn1.Marshal(ocspRequest{TBSRequest: ocspTBSRequest{RequestList: []ocspSingleRequest{{CertID: id}}}})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, responder, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s returned status code %d", responder, resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxOCSPResponseSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxOCSPResponseSize {
+		return nil, fmt.Errorf("OCSP response from %s is larger than %d bytes", responder, maxOCSPResponseSize)
+	}
+	status, err := parseOCSPResponse(data, cert, issuer, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCSP response from %s: %v", responder, err)
+	}
+	return status, nil
+}
+
+// parseOCSPResponse reads the status of the certificate from a DER OCSP response
+func parseOCSPResponse(data []byte, cert, issuer *x509.Certificate, now time.Time) (*ocspStatus, error) {
+	var resp ocspResponse
+	if rest, err := asn1.Unmarshal(data, &resp); err != nil {
+		return nil, err
+	} else if len(rest) > 0 {
+		return nil, errors.New("trailing data after the response")
+	}
+	if resp.Status != 0 {
+		return nil, fmt.Errorf("responder returned error status %d", resp.Status)
+	}
+	if !resp.ResponseBytes.ResponseType.Equal(oidOCSPBasic) {
+		return nil, errors.New("response is not a basic OCSP response")
+	}
+	var basic ocspBasicResponse
+	if _, err := asn1.Unmarshal(resp.ResponseBytes.Response, &basic); err != nil {
+		return nil, err
+	}
+	var tbs ocspResponseData
+	if _, err := asn1.Unmarshal(basic.TBSResponseData.FullBytes, &tbs); err != nil {
+		return nil, err
+	}
+	signer, err := ocspSigner(basic, issuer)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, ok := ocspSignatureAlgorithms[basic.SignatureAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signature algorithm %s", basic.SignatureAlgorithm.Algorithm)
+	}
+	if err = signer.CheckSignature(algorithm, basic.TBSResponseData.FullBytes, basic.Signature.RightAlign()); err != nil {
+		return nil, fmt.Errorf("bad signature: %v", err)
+	}
+	for _, single := range tbs.Responses {
+		if !matchesOCSPCertID(single.CertID, cert, issuer) {
+			continue
+		}
+		if single.ThisUpdate.After(now.Add(time.Minute)) {
+			return nil, errors.New("response is not yet valid")
+		}
+		if !single.NextUpdate.IsZero() && single.NextUpdate.Before(now) {
+			return nil, errors.New("response has expired")
+		}
+		switch {
+		case bool(single.Good):
+			return &ocspStatus{nextUpdate: single.NextUpdate, raw: data}, nil
+		case bool(single.Unknown):
+			return nil, errors.New("responder doesn't know the certificate")
+		}
+		return &ocspStatus{revoked: true, nextUpdate: single.NextUpdate, raw: data}, nil
+	}
+	return nil, errors.New("response doesn't include the certificate")
+}
+
+// ocspSigner returns the certificate that signed the response: the issuer, or a responder certificate issued by it
+// for OCSP signing
+func ocspSigner(basic ocspBasicResponse, issuer *x509.Certificate) (*x509.Certificate, error) {
+	if len(basic.Certificates) == 0 {
+		return issuer, nil
+	}
+	responder, err := x509.ParseCertificate(basic.Certificates[0].FullBytes)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(responder.Raw, issuer.Raw) {
+		return issuer, nil
+	}
+	if err = responder.CheckSignatureFrom(issuer); err != nil {
+		return nil, fmt.Errorf("responder certificate wasn't issued by the certificate's issuer: %v", err)
+	}
+	for _, usage := range responder.ExtKeyUsage {
+		if usage == x509.ExtKeyUsageOCSPSigning {
+			return responder, nil
+		}
+	}
+	return nil, errors.New("responder certificate isn't authorized to sign OCSP responses")
+}
+
+// matchesOCSPCertID reports whether the certificate ID identifies the certificate
+func matchesOCSPCertID(id ocspCertID, cert, issuer *x509.Certificate) bool {
+	if id.SerialNumber == nil || id.SerialNumber.Cmp(cert.SerialNumber) != 0 {
+		return false
+	}
+	hash, ok := ocspHashes[id.HashAlgorithm.Algorithm.String()]
+	if !ok {
+		return false
+	}
+	expected, err := newOCSPCertID(cert, issuer, hash, id.HashAlgorithm.Algorithm)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(id.NameHash, expected.NameHash) && bytes.Equal(id.KeyHash, expected.KeyHash)
+}
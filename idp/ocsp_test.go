@@ -0,0 +1,168 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// createOCSPResponse returns a successful basic OCSP response with the single response, signed with the key. The
+// signer's certificate is included unless it's the issuer.
+func createOCSPResponse(t *testing.T, single ocspSingleResponse, signer *x509.Certificate, key crypto.Signer) []byte {
+	keyHash := single.CertID.KeyHash
+	responderID, err := asn1.Marshal(keyHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbs, err := asn1.Marshal(ocspResponseData{
+		ResponderID: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 2, IsCompound: true, Bytes: responderID},
+		ProducedAt:  time.Now().UTC().Truncate(time.Second),
+		Responses:   []ocspSingleResponse{single},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := crypto.SHA256.New()
+	h.Write(tbs)
+	signature, err := key.Sign(rand.Reader, h.Sum(nil), crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	basic := ocspBasicResponse{
+		TBSResponseData:    asn1.RawValue{FullBytes: tbs},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}},
+		Signature:          asn1.BitString{Bytes: signature, BitLength: 8 * len(signature)},
+	}
+	if !signer.IsCA {
+		basic.Certificates = []asn1.RawValue{{FullBytes: signer.Raw}}
+	}
+	response, err := asn1.Marshal(basic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := asn1.Marshal(ocspResponse{ResponseBytes: ocspResponseBytes{ResponseType: oidOCSPBasic, Response: response}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func Test_parseOCSPResponse(t *testing.T) {
+	p := newTestPKI(t)
+	defer p.Close()
+	cert := p.issue(1)
+	id, err := newOCSPCertID(cert, p.ca, crypto.SHA1, oidSHA1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC().Truncate(time.Second)
+	good := ocspSingleResponse{CertID: id, Good: true, ThisUpdate: now.Add(-time.Minute), NextUpdate: now.Add(time.Hour)}
+	delegated, delegatedKey := newTestCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "OCSP responder"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+	}, p.ca, p.caKey)
+	undelegated, undelegatedKey := newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "Server"}}, p.ca, p.caKey)
+	other := newTestPKI(t)
+	defer other.Close()
+
+	status, err := parseOCSPResponse(createOCSPResponse(t, good, p.ca, p.caKey), cert, p.ca, now)
+	if assert.NoError(t, err) {
+		assert.False(t, status.revoked)
+		assert.Equal(t, now.Add(time.Hour), status.nextUpdate)
+		assert.NotEmpty(t, status.raw)
+	}
+	status, err = parseOCSPResponse(createOCSPResponse(t, good, delegated, delegatedKey), cert, p.ca, now)
+	if assert.NoError(t, err, "the CA can delegate to a responder") {
+		assert.False(t, status.revoked)
+	}
+	revoked := good
+	revoked.Good = false
+	revoked.Revoked = ocspRevokedInfo{RevocationTime: now.Add(-time.Hour)}
+	status, err = parseOCSPResponse(createOCSPResponse(t, revoked, p.ca, p.caKey), cert, p.ca, now)
+	if assert.NoError(t, err) {
+		assert.True(t, status.revoked)
+	}
+
+	unknown := good
+	unknown.Good, unknown.Unknown = false, true
+	expired := good
+	expired.NextUpdate = now.Add(-time.Minute)
+	otherSerial := good
+	otherSerial.CertID.SerialNumber = big.NewInt(2)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"unknown", createOCSPResponse(t, unknown, p.ca, p.caKey)},
+		{"expired", createOCSPResponse(t, expired, p.ca, p.caKey)},
+		{"other certificate", createOCSPResponse(t, otherSerial, p.ca, p.caKey)},
+		{"other CA", createOCSPResponse(t, good, other.ca, other.caKey)},
+		{"responder without OCSP signing", createOCSPResponse(t, good, undelegated, undelegatedKey)},
+		{"error status", []byte{0x30, 0x03, 0x0a, 0x01, 0x01}},
+		{"garbage", []byte("not DER")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseOCSPResponse(tt.data, cert, p.ca, now)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func Test_stapleOCSPResponse(t *testing.T) {
+	p := newTestPKI(t)
+	defer p.Close()
+	leaf := p.issue(1)
+	cert := &tls.Certificate{Certificate: [][]byte{leaf.Raw, p.ca.Raw}}
+	stapleOCSPResponse(cert, time.Second)
+	if assert.NotEmpty(t, cert.OCSPStaple) {
+		status, err := parseOCSPResponse(cert.OCSPStaple, leaf, p.ca, time.Now())
+		assert.NoError(t, err)
+		assert.False(t, status.revoked)
+	}
+
+	p.revoke(2)
+	cert = &tls.Certificate{Certificate: [][]byte{p.issue(2).Raw, p.ca.Raw}}
+	stapleOCSPResponse(cert, time.Second)
+	assert.Empty(t, cert.OCSPStaple, "a revoked status shouldn't be stapled")
+	cert = &tls.Certificate{Certificate: [][]byte{leaf.Raw}}
+	stapleOCSPResponse(cert, time.Second)
+	assert.Empty(t, cert.OCSPStaple, "the issuer is needed to ask for the status")
+}
+
+func Test_fetchOCSP(t *testing.T) {
+	p := newTestPKI(t)
+	defer p.Close()
+	cert := p.issue(1)
+	req := httptest.NewRequest("GET", "/", nil)
+	status, err := fetchOCSP(req.Context(), http.DefaultClient, p.server.URL+"/ocsp", cert, p.ca)
+	if assert.NoError(t, err) {
+		assert.False(t, status.revoked)
+	}
+	_, err = fetchOCSP(req.Context(), http.DefaultClient, p.server.URL+"/missing", cert, p.ca)
+	assert.Error(t, err)
+}
@@ -0,0 +1,503 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// oidcBinding marks saved requests from OpenID Connect clients, which are answered with an authorization code
+const oidcBinding = "urn:lite-idp:bindings:OIDC"
+
+// oidcDiscoveryPath is fixed by OpenID Connect Discovery relative to the issuer
+const oidcDiscoveryPath = "/.well-known/openid-configuration"
+
+// reservedClaims can't be set from user attributes
+var reservedClaims = map[string]bool{
+	"iss": true, "sub": true, "aud": true, "exp": true, "iat": true, "nbf": true,
+	"nonce": true, "acr": true, "azp": true, "jti": true, "scope": true, "client_id": true,
+}
+
+// errInvalidClient is returned by the token endpoint when client authentication fails
+var errInvalidClient = errors.New("client authentication failed")
+
+// OIDCClient is a relying party allowed to use the OpenID Connect endpoints
+type OIDCClient struct {
+	ClientID string
+	// Name shown on the login page
+	Name string
+	// bcrypt hash of the client secret. Public clients don't have one and must use PKCE.
+	ClientSecret string
+	// Authorization responses are only sent to these URIs, which must match exactly
+	RedirectURIs []string
+	// Attributes that may be released to the client as claims, attribute-release-default applies if it isn't set
+	ReleaseAttributes []AttributeRelease
+	releasePolicy     *releasePolicy
+}
+
+// oidcRequest holds the parameters of an authorization request that aren't kept with the saved AuthnRequest
+type oidcRequest struct {
+	Nonce         string
+	CodeChallenge string
+	Scope         string
+}
+
+// oidcGrant is saved with an authorization code until the client redeems it
+type oidcGrant struct {
+	ClientID      string
+	RedirectURI   string
+	Nonce         string
+	CodeChallenge string
+	Scope         string
+	// protobuf encoded model.User
+	User []byte
+}
+
+// oidcConfiguration is the OpenID Provider metadata served for discovery
+type oidcConfiguration struct {
+	Issuer                            string   `json:"issuer"`
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	JWKSURI                           string   `json:"jwks_uri"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	SubjectTypesSupported             []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported  []string `json:"id_token_signing_alg_values_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
+
+func (i *IDP) configureOIDC() error {
+	i.oidcEnabled = i.settings.GetBool("oidc.enabled")
+	i.oidcClients = map[string]*OIDCClient{}
+	if !i.oidcEnabled {
+		return nil
+	}
+	clients := []*OIDCClient{}
+	if err := i.settings.UnmarshalKey("oidc.clients", &clients); err != nil {
+		return err
+	}
+	for _, client := range clients {
+		if client.ClientID == "" {
+			return errors.New("oidc.clients entries must have a clientid")
+		}
+		if len(client.RedirectURIs) == 0 {
+			return fmt.Errorf("OIDC client %s has no redirecturis", client.ClientID)
+		}
+		policy, err := newReleasePolicy(client.ReleaseAttributes)
+		if err != nil {
+			return fmt.Errorf("OIDC client %s: %v", client.ClientID, err)
+		}
+		client.releasePolicy = policy
+		i.oidcClients[client.ClientID] = client
+	}
+	i.oidcTokenLifetime = i.settings.GetDuration("oidc.token-lifetime")
+	if i.oidcTokenLifetime <= 0 {
+		return errors.New("oidc.token-lifetime must be a positive duration")
+	}
+	// Attribute names are case-insensitive like the keys viper returns
+	i.oidcClaimMap = map[string]string{}
+	for attribute, claim := range i.settings.GetStringMapString("oidc.claim-map") {
+		i.oidcClaimMap[strings.ToLower(attribute)] = claim
+	}
+	signer, err := newJWTSigner(i.SigningCertificate)
+	if err != nil {
+		return err
+	}
+	i.jwtSigner = signer
+	return nil
+}
+
+// oidcIssuer identifies the IdP in tokens. Discovery requires it to be a URL without a path.
+func (i *IDP) oidcIssuer() string {
+	return "https://" + i.serverName + i.basePath
+}
+
+// DefaultOIDCConfigurationHandler is the default implementation for the OpenID Connect discovery handler. It can be used
+// as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultOIDCConfigurationHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		issuer := i.oidcIssuer()
+		writeJSON(w, http.StatusOK, oidcConfiguration{
+			Issuer:                            issuer,
+			AuthorizationEndpoint:             issuer + i.settings.GetString("oidc.authorization-path"),
+			TokenEndpoint:                     issuer + i.settings.GetString("oidc.token-path"),
+			JWKSURI:                           issuer + i.settings.GetString("oidc.jwks-path"),
+			ResponseTypesSupported:            []string{"code"},
+			GrantTypesSupported:               []string{"authorization_code"},
+			SubjectTypesSupported:             []string{"public"},
+			IDTokenSigningAlgValuesSupported:  []string{i.jwtSigner.alg},
+			ScopesSupported:                   []string{"openid"},
+			TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+			CodeChallengeMethodsSupported:     []string{"S256"},
+		})
+	}
+}
+
+// DefaultOIDCKeysHandler is the default implementation for the JWKS handler. It publishes the public half of the
+// signing key. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultOIDCKeysHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, i.jwtSigner.keySet())
+	}
+}
+
+// DefaultOIDCAuthorizationHandler is the default implementation for the OpenID Connect authorization handler. Users
+// are authenticated the same way as for SAML requests and sent back to the client with an authorization code. It can
+// be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultOIDCAuthorizationHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			if err := r.ParseForm(); err != nil {
+				return err
+			}
+			clientID := r.Form.Get("client_id")
+			redirectURI := r.Form.Get("redirect_uri")
+			client, ok := i.oidcClients[clientID]
+			// Errors can only be returned to redirect URIs registered for the client
+			if !ok || !containsString(client.RedirectURIs, redirectURI) {
+				i.writeError(w, r, fmt.Errorf("rejecting authorization request from %s for client %q with redirect URI %q",
+					getIP(r), clientID, redirectURI), http.StatusBadRequest)
+				return nil
+			}
+			state := r.Form.Get("state")
+			challenge := r.Form.Get("code_challenge")
+			switch {
+			case r.Form.Get("response_type") != "code":
+				return redirectAuthorizationError(w, r, redirectURI, state, "unsupported_response_type", "only the code response type is supported")
+			case !containsString(strings.Fields(r.Form.Get("scope")), "openid"):
+				return redirectAuthorizationError(w, r, redirectURI, state, "invalid_scope", "the openid scope is required")
+			case challenge != "" && r.Form.Get("code_challenge_method") != "S256":
+				return redirectAuthorizationError(w, r, redirectURI, state, "invalid_request", "code_challenge_method must be S256")
+			case challenge == "" && client.ClientSecret == "":
+				return redirectAuthorizationError(w, r, redirectURI, state, "invalid_request", "public clients must use PKCE")
+			}
+			recordServiceProvider(r, clientID)
+			recordBinding(r, "OIDC")
+			i.metrics.authnRequests.Inc(clientID, "OIDC")
+			params, err := json.Marshal(oidcRequest{
+				Nonce:         r.Form.Get("nonce"),
+				CodeChallenge: challenge,
+				Scope:         r.Form.Get("scope"),
+			})
+			if err != nil {
+				return err
+			}
+			req := &model.AuthnRequest{
+				ID:                          saml.NewID(),
+				IssueInstant:                ptypes.TimestampNow(),
+				Issuer:                      clientID,
+				AssertionConsumerServiceURL: redirectURI,
+				ProtocolBinding:             oidcBinding,
+				RequestBinding:              oidcBinding,
+				RelayState:                  state,
+				CorrelationID:               uuid.New().String(),
+			}
+			if err = tracedSet(r.Context(), "temp", i.TempCache, oidcRequestKey(req.ID), params); err != nil {
+				return err
+			}
+			return i.authenticate(req, w, r)
+		}()
+		if err != nil {
+			i.writeError(w, r, err, http.StatusInternalServerError)
+		}
+	}
+}
+
+// redirectAuthorizationError returns an error to the client's redirect URI as described in RFC 6749 section 4.1.2.1
+func redirectAuthorizationError(w http.ResponseWriter, r *http.Request, redirectURI, state, code, description string) error {
+	params := url.Values{"error": {code}, "error_description": {description}}
+	if state != "" {
+		params.Set("state", state)
+	}
+	return redirectWithParams(w, r, redirectURI, params)
+}
+
+func redirectWithParams(w http.ResponseWriter, r *http.Request, redirectURI string, params url.Values) error {
+	target, err := url.Parse(redirectURI)
+	if err != nil {
+		return err
+	}
+	query := target.Query()
+	for name, values := range params {
+		query[name] = values
+	}
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.String(), http.StatusFound)
+	return nil
+}
+
+// sendAuthorizationCode returns an authenticated user to the OpenID Connect client with a code it can exchange for tokens
+func (i *IDP) sendAuthorizationCode(authRequest *model.AuthnRequest, user *model.User,
+	w http.ResponseWriter, r *http.Request) error {
+	key := oidcRequestKey(authRequest.ID)
+	data, err := i.TempCache.Get(key)
+	if err != nil {
+		return err
+	}
+	params := oidcRequest{}
+	if err = json.Unmarshal(data, &params); err != nil {
+		return err
+	}
+	if err = i.TempCache.Delete(key); err != nil {
+		return err
+	}
+	userData, err := proto.Marshal(user)
+	if err != nil {
+		return err
+	}
+	grant, err := json.Marshal(oidcGrant{
+		ClientID:      authRequest.Issuer,
+		RedirectURI:   authRequest.AssertionConsumerServiceURL,
+		Nonce:         params.Nonce,
+		CodeChallenge: params.CodeChallenge,
+		Scope:         params.Scope,
+		User:          userData,
+	})
+	if err != nil {
+		return err
+	}
+	random := make([]byte, 32)
+	if _, err = rand.Read(random); err != nil {
+		return err
+	}
+	code := base64.RawURLEncoding.EncodeToString(random)
+	if err = tracedSet(r.Context(), "temp", i.TempCache, oidcCodeKey(code), grant); err != nil {
+		return err
+	}
+	response := url.Values{"code": {code}}
+	if authRequest.RelayState != "" {
+		response.Set("state", authRequest.RelayState)
+	}
+	return redirectWithParams(w, r, authRequest.AssertionConsumerServiceURL, response)
+}
+
+// DefaultOIDCTokenHandler is the default implementation for the OpenID Connect token handler. It exchanges
+// authorization codes for a signed ID token and access token. It can be used as is, wrapped in other handlers, or
+// replaced completely.
+func (i *IDP) DefaultOIDCTokenHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			writeTokenError(w, http.StatusBadRequest, "invalid_request", err.Error())
+			return
+		}
+		client, err := i.authenticateClient(r)
+		if err != nil {
+			log.Warnf("rejecting token request from %s: %v", getIP(r), err)
+			if _, _, ok := r.BasicAuth(); ok {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", i.oidcIssuer()))
+			}
+			writeTokenError(w, http.StatusUnauthorized, "invalid_client", err.Error())
+			return
+		}
+		if r.Form.Get("grant_type") != "authorization_code" {
+			writeTokenError(w, http.StatusBadRequest, "unsupported_grant_type", "only the authorization_code grant is supported")
+			return
+		}
+		grant, err := i.redeemCode(r.Form.Get("code"))
+		if err != nil {
+			log.Warnf("rejecting authorization code from %s: %v", client.ClientID, err)
+			writeTokenError(w, http.StatusBadRequest, "invalid_grant", "the authorization code is invalid or expired")
+			return
+		}
+		if err = checkGrant(grant, client, r.Form.Get("redirect_uri"), r.Form.Get("code_verifier")); err != nil {
+			log.Warnf("rejecting authorization code from %s: %v", client.ClientID, err)
+			writeTokenError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+			return
+		}
+		response, err := i.issueTokens(grant)
+		if err != nil {
+			log.Error(err)
+			writeTokenError(w, http.StatusInternalServerError, "server_error", err.Error())
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Pragma", "no-cache")
+		writeJSON(w, http.StatusOK, response)
+	}
+}
+
+// authenticateClient checks the client's secret from HTTP Basic credentials or the form. Public clients don't have a secret.
+func (i *IDP) authenticateClient(r *http.Request) (*OIDCClient, error) {
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		// Basic credentials are form encoded before they're combined
+		var err error
+		if clientID, err = url.QueryUnescape(clientID); err != nil {
+			return nil, errInvalidClient
+		}
+		if secret, err = url.QueryUnescape(secret); err != nil {
+			return nil, errInvalidClient
+		}
+	} else {
+		clientID, secret = r.Form.Get("client_id"), r.Form.Get("client_secret")
+	}
+	client, ok := i.oidcClients[clientID]
+	if !ok {
+		return nil, errInvalidClient
+	}
+	if client.ClientSecret == "" {
+		return client, nil
+	}
+	if bcrypt.CompareHashAndPassword([]byte(client.ClientSecret), []byte(secret)) != nil {
+		return nil, errInvalidClient
+	}
+	return client, nil
+}
+
+// redeemCode returns the grant saved with the code. Codes can only be used once.
+func (i *IDP) redeemCode(code string) (*oidcGrant, error) {
+	if code == "" {
+		return nil, errors.New("missing code")
+	}
+	// Codes can only be redeemed once, even by concurrent token requests
+	data, err := store.Take(i.TempCache, oidcCodeKey(code))
+	if err != nil {
+		return nil, err
+	}
+	grant := &oidcGrant{}
+	if err = json.Unmarshal(data, grant); err != nil {
+		return nil, err
+	}
+	return grant, nil
+}
+
+// checkGrant makes sure the code is redeemed by the client it was issued to with the same redirect URI and PKCE verifier
+func checkGrant(grant *oidcGrant, client *OIDCClient, redirectURI, verifier string) error {
+	if grant.ClientID != client.ClientID {
+		return errors.New("the code was issued to another client")
+	}
+	if grant.RedirectURI != redirectURI {
+		return errors.New("redirect_uri doesn't match the authorization request")
+	}
+	if grant.CodeChallenge != "" {
+		sum := sha256.Sum256([]byte(verifier))
+		if !hmac.Equal([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(grant.CodeChallenge)) {
+			return errors.New("code_verifier doesn't match the code_challenge")
+		}
+	}
+	return nil
+}
+
+// issueTokens signs an ID token with the user's attributes as claims and an access token for the client
+func (i *IDP) issueTokens(grant *oidcGrant) (map[string]interface{}, error) {
+	user := &model.User{}
+	if err := proto.Unmarshal(grant.User, user); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	claims := i.userClaims(user, grant.ClientID)
+	claims["iss"] = i.oidcIssuer()
+	claims["sub"] = user.Name
+	claims["aud"] = grant.ClientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(i.oidcTokenLifetime).Unix()
+	if user.Context != "" {
+		claims["acr"] = user.Context
+	}
+	if grant.Nonce != "" {
+		claims["nonce"] = grant.Nonce
+	}
+	idToken, err := i.jwtSigner.sign(claims)
+	if err != nil {
+		return nil, err
+	}
+	accessToken, err := i.jwtSigner.sign(map[string]interface{}{
+		"iss":       i.oidcIssuer(),
+		"sub":       user.Name,
+		"aud":       grant.ClientID,
+		"client_id": grant.ClientID,
+		"scope":     grant.Scope,
+		"iat":       now.Unix(),
+		"exp":       now.Add(i.oidcTokenLifetime).Unix(),
+		"jti":       saml.NewID(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   int64(i.oidcTokenLifetime / time.Second),
+		"id_token":     idToken,
+		"scope":        grant.Scope,
+	}, nil
+}
+
+// userClaims converts the attributes that may be released to the client to claims, renaming them with oidc.claim-map
+// if it's set. Attributes with one value become strings and the rest become arrays.
+func (i *IDP) userClaims(user *model.User, clientID string) map[string]interface{} {
+	claims := map[string]interface{}{}
+	for _, att := range i.releasedAttributes(user, clientID) {
+		name := att.Name
+		if len(i.oidcClaimMap) > 0 {
+			name = i.oidcClaimMap[strings.ToLower(att.Name)]
+		}
+		if name == "" || reservedClaims[name] || len(att.Value) == 0 {
+			continue
+		}
+		if len(att.Value) == 1 {
+			claims[name] = att.Value[0]
+		} else {
+			claims[name] = att.Value
+		}
+	}
+	return claims
+}
+
+func writeTokenError(w http.ResponseWriter, status int, code, description string) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, map[string]string{"error": code, "error_description": description})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func oidcRequestKey(id string) string {
+	return "oidc-request:" + id
+}
+
+func oidcCodeKey(code string) string {
+	return "oidc-code:" + code
+}
@@ -0,0 +1,337 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const testRedirectURI = "https://app.example.com/callback"
+
+// getTestOIDCIDP returns an IdP with a public and a confidential client and an HTTP client that doesn't follow redirects
+func getTestOIDCIDP(t *testing.T) (*IDP, *httptest.Server, *http.Client) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("oidc.enabled", true)
+	viper.Set("oidc.clients", []map[string]interface{}{
+		{"clientid": "app", "name": "App", "redirecturis": []string{testRedirectURI}},
+		{"clientid": "svc", "clientsecret": string(hash), "redirecturis": []string{testRedirectURI}},
+	})
+	defer viper.Set("oidc.enabled", false)
+	defer viper.Set("oidc.clients", nil)
+	i := &IDP{PasswordValidator: acceptingValidator{}}
+	ts := getTestIDP(t, i)
+	client := ts.Client()
+	client.CheckRedirect = func(r *http.Request, old []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return i, ts, client
+}
+
+// authorize logs joe in through the authorization endpoint and returns the redirect to the client
+func authorize(t *testing.T, i *IDP, client *http.Client, base string, params url.Values) *url.URL {
+	resp, err := client.Get(base + "/oidc/authorize?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if location.Path != "/ui/login.html" {
+		return location
+	}
+	resp, err = postLoginForm(client, i, base+"/ui/login.html", url.Values{
+		"requestId": {location.Query().Get("requestId")},
+		"username":  {"joe"},
+		"password":  {"password"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err = url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func postTokenRequest(t *testing.T, client *http.Client, base string, form url.Values) (int, map[string]interface{}) {
+	resp, err := client.PostForm(base+"/oidc/token", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := map[string]interface{}{}
+	if err = json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestIDP_DefaultOIDCConfigurationHandler(t *testing.T) {
+	_, ts, client := getTestOIDCIDP(t)
+	defer ts.Close()
+	base := ts.URL
+	resp, err := client.Get(base + "/.well-known/openid-configuration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	config := oidcConfiguration{}
+	if err = json.NewDecoder(resp.Body).Decode(&config); err != nil {
+		t.Fatal(err)
+	}
+	issuer := "https://" + viper.GetString("server-name")
+	assert.Equal(t, issuer, config.Issuer)
+	assert.Equal(t, issuer+"/oidc/authorize", config.AuthorizationEndpoint)
+	assert.Equal(t, issuer+"/oidc/token", config.TokenEndpoint)
+	assert.Equal(t, []string{"RS256"}, config.IDTokenSigningAlgValuesSupported)
+
+	resp, err = client.Get(base + "/oidc/jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	keys := jsonWebKeySet{}
+	if err = json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, keys.Keys, 1)
+}
+
+func TestIDP_OIDCCodeFlow(t *testing.T) {
+	i, ts, client := getTestOIDCIDP(t)
+	defer ts.Close()
+	base := ts.URL
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	sum := sha256.Sum256([]byte(verifier))
+	location := authorize(t, i, client, base, url.Values{
+		"client_id":             {"app"},
+		"redirect_uri":          {testRedirectURI},
+		"response_type":         {"code"},
+		"scope":                 {"openid"},
+		"state":                 {"xyz"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	})
+	assert.Equal(t, "app.example.com", location.Host)
+	assert.Equal(t, "xyz", location.Query().Get("state"))
+	code := location.Query().Get("code")
+	if code == "" {
+		t.Fatalf("expected a code in %s", location)
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"client_id":     {"app"},
+		"code_verifier": {"wrong"},
+	}
+	status, body := postTokenRequest(t, client, base, form)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "invalid_grant", body["error"], "the verifier must match the challenge")
+
+	// Failed redemptions use up the code too, so start over
+	location = authorize(t, i, client, base, url.Values{
+		"client_id":             {"app"},
+		"redirect_uri":          {testRedirectURI},
+		"response_type":         {"code"},
+		"scope":                 {"openid"},
+		"nonce":                 {"n-0S6_WzA2Mj"},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(sum[:])},
+		"code_challenge_method": {"S256"},
+	})
+	form.Set("code", location.Query().Get("code"))
+	form.Set("code_verifier", verifier)
+	status, body = postTokenRequest(t, client, base, form)
+	if !assert.Equal(t, http.StatusOK, status, body) {
+		return
+	}
+	assert.Equal(t, "Bearer", body["token_type"])
+	leaf, err := x509.ParseCertificate(i.SigningCertificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, claims := verifyJWT(t, body["id_token"].(string), leaf)
+	assert.Equal(t, "joe", claims["sub"])
+	assert.Equal(t, "app", claims["aud"])
+	assert.Equal(t, "n-0S6_WzA2Mj", claims["nonce"])
+	assert.Equal(t, authnContextPasswordProtectedTransport, claims["acr"])
+	assert.Equal(t, i.oidcIssuer(), claims["iss"])
+
+	status, body = postTokenRequest(t, client, base, form)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, "invalid_grant", body["error"], "codes can only be used once")
+}
+
+// slowReadCache is a cache whose reads are slow, so concurrent callers that read an entry before deleting or
+// replacing it both find it. Take and Add are passed through.
+type slowReadCache struct {
+	store.Cache
+}
+
+func (c slowReadCache) Get(key string) ([]byte, error) {
+	entry, err := c.Cache.Get(key)
+	time.Sleep(20 * time.Millisecond)
+	return entry, err
+}
+
+func (c slowReadCache) Take(key string) ([]byte, error) {
+	return c.Cache.(store.Taker).Take(key)
+}
+
+func (c slowReadCache) Add(key string, entry []byte) (bool, error) {
+	return c.Cache.(store.Adder).Add(key, entry)
+}
+
+func TestIDP_redeemCode_concurrent(t *testing.T) {
+	i, ts, _ := getTestOIDCIDP(t)
+	defer ts.Close()
+	i.TempCache = slowReadCache{i.TempCache}
+	data, err := json.Marshal(&oidcGrant{ClientID: "app", RedirectURI: testRedirectURI})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = i.TempCache.Set(oidcCodeKey("code"), data); err != nil {
+		t.Fatal(err)
+	}
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		redeemed int
+	)
+	start := make(chan struct{})
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if grant, err := i.redeemCode("code"); err == nil {
+				assert.Equal(t, "app", grant.ClientID)
+				mu.Lock()
+				redeemed++
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	assert.Equal(t, 1, redeemed, "concurrent token requests shouldn't both redeem a code")
+	_, err = i.redeemCode("code")
+	assert.Error(t, err, "a second redemption of the code should fail")
+}
+
+func TestIDP_DefaultOIDCAuthorizationHandler_errors(t *testing.T) {
+	i, ts, client := getTestOIDCIDP(t)
+	defer ts.Close()
+	base := ts.URL
+	params := url.Values{
+		"client_id":     {"app"},
+		"redirect_uri":  {"https://evil.example.com/callback"},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+	}
+	resp, err := client.Get(base + "/oidc/authorize?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "unregistered redirect URIs shouldn't be redirected to")
+
+	params.Set("redirect_uri", testRedirectURI)
+	location := authorize(t, i, client, base, params)
+	assert.Equal(t, "invalid_request", location.Query().Get("error"), "public clients must use PKCE")
+
+	params.Set("client_id", "svc")
+	params.Set("scope", "profile")
+	location = authorize(t, i, client, base, params)
+	assert.Equal(t, "invalid_scope", location.Query().Get("error"))
+}
+
+func TestIDP_DefaultOIDCTokenHandler_clientSecret(t *testing.T) {
+	i, ts, client := getTestOIDCIDP(t)
+	defer ts.Close()
+	base := ts.URL
+	params := url.Values{
+		"client_id":     {"svc"},
+		"redirect_uri":  {testRedirectURI},
+		"response_type": {"code"},
+		"scope":         {"openid"},
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {authorize(t, i, client, base, params).Query().Get("code")},
+		"redirect_uri": {testRedirectURI},
+	}
+	req, err := http.NewRequest("POST", base+"/oidc/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("svc", "wrong")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.Contains(t, resp.Header.Get("WWW-Authenticate"), "Basic")
+
+	form.Set("client_id", "svc")
+	form.Set("client_secret", "secret")
+	status, body := postTokenRequest(t, client, base, form)
+	assert.Equal(t, http.StatusOK, status, body)
+}
+
+func TestIDP_userClaims(t *testing.T) {
+	i := &IDP{sps: &registry{}, releaseByDefault: true}
+	user := &model.User{Name: "joe", Attributes: []*model.Attribute{
+		{Name: "mail", Value: []string{"joe@example.com"}},
+		{Name: "memberOf", Value: []string{"admins", "users"}},
+		{Name: "sub", Value: []string{"spoofed"}},
+	}}
+	assert.Equal(t, map[string]interface{}{
+		"mail":     "joe@example.com",
+		"memberOf": []string{"admins", "users"},
+	}, i.userClaims(user, "app"), "attributes should keep their names without a claim map")
+
+	i.oidcClaimMap = map[string]string{"mail": "email", "memberof": "groups"}
+	assert.Equal(t, map[string]interface{}{
+		"email":  "joe@example.com",
+		"groups": []string{"admins", "users"},
+	}, i.userClaims(user, "app"))
+}
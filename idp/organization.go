@@ -0,0 +1,103 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/amdonov/lite-idp/saml"
+)
+
+// OrganizationConfig names the organization responsible for the IdP in one language
+type OrganizationConfig struct {
+	// Value of xml:lang, en if it's empty
+	Lang        string
+	Name        string
+	DisplayName string
+	URL         string
+}
+
+// ContactConfig is a contact person listed in the metadata
+type ContactConfig struct {
+	// technical, support, administrative, billing, or other
+	Type      string
+	GivenName string
+	Email     string
+	Phone     string
+}
+
+var contactTypes = map[string]bool{
+	"technical":      true,
+	"support":        true,
+	"administrative": true,
+	"billing":        true,
+	"other":          true,
+}
+
+// configureOrganization reads the organization and contacts published in the metadata
+func (i *IDP) configureOrganization() error {
+	organizations := []OrganizationConfig{}
+	if err := i.settings.UnmarshalKey("organization", &organizations); err != nil {
+		return err
+	}
+	i.organization = nil
+	if len(organizations) > 0 {
+		i.organization = &saml.Organization{}
+	}
+	for _, org := range organizations {
+		if org.Name == "" || org.URL == "" {
+			return errors.New("organization entries must have a name and url")
+		}
+		if org.Lang == "" {
+			org.Lang = "en"
+		}
+		if org.DisplayName == "" {
+			org.DisplayName = org.Name
+		}
+		i.organization.OrganizationName = append(i.organization.OrganizationName, saml.LocalizedName{Lang: org.Lang, Value: org.Name})
+		i.organization.OrganizationDisplayName = append(i.organization.OrganizationDisplayName, saml.LocalizedName{Lang: org.Lang, Value: org.DisplayName})
+		i.organization.OrganizationURL = append(i.organization.OrganizationURL, saml.LocalizedName{Lang: org.Lang, Value: org.URL})
+	}
+
+	contacts := []ContactConfig{}
+	if err := i.settings.UnmarshalKey("contacts", &contacts); err != nil {
+		return err
+	}
+	i.contacts = nil
+	for _, contact := range contacts {
+		if !contactTypes[contact.Type] {
+			return fmt.Errorf("contact type must be technical, support, administrative, billing, or other, not %q", contact.Type)
+		}
+		if contact.Email == "" && contact.Phone == "" {
+			return fmt.Errorf("%s contact needs an email or phone", contact.Type)
+		}
+		person := saml.ContactPerson{ContactType: contact.Type, GivenName: contact.GivenName}
+		if contact.Email != "" {
+			// EmailAddress is a URI
+			email := contact.Email
+			if !strings.HasPrefix(email, "mailto:") {
+				email = "mailto:" + email
+			}
+			person.EmailAddress = []string{email}
+		}
+		if contact.Phone != "" {
+			person.TelephoneNumber = []string{contact.Phone}
+		}
+		i.contacts = append(i.contacts, person)
+	}
+	return nil
+}
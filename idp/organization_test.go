@@ -0,0 +1,81 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto"
+	"encoding/xml"
+	"testing"
+
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_Metadata_organization(t *testing.T) {
+	viper.Set("organization", []OrganizationConfig{
+		{Name: "Example", DisplayName: "Example Inc.", URL: "https://example.com/"},
+		{Lang: "fr", Name: "Exemple", URL: "https://example.com/fr/"},
+	})
+	viper.Set("contacts", []ContactConfig{
+		{Type: "technical", GivenName: "Jane", Email: "jane@example.com", Phone: "+1 555 0100"},
+		{Type: "support", Email: "mailto:help@example.com"},
+	})
+	defer viper.Set("organization", nil)
+	defer viper.Set("contacts", nil)
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	metadata, err := i.Metadata("  ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := i.TLSConfig.Certificates[0].PrivateKey.(crypto.Signer).Public()
+	assert.NoError(t, dsig.Verify(metadata, key), "metadata signature should cover the organization")
+	assert.Contains(t, string(metadata), `<OrganizationName xml:lang="fr">Exemple</OrganizationName>`)
+
+	ed := &saml.IDPEntityDescriptor{}
+	if err = xml.Unmarshal(metadata, ed); err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, ed.Organization) {
+		assert.Equal(t, []saml.LocalizedName{{Lang: "en", Value: "Example Inc."}, {Lang: "fr", Value: "Exemple"}},
+			ed.Organization.OrganizationDisplayName, "the display name defaults to the name")
+		assert.Equal(t, "https://example.com/fr/", ed.Organization.OrganizationURL[1].Value)
+	}
+	if assert.Len(t, ed.ContactPerson, 2) {
+		assert.Equal(t, "technical", ed.ContactPerson[0].ContactType)
+		assert.Equal(t, "Jane", ed.ContactPerson[0].GivenName)
+		assert.Equal(t, []string{"mailto:jane@example.com"}, ed.ContactPerson[0].EmailAddress)
+		assert.Equal(t, []string{"+1 555 0100"}, ed.ContactPerson[0].TelephoneNumber)
+		assert.Equal(t, []string{"mailto:help@example.com"}, ed.ContactPerson[1].EmailAddress)
+	}
+}
+
+func TestIDP_configureOrganization(t *testing.T) {
+	i := &IDP{settings: viper.GetViper()}
+	assert.NoError(t, i.configureOrganization())
+	assert.Nil(t, i.organization, "the organization should be left out unless it's configured")
+
+	viper.Set("contacts", []ContactConfig{{Type: "sales", Email: "sales@example.com"}})
+	assert.Error(t, i.configureOrganization(), "contact types are limited to those in the metadata schema")
+	viper.Set("contacts", []ContactConfig{{Type: "technical"}})
+	assert.Error(t, i.configureOrganization(), "contacts need a way to reach them")
+	viper.Set("contacts", nil)
+
+	viper.Set("organization", []OrganizationConfig{{Name: "Example"}})
+	defer viper.Set("organization", nil)
+	assert.Error(t, i.configureOrganization(), "organizations need a URL")
+}
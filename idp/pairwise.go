@@ -0,0 +1,125 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+
+	"github.com/amdonov/lite-idp/store"
+)
+
+// persistentLifetime keeps entries in caches that require a lifetime for as long as the process runs
+const persistentLifetime = 100 * 365 * 24 * time.Hour
+
+// PairwiseIDStore keeps the persistent NameIDs issued to service providers. Each user gets a random
+// identifier for each service provider the first time one is needed, and it's reused afterwards.
+type PairwiseIDStore struct {
+	cache store.Cache
+}
+
+// NewPairwiseIDStore returns a store that keeps identifiers in the cache. Entries in the cache shouldn't expire.
+func NewPairwiseIDStore(cache store.Cache) *PairwiseIDStore {
+	return &PairwiseIDStore{cache}
+}
+
+// Get returns the user's identifier for the service provider, creating it if there isn't one
+func (s *PairwiseIDStore) Get(entityID, user string) (string, error) {
+	id, err := s.Lookup(entityID, user)
+	if err != store.ErrNotFound {
+		return id, err
+	}
+	data := make([]byte, 32)
+	if _, err = rand.Read(data); err != nil {
+		return "", err
+	}
+	id = base64.RawURLEncoding.EncodeToString(data)
+	if err = s.cache.Set(pairwiseUserKey(entityID, id), []byte(user)); err != nil {
+		return "", err
+	}
+	if err = s.cache.Set(pairwiseIDKey(entityID, user), []byte(id)); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Lookup returns the user's identifier for the service provider or store.ErrNotFound if there isn't one
+func (s *PairwiseIDStore) Lookup(entityID, user string) (string, error) {
+	data, err := s.cache.Get(pairwiseIDKey(entityID, user))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// User returns the user with the identifier for the service provider or store.ErrNotFound if there isn't one
+func (s *PairwiseIDStore) User(entityID, id string) (string, error) {
+	data, err := s.cache.Get(pairwiseUserKey(entityID, id))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Revoke removes the user's identifier for the service provider and the service provider's own identifier for
+// the user. A new one is created at the next login.
+func (s *PairwiseIDStore) Revoke(entityID, user string) error {
+	if id, err := s.Lookup(entityID, user); err == nil {
+		if err = s.cache.Delete(pairwiseUserKey(entityID, id)); err != nil && err != store.ErrNotFound {
+			return err
+		}
+	}
+	if err := s.cache.Delete(spProvidedIDKey(entityID, user)); err != nil && err != store.ErrNotFound {
+		return err
+	}
+	return s.cache.Delete(pairwiseIDKey(entityID, user))
+}
+
+// SetSPProvidedID saves the service provider's own identifier for the user, which is sent as the SPProvidedID of
+// persistent NameIDs. An empty identifier removes it.
+func (s *PairwiseIDStore) SetSPProvidedID(entityID, user, id string) error {
+	if id == "" {
+		if err := s.cache.Delete(spProvidedIDKey(entityID, user)); err != nil && err != store.ErrNotFound {
+			return err
+		}
+		return nil
+	}
+	return s.cache.Set(spProvidedIDKey(entityID, user), []byte(id))
+}
+
+// SPProvidedID returns the service provider's own identifier for the user or store.ErrNotFound if it doesn't have one
+func (s *PairwiseIDStore) SPProvidedID(entityID, user string) (string, error) {
+	data, err := s.cache.Get(spProvidedIDKey(entityID, user))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// pairwiseIDKey identifies an entry in the cache. Entity IDs are URIs, so they can't contain the separating space.
+func pairwiseIDKey(entityID, user string) string {
+	return "pairwise-id:" + entityID + " " + user
+}
+
+// pairwiseUserKey identifies the entry that maps an identifier back to its user
+func pairwiseUserKey(entityID, id string) string {
+	return "pairwise-user:" + entityID + " " + id
+}
+
+// spProvidedIDKey identifies the entry with the service provider's identifier for the user
+func spProvidedIDKey(entityID, user string) string {
+	return "sp-provided-id:" + entityID + " " + user
+}
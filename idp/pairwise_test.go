@@ -0,0 +1,65 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPairwiseIDStore(t *testing.T) {
+	cache, err := store.New(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := NewPairwiseIDStore(cache)
+	_, err = ids.Lookup("dex", "joe")
+	assert.Equal(t, store.ErrNotFound, err)
+
+	id, err := ids.Get("dex", "joe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := ids.Get("dex", "joe")
+	assert.Equal(t, id, again, "the identifier should be reused")
+	other, _ := ids.Get("other", "joe")
+	assert.NotEqual(t, id, other, "each service provider should get its own identifier")
+	found, err := ids.Lookup("dex", "joe")
+	assert.NoError(t, err)
+	assert.Equal(t, id, found)
+	user, err := ids.User("dex", id)
+	assert.NoError(t, err)
+	assert.Equal(t, "joe", user, "identifiers should map back to their user")
+	_, err = ids.User("other", id)
+	assert.Equal(t, store.ErrNotFound, err, "identifiers only map back for their service provider")
+
+	assert.NoError(t, ids.SetSPProvidedID("dex", "joe", "sp-joe"))
+	spProvided, err := ids.SPProvidedID("dex", "joe")
+	assert.NoError(t, err)
+	assert.Equal(t, "sp-joe", spProvided)
+
+	assert.NoError(t, ids.Revoke("dex", "joe"))
+	_, err = ids.SPProvidedID("dex", "joe")
+	assert.Equal(t, store.ErrNotFound, err, "the service provider's identifier should be removed with the NameID")
+	_, err = ids.Lookup("dex", "joe")
+	assert.Equal(t, store.ErrNotFound, err)
+	_, err = ids.User("dex", id)
+	assert.Equal(t, store.ErrNotFound, err, "revoked identifiers shouldn't map back")
+	again, _ = ids.Get("dex", "joe")
+	assert.NotEqual(t, id, again, "a revoked identifier should be replaced")
+}
@@ -15,24 +15,46 @@
 package idp
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 
 	"github.com/amdonov/lite-idp/model"
 	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"golang.org/x/crypto/bcrypt"
 )
 
 // ErrInvalidPassword should be returned by PasswordValidator if
-// the account doesn't exist or the password is incorrect.
+// the account doesn't exist or the password is incorrect. Any other
+// error is treated as a failure of the credential store.
 var ErrInvalidPassword = errors.New("invalid login or password")
 
-// PasswordValidator validates a user's password
+// ErrUnknownUser should be returned by PasswordValidator, wrapped if desired, when the account doesn't exist. It
+// is an ErrInvalidPassword, so users see the same message, but a validator created by NewFallbackValidator
+// tries the next validator instead of failing.
+var ErrUnknownUser = fmt.Errorf("unknown user: %w", ErrInvalidPassword)
+
+// ErrServiceUnavailable should be returned by PasswordValidator, wrapped if desired,
+// when the credential store can't be reached. Users are told to try again later
+// rather than that their password is wrong.
+var ErrServiceUnavailable = errors.New("authentication service unavailable")
+
+// PasswordValidator validates a user's password. The context is cancelled if the
+// user's request is abandoned, so implementations calling other services should honor it.
 type PasswordValidator interface {
-	Validate(user, password string) error
+	Validate(ctx context.Context, user, password string) error
+}
+
+// AttributeValidator is implemented by PasswordValidators that retrieve user attributes while checking credentials.
+// The attributes are added to the user before any AttributeSources are consulted.
+type AttributeValidator interface {
+	PasswordValidator
+	ValidateAndFetch(ctx context.Context, user, password string) ([]*model.Attribute, error)
 }
 
 type simpleValidator struct {
@@ -45,7 +67,7 @@ type UserPassword struct {
 	Password string
 }
 
-func (sv *simpleValidator) Validate(user, password string) error {
+func (sv *simpleValidator) Validate(ctx context.Context, user, password string) error {
 	if pw, ok := sv.users[user]; ok {
 		err := bcrypt.CompareHashAndPassword(pw, []byte(password))
 		if err == bcrypt.ErrMismatchedHashAndPassword {
@@ -53,13 +75,17 @@ func (sv *simpleValidator) Validate(user, password string) error {
 		}
 		return err
 	}
-	return ErrInvalidPassword
+	return ErrUnknownUser
 }
 
 // NewValidator returns a sample validator that compares passwords to the bcrypt stored values for a user's password defined in the users key of the IDP's configuration
 func NewValidator() (PasswordValidator, error) {
+	return newValidator(viper.GetViper())
+}
+
+func newValidator(settings *viper.Viper) (PasswordValidator, error) {
 	passwords := []UserPassword{}
-	err := viper.UnmarshalKey("users", &passwords)
+	err := settings.UnmarshalKey("users", &passwords)
 	if err != nil {
 		return nil, err
 	}
@@ -70,6 +96,80 @@ func NewValidator() (PasswordValidator, error) {
 	return &simpleValidator{users}, nil
 }
 
+type fallbackValidator struct {
+	validators []PasswordValidator
+}
+
+// NewFallbackValidator returns a validator that tries each of the validators in order until one accepts the
+// password. Users that a validator reports with ErrUnknownUser are passed on to the next one. Any other error,
+// such as ErrInvalidPassword for a wrong password or ErrServiceUnavailable, fails the login without trying the
+// rest. Attributes are fetched from the validator that accepts the password if it's an AttributeValidator.
+func NewFallbackValidator(validators ...PasswordValidator) PasswordValidator {
+	return &fallbackValidator{validators}
+}
+
+func (fv *fallbackValidator) Validate(ctx context.Context, user, password string) error {
+	_, err := fv.ValidateAndFetch(ctx, user, password)
+	return err
+}
+
+func (fv *fallbackValidator) ValidateAndFetch(ctx context.Context, user, password string) ([]*model.Attribute, error) {
+	for _, validator := range fv.validators {
+		var (
+			atts []*model.Attribute
+			err  error
+		)
+		if av, ok := validator.(AttributeValidator); ok {
+			atts, err = av.ValidateAndFetch(ctx, user, password)
+		} else {
+			err = validator.Validate(ctx, user, password)
+		}
+		if !errors.Is(err, ErrUnknownUser) {
+			return atts, err
+		}
+	}
+	return nil, ErrUnknownUser
+}
+
+// CheckHealth checks the validators that implement HealthChecker
+func (fv *fallbackValidator) CheckHealth(ctx context.Context) error {
+	for _, validator := range fv.validators {
+		if checker, ok := validator.(HealthChecker); ok {
+			if err := checker.CheckHealth(ctx); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes the validators that implement io.Closer
+func (fv *fallbackValidator) Close() error {
+	var err error
+	for _, validator := range fv.validators {
+		if closer, ok := validator.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// newPasswordValidator creates one of the validators listed in password-validators
+func newPasswordValidator(settings *viper.Viper, name string) (PasswordValidator, error) {
+	switch name {
+	case "users":
+		return newValidator(settings)
+	case "ldap":
+		if settings.GetString("ldap.url") == "" {
+			return nil, errors.New("password-validators includes ldap, but ldap.url isn't set")
+		}
+		return newLDAPValidator(settings)
+	}
+	return nil, fmt.Errorf("password-validators must list users or ldap, not %q", name)
+}
+
 // DefaultPasswordLoginHandler is the default implementation for the password login handler. It can be used as is, wrapped in other handlers, or replaced completely.
 func (i *IDP) DefaultPasswordLoginHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -79,6 +179,11 @@ func (i *IDP) DefaultPasswordLoginHandler() http.HandlerFunc {
 				return err
 			}
 			requestID := r.Form.Get("requestId")
+			if err = i.checkCSRFToken(r); err != nil {
+				log.Warnf("rejecting login form from %s: %v", getIP(r), err)
+				i.renderLoginPage(w, r, requestID, "Your login form expired. Please try again.", http.StatusForbidden)
+				return nil
+			}
 			data, err := i.TempCache.Get(requestID)
 			if err != nil {
 				return err
@@ -88,20 +193,36 @@ func (i *IDP) DefaultPasswordLoginHandler() http.HandlerFunc {
 			if err != nil {
 				return err
 			}
+			recordServiceProvider(r, i.spLabel(req.Issuer))
 			user, err := i.loginWithPasswordForm(r, req)
 			if user != nil {
-				return i.respond(req, user, w, r)
+				if pending, err := i.startTOTPLogin(requestID, req, user, w, r); pending || err != nil {
+					return err
+				}
+				return i.reportFailure(req, i.respond(req, user, w, r), w, r)
+			}
+			var limited *tooManyAttemptsError
+			if errors.As(err, &limited) {
+				writeTooManyAttempts(w, limited)
+				return nil
+			}
+			if errors.Is(err, ErrInvalidPassword) {
+				http.Redirect(w, r, keepLocale(r, fmt.Sprintf("%s/ui/login.html?requestId=%s&error=%s", i.basePath,
+					url.QueryEscape(requestID), url.QueryEscape("Invalid login or password. Please try again."))),
+					http.StatusFound)
+				return nil
 			}
-			if err == ErrInvalidPassword {
-				http.Redirect(w, r, fmt.Sprintf("/ui/login.html?requestId=%s&error=%s",
-					url.QueryEscape(requestID), url.QueryEscape("Invalid login or password. Please try again.")),
+			if errors.Is(err, ErrServiceUnavailable) {
+				log.Error(err)
+				http.Redirect(w, r, keepLocale(r, fmt.Sprintf("%s/ui/login.html?requestId=%s&error=%s", i.basePath,
+					url.QueryEscape(requestID), url.QueryEscape("The authentication service is unavailable. Please try again later."))),
 					http.StatusFound)
 				return nil
 			}
-			return err
+			return i.reportFailure(req, err, w, r)
 		}()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			i.writeError(w, r, err, http.StatusInternalServerError)
 		}
 	}
 }
@@ -15,7 +15,9 @@
 package idp
 
 import (
+	"context"
 	"errors"
+	"io"
 	"net/http"
 	"net/url"
 	"strings"
@@ -23,6 +25,7 @@ import (
 
 	"github.com/amdonov/lite-idp/model"
 	"github.com/golang/protobuf/proto"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -44,7 +47,7 @@ func TestIDP_DefaultPasswordLoginHandler(t *testing.T) {
 	client.CheckRedirect = func(r *http.Request, old []*http.Request) error {
 		return errors.New("no redirects allowed")
 	}
-	_, err = client.PostForm(ts.URL+"/ui/login.html", url.Values{"requestId": {"1234"}})
+	_, err = postLoginForm(client, i, ts.URL+"/ui/login.html", url.Values{"requestId": {"1234"}})
 	assert.True(t, strings.Contains(err.Error(), "Invalid+login+or+password"), "login should have failed")
 	if err == nil {
 		t.Fatal("login should have failed")
@@ -52,6 +55,35 @@ func TestIDP_DefaultPasswordLoginHandler(t *testing.T) {
 	assert.True(t, strings.Contains(err.Error(), "Invalid+login+or+password"), "login should have redirected to page with error")
 }
 
+type acceptingValidator struct{}
+
+func (acceptingValidator) Validate(ctx context.Context, user, password string) error {
+	return nil
+}
+
+type unavailableValidator struct{}
+
+func (unavailableValidator) Validate(ctx context.Context, user, password string) error {
+	return errors.New("credential store unavailable")
+}
+
+func TestIDP_DefaultPasswordLoginHandler_backendError(t *testing.T) {
+	i := &IDP{PasswordValidator: unavailableValidator{}}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	data, err := proto.Marshal(&model.AuthnRequest{ID: "2134"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.TempCache.Set("1234", data)
+	resp, err := postLoginForm(ts.Client(), i, ts.URL+"/ui/login.html", url.Values{"requestId": {"1234"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode, "backend failures should not look like a bad password")
+}
+
 func Test_simpleValidator_Validate(t *testing.T) {
 	users := map[string][]byte{"joe": []byte("$2a$10$T7dLNN/oQjgxOZYJPYRBnOEFY3ZDqImVXW31zgjdv2Wl3.7Q.uUjC")}
 	type fields struct {
@@ -76,9 +108,76 @@ func Test_simpleValidator_Validate(t *testing.T) {
 			sv := &simpleValidator{
 				users: tt.fields.users,
 			}
-			if err := sv.Validate(tt.args.user, tt.args.password); (err != nil) != tt.wantErr {
+			if err := sv.Validate(context.Background(), tt.args.user, tt.args.password); (err != nil) != tt.wantErr {
 				t.Errorf("simpleValidator.Validate() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
 	}
 }
+
+type closingValidator struct {
+	acceptingValidator
+	closed bool
+}
+
+func (cv *closingValidator) Close() error {
+	cv.closed = true
+	return nil
+}
+
+func TestFallbackValidator(t *testing.T) {
+	// Both have joe, but only the service account is in the second
+	local := &simpleValidator{users: map[string][]byte{
+		"joe":     []byte("$2a$10$T7dLNN/oQjgxOZYJPYRBnOEFY3ZDqImVXW31zgjdv2Wl3.7Q.uUjC"),
+		"service": []byte("$2a$10$T7dLNN/oQjgxOZYJPYRBnOEFY3ZDqImVXW31zgjdv2Wl3.7Q.uUjC"),
+	}}
+	directory := &simpleValidator{users: map[string][]byte{
+		"joe": []byte("$2a$10$U41uarKrlduOofvJRC724.7V7RRZOciyC4TZ4UAQUtWuPuKVvByR."),
+	}}
+	ctx := context.Background()
+	validator := NewFallbackValidator(directory, local)
+	assert.NoError(t, validator.Validate(ctx, "service", "password"), "users missing from the first should be checked by the next")
+	err := validator.Validate(ctx, "joe", "password")
+	assert.Equal(t, ErrInvalidPassword, err, "a wrong password in the first shouldn't fall back")
+	err = validator.Validate(ctx, "suzy", "password")
+	assert.Equal(t, ErrUnknownUser, err)
+	assert.True(t, errors.Is(err, ErrInvalidPassword), "unknown users should look like a bad password")
+
+	validator = NewFallbackValidator(unavailableValidator{}, local)
+	assert.Error(t, validator.Validate(ctx, "service", "password"), "an unavailable validator shouldn't fall back")
+
+	closer := &closingValidator{}
+	validator = NewFallbackValidator(local, closer)
+	assert.NoError(t, validator.Validate(ctx, "suzy", "anything"))
+	assert.NoError(t, validator.(io.Closer).Close())
+	assert.True(t, closer.closed)
+}
+
+func TestIDP_configureValidator(t *testing.T) {
+	s := newTestDirectory()
+	defer s.Close()
+	configureTestLDAP(s.URL)
+	defer viper.Set("ldap.url", "")
+	viper.Set("password-validators", []string{"ldap", "users"})
+	defer viper.Set("password-validators", nil)
+	viper.Set("users", []map[string]string{{"name": "service", "password": "$2a$10$T7dLNN/oQjgxOZYJPYRBnOEFY3ZDqImVXW31zgjdv2Wl3.7Q.uUjC"}})
+	defer viper.Set("users", nil)
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	ctx := context.Background()
+	assert.NoError(t, i.PasswordValidator.Validate(ctx, "joe", "password"), "joe is in the directory")
+	assert.NoError(t, i.PasswordValidator.Validate(ctx, "service", "password"), "service is in the users")
+	assert.Equal(t, ErrUnknownUser, i.PasswordValidator.Validate(ctx, "suzy", "password"))
+	atts, err := i.PasswordValidator.(AttributeValidator).ValidateAndFetch(ctx, "joe", "password")
+	if assert.NoError(t, err) {
+		assert.Len(t, atts, 2, "attributes should come from the directory")
+	}
+
+	viper.Set("password-validators", []string{"users", "kerberos"})
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err)
+	viper.Set("ldap.url", "")
+	viper.Set("password-validators", []string{"ldap"})
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err, "ldap requires ldap.url")
+}
@@ -15,15 +15,19 @@
 package idp
 
 import (
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/asn1"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+	"text/template"
 
 	"github.com/amdonov/xmlsig"
+	log "github.com/sirupsen/logrus"
 )
 
 func getCertFromRequest(r *http.Request) (*x509.Certificate, error) {
@@ -55,6 +59,8 @@ func getSubjectDN(subject pkix.Name) string {
 			switch t[3] {
 			case 3:
 				rdnName = "CN"
+			case 5:
+				rdnName = "SERIALNUMBER"
 			case 6:
 				rdnName = "C"
 			case 7:
@@ -68,7 +74,8 @@ func getSubjectDN(subject pkix.Name) string {
 			case 11:
 				rdnName = "OU"
 			default:
-				panic("RFC 2253 implementation is incomplete")
+				// RFC 2253 uses the dotted OID for types without a short name
+				rdnName = t.String()
 			}
 			rdnValue, _ := names[i].Value.(string)
 			rdns = append(rdns, fmt.Sprintf("%s=%s", rdnName, rdnValue))
@@ -76,3 +83,114 @@ func getSubjectDN(subject pkix.Name) string {
 	}
 	return strings.Join(rdns, ", ")
 }
+
+const (
+	// principal types for certificate logins
+	principalSubject = "subject"
+	principalUPN     = "upn"
+	principalEmail   = "email"
+)
+
+// oidUPN identifies the Microsoft user principal name in a subject alternative name
+var oidUPN = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2, 3}
+
+var oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// nameIDFormats for the principal types
+var principalFormats = map[string]string{
+	principalSubject: nameIDFormatX509,
+	principalUPN:     nameIDFormatUnspecified,
+	principalEmail:   nameIDFormatEmail,
+}
+
+// certificateNames are the values from a client certificate available to the cert-login-nameid template
+type certificateNames struct {
+	// Principal is the value selected by cert-login-principal
+	Principal  string
+	SubjectDN  string
+	CommonName string
+	Email      string
+	UPN        string
+}
+
+func (i *IDP) configureCertLogin() error {
+	i.certLogin = i.settings.GetBool("cert-login-enabled")
+	i.certPrincipal = i.settings.GetString("cert-login-principal")
+	if _, ok := principalFormats[i.certPrincipal]; !ok {
+		return fmt.Errorf("cert-login-principal must be subject, upn, or email, not %q", i.certPrincipal)
+	}
+	templ, err := template.New("nameid").Option("missingkey=error").Parse(i.settings.GetString("cert-login-nameid"))
+	if err != nil {
+		return fmt.Errorf("invalid cert-login-nameid: %v", err)
+	}
+	i.certNameIDTemplate = templ
+	if i.certLogin && i.TLSConfig != nil && i.TLSConfig.ClientAuth == tls.NoClientCert {
+		log.Warn("cert-login-enabled is set, but the TLS configuration doesn't request client certificates")
+	}
+	return i.configureCertRevocation()
+}
+
+// certificateNameID returns the NameID and format for a user who logged in with the certificate
+func (i *IDP) certificateNameID(cert *x509.Certificate) (string, string, error) {
+	names := certificateNames{
+		SubjectDN:  getSubjectDN(cert.Subject),
+		CommonName: cert.Subject.CommonName,
+		UPN:        getUPN(cert),
+	}
+	if len(cert.EmailAddresses) > 0 {
+		names.Email = cert.EmailAddresses[0]
+	}
+	switch i.certPrincipal {
+	case principalUPN:
+		names.Principal = names.UPN
+	case principalEmail:
+		names.Principal = names.Email
+	default:
+		names.Principal = names.SubjectDN
+	}
+	if names.Principal == "" {
+		return "", "", fmt.Errorf("certificate for %s doesn't contain a %s", names.SubjectDN, i.certPrincipal)
+	}
+	var b strings.Builder
+	if err := i.certNameIDTemplate.Execute(&b, names); err != nil {
+		return "", "", err
+	}
+	return b.String(), principalFormats[i.certPrincipal], nil
+}
+
+// getUPN returns the first user principal name in the certificate's subject alternative names
+func getUPN(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		var names asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			return ""
+		}
+		rest := names.Bytes
+		for len(rest) > 0 {
+			var name asn1.RawValue
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &name); err != nil {
+				return ""
+			}
+			// otherName is [0] in GeneralName
+			if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+				continue
+			}
+			var other struct {
+				ID    asn1.ObjectIdentifier
+				Value asn1.RawValue `asn1:"explicit,tag:0"`
+			}
+			if _, err = asn1.UnmarshalWithParams(name.FullBytes, &other, "tag:0"); err != nil || !other.ID.Equal(oidUPN) {
+				continue
+			}
+			var upn string
+			if _, err = asn1.UnmarshalWithParams(other.Value.Bytes, &upn, "utf8"); err == nil {
+				return upn
+			}
+		}
+	}
+	return ""
+}
@@ -1,9 +1,19 @@
 package idp
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
 	"testing"
+	"time"
 
 	"github.com/amdonov/xmlsig"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestGetCertFromXML(t *testing.T) {
@@ -37,3 +47,84 @@ VAMtigDCrxuwesx681g/cdi9oXWmRSB3wt7LXHcvxGWz9Db45iWyMRDh0scqdiQ=`,
 		t.Fatal("dn didn't match expected value")
 	}
 }
+
+// newClientCertificate returns a certificate for joe with an email address and UPN in its subject alternative names
+func newClientCertificate(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upn, err := asn1.MarshalWithParams("joe@EXAMPLE.COM", "utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := asn1.Marshal(oidUPN)
+	value, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: upn})
+	san, err := asn1.Marshal([]asn1.RawValue{
+		{Class: asn1.ClassContextSpecific, Tag: 1, Bytes: []byte("joe@example.com")},
+		{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: append(id, value...)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		Subject:         pkix.Name{CommonName: "Joe User", Organization: []string{"Example"}, SerialNumber: "1234"},
+		NotBefore:       time.Now(),
+		NotAfter:        time.Now().Add(time.Hour),
+		ExtraExtensions: []pkix.Extension{{Id: oidSubjectAltName, Value: san}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestIDP_certificateNameID(t *testing.T) {
+	defer viper.Set("cert-login-principal", "subject")
+	defer viper.Set("cert-login-nameid", "{{.Principal}}")
+	cert := newClientCertificate(t)
+	tests := []struct {
+		principal string
+		template  string
+		name      string
+		format    string
+	}{
+		{"subject", "{{.Principal}}", "SERIALNUMBER=1234, CN=Joe User, O=Example", "urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName"},
+		{"upn", "{{.Principal}}", "joe@EXAMPLE.COM", "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"},
+		{"email", "{{.Principal}}", "joe@example.com", "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"},
+		{"subject", "{{.CommonName}} <{{.Email}}>", "Joe User <joe@example.com>", "urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName"},
+	}
+	for _, test := range tests {
+		viper.Set("cert-login-principal", test.principal)
+		viper.Set("cert-login-nameid", test.template)
+		i := &IDP{settings: viper.GetViper()}
+		if err := i.configureCertLogin(); err != nil {
+			t.Fatal(err)
+		}
+		name, format, err := i.certificateNameID(cert)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, test.name, name)
+		assert.Equal(t, test.format, format)
+	}
+
+	// Certificates without the principal can't be used
+	viper.Set("cert-login-principal", "upn")
+	viper.Set("cert-login-nameid", "{{.Principal}}")
+	i := &IDP{settings: viper.GetViper()}
+	if err := i.configureCertLogin(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := i.certificateNameID(&x509.Certificate{})
+	assert.Error(t, err)
+
+	viper.Set("cert-login-principal", "dn")
+	assert.Error(t, i.configureCertLogin(), "unknown principal types should be rejected")
+}
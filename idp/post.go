@@ -19,40 +19,89 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/xml"
+	htmltemplate "html/template"
 	"io"
 	"net/http"
+	"text/template"
 
 	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
 )
 
 func (i *IDP) sendPostResponse(authRequest *model.AuthnRequest, user *model.User,
 	w io.Writer, r *http.Request) error {
-	response := i.makeAuthnResponse(authRequest, user)
+	response, err := i.makeAuthnResponse(authRequest, user)
+	if err != nil {
+		return err
+	}
 	// Don't need to change the response. Go ahead and sign it
-	signature, err := i.signer.CreateSignature(response.Assertion)
+	if err = i.signResponse(r.Context(), response, authRequest.Issuer); err != nil {
+		return err
+	}
+	return i.postResponse(response, authRequest.RelayState, authRequest.AssertionConsumerServiceURL, w)
+}
+
+// sendPostStatus sends a signed response without an assertion to report why a request failed
+func (i *IDP) sendPostStatus(request *model.AuthnRequest, status *saml.Status, w io.Writer) error {
+	response := i.makeStatusResponse(request, status)
+	signature, err := i.signerFor(request.Issuer).CreateSignature(response)
 	if err != nil {
 		return err
 	}
-	response.Assertion.Signature = signature
+	response.Signature = signature
+	return i.postResponse(response, request.RelayState, request.AssertionConsumerServiceURL, w)
+}
+
+// postResponse writes a form that posts the response to the assertion consumer service
+func (i *IDP) postResponse(response *saml.Response, relayState, location string, w io.Writer) error {
 	var xmlbuff bytes.Buffer
 	memWriter := bufio.NewWriter(&xmlbuff)
 	memWriter.Write([]byte(xml.Header))
 	encoder := xml.NewEncoder(memWriter)
 	encoder.Encode(response)
 	memWriter.Flush()
+	i.debugMessage(messageSent, xmlbuff.Bytes())
 
 	samlMessage := base64.StdEncoding.EncodeToString(xmlbuff.Bytes())
 
-	data := struct {
-		RelayState                  string
-		SAMLResponse                string
-		AssertionConsumerServiceURL string
-	}{
-		authRequest.RelayState,
-		samlMessage,
-		authRequest.AssertionConsumerServiceURL,
+	return i.postTemplate.Execute(w, PostPage{
+		AssertionConsumerServiceURL: location,
+		SAMLResponse:                samlMessage,
+		RelayState:                  relayState,
+	})
+}
+
+// PostPage is passed to the post-template
+type PostPage struct {
+	// Location of the service provider's assertion consumer service, checked against its metadata. It's the form's action.
+	AssertionConsumerServiceURL string
+	// Base64-encoded response to post as SAMLResponse
+	SAMLResponse string
+	// RelayState from the request, only posted if it isn't empty
+	RelayState string
+}
+
+// pageTemplate is implemented by both text and html templates
+type pageTemplate interface {
+	Execute(w io.Writer, data interface{}) error
+}
+
+// configurePostPage parses the post-template if one is set, otherwise the built-in page is used
+func (i *IDP) configurePostPage() error {
+	if file := i.settings.GetString("post-template"); file != "" {
+		templ, err := htmltemplate.ParseFiles(file)
+		if err != nil {
+			return err
+		}
+		i.postTemplate = templ
+		return nil
+	}
+	templ, err := template.New("post").Parse(postTemplate)
+	if err != nil {
+		return err
 	}
-	return i.postTemplate.Execute(w, data)
+	i.postTemplate = templ
+	return nil
 }
 
 const postTemplate = `<?xml version="1.0" encoding="UTF-8"?>
@@ -66,11 +115,11 @@ const postTemplate = `<?xml version="1.0" encoding="UTF-8"?>
 you must press the Continue button once to proceed.
 </p>
 </noscript>
-<form action="{{ .AssertionConsumerServiceURL }}" method="post" id="samlpost">
+<form action="{{ .AssertionConsumerServiceURL | html }}" method="post" id="samlpost">
 <div>
-<input type="hidden" name="RelayState"
-value="{{ .RelayState }}"/>
-<input type="hidden" name="SAMLResponse"
+{{ if .RelayState }}<input type="hidden" name="RelayState"
+value="{{ .RelayState | html }}"/>
+{{ end }}<input type="hidden" name="SAMLResponse"
 value="{{ .SAMLResponse }}"/>
 </div>
 <noscript>
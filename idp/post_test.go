@@ -16,10 +16,16 @@ package idp
 
 import (
 	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/PuerkitoBio/goquery"
 	"github.com/amdonov/lite-idp/model"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -29,7 +35,7 @@ func TestIDP_sendPostResponse(t *testing.T) {
 	var b bytes.Buffer
 	if err := i.sendPostResponse(&model.AuthnRequest{
 		AssertionConsumerServiceURL: "testsvc",
-	}, &model.User{}, &b, nil); err != nil {
+	}, &model.User{}, &b, httptest.NewRequest("POST", "/SAML2/Redirect/SSO", nil)); err != nil {
 		t.Fatal(err)
 	}
 	// Check to see if the response contained a form posting to the assertion consumer service
@@ -42,3 +48,73 @@ func TestIDP_sendPostResponse(t *testing.T) {
 	assert.True(t, ok, "failed to find form")
 	assert.Equal(t, "testsvc", value, "assertion consumer service url doesn't match")
 }
+
+func TestIDP_sendPostResponse_fields(t *testing.T) {
+	i := &IDP{}
+	getTestIDP(t, i)
+	var b bytes.Buffer
+	if err := i.sendPostResponse(&model.AuthnRequest{
+		AssertionConsumerServiceURL: "https://sp.example.com/acs",
+		RelayState:                  `"state"`,
+	}, &model.User{}, &b, httptest.NewRequest("POST", "/SAML2/Redirect/SSO", nil)); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	relayState, _ := doc.Find("input[name=RelayState]").Attr("value")
+	assert.Equal(t, `"state"`, relayState, "RelayState should be escaped")
+	encoded, _ := doc.Find("input[name=SAMLResponse]").Attr("value")
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if assert.NoError(t, err) {
+		assert.Contains(t, string(data), "<Response")
+	}
+	// The parser treats noscript as text since it supports scripts
+	assert.Contains(t, doc.Find("noscript").Text(), `<input type="submit" value="Continue"/>`, "browsers without JavaScript need a button")
+}
+
+func TestIDP_sendPostResponse_template(t *testing.T) {
+	dir, err := ioutil.TempDir("", "post")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "post.html")
+	page := `<html><body onload="document.forms[0].submit()"><p class="spinner">Redirecting...</p>
+<form method="post" action="{{ .AssertionConsumerServiceURL }}">
+<input type="hidden" name="SAMLResponse" value="{{ .SAMLResponse }}"/>
+{{ if .RelayState }}<input type="hidden" name="RelayState" value="{{ .RelayState }}"/>{{ end }}
+<noscript><input type="submit" value="Continue"/></noscript></form></body></html>`
+	if err = ioutil.WriteFile(file, []byte(page), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("post-template", file)
+	defer viper.Set("post-template", "")
+	i := &IDP{}
+	getTestIDP(t, i)
+	var b bytes.Buffer
+	if err = i.sendPostResponse(&model.AuthnRequest{
+		AssertionConsumerServiceURL: "https://sp.example.com/acs",
+		RelayState:                  "<state>",
+	}, &model.User{}, &b, httptest.NewRequest("POST", "/SAML2/Redirect/SSO", nil)); err != nil {
+		t.Fatal(err)
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Redirecting...", doc.Find(".spinner").Text())
+	action, _ := doc.Find("form").Attr("action")
+	assert.Equal(t, "https://sp.example.com/acs", action)
+	relayState, _ := doc.Find("input[name=RelayState]").Attr("value")
+	assert.Equal(t, "<state>", relayState)
+	assert.NotContains(t, b.String(), "<state>", "the template should escape values")
+	encoded, _ := doc.Find("input[name=SAMLResponse]").Attr("value")
+	_, err = base64.StdEncoding.DecodeString(encoded)
+	assert.NoError(t, err)
+
+	viper.Set("post-template", filepath.Join(dir, "missing.html"))
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err, "missing templates should be reported")
+}
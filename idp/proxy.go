@@ -0,0 +1,163 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type clientIPKey struct{}
+
+func (i *IDP) configureTrustedProxies() error {
+	proxies, err := parseNetworks("trusted-proxies", i.settings.GetStringSlice("trusted-proxies"))
+	if err != nil {
+		return err
+	}
+	i.trustedProxies = proxies
+	return nil
+}
+
+// parseNetworks parses the addresses and CIDR blocks listed in a setting
+func parseNetworks(setting string, entries []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			// A single address
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 128
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+				continue
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s entry %s isn't an IP address or CIDR block", setting, entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// containsIP reports whether any of the networks contains the address
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor determines the address of the client for requests relayed by trusted proxies. getIP returns it while
+// the request is handled, and access logs can read it with ClientIPFor.
+func (i *IDP) forwardedFor(h http.Handler) http.Handler {
+	if len(i.trustedProxies) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := i.clientIP(r)
+		if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+			info.clientIP = ip
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), clientIPKey{}, ip)))
+	})
+}
+
+// clientIP returns the address of the client. Requests from trusted proxies are followed back through the
+// Forwarded or X-Forwarded-For header to the first address that isn't a trusted proxy. Headers from other
+// addresses are ignored, since anyone could set them.
+func (i *IDP) clientIP(r *http.Request) net.IP {
+	ip := remoteIP(r)
+	if !i.trustedProxy(ip) {
+		return ip
+	}
+	hops := forwardedHops(r.Header)
+	for n := len(hops) - 1; n >= 0; n-- {
+		hop := parseHop(hops[n])
+		if hop == nil {
+			// Obfuscated or malformed addresses can't be followed any further
+			return ip
+		}
+		ip = hop
+		if !i.trustedProxy(ip) {
+			break
+		}
+	}
+	return ip
+}
+
+func (i *IDP) trustedProxy(ip net.IP) bool {
+	return containsIP(i.trustedProxies, ip)
+}
+
+// forwardedHops returns the addresses a request passed through, starting with the client. The Forwarded header
+// of RFC 7239 is used if the request has one, otherwise X-Forwarded-For.
+func forwardedHops(header http.Header) []string {
+	var hops []string
+	if forwarded := header.Values("Forwarded"); len(forwarded) > 0 {
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			hop := ""
+			for _, pair := range strings.Split(element, ";") {
+				pair = strings.TrimSpace(pair)
+				if len(pair) > 4 && strings.EqualFold(pair[:4], "for=") {
+					hop = strings.Trim(pair[4:], `"`)
+				}
+			}
+			hops = append(hops, hop)
+		}
+		return hops
+	}
+	for _, hop := range strings.Split(strings.Join(header.Values("X-Forwarded-For"), ","), ",") {
+		if hop = strings.TrimSpace(hop); hop != "" {
+			hops = append(hops, hop)
+		}
+	}
+	return hops
+}
+
+// parseHop parses an address from a forwarding header, which may include a port and brackets around IPv6 addresses
+func parseHop(hop string) net.IP {
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		hop = host
+	}
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
+
+// remoteIP returns the address the request came from
+func remoteIP(r *http.Request) net.IP {
+	addr := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(addr)
+}
+
+// getIP returns the address of the client that sent the request, which may have been relayed by a trusted proxy
+func getIP(r *http.Request) net.IP {
+	if ip, ok := r.Context().Value(clientIPKey{}).(net.IP); ok {
+		return ip
+	}
+	return remoteIP(r)
+}
@@ -0,0 +1,98 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_clientIP(t *testing.T) {
+	viper.Set("trusted-proxies", []string{"10.0.0.0/8", "2001:db8::1"})
+	defer viper.Set("trusted-proxies", nil)
+	i := &IDP{settings: viper.GetViper()}
+	if err := i.configureTrustedProxies(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		remote string
+		header http.Header
+		want   string
+	}{
+		{"direct", "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"IPv6", "[2001:db8::2]:1234", nil, "2001:db8::2"},
+		{"untrusted proxy", "192.0.2.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"trusted IPv6 proxy", "[2001:db8::1]:1234", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"proxy chain", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.9, 198.51.100.1, 10.0.0.2"}}, "198.51.100.1"},
+		{"repeated headers", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"203.0.113.9", "198.51.100.1"}}, "198.51.100.1"},
+		{"all trusted", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"malformed", "10.0.0.1:1234", http.Header{"X-Forwarded-For": {"198.51.100.1, bogus"}}, "10.0.0.1"},
+		{"no header", "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"forwarded", "10.0.0.1:1234", http.Header{
+			"Forwarded":       {`for=198.51.100.1;proto=https, for="[2001:db8::3]:4711"`},
+			"X-Forwarded-For": {"203.0.113.9"},
+		}, "2001:db8::3"},
+		{"obfuscated", "10.0.0.1:1234", http.Header{"Forwarded": {"for=_hidden"}}, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for name, values := range tt.header {
+				r.Header[name] = values
+			}
+			assert.Equal(t, net.ParseIP(tt.want).String(), i.clientIP(r).String())
+		})
+	}
+}
+
+func TestIDP_forwardedFor(t *testing.T) {
+	i := &IDP{trustedProxies: []*net.IPNet{{IP: net.IPv4(10, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)}}}
+	var ip net.IP
+	h := i.forwardedFor(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip = getIP(r)
+	}))
+	r := WithRequestInfo(httptest.NewRequest("GET", "/", nil))
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "198.51.100.1", ip.String(), "handlers should see the client's address")
+	assert.Equal(t, "198.51.100.1", ClientIPFor(r).String(), "access logs should see the client's address")
+
+	i.trustedProxies = nil
+	h = i.forwardedFor(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip = getIP(r)
+	}))
+	r = WithRequestInfo(httptest.NewRequest("GET", "/", nil))
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "10.0.0.1", ip.String(), "headers should be ignored without trusted proxies")
+	assert.Nil(t, ClientIPFor(r))
+}
+
+func TestIDP_configureTrustedProxies(t *testing.T) {
+	viper.Set("trusted-proxies", []string{"10.0.0.0/33"})
+	defer viper.Set("trusted-proxies", nil)
+	i := &IDP{settings: viper.GetViper()}
+	assert.Error(t, i.configureTrustedProxies())
+}
@@ -1,93 +1,155 @@
 package idp
 
 import (
+	"bytes"
+	"context"
 	"encoding/xml"
+	"errors"
+	"io/ioutil"
 	"net/http"
 	"time"
 
 	"github.com/amdonov/lite-idp/model"
 	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/store"
 	log "github.com/sirupsen/logrus"
 )
 
 // DefaultQueryHandler is the default implementation for the attribute query handler. It can be used as is, wrapped in other handlers, or replaced completely.
+// Errors are returned as SOAP faults.
 func (i *IDP) DefaultQueryHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sp := ""
+		defer func() { i.metrics.attributeQuery.Observe(since(start), sp) }()
 		err := func() error {
-			decoder := xml.NewDecoder(r.Body)
+			data, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				return clientFault(err)
+			}
+			i.debugMessage(messageReceived, data)
 			attributeEnv := &saml.AttributeQueryEnv{}
-			if err := decoder.Decode(&attributeEnv); err != nil {
-				return err
+			if err = xml.Unmarshal(data, attributeEnv); err != nil {
+				return clientFault(err)
 			}
 			query := attributeEnv.Body.Query
-			user := &model.User{
-				Name:   query.Subject.NameID.Value,
-				Format: query.Subject.NameID.Format,
+			if err := i.checkIssueInstant(query.IssueInstant); err != nil {
+				return deniedFault(http.StatusBadRequest, err)
 			}
-			if err := i.setUserAttributes(user, nil); err != nil {
+			sp = i.spLabel(query.Issuer)
+			recordServiceProvider(r, sp)
+			response, err := i.makeQueryResponse(r.Context(), &query)
+			if err != nil {
+				return err
+			}
+			if err = i.signResponse(r.Context(), response, query.Issuer); err != nil {
 				return err
 			}
-			response := i.makeResponse(query.ID, query.Issuer, user)
 			env := &saml.AttributeRespEnv{
 				Body: saml.AttributeRespBody{
 					Response: *response,
 				},
 			}
-			now := time.Now()
-			fiveMinutes, _ := time.ParseDuration("5m")
-			fiveFromNow := now.Add(fiveMinutes)
-			attrResp := &saml.AttributeRespEnv{
-				Body: saml.AttributeRespBody{
-					Response: saml.Response{
-						StatusResponseType: saml.StatusResponseType{
-							Version:      "2.0",
-							ID:           saml.NewID(),
-							IssueInstant: now,
-							Status: &saml.Status{
-								StatusCode: saml.StatusCode{
-									Value: "urn:oasis:names:tc:SAML:2.0:status:Success",
-								},
-							},
-							InResponseTo: query.ID,
-							Issuer:       saml.NewIssuer(i.entityID),
-						},
-						Assertion: &saml.Assertion{
-							Issuer:       saml.NewIssuer(i.entityID),
-							IssueInstant: now,
-							ID:           saml.NewID(),
-							Version:      "2.0",
-							Subject: &saml.Subject{
-								NameID: query.Subject.NameID,
-							},
-							AttributeStatement: user.AttributeStatement(),
-							Conditions: &saml.Conditions{
-								NotBefore:           now,
-								NotOnOrAfter:        fiveFromNow,
-								AudienceRestriction: &saml.AudienceRestriction{Audience: query.Issuer},
-							},
-						},
-					},
-				},
-			}
-			resp := attrResp.Body.Response
-			signature, err := i.signer.CreateSignature(resp.Assertion)
-			// TODO confirm appropriate error response for this service
-			if err != nil {
-				return err
-			}
-			resp.Assertion.Signature = signature
-			if _, err = w.Write([]byte(xml.Header)); err != nil {
+			// Encode before writing so failures can still be reported as faults
+			var b bytes.Buffer
+			b.WriteString(xml.Header)
+			if err = xml.NewEncoder(&b).Encode(env); err != nil {
 				return err
 			}
-			encoder := xml.NewEncoder(w)
-			if err = encoder.Encode(env); err != nil {
-				return err
+			i.debugMessage(messageSent, b.Bytes())
+			w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+			if _, err = w.Write(b.Bytes()); err != nil {
+				log.Errorf("failed to write attribute response: %v", err)
 			}
-			return encoder.Flush()
+			return nil
 		}()
 		if err != nil {
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			writeSOAPFault(w, err)
+		}
+	}
+}
+
+// makeQueryResponse resolves the current attributes of the query's subject with the attribute sources used for
+// single sign-on and releases them to the service provider under its policy. Subjects that can't be resolved get
+// an assertion without attributes. EncryptedIDs are decrypted with the IdP's key.
+func (i *IDP) makeQueryResponse(ctx context.Context, query *saml.AttributeQuery) (*saml.Response, error) {
+	nameID := query.Subject.NameID
+	if nameID == nil && query.Subject.EncryptedID != nil {
+		var err error
+		if nameID, err = i.decryptNameID(query.Subject.EncryptedID); err != nil {
+			return nil, clientFault(err)
 		}
 	}
+	if nameID == nil {
+		return nil, clientFault(errors.New("attribute query doesn't have a NameID"))
+	}
+	name, err := i.querySubject(nameID, query.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	user := &model.User{Name: name, Format: nameID.Format}
+	if name != "" {
+		if err = i.setUserAttributes(ctx, user, nil); err != nil {
+			return nil, err
+		}
+	}
+	response := i.makeResponse(query.ID, query.Issuer, user)
+	response.Assertion.Subject.NameID = nameID
+	response.Assertion.AttributeStatement = requestedAttributes(response.Assertion.AttributeStatement, query.Attribute)
+	return response, nil
+}
+
+// querySubject returns the name of the user identified by a NameID issued to the service provider. Persistent
+// NameIDs are looked up in the pairwise identifiers. Transient NameIDs only identify a user during a session,
+// so they resolve to an empty name, as do persistent NameIDs that aren't found. Other NameIDs hold the name.
+func (i *IDP) querySubject(nameID *saml.NameID, entityID string) (string, error) {
+	switch nameID.Format {
+	case nameIDFormatPersistent:
+		name, err := i.pairwiseIDs.User(entityID, nameID.Value)
+		if err == store.ErrNotFound {
+			return "", nil
+		}
+		return name, err
+	case nameIDFormatTransient:
+		return "", nil
+	}
+	return nameID.Value, nil
+}
+
+// requestedAttributes keeps the attributes that the query asks for. Requested attributes match by name and by
+// NameFormat when it's given. Requested attributes with values only receive those values.
+func requestedAttributes(stmt *saml.AttributeStatement, requested []saml.Attribute) *saml.AttributeStatement {
+	if stmt == nil || len(requested) == 0 {
+		return stmt
+	}
+	filtered := &saml.AttributeStatement{}
+	for _, att := range stmt.Attribute {
+		for _, req := range requested {
+			if req.Name != att.Name ||
+				(req.NameFormat != "" && req.NameFormat != attrNameFormatUnspecified && req.NameFormat != att.NameFormat) {
+				continue
+			}
+			if len(req.AttributeValue) > 0 {
+				values := []saml.AttributeValue{}
+				for _, value := range att.AttributeValue {
+					for _, wanted := range req.AttributeValue {
+						if value.Value == wanted.Value {
+							values = append(values, value)
+							break
+						}
+					}
+				}
+				if len(values) == 0 {
+					break
+				}
+				att.AttributeValue = values
+			}
+			filtered.Attribute = append(filtered.Attribute, att)
+			break
+		}
+	}
+	if len(filtered.Attribute) == 0 {
+		return nil
+	}
+	return filtered
 }
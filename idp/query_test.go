@@ -1,15 +1,22 @@
 package idp
 
 import (
+	"context"
+	"encoding/xml"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestIDP_DefaultQueryHandler(t *testing.T) {
+	// The query was captured in 2018
+	viper.Set("clock-skew", "876000h")
+	defer viper.Set("clock-skew", "3m")
 	i := &IDP{}
 	ts := getTestIDP(t, i)
 	defer ts.Close()
@@ -24,3 +31,94 @@ func TestIDP_DefaultQueryHandler(t *testing.T) {
 	defer resp.Body.Close()
 	assert.Equal(t, 200, resp.StatusCode)
 }
+
+func TestIDP_DefaultQueryHandler_signed(t *testing.T) {
+	viper.Set("clock-skew", "876000h")
+	defer viper.Set("clock-skew", "3m")
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	in, err := os.Open(filepath.Join("testdata", "attribute-query-request.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := ts.Client().Post(ts.URL+viper.GetString("attribute-service-path"), "text/xml", in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	env := &saml.AttributeRespEnv{}
+	if err = xml.NewDecoder(resp.Body).Decode(env); err != nil {
+		t.Fatal(err)
+	}
+	response := env.Body.Response
+	assert.Equal(t, "_f89f4578-fcc9-4348-9b87-f7fe25f7aff3", response.InResponseTo)
+	if assert.NotNil(t, response.Assertion) {
+		assert.NotNil(t, response.Assertion.Signature, "the assertion should be signed")
+		assert.Equal(t, "CN=joe,C=US", response.Assertion.Subject.NameID.Value, "the subject should be the one queried")
+	}
+}
+
+func TestIDP_makeQueryResponse(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.sps.get("dex")
+	sps := []ServiceProvider{*dex}
+	sps[0].ReleaseAttributes = []AttributeRelease{{Attribute: "mail"}, {Attribute: "memberOf"}}
+	viper.Set("sps", sps)
+	defer viper.Set("sps", nil)
+	i = &IDP{AttributeSources: []AttributeSource{&simpleSource{map[string][]*model.Attribute{
+		"joe": {
+			{Name: "mail", Value: []string{"joe@example.com"}},
+			{Name: "memberOf", Value: []string{"admins", "users"}},
+			{Name: "sn", Value: []string{"Smith"}},
+		},
+	}}}}
+	getTestIDP(t, i).Close()
+	query := func(nameID *saml.NameID, requested ...saml.Attribute) *saml.AttributeStatement {
+		response, err := i.makeQueryResponse(context.Background(), &saml.AttributeQuery{
+			RequestAbstractType: saml.RequestAbstractType{ID: "query", Issuer: "dex"},
+			Subject:             saml.Subject{NameID: nameID},
+			Attribute:           requested,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, nameID, response.Assertion.Subject.NameID)
+		return response.Assertion.AttributeStatement
+	}
+	attributes := func(stmt *saml.AttributeStatement) map[string][]string {
+		atts := map[string][]string{}
+		if stmt != nil {
+			for _, att := range stmt.Attribute {
+				for _, value := range att.AttributeValue {
+					atts[att.Name] = append(atts[att.Name], value.Value)
+				}
+			}
+		}
+		return atts
+	}
+
+	joe := &saml.NameID{Format: nameIDFormatUnspecified, Value: "joe"}
+	assert.Equal(t, map[string][]string{
+		"mail":     {"joe@example.com"},
+		"memberOf": {"admins", "users"},
+	}, attributes(query(joe)), "the release policy should apply")
+	assert.Equal(t, map[string][]string{"mail": {"joe@example.com"}},
+		attributes(query(joe, saml.Attribute{Name: "mail", NameFormat: attrNameFormatBasic}, saml.Attribute{Name: "sn"})),
+		"only requested attributes that may be released should be returned")
+	assert.Equal(t, map[string][]string{"memberOf": {"users"}},
+		attributes(query(joe, saml.Attribute{Name: "memberOf", AttributeValue: []saml.AttributeValue{{Value: "users"}, {Value: "guests"}}})),
+		"requested values should limit the values returned")
+	assert.Nil(t, query(joe, saml.Attribute{Name: "mail", NameFormat: attrNameFormatURI}), "NameFormat should match when it's given")
+
+	id, err := i.pairwiseIDs.Get("dex", "joe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, attributes(query(&saml.NameID{Format: nameIDFormatPersistent, Value: id})), "mail",
+		"persistent NameIDs should be resolved to their user")
+	assert.Nil(t, query(&saml.NameID{Format: nameIDFormatPersistent, Value: "unknown"}), "unknown subjects shouldn't have attributes")
+	assert.Nil(t, query(&saml.NameID{Format: nameIDFormatUnspecified, Value: "nobody"}), "unknown subjects shouldn't have attributes")
+	assert.Nil(t, query(&saml.NameID{Format: nameIDFormatTransient, Value: "session"}), "transient NameIDs can't be resolved")
+}
@@ -0,0 +1,211 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/amdonov/lite-idp/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// tooManyAttemptsError is returned when a password login is refused because of the rate limit or a lockout
+type tooManyAttemptsError struct {
+	retryAfter time.Duration
+}
+
+func (e *tooManyAttemptsError) Error() string {
+	return "too many login attempts, try again later"
+}
+
+// writeTooManyAttempts sends 429 Too Many Requests with a Retry-After header in whole seconds
+func writeTooManyAttempts(w http.ResponseWriter, err *tooManyAttemptsError) {
+	seconds := int(math.Ceil(err.retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
+
+// ipBucket is the token bucket for a source IP
+type ipBucket struct {
+	Tokens  float64   `json:"tokens"`
+	Updated time.Time `json:"updated"`
+}
+
+// userFailures counts a user name's failed logins since Start
+type userFailures struct {
+	Count       int       `json:"count"`
+	Start       time.Time `json:"start"`
+	LockedUntil time.Time `json:"lockedUntil,omitempty"`
+}
+
+// authLimiter throttles password logins per source IP with a token bucket and locks out user names after
+// repeated failures. State is kept in the cache so it's shared by IdP instances using the same store. Updates
+// from one instance are serialized, but concurrent attempts on different instances may both be let through.
+type authLimiter struct {
+	cache store.Cache
+	// attempts per minute from one IP, zero disables the limit
+	rate float64
+	// failures within window that lock out a user name, zero disables lockouts
+	threshold int
+	window    time.Duration
+	mu        sync.Mutex
+	now       func() time.Time
+}
+
+func (i *IDP) configureAuthLimits() error {
+	window := i.settings.GetDuration("auth-lockout-window")
+	if window < time.Minute {
+		return fmt.Errorf("auth-lockout-window must be at least 1m")
+	}
+	rate := i.settings.GetFloat64("auth-rate-limit")
+	threshold := i.settings.GetInt("auth-lockout-threshold")
+	if rate < 0 || threshold < 0 {
+		return fmt.Errorf("auth-rate-limit and auth-lockout-threshold can't be negative")
+	}
+	if i.AuthLimitCache == nil {
+		cache, err := i.newCache("authlimit:", window)
+		if err != nil {
+			return err
+		}
+		i.AuthLimitCache = cache
+	}
+	i.authLimiter = &authLimiter{
+		cache:     i.AuthLimitCache,
+		rate:      rate,
+		threshold: threshold,
+		window:    window,
+		now:       time.Now,
+	}
+	return nil
+}
+
+// allow takes a token from the IP's bucket and checks that the user name isn't locked out
+func (l *authLimiter) allow(ip, userName string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if l.rate > 0 {
+		bucket := &ipBucket{Tokens: l.rate, Updated: now}
+		found, err := l.load(ipBucketKey(ip), bucket)
+		if err != nil {
+			return err
+		}
+		if found {
+			// Refill at rate tokens a minute up to a burst of rate
+			bucket.Tokens = math.Min(l.rate, bucket.Tokens+now.Sub(bucket.Updated).Minutes()*l.rate)
+			bucket.Updated = now
+		}
+		if bucket.Tokens < 1 {
+			wait := time.Duration((1 - bucket.Tokens) / l.rate * float64(time.Minute))
+			log.Warnf("rate limiting password logins from %s", ip)
+			return &tooManyAttemptsError{wait}
+		}
+		bucket.Tokens--
+		if err = l.save(ipBucketKey(ip), bucket); err != nil {
+			return err
+		}
+	}
+	if l.threshold > 0 {
+		failures := &userFailures{}
+		if _, err := l.load(userFailuresKey(userName), failures); err != nil {
+			return err
+		}
+		if now.Before(failures.LockedUntil) {
+			return &tooManyAttemptsError{failures.LockedUntil.Sub(now)}
+		}
+	}
+	return nil
+}
+
+// failed counts a failed login for the user name and locks it out when the threshold is reached
+func (l *authLimiter) failed(ip, userName string) error {
+	if l.threshold == 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	failures := &userFailures{}
+	if _, err := l.load(userFailuresKey(userName), failures); err != nil {
+		return err
+	}
+	if now.Sub(failures.Start) > l.window {
+		failures = &userFailures{Start: now}
+	}
+	failures.Count++
+	if failures.Count >= l.threshold {
+		failures.LockedUntil = now.Add(l.window)
+		log.WithFields(log.Fields{
+			"event":    "account_lockout",
+			"user":     userName,
+			"ip":       ip,
+			"failures": failures.Count,
+			"until":    failures.LockedUntil.UTC().Format(time.RFC3339),
+		}).Warnf("locking out %s after %d failed logins", userName, failures.Count)
+		// Start a new window so the user isn't locked out again on the next failure after this one ends
+		failures.Count = 0
+		failures.Start = failures.LockedUntil
+	}
+	return l.save(userFailuresKey(userName), failures)
+}
+
+// succeeded clears the user name's failed logins
+func (l *authLimiter) succeeded(userName string) error {
+	if l.threshold == 0 {
+		return nil
+	}
+	err := l.cache.Delete(userFailuresKey(userName))
+	if err == store.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// load reads the entry into v and reports whether it was found
+func (l *authLimiter) load(key string, v interface{}) (bool, error) {
+	data, err := l.cache.Get(key)
+	if err == store.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func (l *authLimiter) save(key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return l.cache.Set(key, data)
+}
+
+func ipBucketKey(ip string) string {
+	return "auth-ip:" + ip
+}
+
+func userFailuresKey(userName string) string {
+	return "auth-user:" + userName
+}
@@ -0,0 +1,114 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestAuthLimiter(t *testing.T, rate float64, threshold int) (*authLimiter, *time.Time) {
+	cache, err := store.New(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &authLimiter{
+		cache:     cache,
+		rate:      rate,
+		threshold: threshold,
+		window:    15 * time.Minute,
+		now:       func() time.Time { return now },
+	}, &now
+}
+
+func Test_authLimiter_rate(t *testing.T) {
+	l, now := newTestAuthLimiter(t, 2, 0)
+	assert.NoError(t, l.allow("10.0.0.1", "joe"))
+	assert.NoError(t, l.allow("10.0.0.1", "suzy"))
+	err := l.allow("10.0.0.1", "joe")
+	if assert.IsType(t, &tooManyAttemptsError{}, err) {
+		assert.Equal(t, 30*time.Second, err.(*tooManyAttemptsError).retryAfter)
+	}
+	assert.NoError(t, l.allow("10.0.0.2", "joe"), "other addresses have their own bucket")
+	*now = now.Add(30 * time.Second)
+	assert.NoError(t, l.allow("10.0.0.1", "joe"), "the bucket should refill")
+}
+
+func Test_authLimiter_lockout(t *testing.T) {
+	l, now := newTestAuthLimiter(t, 0, 3)
+	for n := 0; n < 3; n++ {
+		assert.NoError(t, l.allow("10.0.0.1", "joe"))
+		assert.NoError(t, l.failed("10.0.0.1", "joe"))
+	}
+	err := l.allow("10.0.0.2", "joe")
+	if assert.IsType(t, &tooManyAttemptsError{}, err, "the lockout applies to every address") {
+		assert.Equal(t, 15*time.Minute, err.(*tooManyAttemptsError).retryAfter)
+	}
+	assert.NoError(t, l.allow("10.0.0.1", "suzy"))
+	*now = now.Add(15 * time.Minute)
+	assert.NoError(t, l.allow("10.0.0.1", "joe"), "the lockout should end after the window")
+
+	// Failures outside the window and successful logins reset the count
+	assert.NoError(t, l.failed("10.0.0.1", "suzy"))
+	assert.NoError(t, l.failed("10.0.0.1", "suzy"))
+	*now = now.Add(16 * time.Minute)
+	assert.NoError(t, l.failed("10.0.0.1", "suzy"))
+	assert.NoError(t, l.failed("10.0.0.1", "suzy"))
+	assert.NoError(t, l.succeeded("suzy"))
+	assert.NoError(t, l.failed("10.0.0.1", "suzy"))
+	assert.NoError(t, l.allow("10.0.0.1", "suzy"))
+}
+
+func TestIDP_DefaultPasswordLoginHandler_lockout(t *testing.T) {
+	viper.Set("auth-lockout-threshold", 2)
+	defer viper.Set("auth-lockout-threshold", 5)
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	data, err := proto.Marshal(&model.AuthnRequest{ID: "2134"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.TempCache.Set("1234", data)
+	client := ts.Client()
+	client.CheckRedirect = func(r *http.Request, old []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	form := url.Values{"requestId": {"1234"}, "username": {"joe"}, "password": {"wrong"}}
+	for n := 0; n < 2; n++ {
+		resp, err := postLoginForm(client, i, ts.URL+"/ui/login.html", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusFound, resp.StatusCode)
+	}
+	resp, err := postLoginForm(client, i, ts.URL+"/ui/login.html", form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "900", resp.Header.Get("Retry-After"))
+}
@@ -0,0 +1,237 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// UnknownServiceProviderError is returned for messages from entities that aren't in the trust registry
+type UnknownServiceProviderError struct {
+	EntityID string
+}
+
+func (e *UnknownServiceProviderError) Error() string {
+	return fmt.Sprintf("%s is not a registered service provider", e.EntityID)
+}
+
+// registry holds the service providers trusted by the IdP indexed by entity ID. Service providers
+// from the sps setting are fixed, those read from the metadata directory are replaced on each scan, and
+// those from metadata URLs are replaced each time a new copy of the metadata is accepted.
+type registry struct {
+	mu         sync.RWMutex
+	configured map[string]*ServiceProvider
+	sps        map[string]*ServiceProvider
+	directory  string
+	// service providers from the last scan of the directory
+	local   map[string]*ServiceProvider
+	sources []*metadataSource
+	// prepare parses keys and sets up signing and encryption for a new service provider
+	prepare func(*ServiceProvider) error
+	stop    chan struct{}
+}
+
+func newRegistry(configured []*ServiceProvider, directory string, sources []*metadataSource,
+	prepare func(*ServiceProvider) error) (*registry, error) {
+	r := &registry{
+		configured: make(map[string]*ServiceProvider, len(configured)),
+		directory:  directory,
+		sources:    sources,
+		prepare:    prepare,
+		stop:       make(chan struct{}),
+	}
+	for _, sp := range configured {
+		if err := prepare(sp); err != nil {
+			return nil, fmt.Errorf("service provider %s: %v", sp.EntityID, err)
+		}
+		r.configured[sp.EntityID] = sp
+	}
+	if err := r.scan(); err != nil {
+		return nil, err
+	}
+	// The IdP starts without a source's service providers if it can't be fetched, and they're added once it can
+	for _, source := range sources {
+		if err := r.refresh(source); err != nil {
+			log.Errorf("failed to load metadata from %s: %v", source.url, err)
+		}
+	}
+	return r, nil
+}
+
+func (r *registry) get(entityID string) (*ServiceProvider, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sp, ok := r.sps[entityID]
+	return sp, ok
+}
+
+// count returns the number of service providers in the registry
+func (r *registry) count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.sps)
+}
+
+// list returns the service providers in the registry sorted by entity ID
+func (r *registry) list() []*ServiceProvider {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	sps := make([]*ServiceProvider, 0, len(r.sps))
+	for _, sp := range r.sps {
+		sps = append(sps, sp)
+	}
+	sort.Slice(sps, func(i, j int) bool { return sps[i].EntityID < sps[j].EntityID })
+	return sps
+}
+
+// sourceErrors reports whether the last refresh of each metadata URL succeeded
+func (r *registry) sourceErrors() []CheckResult {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	results := make([]CheckResult, 0, len(r.sources))
+	for _, source := range r.sources {
+		results = append(results, CheckResult{
+			fmt.Sprintf("metadata from %s (%d loaded)", source.url, len(source.sps)), source.err})
+	}
+	return results
+}
+
+// scan rereads the metadata directory. The registry is unchanged if any file can't be loaded.
+func (r *registry) scan() error {
+	local := map[string]*ServiceProvider{}
+	if r.directory != "" {
+		files, err := ioutil.ReadDir(r.directory)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if file.IsDir() || !strings.HasSuffix(file.Name(), ".xml") {
+				continue
+			}
+			path := filepath.Join(r.directory, file.Name())
+			sp, err := readSPMetadataFile(path)
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %v", path, err)
+			}
+			if err = r.prepare(sp); err != nil {
+				return fmt.Errorf("failed to load %s: %v", path, err)
+			}
+			if other, ok := local[sp.EntityID]; ok {
+				return fmt.Errorf("%s and %s both describe %s", other.source, path, sp.EntityID)
+			}
+			local[sp.EntityID] = sp
+		}
+	}
+	r.mu.Lock()
+	r.local = local
+	r.merge()
+	r.mu.Unlock()
+	return nil
+}
+
+// merge rebuilds the service providers from each source. The sps setting takes precedence over the metadata
+// directory, which takes precedence over metadata URLs, and earlier URLs take precedence over later ones.
+// It's called with mu locked.
+func (r *registry) merge() {
+	sps := make(map[string]*ServiceProvider, len(r.configured)+len(r.local))
+	for _, source := range r.sources {
+		for entityID, sp := range source.sps {
+			if _, ok := sps[entityID]; !ok {
+				sps[entityID] = sp
+			}
+		}
+	}
+	for entityID, sp := range r.local {
+		sps[entityID] = sp
+	}
+	for entityID, sp := range r.configured {
+		if other, ok := r.local[entityID]; ok {
+			log.Warnf("ignoring %s, %s is configured in the sps setting", other.source, entityID)
+		}
+		sps[entityID] = sp
+	}
+	r.sps = sps
+}
+
+// watch rescans the metadata directory every interval until close is called
+func (r *registry) watch(interval time.Duration) {
+	r.every(interval, func() {
+		if err := r.scan(); err != nil {
+			log.Errorf("failed to rescan metadata directory, keeping the current service providers: %v", err)
+		}
+	})
+}
+
+// watchSources refreshes the metadata from URLs every interval until close is called
+func (r *registry) watchSources(interval time.Duration) {
+	r.every(interval, func() {
+		for _, source := range r.sources {
+			if err := r.refresh(source); err != nil {
+				log.Errorf("failed to refresh metadata from %s, keeping the last good copy: %v", source.url, err)
+			}
+		}
+	})
+}
+
+// every calls f every interval until close is called
+func (r *registry) every(interval time.Duration, f func()) {
+	stop := r.stop
+	ticker := time.NewTicker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				f()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (r *registry) close() {
+	if r.stop != nil {
+		close(r.stop)
+		r.stop = nil
+	}
+}
+
+func readSPMetadataFile(path string) (*ServiceProvider, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sp, err := ReadSPMetadata(f)
+	if err != nil {
+		return nil, err
+	}
+	if sp.EntityID == "" {
+		return nil, errors.New("metadata does not contain an entityID")
+	}
+	sp.source = path
+	return sp, nil
+}
@@ -0,0 +1,134 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeMetadataDirectory(t *testing.T) string {
+	metadata, err := ioutil.ReadFile(filepath.Join("testdata", "sp-metadata.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err = ioutil.WriteFile(filepath.Join(dir, "dex.xml"), metadata, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Only XML files are read
+	if err = ioutil.WriteFile(filepath.Join(dir, "README"), []byte("ignored"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestIDP_ServiceProvider_metadataDirectory(t *testing.T) {
+	dir := writeMetadataDirectory(t)
+	viper.Set("metadata-directory", dir)
+	defer viper.Set("metadata-directory", "")
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	defer i.Close()
+	sp, ok := i.ServiceProvider("dex")
+	if !assert.True(t, ok, "service provider from the directory should be registered") {
+		return
+	}
+	assert.Equal(t, "http://127.0.0.1:5556/dex/callback", sp.AssertionConsumerServices[0].Location)
+	assert.NotEmpty(t, sp.Certificate)
+	_, ok = i.ServiceProvider("other")
+	assert.False(t, ok)
+
+	// New files are picked up on the next scan
+	metadata, _ := ioutil.ReadFile(filepath.Join(dir, "dex.xml"))
+	other := strings.Replace(string(metadata), `entityID="dex"`, `entityID="other"`, 1)
+	if err := ioutil.WriteFile(filepath.Join(dir, "other.xml"), []byte(other), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.sps.scan(); err != nil {
+		t.Fatal(err)
+	}
+	_, ok = i.ServiceProvider("other")
+	assert.True(t, ok, "rescan should add new service providers")
+
+	// A broken file leaves the registry as it was
+	ioutil.WriteFile(filepath.Join(dir, "broken.xml"), []byte("<EntityDescriptor"), 0644)
+	assert.Error(t, i.sps.scan())
+	_, ok = i.ServiceProvider("other")
+	assert.True(t, ok)
+}
+
+func TestIDP_ServiceProvider_configuredPrecedence(t *testing.T) {
+	viper.Set("metadata-directory", writeMetadataDirectory(t))
+	defer viper.Set("metadata-directory", "")
+	f, err := os.Open(filepath.Join("testdata", "sp-metadata.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	configured, err := ReadSPMetadata(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configured.AssertionConsumerServices = []AssertionConsumerService{{
+		IsDefault: true,
+		Binding:   postBinding,
+		Location:  "https://configured.example.com/acs",
+	}}
+	viper.Set("sps", []ServiceProvider{*configured})
+	defer viper.Set("sps", nil)
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	defer i.Close()
+	sp, _ := i.ServiceProvider("dex")
+	assert.Equal(t, "https://configured.example.com/acs", sp.AssertionConsumerServices[0].Location)
+}
+
+func TestIDP_DefaultPostSSOHandler_unknownServiceProvider(t *testing.T) {
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	data, err := xml.Marshal(&saml.AuthnRequest{
+		RequestAbstractType: saml.RequestAbstractType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now(),
+			Issuer:       "https://unknown.example.com/",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{}
+	form.Set("SAMLRequest", base64.StdEncoding.EncodeToString(data))
+	r := httptest.NewRequest("POST", viper.GetString("sso-service-path"), strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	i.PostSSOHandler(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.NotContains(t, w.Body.String(), "https://unknown.example.com/", "the error is only logged")
+}
@@ -0,0 +1,201 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/amdonov/lite-idp/model"
+	log "github.com/sirupsen/logrus"
+)
+
+// AttributeRelease allows an attribute to be released to a service provider
+type AttributeRelease struct {
+	Attribute string
+	// Regular expressions matching the whole of the values that may be released. All values are released if it's empty.
+	Values []string
+}
+
+// AttributeBundle is a named set of attribute release rules, such as the attributes an entity category calls for
+type AttributeBundle struct {
+	Name       string
+	Attributes []AttributeRelease
+}
+
+// CategoryRelease releases an attribute bundle to service providers in an entity category
+type CategoryRelease struct {
+	Category string
+	Bundle   string
+}
+
+// releasePolicy limits the attributes released to a service provider. A nil policy releases
+// every attribute when attribute-release-default is allow and none when it's deny.
+type releasePolicy struct {
+	// allowed value patterns by attribute, nil to allow every value
+	attributes map[string][]*regexp.Regexp
+}
+
+func newReleasePolicy(rules []AttributeRelease) (*releasePolicy, error) {
+	if rules == nil {
+		return nil, nil
+	}
+	policy := &releasePolicy{attributes: map[string][]*regexp.Regexp{}}
+	for _, rule := range rules {
+		if rule.Attribute == "" {
+			return nil, errors.New("attribute release rules must name an attribute")
+		}
+		patterns, seen := policy.attributes[rule.Attribute]
+		// A rule without values releases every value, even if another rule lists some
+		if len(rule.Values) == 0 || (seen && patterns == nil) {
+			policy.attributes[rule.Attribute] = nil
+			continue
+		}
+		for _, value := range rule.Values {
+			pattern, err := regexp.Compile("^(?:" + value + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid value pattern for %s: %v", rule.Attribute, err)
+			}
+			patterns = append(patterns, pattern)
+		}
+		policy.attributes[rule.Attribute] = patterns
+	}
+	return policy, nil
+}
+
+// filter returns the attributes and values the policy allows along with the names of attributes that were
+// dropped entirely and those that lost some values
+func (p *releasePolicy) filter(atts []*model.Attribute) (released []*model.Attribute, dropped, reduced []string) {
+	for _, att := range atts {
+		patterns, ok := p.attributes[att.Name]
+		if !ok {
+			dropped = append(dropped, att.Name)
+			continue
+		}
+		if patterns == nil {
+			released = append(released, att)
+			continue
+		}
+		values := []string{}
+		for _, value := range att.Value {
+			for _, pattern := range patterns {
+				if pattern.MatchString(value) {
+					values = append(values, value)
+					break
+				}
+			}
+		}
+		switch {
+		case len(values) == 0:
+			dropped = append(dropped, att.Name)
+		case len(values) < len(att.Value):
+			reduced = append(reduced, att.Name)
+			released = append(released, &model.Attribute{Name: att.Name, Value: values})
+		default:
+			released = append(released, att)
+		}
+	}
+	return released, dropped, reduced
+}
+
+func (i *IDP) configureAttributeRelease() error {
+	switch mode := i.settings.GetString("attribute-release-default"); mode {
+	case "allow", "deny":
+		i.releaseByDefault = mode == "allow"
+	default:
+		return fmt.Errorf("attribute-release-default must be allow or deny, not %q", mode)
+	}
+	bundles := []AttributeBundle{}
+	if err := i.settings.UnmarshalKey("attribute-bundles", &bundles); err != nil {
+		return err
+	}
+	rules := map[string][]AttributeRelease{}
+	for _, bundle := range bundles {
+		if bundle.Name == "" {
+			return errors.New("attribute bundles must have a name")
+		}
+		if _, ok := rules[bundle.Name]; ok {
+			return fmt.Errorf("attribute bundle %s is defined more than once", bundle.Name)
+		}
+		if _, err := newReleasePolicy(bundle.Attributes); err != nil {
+			return fmt.Errorf("attribute bundle %s: %v", bundle.Name, err)
+		}
+		rules[bundle.Name] = append([]AttributeRelease{}, bundle.Attributes...)
+	}
+	categories := []CategoryRelease{}
+	if err := i.settings.UnmarshalKey("entity-category-release", &categories); err != nil {
+		return err
+	}
+	i.categoryRelease = map[string][]AttributeRelease{}
+	for _, category := range categories {
+		if category.Category == "" {
+			return errors.New("entity-category-release entries must name a category")
+		}
+		bundle, ok := rules[category.Bundle]
+		if !ok {
+			return fmt.Errorf("entity category %s releases unknown attribute bundle %q", category.Category, category.Bundle)
+		}
+		i.categoryRelease[category.Category] = append(i.categoryRelease[category.Category], bundle...)
+	}
+	return nil
+}
+
+// releaseRules returns the service provider's own release rules or, if it doesn't have any, those of the bundles
+// for its entity categories. It returns nil if neither applies, so attribute-release-default is used.
+func (i *IDP) releaseRules(sp *ServiceProvider) []AttributeRelease {
+	if sp.ReleaseAttributes != nil {
+		return sp.ReleaseAttributes
+	}
+	var rules []AttributeRelease
+	for _, category := range sp.EntityCategories {
+		if bundle, ok := i.categoryRelease[category]; ok {
+			// An empty bundle still overrides the default
+			if rules == nil {
+				rules = []AttributeRelease{}
+			}
+			rules = append(rules, bundle...)
+		}
+	}
+	return rules
+}
+
+// releasedAttributes returns the user's attributes that may be released to the service provider or OpenID Connect
+// client. Filtered attributes are logged so releases can be audited.
+func (i *IDP) releasedAttributes(user *model.User, entityID string) []*model.Attribute {
+	var policy *releasePolicy
+	if sp, ok := i.sps.get(entityID); ok {
+		policy = sp.releasePolicy
+	} else if client, ok := i.oidcClients[entityID]; ok {
+		policy = client.releasePolicy
+	}
+	if policy == nil {
+		if i.releaseByDefault {
+			return user.Attributes
+		}
+		policy = &releasePolicy{}
+	}
+	released, dropped, reduced := policy.filter(user.Attributes)
+	if len(dropped) > 0 || len(reduced) > 0 {
+		log.WithFields(log.Fields{
+			"event":           "attributes_filtered",
+			"user":            user.Name,
+			"sp":              entityID,
+			"dropped":         dropped,
+			"values_filtered": reduced,
+		}).Info("attributes withheld by release policy")
+	}
+	return released
+}
@@ -0,0 +1,148 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const researchAndScholarship = "http://refeds.org/category/research-and-scholarship"
+
+func Test_newReleasePolicy(t *testing.T) {
+	policy, err := newReleasePolicy(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, policy, "service providers without rules should use the default")
+	_, err = newReleasePolicy([]AttributeRelease{{Values: []string{"x"}}})
+	assert.Error(t, err, "rules need an attribute")
+	_, err = newReleasePolicy([]AttributeRelease{{Attribute: "memberOf", Values: []string{"("}}})
+	assert.Error(t, err, "value patterns must compile")
+	policy, err = newReleasePolicy([]AttributeRelease{
+		{Attribute: "memberOf", Values: []string{"admins"}},
+		{Attribute: "memberOf"},
+	})
+	if assert.NoError(t, err) {
+		assert.Nil(t, policy.attributes["memberOf"], "a rule without values should release every value")
+	}
+}
+
+func Test_releasePolicy_filter(t *testing.T) {
+	policy, err := newReleasePolicy([]AttributeRelease{
+		{Attribute: "mail"},
+		{Attribute: "memberOf", Values: []string{"app-.*"}},
+		{Attribute: "title", Values: []string{"Manager"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	released, dropped, reduced := policy.filter([]*model.Attribute{
+		{Name: "mail", Value: []string{"joe@example.com"}},
+		{Name: "memberOf", Value: []string{"app-users", "domain-admins", "my-app-admins"}},
+		{Name: "title", Value: []string{"Engineer"}},
+		{Name: "sn", Value: []string{"Smith"}},
+	})
+	assert.Equal(t, []*model.Attribute{
+		{Name: "mail", Value: []string{"joe@example.com"}},
+		{Name: "memberOf", Value: []string{"app-users"}},
+	}, released, "patterns should match whole values")
+	assert.Equal(t, []string{"title", "sn"}, dropped)
+	assert.Equal(t, []string{"memberOf"}, reduced)
+}
+
+func TestIDP_releasedAttributes(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.sps.get("dex")
+	sps := []ServiceProvider{*dex}
+	sps[0].ReleaseAttributes = []AttributeRelease{{Attribute: "uid"}}
+	viper.Set("sps", sps)
+	defer viper.Set("sps", nil)
+	user := &model.User{Name: "joe", Attributes: []*model.Attribute{
+		{Name: "uid", Value: []string{"joe"}},
+		{Name: "sn", Value: []string{"Smith"}},
+	}}
+
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	assert.Equal(t, user.Attributes, i.releasedAttributes(user, "other"), "allow should release everything without rules")
+	assert.Equal(t, user.Attributes[:1], i.releasedAttributes(user, "dex"))
+
+	viper.Set("attribute-release-default", "deny")
+	defer viper.Set("attribute-release-default", "allow")
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	assert.Empty(t, i.releasedAttributes(user, "other"), "deny should release nothing without rules")
+	assert.Nil(t, i.attributeStatement(user, "other"), "assertions shouldn't have empty attribute statements")
+	assert.Equal(t, user.Attributes[:1], i.releasedAttributes(user, "dex"))
+
+	viper.Set("attribute-release-default", "some")
+	assert.Error(t, (&IDP{settings: viper.GetViper()}).configureAttributeRelease())
+}
+
+func TestIDP_releasedAttributes_entityCategories(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.sps.get("dex")
+	rs, explicit, other := *dex, *dex, *dex
+	rs.EntityID, rs.EntityCategories = "rs", []string{researchAndScholarship}
+	explicit.EntityID, explicit.EntityCategories = "explicit", []string{researchAndScholarship}
+	explicit.ReleaseAttributes = []AttributeRelease{{Attribute: "sn"}}
+	other.EntityID, other.EntityCategories = "other", []string{"https://example.com/category"}
+	viper.Set("sps", []ServiceProvider{rs, explicit, other})
+	viper.Set("attribute-release-default", "deny")
+	viper.Set("attribute-bundles", []AttributeBundle{{Name: "rs", Attributes: []AttributeRelease{{Attribute: "uid"}, {Attribute: "mail"}}}})
+	viper.Set("entity-category-release", []CategoryRelease{{Category: researchAndScholarship, Bundle: "rs"}})
+	defer viper.Set("sps", nil)
+	defer viper.Set("attribute-release-default", "allow")
+	defer viper.Set("attribute-bundles", nil)
+	defer viper.Set("entity-category-release", nil)
+	user := &model.User{Name: "joe", Attributes: []*model.Attribute{
+		{Name: "uid", Value: []string{"joe"}},
+		{Name: "mail", Value: []string{"joe@example.com"}},
+		{Name: "sn", Value: []string{"Smith"}},
+	}}
+
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	assert.Equal(t, user.Attributes[:2], i.releasedAttributes(user, "rs"), "the category's bundle should be released")
+	assert.Equal(t, user.Attributes[2:], i.releasedAttributes(user, "explicit"), "explicit rules should take precedence")
+	assert.Empty(t, i.releasedAttributes(user, "other"), "the default should apply to other categories")
+}
+
+func TestIDP_configureAttributeRelease_bundles(t *testing.T) {
+	i := &IDP{settings: viper.GetViper()}
+	defer viper.Set("attribute-bundles", nil)
+	defer viper.Set("entity-category-release", nil)
+
+	viper.Set("attribute-bundles", []AttributeBundle{{Attributes: []AttributeRelease{{Attribute: "uid"}}}})
+	assert.Error(t, i.configureAttributeRelease(), "bundles need a name")
+	viper.Set("attribute-bundles", []AttributeBundle{{Name: "rs"}, {Name: "rs"}})
+	assert.Error(t, i.configureAttributeRelease(), "bundle names must be unique")
+	viper.Set("attribute-bundles", []AttributeBundle{{Name: "rs", Attributes: []AttributeRelease{{Values: []string{"x"}}}}})
+	assert.Error(t, i.configureAttributeRelease(), "bundle rules must be valid")
+
+	viper.Set("attribute-bundles", []AttributeBundle{{Name: "rs", Attributes: []AttributeRelease{{Attribute: "uid"}}}})
+	viper.Set("entity-category-release", []CategoryRelease{{Category: researchAndScholarship, Bundle: "missing"}})
+	assert.Error(t, i.configureAttributeRelease(), "categories must release a defined bundle")
+	viper.Set("entity-category-release", []CategoryRelease{{Bundle: "rs"}})
+	assert.Error(t, i.configureAttributeRelease(), "entries need a category")
+	viper.Set("entity-category-release", []CategoryRelease{{Category: researchAndScholarship, Bundle: "rs"}})
+	if assert.NoError(t, i.configureAttributeRelease()) {
+		assert.Equal(t, []AttributeRelease{{Attribute: "uid"}}, i.categoryRelease[researchAndScholarship])
+	}
+}
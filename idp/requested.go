@@ -0,0 +1,125 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	log "github.com/sirupsen/logrus"
+)
+
+// requestUnsupportedStatus tells a service provider that the IdP doesn't know the attribute consuming service its
+// request selected
+var requestUnsupportedStatus = &saml.Status{
+	StatusCode: saml.StatusCode{
+		Value: "urn:oasis:names:tc:SAML:2.0:status:Requester",
+		StatusCode: &saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:RequestUnsupported",
+		},
+	},
+}
+
+// unknownAttributeServiceError is returned for AuthnRequests whose AttributeConsumingServiceIndex isn't in the
+// service provider's metadata
+type unknownAttributeServiceError struct {
+	entityID string
+	index    uint32
+}
+
+func (e *unknownAttributeServiceError) Error() string {
+	return fmt.Sprintf("%s has no attribute consuming service with index %d", e.entityID, e.index)
+}
+
+// missingAttributesStatus tells a service provider that attributes it requires can't be released to it
+func missingAttributesStatus(missing []string) *saml.Status {
+	return &saml.Status{
+		StatusCode: saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:Responder",
+			StatusCode: &saml.StatusCode{
+				Value: "urn:oasis:names:tc:SAML:2.0:status:RequestDenied",
+			},
+		},
+		StatusMessage: fmt.Sprintf("required attributes aren't available: %s", strings.Join(missing, ", ")),
+	}
+}
+
+// attributeConsumingService returns the service provider's attribute consuming service with the index, or nil if
+// it doesn't have one
+func (sp *ServiceProvider) attributeConsumingService(index uint32) *AttributeConsumingService {
+	for n := range sp.AttributeConsumingServices {
+		if sp.AttributeConsumingServices[n].Index == index {
+			return &sp.AttributeConsumingServices[n]
+		}
+	}
+	return nil
+}
+
+// checkAttributeConsumingService returns an unknownAttributeServiceError if the request selects an attribute
+// consuming service the service provider doesn't have
+func checkAttributeConsumingService(sp *ServiceProvider, index *uint32) error {
+	if index == nil || sp.attributeConsumingService(*index) != nil {
+		return nil
+	}
+	return &unknownAttributeServiceError{sp.EntityID, *index}
+}
+
+// requestedAttributeStatement keeps the released attributes that the attribute consuming service requests. It also
+// returns the names of the required attributes that aren't in the statement.
+func requestedAttributeStatement(stmt *saml.AttributeStatement, service *AttributeConsumingService) (*saml.AttributeStatement, []string) {
+	requested := make([]saml.Attribute, len(service.RequestedAttributes))
+	for n, attribute := range service.RequestedAttributes {
+		requested[n] = saml.Attribute{Name: attribute.Name, NameFormat: attribute.NameFormat}
+		for _, value := range attribute.Values {
+			requested[n].AttributeValue = append(requested[n].AttributeValue, saml.AttributeValue{Value: value})
+		}
+	}
+	stmt = requestedAttributes(stmt, requested)
+	var missing []string
+	for n, attribute := range service.RequestedAttributes {
+		if attribute.Required && requestedAttributes(stmt, requested[n:n+1]) == nil {
+			missing = append(missing, attribute.Name)
+		}
+	}
+	return stmt, missing
+}
+
+// restrictToRequestedAttributes limits the assertion's attributes to those of the attribute consuming service the
+// request selected, if it selected one. It returns the status to send instead of the assertion when the service is
+// no longer in the metadata or required attributes can't be released.
+func (i *IDP) restrictToRequestedAttributes(request *model.AuthnRequest, user *model.User, assertion *saml.Assertion) *saml.Status {
+	if !request.HasAttributeConsumingServiceIndex {
+		return nil
+	}
+	var service *AttributeConsumingService
+	if sp, ok := i.sps.get(request.Issuer); ok {
+		service = sp.attributeConsumingService(request.AttributeConsumingServiceIndex)
+	}
+	if service == nil {
+		log.Warnf("unable to respond to %s: %v", request.Issuer,
+			&unknownAttributeServiceError{request.Issuer, request.AttributeConsumingServiceIndex})
+		return requestUnsupportedStatus
+	}
+	stmt, missing := requestedAttributeStatement(assertion.AttributeStatement, service)
+	if len(missing) > 0 {
+		log.Warnf("unable to respond to %s: it requires attributes of %s that can't be released: %s",
+			request.Issuer, user.Name, strings.Join(missing, ", "))
+		return missingAttributesStatus(missing)
+	}
+	assertion.AttributeStatement = stmt
+	return nil
+}
@@ -0,0 +1,148 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_requestedAttributeStatement(t *testing.T) {
+	stmt := &saml.AttributeStatement{Attribute: []saml.Attribute{
+		{Name: "mail", NameFormat: attrNameFormatBasic, AttributeValue: []saml.AttributeValue{{Value: "joe@example.com"}}},
+		{Name: "memberOf", NameFormat: attrNameFormatBasic, AttributeValue: []saml.AttributeValue{{Value: "admins"}, {Value: "users"}}},
+		{Name: "uid", NameFormat: attrNameFormatBasic, AttributeValue: []saml.AttributeValue{{Value: "joe"}}},
+	}}
+	service := &AttributeConsumingService{RequestedAttributes: []RequestedAttribute{
+		{Name: "mail", Required: true},
+		{Name: "memberOf", Values: []string{"users"}},
+		{Name: "uid", NameFormat: attrNameFormatURI},
+	}}
+	filtered, missing := requestedAttributeStatement(stmt, service)
+	assert.Empty(t, missing)
+	if assert.NotNil(t, filtered) && assert.Len(t, filtered.Attribute, 2, "only requested attributes should be kept") {
+		assert.Equal(t, "mail", filtered.Attribute[0].Name)
+		assert.Equal(t, []saml.AttributeValue{{Value: "users"}}, filtered.Attribute[1].AttributeValue,
+			"only requested values should be kept")
+	}
+
+	service.RequestedAttributes = append(service.RequestedAttributes,
+		RequestedAttribute{Name: "eduPersonPrincipalName", Required: true},
+		RequestedAttribute{Name: "memberOf", Values: []string{"auditors"}, Required: true})
+	_, missing = requestedAttributeStatement(stmt, service)
+	assert.Equal(t, []string{"eduPersonPrincipalName", "memberOf"}, missing)
+	_, missing = requestedAttributeStatement(nil, service)
+	assert.Equal(t, []string{"mail", "eduPersonPrincipalName", "memberOf"}, missing)
+}
+
+func TestIDP_makeAuthnResponse_attributeConsumingService(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.sps.get("dex")
+	sps := []ServiceProvider{*dex}
+	sps[0].AttributeConsumingServices = []AttributeConsumingService{
+		{Index: 0, RequestedAttributes: []RequestedAttribute{{Name: "uid"}}},
+		{Index: 1, RequestedAttributes: []RequestedAttribute{{Name: "mail", Required: true}}},
+		{Index: 2, RequestedAttributes: []RequestedAttribute{{Name: "mail"}, {Name: "uid", Required: true}}},
+	}
+	viper.Set("sps", sps)
+	defer viper.Set("sps", nil)
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	user := newTestUser()
+	user.Attributes = append(user.Attributes, &model.Attribute{Name: "sn", Value: []string{"Smith"}})
+
+	response, err := i.makeAuthnResponse(&model.AuthnRequest{Issuer: "dex"}, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, response.Assertion.AttributeStatement.Attribute, 2, "requests without an index get every released attribute")
+
+	request := &model.AuthnRequest{Issuer: "dex", HasAttributeConsumingServiceIndex: true, AttributeConsumingServiceIndex: 1}
+	response, err = i.makeAuthnResponse(request, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, response.Assertion) && assert.Len(t, response.Assertion.AttributeStatement.Attribute, 1) {
+		assert.Equal(t, "mail", response.Assertion.AttributeStatement.Attribute[0].Name)
+	}
+
+	request.AttributeConsumingServiceIndex = 0
+	response, err = i.makeAuthnResponse(request, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, response.Assertion, "index 0 is a valid index") {
+		assert.Nil(t, response.Assertion.AttributeStatement, "the user has none of the requested attributes")
+	}
+
+	request.AttributeConsumingServiceIndex = 2
+	response, err = i.makeAuthnResponse(request, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, response.Assertion, "required attributes are missing")
+	assert.Equal(t, loginDeniedStatus, decodedStatus(response.Status))
+	assert.True(t, strings.HasSuffix(response.Status.StatusMessage, ": uid"), response.Status.StatusMessage)
+
+	request.AttributeConsumingServiceIndex = 3
+	response, err = i.makeAuthnResponse(request, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(t, response.Assertion)
+	assert.Equal(t, requestUnsupportedStatus, response.Status)
+}
+
+func TestIDP_DefaultPostSSOHandler_attributeConsumingService(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	index := uint32(5)
+	loginReq := newTestAuthnRequest()
+	loginReq.AttributeConsumingServiceIndex = &index
+	assert.Equal(t, requestUnsupportedStatus, redirectedStatus(t, i, postAuthnRequest(t, i, loginReq, true)),
+		"the service provider has no attribute consuming services")
+}
+
+func TestReadSPMetadata_attributeConsumingService(t *testing.T) {
+	metadata := `<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata"
+    xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" entityID="https://sp.example.com/">
+  <md:SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:AssertionConsumerService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="https://sp.example.com/acs" index="0"/>
+    <md:AttributeConsumingService index="1" isDefault="true">
+      <md:ServiceName xml:lang="en">Wiki</md:ServiceName>
+      <md:RequestedAttribute Name="urn:oid:0.9.2342.19200300.100.1.3"
+          NameFormat="urn:oasis:names:tc:SAML:2.0:attrname-format:uri" isRequired="true"/>
+      <md:RequestedAttribute Name="memberOf">
+        <saml:AttributeValue> staff </saml:AttributeValue>
+      </md:RequestedAttribute>
+    </md:AttributeConsumingService>
+  </md:SPSSODescriptor>
+</md:EntityDescriptor>`
+	sp, err := ReadSPMetadata(strings.NewReader(metadata))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []AttributeConsumingService{{Index: 1, RequestedAttributes: []RequestedAttribute{
+		{Name: "urn:oid:0.9.2342.19200300.100.1.3", NameFormat: attrNameFormatURI, Required: true},
+		{Name: "memberOf", Values: []string{"staff"}},
+	}}}, sp.AttributeConsumingServices)
+}
@@ -0,0 +1,78 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/amdonov/lite-idp/tracing"
+)
+
+type requestInfoKey struct{}
+
+// requestInfo collects details about a request while the IDP handles it
+type requestInfo struct {
+	serviceProvider string
+	clientIP        net.IP
+	correlationID   string
+}
+
+// WithRequestInfo returns a shallow copy of r that records details about the request, such as the service provider
+// it's for, while the IDP handles it. Access logs can read them with ServiceProviderFor once the request is handled.
+func WithRequestInfo(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, &requestInfo{}))
+}
+
+// ServiceProviderFor returns the entity ID of the trusted service provider that a request from WithRequestInfo was for
+// or an empty string if it isn't known
+func ServiceProviderFor(r *http.Request) string {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.serviceProvider
+	}
+	return ""
+}
+
+// ClientIPFor returns the address of the client that sent a request from WithRequestInfo through trusted proxies
+// or nil if the request didn't come from a trusted proxy
+func ClientIPFor(r *http.Request) net.IP {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.clientIP
+	}
+	return nil
+}
+
+// CorrelationIDFor returns the ID shown on the error page for a request from WithRequestInfo and logged with the
+// error or an empty string if the request didn't fail
+func CorrelationIDFor(r *http.Request) string {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		return info.correlationID
+	}
+	return ""
+}
+
+func recordServiceProvider(r *http.Request, entityID string) {
+	tracing.SpanFromContext(r.Context()).SetAttributes(tracing.String("saml.sp", entityID))
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.serviceProvider = entityID
+	}
+}
+
+func recordCorrelationID(r *http.Request, id string) {
+	if info, ok := r.Context().Value(requestInfoKey{}).(*requestInfo); ok {
+		info.correlationID = id
+	}
+}
@@ -0,0 +1,47 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServiceProviderFor(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i)
+	for issuer, want := range map[string]string{"dex": "dex", "unknown": ""} {
+		data, err := proto.Marshal(&model.AuthnRequest{ID: "2134", Issuer: issuer})
+		if err != nil {
+			t.Fatal(err)
+		}
+		i.TempCache.Set("1234", data)
+		r := httptest.NewRequest("POST", "/ui/login.html", strings.NewReader(url.Values{
+			"requestId": {"1234"}, csrfField: {csrfToken(testLoginCookie, "1234")}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: i.loginCookieName(), Value: testLoginCookie})
+		r = WithRequestInfo(r)
+		i.PasswordLoginHandler(httptest.NewRecorder(), r)
+		assert.Equal(t, want, ServiceProviderFor(r), "only trusted service providers should be recorded")
+	}
+	assert.Equal(t, "", ServiceProviderFor(httptest.NewRequest("GET", "/", nil)))
+}
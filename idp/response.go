@@ -15,56 +15,245 @@
 package idp
 
 import (
+	"context"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/binary"
 	"errors"
-	"net"
+	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/amdonov/lite-idp/dsig"
 	"github.com/amdonov/lite-idp/model"
 	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/tracing"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
 )
 
 func (i *IDP) respond(authRequest *model.AuthnRequest, user *model.User,
 	w http.ResponseWriter, r *http.Request) error {
+	// Continue an existing session for the same user or start a new one
+	session, current := i.getSession(r)
+	if current != nil && current.Name == user.Name {
+		user.SessionIndex = current.SessionIndex
+		user.ServiceProviders = current.ServiceProviders
+		user.TransientKey = current.TransientKey
+		// A forced login gets a new session cookie. Service providers in the session are kept for single logout.
+		if authRequest.ForceAuthn {
+			if err := i.UserCache.Delete(session); err != nil {
+				return err
+			}
+			session = uuid.New().String()
+		}
+	} else {
+		session = uuid.New().String()
+		user.SessionIndex = saml.NewID()
+		user.ServiceProviders = nil
+		user.TransientKey = newTransientKey()
+	}
+	// Users who just logged in start the absolute timeout, and every use of the session restarts the idle timeout
+	if user.AuthnInstant == nil {
+		user.AuthnInstant = ptypes.TimestampNow()
+	}
+	user.LastActivity = ptypes.TimestampNow()
+	// Track service providers for single logout
+	if authRequest.Issuer != "" && !containsString(user.ServiceProviders, authRequest.Issuer) {
+		user.ServiceProviders = append(user.ServiceProviders, authRequest.Issuer)
+	}
 	// Save user information and set session cookie
+	user.SessionID = session
 	data, err := proto.Marshal(user)
 	if err != nil {
 		return err
 	}
-	session := uuid.New().String()
-	err = i.UserCache.Set(session, data)
+	err = tracedSet(r.Context(), "user", i.UserCache, session, data)
 	if err != nil {
 		return err
 	}
-	http.SetCookie(w, &http.Cookie{
-		Name:     i.cookieName,
-		Path:     "/",
-		Value:    session,
-		Secure:   true,
-		HttpOnly: true,
-	})
+	http.SetCookie(w, i.sessionCookie(session))
+	if asked, err := i.askConsent(authRequest, user, w, r); err != nil || asked {
+		return err
+	}
+	return i.sendResponse(authRequest, user, w, r)
+}
+
+// sendResponse answers the request for the user with the binding it asked for
+func (i *IDP) sendResponse(authRequest *model.AuthnRequest, user *model.User,
+	w http.ResponseWriter, r *http.Request) error {
 	switch authRequest.ProtocolBinding {
-	case "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact":
+	case artifactBinding:
 		return i.sendArtifactResponse(authRequest, user, w, r)
-	case "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST":
+	case postBinding:
 		return i.sendPostResponse(authRequest, user, w, r)
+	case oidcBinding:
+		return i.sendAuthorizationCode(authRequest, user, w, r)
 	default:
 		return errors.New("unsupported protocol binding")
 	}
 }
 
-func (i *IDP) makeAuthnResponse(request *model.AuthnRequest, user *model.User) *saml.Response {
+const (
+	// where responses are signed for service providers
+	signatureLocationAssertion = "assertion"
+	signatureLocationResponse  = "response"
+	signatureLocationBoth      = "both"
+)
+
+// validateSignatureLocation checks that the service provider's signature location is supported and that service
+// providers that want signed assertions get them
+func (sp *ServiceProvider) validateSignatureLocation() error {
+	switch sp.SignatureLocation {
+	case "", signatureLocationAssertion, signatureLocationBoth:
+		return nil
+	case signatureLocationResponse:
+		if sp.WantAssertionsSigned {
+			return fmt.Errorf("service provider %s wants signed assertions, so its signature location can't be response", sp.EntityID)
+		}
+		return nil
+	}
+	return fmt.Errorf("signature location for service provider %s must be assertion, response, or both, not %q",
+		sp.EntityID, sp.SignatureLocation)
+}
+
+const (
+	// how signed content is canonicalized for service providers
+	canonicalizationExclusive = "exclusive"
+	canonicalizationInclusive = "inclusive"
+)
+
+// canonicalizationAlgorithm returns the algorithm for the service provider's canonicalization
+func (sp *ServiceProvider) canonicalizationAlgorithm() (string, error) {
+	switch sp.Canonicalization {
+	case "", canonicalizationExclusive:
+		return dsig.ExclusiveC14N, nil
+	case canonicalizationInclusive:
+		if len(sp.InclusiveNamespaces) > 0 {
+			return "", fmt.Errorf("service provider %s has inclusive namespaces, so its canonicalization must be exclusive", sp.EntityID)
+		}
+		return dsig.InclusiveC14N, nil
+	}
+	return "", fmt.Errorf("canonicalization for service provider %s must be exclusive or inclusive, not %q",
+		sp.EntityID, sp.Canonicalization)
+}
+
+// signatureLocation returns where responses to the service provider are signed
+func (i *IDP) signatureLocation(entityID string) string {
+	if sp, ok := i.sps.get(entityID); ok && sp.SignatureLocation != "" {
+		return sp.SignatureLocation
+	}
+	return signatureLocationAssertion
+}
+
+// signResponse signs the response's assertion, the response, or both for the service provider, and encrypts the
+// assertion if the service provider requires it. The NameID is encrypted before the assertion is signed for service
+// providers that want EncryptedIDs. The response is signed last, so its signature covers the signed and encrypted
+// assertion. Responses without an assertion are always signed.
+func (i *IDP) signResponse(ctx context.Context, response *saml.Response, entityID string) (err error) {
+	_, span := tracing.Start(ctx, "sign_response", tracing.String("saml.sp", entityID))
+	defer func() {
+		span.RecordError(err)
+		span.End()
+	}()
+	location := i.signatureLocation(entityID)
+	if response.Assertion == nil {
+		location = signatureLocationResponse
+	} else {
+		sp, ok := i.sps.get(entityID)
+		if ok && sp.EncryptNameID {
+			if err = encryptNameID(response.Assertion, sp); err != nil {
+				return err
+			}
+		}
+		if location != signatureLocationResponse {
+			signature, err := i.signerFor(entityID).CreateSignature(response.Assertion)
+			if err != nil {
+				return err
+			}
+			response.Assertion.Signature = signature
+		}
+		if ok && sp.EncryptAssertions {
+			if err = encryptAssertion(response, sp); err != nil {
+				return err
+			}
+		}
+	}
+	if location == signatureLocationAssertion {
+		return nil
+	}
+	signature, err := i.signerFor(entityID).CreateSignature(response)
+	if err != nil {
+		return err
+	}
+	response.Signature = signature
+	return nil
+}
+
+// sendNoPassive tells the service provider that the user would have to log in to answer its passive request
+func (i *IDP) sendNoPassive(authRequest *model.AuthnRequest, w http.ResponseWriter, r *http.Request) error {
+	return i.sendStatus(authRequest, noPassiveStatus, w, r)
+}
+
+// makeAuthnResponse builds the response to the request. It reports an InvalidNameIDPolicy status instead of
+// including an assertion if the user's NameID can't be sent in the format the service provider needs,
+// a NoAuthnContext status if the user didn't log in the way the service provider asked for, an AuthnFailed status
+// if the service provider wants holder-of-key confirmation and the user didn't log in with a certificate, and a NoPassive
+// status if there's no user because a passive request couldn't be answered without a login.
+func (i *IDP) makeAuthnResponse(request *model.AuthnRequest, user *model.User) (*saml.Response, error) {
 	now := time.Now()
-	fiveFromNow := now.Add(5 * time.Minute)
+	if user == nil {
+		return i.makeStatusResponse(request, noPassiveStatus), nil
+	}
+	// The session expires a session lifetime after the user logged in
+	sessionExpires := now.Add(i.sessionLifetime)
+	if authnInstant, err := ptypes.Timestamp(user.AuthnInstant); err == nil {
+		sessionExpires = authnInstant.Add(i.sessionLifetime)
+	}
 	resp := i.makeResponse(request.ID, request.Issuer, user)
+	if !i.satisfiesRequest(request, user) {
+		log.Warnf("unable to respond to %s: %s logged in with %s, which doesn't satisfy the requested authentication context",
+			request.Issuer, user.Name, user.Context)
+		resp.Status = noAuthnContextStatus
+		resp.Assertion = nil
+		return resp, nil
+	}
+	if i.holderOfKey(request.Issuer) && len(user.Certificate) == 0 {
+		log.Warnf("unable to respond to %s: it wants holder-of-key confirmation, but %s didn't log in with a certificate",
+			request.Issuer, user.Name)
+		resp.Status = noConfirmationKeyStatus
+		resp.Assertion = nil
+		return resp, nil
+	}
+	nameID, err := i.makeNameID(user, request.Issuer, request.NameIDFormat)
+	var policy *invalidNameIDPolicyError
+	if errors.As(err, &policy) {
+		log.Warnf("unable to respond to %s: %v", request.Issuer, err)
+		resp.Status = invalidNameIDPolicyStatus
+		resp.Assertion = nil
+		return resp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Assertion.Subject.NameID = nameID
+	if status := i.restrictToRequestedAttributes(request, user, resp.Assertion); status != nil {
+		resp.Status = status
+		resp.Assertion = nil
+		return resp, nil
+	}
+	sessionIndex := user.SessionIndex
+	if sessionIndex == "" {
+		sessionIndex = saml.NewID()
+	}
 	// Add subject confirmation data and authentication statement
 	resp.Assertion.AuthnStatement = &saml.AuthnStatement{
-		AuthnInstant: now,
-		SessionIndex: saml.NewID(),
+		AuthnInstant:        now,
+		SessionIndex:        sessionIndex,
+		SessionNotOnOrAfter: &sessionExpires,
 		SubjectLocality: &saml.SubjectLocality{
 			DNSName: i.serverName,
 		},
@@ -72,21 +261,18 @@ func (i *IDP) makeAuthnResponse(request *model.AuthnRequest, user *model.User) *
 			AuthnContextClassRef: user.Context,
 		},
 	}
-	resp.Assertion.Subject.SubjectConfirmation = &saml.SubjectConfirmation{
-		Method: "urn:oasis:names:tc:SAML:2.0:cm:bearer",
-		SubjectConfirmationData: &saml.SubjectConfirmationData{
-			Address:      net.ParseIP(user.IP),
-			InResponseTo: request.ID,
-			Recipient:    request.AssertionConsumerServiceURL,
-			NotOnOrAfter: fiveFromNow,
-		},
+	resp.Assertion.Subject.SubjectConfirmation = i.subjectConfirmation(request, user, resp.Assertion.Conditions.NotOnOrAfter)
+	if err = i.decorateAssertion(resp.Assertion, user, request); err != nil {
+		return nil, err
+	}
+	if err = i.auditAssertion(request, user, resp); err != nil {
+		return nil, err
 	}
-	return resp
+	return resp, nil
 }
 
 func (i *IDP) makeResponse(id, issuer string, user *model.User) *saml.Response {
 	now := time.Now()
-	fiveFromNow := now.Add(5 * time.Minute)
 	s := &saml.Response{
 		StatusResponseType: saml.StatusResponseType{
 			Version:      "2.0",
@@ -98,12 +284,12 @@ func (i *IDP) makeResponse(id, issuer string, user *model.User) *saml.Response {
 				},
 			},
 			InResponseTo: id,
-			Issuer:       saml.NewIssuer(i.entityID),
+			Issuer:       i.issuer(issuer),
 		},
 		Assertion: &saml.Assertion{
 			ID:           saml.NewID(),
 			IssueInstant: now,
-			Issuer:       saml.NewIssuer(i.entityID),
+			Issuer:       i.issuer(issuer),
 			Version:      "2.0",
 			Subject: &saml.Subject{
 				NameID: &saml.NameID{
@@ -116,12 +302,13 @@ func (i *IDP) makeResponse(id, issuer string, user *model.User) *saml.Response {
 					Method: "urn:oasis:names:tc:SAML:2.0:cm:sender-vouches",
 				},
 			},
-			AttributeStatement: user.AttributeStatement(),
+			AttributeStatement: i.attributeStatement(user, issuer),
 			Conditions: &saml.Conditions{
-				NotOnOrAfter: fiveFromNow,
-				NotBefore:    now,
+				NotOnOrAfter: now.Add(i.assertionLifetime),
+				// Service providers with slow clocks can use the assertion right away
+				NotBefore: now.Add(-i.clockSkew),
 				AudienceRestriction: &saml.AudienceRestriction{
-					Audience: issuer,
+					Audience: i.audiences(issuer),
 				},
 			},
 		},
@@ -129,26 +316,32 @@ func (i *IDP) makeResponse(id, issuer string, user *model.User) *saml.Response {
 	return s
 }
 
+// artifactResolutionIndex is the index of the IdP's artifact resolution service in its metadata and artifacts
+const artifactResolutionIndex = 1
+
 func getArtifact(entityID string) string {
 	// The artifact isn't just a random session id. It's a base64-encoded byte array
 	// that's 44 bytes in length. The first two bytes must be 04 for SAML 2. The second
-	// two bytes are the index of the artifact resolution endpoint in the IdP metadata. Something like 02
+	// two bytes are the index of the artifact resolution endpoint in the IdP metadata.
 	// The next 20 bytes are the sha1 hash of the IdP's entity ID
-	// The last 20 bytes are unique to the request
+	// The last 20 bytes are a random message handle that's unique to the request
 	artifact := make([]byte, 44)
 	// Use SAML 2
 	artifact[1] = byte(4)
-	// Index 1
-	artifact[3] = byte(1)
+	binary.BigEndian.PutUint16(artifact[2:4], artifactResolutionIndex)
 	// Hash of entity ID
 	source := sha1.Sum([]byte(entityID))
-	for i := 4; i < 24; i++ {
-		artifact[i] = source[i-4]
-	}
-	// Message ID
-	message := sha1.Sum([]byte(uuid.New().String()))
-	for i := 24; i < 44; i++ {
-		artifact[i] = message[i-24]
-	}
+	copy(artifact[4:24], source[:])
+	// Message handle
+	rand.Read(artifact[24:])
 	return base64.StdEncoding.EncodeToString(artifact)
 }
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -15,10 +15,19 @@
 package idp
 
 import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"encoding/xml"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/amdonov/lite-idp/dsig"
 	"github.com/amdonov/lite-idp/model"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestIDP_respond(t *testing.T) {
@@ -32,3 +41,237 @@ func TestIDP_respond(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestIDP_signResponse_spAlgorithms(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i)
+	dex, _ := i.sps.get("dex")
+	sps := []ServiceProvider{*dex}
+	sps[0].SigningMethods = []string{dsig.ECDSASHA256, dsig.RSASHA1}
+	viper.Set("sps", sps)
+	defer viper.Set("sps", nil)
+	i = &IDP{}
+	getTestIDP(t, i)
+	for entityID, want := range map[string]string{"dex": dsig.RSASHA1, "other": dsig.RSASHA256} {
+		response, err := i.makeAuthnResponse(&model.AuthnRequest{Issuer: entityID}, &model.User{Name: "joe"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = i.signResponse(context.Background(), response, entityID); err != nil {
+			t.Fatal(err)
+		}
+		sig := response.Assertion.Signature.SignedInfo
+		assert.Equal(t, want, sig.SignatureMethod.Algorithm, "first supported preference should be used")
+		assert.Equal(t, dsig.DigestAlgorithm(want), sig.Reference.DigestMethod.Algorithm)
+	}
+}
+
+func TestIDP_signResponse_canonicalization(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.sps.get("dex")
+	sps := []ServiceProvider{*dex, *dex}
+	sps[0].Canonicalization = canonicalizationInclusive
+	sps[1].EntityID = "prefixes"
+	sps[1].InclusiveNamespaces = []string{"#default", "xs"}
+	viper.Set("sps", sps)
+	defer viper.Set("sps", nil)
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	key := i.SigningCertificate.PrivateKey.(crypto.Signer).Public()
+	for entityID, want := range map[string]string{"dex": dsig.InclusiveC14N, "prefixes": dsig.ExclusiveC14N, "other": dsig.ExclusiveC14N} {
+		response, err := i.makeAuthnResponse(&model.AuthnRequest{Issuer: entityID}, &model.User{Name: "joe"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = i.signResponse(context.Background(), response, entityID); err != nil {
+			t.Fatal(err)
+		}
+		method := response.Assertion.Signature.SignedInfo.CanonicalizationMethod
+		assert.Equal(t, want, method.Algorithm, entityID)
+		if entityID == "prefixes" && assert.NotNil(t, method.InclusiveNamespaces) {
+			assert.Equal(t, "#default xs", method.InclusiveNamespaces.PrefixList)
+		} else if entityID != "prefixes" {
+			assert.Nil(t, method.InclusiveNamespaces, entityID)
+		}
+		data, err := xml.Marshal(response.Assertion)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, dsig.Verify(data, key), entityID)
+	}
+
+	sps[0].InclusiveNamespaces = []string{"xs"}
+	viper.Set("sps", sps)
+	_, err := (&IDP{}).Handler()
+	assert.Error(t, err, "inclusive canonicalization doesn't have inclusive namespaces")
+	sps[0].InclusiveNamespaces = nil
+	sps[0].Canonicalization = "c14n11"
+	viper.Set("sps", sps)
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err)
+}
+
+func TestIDP_makeAuthnResponse_lifetimes(t *testing.T) {
+	defer viper.Set("assertion-lifetime", viper.GetString("assertion-lifetime"))
+	viper.Set("assertion-lifetime", "2m")
+	i := &IDP{}
+	getTestIDP(t, i)
+	response, err := i.makeAuthnResponse(&model.AuthnRequest{Issuer: "dex"}, &model.User{Name: "joe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conditions := response.Assertion.Conditions
+	assert.Equal(t, 2*time.Minute+i.clockSkew, conditions.NotOnOrAfter.Sub(conditions.NotBefore),
+		"NotBefore should allow for clock skew")
+	assert.Equal(t, conditions.NotOnOrAfter, response.Assertion.Subject.SubjectConfirmation.SubjectConfirmationData.NotOnOrAfter)
+	assert.Equal(t, 8*time.Hour, response.Assertion.AuthnStatement.SessionNotOnOrAfter.Sub(response.Assertion.AuthnStatement.AuthnInstant))
+}
+
+func TestIDP_makeAuthnResponse_audiences(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.sps.get("dex")
+	sps := []ServiceProvider{*dex}
+	sps[0].Audiences = []string{"https://legacy.example.com/", "dex"}
+	viper.Set("sps", sps)
+	defer viper.Set("sps", nil)
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	response, err := i.makeAuthnResponse(&model.AuthnRequest{Issuer: "dex"}, &model.User{Name: "joe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(response.Assertion.Conditions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, strings.Count(string(data), "<Audience "), "each audience should have its own element")
+	assert.Equal(t, []string{"dex", "https://legacy.example.com/"}, response.Assertion.Conditions.AudienceRestriction.Audience,
+		"the entity ID should come first without duplicates")
+
+	response, err = i.makeAuthnResponse(&model.AuthnRequest{Issuer: "other"}, &model.User{Name: "joe"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"other"}, response.Assertion.Conditions.AudienceRestriction.Audience)
+
+	sps[0].Audiences = []string{""}
+	viper.Set("sps", sps)
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err, "empty audiences should be rejected")
+}
+
+func TestIDP_signResponse_location(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i)
+	key := i.TLSConfig.Certificates[0].PrivateKey.(crypto.Signer).Public()
+	sp, _ := i.sps.get("dex")
+	sp.EncryptionAlgorithm = aes128GCM
+	defer func() {
+		sp.SignatureLocation = ""
+		sp.EncryptAssertions = false
+	}()
+	tests := []struct {
+		location        string
+		encrypt         bool
+		assertionSigned bool
+		responseSigned  bool
+	}{
+		{"", false, true, false},
+		{signatureLocationAssertion, false, true, false},
+		{signatureLocationResponse, false, false, true},
+		{signatureLocationBoth, false, true, true},
+		{signatureLocationBoth, true, true, true},
+	}
+	for _, tt := range tests {
+		sp.SignatureLocation = tt.location
+		sp.EncryptAssertions = tt.encrypt
+		response, err := i.makeAuthnResponse(&model.AuthnRequest{Issuer: "dex"}, &model.User{Name: "joe"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = i.signResponse(context.Background(), response, "dex"); err != nil {
+			t.Fatal(err)
+		}
+		assertion := response.Assertion
+		if tt.encrypt {
+			assertion = decryptAssertion(t, i.TLSConfig.Certificates[0].PrivateKey.(*rsa.PrivateKey), response.EncryptedAssertion)
+		}
+		assert.Equal(t, tt.assertionSigned, assertion.Signature != nil, "assertion signature for %q", tt.location)
+		assert.Equal(t, tt.responseSigned, response.Signature != nil, "response signature for %q", tt.location)
+		if !tt.responseSigned {
+			continue
+		}
+		data, err := xml.Marshal(response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The response's signature has to cover the assertion as it was sent, including its signature
+		assert.NoError(t, dsig.Verify(data, key), "response signature for %q", tt.location)
+		if tt.assertionSigned && !tt.encrypt {
+			if data, err = xml.Marshal(assertion); err != nil {
+				t.Fatal(err)
+			}
+			assert.NoError(t, dsig.Verify(data, key), "assertion signature for %q", tt.location)
+		}
+	}
+
+	// Responses without an assertion are signed wherever the service provider wants signatures
+	sp.SignatureLocation = signatureLocationAssertion
+	response := i.makeResponse("id", "dex", &model.User{})
+	response.Assertion = nil
+	if assert.NoError(t, i.signResponse(context.Background(), response, "dex")) {
+		assert.NotNil(t, response.Signature)
+	}
+}
+
+func TestServiceProvider_validateSignatureLocation(t *testing.T) {
+	sp := &ServiceProvider{EntityID: "test"}
+	for _, location := range []string{"", signatureLocationAssertion, signatureLocationResponse, signatureLocationBoth} {
+		sp.SignatureLocation = location
+		assert.NoError(t, sp.validateSignatureLocation())
+	}
+	sp.SignatureLocation = "envelope"
+	assert.Error(t, sp.validateSignatureLocation())
+
+	sp.WantAssertionsSigned = true
+	sp.SignatureLocation = signatureLocationResponse
+	assert.Error(t, sp.validateSignatureLocation(), "the metadata requires signed assertions")
+	sp.SignatureLocation = signatureLocationBoth
+	assert.NoError(t, sp.validateSignatureLocation())
+}
+
+func BenchmarkIDP_makeAuthnResponse(b *testing.B) {
+	i := &IDP{}
+	getTestIDPWithSP(b, i).Close()
+	request := &model.AuthnRequest{ID: "_1", Issuer: "dex", AssertionConsumerServiceURL: "http://127.0.0.1:5556/dex/callback"}
+	user := newTestUser()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if _, err := i.makeAuthnResponse(request, user); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkIDP_signResponse(b *testing.B) {
+	i := &IDP{}
+	getTestIDPWithSP(b, i).Close()
+	response, err := i.makeAuthnResponse(&model.AuthnRequest{ID: "_1", Issuer: "dex"}, newTestUser())
+	if err != nil {
+		b.Fatal(err)
+	}
+	assertion := response.Assertion
+	ctx := context.Background()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		response.Signature, assertion.Signature = nil, nil
+		response.Assertion = assertion
+		if err := i.signResponse(ctx, response, "dex"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Methods of checking whether client certificates are revoked
+const (
+	revocationOCSP = "ocsp"
+	revocationCRL  = "crl"
+)
+
+const (
+	// maxCRLSize limits how much of a CRL is read. CRLs of large CAs are tens of megabytes.
+	maxCRLSize = 128 << 20
+	// maxCachedStatuses limits how many certificates' statuses are kept
+	maxCachedStatuses = 100000
+)
+
+// revocationChecker checks client certificates with OCSP responders and CRLs and remembers the answers
+type revocationChecker struct {
+	// tried in order until one gives an answer
+	methods []string
+	// used instead of the responder in the certificate
+	ocspResponder string
+	// used instead of the certificate's CRL distribution points
+	crlURLs []string
+	ttl     time.Duration
+	timeout time.Duration
+	client  *http.Client
+	mu      sync.Mutex
+	// statuses by issuer and serial number, and CRLs by URL
+	statuses map[string]revocationStatus
+	crls     map[string]*cachedCRL
+}
+
+// revocationStatus is a remembered answer
+type revocationStatus struct {
+	revoked bool
+	expires time.Time
+}
+
+// cachedCRL holds the serial numbers in a CRL
+type cachedCRL struct {
+	rawIssuer []byte
+	revoked   map[string]bool
+	expires   time.Time
+}
+
+// configureCertRevocation reads how client certificates are checked for revocation. Nothing is checked if
+// cert-revocation-methods is empty.
+func (i *IDP) configureCertRevocation() error {
+	i.revocation = nil
+	methods := i.settings.GetStringSlice("cert-revocation-methods")
+	if len(methods) == 0 {
+		return nil
+	}
+	for _, method := range methods {
+		if method != revocationOCSP && method != revocationCRL {
+			return fmt.Errorf("cert-revocation-methods can only contain ocsp and crl, not %q", method)
+		}
+	}
+	checker := &revocationChecker{
+		methods:       methods,
+		ocspResponder: i.settings.GetString("cert-ocsp-responder"),
+		crlURLs:       i.settings.GetStringSlice("cert-crl-urls"),
+		ttl:           i.settings.GetDuration("cert-revocation-cache-ttl"),
+		timeout:       i.settings.GetDuration("cert-revocation-timeout"),
+		client:        &http.Client{},
+		statuses:      map[string]revocationStatus{},
+		crls:          map[string]*cachedCRL{},
+	}
+	if checker.ttl < 0 {
+		return errors.New("cert-revocation-cache-ttl can't be negative")
+	}
+	if checker.timeout <= 0 {
+		return errors.New("cert-revocation-timeout must be a positive duration")
+	}
+	i.revocation = checker
+	return nil
+}
+
+// checkRevocation returns an error wrapping ErrAuthnFailed if the client certificate is revoked or its status can't
+// be checked, such as when the certificate wasn't verified or no responder or CRL answers
+func (c *revocationChecker) checkRevocation(ctx context.Context, state *tls.ConnectionState) error {
+	cert := state.PeerCertificates[0]
+	subject := getSubjectDN(cert.Subject)
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) < 2 {
+		return fmt.Errorf("%w: revocation status of the certificate for %s can't be checked without its issuer",
+			ErrAuthnFailed, subject)
+	}
+	issuer := state.VerifiedChains[0][1]
+	revoked, err := c.revoked(ctx, cert, issuer)
+	if err != nil {
+		return fmt.Errorf("%w: revocation status of the certificate for %s couldn't be checked: %v", ErrAuthnFailed, subject, err)
+	}
+	if revoked {
+		return fmt.Errorf("%w: the certificate for %s is revoked", ErrAuthnFailed, subject)
+	}
+	return nil
+}
+
+// revoked asks each method in turn whether the certificate is revoked, using a remembered answer if there is one
+func (c *revocationChecker) revoked(ctx context.Context, cert, issuer *x509.Certificate) (bool, error) {
+	key := hex.EncodeToString(issuer.RawSubjectPublicKeyInfo) + ":" + cert.SerialNumber.String()
+	now := time.Now()
+	c.mu.Lock()
+	status, ok := c.statuses[key]
+	c.mu.Unlock()
+	if ok && now.Before(status.expires) {
+		return status.revoked, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	failures := []string{}
+	for _, method := range c.methods {
+		var (
+			revoked    bool
+			nextUpdate time.Time
+			err        error
+		)
+		switch method {
+		case revocationOCSP:
+			revoked, nextUpdate, err = c.checkOCSP(ctx, cert, issuer)
+		case revocationCRL:
+			revoked, nextUpdate, err = c.checkCRL(ctx, cert, issuer, now)
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", method, err))
+			continue
+		}
+		c.remember(key, revocationStatus{revoked: revoked, expires: c.expires(now, nextUpdate)}, now)
+		return revoked, nil
+	}
+	return false, errors.New(strings.Join(failures, "; "))
+}
+
+// expires returns when an answer is checked again: after cert-revocation-cache-ttl, or sooner if the responder or CRL
+// will have newer information
+func (c *revocationChecker) expires(now, nextUpdate time.Time) time.Time {
+	expires := now.Add(c.ttl)
+	if !nextUpdate.IsZero() && nextUpdate.Before(expires) {
+		return nextUpdate
+	}
+	return expires
+}
+
+// remember caches the status. Expired statuses are dropped when the cache is full.
+func (c *revocationChecker) remember(key string, status revocationStatus, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.statuses) >= maxCachedStatuses {
+		for k, s := range c.statuses {
+			if !now.Before(s.expires) {
+				delete(c.statuses, k)
+			}
+		}
+		if len(c.statuses) >= maxCachedStatuses {
+			c.statuses = map[string]revocationStatus{}
+		}
+	}
+	c.statuses[key] = status
+}
+
+// checkOCSP asks cert-ocsp-responder, or the responder in the certificate, for the certificate's status
+func (c *revocationChecker) checkOCSP(ctx context.Context, cert, issuer *x509.Certificate) (bool, time.Time, error) {
+	responder := c.ocspResponder
+	if responder == "" {
+		if len(cert.OCSPServer) == 0 {
+			return false, time.Time{}, errors.New("the certificate doesn't name an OCSP responder")
+		}
+		responder = cert.OCSPServer[0]
+	}
+	status, err := fetchOCSP(ctx, c.client, responder, cert, issuer)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	return status.revoked, status.nextUpdate, nil
+}
+
+// checkCRL looks for the certificate in the issuer's CRL from cert-crl-urls or the certificate's distribution points
+func (c *revocationChecker) checkCRL(ctx context.Context, cert, issuer *x509.Certificate, now time.Time) (bool, time.Time, error) {
+	urls := c.crlURLs
+	if len(urls) == 0 {
+		urls = cert.CRLDistributionPoints
+	}
+	if len(urls) == 0 {
+		return false, time.Time{}, errors.New("the certificate doesn't have a CRL distribution point")
+	}
+	var err error
+	for _, url := range urls {
+		var crl *cachedCRL
+		if crl, err = c.crl(ctx, url, issuer, now); err != nil {
+			continue
+		}
+		if string(crl.rawIssuer) != string(issuer.RawSubject) {
+			err = fmt.Errorf("CRL from %s wasn't issued by %s", url, getSubjectDN(issuer.Subject))
+			continue
+		}
+		return crl.revoked[cert.SerialNumber.String()], crl.expires, nil
+	}
+	return false, time.Time{}, err
+}
+
+// crl returns the CRL at the URL, downloading it if it isn't cached or has expired. CRLs from other issuers, such as
+// those in cert-crl-urls for other CAs, are cached without checking their signatures.
+func (c *revocationChecker) crl(ctx context.Context, url string, issuer *x509.Certificate, now time.Time) (*cachedCRL, error) {
+	c.mu.Lock()
+	crl, ok := c.crls[url]
+	c.mu.Unlock()
+	if ok && now.Before(crl.expires) {
+		return crl, nil
+	}
+	list, err := fetchCRL(ctx, c.client, url)
+	if err != nil {
+		return nil, err
+	}
+	if !list.NextUpdate.IsZero() && list.NextUpdate.Before(now) {
+		return nil, fmt.Errorf("CRL from %s expired at %s", url, list.NextUpdate.Format(time.RFC3339))
+	}
+	crl = &cachedCRL{rawIssuer: list.RawIssuer, revoked: map[string]bool{}, expires: c.expires(now, list.NextUpdate)}
+	if string(list.RawIssuer) == string(issuer.RawSubject) {
+		if err = list.CheckSignatureFrom(issuer); err != nil {
+			return nil, fmt.Errorf("CRL from %s has a bad signature: %v", url, err)
+		}
+	}
+	for _, entry := range list.RevokedCertificateEntries {
+		crl.revoked[entry.SerialNumber.String()] = true
+	}
+	c.mu.Lock()
+	c.crls[url] = crl
+	c.mu.Unlock()
+	return crl, nil
+}
+
+// fetchCRL downloads a DER or PEM encoded CRL
+func fetchCRL(ctx context.Context, client *http.Client, url string) (*x509.RevocationList, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("CRL from %s returned status code %d", url, resp.StatusCode)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxCRLSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxCRLSize {
+		return nil, fmt.Errorf("CRL from %s is larger than %d bytes", url, maxCRLSize)
+	}
+	if block, _ := pem.Decode(data); block != nil && block.Type == "X509 CRL" {
+		data = block.Bytes
+	}
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRL from %s: %v", url, err)
+	}
+	return list, nil
+}
@@ -0,0 +1,340 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// testPKI is a CA that issues client certificates and answers for them with an OCSP responder and a CRL
+type testPKI struct {
+	t      *testing.T
+	ca     *x509.Certificate
+	caKey  crypto.Signer
+	server *httptest.Server
+	mu     sync.Mutex
+	// serial numbers of revoked certificates
+	revoked map[int64]bool
+	// signs OCSP responses instead of the CA when it's set
+	responder    *x509.Certificate
+	responderKey crypto.Signer
+	// requests answered by the responder and the CRL distribution point, and whether they fail
+	ocspRequests, crlRequests int
+	down                      bool
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	p := &testPKI{t: t, revoked: map[int64]bool{}}
+	p.ca, p.caKey = newTestCA(t, pkix.Name{CommonName: fmt.Sprintf("Test CA %d", time.Now().UnixNano())})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ocsp", p.serveOCSP)
+	mux.HandleFunc("/ca.crl", p.serveCRL)
+	p.server = httptest.NewServer(mux)
+	return p
+}
+
+func (p *testPKI) Close() {
+	p.server.Close()
+}
+
+// newTestCA creates a self-signed CA certificate
+func newTestCA(t *testing.T, subject pkix.Name) (*x509.Certificate, crypto.Signer) {
+	return newTestCertificate(t, &x509.Certificate{
+		Subject:               subject,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil, nil)
+}
+
+// newTestCertificate creates a certificate from the template with a new key, signed by the parent or self-signed
+func newTestCertificate(t *testing.T, template, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template.SerialNumber == nil {
+		template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	}
+	template.NotBefore = time.Now().Add(-time.Minute)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// issue returns a client certificate with the serial number that names the responder and CRL
+func (p *testPKI) issue(serial int64) *x509.Certificate {
+	cert, _ := newTestCertificate(p.t, &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "Joe User", Organization: []string{"Example"}},
+		OCSPServer:            []string{p.server.URL + "/ocsp"},
+		CRLDistributionPoints: []string{p.server.URL + "/ca.crl"},
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, p.ca, p.caKey)
+	return cert
+}
+
+// connection is the state of a TLS connection from a browser that presented the certificate
+func (p *testPKI) connection(cert *x509.Certificate) *tls.ConnectionState {
+	return &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert, p.ca}},
+	}
+}
+
+func (p *testPKI) revoke(serial int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.revoked[serial] = true
+}
+
+// setDown makes the responder and the CRL distribution point fail
+func (p *testPKI) setDown(down bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.down = down
+}
+
+func (p *testPKI) serveOCSP(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ocspRequests++
+	if p.down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	body, _ := ioutil.ReadAll(r.Body)
+	var req ocspRequest
+	if _, err := asn1.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	id := req.TBSRequest.RequestList[0].CertID
+	signer, key := p.ca, p.caKey
+	if p.responder != nil {
+		signer, key = p.responder, p.responderKey
+	}
+	single := ocspSingleResponse{CertID: id, ThisUpdate: time.Now().Add(-time.Minute), NextUpdate: time.Now().Add(time.Hour)}
+	if p.revoked[id.SerialNumber.Int64()] {
+		single.Revoked = ocspRevokedInfo{RevocationTime: time.Now().Add(-time.Hour)}
+	} else {
+		single.Good = true
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(createOCSPResponse(p.t, single, signer, key))
+}
+
+func (p *testPKI) serveCRL(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.crlRequests++
+	if p.down {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for serial := range p.revoked {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now().Add(-time.Hour),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, p.ca, p.caKey)
+	if err != nil {
+		p.t.Error(err)
+		return
+	}
+	w.Write(der)
+}
+
+func (p *testPKI) requests() (int, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.ocspRequests, p.crlRequests
+}
+
+// setRevocationMethods configures the checks and returns an IDP that uses them
+func setRevocationMethods(t *testing.T, methods ...string) *IDP {
+	viper.Set("cert-revocation-methods", methods)
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	return i
+}
+
+func TestIDP_loginWithCert_revocation(t *testing.T) {
+	defer viper.Set("cert-revocation-methods", []string{})
+	p := newTestPKI(t)
+	defer p.Close()
+	i := setRevocationMethods(t, revocationOCSP)
+	good, revoked := p.issue(1), p.issue(2)
+	p.revoke(2)
+	req := httptest.NewRequest("GET", "/", nil)
+
+	req.TLS = p.connection(good)
+	user, err := i.loginWithCert(req, nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, user, "certificates that aren't revoked can log in")
+	req.TLS = p.connection(revoked)
+	user, err = i.loginWithCert(req, nil)
+	assert.Nil(t, user)
+	if assert.Error(t, err, "revoked certificates should be refused") {
+		assert.True(t, errors.Is(err, ErrAuthnFailed), "the service provider should be told the login failed")
+		assert.Contains(t, err.Error(), "revoked")
+	}
+	ocsp, crl := p.requests()
+	assert.Equal(t, 2, ocsp)
+	assert.Equal(t, 0, crl)
+
+	// Answers are remembered, so logins don't depend on the responder
+	p.setDown(true)
+	req.TLS = p.connection(good)
+	user, err = i.loginWithCert(req, nil)
+	assert.NoError(t, err)
+	assert.NotNil(t, user)
+	ocsp, _ = p.requests()
+	assert.Equal(t, 2, ocsp)
+
+	// Certificates whose status can't be checked are refused too
+	req.TLS = p.connection(p.issue(3))
+	user, err = i.loginWithCert(req, nil)
+	assert.Nil(t, user)
+	if assert.Error(t, err) {
+		assert.True(t, errors.Is(err, ErrAuthnFailed))
+		assert.Contains(t, err.Error(), "couldn't be checked")
+	}
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{good}}
+	_, err = i.loginWithCert(req, nil)
+	assert.Error(t, err, "unverified certificates don't have an issuer to check with")
+}
+
+func TestIDP_loginWithCert_crl(t *testing.T) {
+	defer viper.Set("cert-revocation-methods", []string{})
+	p := newTestPKI(t)
+	defer p.Close()
+	p.revoke(2)
+	req := httptest.NewRequest("GET", "/", nil)
+
+	// The CRL is used when the responder doesn't answer
+	i := setRevocationMethods(t, revocationOCSP, revocationCRL)
+	p.setDown(true)
+	req.TLS = p.connection(p.issue(1))
+	_, err := i.loginWithCert(req, nil)
+	assert.Error(t, err, "neither answers")
+	p.setDown(false)
+	responder, responderKey := newTestCertificate(t, &x509.Certificate{Subject: pkix.Name{CommonName: "Rogue responder"}}, p.ca, p.caKey)
+	p.mu.Lock()
+	p.responder, p.responderKey = responder, responderKey
+	p.mu.Unlock()
+	user, err := i.loginWithCert(req, nil)
+	assert.NoError(t, err, "responders without the OCSP signing usage aren't trusted, so the CRL should be checked")
+	assert.NotNil(t, user)
+
+	i = setRevocationMethods(t, revocationCRL)
+	for serial, want := range map[int64]bool{1: false, 2: true, 3: false} {
+		req.TLS = p.connection(p.issue(serial))
+		_, err = i.loginWithCert(req, nil)
+		assert.Equal(t, want, err != nil, "serial number %d", serial)
+	}
+	_, crl := p.requests()
+	assert.Equal(t, 3, crl, "the CRL should be downloaded once for the checks that needed it")
+}
+
+func Test_revocationChecker_crl(t *testing.T) {
+	p := newTestPKI(t)
+	defer p.Close()
+	other := newTestPKI(t)
+	defer other.Close()
+	other.revoke(2)
+	checker := &revocationChecker{
+		methods:  []string{revocationCRL},
+		ttl:      time.Hour,
+		timeout:  time.Second,
+		client:   http.DefaultClient,
+		statuses: map[string]revocationStatus{},
+		crls:     map[string]*cachedCRL{},
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	cert := p.issue(2)
+	// A CRL from another CA doesn't say anything about the certificate
+	checker.crlURLs = []string{other.server.URL + "/ca.crl"}
+	assert.Error(t, checker.checkRevocation(req.Context(), p.connection(cert)))
+	checker.crlURLs = []string{other.server.URL + "/ca.crl", p.server.URL + "/ca.crl"}
+	assert.NoError(t, checker.checkRevocation(req.Context(), p.connection(cert)), "the first CRL from the issuer should be used")
+
+	// CRLs signed by another key are rejected
+	forged := &testPKI{t: t, revoked: map[int64]bool{}}
+	forged.ca, forged.caKey = newTestCA(t, p.ca.Subject)
+	forgedServer := httptest.NewServer(http.HandlerFunc(forged.serveCRL))
+	defer forgedServer.Close()
+	checker.crlURLs = []string{forgedServer.URL}
+	checker.statuses = map[string]revocationStatus{}
+	err := checker.checkRevocation(req.Context(), p.connection(cert))
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "signature")
+	}
+}
+
+func TestIDP_configureCertRevocation(t *testing.T) {
+	defer viper.Set("cert-revocation-methods", []string{})
+	defer viper.Set("cert-revocation-timeout", "10s")
+	i := setRevocationMethods(t)
+	assert.Nil(t, i.revocation, "nothing is checked by default")
+	i = setRevocationMethods(t, revocationCRL, revocationOCSP)
+	if assert.NotNil(t, i.revocation) {
+		assert.Equal(t, []string{revocationCRL, revocationOCSP}, i.revocation.methods)
+		assert.Equal(t, time.Hour, i.revocation.ttl)
+	}
+
+	viper.Set("cert-revocation-methods", []string{"ocsp", "scvp"})
+	_, err := (&IDP{}).Handler()
+	assert.Error(t, err, "unknown methods should be rejected")
+	viper.Set("cert-revocation-methods", []string{"ocsp"})
+	viper.Set("cert-revocation-timeout", "0s")
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err)
+}
@@ -0,0 +1,91 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/amdonov/lite-idp/saml"
+)
+
+// noSupportedIDPStatus tells a service provider that the IdP isn't one of those its IDPList allows
+var noSupportedIDPStatus = &saml.Status{
+	StatusCode: saml.StatusCode{
+		Value: "urn:oasis:names:tc:SAML:2.0:status:Responder",
+		StatusCode: &saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:NoSupportedIDP",
+		},
+	},
+}
+
+// proxyCountExceededStatus tells a service provider that the IdP would have to proxy a request that may not be
+// proxied any further
+var proxyCountExceededStatus = &saml.Status{
+	StatusCode: saml.StatusCode{
+		Value: "urn:oasis:names:tc:SAML:2.0:status:Responder",
+		StatusCode: &saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:ProxyCountExceeded",
+		},
+	},
+}
+
+// scopingError is returned for AuthnRequests whose IDPList leaves out the IdP. The IdP only authenticates users
+// itself, so answering them would mean proxying the request to one of the listed identity providers.
+type scopingError struct {
+	entityID string
+	idps     []string
+	// proxyCount is the ProxyCount of the request, nil if it didn't limit proxying
+	proxyCount *int
+}
+
+func (e *scopingError) Error() string {
+	if e.proxyCount != nil && *e.proxyCount == 0 {
+		return fmt.Sprintf("%s asked for a login at %s without proxying", e.entityID, strings.Join(e.idps, ", "))
+	}
+	return fmt.Sprintf("%s asked for a login at %s, which the IdP doesn't proxy to", e.entityID, strings.Join(e.idps, ", "))
+}
+
+// status reports ProxyCountExceeded when the request forbade proxying and NoSupportedIDP otherwise
+func (e *scopingError) status() *saml.Status {
+	if e.proxyCount != nil && *e.proxyCount == 0 {
+		return proxyCountExceededStatus
+	}
+	return noSupportedIDPStatus
+}
+
+// checkScoping returns a scopingError if the request's IDPList names identity providers but not this one. Lists
+// that are only given by reference with GetComplete aren't fetched, so they don't exclude the IdP. Nothing is
+// checked when scoping-enforced is false.
+func (i *IDP) checkScoping(entityID string, scoping *saml.Scoping) error {
+	if scoping == nil {
+		return nil
+	}
+	if scoping.ProxyCount != nil && *scoping.ProxyCount < 0 {
+		return errors.New("ProxyCount can't be negative")
+	}
+	if scoping.IDPList == nil || len(scoping.IDPList.IDPEntry) == 0 || !i.settings.GetBool("scoping-enforced") {
+		return nil
+	}
+	idps := make([]string, 0, len(scoping.IDPList.IDPEntry))
+	for _, entry := range scoping.IDPList.IDPEntry {
+		if entry.ProviderID == i.entityID {
+			return nil
+		}
+		idps = append(idps, entry.ProviderID)
+	}
+	return &scopingError{entityID, idps, scoping.ProxyCount}
+}
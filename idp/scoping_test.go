@@ -0,0 +1,130 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_checkScoping(t *testing.T) {
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	zero, one, negative := 0, 1, -1
+	idpList := func(providers ...string) *saml.IDPList {
+		list := &saml.IDPList{}
+		for _, provider := range providers {
+			list.IDPEntry = append(list.IDPEntry, saml.IDPEntry{ProviderID: provider})
+		}
+		return list
+	}
+	tests := []struct {
+		name    string
+		scoping *saml.Scoping
+		want    *saml.Status
+		wantErr bool
+	}{
+		{"no scoping", nil, nil, false},
+		{"requester IDs only", &saml.Scoping{RequesterID: []string{"wiki"}}, nil, false},
+		{"listed", &saml.Scoping{ProxyCount: &zero, IDPList: idpList("other", i.entityID)}, nil, false},
+		{"not listed", &saml.Scoping{IDPList: idpList("other")}, noSupportedIDPStatus, true},
+		{"not listed and proxying allowed", &saml.Scoping{ProxyCount: &one, IDPList: idpList("other")}, noSupportedIDPStatus, true},
+		{"not listed and proxying forbidden", &saml.Scoping{ProxyCount: &zero, IDPList: idpList("other")}, proxyCountExceededStatus, true},
+		{"only GetComplete", &saml.Scoping{IDPList: &saml.IDPList{GetComplete: "https://hub.example.com/idps"}}, nil, false},
+		{"negative proxy count", &saml.Scoping{ProxyCount: &negative}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := i.checkScoping("dex", tt.scoping)
+			assert.Equal(t, tt.wantErr, err != nil)
+			assert.Equal(t, tt.want, failureStatus(err))
+		})
+	}
+
+	viper.Set("scoping-enforced", false)
+	defer viper.Set("scoping-enforced", true)
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	assert.NoError(t, i.checkScoping("dex", &saml.Scoping{ProxyCount: &zero, IDPList: idpList("other")}),
+		"the IDPList should be ignored")
+}
+
+func TestIDP_DefaultPostSSOHandler_scoping(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	zero := 0
+	loginReq := newTestAuthnRequest()
+	loginReq.Scoping = &saml.Scoping{
+		ProxyCount: &zero,
+		IDPList:    &saml.IDPList{IDPEntry: []saml.IDPEntry{{ProviderID: "https://other.example.com/"}}},
+	}
+	assert.Equal(t, proxyCountExceededStatus, redirectedStatus(t, i, postAuthnRequest(t, i, loginReq, true)))
+
+	loginReq = newTestAuthnRequest()
+	loginReq.Scoping = &saml.Scoping{
+		ProxyCount:  &zero,
+		IDPList:     &saml.IDPList{IDPEntry: []saml.IDPEntry{{ProviderID: i.entityID}}},
+		RequesterID: []string{"https://wiki.example.org/", "https://hub.example.com/"},
+	}
+	w := postAuthnRequest(t, i, loginReq, true)
+	assert.Equal(t, http.StatusSeeOther, w.Code, "expected redirect to login page")
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := i.TempCache.Get(location.Query().Get("requestId"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &model.AuthnRequest{}
+	if err = proto.Unmarshal(saved, req); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"https://wiki.example.org/", "https://hub.example.com/"}, req.RequesterIDs)
+}
+
+func TestScoping_unmarshal(t *testing.T) {
+	data := `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="id" Version="2.0">
+  <samlp:Scoping ProxyCount="2">
+    <samlp:IDPList>
+      <samlp:IDPEntry ProviderID="https://idp.example.com/" Name="Example"/>
+      <samlp:GetComplete>https://hub.example.com/idps</samlp:GetComplete>
+    </samlp:IDPList>
+    <samlp:RequesterID>https://wiki.example.org/</samlp:RequesterID>
+  </samlp:Scoping>
+</samlp:AuthnRequest>`
+	req := &saml.AuthnRequest{}
+	if err := xml.Unmarshal([]byte(data), req); err != nil {
+		t.Fatal(err)
+	}
+	if !assert.NotNil(t, req.Scoping) || !assert.NotNil(t, req.Scoping.IDPList) {
+		return
+	}
+	if assert.NotNil(t, req.Scoping.ProxyCount) {
+		assert.Equal(t, 2, *req.Scoping.ProxyCount)
+	}
+	assert.Equal(t, []saml.IDPEntry{{ProviderID: "https://idp.example.com/", Name: "Example"}}, req.Scoping.IDPList.IDPEntry)
+	assert.Equal(t, "https://hub.example.com/idps", req.Scoping.IDPList.GetComplete)
+	assert.Equal(t, []string{"https://wiki.example.org/"}, req.Scoping.RequesterID)
+}
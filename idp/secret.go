@@ -0,0 +1,56 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Prefixes of settings that hold a reference to a secret instead of the secret itself
+const (
+	secretEnvPrefix  = "env:"
+	secretFilePrefix = "file:"
+)
+
+// resolveSecret returns the secret held by a setting such as ldap.bind-password. A value starting with env: names
+// the environment variable with the secret and one starting with file: names a file with it, such as a mounted
+// Kubernetes secret. Trailing line breaks are removed from files. Any other value is the secret itself. Errors
+// name the setting but never include the secret.
+func resolveSecret(settings *viper.Viper, key string) (string, error) {
+	value := settings.GetString(key)
+	switch {
+	case strings.HasPrefix(value, secretEnvPrefix):
+		name := strings.TrimPrefix(value, secretEnvPrefix)
+		secret, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("%s refers to environment variable %s, which isn't set", key, name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, secretFilePrefix):
+		file := strings.TrimPrefix(value, secretFilePrefix)
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s from %s: %v", key, file, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	default:
+		return value, nil
+	}
+}
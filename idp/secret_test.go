@@ -0,0 +1,81 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_resolveSecret(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "password")
+	if err = ioutil.WriteFile(file, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("LITE_IDP_TEST_SECRET", "from-env")
+	defer os.Unsetenv("LITE_IDP_TEST_SECRET")
+
+	settings := viper.New()
+	for value, expected := range map[string]string{
+		"literal":                  "literal",
+		"":                         "",
+		"env:LITE_IDP_TEST_SECRET": "from-env",
+		"file:" + file:             "from-file",
+	} {
+		settings.Set("ldap.bind-password", value)
+		secret, err := resolveSecret(settings, "ldap.bind-password")
+		if assert.NoError(t, err, value) {
+			assert.Equal(t, expected, secret, value)
+		}
+	}
+
+	settings.Set("ldap.bind-password", "env:LITE_IDP_TEST_MISSING")
+	_, err = resolveSecret(settings, "ldap.bind-password")
+	assert.Error(t, err, "the environment variable isn't set")
+	settings.Set("ldap.bind-password", "file:"+filepath.Join(dir, "missing"))
+	_, err = resolveSecret(settings, "ldap.bind-password")
+	if assert.Error(t, err, "the file doesn't exist") {
+		assert.Contains(t, err.Error(), "ldap.bind-password")
+	}
+}
+
+func TestIDP_adminAPIToken_env(t *testing.T) {
+	os.Setenv("LITE_IDP_TEST_TOKEN", "secret")
+	defer os.Unsetenv("LITE_IDP_TEST_TOKEN")
+	viper.Set("admin-listen-address", "127.0.0.1:9090")
+	defer viper.Set("admin-listen-address", "")
+	viper.Set("admin-api-token", "env:LITE_IDP_TEST_TOKEN")
+	defer viper.Set("admin-api-token", "")
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	assert.Equal(t, http.StatusOK, sessionsRequest(i, "GET", "/admin/sessions", "secret").Code)
+	assert.Equal(t, http.StatusUnauthorized, sessionsRequest(i, "GET", "/admin/sessions", "env:LITE_IDP_TEST_TOKEN").Code,
+		"the reference isn't the token")
+
+	viper.Set("admin-api-token", "env:LITE_IDP_TEST_MISSING")
+	_, err := (&IDP{}).Handler()
+	assert.Error(t, err)
+}
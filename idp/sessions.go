@@ -0,0 +1,195 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	log "github.com/sirupsen/logrus"
+)
+
+// SessionInfo describes an active session in the session API. Sessions are identified by their SessionIndex
+// rather than the session cookie, so listing sessions doesn't reveal cookies that could be used to log in.
+type SessionInfo struct {
+	ID               string     `json:"id"`
+	User             string     `json:"user"`
+	ServiceProviders []string   `json:"service_providers"`
+	Created          *time.Time `json:"created,omitempty"`
+	LastActivity     *time.Time `json:"last_activity,omitempty"`
+	Expires          *time.Time `json:"expires,omitempty"`
+}
+
+// sessionAPIEnabled reports whether admin-api-token or admin-client-ca protect the session API
+func (i *IDP) sessionAPIEnabled() bool {
+	return i.settings.GetString("admin-api-token") != "" || i.settings.GetString("admin-client-ca") != ""
+}
+
+// configureSessionAPI checks that the session API is only served on the admin listener and reads the admin-api-token
+func (i *IDP) configureSessionAPI() error {
+	i.adminAPIToken = ""
+	if !i.sessionAPIEnabled() {
+		return nil
+	}
+	token, err := resolveSecret(i.settings, "admin-api-token")
+	if err != nil {
+		return err
+	}
+	i.adminAPIToken = token
+	if i.settings.GetString("admin-listen-address") == "" {
+		return errors.New("the session API requires admin-listen-address")
+	}
+	if i.settings.GetString("admin-client-ca") != "" && i.settings.GetString("admin-tls-certificate") == "" {
+		return errors.New("admin-client-ca requires admin-tls-certificate")
+	}
+	return nil
+}
+
+// authorizedAdmin reports whether the request has the admin-api-token as a bearer token or a client certificate
+// the admin listener verified against admin-client-ca
+func (i *IDP) authorizedAdmin(r *http.Request) bool {
+	if token := i.adminAPIToken; token != "" {
+		const prefix = "Bearer "
+		auth := r.Header.Get("Authorization")
+		if strings.HasPrefix(auth, prefix) &&
+			subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, prefix)), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return i.settings.GetString("admin-client-ca") != "" && r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
+
+// DefaultSessionsHandler is the default implementation for the session API at admin-sessions-path. GET lists active
+// sessions, optionally only those of the user query parameter. DELETE revokes the session whose ID follows the path,
+// or every session of the user query parameter. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultSessionsHandler() http.HandlerFunc {
+	path := i.settings.GetString("admin-sessions-path")
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !i.authorizedAdmin(r) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, path), "/")
+		userName := r.URL.Query().Get("user")
+		switch {
+		case r.Method == http.MethodGet && id == "":
+			sessions, err := i.findSessions(func(user *model.User) bool {
+				return userName == "" || user.Name == userName
+			})
+			if err != nil {
+				log.Errorf("failed to list sessions: %v", err)
+				http.Error(w, "failed to list sessions", http.StatusInternalServerError)
+				return
+			}
+			infos := []SessionInfo{}
+			for _, user := range sessions {
+				infos = append(infos, i.sessionInfo(user))
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				Sessions []SessionInfo `json:"sessions"`
+			}{infos})
+		case r.Method == http.MethodDelete && (id != "" || userName != ""):
+			revoked, err := i.revokeSessions(func(user *model.User) bool {
+				return (id == "" || user.SessionIndex == id) && (userName == "" || user.Name == userName)
+			})
+			if err != nil {
+				log.Errorf("failed to revoke sessions: %v", err)
+				http.Error(w, "failed to revoke sessions", http.StatusInternalServerError)
+				return
+			}
+			if id != "" && revoked == 0 {
+				http.Error(w, "session not found", http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(struct {
+				Revoked int `json:"revoked"`
+			}{revoked})
+		default:
+			http.Error(w, "list sessions with GET, or revoke them with DELETE and a session ID or user", http.StatusBadRequest)
+		}
+	}
+}
+
+// findSessions returns the sessions in the UserCache that match. Ended sessions and those saved before sessions
+// recorded their ID are left out.
+func (i *IDP) findSessions(match func(*model.User) bool) ([]*model.User, error) {
+	now := time.Now()
+	sessions := []*model.User{}
+	err := store.List(i.UserCache, func(entry []byte) error {
+		user := &model.User{}
+		// Skip entries that aren't sessions, such as readiness probes
+		if err := proto.Unmarshal(entry, user); err != nil || user.SessionID == "" || user.Name == "" {
+			return nil
+		}
+		if i.sessionEnded(user, now) == "" && match(user) {
+			sessions = append(sessions, user)
+		}
+		return nil
+	})
+	return sessions, err
+}
+
+// revokeSessions deletes the matching sessions from the UserCache, so their users have to log in again
+func (i *IDP) revokeSessions(match func(*model.User) bool) (int, error) {
+	sessions, err := i.findSessions(match)
+	if err != nil {
+		return 0, err
+	}
+	for _, user := range sessions {
+		if err = i.UserCache.Delete(user.SessionID); err != nil {
+			return 0, err
+		}
+		log.WithFields(log.Fields{
+			"event":         "session_revoked",
+			"user":          user.Name,
+			"session_index": user.SessionIndex,
+		}).Info("session revoked")
+	}
+	return len(sessions), nil
+}
+
+func (i *IDP) sessionInfo(user *model.User) SessionInfo {
+	info := SessionInfo{
+		ID:               user.SessionIndex,
+		User:             user.Name,
+		ServiceProviders: user.ServiceProviders,
+	}
+	if info.ServiceProviders == nil {
+		info.ServiceProviders = []string{}
+	}
+	if created, err := ptypes.Timestamp(user.AuthnInstant); err == nil {
+		expires := created.Add(i.sessionLifetime)
+		info.Created = &created
+		info.Expires = &expires
+	}
+	if lastActivity, err := ptypes.Timestamp(user.LastActivity); err == nil {
+		info.LastActivity = &lastActivity
+		if idle := lastActivity.Add(i.sessionIdleTimeout); i.sessionIdleTimeout > 0 && (info.Expires == nil || idle.Before(*info.Expires)) {
+			info.Expires = &idle
+		}
+	}
+	return info
+}
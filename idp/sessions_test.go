@@ -0,0 +1,150 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// sessionsRequest sends a request to the session API on the admin listener with the token
+func sessionsRequest(i *IDP, method, target, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	i.AdminHandler().ServeHTTP(w, r)
+	return w
+}
+
+func listSessions(t *testing.T, i *IDP, target string) []SessionInfo {
+	w := sessionsRequest(i, "GET", target, "secret")
+	if !assert.Equal(t, http.StatusOK, w.Code) {
+		return nil
+	}
+	var list struct {
+		Sessions []SessionInfo `json:"sessions"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatal(err)
+	}
+	return list.Sessions
+}
+
+func TestIDP_DefaultSessionsHandler(t *testing.T) {
+	viper.Set("admin-listen-address", "127.0.0.1:9090")
+	defer viper.Set("admin-listen-address", "")
+	viper.Set("admin-api-token", "secret")
+	defer viper.Set("admin-api-token", "")
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	loggedIn := time.Now().Add(-time.Hour).Truncate(time.Second)
+	authnInstant, _ := ptypes.TimestampProto(loggedIn)
+	for id, session := range map[string]*model.User{
+		"cookie-1": {Name: "joe", SessionID: "cookie-1", SessionIndex: "index-1", ServiceProviders: []string{"dex"}, AuthnInstant: authnInstant, LastActivity: authnInstant},
+		"cookie-2": {Name: "joe", SessionID: "cookie-2", SessionIndex: "index-2"},
+		"cookie-3": {Name: "ann", SessionID: "cookie-3", SessionIndex: "index-3"},
+		// Sessions from before IDs were recorded can't be revoked, so they aren't listed
+		"cookie-4": {Name: "bob", SessionIndex: "index-4"},
+	} {
+		addTestSession(t, i, id, session)
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, sessionsRequest(i, "GET", "/admin/sessions", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, sessionsRequest(i, "GET", "/admin/sessions", "wrong").Code)
+
+	sessions := listSessions(t, i, "/admin/sessions")
+	assert.Len(t, sessions, 3)
+	sessions = listSessions(t, i, "/admin/sessions?user=joe")
+	if assert.Len(t, sessions, 2) {
+		for _, session := range sessions {
+			if session.ID != "index-1" {
+				continue
+			}
+			assert.Equal(t, "joe", session.User)
+			assert.Equal(t, []string{"dex"}, session.ServiceProviders)
+			if assert.NotNil(t, session.Created) && assert.NotNil(t, session.Expires) {
+				assert.True(t, loggedIn.Equal(*session.Created))
+				assert.True(t, loggedIn.Add(i.sessionLifetime).Equal(*session.Expires))
+			}
+		}
+	}
+
+	w := sessionsRequest(i, "DELETE", "/admin/sessions/index-1", "secret")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"revoked": 1}`, w.Body.String())
+	_, err := i.UserCache.Get("cookie-1")
+	assert.Error(t, err, "the session should be removed from the store")
+	assert.Equal(t, http.StatusNotFound, sessionsRequest(i, "DELETE", "/admin/sessions/index-1", "secret").Code)
+
+	w = sessionsRequest(i, "DELETE", "/admin/sessions?user=joe", "secret")
+	assert.JSONEq(t, `{"revoked": 1}`, w.Body.String())
+	sessions = listSessions(t, i, "/admin/sessions")
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, "ann", sessions[0].User)
+	}
+
+	assert.Equal(t, http.StatusBadRequest, sessionsRequest(i, "DELETE", "/admin/sessions", "secret").Code,
+		"revoking every session needs a user")
+}
+
+func TestIDP_authorizedAdmin_clientCertificate(t *testing.T) {
+	viper.Set("admin-client-ca", "ca.pem")
+	defer viper.Set("admin-client-ca", "")
+	i := &IDP{settings: viper.GetViper()}
+	r := httptest.NewRequest("GET", "/admin/sessions", nil)
+	assert.False(t, i.authorizedAdmin(r))
+	r.TLS = &tls.ConnectionState{}
+	assert.False(t, i.authorizedAdmin(r), "the certificate must be verified by the admin listener")
+	r.TLS.VerifiedChains = [][]*x509.Certificate{{newClientCertificate(t)}}
+	assert.True(t, i.authorizedAdmin(r))
+}
+
+func TestIDP_configureSessionAPI(t *testing.T) {
+	viper.Set("admin-listen-address", "127.0.0.1:9090")
+	defer viper.Set("admin-listen-address", "")
+	viper.Set("admin-api-token", "secret")
+	defer viper.Set("admin-api-token", "")
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	resp, err := ts.Client().Get(ts.URL + "/admin/sessions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode, "the session API shouldn't be on the public port")
+
+	viper.Set("admin-client-ca", "ca.pem")
+	defer viper.Set("admin-client-ca", "")
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err, "client certificates require TLS on the admin listener")
+
+	viper.Set("admin-client-ca", "")
+	viper.Set("admin-listen-address", "")
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err, "the session API should only be served on the admin listener")
+}
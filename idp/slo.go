@@ -0,0 +1,262 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultSingleLogoutHandler is the default implementation for the single logout handler. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultSingleLogoutHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			query, err := parseRedirectQuery(r)
+			if err != nil {
+				return err
+			}
+			if query.get("SAMLResponse") != "" {
+				return i.processLogoutResponse(query, w, r)
+			}
+			return i.processLogoutRequest(query, w, r)
+		}()
+		if err != nil {
+			i.writeError(w, r, err, http.StatusBadRequest)
+		}
+	}
+}
+
+func (i *IDP) processLogoutRequest(query redirectQuery, w http.ResponseWriter, r *http.Request) error {
+	logoutReq := &saml.LogoutRequest{}
+	if err := i.decodeRedirectMessage(query.get("SAMLRequest"), logoutReq); err != nil {
+		return err
+	}
+	sp, err := i.validateRedirectMessage(logoutReq.Issuer, logoutReq.IssueInstant, query, r)
+	if err != nil {
+		return err
+	}
+	if err = i.checkNotOnOrAfter(logoutReq.NotOnOrAfter); err != nil {
+		return err
+	}
+	slo := sp.singleLogoutService(redirectBinding)
+	if slo == nil {
+		return errors.New("service provider does not support redirect single logout")
+	}
+	log.Infof("received logout request from %s", logoutReq.Issuer)
+
+	status := &saml.Status{
+		StatusCode: saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:Success",
+		},
+	}
+	var propagate []string
+	session, user := i.getSession(r)
+	switch {
+	case user == nil:
+		// Session already expired. There is nothing to terminate.
+		log.Info("no active session found for logout request")
+	case !i.matchesNameID(logoutReq.NameID, user, sp.EntityID):
+		log.Warnf("logout request from %s does not match the active session", logoutReq.Issuer)
+		status.StatusCode.Value = "urn:oasis:names:tc:SAML:2.0:status:Requester"
+		status.StatusCode.StatusCode = &saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:UnknownPrincipal",
+		}
+	default:
+		if err = i.UserCache.Delete(session); err != nil {
+			return err
+		}
+		cookie := i.sessionCookie("")
+		cookie.MaxAge = -1
+		http.SetCookie(w, cookie)
+		log.Infof("terminated session for %s", user.Name)
+		if propagate, err = i.propagateLogout(user, sp.EntityID); err != nil {
+			return err
+		}
+		if failed := i.backChannelLogout(r.Context(), user, sp.EntityID); len(failed) > 0 {
+			log.Warnf("%s wasn't logged out of %s", user.Name, strings.Join(failed, ", "))
+			status = partialLogoutStatus
+		}
+	}
+
+	location := slo.ResponseLocation
+	if location == "" {
+		location = slo.Location
+	}
+	response := &saml.LogoutResponse{
+		StatusResponseType: saml.StatusResponseType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now(),
+			Issuer:       i.issuer(sp.EntityID),
+			Destination:  location,
+			InResponseTo: logoutReq.ID,
+			Status:       status,
+		},
+	}
+	target, err := i.redirectURL(location, "SAMLResponse", response, query.get("RelayState"))
+	if err != nil {
+		return err
+	}
+	if len(propagate) == 0 {
+		http.Redirect(w, r, target, http.StatusFound)
+		return nil
+	}
+	// Other service providers are loaded in hidden frames before returning to the requester
+	data := struct {
+		Requests []string
+		Target   string
+	}{propagate, target}
+	return i.logoutTemplate.Execute(w, data)
+}
+
+// propagateLogout builds signed redirect logout requests for the other service providers that received assertions
+// during the session. Service providers with a SOAP single logout service are notified by backChannelLogout instead.
+func (i *IDP) propagateLogout(user *model.User, requester string) ([]string, error) {
+	requests := []string{}
+	for _, entityID := range user.ServiceProviders {
+		if entityID == requester {
+			continue
+		}
+		sp, ok := i.sps.get(entityID)
+		if !ok || sp.singleLogoutService(soapBinding) != nil {
+			continue
+		}
+		slo := sp.singleLogoutService(redirectBinding)
+		if slo == nil {
+			log.Infof("unable to propagate logout to %s, no single logout service", entityID)
+			continue
+		}
+		nameID, err := i.makeNameID(user, entityID, "")
+		if err != nil {
+			log.Infof("unable to propagate logout to %s: %v", entityID, err)
+			continue
+		}
+		logoutReq := &saml.LogoutRequest{
+			RequestAbstractType: saml.RequestAbstractType{
+				ID:           saml.NewID(),
+				Version:      "2.0",
+				IssueInstant: time.Now(),
+				Issuer:       i.entityID,
+				Destination:  slo.Location,
+			},
+			NameID:       nameID,
+			SessionIndex: []string{user.SessionIndex},
+		}
+		target, err := i.redirectURL(slo.Location, "SAMLRequest", logoutReq, "")
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, target)
+	}
+	return requests, nil
+}
+
+func (i *IDP) processLogoutResponse(query redirectQuery, w http.ResponseWriter, r *http.Request) error {
+	logoutResp := &saml.LogoutResponse{}
+	if err := i.decodeRedirectMessage(query.get("SAMLResponse"), logoutResp); err != nil {
+		return err
+	}
+	if logoutResp.Issuer == nil {
+		return errors.New("response does not contain an issuer")
+	}
+	if _, err := i.validateRedirectMessage(logoutResp.Issuer.Value, logoutResp.IssueInstant, query, r); err != nil {
+		return err
+	}
+	status := ""
+	if logoutResp.Status != nil {
+		status = logoutResp.Status.StatusCode.Value
+	}
+	log.Infof("received logout response from %s with status %s", logoutResp.Issuer.Value, status)
+	return nil
+}
+
+// validateRedirectMessage checks the issuer, signature, and IssueInstant of a message sent with the HTTP-Redirect binding
+func (i *IDP) validateRedirectMessage(issuer string, issued time.Time, query redirectQuery, r *http.Request) (*ServiceProvider, error) {
+	if issuer == "" {
+		return nil, errors.New("message does not contain an issuer")
+	}
+	sp, ok := i.sps.get(issuer)
+	if !ok {
+		return nil, &UnknownServiceProviderError{issuer}
+	}
+	if err := verifySignature(query, sp); err != nil {
+		i.metrics.signatureFailures.Inc(sp.EntityID)
+		return nil, err
+	}
+	if err := i.checkIssueInstant(issued); err != nil {
+		return nil, err
+	}
+	recordServiceProvider(r, sp.EntityID)
+	return sp, nil
+}
+
+// redirectURL encodes and signs a SAML message for delivery with the HTTP-Redirect binding
+func (i *IDP) redirectURL(location, parameter string, message interface{}, relayState string) (string, error) {
+	var data, b bytes.Buffer
+	if err := xml.NewEncoder(&data).Encode(message); err != nil {
+		return "", err
+	}
+	i.debugMessage(messageSent, data.Bytes())
+	writer, err := flate.NewWriter(&b, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err = writer.Write(data.Bytes()); err != nil {
+		return "", err
+	}
+	if err = writer.Close(); err != nil {
+		return "", err
+	}
+	query := fmt.Sprintf("%s=%s", parameter, url.QueryEscape(base64.StdEncoding.EncodeToString(b.Bytes())))
+	if relayState != "" {
+		query = fmt.Sprintf("%s&RelayState=%s", query, url.QueryEscape(relayState))
+	}
+	query = fmt.Sprintf("%s&SigAlg=%s", query, url.QueryEscape(i.signer.Algorithm()))
+	signature, err := i.signer.Sign([]byte(query))
+	if err != nil {
+		return "", err
+	}
+	target, err := url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	query = fmt.Sprintf("%s&Signature=%s", query, url.QueryEscape(signature))
+	if target.RawQuery != "" {
+		query = target.RawQuery + "&" + query
+	}
+	target.RawQuery = query
+	return target.String(), nil
+}
+
+const logoutTemplate = `<!DOCTYPE html>
+<html lang="en">
+<body onload="window.location.replace(document.getElementById('continue').href)">
+<p>Signing out of all applications.</p>
+{{ range .Requests }}<iframe src="{{ . }}" style="display:none" width="0" height="0"></iframe>
+{{ end }}<p><a id="continue" href="{{ .Target }}">Continue</a></p>
+</body>
+</html>`
@@ -0,0 +1,162 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+)
+
+const testSLOLocation = "https://sp.example.com/saml/slo"
+
+func sendLogoutRequest(t *testing.T, i *IDP, sp, name string, session *http.Cookie) (*httptest.ResponseRecorder, *saml.LogoutResponse) {
+	return sendLogoutRequestWithNameID(t, i, sp, &saml.NameID{Value: name}, session)
+}
+
+func sendLogoutRequestWithNameID(t *testing.T, i *IDP, sp string, nameID *saml.NameID, session *http.Cookie) (*httptest.ResponseRecorder, *saml.LogoutResponse) {
+	logoutReq := &saml.LogoutRequest{
+		RequestAbstractType: saml.RequestAbstractType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now(),
+			Issuer:       sp,
+		},
+		NameID: nameID,
+	}
+	// The test service provider shares the IdP's key so its requests can be signed here
+	target, err := i.redirectURL(i.singleLogoutServiceLocation, "SAMLRequest", logoutReq, "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", target, nil)
+	if session != nil {
+		r.AddCookie(session)
+	}
+	w := httptest.NewRecorder()
+	i.SingleLogoutHandler(w, r)
+	if w.Code != http.StatusFound {
+		return w, nil
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(location.String(), testSLOLocation), "should redirect to the service provider")
+	assert.Equal(t, "state", location.Query().Get("RelayState"))
+	logoutResp := &saml.LogoutResponse{}
+	if err = i.decodeRedirectMessage(location.Query().Get("SAMLResponse"), logoutResp); err != nil {
+		t.Fatal(err)
+	}
+	return w, logoutResp
+}
+
+func addTestSession(t *testing.T, i *IDP, id string, user *model.User) *http.Cookie {
+	data, err := proto.Marshal(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = i.UserCache.Set(id, data); err != nil {
+		t.Fatal(err)
+	}
+	return &http.Cookie{Name: i.cookieName, Value: id}
+}
+
+func TestIDP_DefaultSingleLogoutHandler(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	cookie := addTestSession(t, i, "12345", &model.User{Name: "joe", ServiceProviders: []string{"dex"}})
+	w, resp := sendLogoutRequest(t, i, "dex", "joe", cookie)
+	if !assert.NotNil(t, resp, "expected a logout response") {
+		return
+	}
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", resp.Status.StatusCode.Value)
+	assert.Equal(t, testSLOLocation, resp.Destination)
+	_, err := i.UserCache.Get("12345")
+	assert.Error(t, err, "session should be deleted")
+	assert.Contains(t, w.Header().Get("Set-Cookie"), "Max-Age=0", "cookie should be expired")
+}
+
+func TestIDP_DefaultSingleLogoutHandler_expiredSession(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	_, resp := sendLogoutRequest(t, i, "dex", "joe", &http.Cookie{Name: i.cookieName, Value: "missing"})
+	if !assert.NotNil(t, resp, "expected a logout response") {
+		return
+	}
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Success", resp.Status.StatusCode.Value)
+}
+
+func TestIDP_DefaultSingleLogoutHandler_wrongUser(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	cookie := addTestSession(t, i, "12345", &model.User{Name: "joe"})
+	_, resp := sendLogoutRequest(t, i, "dex", "bob", cookie)
+	if !assert.NotNil(t, resp, "expected a logout response") {
+		return
+	}
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Requester", resp.Status.StatusCode.Value)
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:UnknownPrincipal", resp.Status.StatusCode.StatusCode.Value)
+	_, err := i.UserCache.Get("12345")
+	assert.NoError(t, err, "session should remain")
+}
+
+func TestIDP_DefaultSingleLogoutHandler_unregistered(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	w, _ := sendLogoutRequest(t, i, "unknown", "joe", nil)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestIDP_DefaultSingleLogoutHandler_duplicateParameters(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	cookie := addTestSession(t, i, "12345", &model.User{Name: "joe", ServiceProviders: []string{"dex"}})
+	logoutReq := &saml.LogoutRequest{
+		RequestAbstractType: saml.RequestAbstractType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now(),
+			Issuer:       "dex",
+		},
+		NameID: &saml.NameID{Value: "joe"},
+	}
+	target, err := i.redirectURL(i.singleLogoutServiceLocation, "SAMLRequest", logoutReq, "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, extra := range []string{"SAMLRequest=forged", "SAMLResponse=forged", "Signature=forged", "RelayState=forged"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", target+"&"+extra, nil)
+		r.AddCookie(cookie)
+		i.SingleLogoutHandler(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code, extra)
+	}
+	_, err = i.UserCache.Get("12345")
+	assert.NoError(t, err, "session should remain")
+}
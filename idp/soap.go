@@ -0,0 +1,106 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/amdonov/lite-idp/saml"
+	log "github.com/sirupsen/logrus"
+)
+
+// requesterStatus tells a service provider that its request was at fault
+var requesterStatus = &saml.Status{
+	StatusCode: saml.StatusCode{
+		Value: "urn:oasis:names:tc:SAML:2.0:status:Requester",
+	},
+}
+
+// responderStatus tells a service provider that the IdP failed to handle its request
+var responderStatus = &saml.Status{
+	StatusCode: saml.StatusCode{
+		Value: "urn:oasis:names:tc:SAML:2.0:status:Responder",
+	},
+}
+
+// soapFault is an error in a request to a SOAP endpoint that the client caused. It's reported as a Client fault
+// with the HTTP status and the SAML status in the fault's detail.
+type soapFault struct {
+	httpStatus int
+	status     *saml.Status
+	err        error
+}
+
+func (e *soapFault) Error() string {
+	return e.err.Error()
+}
+
+func (e *soapFault) Unwrap() error {
+	return e.err
+}
+
+// clientFault reports an invalid request to a SOAP endpoint with 400 Bad Request and a Requester status
+func clientFault(err error) error {
+	return &soapFault{http.StatusBadRequest, requesterStatus, err}
+}
+
+// deniedFault reports a request to a SOAP endpoint that the IdP refused with the HTTP status and a
+// RequestDenied status
+func deniedFault(httpStatus int, err error) error {
+	return &soapFault{httpStatus, requestDeniedStatus, err}
+}
+
+// unmarshalSOAPRequest unmarshals the request in a SOAP Body into v and returns the request's XML. Enveloped
+// signatures are checked over that XML, so the request has to come from it rather than a separate parse of the
+// envelope, which could pick up elements the signature doesn't cover. The request must be the element v expects.
+func unmarshalSOAPRequest(body string, v interface{}) ([]byte, error) {
+	data := []byte(strings.TrimSpace(body))
+	if err := xml.Unmarshal(data, v); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// writeSOAPFault logs the error and returns it to the client as a SOAP 1.1 Fault. Errors that aren't a soapFault
+// are Server faults with 500 Internal Server Error and a Responder status.
+func writeSOAPFault(w http.ResponseWriter, err error) {
+	code, httpStatus, status := "soap:Server", http.StatusInternalServerError, responderStatus
+	var fault *soapFault
+	if errors.As(err, &fault) {
+		code, httpStatus, status = "soap:Client", fault.httpStatus, fault.status
+		log.Warn(err)
+	} else {
+		log.Error(err)
+	}
+	// encoding/xml qualifies child elements with their parent's namespace, but faultcode, faultstring, and
+	// detail must be unqualified, so the envelope is written with a prefix
+	var b bytes.Buffer
+	b.WriteString(xml.Header)
+	b.WriteString(`<soap:Envelope xmlns:soap="http://schemas.xmlsoap.org/soap/envelope/"><soap:Body><soap:Fault>`)
+	b.WriteString("<faultcode>" + code + "</faultcode><faultstring>")
+	xml.EscapeText(&b, []byte(err.Error()))
+	b.WriteString("</faultstring><detail>")
+	if encodeErr := xml.NewEncoder(&b).Encode(status); encodeErr != nil {
+		log.Errorf("failed to encode SOAP fault: %v", encodeErr)
+	}
+	b.WriteString("</detail></soap:Fault></soap:Body></soap:Envelope>")
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(httpStatus)
+	w.Write(b.Bytes())
+}
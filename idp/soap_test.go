@@ -0,0 +1,105 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// testFault is a SOAP 1.1 fault with unqualified children
+type testFault struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    struct {
+		Fault struct {
+			Code   string `xml:"faultcode"`
+			String string `xml:"faultstring"`
+			Detail struct {
+				Status saml.Status
+			} `xml:"detail"`
+		} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Fault"`
+	} `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+}
+
+func readFault(t *testing.T, body io.Reader) *testFault {
+	fault := &testFault{}
+	if err := xml.NewDecoder(body).Decode(fault); err != nil {
+		t.Fatal(err)
+	}
+	return fault
+}
+
+func Test_writeSOAPFault(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeSOAPFault(w, clientFault(errors.New("bad <request>")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "text/xml; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), "<faultcode>soap:Client</faultcode>", "fault children must be unqualified")
+	fault := readFault(t, w.Body)
+	assert.Equal(t, "soap:Client", fault.Body.Fault.Code)
+	assert.Equal(t, "bad <request>", fault.Body.Fault.String)
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Requester", fault.Body.Fault.Detail.Status.StatusCode.Value)
+
+	w = httptest.NewRecorder()
+	writeSOAPFault(w, deniedFault(http.StatusUnauthorized, errors.New("no certificate")))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	fault = readFault(t, w.Body)
+	assert.Equal(t, "soap:Client", fault.Body.Fault.Code)
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:RequestDenied", fault.Body.Fault.Detail.Status.StatusCode.StatusCode.Value)
+
+	w = httptest.NewRecorder()
+	writeSOAPFault(w, errors.New("store is down"))
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	fault = readFault(t, w.Body)
+	assert.Equal(t, "soap:Server", fault.Body.Fault.Code)
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Responder", fault.Body.Fault.Detail.Status.StatusCode.Value)
+}
+
+func TestIDP_soapFaults(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		httpStatus int
+	}{
+		{"malformed query", "attribute-service-path", "<Envelope", http.StatusBadRequest},
+		{"query without an IssueInstant", "attribute-service-path",
+			`<Envelope xmlns="http://schemas.xmlsoap.org/soap/envelope/"><Body/></Envelope>`, http.StatusBadRequest},
+		{"artifact resolution without a certificate", "artifact-service-path", "<Envelope", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := ts.Client().Post(ts.URL+viper.GetString(tt.path), "text/xml", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			assert.Equal(t, tt.httpStatus, resp.StatusCode)
+			assert.Equal(t, "soap:Client", readFault(t, resp.Body).Body.Fault.Code)
+		})
+	}
+}
@@ -19,31 +19,140 @@ import (
 	"encoding/base64"
 	"encoding/xml"
 	"errors"
+	"fmt"
 	"io"
+	"strings"
 
+	"github.com/amdonov/lite-idp/dsig"
 	"github.com/amdonov/lite-idp/saml"
 )
 
-//ServiceProvider stores the Service Provider metadata required by the IdP
+// ServiceProvider stores the Service Provider metadata required by the IdP
 type ServiceProvider struct {
-	EntityID                  string
+	EntityID string
+	// Name shown on the login page, the entity ID is shown if it's empty
+	Name string
+	// Names shown to users in other languages, keyed by language such as de. Service providers loaded from
+	// metadata get them and their Name from the mdui:DisplayName elements.
+	DisplayNames              map[string]string
 	AssertionConsumerServices []AssertionConsumerService
-	Certificate               string
+	SingleLogoutServices      []SingleLogoutService
+	ManageNameIDServices      []ManageNameIDService
+	// Attributes the service provider asks for, which AuthnRequests select with AttributeConsumingServiceIndex
+	AttributeConsumingServices []AttributeConsumingService
+	Certificate                string
+	// Certificate used to encrypt assertions if it differs from the signing certificate
+	EncryptionCertificate string
+	// Send assertions as EncryptedAssertions
+	EncryptAssertions bool
+	// Send NameIDs as EncryptedIDs in assertions
+	EncryptNameID bool
+	// Content encryption algorithm for assertions and NameIDs. Defaults to the encryption-algorithm setting.
+	EncryptionAlgorithm string
+	// Signature and digest algorithms preferred by the service provider, most preferred first.
+	// The first that the IdP's key supports is used to sign assertions for the service provider.
+	SigningMethods []string
+	DigestMethods  []string
+	// Where responses to the service provider are signed: assertion, response, or both. Defaults to assertion.
+	SignatureLocation string
+	// How signed content is canonicalized for the service provider: exclusive or inclusive. Defaults to exclusive.
+	Canonicalization string
+	// Prefixes that exclusive canonicalization renders as if they were visibly used, #default for the default namespace
+	InclusiveNamespaces []string
+	// Require signed assertions, read from WantAssertionsSigned in the service provider's metadata
+	WantAssertionsSigned bool
+	// Reject AuthnRequests that aren't signed. Defaults to the want-authn-requests-signed setting
+	// unless the service provider's metadata sets AuthnRequestsSigned.
+	AuthnRequestsSigned *bool
+	// Reject ArtifactResolves that aren't signed. Defaults to the want-artifact-resolve-signed setting.
+	ArtifactResolveSigned *bool
+	// NameID formats supported by the service provider, most preferred first
+	NameIDFormats []string
+	// Qualifiers of the NameIDs sent to the service provider, such as an affiliation it belongs to. They default
+	// to the IdP's entity ID and the service provider's entity ID.
+	NameQualifier   string
+	SPNameQualifier string
+	// How attributes are named in assertions for the service provider, overriding attribute-definitions
+	AttributeDefinitions []AttributeDefinition
+	// Names of attributes listed first in assertions for the service provider, overriding attribute-order
+	AttributeOrder []string
+	// Ask users to approve the attributes released to the service provider. Defaults to consent-enabled.
+	Consent *bool
+	// Attributes that may be released to the service provider. The attribute bundles for its entity categories are
+	// released if it isn't set, and attribute-release-default applies if none of them has a bundle.
+	ReleaseAttributes []AttributeRelease
+	// Entity categories the service provider belongs to, read from the EntityAttributes in its metadata
+	EntityCategories []string
+	// RelayState sent with IdP-initiated responses when the link doesn't have one, such as the page users land on
+	DefaultRelayState string
+	// List the service provider on the landing page shown at the SSO endpoint without an AuthnRequest
+	ShowOnLandingPage bool
+	// How the subject of assertions is confirmed: bearer or holder-of-key. Defaults to bearer. Holder-of-key
+	// assertions name the client certificate the user logged in with.
+	SubjectConfirmation string
+	// Audiences listed after the entity ID in the AudienceRestriction of assertions, such as the
+	// service provider's entity ID before it was changed
+	Audiences []string
+	// Format of the Issuer in responses and assertions for the service provider, or none to leave it out.
+	// Defaults to the issuer-format setting.
+	IssuerFormat string
 	// Could be an RSA or DSA public key
-	publicKey interface{}
+	publicKey     interface{}
+	encryptionKey interface{}
+	// signer for service providers that prefer other algorithms than the IdP's default
+	signer dsig.Signer
+	// AttributeDefinitions indexed by attribute
+	attributeDefinitions attributeDefinitions
+	releasePolicy        *releasePolicy
+	// metadata file the service provider was loaded from, empty for the sps setting
+	source string
+}
+
+// audiences is the entity ID followed by the additional Audiences
+func (sp *ServiceProvider) audiences() []string {
+	audiences := []string{sp.EntityID}
+	for _, audience := range sp.Audiences {
+		if !containsString(audiences, audience) {
+			audiences = append(audiences, audience)
+		}
+	}
+	return audiences
+}
+
+// validateAudiences ensures assertions for the service provider name at least one audience and no empty ones
+func (sp *ServiceProvider) validateAudiences() error {
+	for _, audience := range sp.audiences() {
+		if audience == "" {
+			return fmt.Errorf("service provider %s has an empty audience", sp.EntityID)
+		}
+	}
+	return nil
 }
 
 func (sp *ServiceProvider) parseCertificate() error {
-	block, err := base64.StdEncoding.DecodeString(sp.Certificate)
+	key, err := parsePublicKey(sp.Certificate)
 	if err != nil {
-		return errors.New("failed to parse PEM block containing the public key")
+		return err
+	}
+	sp.publicKey = key
+	if sp.EncryptionCertificate != "" {
+		if sp.encryptionKey, err = parsePublicKey(sp.EncryptionCertificate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parsePublicKey(certificate string) (interface{}, error) {
+	block, err := base64.StdEncoding.DecodeString(certificate)
+	if err != nil {
+		return nil, errors.New("failed to parse PEM block containing the public key")
 	}
 	cert, err := x509.ParseCertificate(block)
 	if err != nil {
-		return errors.New("failed to parse certificate: " + err.Error())
+		return nil, errors.New("failed to parse certificate: " + err.Error())
 	}
-	sp.publicKey = cert.PublicKey
-	return nil
+	return cert.PublicKey, nil
 }
 
 // AssertionConsumerService is a SAML assertion consumer service
@@ -54,6 +163,118 @@ type AssertionConsumerService struct {
 	Location  string
 }
 
+// AttributeConsumingService is a set of attributes requested by a service provider
+type AttributeConsumingService struct {
+	Index               uint32
+	RequestedAttributes []RequestedAttribute
+}
+
+// RequestedAttribute is an attribute a service provider asks for by its name in assertions. NameFormat must match
+// too if it's set, and only the listed Values are released if there are any.
+type RequestedAttribute struct {
+	Name       string
+	NameFormat string
+	Values     []string
+	// Fail the login if the attribute can't be released
+	Required bool
+}
+
+// SingleLogoutService is a SAML single logout service
+type SingleLogoutService struct {
+	Binding          string
+	Location         string
+	ResponseLocation string
+}
+
+// ManageNameIDService is a SAML name identifier management service
+type ManageNameIDService struct {
+	Binding          string
+	Location         string
+	ResponseLocation string
+}
+
+// assertionConsumerService returns the endpoint from the metadata that the response to the request is sent to.
+// Requests can select one by index or by location and binding. The default for the binding is used if they don't.
+func (sp *ServiceProvider) assertionConsumerService(request *saml.AuthnRequest) (*AssertionConsumerService, error) {
+	var acs *AssertionConsumerService
+	switch {
+	case request.AssertionConsumerServiceIndex != nil:
+		for i := range sp.AssertionConsumerServices {
+			if sp.AssertionConsumerServices[i].Index == *request.AssertionConsumerServiceIndex {
+				acs = &sp.AssertionConsumerServices[i]
+				break
+			}
+		}
+		if acs == nil {
+			return nil, fmt.Errorf("assertion consumer service index %d in request does not match metadata", *request.AssertionConsumerServiceIndex)
+		}
+		if request.AssertionConsumerServiceURL != "" && request.AssertionConsumerServiceURL != acs.Location {
+			return nil, errors.New("assertion consumer location in request does not match the index")
+		}
+	case request.AssertionConsumerServiceURL != "":
+		for i, a := range sp.AssertionConsumerServices {
+			if a.Location == request.AssertionConsumerServiceURL &&
+				(request.ProtocolBinding == "" || a.Binding == request.ProtocolBinding) {
+				acs = &sp.AssertionConsumerServices[i]
+				break
+			}
+		}
+		if acs == nil {
+			return nil, errors.New("assertion consumer location in request does not match metadata")
+		}
+	default:
+		// Use the default endpoint for the requested binding or the first if none is the default. Requests without
+		// a binding only get endpoints the browser can be sent to.
+		for i, a := range sp.AssertionConsumerServices {
+			if request.ProtocolBinding != "" && a.Binding != request.ProtocolBinding {
+				continue
+			}
+			if request.ProtocolBinding == "" && !responseBindingSupported(redirectBinding, a.Binding) {
+				continue
+			}
+			if acs == nil || (a.IsDefault && !acs.IsDefault) {
+				acs = &sp.AssertionConsumerServices[i]
+			}
+		}
+		if acs == nil {
+			return nil, errors.New("service provider does not have an assertion consumer service for the request")
+		}
+	}
+	if request.ProtocolBinding != "" && request.ProtocolBinding != acs.Binding {
+		return nil, errors.New("protocol binding in request does not match the assertion consumer service")
+	}
+	return acs, nil
+}
+
+// assertionConsumerLocations returns the locations of the service provider's assertion consumer services
+func (sp *ServiceProvider) assertionConsumerLocations() []string {
+	locations := make([]string, len(sp.AssertionConsumerServices))
+	for i, acs := range sp.AssertionConsumerServices {
+		locations[i] = acs.Location
+	}
+	return locations
+}
+
+// manageNameIDService returns the service provider's name identifier management endpoint for the given binding or nil
+func (sp *ServiceProvider) manageNameIDService(binding string) *ManageNameIDService {
+	for i := range sp.ManageNameIDServices {
+		if sp.ManageNameIDServices[i].Binding == binding {
+			return &sp.ManageNameIDServices[i]
+		}
+	}
+	return nil
+}
+
+// singleLogoutService returns the service provider's logout endpoint for the given binding or nil
+func (sp *ServiceProvider) singleLogoutService(binding string) *SingleLogoutService {
+	for i := range sp.SingleLogoutServices {
+		if sp.SingleLogoutServices[i].Binding == binding {
+			return &sp.SingleLogoutServices[i]
+		}
+	}
+	return nil
+}
+
 // ReadSPMetadata reads XML metadata from a reader
 func ReadSPMetadata(metadata io.Reader) (*ServiceProvider, error) {
 	decoder := xml.NewDecoder(metadata)
@@ -66,9 +287,77 @@ func ReadSPMetadata(metadata io.Reader) (*ServiceProvider, error) {
 
 func convertMetadata(spMeta *saml.SPEntityDescriptor) *ServiceProvider {
 	sp := &ServiceProvider{
-		Certificate: spMeta.SPSSODescriptor.KeyDescriptor.KeyInfo.X509Data.X509Certificate,
-		EntityID:    spMeta.EntityDescriptor.EntityID,
+		EntityID: spMeta.EntityDescriptor.EntityID,
+	}
+	for _, kd := range spMeta.SPSSODescriptor.KeyDescriptor {
+		if kd.KeyInfo.X509Data == nil {
+			continue
+		}
+		cert := kd.KeyInfo.X509Data.X509Certificate
+		// Keys without a use can be used for both signing and encryption
+		if kd.Use != "encryption" && sp.Certificate == "" {
+			sp.Certificate = cert
+		}
+		if kd.Use != "signing" && sp.EncryptionCertificate == "" {
+			sp.EncryptionCertificate = cert
+		}
+	}
+	if sp.EncryptionCertificate == sp.Certificate {
+		sp.EncryptionCertificate = ""
+	}
+	// Algorithm preferences can be placed on the entity or the role
+	for _, extensions := range []*saml.Extensions{spMeta.Extensions, spMeta.SPSSODescriptor.Extensions} {
+		if extensions == nil {
+			continue
+		}
+		for _, method := range extensions.SigningMethod {
+			sp.SigningMethods = append(sp.SigningMethods, method.Algorithm)
+		}
+		for _, method := range extensions.DigestMethod {
+			sp.DigestMethods = append(sp.DigestMethods, method.Algorithm)
+		}
+	}
+	// User interface information belongs on the role, but some metadata places it on the entity
+	for _, extensions := range []*saml.Extensions{spMeta.SPSSODescriptor.Extensions, spMeta.Extensions} {
+		if extensions == nil || extensions.UIInfo == nil {
+			continue
+		}
+		for _, name := range extensions.UIInfo.DisplayName {
+			lang, value := normalizeLocale(name.Lang), strings.TrimSpace(name.Value)
+			if value == "" {
+				continue
+			}
+			if sp.DisplayNames == nil {
+				sp.DisplayNames = map[string]string{}
+			}
+			if _, ok := sp.DisplayNames[lang]; !ok {
+				sp.DisplayNames[lang] = value
+			}
+			if sp.Name == "" {
+				sp.Name = value
+			}
+		}
 	}
+	// The English name is shown when there isn't one in the user's language
+	if name, ok := sp.DisplayNames["en"]; ok {
+		sp.Name = name
+	}
+	if spMeta.Extensions != nil && spMeta.Extensions.EntityAttributes != nil {
+		for _, att := range spMeta.Extensions.EntityAttributes.Attribute {
+			if att.Name != entityCategoryAttribute {
+				continue
+			}
+			for _, value := range att.AttributeValue {
+				sp.EntityCategories = append(sp.EntityCategories, strings.TrimSpace(value.Value))
+			}
+		}
+	}
+	sp.WantAssertionsSigned = spMeta.SPSSODescriptor.WantAssertionsSigned
+	if spMeta.SPSSODescriptor.AuthnRequestsSigned {
+		signed := true
+		sp.AuthnRequestsSigned = &signed
+	}
+	sp.NameIDFormats = spMeta.SPSSODescriptor.NameIDFormat
 	sp.AssertionConsumerServices = make([]AssertionConsumerService, len(spMeta.SPSSODescriptor.AssertionConsumerService))
 	for i, val := range spMeta.SPSSODescriptor.AssertionConsumerService {
 		sp.AssertionConsumerServices[i] = AssertionConsumerService{
@@ -78,5 +367,34 @@ func convertMetadata(spMeta *saml.SPEntityDescriptor) *ServiceProvider {
 			Location:  val.Location,
 		}
 	}
+	for _, val := range spMeta.SPSSODescriptor.AttributeConsumingService {
+		service := AttributeConsumingService{Index: val.Index}
+		for _, requested := range val.RequestedAttribute {
+			attribute := RequestedAttribute{
+				Name:       requested.Name,
+				NameFormat: requested.NameFormat,
+				Required:   requested.IsRequired,
+			}
+			for _, value := range requested.AttributeValue {
+				attribute.Values = append(attribute.Values, strings.TrimSpace(value.Value))
+			}
+			service.RequestedAttributes = append(service.RequestedAttributes, attribute)
+		}
+		sp.AttributeConsumingServices = append(sp.AttributeConsumingServices, service)
+	}
+	for _, val := range spMeta.SPSSODescriptor.SingleLogoutService {
+		sp.SingleLogoutServices = append(sp.SingleLogoutServices, SingleLogoutService{
+			Binding:          val.Binding,
+			Location:         val.Location,
+			ResponseLocation: val.ResponseLocation,
+		})
+	}
+	for _, val := range spMeta.SPSSODescriptor.ManageNameIDService {
+		sp.ManageNameIDServices = append(sp.ManageNameIDServices, ManageNameIDService{
+			Binding:          val.Binding,
+			Location:         val.Location,
+			ResponseLocation: val.ResponseLocation,
+		})
+	}
 	return sp
 }
@@ -17,8 +17,12 @@ package idp
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/xmlsig"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -34,3 +38,165 @@ func TestReadSPMetadata(t *testing.T) {
 	}
 	assert.Equal(t, "dex", sp.EntityID, "entity id is wrong")
 }
+
+func Test_convertMetadata_encryptionKey(t *testing.T) {
+	sp := convertMetadata(&saml.SPEntityDescriptor{
+		SPSSODescriptor: saml.SPSSODescriptor{
+			KeyDescriptor: []saml.KeyDescriptor{
+				{Use: "encryption", KeyInfo: xmlsig.KeyInfo{X509Data: &xmlsig.X509Data{X509Certificate: "enc"}}},
+				{Use: "signing", KeyInfo: xmlsig.KeyInfo{X509Data: &xmlsig.X509Data{X509Certificate: "sig"}}},
+			},
+		},
+	})
+	assert.Equal(t, "sig", sp.Certificate)
+	assert.Equal(t, "enc", sp.EncryptionCertificate)
+	sp = convertMetadata(&saml.SPEntityDescriptor{
+		SPSSODescriptor: saml.SPSSODescriptor{
+			KeyDescriptor: []saml.KeyDescriptor{
+				{KeyInfo: xmlsig.KeyInfo{X509Data: &xmlsig.X509Data{X509Certificate: "both"}}},
+			},
+		},
+	})
+	assert.Equal(t, "both", sp.Certificate)
+	assert.Empty(t, sp.EncryptionCertificate, "a key without a use should serve as both")
+}
+
+func Test_convertMetadata_algorithms(t *testing.T) {
+	sp := convertMetadata(&saml.SPEntityDescriptor{
+		EntityDescriptor: saml.EntityDescriptor{
+			Extensions: &saml.Extensions{
+				SigningMethod: []saml.AlgorithmMethod{{Algorithm: dsig.RSASHA512}},
+				DigestMethod:  []saml.AlgorithmMethod{{Algorithm: dsig.SHA512}},
+			},
+		},
+	})
+	assert.Equal(t, []string{dsig.RSASHA512}, sp.SigningMethods)
+	assert.Equal(t, []string{dsig.SHA512}, sp.DigestMethods)
+}
+
+func Test_convertMetadata_wantAssertionsSigned(t *testing.T) {
+	sp := convertMetadata(&saml.SPEntityDescriptor{SPSSODescriptor: saml.SPSSODescriptor{WantAssertionsSigned: true}})
+	assert.True(t, sp.WantAssertionsSigned)
+	assert.Empty(t, sp.SignatureLocation, "assertions are signed by default")
+}
+
+func Test_convertMetadata_manageNameIDServices(t *testing.T) {
+	sp, err := ReadSPMetadata(strings.NewReader(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://sp.example.com/">
+  <SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <SingleLogoutService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://sp.example.com/slo"/>
+    <ManageNameIDService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="https://sp.example.com/mni"
+      ResponseLocation="https://sp.example.com/mni/response"/>
+  </SPSSODescriptor>
+</EntityDescriptor>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := sp.manageNameIDService(redirectBinding)
+	if assert.NotNil(t, service) {
+		assert.Equal(t, "https://sp.example.com/mni", service.Location)
+		assert.Equal(t, "https://sp.example.com/mni/response", service.ResponseLocation)
+	}
+	assert.Nil(t, sp.manageNameIDService(soapBinding))
+}
+
+func Test_convertMetadata_entityCategories(t *testing.T) {
+	sp, err := ReadSPMetadata(strings.NewReader(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://sp.example.com/">
+  <Extensions>
+    <mdattr:EntityAttributes xmlns:mdattr="urn:oasis:names:tc:SAML:metadata:attribute" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">
+      <saml:Attribute Name="http://macedir.org/entity-category" NameFormat="urn:oasis:names:tc:SAML:2.0:attrname-format:uri">
+        <saml:AttributeValue>http://refeds.org/category/research-and-scholarship</saml:AttributeValue>
+        <saml:AttributeValue> http://www.geant.net/uri/dataprotection-code-of-conduct/v1 </saml:AttributeValue>
+      </saml:Attribute>
+      <saml:Attribute Name="urn:oasis:names:tc:SAML:attribute:assurance-certification">
+        <saml:AttributeValue>https://refeds.org/sirtfi</saml:AttributeValue>
+      </saml:Attribute>
+    </mdattr:EntityAttributes>
+  </Extensions>
+  <SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol"/>
+</EntityDescriptor>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{
+		"http://refeds.org/category/research-and-scholarship",
+		"http://www.geant.net/uri/dataprotection-code-of-conduct/v1",
+	}, sp.EntityCategories, "only entity categories should be read")
+}
+
+func Test_convertMetadata_displayNames(t *testing.T) {
+	sp, err := ReadSPMetadata(strings.NewReader(`<EntityDescriptor xmlns="urn:oasis:names:tc:SAML:2.0:metadata" entityID="https://sp.example.com/">
+  <SPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <Extensions>
+      <mdui:UIInfo xmlns:mdui="urn:oasis:names:tc:SAML:metadata:ui">
+        <mdui:DisplayName xml:lang="de">Wiki auf Deutsch</mdui:DisplayName>
+        <mdui:DisplayName xml:lang="en"> Wiki </mdui:DisplayName>
+        <mdui:DisplayName xml:lang="pt-BR">Wiki em português</mdui:DisplayName>
+      </mdui:UIInfo>
+    </Extensions>
+  </SPSSODescriptor>
+</EntityDescriptor>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "Wiki", sp.Name, "the English name should be the default")
+	assert.Equal(t, map[string]string{"de": "Wiki auf Deutsch", "en": "Wiki", "pt-br": "Wiki em português"}, sp.DisplayNames)
+}
+
+func TestServiceProvider_assertionConsumerService(t *testing.T) {
+	sp := &ServiceProvider{
+		AssertionConsumerServices: []AssertionConsumerService{
+			{Index: 0, Binding: artifactBinding, Location: "https://sp.example.com/artifact"},
+			{Index: 1, Binding: postBinding, Location: "https://sp.example.com/post", IsDefault: true},
+			{Index: 2, Binding: artifactBinding, Location: "https://sp.example.com/post"},
+		},
+	}
+	index := func(i uint32) *uint32 { return &i }
+	tests := []struct {
+		name    string
+		request saml.AuthnRequest
+		want    uint32
+		wantErr bool
+	}{
+		{"default", saml.AuthnRequest{}, 1, false},
+		{"default for binding", saml.AuthnRequest{ProtocolBinding: artifactBinding}, 0, false},
+		{"index", saml.AuthnRequest{AssertionConsumerServiceIndex: index(0)}, 0, false},
+		{"unknown index", saml.AuthnRequest{AssertionConsumerServiceIndex: index(3)}, 0, true},
+		{"index and other location", saml.AuthnRequest{AssertionConsumerServiceIndex: index(0),
+			AssertionConsumerServiceURL: "https://sp.example.com/post"}, 0, true},
+		{"location", saml.AuthnRequest{AssertionConsumerServiceURL: "https://sp.example.com/artifact"}, 0, false},
+		{"location and binding", saml.AuthnRequest{AssertionConsumerServiceURL: "https://sp.example.com/post",
+			ProtocolBinding: artifactBinding}, 2, false},
+		{"unknown location", saml.AuthnRequest{AssertionConsumerServiceURL: "https://attacker.example.com/"}, 0, true},
+		{"wrong binding", saml.AuthnRequest{AssertionConsumerServiceURL: "https://sp.example.com/artifact",
+			ProtocolBinding: postBinding}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			acs, err := sp.assertionConsumerService(&tt.request)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, acs.Index)
+			}
+		})
+	}
+}
+
+func TestServiceProvider_assertionConsumerService_browserBindings(t *testing.T) {
+	sp := &ServiceProvider{
+		AssertionConsumerServices: []AssertionConsumerService{
+			{Index: 0, Binding: paosBinding, Location: "https://sp.example.com/ecp", IsDefault: true},
+			{Index: 1, Binding: artifactBinding, Location: "https://sp.example.com/artifact"},
+		},
+	}
+	acs, err := sp.assertionConsumerService(&saml.AuthnRequest{})
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint32(1), acs.Index, "requests without a binding shouldn't default to PAOS")
+	}
+	acs, err = sp.assertionConsumerService(&saml.AuthnRequest{ProtocolBinding: paosBinding})
+	if assert.NoError(t, err) {
+		assert.Equal(t, uint32(0), acs.Index)
+	}
+}
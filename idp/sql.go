@@ -0,0 +1,134 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/spf13/viper"
+)
+
+type sqlSource struct {
+	db      *sql.DB
+	query   string
+	mapping map[string]string
+	timeout time.Duration
+}
+
+// NewSQLAttributeSource returns a source that adds attributes from the rows returned by sql.query, which is run with the
+// user's name as its only parameter. Columns are renamed with sql.attribute-map, and each row adds a value to the
+// attributes, so queries returning several rows produce multi-valued attributes. The driver named by sql.driver
+// must be registered by importing it into the application.
+func NewSQLAttributeSource() (AttributeSource, error) {
+	return newSQLAttributeSource(viper.GetViper())
+}
+
+func newSQLAttributeSource(settings *viper.Viper) (AttributeSource, error) {
+	query := settings.GetString("sql.query")
+	if query == "" {
+		return nil, errors.New("sql.query is required")
+	}
+	db, err := sql.Open(settings.GetString("sql.driver"), settings.GetString("sql.dsn"))
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(settings.GetInt("sql.pool-size"))
+	db.SetMaxIdleConns(settings.GetInt("sql.pool-size"))
+	return &sqlSource{
+		db:      db,
+		query:   query,
+		mapping: settings.GetStringMapString("sql.attribute-map"),
+		timeout: settings.GetDuration("sql.timeout"),
+	}, nil
+}
+
+// AddAttributes adds the user's attributes from the database. Users without rows get none, while
+// failures to reach the database or run the query are returned wrapping ErrServiceUnavailable.
+func (ss *sqlSource) AddAttributes(user *model.User, _ *model.AuthnRequest) error {
+	atts, err := ss.lookup(user.Name)
+	if err != nil {
+		return err
+	}
+	user.AppendAttributes(atts)
+	return nil
+}
+
+func (ss *sqlSource) lookup(name string) ([]*model.Attribute, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ss.timeout)
+	defer cancel()
+	rows, err := ss.db.QueryContext(ctx, ss.query, name)
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, unavailable(err)
+	}
+	// Attributes are listed in column order
+	atts := make([]*model.Attribute, len(columns))
+	for i, column := range columns {
+		attName := column
+		if len(ss.mapping) > 0 {
+			attName = ss.mapping[column]
+		}
+		atts[i] = &model.Attribute{Name: attName}
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]interface{}, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	for rows.Next() {
+		if err = rows.Scan(dest...); err != nil {
+			return nil, unavailable(err)
+		}
+		for i, value := range values {
+			if value.Valid && !containsString(atts[i].Value, value.String) {
+				atts[i].Value = append(atts[i].Value, value.String)
+			}
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, unavailable(err)
+	}
+	// Drop unmapped columns and columns that were null in every row
+	found := []*model.Attribute{}
+	for _, att := range atts {
+		if att.Name != "" && len(att.Value) > 0 {
+			found = append(found, att)
+		}
+	}
+	return found, nil
+}
+
+// CheckHealth pings the database
+func (ss *sqlSource) CheckHealth(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, ss.timeout)
+	defer cancel()
+	if err := ss.db.PingContext(ctx); err != nil {
+		return unavailable(err)
+	}
+	return nil
+}
+
+// Close closes the database's connection pool
+func (ss *sqlSource) Close() error {
+	return ss.db.Close()
+}
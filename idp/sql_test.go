@@ -0,0 +1,150 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// testDriver serves fixed rows of mail and role columns for the user passed to any query.
+// Connections fail when the DSN is "down".
+type testDriver struct{}
+
+var testRows = map[string][][]driver.Value{
+	"joe": {
+		{"joe@example.com", "admin"},
+		{"joe@example.com", "user"},
+		{"joe@example.com", nil},
+	},
+}
+
+func init() {
+	sql.Register("idptest", testDriver{})
+}
+
+func (testDriver) Open(dsn string) (driver.Conn, error) {
+	if dsn == "down" {
+		return nil, errors.New("connection refused")
+	}
+	return testConn{}, nil
+}
+
+type testConn struct{}
+
+func (testConn) Prepare(query string) (driver.Stmt, error) { return testStmt{}, nil }
+func (testConn) Close() error                              { return nil }
+func (testConn) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+
+type testStmt struct{}
+
+func (testStmt) Close() error  { return nil }
+func (testStmt) NumInput() int { return 1 }
+func (testStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+func (testStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return &testResult{rows: testRows[args[0].(string)]}, nil
+}
+
+type testResult struct {
+	rows [][]driver.Value
+}
+
+func (r *testResult) Columns() []string { return []string{"mail", "role"} }
+func (r *testResult) Close() error      { return nil }
+func (r *testResult) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func newTestSQLSource(t *testing.T, dsn string, mapping map[string]string) *sqlSource {
+	viper.Set("sql.driver", "idptest")
+	viper.Set("sql.dsn", dsn)
+	viper.Set("sql.query", "SELECT mail, role FROM users WHERE uid = $1")
+	viper.Set("sql.attribute-map", mapping)
+	defer viper.Set("sql.driver", "")
+	defer viper.Set("sql.query", "")
+	defer viper.Set("sql.attribute-map", nil)
+	source, err := NewSQLAttributeSource()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return source.(*sqlSource)
+}
+
+func Test_sqlSource_AddAttributes(t *testing.T) {
+	source := newTestSQLSource(t, "", map[string]string{"mail": "Email", "role": "Roles"})
+	defer source.Close()
+	user := &model.User{Name: "joe"}
+	if err := source.AddAttributes(user, nil); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []*model.Attribute{
+		{Name: "Email", Value: []string{"joe@example.com"}},
+		{Name: "Roles", Value: []string{"admin", "user"}},
+	}, user.Attributes, "rows should become multi-valued attributes")
+
+	user = &model.User{Name: "suzy"}
+	assert.NoError(t, source.AddAttributes(user, nil), "users without rows aren't an error")
+	assert.Empty(t, user.Attributes)
+	assert.NoError(t, source.CheckHealth(context.Background()))
+}
+
+func Test_sqlSource_AddAttributes_columnNames(t *testing.T) {
+	source := newTestSQLSource(t, "", nil)
+	defer source.Close()
+	user := &model.User{Name: "joe"}
+	if err := source.AddAttributes(user, nil); err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, user.Attributes, 2) {
+		assert.Equal(t, "mail", user.Attributes[0].Name, "columns should be used as names without a mapping")
+	}
+
+	source.mapping = map[string]string{"role": "Roles"}
+	user = &model.User{Name: "joe"}
+	source.AddAttributes(user, nil)
+	if assert.Len(t, user.Attributes, 1, "unmapped columns should be dropped") {
+		assert.Equal(t, "Roles", user.Attributes[0].Name)
+	}
+}
+
+func Test_sqlSource_AddAttributes_unavailable(t *testing.T) {
+	source := newTestSQLSource(t, "down", nil)
+	defer source.Close()
+	err := source.AddAttributes(&model.User{Name: "joe"}, nil)
+	assert.True(t, errors.Is(err, ErrServiceUnavailable), "connection failures should be distinct from missing rows")
+	assert.True(t, errors.Is(source.CheckHealth(context.Background()), ErrServiceUnavailable))
+}
+
+func TestNewSQLAttributeSource_noQuery(t *testing.T) {
+	viper.Set("sql.driver", "idptest")
+	defer viper.Set("sql.driver", "")
+	_, err := NewSQLAttributeSource()
+	assert.Error(t, err)
+}
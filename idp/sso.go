@@ -16,10 +16,7 @@ package idp
 
 import (
 	"bytes"
-	"compress/flate"
-	"crypto"
 	"crypto/dsa"
-	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/asn1"
@@ -27,103 +24,269 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/big"
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/amdonov/lite-idp/dsig"
 	"github.com/amdonov/lite-idp/model"
 	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/lite-idp/tracing"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
 	"github.com/google/uuid"
 	log "github.com/sirupsen/logrus"
 )
 
-func (i *IDP) validateRequest(request *saml.AuthnRequest, r *http.Request) error {
+const (
+	redirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	postBinding     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	artifactBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact"
+)
+
+// responseBindingSupported reports whether the response to a request received with the binding can be sent to an
+// assertion consumer service with the response binding. Browsers are sent to POST and Artifact endpoints and ECP
+// clients to PAOS ones.
+func responseBindingSupported(requestBinding, responseBinding string) bool {
+	if requestBinding == soapBinding {
+		return responseBinding == paosBinding
+	}
+	return responseBinding == postBinding || responseBinding == artifactBinding
+}
+
+// maxRelayStateLength is the limit the SAML bindings place on RelayState
+const maxRelayStateLength = 80
+
+// validateRequest checks an AuthnRequest against the service provider's metadata. The message holds the XML of the
+// request for bindings that use an enveloped signature.
+func (i *IDP) validateRequest(request *saml.AuthnRequest, binding string, message []byte, r *http.Request) error {
 	// Only accept requests from registered service providers
 	if request.Issuer == "" {
 		return errors.New("request does not contain an issuer")
 	}
 	log.Infof("received authentication request from %s", request.Issuer)
-	sp, ok := i.sps[request.Issuer]
+	sp, ok := i.sps.get(request.Issuer)
 	if !ok {
-		return errors.New("request from an unregistered issuer")
-	}
-	// Determine the right assertion consumer service
-	var acs *AssertionConsumerService
-	for i, a := range sp.AssertionConsumerServices {
-		// Find either the matching service or the default
-		if a.Index == request.AssertionConsumerServiceIndex {
-			acs = &sp.AssertionConsumerServices[i]
-			break
+		return &UnknownServiceProviderError{request.Issuer}
+	}
+	// Determine the right assertion consumer service. Don't allow a different one than specified in the metadata.
+	acs, err := sp.assertionConsumerService(request)
+	if err != nil {
+		log.Warnf("rejecting authentication request from %s for %s, allowed assertion consumer services are %s",
+			sp.EntityID, requestedService(request), strings.Join(sp.assertionConsumerLocations(), ", "))
+		return err
+	}
+	request.AssertionConsumerServiceURL = acs.Location
+	request.ProtocolBinding = acs.Binding
+	if !responseBindingSupported(binding, acs.Binding) {
+		log.Warnf("rejecting authentication request from %s for %s, which uses binding %s",
+			sp.EntityID, acs.Location, acs.Binding)
+		return fmt.Errorf("responses can't be sent with binding %s", acs.Binding)
+	}
+	// At this point, we're OK with the request
+	// Need to validate the signature
+	if err := i.verifyRequestSignature(sp, binding, message, r); err != nil {
+		i.metrics.signatureFailures.Inc(sp.EntityID)
+		log.Warnf("rejecting authentication request from %s: %v", sp.EntityID, err)
+		return &requestDeniedError{sp.EntityID, err}
+	}
+	if err := i.checkIssueInstant(request.IssueInstant); err != nil {
+		log.Warnf("rejecting authentication request from %s: %v", sp.EntityID, err)
+		return &requestDeniedError{sp.EntityID, err}
+	}
+	if request.NameIDPolicy != nil {
+		if _, err := i.nameIDFormat(sp, request.NameIDPolicy.Format); err != nil {
+			log.Warnf("rejecting authentication request: %v", err)
+			return err
 		}
-		if a.Location == request.AssertionConsumerServiceURL {
-			acs = &sp.AssertionConsumerServices[i]
-			break
+	}
+	if err := i.checkRequestedAuthnContext(sp.EntityID, request.RequestedAuthnContext); err != nil {
+		log.Warnf("rejecting authentication request: %v", err)
+		return err
+	}
+	if err := i.checkScoping(sp.EntityID, request.Scoping); err != nil {
+		log.Warnf("rejecting authentication request: %v", err)
+		return err
+	}
+	if err := checkAttributeConsumingService(sp, request.AttributeConsumingServiceIndex); err != nil {
+		log.Warnf("rejecting authentication request: %v", err)
+		return err
+	}
+	if err := i.checkReplay(sp.EntityID, request.ID); err != nil {
+		log.Warnf("rejecting authentication request from %s: %v", sp.EntityID, err)
+		return err
+	}
+	return nil
+}
+
+// requestedService describes the assertion consumer service an AuthnRequest asked for
+func requestedService(request *saml.AuthnRequest) string {
+	switch {
+	case request.AssertionConsumerServiceIndex != nil:
+		return fmt.Sprintf("index %d", *request.AssertionConsumerServiceIndex)
+	case request.AssertionConsumerServiceURL != "":
+		return request.AssertionConsumerServiceURL
+	}
+	return "the default"
+}
+
+// requestDeniedError is returned for AuthnRequests that aren't signed correctly, are stale, or were replayed
+type requestDeniedError struct {
+	entityID string
+	err      error
+}
+
+func (e *requestDeniedError) Error() string {
+	return fmt.Sprintf("authentication request from %s denied: %v", e.entityID, e.err)
+}
+
+func (e *requestDeniedError) Unwrap() error {
+	return e.err
+}
+
+// requestDeniedStatus tells a service provider that the IdP refused its request
+var requestDeniedStatus = &saml.Status{
+	StatusCode: saml.StatusCode{
+		Value: "urn:oasis:names:tc:SAML:2.0:status:Requester",
+		StatusCode: &saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:RequestDenied",
+		},
+	},
+}
+
+// verifyRequestSignature checks the signature on an AuthnRequest with the service provider's certificate.
+// Unsigned requests are accepted unless the service provider is required to sign them.
+func (i *IDP) verifyRequestSignature(sp *ServiceProvider, binding string, message []byte, r *http.Request) error {
+	var err error
+	if binding == redirectBinding {
+		var query redirectQuery
+		if query, err = parseRedirectQuery(r); err != nil {
+			return err
 		}
-		if a.IsDefault {
-			acs = &sp.AssertionConsumerServices[i]
+		if query.get("Signature") == "" {
+			err = dsig.ErrNoSignature
+		} else {
+			err = verifySignature(query, sp)
 		}
+	} else {
+		// The POST and SOAP bindings use an enveloped signature
+		err = dsig.Verify(message, sp.publicKey)
 	}
-	if acs == nil {
-		return errors.New("unable to determine assertion consumer service")
+	if err == dsig.ErrNoSignature && !*sp.AuthnRequestsSigned {
+		return nil
 	}
-	// Don't allow a different URL than specified in the metadata
-	if request.AssertionConsumerServiceURL == "" {
-		request.AssertionConsumerServiceURL = acs.Location
-	} else if request.AssertionConsumerServiceURL != acs.Location {
-		return errors.New("assertion consumer location in request does not match metadata")
+	return err
+}
+
+// redirectParameters are the query parameters of the HTTP-Redirect binding
+var redirectParameters = []string{"SAMLRequest", "SAMLResponse", "RelayState", "SigAlg", "Signature"}
+
+// redirectParameter is a parameter of the HTTP-Redirect binding as it was sent and after URL decoding
+type redirectParameter struct {
+	raw, value string
+}
+
+// redirectQuery holds the HTTP-Redirect binding parameters of a request's query
+type redirectQuery map[string]redirectParameter
+
+// parseRedirectQuery parses the form of a request made with the HTTP-Redirect binding and reads its parameters from the
+// raw query, which the signature covers. Requests that repeat a parameter, send both SAMLRequest and SAMLResponse, or
+// whose form doesn't agree with the query are rejected, so the message that's processed is always the one that's
+// verified.
+func parseRedirectQuery(r *http.Request) (redirectQuery, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
 	}
-	// At this point, we're OK with the request
-	// Need to validate the signature
-	// Have to use the raw query as pointed out in the spec.
-	// https://docs.oasis-open.org/security/saml/v2.0/saml-bindings-2.0-os.pdf
-	// Line 621
-	return verifySignature(r.URL.RawQuery, r.Form.Get("SigAlg"), r.Form.Get("Signature"), sp)
+	query := redirectQuery{}
+	for _, param := range strings.Split(r.URL.RawQuery, "&") {
+		rawName, raw, _ := strings.Cut(param, "=")
+		name, err := url.QueryUnescape(rawName)
+		if err != nil {
+			return nil, err
+		}
+		if !isRedirectParameter(name) {
+			continue
+		}
+		if _, ok := query[name]; ok {
+			return nil, fmt.Errorf("%s can only be sent once", name)
+		}
+		value, err := url.QueryUnescape(raw)
+		if err != nil {
+			return nil, err
+		}
+		query[name] = redirectParameter{raw, value}
+	}
+	if _, ok := query["SAMLRequest"]; ok {
+		if _, ok = query["SAMLResponse"]; ok {
+			return nil, errors.New("SAMLRequest and SAMLResponse can't be sent together")
+		}
+	}
+	for _, name := range redirectParameters {
+		values := r.Form[name]
+		param, ok := query[name]
+		if ok && (len(values) != 1 || values[0] != param.value) || !ok && len(values) != 0 {
+			return nil, fmt.Errorf("%s can only be sent once, in the query", name)
+		}
+	}
+	return query, nil
+}
+
+// get returns the decoded value of the parameter, or an empty string if it wasn't sent
+func (q redirectQuery) get(name string) string {
+	return q[name].value
 }
 
-func verifySignature(rawQuery, alg, expectedSig string, sp *ServiceProvider) error {
-	// Split up the parts
-	params := strings.Split(rawQuery, "&")
-	pMap := make(map[string]string, len(params))
-	for i := range params {
-		parts := strings.Split(params[i], "=")
-		if len(parts) != 2 {
-			return errors.New("trouble validating signature on request")
+func isRedirectParameter(name string) bool {
+	for _, param := range redirectParameters {
+		if name == param {
+			return true
 		}
-		pMap[parts[0]] = parts[1]
 	}
-	// Order them
-	sigparts := []string{fmt.Sprintf("SAMLRequest=%s", pMap["SAMLRequest"])}
-	if state, ok := pMap["RelayState"]; ok {
-		sigparts = append(sigparts, fmt.Sprintf("RelayState=%s", state))
+	return false
+}
+
+// verifySignature checks the signature of a message sent with the HTTP-Redirect binding. The signed octets are built
+// from the parameters exactly as they appear in the raw query, as the spec requires.
+// https://docs.oasis-open.org/security/saml/v2.0/saml-bindings-2.0-os.pdf
+// Line 621
+func verifySignature(query redirectQuery, sp *ServiceProvider) error {
+	message := "SAMLRequest"
+	if _, ok := query[message]; !ok {
+		message = "SAMLResponse"
+	}
+	sigparts := []string{fmt.Sprintf("%s=%s", message, query[message].raw)}
+	if state, ok := query["RelayState"]; ok {
+		sigparts = append(sigparts, fmt.Sprintf("RelayState=%s", state.raw))
 	}
-	sigparts = append(sigparts, fmt.Sprintf("SigAlg=%s", pMap["SigAlg"]))
+	sigparts = append(sigparts, fmt.Sprintf("SigAlg=%s", query["SigAlg"].raw))
 	sig := []byte(strings.Join(sigparts, "&"))
 	// Validate the signature
-	signature, err := base64.StdEncoding.DecodeString(expectedSig)
+	signature, err := base64.StdEncoding.DecodeString(query.get("Signature"))
 	if err != nil {
 		return err
 	}
-	switch alg {
+	switch alg := query.get("SigAlg"); alg {
 	case "http://www.w3.org/2009/xmldsig11#dsa-sha256":
 		sum := sha256Sum(sig)
 		return verifyDSA(sp, signature, sum)
 	case "http://www.w3.org/2000/09/xmldsig#dsa-sha1":
 		sum := sha1Sum(sig)
 		return verifyDSA(sp, signature, sum)
-	case "http://www.w3.org/2000/09/xmldsig#rsa-sha1":
-		sum := sha1Sum(sig)
-		return rsa.VerifyPKCS1v15(sp.publicKey.(*rsa.PublicKey), crypto.SHA1, sum, signature)
-	case "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256":
-		sum := sha256Sum(sig)
-		return rsa.VerifyPKCS1v15(sp.publicKey.(*rsa.PublicKey), crypto.SHA256, sum, signature)
 	default:
-		return fmt.Errorf("unsupported signature algorithm, %s", alg)
+		// RSA and ECDSA algorithms, which are checked against the type of the service provider's key
+		return dsig.VerifyData(sig, alg, signature, sp.publicKey)
 	}
 }
 
 func verifyDSA(sp *ServiceProvider, signature, sum []byte) error {
+	key, ok := sp.publicKey.(*dsa.PublicKey)
+	if !ok {
+		return errors.New("DSA signatures require a DSA key")
+	}
 	dsaSig := new(dsaSignature)
 	if rest, err := asn1.Unmarshal(signature, dsaSig); err != nil {
 		return err
@@ -133,7 +296,7 @@ func verifyDSA(sp *ServiceProvider, signature, sum []byte) error {
 	if dsaSig.R.Sign() <= 0 || dsaSig.S.Sign() <= 0 {
 		return errors.New("DSA signature contained zero or negative values")
 	}
-	if !dsa.Verify(sp.publicKey.(*dsa.PublicKey), sum, dsaSig.R, dsaSig.S) {
+	if !dsa.Verify(key, sum, dsaSig.R, dsaSig.S) {
 		return errors.New("DSA verification failure")
 	}
 	return nil
@@ -155,107 +318,305 @@ func sha256Sum(sig []byte) []byte {
 func (i *IDP) DefaultRedirectSSOHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		err := func() error {
-			err := r.ParseForm()
+			query, err := parseRedirectQuery(r)
 			if err != nil {
 				return err
 			}
-			relayState := r.Form.Get("RelayState")
-			if len(relayState) > 80 {
-				return errors.New("RelayState cannot be longer than 80 characters")
+			// Users who come to the IdP directly rather than from a service provider get the landing page
+			if query.get("SAMLRequest") == "" {
+				i.showLandingPage(w, r)
+				return nil
 			}
-
-			samlReq := r.Form.Get("SAMLRequest")
-			// URL decoding is already performed
-			// remove base64 encoding
-			reqBytes, err := base64.StdEncoding.DecodeString(samlReq)
-			if err != nil {
-				return err
-			}
-			// Remove deflate
-			req := flate.NewReader(bytes.NewReader(reqBytes))
-			// Read the XML
-			decoder := xml.NewDecoder(req)
 			loginReq := &saml.AuthnRequest{}
-			if err = decoder.Decode(loginReq); err != nil {
-				return err
-			}
-
-			if err = i.validateRequest(loginReq, r); err != nil {
-				return err
-			}
-
-			// create saveable request
-			saveableRequest, err := model.NewAuthnRequest(loginReq, relayState)
+			_, span := tracing.Start(r.Context(), "parse_authn_request")
+			err = i.decodeRedirectMessage(query.get("SAMLRequest"), loginReq)
+			span.RecordError(err)
+			span.End()
 			if err != nil {
 				return err
 			}
+			return i.processAuthnRequest(loginReq, redirectBinding, nil, w, r)
+		}()
+		if err != nil {
+			i.writeError(w, r, err, ssoErrorStatus(err))
+		}
+	}
+}
 
-			// check for existing session
-			if user := i.getUserFromSession(r); user != nil {
-				return i.respond(saveableRequest, user, w, r)
-			}
-
-			// check to see if they presented a client cert
-			if user, err := i.loginWithCert(r, saveableRequest); user != nil {
-				return i.respond(saveableRequest, user, w, r)
-			} else if err != nil {
-				return err
-			}
-
-			// need to display the login form
-			data, err := proto.Marshal(saveableRequest)
+// DefaultPostSSOHandler is the default implementation for the POST login handler. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultPostSSOHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			err := r.ParseForm()
 			if err != nil {
 				return err
 			}
-			id := uuid.New().String()
-			err = i.TempCache.Set(id, data)
+			loginReq := &saml.AuthnRequest{}
+			_, span := tracing.Start(r.Context(), "parse_authn_request")
+			message, err := i.readPostMessage(r.Form.Get("SAMLRequest"))
+			if err == nil {
+				err = xml.Unmarshal(message, loginReq)
+			}
+			span.RecordError(err)
+			span.End()
 			if err != nil {
 				return err
 			}
-			http.Redirect(w, r, fmt.Sprintf("/ui/login.html?requestId=%s",
-				url.QueryEscape(id)), http.StatusTemporaryRedirect)
-			return nil
+			return i.processAuthnRequest(loginReq, postBinding, message, w, r)
 		}()
 		if err != nil {
-			log.Error(err)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			i.writeError(w, r, err, ssoErrorStatus(err))
 		}
 	}
 }
 
-func (i *IDP) loginWithCert(r *http.Request, authnReq *model.AuthnRequest) (*model.User, error) {
+// ssoErrorStatus returns the HTTP status for an AuthnRequest that couldn't be processed. Requests from
+// unknown service providers can't be answered with a SAML response because there's no trusted endpoint to send it to.
+func ssoErrorStatus(err error) int {
+	var unknown *UnknownServiceProviderError
+	var denied *requestDeniedError
+	if errors.As(err, &unknown) || errors.As(err, &denied) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadRequest
+}
+
+// processAuthnRequest validates a decoded AuthnRequest and either responds or sends the user to the login page
+func (i *IDP) processAuthnRequest(loginReq *saml.AuthnRequest, binding string, message []byte, w http.ResponseWriter, r *http.Request) error {
+	// RelayState is saved with the request and returned unchanged with the response
+	relayState := r.Form.Get("RelayState")
+	recordBinding(r, binding)
+	tracing.SpanFromContext(r.Context()).SetAttributes(tracing.String("saml.sp", loginReq.Issuer))
+	if len(relayState) > maxRelayStateLength {
+		return fmt.Errorf("RelayState cannot be longer than %d bytes", maxRelayStateLength)
+	}
+
+	if err := i.validateRequest(loginReq, binding, message, r); err != nil {
+		// Tell the service provider when there's a trusted endpoint to send the response to, which there isn't if
+		// the request couldn't be matched to one of its assertion consumer services
+		if failureStatus(err) == nil || loginReq.AssertionConsumerServiceURL == "" {
+			return err
+		}
+		saveableRequest, newErr := model.NewAuthnRequest(loginReq, relayState)
+		if newErr != nil {
+			return err
+		}
+		saveableRequest.RequestBinding = binding
+		return i.reportFailure(saveableRequest, err, w, r)
+	}
+	recordServiceProvider(r, loginReq.Issuer)
+	i.metrics.authnRequests.Inc(loginReq.Issuer, strings.TrimPrefix(binding, "urn:oasis:names:tc:SAML:2.0:bindings:"))
+
+	// create saveable request
+	saveableRequest, err := model.NewAuthnRequest(loginReq, relayState)
+	if err != nil {
+		return err
+	}
+	saveableRequest.RequestBinding = binding
+	return i.reportFailure(saveableRequest, i.authenticate(saveableRequest, w, r), w, r)
+}
+
+// authenticate responds to the request for a user whose session or client certificate satisfies it. Otherwise the
+// request is saved and the user is sent to the login form, or told the user isn't logged in if the request is passive.
+func (i *IDP) authenticate(saveableRequest *model.AuthnRequest, w http.ResponseWriter, r *http.Request) error {
+	// check for existing session, users have to log in again if the service provider wants a different authentication context
+	// or forces them to
+	if user := i.getUserFromSession(r); user != nil && !saveableRequest.ForceAuthn && i.satisfiesRequest(saveableRequest, user) {
+		return i.respond(saveableRequest, user, w, r)
+	}
+
 	// check to see if they presented a client cert
-	if clientCert, err := getCertFromRequest(r); err == nil {
-		user := &model.User{
-			Name:    getSubjectDN(clientCert.Subject),
-			Format:  "urn:oasis:names:tc:SAML:1.1:nameid-format:X509SubjectName",
-			Context: "urn:oasis:names:tc:SAML:2.0:ac:classes:X509",
-			IP:      getIP(r).String()}
-		// Add attributes
-		err = i.setUserAttributes(user, authnReq)
+	if user, err := i.loginWithCert(r, saveableRequest); user != nil && i.satisfiesRequest(saveableRequest, user) {
+		return i.respond(saveableRequest, user, w, r)
+	} else if err != nil {
+		return err
+	}
+
+	// check to see if their browser sent a Kerberos ticket
+	if user, err := i.loginWithKerberos(w, r, saveableRequest); user != nil && i.satisfiesRequest(saveableRequest, user) {
+		return i.respond(saveableRequest, user, w, r)
+	} else if err != nil {
+		return err
+	}
+
+	// Passive requests can't show the login form or ask for a Kerberos ticket
+	if saveableRequest.IsPassive {
+		log.Infof("unable to respond to passive request from %s without a login", saveableRequest.Issuer)
+		return i.sendNoPassive(saveableRequest, w, r)
+	}
+
+	// need to display the login form
+	data, err := proto.Marshal(saveableRequest)
+	if err != nil {
+		return err
+	}
+	id := uuid.New().String()
+	err = tracedSet(r.Context(), "temp", i.TempCache, id, data)
+	if err != nil {
+		return err
+	}
+	// The login form's CSRF token is derived from this cookie
+	i.setLoginCookie(w, r)
+	loginURL := fmt.Sprintf("%s/ui/login.html?requestId=%s", i.basePath, url.QueryEscape(id))
+	// Browsers that haven't tried Kerberos are asked for a ticket first
+	if _, negotiated := negotiateToken(r); i.kerberos != nil && !negotiated {
+		return i.challengeKerberos(w, loginURL)
+	}
+	// A temporary redirect would replay a POST against the login handler
+	status := http.StatusTemporaryRedirect
+	if r.Method == http.MethodPost {
+		status = http.StatusSeeOther
+	}
+	http.Redirect(w, r, loginURL, status)
+	return nil
+}
+
+// decodeRedirectMessage reads a SAML message that was deflated and base64 encoded for the HTTP-Redirect binding
+func (i *IDP) decodeRedirectMessage(message string, v interface{}) error {
+	// URL decoding is already performed
+	// remove base64 encoding
+	reqBytes, err := base64.StdEncoding.DecodeString(message)
+	if err != nil {
+		return err
+	}
+	// Remove deflate and read the XML, keeping what was read if it's logged
+	inflated := inflate(reqBytes, i.maxInflatedSize)
+	defer inflated.Close()
+	if !i.debugSAML {
+		return xml.NewDecoder(inflated).Decode(v)
+	}
+	var data bytes.Buffer
+	err = xml.NewDecoder(io.TeeReader(inflated, &data)).Decode(v)
+	i.debugMessage(messageReceived, data.Bytes())
+	return err
+}
+
+// readPostMessage returns the XML of a SAML message that was base64 encoded for the HTTP-POST binding
+func (i *IDP) readPostMessage(message string) ([]byte, error) {
+	reqBytes, err := base64.StdEncoding.DecodeString(message)
+	if err != nil {
+		return nil, err
+	}
+	// Some service providers deflate POST messages as well
+	if !bytes.HasPrefix(bytes.TrimSpace(reqBytes), []byte("<")) {
+		inflated := inflate(reqBytes, i.maxInflatedSize)
+		reqBytes, err = ioutil.ReadAll(inflated)
+		inflated.Close()
 		if err != nil {
 			return nil, err
 		}
-		i.Auditor.LogSuccess(user, authnReq, CertificateLogin)
-		log.Infof("successful PKI login for %s", user.Name)
-		return user, nil
 	}
-	return nil, nil
+	i.debugMessage(messageReceived, reqBytes)
+	return reqBytes, nil
+}
+
+// loginWithCert authenticates the user with the client certificate from the TLS handshake. The user and error are
+// both nil when certificate logins are disabled or the certificate can't be used, so the user can log in with a password.
+// Certificates that are revoked, or whose revocation status can't be checked when cert-revocation-methods is set,
+// are refused with an error wrapping ErrAuthnFailed.
+func (i *IDP) loginWithCert(r *http.Request, authnReq *model.AuthnRequest) (*model.User, error) {
+	if !i.certLogin {
+		return nil, nil
+	}
+	// check to see if they presented a client cert
+	clientCert, err := getCertFromRequest(r)
+	if err != nil {
+		return nil, nil
+	}
+	ctx, span := tracing.Start(r.Context(), "authenticate", tracing.String("idp.login_method", "certificate"))
+	if i.revocation != nil {
+		// Revoked certificates are refused rather than falling back to the password form
+		if err = i.revocation.checkRevocation(ctx, r.TLS); err != nil {
+			span.RecordError(err)
+			span.End()
+			i.recordAuthentication(r, authnReq, getSubjectDN(clientCert.Subject), CertificateLogin, resultFailure)
+			log.Warnf("refusing certificate login: %v", err)
+			return nil, err
+		}
+	}
+	name, format, err := i.certificateNameID(clientCert)
+	span.RecordError(err)
+	span.End()
+	if err != nil {
+		i.recordAuthentication(r, authnReq, clientCert.Subject.String(), CertificateLogin, resultFailure)
+		log.Warnf("falling back to password login: %v", err)
+		return nil, nil
+	}
+	user := &model.User{
+		Name:        name,
+		Format:      format,
+		Context:     i.certificateAuthnContext,
+		IP:          getIP(r).String(),
+		Certificate: clientCert.Raw}
+	// Add attributes
+	err = i.setUserAttributes(r.Context(), user, authnReq)
+	if err != nil {
+		i.recordAuthentication(r, authnReq, name, CertificateLogin, resultError)
+		return nil, err
+	}
+	i.recordAuthentication(r, authnReq, name, CertificateLogin, resultSuccess)
+	i.Auditor.LogSuccess(user, authnReq, CertificateLogin)
+	log.Infof("successful PKI login for %s", user.Name)
+	return user, nil
 }
 
 func (i *IDP) loginWithPasswordForm(r *http.Request, authnReq *model.AuthnRequest) (*model.User, error) {
-	userName := r.Form.Get("username")
-	if err := i.PasswordValidator.Validate(userName, r.Form.Get("password")); err != nil {
+	return i.loginWithPassword(r, r.Form.Get("username"), r.Form.Get("password"), authnReq)
+}
+
+func (i *IDP) loginWithPassword(r *http.Request, userName, password string, authnReq *model.AuthnRequest) (*model.User, error) {
+	ip := getIP(r).String()
+	if err := i.authLimiter.allow(ip, userName); err != nil {
+		var limited *tooManyAttemptsError
+		if errors.As(err, &limited) {
+			i.recordAuthentication(r, authnReq, userName, PasswordLogin, resultThrottled)
+		} else {
+			i.recordAuthentication(r, authnReq, userName, PasswordLogin, resultError)
+		}
+		return nil, err
+	}
+	user, err := i.validatePassword(r, userName, password, authnReq)
+	result := resultSuccess
+	if errors.Is(err, ErrInvalidPassword) {
+		result = resultFailure
+		if limitErr := i.authLimiter.failed(ip, userName); limitErr != nil {
+			log.Errorf("failed to record failed login for %s: %v", userName, limitErr)
+		}
+	} else if failureStatus(err) != nil {
+		// The login was refused rather than the credential store failing
+		result = resultFailure
+	} else if err != nil {
+		result = resultError
+	} else if limitErr := i.authLimiter.succeeded(userName); limitErr != nil {
+		log.Errorf("failed to reset failed logins for %s: %v", userName, limitErr)
+	}
+	i.recordAuthentication(r, authnReq, userName, PasswordLogin, result)
+	return user, err
+}
+
+func (i *IDP) validatePassword(r *http.Request, userName, password string, authnReq *model.AuthnRequest) (*model.User, error) {
+	var atts []*model.Attribute
+	ctx, span := tracing.Start(r.Context(), "authenticate", tracing.String("idp.login_method", "password"))
+	var err error
+	if av, ok := i.PasswordValidator.(AttributeValidator); ok {
+		atts, err = av.ValidateAndFetch(ctx, userName, password)
+	} else {
+		err = i.PasswordValidator.Validate(ctx, userName, password)
+	}
+	span.RecordError(err)
+	span.End()
+	if err != nil {
 		return nil, err
 	}
 	// They have provided the right password
 	user := &model.User{
 		Name:    userName,
 		Format:  "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified",
-		Context: "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport",
+		Context: i.passwordAuthnContext,
 		IP:      getIP(r).String()}
+	user.AppendAttributes(atts)
 	// Add attributes
-	if err := i.setUserAttributes(user, authnReq); err != nil {
+	if err := i.setUserAttributes(r.Context(), user, authnReq); err != nil {
 		return nil, err
 	}
 	i.Auditor.LogSuccess(user, authnReq, PasswordLogin)
@@ -264,6 +625,12 @@ func (i *IDP) loginWithPasswordForm(r *http.Request, authnReq *model.AuthnReques
 }
 
 func (i *IDP) getUserFromSession(r *http.Request) *model.User {
+	_, user := i.getSession(r)
+	return user
+}
+
+// getSession returns the session identifier and user for the session cookie on the request
+func (i *IDP) getSession(r *http.Request) (string, *model.User) {
 	// check for cookie to see if user has a current session
 	if cookie, err := r.Cookie(i.cookieName); err == nil {
 		// Found a session cookie
@@ -271,12 +638,35 @@ func (i *IDP) getUserFromSession(r *http.Request) *model.User {
 			// Cookie matched user in cache
 			user := &model.User{}
 			if err = proto.Unmarshal(data, user); err == nil {
+				if reason := i.sessionEnded(user, time.Now()); reason != "" {
+					log.Infof("session for %s %s", user.Name, reason)
+					if err = i.UserCache.Delete(cookie.Value); err != nil {
+						log.Warnf("failed to remove ended session: %v", err)
+					}
+					return "", nil
+				}
 				log.Infof("found existing session for %s", user.Name)
-				return user
+				return cookie.Value, user
 			}
 		}
 	}
-	return nil
+	return "", nil
+}
+
+// sessionEnded describes why the session can no longer be used, or returns an empty string if it can. Sessions end a
+// session lifetime after the user logged in, or earlier if they go unused for session-idle-timeout.
+func (i *IDP) sessionEnded(user *model.User, now time.Time) string {
+	if user.AuthnInstant != nil {
+		if authnInstant, err := ptypes.Timestamp(user.AuthnInstant); err == nil && now.Sub(authnInstant) > i.sessionLifetime {
+			return "reached the absolute timeout"
+		}
+	}
+	if user.LastActivity != nil && i.sessionIdleTimeout > 0 {
+		if lastActivity, err := ptypes.Timestamp(user.LastActivity); err == nil && now.Sub(lastActivity) > i.sessionIdleTimeout {
+			return "was idle too long"
+		}
+	}
+	return ""
 }
 
 type dsaSignature struct {
@@ -15,16 +15,26 @@
 package idp
 
 import (
+	"crypto"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
+	"encoding/xml"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/PuerkitoBio/goquery"
+	"github.com/amdonov/lite-idp/dsig"
 	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
@@ -44,6 +54,9 @@ func TestIDP_DefaultRedirectSSOHandler(t *testing.T) {
 			Certificate: "MIICzDCCAbQCCQCaJRU/CzFSGzANBgkqhkiG9w0BAQsFADAoMQswCQYDVQQGEwJVUzEMMAoGA1UECgwDZGV4MQswCQYDVQQDDAJzcDAeFw0xODA5MDQxODEwMzlaFw0yODA5MDExODEwMzlaMCgxCzAJBgNVBAYTAlVTMQwwCgYDVQQKDANkZXgxCzAJBgNVBAMMAnNwMIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEAzJZd8K9jxC6mxuR5dw08qicw0VsDN1bAvdInKGzugsJYRH/MfcgrKwLCTZHBGZZFmdHxhca84cG/Wn24Ys5eF1JWhehYocyYqZqY3ESPldDK4ohwCvKhSogpF9hVyi9LnujCgfGOv98atMWDeqTLletCPsHcXzLq3cN58oNl80HXIQKFM7n9ZgUKLqk6d2hT7LeYndZKg5aUQ4jyTfz/S1XgYBDr0utl41HtUsHSYwQDx3v0wMqZVorzk8HrXaXowvUwVct6HxT/c5QxtHCxmm6n6/Mwr8Xzk1yxQq9dLtEOmEtnYgIEhyiUP7CdFPWC37sn9YiGCSjRukE07CyG0wIDAQABMA0GCSqGSIb3DQEBCwUAA4IBAQAJFl+hHwS6xNRtWMgJsu943zv4U8ZksyWAM5bk94ERMwpJVPndJIW0+UAT3Pp/k9E3Lro/AbSIA364LBzLoONOqfeNTUK4YH7wQGfmusI8c28akY5ZfDx8Ixc4oxPkcExh47YkVECSUhMq9gDMI10ePsSkVB7fss1QibmOsGM8WQyQzdmqfHbd7ws0g7P2I+SiR5+FboyliKRdqqSvQ8dL2hEAGtc9mZCPnlriiNzawCYPprH3lA+QWq+SI+QmQqTou05pWl5q+KcWU7INf0wEsXa26qcizqMTMNPuuu8Lp0gmmpUeH1AKVqO8P9VYT+GnkAUdoD3z1GCkLUvPaFYP",
 		},
 	})
+	// The request was captured in 2018
+	viper.Set("clock-skew", "876000h")
+	defer viper.Set("clock-skew", "3m")
 	i := &IDP{}
 	ts := getTestIDP(t, i)
 	defer ts.Close()
@@ -55,6 +68,277 @@ func TestIDP_DefaultRedirectSSOHandler(t *testing.T) {
 	assert.Equal(t, 200, resp.StatusCode, "expected login page from sso")
 }
 
+func TestIDP_DefaultRedirectSSOHandler_duplicateParameters(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	// The test service provider shares the IdP's key so its requests can be signed here
+	signed, err := i.redirectURL(i.singleSignOnServiceLocation, "SAMLRequest", newTestAuthnRequest(), "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged := newTestAuthnRequest()
+	forged.ProtocolBinding = postBinding
+	unsigned, err := i.redirectURL(i.singleSignOnServiceLocation, "SAMLRequest", forged, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := url.Parse(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forgedQuery, err := url.Parse(unsigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(rawQuery string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		i.RedirectSSOHandler(w, httptest.NewRequest("GET", target.Path+"?"+rawQuery, nil))
+		return w
+	}
+	w := send(target.RawQuery)
+	assert.Contains(t, w.Header().Get("Location"), "/ui/login.html", "expected redirect to login page")
+
+	message := "SAMLRequest=" + url.QueryEscape(forgedQuery.Query().Get("SAMLRequest"))
+	w = send(message + "&" + target.RawQuery)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "a repeated SAMLRequest should be rejected")
+	w = send(strings.Replace(message, "SAMLRequest", "SAML%52equest", 1) + "&" + target.RawQuery)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "an encoded parameter name shouldn't hide a repeat")
+}
+
+func Test_parseRedirectQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		body    string
+		wantErr bool
+	}{
+		{"signed request", "SAMLRequest=a%2Bb&RelayState=state&SigAlg=alg&Signature=sig&other=1&other=2", "", false},
+		{"repeated SAMLRequest", "SAMLRequest=a&SAMLRequest=b", "", true},
+		{"repeated SAMLResponse", "SAMLResponse=a&SAMLResponse=b", "", true},
+		{"repeated RelayState", "SAMLRequest=a&RelayState=a&RelayState=b", "", true},
+		{"repeated SigAlg", "SAMLRequest=a&SigAlg=a&SigAlg=b", "", true},
+		{"repeated Signature", "SAMLRequest=a&Signature=a&Signature=b", "", true},
+		{"request and response", "SAMLRequest=a&SAMLResponse=b", "", true},
+		{"parameter in the body", "SAMLRequest=a", "RelayState=b", true},
+		{"invalid escape", "SAMLRequest=%zz", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "/?"+tt.query, strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			query, err := parseRedirectQuery(r)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, "a+b", query.get("SAMLRequest"))
+				assert.Equal(t, "a%2Bb", query["SAMLRequest"].raw, "the raw value is what's signed")
+				assert.Equal(t, "", query.get("SAMLResponse"))
+			}
+		})
+	}
+}
+
+// postAuthnRequest sends the AuthnRequest to the IdP with the HTTP-POST binding, signed with the IdP's key if sign is set
+func postAuthnRequest(t *testing.T, i *IDP, loginReq *saml.AuthnRequest, sign bool) *httptest.ResponseRecorder {
+	return postAuthnRequestWithRelayState(t, i, loginReq, sign, "state")
+}
+
+func postAuthnRequestWithRelayState(t *testing.T, i *IDP, loginReq *saml.AuthnRequest, sign bool, relayState string) *httptest.ResponseRecorder {
+	if sign {
+		signature, err := i.signer.CreateSignature(loginReq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loginReq.Signature = signature
+	}
+	data, err := xml.Marshal(loginReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{}
+	form.Set("SAMLRequest", base64.StdEncoding.EncodeToString(data))
+	form.Set("RelayState", relayState)
+	r := httptest.NewRequest("POST", viper.GetString("sso-service-path"), strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	i.PostSSOHandler(w, r)
+	return w
+}
+
+func newTestAuthnRequest() *saml.AuthnRequest {
+	return &saml.AuthnRequest{
+		RequestAbstractType: saml.RequestAbstractType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now(),
+			Issuer:       "dex",
+		},
+	}
+}
+
+func TestIDP_DefaultPostSSOHandler(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	w := postAuthnRequest(t, i, newTestAuthnRequest(), true)
+	assert.Equal(t, http.StatusSeeOther, w.Code, "expected redirect to login page")
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/ui/login.html", location.Path)
+	// The saved request records the binding and the response binding from metadata
+	saved, err := i.TempCache.Get(location.Query().Get("requestId"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &model.AuthnRequest{}
+	if err = proto.Unmarshal(saved, req); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, postBinding, req.RequestBinding)
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact", req.ProtocolBinding)
+	assert.Equal(t, "state", req.RelayState)
+}
+
+func TestIDP_DefaultPostSSOHandler_relayState(t *testing.T) {
+	i := &IDP{PasswordValidator: acceptingValidator{}}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	assert.Equal(t, http.StatusBadRequest,
+		postAuthnRequestWithRelayState(t, i, newTestAuthnRequest(), true, strings.Repeat("a", 81)).Code,
+		"RelayState longer than 80 bytes should be rejected")
+
+	// RelayState must survive the login form unchanged
+	dex, _ := i.ServiceProvider("dex")
+	dex.AssertionConsumerServices = append(dex.AssertionConsumerServices, AssertionConsumerService{
+		Index:    1,
+		Binding:  postBinding,
+		Location: "https://dex.example.com/acs",
+	})
+	relayState := `/app?a=1&b="2"<3>`
+	loginReq := newTestAuthnRequest()
+	loginReq.ProtocolBinding = postBinding
+	w := postAuthnRequestWithRelayState(t, i, loginReq, true, relayState)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := w.Result().Cookies()
+	// Load the login page for its CSRF token
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", location.String(), nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	i.LoginPageHandler(w, r)
+	doc, err := goquery.NewDocumentFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := doc.Find("input[name=csrfToken]").Attr("value")
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/ui/login.html", strings.NewReader(url.Values{
+		"requestId": {location.Query().Get("requestId")},
+		"username":  {"joe"},
+		"password":  {"password"},
+		"csrfToken": {token},
+	}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	i.PasswordLoginHandler(w, r)
+	doc, err = goquery.NewDocumentFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, ok := doc.Find("input[name=RelayState]").Attr("value")
+	assert.True(t, ok, "response form should include RelayState")
+	assert.Equal(t, relayState, value)
+}
+
+func TestIDP_DefaultPostSSOHandler_signatures(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	// Responses go to the artifact endpoint, so a denied request is reported with an artifact
+	assert.Equal(t, requestDeniedStatus, redirectedStatus(t, i, postAuthnRequest(t, i, newTestAuthnRequest(), false)),
+		"unsigned requests should be rejected by default")
+	tampered := newTestAuthnRequest()
+	signature, err := i.signer.CreateSignature(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered.Signature = signature
+	tampered.ID = saml.NewID()
+	assert.Equal(t, requestDeniedStatus, redirectedStatus(t, i, postAuthnRequest(t, i, tampered, false)),
+		"requests modified after signing should be rejected")
+
+	// Service providers that don't sign requests can be allowed
+	dex, _ := i.ServiceProvider("dex")
+	unsigned := false
+	dex.AuthnRequestsSigned = &unsigned
+	assert.Equal(t, http.StatusSeeOther, postAuthnRequest(t, i, newTestAuthnRequest(), false).Code)
+}
+
+func TestIDP_DefaultPostSSOHandler_requestDenied(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	dex, _ := i.ServiceProvider("dex")
+	dex.AssertionConsumerServices = append(dex.AssertionConsumerServices, AssertionConsumerService{
+		Index:    1,
+		Binding:  postBinding,
+		Location: "https://dex.example.com/acs",
+	})
+	loginReq := newTestAuthnRequest()
+	loginReq.ProtocolBinding = postBinding
+	w := postAuthnRequest(t, i, loginReq, false)
+	assert.Equal(t, http.StatusOK, w.Code, "expected a form posting the response")
+	doc, err := goquery.NewDocumentFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := doc.Find("input[name=SAMLResponse]").Attr("value")
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &saml.Response{}
+	if err = xml.Unmarshal(data, response); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, loginReq.ID, response.InResponseTo)
+	assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:Requester", response.Status.StatusCode.Value)
+	if assert.NotNil(t, response.Status.StatusCode.StatusCode) {
+		assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:RequestDenied", response.Status.StatusCode.StatusCode.Value)
+	}
+	assert.Nil(t, response.Assertion)
+	assert.NoError(t, dsig.Verify(data, i.TLSConfig.Certificates[0].PrivateKey.(crypto.Signer).Public()))
+}
+
+func TestIDP_DefaultPostSSOHandler_unsupportedBinding(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	dex, _ := i.ServiceProvider("dex")
+	dex.AssertionConsumerServices = append(dex.AssertionConsumerServices, AssertionConsumerService{
+		Index:    1,
+		Binding:  paosBinding,
+		Location: "https://dex.example.com/ecp",
+	})
+	loginReq := newTestAuthnRequest()
+	index := uint32(1)
+	loginReq.AssertionConsumerServiceIndex = &index
+	w := postAuthnRequest(t, i, loginReq, true)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "browsers can't be sent to a PAOS endpoint")
+	assert.Contains(t, w.Body.String(), "Invalid request")
+}
+
 const certPEM = `
 -----BEGIN CERTIFICATE-----
 MIIDujCCAqKgAwIBAgIIE31FZVaPXTUwDQYJKoZIhvcNAQEFBQAwSTELMAkGA1UE
@@ -99,6 +383,43 @@ func TestIDP_loginWithCert(t *testing.T) {
 	i.loginWithCert(req, nil)
 }
 
+func TestIDP_loginWithCert_fallback(t *testing.T) {
+	defer viper.Set("cert-login-enabled", true)
+	defer viper.Set("cert-login-principal", "subject")
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	req := httptest.NewRequest("GET", "/", nil)
+	user, err := i.loginWithCert(req, nil)
+	assert.Nil(t, user, "no certificate was presented")
+	assert.NoError(t, err)
+
+	cert := newClientCertificate(t)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	user, err = i.loginWithCert(req, nil)
+	if assert.NotNil(t, user) {
+		assert.Equal(t, "SERIALNUMBER=1234, CN=Joe User, O=Example", user.Name)
+		assert.Equal(t, cert.Raw, user.Certificate, "the certificate is kept for holder-of-key confirmation")
+	}
+	assert.NoError(t, err)
+
+	// Certificates without the configured principal fall back to the password form
+	viper.Set("cert-login-principal", "upn")
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	req.TLS.PeerCertificates = []*x509.Certificate{{}}
+	user, err = i.loginWithCert(req, nil)
+	assert.Nil(t, user)
+	assert.NoError(t, err)
+
+	viper.Set("cert-login-enabled", false)
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+	req.TLS.PeerCertificates = []*x509.Certificate{newClientCertificate(t)}
+	user, err = i.loginWithCert(req, nil)
+	assert.Nil(t, user, "certificate logins are disabled")
+	assert.NoError(t, err)
+}
+
 func TestIDP_getUserFromSession(t *testing.T) {
 	i := &IDP{}
 	ts := getTestIDP(t, i)
@@ -147,3 +468,231 @@ func TestIDP_loginWithPasswordForm(t *testing.T) {
 	}
 	assert.Equal(t, "joe", user.Name, "user name doesn't match")
 }
+
+func TestIDP_authenticate_forceAuthn(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	user := newTestUser()
+	user.ServiceProviders = []string{"other"}
+	cookie := addTestSession(t, i, "12345", user)
+	authnReq := &model.AuthnRequest{
+		ID:                          saml.NewID(),
+		Issuer:                      "dex",
+		ProtocolBinding:             artifactBinding,
+		AssertionConsumerServiceURL: "http://127.0.0.1:5556/dex/callback",
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	assert.NoError(t, i.authenticate(authnReq, w, r))
+	assert.Equal(t, http.StatusFound, w.Code, "the session should be used")
+
+	authnReq.ForceAuthn = true
+	w = httptest.NewRecorder()
+	assert.NoError(t, i.authenticate(authnReq, w, r))
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Contains(t, w.Header().Get("Location"), "/ui/login.html", "the user should have to log in again")
+
+	// Logging in again starts a new session
+	w = httptest.NewRecorder()
+	assert.NoError(t, i.respond(authnReq, newTestUser(), w, r))
+	cookies := w.Result().Cookies()
+	if assert.Len(t, cookies, 1) {
+		assert.NotEqual(t, "12345", cookies[0].Value)
+		_, err := i.UserCache.Get("12345")
+		assert.Error(t, err, "the old session should be removed")
+		r = httptest.NewRequest("GET", "/", nil)
+		r.AddCookie(cookies[0])
+		session := i.getUserFromSession(r)
+		if assert.NotNil(t, session) {
+			assert.Equal(t, "session", session.SessionIndex)
+			assert.Equal(t, []string{"other", "dex"}, session.ServiceProviders, "single logout should still reach the earlier service providers")
+		}
+	}
+}
+
+func TestIDP_DefaultPostSSOHandler_isPassive(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	dex, _ := i.ServiceProvider("dex")
+	dex.AssertionConsumerServices = append(dex.AssertionConsumerServices, AssertionConsumerService{
+		Index:    1,
+		Binding:  postBinding,
+		Location: "https://dex.example.com/acs",
+	})
+	loginReq := newTestAuthnRequest()
+	loginReq.ProtocolBinding = postBinding
+	loginReq.IsPassive = true
+	w := postAuthnRequest(t, i, loginReq, true)
+	assert.Equal(t, http.StatusOK, w.Code, "expected a form posting the response instead of the login page")
+	doc, err := goquery.NewDocumentFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := doc.Find("input[name=SAMLResponse]").Attr("value")
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &saml.Response{}
+	if err = xml.Unmarshal(data, response); err != nil {
+		t.Fatal(err)
+	}
+	if assert.NotNil(t, response.Status.StatusCode.StatusCode) {
+		assert.Equal(t, "urn:oasis:names:tc:SAML:2.0:status:NoPassive", response.Status.StatusCode.StatusCode.Value)
+	}
+	assert.Nil(t, response.Assertion)
+	assert.Equal(t, loginReq.ID, response.InResponseTo)
+	assert.NoError(t, dsig.Verify(data, i.SigningCertificate.Leaf.PublicKey), "the response should be signed")
+}
+
+func TestIDP_authenticate_isPassive(t *testing.T) {
+	i := &IDP{}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	cookie := addTestSession(t, i, "12345", newTestUser())
+	authnReq := &model.AuthnRequest{
+		ID:                          saml.NewID(),
+		Issuer:                      "dex",
+		ProtocolBinding:             artifactBinding,
+		AssertionConsumerServiceURL: "http://127.0.0.1:5556/dex/callback",
+		IsPassive:                   true,
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	assert.NoError(t, i.authenticate(authnReq, w, r))
+	assert.Equal(t, http.StatusFound, w.Code, "the artifact should be sent back without a login")
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := i.ArtifactCache.Get(location.Query().Get("SAMLart"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifactResponse := &model.ArtifactResponse{}
+	if err = proto.Unmarshal(data, artifactResponse); err != nil {
+		t.Fatal(err)
+	}
+	response, err := i.makeAuthnResponse(artifactResponse.Request, artifactResponse.User)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, noPassiveStatus, response.Status)
+	assert.Nil(t, response.Assertion)
+
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	assert.NoError(t, i.authenticate(authnReq, w, r))
+	location, _ = url.Parse(w.Header().Get("Location"))
+	data, _ = i.ArtifactCache.Get(location.Query().Get("SAMLart"))
+	artifactResponse = &model.ArtifactResponse{}
+	proto.Unmarshal(data, artifactResponse)
+	if assert.NotNil(t, artifactResponse.User, "passive requests should be answered from the session") {
+		assert.Equal(t, "joe", artifactResponse.User.Name)
+	}
+
+	authnReq.ForceAuthn = true
+	w = httptest.NewRecorder()
+	assert.NoError(t, i.authenticate(authnReq, w, r))
+	location, _ = url.Parse(w.Header().Get("Location"))
+	data, _ = i.ArtifactCache.Get(location.Query().Get("SAMLart"))
+	artifactResponse = &model.ArtifactResponse{}
+	proto.Unmarshal(data, artifactResponse)
+	assert.Nil(t, artifactResponse.User, "a passive request can't force a login")
+}
+
+func TestIDP_getSession_timeouts(t *testing.T) {
+	viper.Set("session-idle-timeout", "30m")
+	defer viper.Set("session-idle-timeout", "0s")
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	now := time.Now()
+	at := func(t time.Time) *timestamp.Timestamp {
+		ts, _ := ptypes.TimestampProto(t)
+		return ts
+	}
+	tests := []struct {
+		name         string
+		authnInstant time.Time
+		lastActivity time.Time
+		valid        bool
+	}{
+		{"recently used", now.Add(-7 * time.Hour), now.Add(-29 * time.Minute), true},
+		{"idle", now.Add(-time.Hour), now.Add(-31 * time.Minute), false},
+		{"too old", now.Add(-9 * time.Hour), now.Add(-time.Minute), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := newTestUser()
+			user.AuthnInstant = at(tt.authnInstant)
+			user.LastActivity = at(tt.lastActivity)
+			cookie := addTestSession(t, i, tt.name, user)
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(cookie)
+			assert.Equal(t, tt.valid, i.getUserFromSession(r) != nil)
+		})
+	}
+	// Sessions saved before the timestamps were recorded are only limited by the cache
+	cookie := addTestSession(t, i, "old", newTestUser())
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	assert.NotNil(t, i.getUserFromSession(r))
+}
+
+func TestIDP_respond_sessionActivity(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	authnReq := &model.AuthnRequest{
+		ID:                          saml.NewID(),
+		Issuer:                      "dex",
+		ProtocolBinding:             artifactBinding,
+		AssertionConsumerServiceURL: "http://127.0.0.1:5556/dex/callback",
+	}
+	loggedIn, _ := ptypes.TimestampProto(time.Now().Add(-time.Hour))
+	user := newTestUser()
+	user.AuthnInstant = loggedIn
+	cookie := addTestSession(t, i, "12345", user)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	assert.NoError(t, i.authenticate(authnReq, w, r))
+	session := i.getUserFromSession(r)
+	if assert.NotNil(t, session) {
+		assert.Equal(t, loggedIn.Seconds, session.AuthnInstant.Seconds, "reusing the session shouldn't restart the absolute timeout")
+		lastActivity, _ := ptypes.Timestamp(session.LastActivity)
+		assert.WithinDuration(t, time.Now(), lastActivity, time.Minute, "reusing the session should restart the idle timeout")
+	}
+
+	assert.NoError(t, i.respond(authnReq, newTestUser(), httptest.NewRecorder(), r))
+	session = i.getUserFromSession(r)
+	if assert.NotNil(t, session) {
+		authnInstant, _ := ptypes.Timestamp(session.AuthnInstant)
+		assert.WithinDuration(t, time.Now(), authnInstant, time.Minute, "logging in again should restart the absolute timeout")
+	}
+	response, err := i.makeAuthnResponse(authnReq, session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authnInstant, _ := ptypes.Timestamp(session.AuthnInstant)
+	assert.Equal(t, authnInstant.Add(i.sessionLifetime).Unix(), response.Assertion.AuthnStatement.SessionNotOnOrAfter.Unix())
+}
+
+func BenchmarkIDP_decodeRedirectMessage(b *testing.B) {
+	i := &IDP{}
+	getTestIDPWithSP(b, i).Close()
+	data, err := xml.Marshal(newTestAuthnRequest())
+	if err != nil {
+		b.Fatal(err)
+	}
+	message := base64.StdEncoding.EncodeToString(deflate(b, data))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := i.decodeRedirectMessage(message, &saml.AuthnRequest{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrAuthnFailed can be returned, wrapped if desired, by PasswordValidators, AttributeSources, and
+// AssertionDecorators to end a login that can't succeed, such as one for a disabled account. The service provider
+// is sent a response with an AuthnFailed status rather than the user being shown an error.
+var ErrAuthnFailed = errors.New("authentication failed")
+
+// ErrRequestDenied can be returned, wrapped if desired, by AttributeSources and AssertionDecorators when the user
+// isn't allowed to log in to the service provider. The service provider is sent a response with a RequestDenied status.
+var ErrRequestDenied = errors.New("request denied")
+
+// ErrUnknownPrincipal can be returned, wrapped if desired, by AttributeSources when a user who authenticated, such as
+// with a certificate, isn't in the directory. The service provider is sent a response with an UnknownPrincipal status.
+// PasswordValidators should return ErrUnknownUser instead, so users who mistype their login can try again.
+var ErrUnknownPrincipal = errors.New("user is not known")
+
+// authnFailedStatus tells a service provider that the user couldn't be authenticated
+var authnFailedStatus = &saml.Status{
+	StatusCode: saml.StatusCode{
+		Value: "urn:oasis:names:tc:SAML:2.0:status:Responder",
+		StatusCode: &saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:AuthnFailed",
+		},
+	},
+}
+
+// loginDeniedStatus tells a service provider that the IdP won't log the user in to it
+var loginDeniedStatus = &saml.Status{
+	StatusCode: saml.StatusCode{
+		Value: "urn:oasis:names:tc:SAML:2.0:status:Responder",
+		StatusCode: &saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:RequestDenied",
+		},
+	},
+}
+
+// unknownUserStatus tells a service provider that the user who authenticated isn't known to the IdP
+var unknownUserStatus = &saml.Status{
+	StatusCode: saml.StatusCode{
+		Value: "urn:oasis:names:tc:SAML:2.0:status:Responder",
+		StatusCode: &saml.StatusCode{
+			Value: "urn:oasis:names:tc:SAML:2.0:status:UnknownPrincipal",
+		},
+	},
+}
+
+// failureStatus returns the status that reports the error to the service provider, or nil if the error isn't one the
+// service provider is told about
+func failureStatus(err error) *saml.Status {
+	var (
+		denied    *requestDeniedError
+		policy    *invalidNameIDPolicyError
+		noContext *noAuthnContextError
+		scoping   *scopingError
+		service   *unknownAttributeServiceError
+	)
+	switch {
+	case errors.As(err, &denied):
+		return requestDeniedStatus
+	case errors.As(err, &policy):
+		return invalidNameIDPolicyStatus
+	case errors.As(err, &noContext):
+		return noAuthnContextStatus
+	case errors.As(err, &scoping):
+		return scoping.status()
+	case errors.As(err, &service):
+		return requestUnsupportedStatus
+	case errors.Is(err, ErrRequestDenied):
+		return loginDeniedStatus
+	case errors.Is(err, ErrAuthnFailed):
+		return authnFailedStatus
+	case errors.Is(err, ErrUnknownPrincipal):
+		return unknownUserStatus
+	}
+	return nil
+}
+
+// reportFailure sends the service provider a signed response with the status for the error, so it can tell the user
+// why the login failed. It returns the error unchanged if it has no status or the response can't be sent with the
+// binding the request was received with, and nil if there's no error.
+func (i *IDP) reportFailure(request *model.AuthnRequest, err error, w http.ResponseWriter, r *http.Request) error {
+	if err == nil {
+		return nil
+	}
+	status := failureStatus(err)
+	// Statuses are sent through the browser, so ECP clients get the error instead
+	if status == nil || request.RequestBinding == soapBinding ||
+		!responseBindingSupported(request.RequestBinding, request.ProtocolBinding) {
+		return err
+	}
+	log.Warnf("sending %s status to %s: %v", status.StatusCode.StatusCode.Value, request.Issuer, err)
+	return i.sendStatus(request, status, w, r)
+}
+
+// sendStatus answers the request with a response that only has a status, using the binding of its assertion
+// consumer service
+func (i *IDP) sendStatus(request *model.AuthnRequest, status *saml.Status, w http.ResponseWriter, r *http.Request) error {
+	switch request.ProtocolBinding {
+	case artifactBinding:
+		return i.redirectArtifact(&model.ArtifactResponse{
+			Request:               request,
+			StatusCode:            status.StatusCode.Value,
+			SecondLevelStatusCode: status.StatusCode.StatusCode.Value,
+		}, w, r)
+	case postBinding:
+		return i.sendPostStatus(request, status, w)
+	default:
+		return errors.New("unsupported protocol binding")
+	}
+}
+
+// makeStatusResponse builds a response to the request that reports the status instead of carrying an assertion
+func (i *IDP) makeStatusResponse(request *model.AuthnRequest, status *saml.Status) *saml.Response {
+	return &saml.Response{
+		StatusResponseType: saml.StatusResponseType{
+			Version:      "2.0",
+			ID:           saml.NewID(),
+			IssueInstant: time.Now(),
+			Issuer:       i.issuer(request.Issuer),
+			Destination:  request.AssertionConsumerServiceURL,
+			InResponseTo: request.ID,
+			Status:       status,
+		},
+	}
+}
+
+// artifactStatus returns the status saved with an artifact, or nil if the artifact is for an assertion
+func artifactStatus(response *model.ArtifactResponse) *saml.Status {
+	if response.StatusCode == "" {
+		return nil
+	}
+	status := &saml.Status{StatusCode: saml.StatusCode{Value: response.StatusCode}}
+	if response.SecondLevelStatusCode != "" {
+		status.StatusCode.StatusCode = &saml.StatusCode{Value: response.SecondLevelStatusCode}
+	}
+	return status
+}
@@ -0,0 +1,245 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/stretchr/testify/assert"
+)
+
+// redirectedStatus resolves the artifact the browser was redirected to the service provider with, and returns the
+// status of the response it carries
+func redirectedStatus(t *testing.T, i *IDP, w *httptest.ResponseRecorder) *saml.Status {
+	artifactResponse := resolveRedirect(t, i, w)
+	if artifactResponse == nil {
+		return nil
+	}
+	response := artifactResponse.Response
+	assert.Nil(t, response.Assertion, "a failure shouldn't carry an assertion")
+	return decodedStatus(response.Status)
+}
+
+// resolveRedirect resolves the artifact the browser was redirected to the service provider with
+func resolveRedirect(t *testing.T, i *IDP, w *httptest.ResponseRecorder) *saml.ArtifactResponse {
+	if !assert.Equal(t, http.StatusFound, w.Code, "expected a redirect to the assertion consumer service") {
+		return nil
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The service provider in testdata shares the IdP's key, so the IdP can sign the ArtifactResolve for it
+	resolve := saml.ArtifactResolve{
+		RequestAbstractType: saml.RequestAbstractType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now(),
+			Issuer:       "dex",
+		},
+		Artifact: location.Query().Get("SAMLart"),
+	}
+	if resolve.Signature, err = i.signer.CreateSignature(resolve); err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(saml.ArtifactResolveEnvelope{Body: saml.ArtifactResolveBody{ArtifactResolve: resolve}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolved := httptest.NewRecorder()
+	i.processArtifactResolutionRequest(resolved, httptest.NewRequest("POST", "/", bytes.NewReader(data)))
+	if !assert.Equal(t, http.StatusOK, resolved.Code, "failed to resolve artifact") {
+		return nil
+	}
+	env := saml.ArtifactResponseEnvelope{}
+	if err = xml.NewDecoder(resolved.Body).Decode(&env); err != nil {
+		t.Fatal(err)
+	}
+	return &env.Body.ArtifactResponse
+}
+
+// decodedStatus drops the element names a decoded status has, so it can be compared with the IdP's statuses
+func decodedStatus(status *saml.Status) *saml.Status {
+	if status == nil {
+		return nil
+	}
+	decoded := &saml.Status{StatusCode: saml.StatusCode{Value: status.StatusCode.Value}}
+	if status.StatusCode.StatusCode != nil {
+		decoded.StatusCode.StatusCode = &saml.StatusCode{Value: status.StatusCode.StatusCode.Value}
+	}
+	return decoded
+}
+
+// postedResponse returns the response in a form that posts it to the service provider
+func postedResponse(t *testing.T, w *httptest.ResponseRecorder) ([]byte, *saml.Response) {
+	doc, err := goquery.NewDocumentFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, _ := doc.Find("input[name=SAMLResponse]").Attr("value")
+	data, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response := &saml.Response{}
+	if err = xml.Unmarshal(data, response); err != nil {
+		t.Fatal(err)
+	}
+	return data, response
+}
+
+// submitTestLogin fills in the login form the browser was redirected to
+func submitTestLogin(t *testing.T, i *IDP, redirect *httptest.ResponseRecorder, username, password string) *httptest.ResponseRecorder {
+	location, err := url.Parse(redirect.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookies := redirect.Result().Cookies()
+	// Load the login page for its CSRF token
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", location.String(), nil)
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	i.LoginPageHandler(w, r)
+	doc, err := goquery.NewDocumentFromReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, _ := doc.Find("input[name=csrfToken]").Attr("value")
+	w = httptest.NewRecorder()
+	r = httptest.NewRequest("POST", "/ui/login.html", strings.NewReader(url.Values{
+		"requestId": {location.Query().Get("requestId")},
+		"username":  {username},
+		"password":  {password},
+		"csrfToken": {token},
+	}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, cookie := range cookies {
+		r.AddCookie(cookie)
+	}
+	i.PasswordLoginHandler(w, r)
+	return w
+}
+
+func Test_failureStatus(t *testing.T) {
+	tests := []struct {
+		err  error
+		want *saml.Status
+	}{
+		{&requestDeniedError{"dex", dsig.ErrNoSignature}, requestDeniedStatus},
+		{&invalidNameIDPolicyError{entityID: "dex"}, invalidNameIDPolicyStatus},
+		{&noAuthnContextError{entityID: "dex"}, noAuthnContextStatus},
+		{fmt.Errorf("joe isn't in the wiki group: %w", ErrRequestDenied), loginDeniedStatus},
+		{fmt.Errorf("account disabled: %w", ErrAuthnFailed), authnFailedStatus},
+		{ErrUnknownPrincipal, unknownUserStatus},
+		{ErrInvalidPassword, nil},
+		{errors.New("directory is down"), nil},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, failureStatus(tt.err), tt.err.Error())
+	}
+}
+
+// deniedDecorator refuses to issue assertions with the error
+type deniedDecorator struct {
+	err error
+}
+
+func (d deniedDecorator) DecorateAssertion(*saml.Assertion, *model.User, *model.AuthnRequest) error {
+	return d.err
+}
+
+func TestIDP_reportFailure(t *testing.T) {
+	i := &IDP{AssertionDecorators: []AssertionDecorator{
+		deniedDecorator{fmt.Errorf("account disabled: %w", ErrAuthnFailed)}}}
+	getTestIDPWithSP(t, i).Close()
+	request := func(binding string) *model.AuthnRequest {
+		return &model.AuthnRequest{
+			ID:                          saml.NewID(),
+			Issuer:                      "dex",
+			ProtocolBinding:             binding,
+			AssertionConsumerServiceURL: "http://127.0.0.1:5556/dex/callback",
+			RelayState:                  "state",
+		}
+	}
+
+	// Artifact binding
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	assert.NoError(t, i.reportFailure(request(artifactBinding), i.respond(request(artifactBinding), newTestUser(), w, r), w, r))
+	assert.Equal(t, authnFailedStatus, redirectedStatus(t, i, w))
+
+	// POST binding
+	i.AssertionDecorators = []AssertionDecorator{deniedDecorator{fmt.Errorf("not in the group: %w", ErrRequestDenied)}}
+	req := request(postBinding)
+	w = httptest.NewRecorder()
+	assert.NoError(t, i.reportFailure(req, i.respond(req, newTestUser(), w, r), w, r))
+	data, response := postedResponse(t, w)
+	assert.Equal(t, loginDeniedStatus, decodedStatus(response.Status))
+	assert.Equal(t, req.ID, response.InResponseTo)
+	assert.Nil(t, response.Assertion)
+	assert.NoError(t, dsig.Verify(data, i.SigningCertificate.Leaf.PublicKey), "the response should be signed")
+
+	// Errors the service provider isn't told about are shown to the user
+	err := errors.New("directory is down")
+	assert.Equal(t, err, i.reportFailure(request(postBinding), err, httptest.NewRecorder(), r))
+	assert.Equal(t, ErrUnknownPrincipal, i.reportFailure(request(oidcBinding), ErrUnknownPrincipal, httptest.NewRecorder(), r),
+		"OpenID Connect clients aren't sent SAML responses")
+	req = request(postBinding)
+	req.RequestBinding = soapBinding
+	assert.Equal(t, ErrUnknownPrincipal, i.reportFailure(req, ErrUnknownPrincipal, httptest.NewRecorder(), r),
+		"requests received over SOAP aren't answered through the browser")
+	req.ProtocolBinding = paosBinding
+	assert.Equal(t, ErrUnknownPrincipal, i.reportFailure(req, ErrUnknownPrincipal, httptest.NewRecorder(), r))
+	req = request(artifactBinding)
+	req.RequestBinding = redirectBinding
+	w = httptest.NewRecorder()
+	assert.NoError(t, i.reportFailure(req, ErrUnknownPrincipal, w, r))
+	assert.Equal(t, unknownUserStatus, redirectedStatus(t, i, w))
+	assert.NoError(t, i.reportFailure(request(postBinding), nil, httptest.NewRecorder(), r))
+}
+
+// unknownSource doesn't know any users
+type unknownSource struct{}
+
+func (unknownSource) AddAttributes(user *model.User, request *model.AuthnRequest) error {
+	return fmt.Errorf("%s isn't in the directory: %w", user.Name, ErrUnknownPrincipal)
+}
+
+func TestIDP_DefaultPasswordLoginHandler_unknownPrincipal(t *testing.T) {
+	i := &IDP{PasswordValidator: acceptingValidator{}, AttributeSources: []AttributeSource{unknownSource{}}}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	w := postAuthnRequest(t, i, newTestAuthnRequest(), true)
+	assert.Equal(t, http.StatusSeeOther, w.Code, "expected redirect to login page")
+	w = submitTestLogin(t, i, w, "joe", "password")
+	assert.Equal(t, unknownUserStatus, redirectedStatus(t, i, w),
+		"a user the attribute sources don't know should be reported to the service provider")
+}
@@ -15,25 +15,42 @@
 package idp
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"time"
 
+	"github.com/amdonov/lite-idp/pkcs11"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
 // ConfigureTLS not requiring users to present client certificates.
 func ConfigureTLS() (*tls.Config, error) {
-	cert, err := tls.LoadX509KeyPair(viper.GetString("tls-certificate"), viper.GetString("tls-private-key"))
-	ca := viper.GetString("tls-ca")
+	return configureTLS(viper.GetViper())
+}
+
+func configureTLS(settings *viper.Viper) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(settings.GetString("tls-certificate"), settings.GetString("tls-private-key"))
+	ca := settings.GetString("tls-ca")
 	if err != nil {
 		return nil, err
 	}
+	if settings.GetBool("tls-ocsp-stapling") {
+		stapleOCSPResponse(&cert, settings.GetDuration("cert-revocation-timeout"))
+	}
 	tlsConfig := &tls.Config{
 		Certificates: []tls.Certificate{cert},
 		//Some but not all operations will require a client cert
 		ClientAuth: tls.VerifyClientCertIfGiven,
-		MinVersion: tls.VersionTLS12,
+	}
+	if err = configureTLSVersions(settings, tlsConfig); err != nil {
+		return nil, err
 	}
 	if ca != "" {
 		caCert, err := ioutil.ReadFile(ca)
@@ -48,3 +65,185 @@ func ConfigureTLS() (*tls.Config, error) {
 	tlsConfig.BuildNameToCertificate()
 	return tlsConfig, nil
 }
+
+// stapleOCSPResponse gets the status of the TLS certificate from the OCSP responder it names, so clients don't have
+// to ask. The certificate file has to include the issuer's certificate. Failures are logged rather than returned,
+// since clients can still ask the responder themselves. The response is fetched again when the configuration is reloaded.
+func stapleOCSPResponse(cert *tls.Certificate, timeout time.Duration) {
+	err := func() error {
+		if len(cert.Certificate) < 2 {
+			return errors.New("tls-certificate doesn't include the issuer's certificate")
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+		issuer, err := x509.ParseCertificate(cert.Certificate[1])
+		if err != nil {
+			return err
+		}
+		if len(leaf.OCSPServer) == 0 {
+			return errors.New("tls-certificate doesn't name an OCSP responder")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		status, err := fetchOCSP(ctx, http.DefaultClient, leaf.OCSPServer[0], leaf, issuer)
+		if err != nil {
+			return err
+		}
+		if status.revoked {
+			return errors.New("the responder says tls-certificate is revoked")
+		}
+		cert.OCSPStaple = status.raw
+		return nil
+	}()
+	if err != nil {
+		log.Warnf("not stapling an OCSP response to TLS handshakes: %v", err)
+	}
+}
+
+// tlsVersions are the accepted values of tls-min-version
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ConfigureTLSVersions applies the tls-min-version and tls-cipher-suites settings to a TLS configuration, such as
+// that of a second listener.
+func ConfigureTLSVersions(config *tls.Config) error {
+	return configureTLSVersions(viper.GetViper(), config)
+}
+
+// configureTLSVersions sets the minimum TLS version and the TLS 1.2 cipher suites. Go's default suites are used if
+// tls-cipher-suites is empty. TLS 1.3 suites can't be configured, so tls-cipher-suites can't be set with 1.3 only.
+func configureTLSVersions(settings *viper.Viper, config *tls.Config) error {
+	minVersion := settings.GetString("tls-min-version")
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return fmt.Errorf("tls-min-version must be 1.2 or 1.3, not %q", minVersion)
+	}
+	config.MinVersion = version
+	names := settings.GetStringSlice("tls-cipher-suites")
+	if len(names) == 0 {
+		return nil
+	}
+	if version == tls.VersionTLS13 {
+		return errors.New("tls-cipher-suites can't be set when tls-min-version is 1.3")
+	}
+	suites := map[string]*tls.CipherSuite{}
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite
+	}
+	insecure := map[string]bool{}
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+	config.CipherSuites = nil
+	for _, name := range names {
+		suite, ok := suites[name]
+		switch {
+		case insecure[name]:
+			return fmt.Errorf("tls-cipher-suites contains the insecure cipher suite %s", name)
+		case !ok:
+			return fmt.Errorf("tls-cipher-suites contains the unknown cipher suite %s", name)
+		case !supportsVersion(suite, tls.VersionTLS12):
+			return fmt.Errorf("tls-cipher-suites contains the TLS 1.3 cipher suite %s, which can't be configured", name)
+		}
+		config.CipherSuites = append(config.CipherSuites, suite.ID)
+	}
+	return nil
+}
+
+func supportsVersion(suite *tls.CipherSuite, version uint16) bool {
+	for _, v := range suite.SupportedVersions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
+
+// loadSigningCertificate reads the key pair from signing-certificate and signing-private-key. The key may be a
+// PKCS #11 URI for a key kept in an HSM, whose PIN is replaced by signing-pin if it's set. It returns nil if neither is set.
+func loadSigningCertificate(settings *viper.Viper) (*tls.Certificate, error) {
+	certificate, key := settings.GetString("signing-certificate"), settings.GetString("signing-private-key")
+	if certificate == "" && key == "" {
+		return nil, nil
+	}
+	if certificate == "" || key == "" {
+		return nil, errors.New("signing-certificate and signing-private-key must be set together")
+	}
+	if pkcs11.IsURI(key) {
+		pin, err := resolveSecret(settings, "signing-pin")
+		if err != nil {
+			return nil, err
+		}
+		return loadPKCS11Certificate(certificate, key, pin)
+	}
+	cert, err := tls.LoadX509KeyPair(certificate, key)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// loadPKCS11Certificate pairs the PEM certificate chain with a private key on a token. A PIN other than the
+// empty string takes the place of the one in the URI.
+func loadPKCS11Certificate(certificate, uri, pin string) (*tls.Certificate, error) {
+	u, err := pkcs11.ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	if pin != "" {
+		u.PIN = pin
+	}
+	ders, err := readCertificates(certificate)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{Certificate: ders}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
+	if cert.PrivateKey, err = pkcs11.NewSignerFromURI(u, cert.Leaf.PublicKey); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
+
+// loadAdditionalSigningCertificates reads the certificates in the additional-signing-certificates files
+func loadAdditionalSigningCertificates(settings *viper.Viper) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	for _, file := range settings.GetStringSlice("additional-signing-certificates") {
+		ders, err := readCertificates(file)
+		if err != nil {
+			return nil, err
+		}
+		for _, der := range ders {
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("invalid certificate in %s: %v", file, err)
+			}
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
+// readCertificates returns the DER bytes of the PEM certificates in the file
+func readCertificates(file string) ([][]byte, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var ders [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "CERTIFICATE" {
+			ders = append(ders, block.Bytes)
+		}
+	}
+	if len(ders) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return ders, nil
+}
@@ -0,0 +1,215 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeSigningCertificate writes a self-signed ECDSA key pair to dir and returns the certificate
+func writeSigningCertificate(t *testing.T, dir string) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "signing"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]*pem.Block{
+		"signing.pem":     {Type: "CERTIFICATE", Bytes: der},
+		"signing-key.pem": {Type: "PRIVATE KEY", Bytes: keyDER},
+	}
+	for name, block := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestIDP_signingCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cert := writeSigningCertificate(t, dir)
+	viper.Set("signing-certificate", filepath.Join(dir, "signing.pem"))
+	defer viper.Set("signing-certificate", "")
+	viper.Set("signing-private-key", filepath.Join(dir, "signing-key.pem"))
+	defer viper.Set("signing-private-key", "")
+	i := &IDP{}
+	getTestIDP(t, i)
+	assert.Equal(t, dsig.ECDSASHA256, i.signer.Algorithm(), "messages should be signed with the signing key")
+
+	metadata, err := i.Metadata("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, dsig.Verify(metadata, cert.PublicKey))
+	ed := &saml.IDPEntityDescriptor{}
+	if err = xml.Unmarshal(metadata, ed); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, base64.StdEncoding.EncodeToString(cert.Raw), ed.IDPSSODescriptor.KeyDescriptor[0].KeyInfo.X509Data.X509Certificate,
+		"metadata should publish the signing certificate")
+
+	viper.Set("signing-private-key", "")
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err, "a signing certificate without a key should be rejected")
+}
+
+func Test_loadSigningCertificate_pkcs11(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeSigningCertificate(t, dir)
+	settings := viper.New()
+	settings.Set("signing-certificate", filepath.Join(dir, "signing.pem"))
+	settings.Set("signing-private-key", "pkcs11:object=signing?module-path="+filepath.Join(dir, "missing.so")+"&pin-value=secret")
+	_, err = loadSigningCertificate(settings)
+	if assert.Error(t, err, "the PKCS #11 library doesn't exist") {
+		assert.NotContains(t, err.Error(), "secret")
+	}
+
+	settings.Set("signing-certificate", filepath.Join(dir, "signing-key.pem"))
+	_, err = loadSigningCertificate(settings)
+	assert.Error(t, err, "the certificate file doesn't have a certificate")
+
+	settings.Set("signing-certificate", filepath.Join(dir, "signing.pem"))
+	settings.Set("signing-private-key", "pkcs11:object=signing")
+	_, err = loadSigningCertificate(settings)
+	assert.Error(t, err, "the URI doesn't have a module-path")
+}
+
+func TestIDP_additionalSigningCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	next := writeSigningCertificate(t, dir)
+	viper.Set("additional-signing-certificates", []string{filepath.Join(dir, "signing.pem")})
+	defer viper.Set("additional-signing-certificates", []string{})
+	i := &IDP{}
+	getTestIDP(t, i)
+
+	metadata, err := i.Metadata("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ed := &saml.IDPEntityDescriptor{}
+	if err = xml.Unmarshal(metadata, ed); err != nil {
+		t.Fatal(err)
+	}
+	descriptors := ed.IDPSSODescriptor.KeyDescriptor
+	if assert.Len(t, descriptors, 3, "current signing, next signing and encryption keys") {
+		assert.Equal(t, "signing", descriptors[1].Use)
+		assert.Equal(t, base64.StdEncoding.EncodeToString(next.Raw), descriptors[1].KeyInfo.X509Data.X509Certificate)
+		assert.Equal(t, "encryption", descriptors[2].Use)
+	}
+	assert.NoError(t, dsig.Verify(metadata, i.SigningCertificate.Leaf.PublicKey), "metadata should still be signed with the current key")
+
+	viper.Set("additional-signing-certificates", []string{filepath.Join(dir, "signing-key.pem")})
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err, "the file doesn't have a certificate")
+}
+
+func Test_configureTLSVersions(t *testing.T) {
+	tests := []struct {
+		name       string
+		minVersion string
+		suites     []string
+		want       *tls.Config
+	}{
+		{"defaults", "1.2", nil, &tls.Config{MinVersion: tls.VersionTLS12}},
+		{"TLS 1.3 only", "1.3", nil, &tls.Config{MinVersion: tls.VersionTLS13}},
+		{"cipher suites", "1.2", []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384", "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256"},
+			&tls.Config{MinVersion: tls.VersionTLS12, CipherSuites: []uint16{
+				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}}},
+		{"TLS 1.1", "1.1", nil, nil},
+		{"unknown version", "tls12", nil, nil},
+		{"unknown cipher suite", "1.2", []string{"TLS_RSA_WITH_NOTHING"}, nil},
+		{"insecure cipher suite", "1.2", []string{"TLS_RSA_WITH_RC4_128_SHA"}, nil},
+		{"TLS 1.3 cipher suite", "1.2", []string{"TLS_AES_128_GCM_SHA256"}, nil},
+		{"cipher suites with TLS 1.3 only", "1.3", []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := viper.New()
+			settings.Set("tls-min-version", tt.minVersion)
+			settings.Set("tls-cipher-suites", tt.suites)
+			config := &tls.Config{}
+			err := configureTLSVersions(settings, config)
+			if tt.want == nil {
+				assert.Error(t, err)
+				return
+			}
+			if assert.NoError(t, err) {
+				assert.Equal(t, tt.want, config)
+			}
+		})
+	}
+}
+
+func TestIDP_tlsMinVersion(t *testing.T) {
+	defer viper.Set("tls-min-version", "1.2")
+	viper.Set("tls-min-version", "1.3")
+	i := &IDP{}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	assert.Equal(t, uint16(tls.VersionTLS13), i.TLSConfig.MinVersion)
+
+	viper.Set("tls-min-version", "1.0")
+	_, err := (&IDP{}).Handler()
+	assert.Error(t, err, "versions before TLS 1.2 should be rejected at startup")
+}
@@ -0,0 +1,395 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/store"
+	"github.com/golang/protobuf/proto"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// totpPeriod is the lifetime of each code in seconds
+	totpPeriod = 30
+	totpDigits = 6
+	// totpPagePath is where users are asked for a code after entering their password
+	totpPagePath = "/ui/totp.html"
+)
+
+// errTOTPRequired is returned for password logins that can't continue without a code, such as ECP logins
+var errTOTPRequired = errors.New("a one-time code is required to log in")
+
+// TOTPSecretSource is implemented by PasswordValidators that keep users' TOTP secrets with their
+// credentials. An empty secret means the user isn't enrolled, and the TOTP secret store is checked instead.
+type TOTPSecretSource interface {
+	TOTPSecret(ctx context.Context, user string) (string, error)
+}
+
+// TOTPSecretStore keeps the base32 encoded TOTP secrets users are enrolled with
+type TOTPSecretStore struct {
+	cache store.Cache
+}
+
+// NewTOTPSecretStore returns a store that keeps secrets in the cache. Entries in the cache shouldn't expire.
+func NewTOTPSecretStore(cache store.Cache) *TOTPSecretStore {
+	return &TOTPSecretStore{cache}
+}
+
+// Enroll generates a new secret for the user, replacing any existing one
+func (s *TOTPSecretStore) Enroll(user string) (string, error) {
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+	if err = s.cache.Set(totpSecretKey(user), []byte(secret)); err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// Lookup returns the user's secret or store.ErrNotFound if they aren't enrolled
+func (s *TOTPSecretStore) Lookup(user string) (string, error) {
+	data, err := s.cache.Get(totpSecretKey(user))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// Remove unenrolls the user
+func (s *TOTPSecretStore) Remove(user string) error {
+	return s.cache.Delete(totpSecretKey(user))
+}
+
+func totpSecretKey(user string) string {
+	return "totp-secret:" + user
+}
+
+// GenerateTOTPSecret returns a random 160 bit secret encoded with base32 as authenticator apps expect
+func GenerateTOTPSecret() (string, error) {
+	data := make([]byte, 20)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(data), nil
+}
+
+// TOTPURL returns the otpauth URL authenticator apps read from QR codes to add the user's secret
+func TOTPURL(issuer, user, secret string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", strconv.Itoa(totpDigits))
+	params.Set("period", strconv.Itoa(totpPeriod))
+	label := url.PathEscape(issuer) + ":" + url.PathEscape(user)
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, params.Encode())
+}
+
+// decodeTOTPSecret accepts secrets with or without padding, spaces, and lowercase letters
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+}
+
+// totpCode computes the RFC 4226 HOTP value for the counter, which is the time step for RFC 6238 codes
+func totpCode(key []byte, counter int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	value := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// validateTOTP checks the code against the time steps within skew of now and returns the step it matched
+func validateTOTP(secret, code string, now time.Time, skew int) (int64, bool) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / totpPeriod
+	for step := current - int64(skew); step <= current+int64(skew); step++ {
+		if hmac.Equal([]byte(totpCode(key, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func (i *IDP) configureTOTP() error {
+	i.totpEnabled = i.settings.GetBool("totp-enabled")
+	i.totpRequired = i.settings.GetBool("totp-required")
+	i.totpSkew = i.settings.GetInt("totp-skew")
+	i.totpMaxAttempts = i.settings.GetInt("totp-max-attempts")
+	if i.totpSkew < 0 {
+		return errors.New("totp-skew can't be negative")
+	}
+	if i.totpMaxAttempts < 1 {
+		return errors.New("totp-max-attempts must be at least 1")
+	}
+	if i.TOTPSecretCache == nil {
+		cache, err := i.newCache("totp:", 0)
+		if err != nil {
+			return err
+		}
+		i.TOTPSecretCache = cache
+	}
+	i.totpSecrets = NewTOTPSecretStore(i.TOTPSecretCache)
+	templ, err := htmltemplate.New("totp").Parse(totpTemplate)
+	if err != nil {
+		return err
+	}
+	i.totpTemplate = templ
+	return nil
+}
+
+// totpSecret returns the user's secret from the password validator or the secret store, or an empty string if they aren't enrolled
+func (i *IDP) totpSecret(ctx context.Context, user string) (string, error) {
+	if source, ok := i.PasswordValidator.(TOTPSecretSource); ok {
+		secret, err := source.TOTPSecret(ctx, user)
+		if err != nil || secret != "" {
+			return secret, err
+		}
+	}
+	secret, err := i.totpSecrets.Lookup(user)
+	if err == store.ErrNotFound {
+		return "", nil
+	}
+	return secret, err
+}
+
+// requiresTOTP reports whether a user who entered their password has to enter a code as well
+func (i *IDP) requiresTOTP(ctx context.Context, user string) (bool, error) {
+	if !i.totpEnabled {
+		return false, nil
+	}
+	if i.totpRequired {
+		return true, nil
+	}
+	secret, err := i.totpSecret(ctx, user)
+	return secret != "", err
+}
+
+// startTOTPLogin saves a user who entered their password and sends them to the code page. It returns
+// false without writing a response if the user doesn't need to enter a code.
+func (i *IDP) startTOTPLogin(requestID string, req *model.AuthnRequest, user *model.User,
+	w http.ResponseWriter, r *http.Request) (bool, error) {
+	if !i.totpEnabled {
+		return false, nil
+	}
+	secret, err := i.totpSecret(r.Context(), user.Name)
+	if err != nil || (secret == "" && !i.totpRequired) {
+		return false, err
+	}
+	if secret == "" {
+		log.Warnf("%s can't log in because they aren't enrolled for TOTP", user.Name)
+		http.Redirect(w, r, keepLocale(r, fmt.Sprintf("%s/ui/login.html?requestId=%s&error=%s", i.basePath, url.QueryEscape(requestID),
+			url.QueryEscape("A one-time code is required, but your account isn't set up for one."))), http.StatusFound)
+		return true, nil
+	}
+	id := uuid.New().String()
+	if err = i.savePendingLogin(id, &model.PendingLogin{User: user, Request: req, RequestID: requestID}); err != nil {
+		return false, err
+	}
+	http.Redirect(w, r, keepLocale(r, fmt.Sprintf("%s%s?requestId=%s", i.basePath, totpPagePath, url.QueryEscape(id))), http.StatusFound)
+	return true, nil
+}
+
+func (i *IDP) savePendingLogin(id string, pending *model.PendingLogin) error {
+	data, err := proto.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	return i.TempCache.Set(id, data)
+}
+
+// DefaultTOTPPageHandler is the default implementation for the TOTP page handler. It serves the form users enter their
+// code in after their password is accepted. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultTOTPPageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		i.renderTOTPPage(w, r, query.Get("requestId"), query.Get("error"), http.StatusOK)
+	}
+}
+
+// TOTPPage is passed to the template for the TOTP form
+type TOTPPage struct {
+	Error        string
+	HiddenFields []HiddenField
+	// Language the page is shown in and its messages, such as .Messages.totpCode
+	Lang     string
+	Messages Messages
+}
+
+func (i *IDP) renderTOTPPage(w http.ResponseWriter, r *http.Request, id, message string, status int) {
+	token := csrfToken(i.setLoginCookie(w, r), id)
+	lang, messages := i.messages(r)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", lang)
+	w.WriteHeader(status)
+	err := i.totpTemplate.Execute(w, TOTPPage{
+		Error:        messages.text(message),
+		HiddenFields: []HiddenField{{"requestId", id}, {csrfField, token}},
+		Lang:         lang,
+		Messages:     messages,
+	})
+	if err != nil {
+		log.Error(err)
+	}
+}
+
+// DefaultTOTPLoginHandler is the default implementation for the TOTP login handler. It checks the code entered by a user
+// whose password was accepted and completes their login. Users who enter too many invalid codes have to enter their
+// password again. It can be used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultTOTPLoginHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			err := r.ParseForm()
+			if err != nil {
+				return err
+			}
+			id := r.Form.Get("requestId")
+			if err = i.checkCSRFToken(r); err != nil {
+				log.Warnf("rejecting TOTP form from %s: %v", getIP(r), err)
+				i.renderTOTPPage(w, r, id, "Your form expired. Please try again.", http.StatusForbidden)
+				return nil
+			}
+			// The pending login is taken so concurrent guesses can't each count from the same number of attempts.
+			// It's only saved again when another code can be tried.
+			data, err := store.Take(i.TempCache, id)
+			if err != nil {
+				return err
+			}
+			pending := &model.PendingLogin{}
+			if err = proto.Unmarshal(data, pending); err != nil {
+				return err
+			}
+			user, req := pending.User, pending.Request
+			if user == nil || req == nil {
+				return errors.New("pending login is missing the user or request")
+			}
+			recordServiceProvider(r, i.spLabel(req.Issuer))
+			ip := getIP(r).String()
+			if err = i.authLimiter.allow(ip, user.Name); err != nil {
+				var limited *tooManyAttemptsError
+				if !errors.As(err, &limited) {
+					i.recordAuthentication(r, req, user.Name, TOTPLogin, resultError)
+					return err
+				}
+				i.recordAuthentication(r, req, user.Name, TOTPLogin, resultThrottled)
+				if err = i.savePendingLogin(id, pending); err != nil {
+					return err
+				}
+				writeTooManyAttempts(w, limited)
+				return nil
+			}
+			ok, err := i.checkTOTPCode(r.Context(), user.Name, r.Form.Get("code"))
+			if err != nil {
+				i.recordAuthentication(r, req, user.Name, TOTPLogin, resultError)
+				return err
+			}
+			if ok {
+				i.recordAuthentication(r, req, user.Name, TOTPLogin, resultSuccess)
+				if err = i.authLimiter.succeeded(user.Name); err != nil {
+					log.Errorf("failed to reset failed logins for %s: %v", user.Name, err)
+				}
+				user.Context = i.mfaAuthnContext
+				i.Auditor.LogSuccess(user, req, TOTPLogin)
+				log.Infof("successful TOTP login for %s", user.Name)
+				return i.reportFailure(req, i.respond(req, user, w, r), w, r)
+			}
+			i.recordAuthentication(r, req, user.Name, TOTPLogin, resultFailure)
+			if err = i.authLimiter.failed(ip, user.Name); err != nil {
+				log.Errorf("failed to record failed TOTP login for %s: %v", user.Name, err)
+			}
+			pending.Attempts++
+			if int(pending.Attempts) >= i.totpMaxAttempts {
+				log.WithFields(log.Fields{
+					"event": "totp_attempts_exceeded",
+					"user":  user.Name,
+					"ip":    ip,
+				}).Warn("too many invalid one-time codes")
+				http.Redirect(w, r, keepLocale(r, fmt.Sprintf("%s/ui/login.html?requestId=%s&error=%s", i.basePath, url.QueryEscape(pending.RequestID),
+					url.QueryEscape("Too many invalid codes. Please log in again."))), http.StatusFound)
+				return nil
+			}
+			if err = i.savePendingLogin(id, pending); err != nil {
+				return err
+			}
+			http.Redirect(w, r, keepLocale(r, fmt.Sprintf("%s%s?requestId=%s&error=%s", i.basePath, totpPagePath, url.QueryEscape(id),
+				url.QueryEscape("Invalid code. Please try again."))), http.StatusFound)
+			return nil
+		}()
+		if err != nil {
+			i.writeError(w, r, err, http.StatusInternalServerError)
+		}
+	}
+}
+
+// checkTOTPCode validates the user's code. Each time step is only accepted once, so an observed code can't be replayed.
+func (i *IDP) checkTOTPCode(ctx context.Context, user, code string) (bool, error) {
+	secret, err := i.totpSecret(ctx, user)
+	if err != nil || secret == "" {
+		return false, err
+	}
+	step, ok := validateTOTP(secret, code, time.Now(), i.totpSkew)
+	if !ok {
+		return false, nil
+	}
+	// Adding the step is atomic, so only one of several requests with the same code succeeds
+	return store.Add(i.TempCache, fmt.Sprintf("totp-step:%s:%d", user, step), []byte{1})
+}
+
+const totpTemplate = `<!DOCTYPE html>
+<html lang="{{ .Lang }}" class="login-pf">
+<head><meta charset="UTF-8"><title>{{ .Messages.totpTitle }}</title><link href="styles-9b468590c18b8fbba512.css" rel="stylesheet"></head>
+<body>
+<div class="container"><div class="row">
+<div class="col-sm-12">{{ if .Error }}<div class="alert alert-danger"><span class="pficon pficon-error-circle-o"></span> {{ .Error }}</div>{{ end }}</div>
+<div class="col-sm-7 col-md-6 col-lg-5 login">
+<form class="form-horizontal" role="form" method="POST">
+{{ range .HiddenFields }}<input type="hidden" name="{{ .Name }}" value="{{ .Value }}">
+{{ end }}<div class="form-group">
+<label for="inputCode" class="col-sm-2 col-md-2 control-label">{{ .Messages.totpCode }}</label>
+<div class="col-sm-10 col-md-10"><input type="text" class="form-control" id="inputCode" name="code" inputmode="numeric" autocomplete="one-time-code" pattern="[0-9]{6}" maxlength="6" autofocus></div>
+</div>
+<div class="form-group"><div class="col-xs-4 col-sm-offset-8 col-sm-4 submit"><button type="submit" class="btn btn-primary btn-lg">{{ .Messages.totpSubmit }}</button></div></div>
+</form>
+</div>
+<div class="col-sm-5 col-md-6 col-lg-7 details"><p>{{ .Messages.totpInstructions }}</p></div>
+</div></div>
+</body>
+</html>`
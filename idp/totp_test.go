@@ -0,0 +1,350 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/amdonov/lite-idp/model"
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// rfc6238Secret is the SHA1 key from the RFC 6238 test vectors
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func Test_validateTOTP(t *testing.T) {
+	// The last six digits of the RFC 6238 SHA1 test vectors
+	tests := []struct {
+		seconds int64
+		code    string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+	for _, tt := range tests {
+		step, ok := validateTOTP(rfc6238Secret, tt.code, time.Unix(tt.seconds, 0), 0)
+		assert.True(t, ok, "code at %d should be valid", tt.seconds)
+		assert.Equal(t, tt.seconds/totpPeriod, step)
+	}
+	now := time.Unix(59, 0)
+	_, ok := validateTOTP(rfc6238Secret, "287082", now.Add(totpPeriod*time.Second), 0)
+	assert.False(t, ok, "codes should expire without skew")
+	_, ok = validateTOTP(rfc6238Secret, "287082", now.Add(totpPeriod*time.Second), 1)
+	assert.True(t, ok, "skew should accept the previous code")
+	_, ok = validateTOTP(strings.ToLower(rfc6238Secret), "287082", now, 0)
+	assert.True(t, ok, "secrets shouldn't be case sensitive")
+	_, ok = validateTOTP(rfc6238Secret, "28708", now, 0)
+	assert.False(t, ok)
+}
+
+func TestTOTPURL(t *testing.T) {
+	u, err := url.Parse(TOTPURL("lite-idp", "joe", rfc6238Secret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "otpauth", u.Scheme)
+	assert.Equal(t, "totp", u.Host)
+	assert.Equal(t, "/lite-idp:joe", u.Path)
+	assert.Equal(t, rfc6238Secret, u.Query().Get("secret"))
+	assert.Equal(t, "lite-idp", u.Query().Get("issuer"))
+}
+
+type totpValidator struct {
+	acceptingValidator
+}
+
+func (totpValidator) TOTPSecret(ctx context.Context, user string) (string, error) {
+	if user == "suzy" {
+		return rfc6238Secret, nil
+	}
+	return "", nil
+}
+
+func TestIDP_totpSecret(t *testing.T) {
+	i := &IDP{PasswordValidator: totpValidator{}}
+	getTestIDP(t, i).Close()
+	secret, err := i.totpSecret(context.Background(), "suzy")
+	assert.NoError(t, err)
+	assert.Equal(t, rfc6238Secret, secret, "the validator's secret should be used")
+	secret, err = i.totpSecret(context.Background(), "joe")
+	assert.NoError(t, err)
+	assert.Empty(t, secret)
+	enrolled, err := i.totpSecrets.Enroll("joe")
+	assert.NoError(t, err)
+	secret, err = i.totpSecret(context.Background(), "joe")
+	assert.NoError(t, err)
+	assert.Equal(t, enrolled, secret, "the store should be checked when the validator has no secret")
+}
+
+func TestIDP_DefaultTOTPLoginHandler(t *testing.T) {
+	viper.Set("totp-enabled", true)
+	defer viper.Set("totp-enabled", false)
+	i := &IDP{PasswordValidator: acceptingValidator{}}
+	ts := getTestIDPWithSP(t, i)
+	defer ts.Close()
+	secret, err := i.totpSecrets.Enroll("joe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := proto.Marshal(&model.AuthnRequest{
+		ID:                          "2134",
+		Issuer:                      "dex",
+		AssertionConsumerServiceURL: "http://127.0.0.1:5556/dex/callback",
+		ProtocolBinding:             artifactBinding,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.TempCache.Set("1234", data)
+	client := ts.Client()
+	client.CheckRedirect = func(r *http.Request, old []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	login := func() string {
+		resp, err := postLoginForm(client, i, ts.URL+"/ui/login.html",
+			url.Values{"requestId": {"1234"}, "username": {"joe"}, "password": {"password"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		location, err := url.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, totpPagePath, location.Path, "enrolled users should be asked for a code")
+		return location.Query().Get("requestId")
+	}
+	enterCode := func(id, code string) *http.Response {
+		resp, err := postLoginForm(client, i, ts.URL+totpPagePath, url.Values{"requestId": {id}, "code": {code}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	id := login()
+	resp, err := client.Get(ts.URL + totpPagePath + "?requestId=" + url.QueryEscape(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, doc.Find("form input[name=code]").Length())
+	_, ok := doc.Find("form input[name=csrfToken]").Attr("value")
+	assert.True(t, ok, "the form should include a CSRF token")
+
+	// Too many invalid codes start the login over
+	for n := 1; n < 3; n++ {
+		resp = enterCode(id, "000000")
+		assert.Contains(t, resp.Header.Get("Location"), totpPagePath)
+	}
+	resp = enterCode(id, "000000")
+	assert.Contains(t, resp.Header.Get("Location"), "/ui/login.html?requestId=1234")
+	_, err = i.TempCache.Get(id)
+	assert.Error(t, err, "the pending login should be discarded")
+	assert.Equal(t, float64(3), i.metrics.authentications.Value("dex", "totp", resultFailure))
+
+	key, _ := decodeTOTPSecret(secret)
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+	id = login()
+	resp = enterCode(id, code)
+	assert.Equal(t, http.StatusFound, resp.StatusCode)
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Location"), "http://127.0.0.1:5556/dex/callback"))
+	var session string
+	for _, c := range resp.Cookies() {
+		if c.Name == i.cookieName {
+			session = c.Value
+		}
+	}
+	data, err = i.UserCache.Get(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &model.User{}
+	if err = proto.Unmarshal(data, user); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, authnContextTimeSyncToken, user.Context, "the session should record the second factor")
+
+	id = login()
+	resp = enterCode(id, code)
+	assert.Contains(t, resp.Header.Get("Location"), totpPagePath, "codes can't be used twice")
+}
+
+// getTestIDPWithPendingTOTP returns an IdP with joe enrolled for TOTP and a pending login for him under id
+func getTestIDPWithPendingTOTP(t *testing.T, id string) (*IDP, *httptest.Server, []byte) {
+	viper.Set("totp-enabled", true)
+	defer viper.Set("totp-enabled", false)
+	i := &IDP{PasswordValidator: acceptingValidator{}}
+	ts := getTestIDPWithSP(t, i)
+	secret, err := i.totpSecrets.Enroll("joe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = i.savePendingLogin(id, &model.PendingLogin{
+		User: &model.User{Name: "joe"},
+		Request: &model.AuthnRequest{
+			ID:                          "2134",
+			Issuer:                      "dex",
+			AssertionConsumerServiceURL: "http://127.0.0.1:5556/dex/callback",
+			ProtocolBinding:             artifactBinding,
+		},
+		RequestID: "1234",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := decodeTOTPSecret(secret)
+	return i, ts, key
+}
+
+func TestIDP_DefaultTOTPLoginHandler_concurrent(t *testing.T) {
+	i, ts, _ := getTestIDPWithPendingTOTP(t, "pending")
+	defer ts.Close()
+	i.TempCache = slowReadCache{i.TempCache}
+	client := ts.Client()
+	client.CheckRedirect = func(r *http.Request, old []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			resp, err := postLoginForm(client, i, ts.URL+totpPagePath, url.Values{"requestId": {"pending"}, "code": {"000000"}})
+			if err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	assert.True(t, i.metrics.authentications.Value("dex", "totp", resultFailure) <= 3,
+		"concurrent guesses shouldn't get more than totp-max-attempts codes checked")
+}
+
+func TestIDP_DefaultTOTPLoginHandler_lockout(t *testing.T) {
+	i, ts, key := getTestIDPWithPendingTOTP(t, "pending")
+	defer ts.Close()
+	client := ts.Client()
+	client.CheckRedirect = func(r *http.Request, old []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	// Invalid codes count toward the lockout like invalid passwords
+	for n := 0; n < 5; n++ {
+		if err := i.authLimiter.failed("127.0.0.1", "joe"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+	resp, err := postLoginForm(client, i, ts.URL+totpPagePath, url.Values{"requestId": {"pending"}, "code": {code}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Retry-After"))
+	_, err = i.TempCache.Get("pending")
+	assert.NoError(t, err, "the pending login should be kept for when the lockout ends")
+	assert.Equal(t, float64(1), i.metrics.authentications.Value("dex", "totp", resultThrottled))
+}
+
+func TestIDP_checkTOTPCode_concurrent(t *testing.T) {
+	i, ts, key := getTestIDPWithPendingTOTP(t, "pending")
+	defer ts.Close()
+	i.TempCache = slowReadCache{i.TempCache}
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		accepted int
+	)
+	start := make(chan struct{})
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if ok, err := i.checkTOTPCode(context.Background(), "joe", code); err == nil && ok {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	assert.Equal(t, 1, accepted, "a code should only be accepted once")
+}
+
+func TestIDP_DefaultPasswordLoginHandler_totpRequired(t *testing.T) {
+	viper.Set("totp-enabled", true)
+	viper.Set("totp-required", true)
+	defer viper.Set("totp-enabled", false)
+	defer viper.Set("totp-required", false)
+	i := &IDP{PasswordValidator: acceptingValidator{}}
+	ts := getTestIDP(t, i)
+	defer ts.Close()
+	data, err := proto.Marshal(&model.AuthnRequest{ID: "2134"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.TempCache.Set("1234", data)
+	client := ts.Client()
+	client.CheckRedirect = func(r *http.Request, old []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	resp, err := postLoginForm(client, i, ts.URL+"/ui/login.html",
+		url.Values{"requestId": {"1234"}, "username": {"joe"}, "password": {"password"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Contains(t, resp.Header.Get("Location"), "/ui/login.html?requestId=1234&error=",
+		"users who aren't enrolled can't log in")
+}
+
+func TestIDP_DefaultECPHandler_totp(t *testing.T) {
+	viper.Set("totp-enabled", true)
+	defer viper.Set("totp-enabled", false)
+	i := getTestIDPWithECP(t)
+	if _, err := i.totpSecrets.Enroll("joe"); err != nil {
+		t.Fatal(err)
+	}
+	header := http.Header{}
+	header.Set("Content-Type", "text/xml")
+	header.Set("Authorization", "Basic am9lOnBhc3N3b3Jk") // joe:password
+	assert.Equal(t, http.StatusForbidden, sendECPRequest(t, i, newTestAuthnRequest(), header).Code,
+		"ECP clients can't enter a code")
+}
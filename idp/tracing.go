@@ -0,0 +1,45 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/amdonov/lite-idp/store"
+	"github.com/amdonov/lite-idp/tracing"
+)
+
+func (i *IDP) configureTracing() {
+	if i.Tracer == nil && i.settings.GetBool("tracing-enabled") {
+		i.Tracer = tracing.New(i.settings.GetString("tracing-endpoint"), i.settings.GetString("tracing-service-name"))
+	}
+}
+
+// recordBinding adds the binding a message arrived with to the request's span
+func recordBinding(r *http.Request, binding string) {
+	tracing.SpanFromContext(r.Context()).SetAttributes(
+		tracing.String("saml.binding", strings.TrimPrefix(binding, "urn:oasis:names:tc:SAML:2.0:bindings:")))
+}
+
+// tracedSet writes to a cache in a span named for the store
+func tracedSet(ctx context.Context, name string, cache store.Cache, key string, value []byte) error {
+	_, span := tracing.Start(ctx, "store.set", tracing.String("store", name))
+	defer span.End()
+	err := cache.Set(key, value)
+	span.RecordError(err)
+	return err
+}
@@ -0,0 +1,106 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSpan struct {
+	Name       string
+	Attributes []struct {
+		Key   string
+		Value struct{ StringValue string }
+	}
+}
+
+func (s testSpan) attribute(key string) string {
+	for _, attribute := range s.Attributes {
+		if attribute.Key == key {
+			return attribute.Value.StringValue
+		}
+	}
+	return ""
+}
+
+func TestIDP_tracing(t *testing.T) {
+	var mu sync.Mutex
+	spans := map[string]testSpan{}
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct{ Spans []testSpan }
+			}
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		mu.Lock()
+		defer mu.Unlock()
+		for _, resource := range req.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				for _, span := range scope.Spans {
+					spans[span.Name] = span
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+	viper.Set("tracing-enabled", true)
+	viper.Set("tracing-endpoint", collector.URL+"/v1/traces")
+	defer viper.Set("tracing-enabled", false)
+
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	loginReq := newTestAuthnRequest()
+	signature, err := i.signer.CreateSignature(loginReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginReq.Signature = signature
+	data, err := xml.Marshal(loginReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"SAMLRequest": {base64.StdEncoding.EncodeToString(data)}}
+	r := httptest.NewRequest("POST", viper.GetString("sso-service-path"), strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	i.handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusSeeOther, w.Code)
+	// Closing the IDP sends the remaining spans
+	if err = i.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	server, ok := spans["POST "+viper.GetString("sso-service-path")]
+	if assert.True(t, ok, "the request should have a span") {
+		assert.Equal(t, "dex", server.attribute("saml.sp"))
+		assert.Equal(t, "HTTP-POST", server.attribute("saml.binding"))
+	}
+	assert.Contains(t, spans, "parse_authn_request")
+	assert.Equal(t, "temp", spans["store.set"].attribute("store"), "saving the request should have a span")
+}
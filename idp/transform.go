@@ -0,0 +1,225 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/amdonov/lite-idp/model"
+)
+
+// AttributeTransform reshapes the values of an attribute from the attribute sources, or derives a new attribute from them
+type AttributeTransform struct {
+	// Attribute set to the transformed values
+	Attribute string
+	// Attribute whose values are transformed, Attribute itself if it's empty
+	Source string
+	// Functions applied to every value in order
+	Steps []TransformStep
+}
+
+// TransformStep is a function applied to the values of an attribute
+type TransformStep struct {
+	// lower, upper, scope, regex-replace, or template
+	Function string
+	// Scope appended by scope or text/template executed by template
+	Value string
+	// Regular expression replaced by regex-replace
+	Pattern string
+	// Replacement for regex-replace, which can refer to submatches like $1
+	Replacement string
+}
+
+// transformValue changes one value of an attribute for the user
+type transformValue func(value string, user *model.User) (string, error)
+
+type attributeTransform struct {
+	attribute string
+	source    string
+	steps     []transformValue
+}
+
+// attributeTransforms are applied in order, so a transform can use attributes set by earlier ones
+type attributeTransforms []attributeTransform
+
+// templateData is passed to template steps
+type templateData struct {
+	// Value being transformed
+	Value string
+	// User's login name
+	User string
+	// User's attributes, including those set by earlier transforms
+	Attributes map[string][]string
+}
+
+var templateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	// first returns the first value of an attribute or an empty string if it doesn't have one
+	"first": func(values []string) string {
+		if len(values) == 0 {
+			return ""
+		}
+		return values[0]
+	},
+}
+
+func newAttributeTransforms(transforms []AttributeTransform) (attributeTransforms, error) {
+	compiled := attributeTransforms{}
+	for _, transform := range transforms {
+		if transform.Attribute == "" {
+			return nil, errors.New("attribute transforms must name an attribute")
+		}
+		t := attributeTransform{attribute: transform.Attribute, source: transform.Source}
+		if t.source == "" {
+			t.source = t.attribute
+		}
+		for _, step := range transform.Steps {
+			f, err := newTransformValue(step)
+			if err != nil {
+				return nil, fmt.Errorf("attribute transform for %s: %v", transform.Attribute, err)
+			}
+			t.steps = append(t.steps, f)
+		}
+		compiled = append(compiled, t)
+	}
+	return compiled, nil
+}
+
+func newTransformValue(step TransformStep) (transformValue, error) {
+	switch step.Function {
+	case "lower":
+		return func(value string, _ *model.User) (string, error) {
+			return strings.ToLower(value), nil
+		}, nil
+	case "upper":
+		return func(value string, _ *model.User) (string, error) {
+			return strings.ToUpper(value), nil
+		}, nil
+	case "scope":
+		if step.Value == "" {
+			return nil, errors.New("scope requires a value")
+		}
+		scope := "@" + step.Value
+		return func(value string, _ *model.User) (string, error) {
+			// Replace any scope the value already has
+			if at := strings.LastIndex(value, "@"); at >= 0 {
+				value = value[:at]
+			}
+			return value + scope, nil
+		}, nil
+	case "regex-replace":
+		pattern, err := regexp.Compile(step.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex-replace pattern: %v", err)
+		}
+		return func(value string, _ *model.User) (string, error) {
+			return pattern.ReplaceAllString(value, step.Replacement), nil
+		}, nil
+	case "template":
+		templ, err := template.New("transform").Funcs(templateFuncs).Option("missingkey=zero").Parse(step.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template: %v", err)
+		}
+		return func(value string, user *model.User) (string, error) {
+			data := templateData{Value: value, User: user.Name, Attributes: map[string][]string{}}
+			for _, att := range user.Attributes {
+				data.Attributes[att.Name] = att.Value
+			}
+			var buf bytes.Buffer
+			if err := templ.Execute(&buf, data); err != nil {
+				return "", err
+			}
+			return buf.String(), nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown transform function %q", step.Function)
+	}
+}
+
+// apply sets the transformed attributes on the user. Transforms whose source attribute the user doesn't have are
+// skipped. Values that become empty or duplicate another value are dropped, and the attribute is removed if none remain.
+func (transforms attributeTransforms) apply(user *model.User) error {
+	for _, t := range transforms {
+		source := findAttribute(user, t.source)
+		if source == nil {
+			continue
+		}
+		values := []string{}
+		seen := map[string]bool{}
+		for _, value := range source.Value {
+			for _, step := range t.steps {
+				var err error
+				if value, err = step(value, user); err != nil {
+					return fmt.Errorf("failed to transform %s for %s: %v", t.source, t.attribute, err)
+				}
+			}
+			if value != "" && !seen[value] {
+				seen[value] = true
+				values = append(values, value)
+			}
+		}
+		setAttribute(user, t.attribute, values)
+	}
+	return nil
+}
+
+func findAttribute(user *model.User, name string) *model.Attribute {
+	for _, att := range user.Attributes {
+		if att.Name == name {
+			return att
+		}
+	}
+	return nil
+}
+
+// setAttribute replaces the values of the user's attribute, removing it if there aren't any
+func setAttribute(user *model.User, name string, values []string) {
+	atts := make([]*model.Attribute, 0, len(user.Attributes)+1)
+	set := false
+	for _, att := range user.Attributes {
+		if att.Name != name {
+			atts = append(atts, att)
+			continue
+		}
+		if len(values) > 0 && !set {
+			atts = append(atts, &model.Attribute{Name: name, Value: values})
+			set = true
+		}
+	}
+	if len(values) > 0 && !set {
+		atts = append(atts, &model.Attribute{Name: name, Value: values})
+	}
+	user.Attributes = atts
+}
+
+// configureAttributeTransforms reads the attribute-transforms applied after the attribute sources
+func (i *IDP) configureAttributeTransforms() error {
+	transforms := []AttributeTransform{}
+	if err := i.settings.UnmarshalKey("attribute-transforms", &transforms); err != nil {
+		return err
+	}
+	compiled, err := newAttributeTransforms(transforms)
+	if err != nil {
+		return err
+	}
+	i.attributeTransforms = compiled
+	return nil
+}
@@ -0,0 +1,125 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"context"
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newTransformValue(t *testing.T) {
+	user := &model.User{Name: "jsmith", Attributes: []*model.Attribute{
+		{Name: "givenName", Value: []string{"Joe"}},
+		{Name: "sn", Value: []string{"Smith"}},
+	}}
+	tests := []struct {
+		step  TransformStep
+		value string
+		want  string
+	}{
+		{TransformStep{Function: "lower"}, "JSmith", "jsmith"},
+		{TransformStep{Function: "upper"}, "jsmith", "JSMITH"},
+		{TransformStep{Function: "scope", Value: "example.edu"}, "jsmith", "jsmith@example.edu"},
+		{TransformStep{Function: "scope", Value: "example.edu"}, "jsmith@EXAMPLE.local", "jsmith@example.edu"},
+		{TransformStep{Function: "regex-replace", Pattern: "^[^@]*@", Replacement: ""}, "joe@example.com", "example.com"},
+		{TransformStep{Function: "regex-replace", Pattern: "^CN=([^,]+),.*$", Replacement: "$1"}, "CN=staff,OU=Groups,DC=example,DC=com", "staff"},
+		{TransformStep{Function: "template", Value: `{{first .Attributes.givenName}} {{first .Attributes.sn}}`}, "", "Joe Smith"},
+		{TransformStep{Function: "template", Value: `{{.Value}}-{{lower .User}}{{first .Attributes.missing}}`}, "member", "member-jsmith"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.step.Function, func(t *testing.T) {
+			f, err := newTransformValue(tt.step)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := f(tt.value, user)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	for _, step := range []TransformStep{
+		{Function: "titlecase"},
+		{Function: "scope"},
+		{Function: "regex-replace", Pattern: "("},
+		{Function: "template", Value: "{{.Value"},
+	} {
+		_, err := newTransformValue(step)
+		assert.Error(t, err, step.Function)
+	}
+}
+
+func Test_attributeTransforms_apply(t *testing.T) {
+	transforms, err := newAttributeTransforms([]AttributeTransform{
+		{Attribute: "uid", Steps: []TransformStep{{Function: "lower"}}},
+		{Attribute: "eduPersonPrincipalName", Source: "uid", Steps: []TransformStep{{Function: "scope", Value: "example.edu"}}},
+		{Attribute: "groups", Source: "memberOf", Steps: []TransformStep{
+			{Function: "regex-replace", Pattern: "^CN=app-([^,]+),.*$|^CN=.*$", Replacement: "$1"},
+		}},
+		{Attribute: "domain", Source: "mail", Steps: []TransformStep{{Function: "regex-replace", Pattern: "^.*@"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := &model.User{Name: "JSmith", Attributes: []*model.Attribute{
+		{Name: "uid", Value: []string{"JSmith"}},
+		{Name: "memberOf", Value: []string{"CN=app-users,DC=example", "CN=domain-admins,DC=example", "CN=app-users,DC=other"}},
+		{Name: "groups", Value: []string{"stale"}},
+	}}
+	assert.NoError(t, transforms.apply(user))
+	assert.Equal(t, []*model.Attribute{
+		{Name: "uid", Value: []string{"jsmith"}},
+		{Name: "memberOf", Value: []string{"CN=app-users,DC=example", "CN=domain-admins,DC=example", "CN=app-users,DC=other"}},
+		{Name: "groups", Value: []string{"users"}},
+		{Name: "eduPersonPrincipalName", Value: []string{"jsmith@example.edu"}},
+	}, user.Attributes, "transforms should compose, replace targets, and drop empty and duplicate values")
+
+	transforms, _ = newAttributeTransforms([]AttributeTransform{
+		{Attribute: "memberOf", Steps: []TransformStep{{Function: "regex-replace", Pattern: ".*"}}},
+	})
+	assert.NoError(t, transforms.apply(user))
+	assert.Nil(t, findAttribute(user, "memberOf"), "attributes without values should be removed")
+
+	_, err = newAttributeTransforms([]AttributeTransform{{Source: "uid"}})
+	assert.Error(t, err)
+}
+
+func TestIDP_setUserAttributes_transforms(t *testing.T) {
+	viper.Set("attribute-transforms", []map[string]interface{}{{
+		"attribute": "eduPersonPrincipalName",
+		"source":    "uid",
+		"steps": []map[string]interface{}{
+			{"function": "lower"},
+			{"function": "scope", "value": "example.edu"},
+		},
+	}})
+	defer viper.Set("attribute-transforms", nil)
+	i := &IDP{}
+	getTestIDP(t, i).Close()
+	i.AttributeSources = []AttributeSource{&simpleSource{users: map[string][]*model.Attribute{
+		"joe": {{Name: "uid", Value: []string{"Joe"}}},
+	}}}
+	user := &model.User{Name: "joe"}
+	assert.NoError(t, i.setUserAttributes(context.Background(), user, nil))
+	assert.Equal(t, []string{"joe@example.edu"}, findAttribute(user, "eduPersonPrincipalName").Value)
+
+	viper.Set("attribute-transforms", []map[string]interface{}{{"attribute": "uid", "steps": []map[string]interface{}{{"function": "reverse"}}}})
+	_, err := (&IDP{}).Handler()
+	assert.Error(t, err)
+}
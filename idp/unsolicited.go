@@ -0,0 +1,88 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/golang/protobuf/ptypes"
+	"github.com/google/uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// unsolicitedBinding marks saved requests that the IdP started itself rather than receiving an AuthnRequest
+const unsolicitedBinding = "urn:lite-idp:bindings:Unsolicited"
+
+// DefaultUnsolicitedSSOHandler is the default implementation for the IdP-initiated SSO handler. It logs the user in
+// and sends the service provider named by the sp parameter a response that isn't InResponseTo any request. It can be
+// used as is, wrapped in other handlers, or replaced completely.
+func (i *IDP) DefaultUnsolicitedSSOHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := func() error {
+			if err := r.ParseForm(); err != nil {
+				return err
+			}
+			entityID := r.Form.Get("sp")
+			relayState := r.Form.Get("relayState")
+			if len(relayState) > maxRelayStateLength {
+				return fmt.Errorf("RelayState cannot be longer than %d bytes", maxRelayStateLength)
+			}
+			req, err := i.unsolicitedRequest(entityID, relayState)
+			if err != nil {
+				return err
+			}
+			log.Infof("starting unsolicited login for %s", entityID)
+			recordServiceProvider(r, entityID)
+			recordBinding(r, "Unsolicited")
+			i.metrics.authnRequests.Inc(entityID, "Unsolicited")
+			return i.authenticate(req, w, r)
+		}()
+		if err != nil {
+			i.writeError(w, r, err, ssoErrorStatus(err))
+		}
+	}
+}
+
+// unsolicitedRequest stands in for the AuthnRequest the service provider didn't send. It has no ID, so the response
+// isn't InResponseTo anything. The response is posted to the default assertion consumer service for the POST binding
+// or sent to the default service if the service provider doesn't accept posts. The service provider's
+// DefaultRelayState is sent if relayState is empty.
+func (i *IDP) unsolicitedRequest(entityID, relayState string) (*model.AuthnRequest, error) {
+	sp, ok := i.sps.get(entityID)
+	if !ok {
+		return nil, &UnknownServiceProviderError{entityID}
+	}
+	acs, err := sp.assertionConsumerService(&saml.AuthnRequest{ProtocolBinding: postBinding})
+	if err != nil {
+		if acs, err = sp.assertionConsumerService(&saml.AuthnRequest{}); err != nil {
+			return nil, err
+		}
+	}
+	if relayState == "" {
+		relayState = sp.DefaultRelayState
+	}
+	return &model.AuthnRequest{
+		IssueInstant:                ptypes.TimestampNow(),
+		Issuer:                      sp.EntityID,
+		AssertionConsumerServiceURL: acs.Location,
+		ProtocolBinding:             acs.Binding,
+		RequestBinding:              unsolicitedBinding,
+		RelayState:                  relayState,
+		CorrelationID:               uuid.New().String(),
+	}, nil
+}
@@ -0,0 +1,117 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package idp
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/amdonov/lite-idp/model"
+	"github.com/golang/protobuf/proto"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDP_DefaultUnsolicitedSSOHandler(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.sps.get("dex")
+	sps := []ServiceProvider{*dex}
+	sps[0].AssertionConsumerServices = append(sps[0].AssertionConsumerServices, AssertionConsumerService{
+		Index:    1,
+		Binding:  postBinding,
+		Location: "https://dex.example.com/post",
+	})
+	viper.Set("sps", sps)
+	defer viper.Set("sps", nil)
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+
+	w := httptest.NewRecorder()
+	i.UnsolicitedSSOHandler(w, httptest.NewRequest("GET", "/SAML2/Unsolicited/SSO?sp=unknown", nil))
+	assert.Equal(t, http.StatusForbidden, w.Code, "only trusted service providers should get responses")
+
+	w = httptest.NewRecorder()
+	i.UnsolicitedSSOHandler(w, httptest.NewRequest("GET", "/SAML2/Unsolicited/SSO?sp=dex&relayState=portal", nil))
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code, "expected redirect to login page")
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/ui/login.html", location.Path)
+	saved, err := i.TempCache.Get(location.Query().Get("requestId"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &model.AuthnRequest{}
+	if err = proto.Unmarshal(saved, req); err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, req.ID)
+	assert.Equal(t, postBinding, req.ProtocolBinding, "responses should be posted when the service provider accepts them")
+	assert.Equal(t, "https://dex.example.com/post", req.AssertionConsumerServiceURL)
+	assert.Equal(t, "portal", req.RelayState)
+}
+
+func TestIDP_unsolicitedRequest(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	req, err := i.unsolicitedRequest("dex", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, artifactBinding, req.ProtocolBinding, "the default service should be used without a POST service")
+	response, err := i.makeAuthnResponse(req, &model.User{Name: "joe", Format: "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := xml.Marshal(response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotContains(t, string(data), "InResponseTo", "unsolicited responses aren't in response to anything")
+}
+
+func TestIDP_unsolicitedRequest_defaultRelayState(t *testing.T) {
+	i := &IDP{}
+	getTestIDPWithSP(t, i).Close()
+	dex, _ := i.sps.get("dex")
+	sps := []ServiceProvider{*dex}
+	sps[0].DefaultRelayState = "/dashboard"
+	viper.Set("sps", sps)
+	defer viper.Set("sps", nil)
+	i = &IDP{}
+	getTestIDP(t, i).Close()
+
+	req, err := i.unsolicitedRequest("dex", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/dashboard", req.RelayState)
+	req, err = i.unsolicitedRequest("dex", "/reports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "/reports", req.RelayState, "the link's relayState takes precedence")
+
+	sps[0].DefaultRelayState = strings.Repeat("a", maxRelayStateLength+1)
+	viper.Set("sps", sps)
+	_, err = (&IDP{}).Handler()
+	assert.Error(t, err)
+}
@@ -0,0 +1,243 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package krb5 implements the Kerberos messages and encryption types needed to accept AP-REQs
+// (RFC 4120) with the AES encryption types of RFC 3961 and RFC 3962. Only the acceptor side is
+// implemented, so there's no KDC exchange, credential cache, or client support, and the encryption is
+// checked against the RFC test vectors. Like the ldap package's BER codec, it stays within the standard
+// library rather than vendoring a full Kerberos client such as gokrb5 and its dependencies.
+package krb5
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Encryption types from RFC 3962
+const (
+	AES128CTSHMACSHA196 = 17
+	AES256CTSHMACSHA196 = 18
+)
+
+// Key usage numbers from RFC 4120
+const (
+	UsageTicket             = 2
+	UsageAPReqAuthenticator = 11
+	UsageAPRepEncPart       = 12
+)
+
+// macSize is the length of the truncated HMAC-SHA1 checksum
+const macSize = 12
+
+// ErrIntegrity is returned when the checksum of a decrypted message doesn't match, usually because the wrong key was used
+var ErrIntegrity = errors.New("krb5: integrity check failed")
+
+// KeySize returns the length of keys for the encryption type, or false if it isn't supported
+func KeySize(etype int32) (int, bool) {
+	switch etype {
+	case AES128CTSHMACSHA196:
+		return 16, true
+	case AES256CTSHMACSHA196:
+		return 32, true
+	}
+	return 0, false
+}
+
+// Encrypt encrypts the plaintext with a random confounder and appends its checksum as described in RFC 3961
+func Encrypt(etype int32, key []byte, usage uint32, plaintext []byte) ([]byte, error) {
+	ke, ki, err := usageKeys(etype, key, usage)
+	if err != nil {
+		return nil, err
+	}
+	p := make([]byte, aes.BlockSize, aes.BlockSize+len(plaintext))
+	if _, err := rand.Read(p); err != nil {
+		return nil, err
+	}
+	p = append(p, plaintext...)
+	c, err := ctsEncrypt(ke, p)
+	if err != nil {
+		return nil, err
+	}
+	return append(c, checksum(ki, p)...), nil
+}
+
+// Decrypt checks and decrypts a message encrypted by Encrypt
+func Decrypt(etype int32, key []byte, usage uint32, ciphertext []byte) ([]byte, error) {
+	ke, ki, err := usageKeys(etype, key, usage)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aes.BlockSize+macSize {
+		return nil, errors.New("krb5: ciphertext is too short")
+	}
+	c, mac := ciphertext[:len(ciphertext)-macSize], ciphertext[len(ciphertext)-macSize:]
+	p, err := ctsDecrypt(ke, c)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal(checksum(ki, p), mac) {
+		return nil, ErrIntegrity
+	}
+	return p[aes.BlockSize:], nil
+}
+
+func checksum(key, data []byte) []byte {
+	h := hmac.New(sha1.New, key)
+	h.Write(data)
+	return h.Sum(nil)[:macSize]
+}
+
+// usageKeys derives the encryption and integrity keys for the key usage
+func usageKeys(etype int32, key []byte, usage uint32) ([]byte, []byte, error) {
+	size, ok := KeySize(etype)
+	if !ok {
+		return nil, nil, fmt.Errorf("krb5: unsupported encryption type %d", etype)
+	}
+	if len(key) != size {
+		return nil, nil, fmt.Errorf("krb5: encryption type %d needs a %d byte key, not %d", etype, size, len(key))
+	}
+	constant := make([]byte, 5)
+	binary.BigEndian.PutUint32(constant, usage)
+	constant[4] = 0xAA
+	ke := deriveKey(key, constant)
+	constant[4] = 0x55
+	ki := deriveKey(key, constant)
+	return ke, ki, nil
+}
+
+// deriveKey is DK from RFC 3961 with the identity random-to-key function of RFC 3962
+func deriveKey(key, constant []byte) []byte {
+	block, _ := aes.NewCipher(key)
+	in := nfold(constant, aes.BlockSize)
+	out := make([]byte, 0, len(key)+aes.BlockSize)
+	for len(out) < len(key) {
+		next := make([]byte, aes.BlockSize)
+		block.Encrypt(next, in)
+		out = append(out, next...)
+		in = next
+	}
+	return out[:len(key)]
+}
+
+// nfold stretches or folds the input to size bytes as described in RFC 3961
+func nfold(in []byte, size int) []byte {
+	inBits, outBits := len(in)*8, size*8
+	a, b := inBits, outBits
+	for b != 0 {
+		a, b = b, a%b
+	}
+	lcm := inBits * outBits / a
+	// Concatenate copies of the input, each rotated 13 bits further right
+	buf := make([]byte, 0, lcm/8)
+	for n := 0; n < lcm/inBits; n++ {
+		buf = append(buf, rotateRight(in, 13*n)...)
+	}
+	// Add the blocks with ones' complement addition
+	out := make([]byte, size)
+	for n := 0; n < len(buf); n += size {
+		carry := 0
+		for i := size - 1; i >= 0; i-- {
+			sum := int(out[i]) + int(buf[n+i]) + carry
+			out[i], carry = byte(sum), sum>>8
+		}
+		for i := size - 1; carry != 0; i = (i + size - 1) % size {
+			sum := int(out[i]) + carry
+			out[i], carry = byte(sum), sum>>8
+		}
+	}
+	return out
+}
+
+func rotateRight(in []byte, bits int) []byte {
+	size := len(in) * 8
+	bits %= size
+	out := make([]byte, len(in))
+	for i := 0; i < size; i++ {
+		from := (i - bits + size) % size
+		if in[from/8]&(0x80>>uint(from%8)) != 0 {
+			out[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return out
+}
+
+// ctsEncrypt is AES in CBC mode with ciphertext stealing and a zero IV as described in RFC 3962
+func ctsEncrypt(key, p []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(p) < aes.BlockSize {
+		return nil, errors.New("krb5: plaintext is shorter than a block")
+	}
+	blocks := (len(p) + aes.BlockSize - 1) / aes.BlockSize
+	padded := make([]byte, blocks*aes.BlockSize)
+	copy(padded, p)
+	cipher.NewCBCEncrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(padded, padded)
+	if blocks == 1 {
+		return padded, nil
+	}
+	// Swap the last two blocks and drop the padding from what was the second to last
+	last := len(p) - (blocks-1)*aes.BlockSize
+	c := make([]byte, 0, len(p))
+	c = append(c, padded[:(blocks-2)*aes.BlockSize]...)
+	c = append(c, padded[(blocks-1)*aes.BlockSize:]...)
+	c = append(c, padded[(blocks-2)*aes.BlockSize:(blocks-2)*aes.BlockSize+last]...)
+	return c, nil
+}
+
+// ctsDecrypt reverses ctsEncrypt
+func ctsDecrypt(key, c []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(c) < aes.BlockSize {
+		return nil, errors.New("krb5: ciphertext is shorter than a block")
+	}
+	iv := make([]byte, aes.BlockSize)
+	if len(c) == aes.BlockSize {
+		p := make([]byte, aes.BlockSize)
+		block.Decrypt(p, c)
+		return p, nil
+	}
+	blocks := (len(c) + aes.BlockSize - 1) / aes.BlockSize
+	last := len(c) - (blocks-1)*aes.BlockSize
+	head := c[:(blocks-2)*aes.BlockSize]
+	p := make([]byte, len(c))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(p[:len(head)], head)
+	prev := iv
+	if len(head) > 0 {
+		prev = head[len(head)-aes.BlockSize:]
+	}
+	// The final block decrypts to the last plaintext XORed with the full second to last block, whose
+	// missing bytes are the tail of the result
+	d := make([]byte, aes.BlockSize)
+	block.Decrypt(d, c[len(head):len(head)+aes.BlockSize])
+	secondToLast := append(append([]byte{}, c[len(head)+aes.BlockSize:]...), d[last:]...)
+	for i := 0; i < last; i++ {
+		p[len(head)+aes.BlockSize+i] = d[i] ^ secondToLast[i]
+	}
+	block.Decrypt(p[len(head):len(head)+aes.BlockSize], secondToLast)
+	for i := 0; i < aes.BlockSize; i++ {
+		p[len(head)+i] ^= prev[i]
+	}
+	return p, nil
+}
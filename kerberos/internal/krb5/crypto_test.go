@@ -0,0 +1,118 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package krb5
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Test vectors from RFC 3961 appendix A.1
+func Test_nfold(t *testing.T) {
+	tests := []struct {
+		in   string
+		bits int
+		want string
+	}{
+		{"012345", 64, "be072631276b1955"},
+		{"password", 56, "78a07b6caf85fa"},
+		{"Rough Consensus, and Running Code", 64, "bb6ed30870b7f0e0"},
+		{"password", 168, "59e4a8ca7c0385c3c37b3f6d2000247cb6e6bd5b3e"},
+		{"MASSACHVSETTS INSTITVTE OF TECHNOLOGY", 192, "db3b0d8f0b061e603282b308a50841229ad798fab9540c1b"},
+		{"Q", 168, "518a54a215a8452a518a54a215a8452a518a54a215"},
+		{"ba", 168, "fb25d531ae8974499f52fd92ea9857c4ba24cf297e"},
+		{"kerberos", 64, "6b65726265726f73"},
+		{"kerberos", 128, "6b65726265726f737b9b5b2b93132b93"},
+		{"kerberos", 168, "8372c236344e5f1550cd0747e15d62ca7a5a3bcea4"},
+		{"kerberos", 256, "6b65726265726f737b9b5b2b93132b935c9bdcdad95c9899c4cae4dee6d6cae4"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, hex.EncodeToString(nfold([]byte(tt.in), tt.bits/8)), "%d-fold(%q)", tt.bits, tt.in)
+	}
+}
+
+// Test vectors from RFC 3962 appendix B
+func Test_cts(t *testing.T) {
+	key, _ := hex.DecodeString("636869636b656e207465726979616b69")
+	tests := []struct{ in, want string }{
+		{"4920776f756c64206c696b652074686520",
+			"c6353568f2bf8cb4d8a580362da7ff7f97"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320",
+			"fc00783e0efdb2c1d445d4c8eff7ed2297687268d6ecccc0c07b25e25ecfe5"},
+		{"4920776f756c64206c696b65207468652047656e6572616c2047617527732043",
+			"39312523a78662d5be7fcbcc98ebf5a897687268d6ecccc0c07b25e25ecfe584"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320436869636b656e2c20706c656173652c",
+			"97687268d6ecccc0c07b25e25ecfe584b3fffd940c16a18c1b5549d2f838029e39312523a78662d5be7fcbcc98ebf5"},
+		{"4920776f756c64206c696b65207468652047656e6572616c20476175277320436869636b656e2c20706c656173652c20",
+			"97687268d6ecccc0c07b25e25ecfe5849dad8bbb96c4cdc03bc103e1a194bbd839312523a78662d5be7fcbcc98ebf5a8"},
+	}
+	for _, tt := range tests {
+		in, _ := hex.DecodeString(tt.in)
+		c, err := ctsEncrypt(key, in)
+		if assert.NoError(t, err) {
+			assert.Equal(t, tt.want, hex.EncodeToString(c), "%d bytes", len(in))
+		}
+		p, err := ctsDecrypt(key, c)
+		if assert.NoError(t, err) {
+			assert.Equal(t, tt.in, hex.EncodeToString(p))
+		}
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	for _, etype := range []int32{AES128CTSHMACSHA196, AES256CTSHMACSHA196} {
+		size, _ := KeySize(etype)
+		key := make([]byte, size)
+		for _, message := range []string{"", "short", "exactly sixteen!", "a message that spans several blocks of AES"} {
+			c, err := Encrypt(etype, key, UsageTicket, []byte(message))
+			if !assert.NoError(t, err) {
+				continue
+			}
+			p, err := Decrypt(etype, key, UsageTicket, c)
+			if assert.NoError(t, err) {
+				assert.Equal(t, message, string(p))
+			}
+			_, err = Decrypt(etype, key, UsageAPReqAuthenticator, c)
+			assert.Equal(t, ErrIntegrity, err, "the key usage should be part of the key")
+		}
+	}
+	_, err := Encrypt(AES256CTSHMACSHA196, make([]byte, 16), UsageTicket, nil)
+	assert.Error(t, err, "keys must match the encryption type")
+	_, err = Encrypt(23, make([]byte, 16), UsageTicket, nil)
+	assert.Error(t, err, "RC4 isn't supported")
+	_, err = Decrypt(AES128CTSHMACSHA196, make([]byte, 16), UsageTicket, make([]byte, 20))
+	assert.Error(t, err)
+}
+
+// string-to-key test vectors from RFC 3962 appendix B check the key derivation from the PBKDF2 output
+func Test_deriveKey(t *testing.T) {
+	tests := []struct {
+		tkey string
+		want string
+	}{
+		{"cdedb5281bb2f801565a1122b2563515", "42263c6e89f4fc28b8df68ee09799f15"},
+		{"cdedb5281bb2f801565a1122b25635150ad1f7a04bb9f3a333ecc0e2e1f70837",
+			"fe697b52bc0d3ce14432ba036a92e65bbb52280990a2fa27883998d72af30161"},
+	}
+	for _, tt := range tests {
+		tkey, err := hex.DecodeString(tt.tkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, tt.want, hex.EncodeToString(deriveKey(tkey, []byte("kerberos"))))
+	}
+}
@@ -0,0 +1,216 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package krb5
+
+import (
+	"encoding/asn1"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Message types and the APPLICATION tags of the structures from RFC 4120
+const (
+	tagTicket        = 1
+	tagAuthenticator = 2
+	tagEncTicketPart = 3
+	tagEncAPRepPart  = 27
+
+	MsgTypeAPReq = 14
+	MsgTypeAPRep = 15
+)
+
+// NameTypePrincipal is the name type of user principals
+const NameTypePrincipal = 1
+
+// APOptionMutualRequired is the bit set in AP options when the client wants an AP-REP
+const APOptionMutualRequired = 2
+
+// PrincipalName is a client or service name without the realm
+type PrincipalName struct {
+	NameType   int32    `asn1:"explicit,tag:0"`
+	NameString []string `asn1:"explicit,tag:1"`
+}
+
+// NewPrincipalName splits a name such as HTTP/www.example.com into its components
+func NewPrincipalName(nameType int32, name string) PrincipalName {
+	return PrincipalName{NameType: nameType, NameString: strings.Split(name, "/")}
+}
+
+func (p PrincipalName) String() string {
+	return strings.Join(p.NameString, "/")
+}
+
+// Equal compares the components of the names. The name types are only hints.
+func (p PrincipalName) Equal(other PrincipalName) bool {
+	return p.String() == other.String()
+}
+
+// EncryptedData holds a message encrypted with Encrypt
+type EncryptedData struct {
+	EType  int32  `asn1:"explicit,tag:0"`
+	KVNO   int    `asn1:"optional,explicit,tag:1"`
+	Cipher []byte `asn1:"explicit,tag:2"`
+}
+
+// EncryptionKey is a key such as the session key in a ticket
+type EncryptionKey struct {
+	KeyType  int32  `asn1:"explicit,tag:0"`
+	KeyValue []byte `asn1:"explicit,tag:1"`
+}
+
+// TransitedEncoding lists the realms a cross-realm ticket passed through
+type TransitedEncoding struct {
+	TRType   int32  `asn1:"explicit,tag:0"`
+	Contents []byte `asn1:"explicit,tag:1"`
+}
+
+// APReq is the message a client sends a service to authenticate. encoding/asn1 keeps the explicit tag of raw
+// values, so the encoded Ticket is in the Bytes of the Ticket field.
+type APReq struct {
+	PVNO          int            `asn1:"explicit,tag:0"`
+	MsgType       int            `asn1:"explicit,tag:1"`
+	APOptions     asn1.BitString `asn1:"explicit,tag:2"`
+	Ticket        asn1.RawValue  `asn1:"explicit,tag:3"`
+	Authenticator EncryptedData  `asn1:"explicit,tag:4"`
+}
+
+// Ticket is issued by the KDC for a service and encrypted with the service's key
+type Ticket struct {
+	TktVNO  int           `asn1:"explicit,tag:0"`
+	Realm   string        `asn1:"explicit,tag:1"`
+	SName   PrincipalName `asn1:"explicit,tag:2"`
+	EncPart EncryptedData `asn1:"explicit,tag:3"`
+}
+
+// EncTicketPart is the encrypted part of a ticket
+type EncTicketPart struct {
+	Flags             asn1.BitString    `asn1:"explicit,tag:0"`
+	Key               EncryptionKey     `asn1:"explicit,tag:1"`
+	CRealm            string            `asn1:"explicit,tag:2"`
+	CName             PrincipalName     `asn1:"explicit,tag:3"`
+	Transited         TransitedEncoding `asn1:"explicit,tag:4"`
+	AuthTime          time.Time         `asn1:"generalized,explicit,tag:5"`
+	StartTime         time.Time         `asn1:"generalized,optional,explicit,tag:6"`
+	EndTime           time.Time         `asn1:"generalized,explicit,tag:7"`
+	RenewTill         time.Time         `asn1:"generalized,optional,explicit,tag:8"`
+	CAddr             asn1.RawValue     `asn1:"optional,explicit,tag:9"`
+	AuthorizationData asn1.RawValue     `asn1:"optional,explicit,tag:10"`
+}
+
+// TicketFlagInvalid marks postdated tickets that haven't been validated by the KDC
+const TicketFlagInvalid = 7
+
+// Authenticator proves that the client holds the ticket's session key
+type Authenticator struct {
+	AVNO              int           `asn1:"explicit,tag:0"`
+	CRealm            string        `asn1:"explicit,tag:1"`
+	CName             PrincipalName `asn1:"explicit,tag:2"`
+	Cksum             asn1.RawValue `asn1:"optional,explicit,tag:3"`
+	Cusec             int           `asn1:"explicit,tag:4"`
+	CTime             time.Time     `asn1:"generalized,explicit,tag:5"`
+	SubKey            asn1.RawValue `asn1:"optional,explicit,tag:6"`
+	SeqNumber         int64         `asn1:"optional,explicit,tag:7"`
+	AuthorizationData asn1.RawValue `asn1:"optional,explicit,tag:8"`
+}
+
+// APRep is the reply to an AP-REQ that asked for mutual authentication
+type APRep struct {
+	PVNO    int           `asn1:"explicit,tag:0"`
+	MsgType int           `asn1:"explicit,tag:1"`
+	EncPart EncryptedData `asn1:"explicit,tag:2"`
+}
+
+// EncAPRepPart is the encrypted part of an AP-REP
+type EncAPRepPart struct {
+	CTime     time.Time `asn1:"generalized,explicit,tag:0"`
+	Cusec     int       `asn1:"explicit,tag:1"`
+	SeqNumber int64     `asn1:"optional,explicit,tag:3"`
+}
+
+// Marshal encodes the AP-REQ with its APPLICATION tag
+func (m *APReq) Marshal() ([]byte, error) {
+	return asn1.MarshalWithParams(*m, applicationTag(MsgTypeAPReq))
+}
+
+// Unmarshal decodes an AP-REQ
+func (m *APReq) Unmarshal(b []byte) error {
+	return unmarshal(b, m, MsgTypeAPReq)
+}
+
+// Marshal encodes the ticket with its APPLICATION tag
+func (m *Ticket) Marshal() ([]byte, error) {
+	return asn1.MarshalWithParams(*m, applicationTag(tagTicket))
+}
+
+// Unmarshal decodes a ticket
+func (m *Ticket) Unmarshal(b []byte) error {
+	return unmarshal(b, m, tagTicket)
+}
+
+// Marshal encodes the encrypted part of a ticket with its APPLICATION tag
+func (m *EncTicketPart) Marshal() ([]byte, error) {
+	return asn1.MarshalWithParams(*m, applicationTag(tagEncTicketPart))
+}
+
+// Unmarshal decodes the encrypted part of a ticket
+func (m *EncTicketPart) Unmarshal(b []byte) error {
+	return unmarshal(b, m, tagEncTicketPart)
+}
+
+// Marshal encodes the authenticator with its APPLICATION tag
+func (m *Authenticator) Marshal() ([]byte, error) {
+	return asn1.MarshalWithParams(*m, applicationTag(tagAuthenticator))
+}
+
+// Unmarshal decodes an authenticator
+func (m *Authenticator) Unmarshal(b []byte) error {
+	return unmarshal(b, m, tagAuthenticator)
+}
+
+// Marshal encodes the AP-REP with its APPLICATION tag
+func (m *APRep) Marshal() ([]byte, error) {
+	return asn1.MarshalWithParams(*m, applicationTag(MsgTypeAPRep))
+}
+
+// Unmarshal decodes an AP-REP
+func (m *APRep) Unmarshal(b []byte) error {
+	return unmarshal(b, m, MsgTypeAPRep)
+}
+
+// Marshal encodes the encrypted part of an AP-REP with its APPLICATION tag
+func (m *EncAPRepPart) Marshal() ([]byte, error) {
+	return asn1.MarshalWithParams(*m, applicationTag(tagEncAPRepPart))
+}
+
+// Unmarshal decodes the encrypted part of an AP-REP
+func (m *EncAPRepPart) Unmarshal(b []byte) error {
+	return unmarshal(b, m, tagEncAPRepPart)
+}
+
+func applicationTag(tag int) string {
+	return fmt.Sprintf("application,explicit,tag:%d", tag)
+}
+
+func unmarshal(b []byte, v interface{}, tag int) error {
+	rest, err := asn1.UnmarshalWithParams(b, v, applicationTag(tag))
+	if err != nil {
+		return err
+	}
+	if len(rest) > 0 {
+		return fmt.Errorf("krb5: %d bytes of trailing data", len(rest))
+	}
+	return nil
+}
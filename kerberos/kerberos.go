@@ -0,0 +1,231 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kerberos accepts Kerberos tickets sent by browsers with SPNEGO (HTTP Negotiate authentication). Tickets
+// must use AES encryption, the default for Active Directory and MIT Kerberos.
+package kerberos
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amdonov/lite-idp/kerberos/internal/krb5"
+)
+
+// Principal is an authenticated client
+type Principal struct {
+	// Name is the principal without the realm, such as jdoe
+	Name  string
+	Realm string
+}
+
+func (p Principal) String() string {
+	return p.Name + "@" + p.Realm
+}
+
+// ReplayCache remembers authenticators so a captured token can't be used again. Add reports whether the ID was
+// new. Authenticators are only accepted within the clock skew, so IDs need to be kept for twice the skew.
+type ReplayCache interface {
+	Add(id string) (bool, error)
+}
+
+// Acceptor validates the tickets clients present to a service
+type Acceptor struct {
+	keytab  *Keytab
+	service string
+	skew    time.Duration
+	replays ReplayCache
+}
+
+// NewAcceptor returns an Acceptor for tickets to the service, such as HTTP/idp.example.com@EXAMPLE.COM, with a
+// key in the keytab. Tickets for any principal in the keytab are accepted if service is empty. Authenticators
+// more than skew from the current time are rejected. Replays are tracked in memory unless the replay cache is set.
+func NewAcceptor(keytab *Keytab, service string, skew time.Duration, replays ReplayCache) (*Acceptor, error) {
+	if len(keytab.entries) == 0 {
+		return nil, errors.New("kerberos: the keytab is empty")
+	}
+	if service != "" && !containsString(keytab.Principals(), service) {
+		return nil, fmt.Errorf("kerberos: the keytab doesn't have a key for %s, it has %s",
+			service, strings.Join(keytab.Principals(), ", "))
+	}
+	if replays == nil {
+		replays = newMemoryReplayCache(2 * skew)
+	}
+	return &Acceptor{
+		keytab:  keytab,
+		service: service,
+		skew:    skew,
+		replays: replays,
+	}, nil
+}
+
+// Accept validates the GSS-API token from an Authorization: Negotiate header. It returns the client and the
+// token for the WWW-Authenticate header of the response, which includes an AP-REP if the client asked for
+// mutual authentication.
+func (a *Acceptor) Accept(token []byte) (*Principal, []byte, error) {
+	initial, err := readInitialToken(token)
+	if err != nil {
+		return nil, nil, err
+	}
+	apReq := &krb5.APReq{}
+	if err = apReq.Unmarshal(initial.apReq); err != nil {
+		return nil, nil, fmt.Errorf("kerberos: invalid AP-REQ: %v", err)
+	}
+	if apReq.PVNO != 5 || apReq.MsgType != krb5.MsgTypeAPReq {
+		return nil, nil, errors.New("kerberos: invalid AP-REQ")
+	}
+	ticket := &krb5.Ticket{}
+	if err = ticket.Unmarshal(apReq.Ticket.Bytes); err != nil {
+		return nil, nil, fmt.Errorf("kerberos: invalid ticket: %v", err)
+	}
+	service := ticket.SName.String() + "@" + ticket.Realm
+	if a.service != "" && service != a.service {
+		return nil, nil, fmt.Errorf("kerberos: ticket is for %s, not %s", service, a.service)
+	}
+	key, ok := a.keytab.key(service, ticket.EncPart.EType, uint32(ticket.EncPart.KVNO))
+	if !ok {
+		return nil, nil, fmt.Errorf("kerberos: no key for %s with encryption type %d and version %d",
+			service, ticket.EncPart.EType, ticket.EncPart.KVNO)
+	}
+	data, err := krb5.Decrypt(ticket.EncPart.EType, key, krb5.UsageTicket, ticket.EncPart.Cipher)
+	if err != nil {
+		return nil, nil, fmt.Errorf("kerberos: failed to decrypt ticket for %s: %v", service, err)
+	}
+	encTicket := &krb5.EncTicketPart{}
+	if err = encTicket.Unmarshal(data); err != nil {
+		return nil, nil, fmt.Errorf("kerberos: invalid ticket: %v", err)
+	}
+	principal := &Principal{Name: encTicket.CName.String(), Realm: encTicket.CRealm}
+	if err = a.checkTicket(encTicket); err != nil {
+		return nil, nil, fmt.Errorf("kerberos: ticket for %s: %v", principal, err)
+	}
+
+	// The authenticator shows the client knows the session key and keeps the ticket from being replayed
+	sessionKey := encTicket.Key
+	data, err = krb5.Decrypt(apReq.Authenticator.EType, sessionKey.KeyValue, krb5.UsageAPReqAuthenticator,
+		apReq.Authenticator.Cipher)
+	if err != nil {
+		return nil, nil, fmt.Errorf("kerberos: failed to decrypt authenticator from %s: %v", principal, err)
+	}
+	authenticator := &krb5.Authenticator{}
+	if err = authenticator.Unmarshal(data); err != nil {
+		return nil, nil, fmt.Errorf("kerberos: invalid authenticator from %s: %v", principal, err)
+	}
+	if authenticator.CRealm != encTicket.CRealm || !authenticator.CName.Equal(encTicket.CName) {
+		return nil, nil, fmt.Errorf("kerberos: authenticator from %s@%s doesn't match ticket for %s",
+			authenticator.CName, authenticator.CRealm, principal)
+	}
+	if skew := time.Now().Sub(authenticator.CTime); skew > a.skew || skew < -a.skew {
+		return nil, nil, fmt.Errorf("kerberos: authenticator from %s is %s from the current time", principal, skew)
+	}
+	added, err := a.replays.Add(fmt.Sprintf("%s %s %d %d", principal, service,
+		authenticator.CTime.Unix(), authenticator.Cusec))
+	if err != nil {
+		return nil, nil, err
+	}
+	if !added {
+		return nil, nil, fmt.Errorf("kerberos: authenticator from %s has already been used", principal)
+	}
+
+	response, err := a.response(initial, apReq, authenticator, sessionKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return principal, response, nil
+}
+
+// checkTicket ensures the ticket is currently valid
+func (a *Acceptor) checkTicket(ticket *krb5.EncTicketPart) error {
+	if ticket.Flags.At(krb5.TicketFlagInvalid) == 1 {
+		return errors.New("postdated ticket hasn't been validated")
+	}
+	now := time.Now()
+	start := ticket.StartTime
+	if start.IsZero() {
+		start = ticket.AuthTime
+	}
+	if now.Add(a.skew).Before(start) {
+		return fmt.Errorf("not valid until %s", start)
+	}
+	if now.Add(-a.skew).After(ticket.EndTime) {
+		return fmt.Errorf("expired %s", ticket.EndTime)
+	}
+	return nil
+}
+
+// response returns the token sent back to the client. SPNEGO clients get a negTokenResp accepting the context.
+func (a *Acceptor) response(initial *initialToken, apReq *krb5.APReq, authenticator *krb5.Authenticator,
+	sessionKey krb5.EncryptionKey) ([]byte, error) {
+	var apRep []byte
+	if apReq.APOptions.At(krb5.APOptionMutualRequired) == 1 {
+		part, err := (&krb5.EncAPRepPart{
+			CTime:     authenticator.CTime,
+			Cusec:     authenticator.Cusec,
+			SeqNumber: authenticator.SeqNumber,
+		}).Marshal()
+		if err != nil {
+			return nil, err
+		}
+		cipher, err := krb5.Encrypt(sessionKey.KeyType, sessionKey.KeyValue, krb5.UsageAPRepEncPart, part)
+		if err != nil {
+			return nil, err
+		}
+		message, err := (&krb5.APRep{
+			PVNO:    5,
+			MsgType: krb5.MsgTypeAPRep,
+			EncPart: krb5.EncryptedData{EType: sessionKey.KeyType, Cipher: cipher},
+		}).Marshal()
+		if err != nil {
+			return nil, err
+		}
+		if apRep, err = writeKRB5Token(oidKRB5, tokenIDAPRep, message); err != nil {
+			return nil, err
+		}
+	}
+	if !initial.spnego {
+		// Kerberos tokens are answered with the AP-REP alone
+		return apRep, nil
+	}
+	return writeNegTokenResp(initial.mech, apRep)
+}
+
+// memoryReplayCache remembers authenticators for a single instance
+type memoryReplayCache struct {
+	ttl  time.Duration
+	mu   sync.Mutex
+	seen map[string]time.Time
+}
+
+func newMemoryReplayCache(ttl time.Duration) *memoryReplayCache {
+	return &memoryReplayCache{ttl: ttl, seen: map[string]time.Time{}}
+}
+
+func (c *memoryReplayCache) Add(id string) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for seen, expires := range c.seen {
+		if now.After(expires) {
+			delete(c.seen, seen)
+		}
+	}
+	if _, ok := c.seen[id]; ok {
+		return false, nil
+	}
+	c.seen[id] = now.Add(c.ttl)
+	return true, nil
+}
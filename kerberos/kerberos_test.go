@@ -0,0 +1,137 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kerberos_test
+
+import (
+	"encoding/asn1"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/kerberos"
+	"github.com/amdonov/lite-idp/kerberos/internal/krb5"
+	"github.com/amdonov/lite-idp/kerberos/kerberostest"
+	"github.com/stretchr/testify/assert"
+)
+
+const service = "HTTP/idp.example.com@EXAMPLE.COM"
+
+func newAcceptor(t *testing.T, kdc *kerberostest.KDC, service string) *kerberos.Acceptor {
+	acceptor, err := kerberos.NewAcceptor(kdc.Keytab(), service, 3*time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acceptor
+}
+
+func TestAcceptor_Accept(t *testing.T) {
+	kdc := kerberostest.NewKDC(service)
+	acceptor := newAcceptor(t, kdc, service)
+
+	token := kdc.Token(kerberostest.Ticket{Client: "jdoe"})
+	principal, response, err := acceptor.Accept(token)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "jdoe@EXAMPLE.COM", principal.String())
+		assert.Equal(t, "jdoe", principal.Name)
+		assert.Equal(t, []byte{0xa1, 0x14, 0x30, 0x12, 0xa0, 0x03, 0x0a, 0x01, 0x00, 0xa1, 0x0b, 0x06, 0x09,
+			0x2a, 0x86, 0x48, 0x86, 0xf7, 0x12, 0x01, 0x02, 0x02}, response,
+			"SPNEGO clients should get accept-completed without a token unless they ask for mutual authentication")
+	}
+	_, _, err = acceptor.Accept(token)
+	assert.Error(t, err, "tokens can't be replayed")
+
+	principal, response, err = newAcceptor(t, kdc, "").Accept(kdc.Token(kerberostest.Ticket{Client: "admin/ops"}))
+	if assert.NoError(t, err, "tickets for any service in the keytab should be accepted without a service") {
+		assert.Equal(t, "admin/ops@EXAMPLE.COM", principal.String())
+	}
+}
+
+func TestAcceptor_Accept_mutual(t *testing.T) {
+	kdc := kerberostest.NewKDC(service)
+	acceptor := newAcceptor(t, kdc, service)
+
+	_, response, err := acceptor.Accept(kdc.Token(kerberostest.Ticket{Client: "jdoe", Mutual: true}))
+	if !assert.NoError(t, err) {
+		return
+	}
+	var resp struct {
+		NegState      asn1.Enumerated       `asn1:"explicit,tag:0"`
+		SupportedMech asn1.ObjectIdentifier `asn1:"explicit,tag:1"`
+		ResponseToken []byte                `asn1:"optional,explicit,tag:2"`
+	}
+	if _, err = asn1.UnmarshalWithParams(response, &resp, "explicit,tag:1"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, asn1.Enumerated(0), resp.NegState)
+	apRep := &krb5.APRep{}
+	// Skip the GSS-API header, the OID, and the token ID
+	assert.NoError(t, apRep.Unmarshal(resp.ResponseToken[15:]), "the response token should be an AP-REP")
+
+	_, response, err = acceptor.Accept(kdc.Token(kerberostest.Ticket{Client: "jdoe", Mutual: true, Kerberos: true}))
+	if assert.NoError(t, err, "Kerberos tokens without SPNEGO should be accepted") {
+		assert.NoError(t, apRep.Unmarshal(response[15:]), "the response should be an AP-REP without SPNEGO")
+	}
+}
+
+func TestAcceptor_Accept_invalid(t *testing.T) {
+	kdc := kerberostest.NewKDC(service)
+	acceptor := newAcceptor(t, kdc, service)
+	now := time.Now()
+	tests := []struct {
+		name  string
+		token []byte
+	}{
+		{"other key", kerberostest.NewKDC(service).Token(kerberostest.Ticket{Client: "jdoe"})},
+		{"other service", kerberostest.NewKDC("HTTP/www.example.com@EXAMPLE.COM").Token(kerberostest.Ticket{Client: "jdoe"})},
+		{"expired", kdc.Token(kerberostest.Ticket{Client: "jdoe", Issued: now.Add(-11 * time.Hour)})},
+		{"not yet valid", kdc.Token(kerberostest.Ticket{Client: "jdoe", Issued: now.Add(time.Hour)})},
+		{"old authenticator", kdc.Token(kerberostest.Ticket{Client: "jdoe", Sent: now.Add(-5 * time.Minute)})},
+		{"NTLM", []byte("NTLMSSP\x00\x01\x00\x00\x00")},
+		{"garbage", []byte("garbage")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, _, err := acceptor.Accept(tt.token)
+			assert.Error(t, err)
+			assert.Nil(t, principal)
+		})
+	}
+	_, _, err := acceptor.Accept([]byte("NTLMSSP\x00\x01\x00\x00\x00"))
+	assert.Equal(t, kerberos.ErrUnsupportedMechanism, err)
+}
+
+func TestNewAcceptor(t *testing.T) {
+	kdc := kerberostest.NewKDC(service)
+	_, err := kerberos.NewAcceptor(kdc.Keytab(), "HTTP/www.example.com@EXAMPLE.COM", time.Minute, nil)
+	assert.Error(t, err, "the keytab must have a key for the service")
+	_, err = kerberos.NewAcceptor(&kerberos.Keytab{}, "", time.Minute, nil)
+	assert.Error(t, err, "the keytab can't be empty")
+}
+
+func TestReadKeytab(t *testing.T) {
+	keytab := &kerberos.Keytab{}
+	keytab.AddKey(service, 3, krb5.AES256CTSHMACSHA196, make([]byte, 32))
+	keytab.AddKey("host/idp.example.com@EXAMPLE.COM", 300, krb5.AES128CTSHMACSHA196, make([]byte, 16))
+	read, err := kerberos.ReadKeytab(keytab.Marshal())
+	if assert.NoError(t, err) {
+		assert.Equal(t, []string{service, "host/idp.example.com@EXAMPLE.COM"}, read.Principals())
+	}
+	data := keytab.Marshal()
+	_, err = kerberos.ReadKeytab(data[:len(data)-10])
+	assert.Error(t, err, "truncated keytabs should be rejected")
+	_, err = kerberos.ReadKeytab([]byte{0x05, 0x01})
+	assert.Error(t, err, "only version 2 keytabs are supported")
+	_, err = kerberos.LoadKeytab("missing.keytab")
+	assert.Error(t, err)
+}
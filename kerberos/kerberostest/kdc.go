@@ -0,0 +1,200 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package kerberostest issues Kerberos tickets for testing SPNEGO logins without a KDC
+package kerberostest
+
+import (
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/base64"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/amdonov/lite-idp/kerberos"
+	"github.com/amdonov/lite-idp/kerberos/internal/krb5"
+)
+
+var (
+	oidSPNEGO = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 2}
+	oidKRB5   = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+)
+
+// KDC issues tickets for a single service with a random AES-256 key
+type KDC struct {
+	// Service is the principal tickets are issued for, such as HTTP/idp.example.com@EXAMPLE.COM
+	Service string
+	// Realm of the service and clients
+	Realm string
+	key   []byte
+	kvno  uint32
+}
+
+// Ticket describes a ticket and the authenticator sent with it. Zero values are replaced by defaults.
+type Ticket struct {
+	// Client is the name of the user without the realm
+	Client string
+	// Issued is when the user logged in, now by default
+	Issued time.Time
+	// Lifetime of the ticket, ten hours by default
+	Lifetime time.Duration
+	// Sent is the time in the authenticator, now by default
+	Sent time.Time
+	// Kerberos sends a Kerberos token instead of wrapping it in SPNEGO
+	Kerberos bool
+	// Mutual asks the service for an AP-REP
+	Mutual bool
+}
+
+// NewKDC returns a KDC for the service
+func NewKDC(service string) *KDC {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic("kerberostest: failed to generate key: " + err.Error())
+	}
+	realm := ""
+	if at := strings.LastIndex(service, "@"); at >= 0 {
+		realm = service[at+1:]
+	}
+	return &KDC{Service: service, Realm: realm, key: key, kvno: 1}
+}
+
+// Keytab returns a keytab with the service's key
+func (k *KDC) Keytab() *kerberos.Keytab {
+	keytab := &kerberos.Keytab{}
+	keytab.AddKey(k.Service, k.kvno, krb5.AES256CTSHMACSHA196, k.key)
+	return keytab
+}
+
+// WriteKeytab saves the keytab to a file
+func (k *KDC) WriteKeytab(path string) error {
+	return ioutil.WriteFile(path, k.Keytab().Marshal(), 0600)
+}
+
+// Negotiate returns the Authorization header of a browser presenting a new ticket for the client
+func (k *KDC) Negotiate(client string) string {
+	return "Negotiate " + base64.StdEncoding.EncodeToString(k.Token(Ticket{Client: client, Mutual: true}))
+}
+
+// Token returns the GSS-API token for the ticket
+func (k *KDC) Token(t Ticket) []byte {
+	now := time.Now().UTC().Truncate(time.Second)
+	if t.Issued.IsZero() {
+		t.Issued = now
+	}
+	if t.Lifetime == 0 {
+		t.Lifetime = 10 * time.Hour
+	}
+	if t.Sent.IsZero() {
+		// Authenticators are told apart by their microseconds
+		t.Sent = time.Now()
+	}
+	sessionKey := make([]byte, 32)
+	if _, err := rand.Read(sessionKey); err != nil {
+		panic("kerberostest: failed to generate key: " + err.Error())
+	}
+	cname := krb5.NewPrincipalName(krb5.NameTypePrincipal, t.Client)
+	encTicket, err := (&krb5.EncTicketPart{
+		Flags:     asn1.BitString{Bytes: []byte{0x40, 0x81, 0, 0}, BitLength: 32},
+		Key:       krb5.EncryptionKey{KeyType: krb5.AES256CTSHMACSHA196, KeyValue: sessionKey},
+		CRealm:    k.Realm,
+		CName:     cname,
+		Transited: krb5.TransitedEncoding{TRType: 1, Contents: []byte{}},
+		AuthTime:  t.Issued.UTC(),
+		EndTime:   t.Issued.Add(t.Lifetime).UTC(),
+	}).Marshal()
+	if err != nil {
+		panic(err)
+	}
+	service, realm := k.Service, ""
+	if at := strings.LastIndex(service, "@"); at >= 0 {
+		service, realm = service[:at], service[at+1:]
+	}
+	ticket, err := (&krb5.Ticket{
+		TktVNO: 5,
+		Realm:  realm,
+		SName:  krb5.NewPrincipalName(2, service),
+		EncPart: krb5.EncryptedData{
+			EType:  krb5.AES256CTSHMACSHA196,
+			KVNO:   int(k.kvno),
+			Cipher: encrypt(k.key, krb5.UsageTicket, encTicket),
+		},
+	}).Marshal()
+	if err != nil {
+		panic(err)
+	}
+	authenticator, err := (&krb5.Authenticator{
+		AVNO:      5,
+		CRealm:    k.Realm,
+		CName:     cname,
+		Cusec:     t.Sent.Nanosecond() / 1000,
+		CTime:     t.Sent.UTC().Truncate(time.Second),
+		SeqNumber: 1,
+	}).Marshal()
+	if err != nil {
+		panic(err)
+	}
+	options := asn1.BitString{Bytes: []byte{0, 0, 0, 0}, BitLength: 32}
+	if t.Mutual {
+		options.Bytes[0] |= 0x80 >> krb5.APOptionMutualRequired
+	}
+	apReq, err := (&krb5.APReq{
+		PVNO:      5,
+		MsgType:   krb5.MsgTypeAPReq,
+		APOptions: options,
+		Ticket:    asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: ticket},
+		Authenticator: krb5.EncryptedData{
+			EType:  krb5.AES256CTSHMACSHA196,
+			Cipher: encrypt(sessionKey, krb5.UsageAPReqAuthenticator, authenticator),
+		},
+	}).Marshal()
+	if err != nil {
+		panic(err)
+	}
+	token := gssToken(oidKRB5, append([]byte{0x01, 0x00}, apReq...))
+	if t.Kerberos {
+		return token
+	}
+	init, err := asn1.MarshalWithParams(struct {
+		MechTypes []asn1.ObjectIdentifier `asn1:"explicit,tag:0"`
+		MechToken []byte                  `asn1:"explicit,tag:2"`
+	}{[]asn1.ObjectIdentifier{oidKRB5}, token}, "explicit,tag:0")
+	if err != nil {
+		panic(err)
+	}
+	return gssToken(oidSPNEGO, init)
+}
+
+func encrypt(key []byte, usage uint32, plaintext []byte) []byte {
+	c, err := krb5.Encrypt(krb5.AES256CTSHMACSHA196, key, usage, plaintext)
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// gssToken wraps the inner token in a GSS-API initial context token for the mechanism
+func gssToken(mech asn1.ObjectIdentifier, inner []byte) []byte {
+	oid, err := asn1.Marshal(mech)
+	if err != nil {
+		panic(err)
+	}
+	token, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true,
+		Bytes: append(oid, inner...)})
+	if err != nil {
+		panic(err)
+	}
+	return token
+}
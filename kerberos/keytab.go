@@ -0,0 +1,234 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kerberos
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// keytabVersion is the only keytab format in use, version 2 with big-endian integers
+const keytabVersion = 0x0502
+
+// Keytab holds the keys of service principals, as exported by kadmin or ktpass
+type Keytab struct {
+	entries []keytabEntry
+}
+
+type keytabEntry struct {
+	principal string
+	nameType  uint32
+	timestamp time.Time
+	kvno      uint32
+	etype     int32
+	key       []byte
+}
+
+// LoadKeytab reads a keytab file
+func LoadKeytab(path string) (*Keytab, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keytab, err := ReadKeytab(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return keytab, nil
+}
+
+// ReadKeytab parses the contents of a keytab file
+func ReadKeytab(data []byte) (*Keytab, error) {
+	if len(data) < 2 || binary.BigEndian.Uint16(data) != keytabVersion {
+		return nil, errors.New("not a version 2 keytab")
+	}
+	keytab := &Keytab{}
+	r := &keytabReader{data: data[2:]}
+	for len(r.data) > 0 {
+		size := int32(r.uint32())
+		if r.err != nil {
+			return nil, r.err
+		}
+		if size < 0 {
+			// A hole left by a deleted entry
+			r.bytes(int(-size))
+			continue
+		}
+		entry := &keytabReader{data: r.bytes(int(size))}
+		if r.err != nil {
+			return nil, r.err
+		}
+		keytab.entries = append(keytab.entries, entry.entry())
+		if entry.err != nil {
+			return nil, entry.err
+		}
+	}
+	return keytab, r.err
+}
+
+// AddKey adds a key for the principal, such as HTTP/idp.example.com@EXAMPLE.COM
+func (k *Keytab) AddKey(principal string, kvno uint32, etype int32, key []byte) {
+	k.entries = append(k.entries, keytabEntry{
+		principal: principal,
+		nameType:  1,
+		timestamp: time.Now(),
+		kvno:      kvno,
+		etype:     etype,
+		key:       append([]byte{}, key...),
+	})
+}
+
+// Marshal returns the keytab in the format read by ReadKeytab
+func (k *Keytab) Marshal() []byte {
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, uint16(keytabVersion))
+	for _, entry := range k.entries {
+		var e bytes.Buffer
+		name, realm := splitPrincipal(entry.principal)
+		components := strings.Split(name, "/")
+		binary.Write(&e, binary.BigEndian, uint16(len(components)))
+		writeCounted(&e, realm)
+		for _, component := range components {
+			writeCounted(&e, component)
+		}
+		binary.Write(&e, binary.BigEndian, entry.nameType)
+		binary.Write(&e, binary.BigEndian, uint32(entry.timestamp.Unix()))
+		e.WriteByte(byte(entry.kvno))
+		binary.Write(&e, binary.BigEndian, uint16(entry.etype))
+		writeCounted(&e, string(entry.key))
+		binary.Write(&e, binary.BigEndian, entry.kvno)
+		binary.Write(&b, binary.BigEndian, int32(e.Len()))
+		b.Write(e.Bytes())
+	}
+	return b.Bytes()
+}
+
+// Principals returns the principals with keys in the keytab
+func (k *Keytab) Principals() []string {
+	principals := []string{}
+	for _, entry := range k.entries {
+		if !containsString(principals, entry.principal) {
+			principals = append(principals, entry.principal)
+		}
+	}
+	return principals
+}
+
+// key returns the principal's key for the encryption type. The key with the highest version is used when the
+// ticket doesn't give one.
+func (k *Keytab) key(principal string, etype int32, kvno uint32) ([]byte, bool) {
+	var found *keytabEntry
+	for n, entry := range k.entries {
+		if entry.principal != principal || entry.etype != etype {
+			continue
+		}
+		if kvno != 0 && entry.kvno != kvno {
+			continue
+		}
+		if found == nil || entry.kvno > found.kvno {
+			found = &k.entries[n]
+		}
+	}
+	if found == nil {
+		return nil, false
+	}
+	return found.key, true
+}
+
+type keytabReader struct {
+	data []byte
+	err  error
+}
+
+func (r *keytabReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = errors.New("keytab entry is truncated")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *keytabReader) uint16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *keytabReader) uint32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *keytabReader) counted() string {
+	return string(r.bytes(int(r.uint16())))
+}
+
+func (r *keytabReader) entry() keytabEntry {
+	components := make([]string, r.uint16())
+	realm := r.counted()
+	for n := range components {
+		components[n] = r.counted()
+	}
+	entry := keytabEntry{principal: strings.Join(components, "/") + "@" + realm}
+	entry.nameType = r.uint32()
+	entry.timestamp = time.Unix(int64(r.uint32()), 0)
+	if b := r.bytes(1); b != nil {
+		entry.kvno = uint32(b[0])
+	}
+	entry.etype = int32(r.uint16())
+	entry.key = []byte(r.counted())
+	// Newer keytabs follow the key with the full 32-bit version number
+	if len(r.data) >= 4 {
+		if kvno := r.uint32(); kvno != 0 {
+			entry.kvno = kvno
+		}
+	}
+	return entry
+}
+
+func writeCounted(b *bytes.Buffer, s string) {
+	binary.Write(b, binary.BigEndian, uint16(len(s)))
+	b.WriteString(s)
+}
+
+// splitPrincipal separates the name of a principal such as HTTP/idp.example.com@EXAMPLE.COM from its realm
+func splitPrincipal(principal string) (string, string) {
+	if at := strings.LastIndex(principal, "@"); at >= 0 {
+		return principal[:at], principal[at+1:]
+	}
+	return principal, ""
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,160 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kerberos
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+// Mechanism OIDs. Windows offers Kerberos under its own OID as well as the standard one.
+var (
+	oidSPNEGO  = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 2}
+	oidKRB5    = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+	oidMSKRB5  = asn1.ObjectIdentifier{1, 2, 840, 48018, 1, 2, 2}
+	oidNTLMSSP = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 2, 2, 10}
+)
+
+// Token IDs of Kerberos GSS-API tokens from RFC 4121
+var (
+	tokenIDAPReq = []byte{0x01, 0x00}
+	tokenIDAPRep = []byte{0x02, 0x00}
+)
+
+// negStateAcceptCompleted tells the client the context is established
+const negStateAcceptCompleted = 0
+
+// negTokenInit is the first token of an SPNEGO exchange from RFC 4178
+type negTokenInit struct {
+	MechTypes   []asn1.ObjectIdentifier `asn1:"explicit,tag:0"`
+	ReqFlags    asn1.BitString          `asn1:"optional,explicit,tag:1"`
+	MechToken   []byte                  `asn1:"optional,explicit,tag:2"`
+	MechListMIC []byte                  `asn1:"optional,explicit,tag:3"`
+}
+
+// negTokenResp answers a negTokenInit
+type negTokenResp struct {
+	NegState      asn1.Enumerated       `asn1:"explicit,tag:0"`
+	SupportedMech asn1.ObjectIdentifier `asn1:"explicit,tag:1"`
+	ResponseToken []byte                `asn1:"optional,explicit,tag:2"`
+}
+
+// ErrUnsupportedMechanism is returned for tokens that don't use Kerberos, such as NTLM tokens sent by clients
+// outside the domain
+var ErrUnsupportedMechanism = errors.New("kerberos: the client didn't offer Kerberos")
+
+// initialToken is the first token a client sends
+type initialToken struct {
+	// spnego is set if the Kerberos token was wrapped in a negTokenInit
+	spnego bool
+	// mech is the Kerberos mechanism OID the client used
+	mech  asn1.ObjectIdentifier
+	apReq []byte
+}
+
+// readInitialToken reads the AP-REQ from a GSS-API initial context token, which may be an SPNEGO negTokenInit or
+// a Kerberos token
+func readInitialToken(token []byte) (*initialToken, error) {
+	mech, inner, err := readGSSToken(token)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case mech.Equal(oidKRB5):
+		apReq, err := readKRB5Token(inner, tokenIDAPReq)
+		if err != nil {
+			return nil, err
+		}
+		return &initialToken{mech: mech, apReq: apReq}, nil
+	case mech.Equal(oidSPNEGO):
+		init := negTokenInit{}
+		rest, err := asn1.UnmarshalWithParams(inner, &init, "explicit,tag:0")
+		if err != nil {
+			return nil, fmt.Errorf("kerberos: invalid negTokenInit: %v", err)
+		}
+		if len(rest) > 0 {
+			return nil, errors.New("kerberos: trailing data after negTokenInit")
+		}
+		// The optimistic token is for the client's preferred mechanism
+		if len(init.MechTypes) == 0 || len(init.MechToken) == 0 ||
+			!(init.MechTypes[0].Equal(oidKRB5) || init.MechTypes[0].Equal(oidMSKRB5)) {
+			return nil, ErrUnsupportedMechanism
+		}
+		krb5Mech, krb5Token, err := readGSSToken(init.MechToken)
+		if err != nil {
+			return nil, err
+		}
+		if !krb5Mech.Equal(oidKRB5) && !krb5Mech.Equal(oidMSKRB5) {
+			return nil, ErrUnsupportedMechanism
+		}
+		apReq, err := readKRB5Token(krb5Token, tokenIDAPReq)
+		if err != nil {
+			return nil, err
+		}
+		return &initialToken{spnego: true, mech: init.MechTypes[0], apReq: apReq}, nil
+	case mech.Equal(oidNTLMSSP):
+		return nil, ErrUnsupportedMechanism
+	}
+	return nil, fmt.Errorf("kerberos: unknown mechanism %s", mech)
+}
+
+// readGSSToken reads the mechanism OID and inner token of a GSS-API initial context token from RFC 2743
+func readGSSToken(token []byte) (asn1.ObjectIdentifier, []byte, error) {
+	var outer asn1.RawValue
+	rest, err := asn1.Unmarshal(token, &outer)
+	if err != nil {
+		if len(token) >= 8 && string(token[:8]) == "NTLMSSP\x00" {
+			return nil, nil, ErrUnsupportedMechanism
+		}
+		return nil, nil, fmt.Errorf("kerberos: invalid GSS-API token: %v", err)
+	}
+	if outer.Class != asn1.ClassApplication || outer.Tag != 0 || !outer.IsCompound || len(rest) > 0 {
+		return nil, nil, errors.New("kerberos: invalid GSS-API token")
+	}
+	var mech asn1.ObjectIdentifier
+	inner, err := asn1.Unmarshal(outer.Bytes, &mech)
+	if err != nil {
+		return nil, nil, fmt.Errorf("kerberos: invalid GSS-API mechanism: %v", err)
+	}
+	return mech, inner, nil
+}
+
+// readKRB5Token checks the token ID of a Kerberos GSS-API token and returns the message following it
+func readKRB5Token(token, tokenID []byte) ([]byte, error) {
+	if len(token) < 2 || token[0] != tokenID[0] || token[1] != tokenID[1] {
+		return nil, errors.New("kerberos: unexpected Kerberos token")
+	}
+	return token[2:], nil
+}
+
+// writeKRB5Token wraps a Kerberos message in a GSS-API token
+func writeKRB5Token(mech asn1.ObjectIdentifier, tokenID, message []byte) ([]byte, error) {
+	oid, err := asn1.Marshal(mech)
+	if err != nil {
+		return nil, err
+	}
+	inner := append(append(oid, tokenID...), message...)
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassApplication, Tag: 0, IsCompound: true, Bytes: inner})
+}
+
+// writeNegTokenResp returns an SPNEGO response accepting the context with the mechanism and optional AP-REP token
+func writeNegTokenResp(mech asn1.ObjectIdentifier, responseToken []byte) ([]byte, error) {
+	return asn1.MarshalWithParams(negTokenResp{
+		NegState:      negStateAcceptCompleted,
+		SupportedMech: mech,
+		ResponseToken: responseToken,
+	}, "explicit,tag:1")
+}
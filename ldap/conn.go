@@ -0,0 +1,425 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ldap is a small LDAP v3 client supporting simple binds, searches, StartTLS and LDAPS
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/amdonov/lite-idp/ldap/internal/ber"
+)
+
+// Result codes from RFC 4511
+const (
+	ResultSuccess            = 0
+	ResultNoSuchObject       = 32
+	ResultInvalidCredentials = 49
+	ResultBusy               = 51
+	ResultUnavailable        = 52
+)
+
+// Protocol operation tags
+const (
+	opBindRequest        = 0
+	opBindResponse       = 1
+	opUnbindRequest      = 2
+	opSearchRequest      = 3
+	opSearchEntry        = 4
+	opSearchDone         = 5
+	opSearchReference    = 19
+	opExtendedRequest    = 23
+	opExtendedResponse   = 24
+	startTLSOID          = "1.3.6.1.4.1.1466.20037"
+	defaultPort          = "389"
+	defaultTLSPort       = "636"
+	derefAliasesNever    = 0
+	protocolVersion      = 3
+	simpleAuthentication = 0
+)
+
+// Search scopes
+const (
+	ScopeBaseObject   = 0
+	ScopeSingleLevel  = 1
+	ScopeWholeSubtree = 2
+)
+
+var (
+	// ErrConnectionClosed is returned when the server sends a notice of disconnection
+	ErrConnectionClosed = errors.New("ldap server terminated the connection")
+	// ErrConnectionBroken is returned for requests on a connection that an earlier error left unusable
+	ErrConnectionBroken = errors.New("ldap connection is no longer usable")
+)
+
+// Error is an LDAP result other than success
+type Error struct {
+	ResultCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("ldap result code %d", e.ResultCode)
+	}
+	return fmt.Sprintf("ldap result code %d: %s", e.ResultCode, e.Message)
+}
+
+// IsInvalidCredentials reports whether the server rejected the credentials in a bind
+func IsInvalidCredentials(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.ResultCode == ResultInvalidCredentials
+}
+
+// IsTransient reports whether err is a network failure or a busy or unavailable server, which may not happen again
+// on a new connection
+func IsTransient(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.ResultCode == ResultBusy || e.ResultCode == ResultUnavailable
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, ErrConnectionClosed) || errors.Is(err, ErrConnectionBroken)
+}
+
+// Config holds the settings used to connect to a directory server
+type Config struct {
+	// URL of the server such as ldap://ldap.example.com or ldaps://ldap.example.com
+	URL string
+	// StartTLS upgrades ldap:// connections before any credentials are sent
+	StartTLS bool
+	// TLSConfig is used for LDAPS and StartTLS. The server name is taken from the URL if not set.
+	TLSConfig *tls.Config
+	// Timeout applies to dialing and each request
+	Timeout time.Duration
+}
+
+// Conn is a connection to a directory server. It is not safe for concurrent use.
+type Conn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	timeout time.Duration
+	msgID   int64
+	// set after a network or protocol error leaves the connection unusable
+	broken bool
+}
+
+// SearchRequest describes a search of the directory
+type SearchRequest struct {
+	BaseDN     string
+	Scope      int
+	Filter     string
+	Attributes []string
+	SizeLimit  int
+}
+
+// Entry is a single search result
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Values returns the values of the named attribute. Attribute names are not case sensitive.
+func (e *Entry) Values(name string) []string {
+	for k, v := range e.Attributes {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+// Dial connects to the server named in the configuration
+func Dial(config *Config) (*Conn, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host, port = u.Host, ""
+	}
+	tlsConfig := &tls.Config{}
+	if config.TLSConfig != nil {
+		tlsConfig = config.TLSConfig.Clone()
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = host
+	}
+	dialer := &net.Dialer{Timeout: config.Timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = defaultPort
+		}
+		conn, err = dialer.Dial("tcp", net.JoinHostPort(host, port))
+	case "ldaps":
+		if port == "" {
+			port = defaultTLSPort
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), tlsConfig)
+	default:
+		return nil, fmt.Errorf("unsupported ldap URL scheme %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{conn: conn, reader: bufio.NewReader(conn), timeout: config.Timeout}
+	if config.StartTLS && u.Scheme == "ldap" {
+		if err = c.startTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Bind performs a simple bind. Empty passwords are rejected because most servers treat them
+// as unauthenticated binds that always succeed.
+func (c *Conn) Bind(dn, password string) error {
+	if password == "" {
+		return &Error{ResultCode: ResultInvalidCredentials, Message: "empty password"}
+	}
+	resp, err := c.request(ber.New(ber.ClassApplication, opBindRequest, true).Add(
+		ber.NewInteger(ber.ClassUniversal, ber.TagInteger, protocolVersion),
+		ber.NewString(ber.ClassUniversal, ber.TagOctetString, dn),
+		ber.NewString(ber.ClassContext, simpleAuthentication, password),
+	), opBindResponse)
+	if err != nil {
+		return err
+	}
+	return c.result(resp)
+}
+
+// AnonymousBind resets the connection to an anonymous identity
+func (c *Conn) AnonymousBind() error {
+	resp, err := c.request(ber.New(ber.ClassApplication, opBindRequest, true).Add(
+		ber.NewInteger(ber.ClassUniversal, ber.TagInteger, protocolVersion),
+		ber.NewString(ber.ClassUniversal, ber.TagOctetString, ""),
+		ber.NewString(ber.ClassContext, simpleAuthentication, ""),
+	), opBindResponse)
+	if err != nil {
+		return err
+	}
+	return c.result(resp)
+}
+
+// Search returns the entries matching the request
+func (c *Conn) Search(req *SearchRequest) ([]*Entry, error) {
+	filter, err := compileFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	attributes := ber.NewSequence()
+	for _, a := range req.Attributes {
+		attributes.Add(ber.NewString(ber.ClassUniversal, ber.TagOctetString, a))
+	}
+	id, err := c.send(ber.New(ber.ClassApplication, opSearchRequest, true).Add(
+		ber.NewString(ber.ClassUniversal, ber.TagOctetString, req.BaseDN),
+		ber.NewInteger(ber.ClassUniversal, ber.TagEnumerated, int64(req.Scope)),
+		ber.NewInteger(ber.ClassUniversal, ber.TagEnumerated, derefAliasesNever),
+		ber.NewInteger(ber.ClassUniversal, ber.TagInteger, int64(req.SizeLimit)),
+		ber.NewInteger(ber.ClassUniversal, ber.TagInteger, int64(c.timeout/time.Second)),
+		ber.NewBoolean(false),
+		filter,
+		attributes,
+	))
+	if err != nil {
+		return nil, err
+	}
+	entries := []*Entry{}
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case op.Is(ber.ClassApplication, opSearchEntry):
+			entry, err := parseEntry(op)
+			if err != nil {
+				c.broken = true
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case op.Is(ber.ClassApplication, opSearchReference):
+			// Referrals are not followed
+		case op.Is(ber.ClassApplication, opSearchDone):
+			return entries, c.result(op)
+		default:
+			c.broken = true
+			return nil, errors.New("unexpected response to search request")
+		}
+	}
+}
+
+// Close sends an unbind request and closes the connection
+func (c *Conn) Close() error {
+	if !c.broken {
+		c.send(ber.New(ber.ClassApplication, opUnbindRequest, false))
+	}
+	return c.conn.Close()
+}
+
+// Broken reports whether an earlier error left the connection unusable
+func (c *Conn) Broken() bool {
+	return c.broken
+}
+
+// Alive checks that an idle connection is still open. Connections that the server closed or sent a notice of
+// disconnection on are marked broken.
+func (c *Conn) Alive() bool {
+	if c.broken {
+		return false
+	}
+	c.conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	_, err := c.reader.Peek(1)
+	c.conn.SetReadDeadline(time.Time{})
+	var netErr net.Error
+	if err != nil && errors.As(err, &netErr) && netErr.Timeout() {
+		// Nothing to read, so the server hasn't hung up
+		return true
+	}
+	// Idle connections shouldn't have anything to read
+	c.broken = true
+	return false
+}
+
+func (c *Conn) startTLS(config *tls.Config) error {
+	resp, err := c.request(ber.New(ber.ClassApplication, opExtendedRequest, true).Add(
+		ber.NewString(ber.ClassContext, 0, startTLSOID),
+	), opExtendedResponse)
+	if err != nil {
+		return err
+	}
+	if err = c.result(resp); err != nil {
+		return err
+	}
+	tlsConn := tls.Client(c.conn, config)
+	c.deadline()
+	if err = tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tlsConn
+	c.reader = bufio.NewReader(tlsConn)
+	return nil
+}
+
+func (c *Conn) request(op *ber.Packet, responseTag byte) (*ber.Packet, error) {
+	id, err := c.send(op)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.receive(id)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Is(ber.ClassApplication, responseTag) {
+		c.broken = true
+		return nil, errors.New("unexpected response from ldap server")
+	}
+	return resp, nil
+}
+
+func (c *Conn) send(op *ber.Packet) (int64, error) {
+	if c.broken {
+		return 0, ErrConnectionBroken
+	}
+	c.msgID++
+	msg := ber.NewSequence().Add(ber.NewInteger(ber.ClassUniversal, ber.TagInteger, c.msgID), op)
+	c.deadline()
+	if _, err := c.conn.Write(msg.Bytes()); err != nil {
+		c.broken = true
+		return 0, err
+	}
+	return c.msgID, nil
+}
+
+func (c *Conn) receive(id int64) (*ber.Packet, error) {
+	for {
+		c.deadline()
+		msg, err := ber.Read(c.reader)
+		if err != nil {
+			c.broken = true
+			return nil, err
+		}
+		if len(msg.Children) < 2 {
+			c.broken = true
+			return nil, errors.New("malformed ldap message")
+		}
+		msgID, err := msg.Children[0].Int()
+		if err != nil {
+			c.broken = true
+			return nil, err
+		}
+		if msgID == 0 {
+			// Unsolicited notifications such as notice of disconnection
+			c.broken = true
+			return nil, ErrConnectionClosed
+		}
+		if msgID == id {
+			return msg.Children[1], nil
+		}
+	}
+}
+
+func (c *Conn) result(op *ber.Packet) error {
+	if len(op.Children) < 3 {
+		c.broken = true
+		return errors.New("malformed ldap result")
+	}
+	code, err := op.Children[0].Int()
+	if err != nil {
+		c.broken = true
+		return err
+	}
+	if code == ResultSuccess {
+		return nil
+	}
+	return &Error{ResultCode: int(code), Message: op.Children[2].String()}
+}
+
+func (c *Conn) deadline() {
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+	}
+}
+
+func parseEntry(op *ber.Packet) (*Entry, error) {
+	if len(op.Children) < 2 {
+		return nil, errors.New("malformed search entry")
+	}
+	entry := &Entry{DN: op.Children[0].String(), Attributes: map[string][]string{}}
+	for _, attr := range op.Children[1].Children {
+		if len(attr.Children) < 2 {
+			return nil, errors.New("malformed search entry attribute")
+		}
+		values := make([]string, 0, len(attr.Children[1].Children))
+		for _, v := range attr.Children[1].Children {
+			values = append(values, v.String())
+		}
+		name := attr.Children[0].String()
+		entry.Attributes[name] = append(entry.Attributes[name], values...)
+	}
+	return entry, nil
+}
@@ -0,0 +1,223 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap_test
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/amdonov/lite-idp/ldap"
+	"github.com/amdonov/lite-idp/ldap/ldaptest"
+	"github.com/stretchr/testify/assert"
+)
+
+var testEntries = []ldaptest.Entry{
+	{
+		DN:       "cn=service,dc=example,dc=com",
+		Password: "service",
+	},
+	{
+		DN:       "uid=joe,ou=people,dc=example,dc=com",
+		Password: "password",
+		Attributes: map[string][]string{
+			"uid":      {"joe"},
+			"mail":     {"joe@example.com"},
+			"memberOf": {"cn=admins,dc=example,dc=com", "cn=users,dc=example,dc=com"},
+		},
+	},
+	{
+		DN: "uid=suzy,ou=people,dc=example,dc=com",
+		Attributes: map[string][]string{
+			"uid":  {"suzy"},
+			"mail": {"suzy@example.com"},
+		},
+	},
+}
+
+func dial(t *testing.T, s *ldaptest.Server, startTLS bool) *ldap.Conn {
+	conn, err := ldap.Dial(&ldap.Config{
+		URL:       s.URL,
+		StartTLS:  startTLS,
+		TLSConfig: &tls.Config{RootCAs: s.RootCAs},
+		Timeout:   5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestConn_Bind(t *testing.T) {
+	s := ldaptest.NewServer(testEntries...)
+	defer s.Close()
+	conn := dial(t, s, false)
+	defer conn.Close()
+	assert.NoError(t, conn.Bind("uid=joe,ou=people,dc=example,dc=com", "password"))
+	err := conn.Bind("uid=joe,ou=people,dc=example,dc=com", "wrong")
+	assert.True(t, ldap.IsInvalidCredentials(err), "expected invalid credentials")
+	err = conn.Bind("uid=joe,ou=people,dc=example,dc=com", "")
+	assert.True(t, ldap.IsInvalidCredentials(err), "empty passwords should never bind")
+	assert.NoError(t, conn.AnonymousBind())
+	assert.False(t, conn.Broken())
+}
+
+func TestConn_Search(t *testing.T) {
+	s := ldaptest.NewServer(testEntries...)
+	defer s.Close()
+	conn := dial(t, s, false)
+	defer conn.Close()
+	entries, err := conn.Search(&ldap.SearchRequest{
+		BaseDN:     "ou=people,dc=example,dc=com",
+		Scope:      ldap.ScopeWholeSubtree,
+		Filter:     "(&(objectClass=*)(uid=" + ldap.EscapeFilter("joe") + "))",
+		Attributes: []string{"mail", "memberOf"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "uid=joe,ou=people,dc=example,dc=com", entries[0].DN)
+		assert.Equal(t, []string{"joe@example.com"}, entries[0].Values("MAIL"))
+		assert.Len(t, entries[0].Values("memberof"), 2)
+		assert.Nil(t, entries[0].Values("uid"), "only requested attributes should be returned")
+	}
+	entries, err = conn.Search(&ldap.SearchRequest{
+		BaseDN: "dc=example,dc=com",
+		Scope:  ldap.ScopeWholeSubtree,
+		Filter: "(mail=*@example.com)",
+	})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	_, err = conn.Search(&ldap.SearchRequest{Filter: "(uid=joe"})
+	assert.Error(t, err, "malformed filter should fail")
+}
+
+func TestConn_StartTLS(t *testing.T) {
+	s := ldaptest.NewServer(testEntries...)
+	defer s.Close()
+	conn := dial(t, s, true)
+	defer conn.Close()
+	assert.NoError(t, conn.Bind("cn=service,dc=example,dc=com", "service"))
+}
+
+func TestConn_LDAPS(t *testing.T) {
+	s := ldaptest.NewTLSServer(testEntries...)
+	defer s.Close()
+	conn := dial(t, s, false)
+	defer conn.Close()
+	assert.NoError(t, conn.Bind("cn=service,dc=example,dc=com", "service"))
+	_, err := ldap.Dial(&ldap.Config{URL: s.URL, Timeout: time.Second})
+	assert.Error(t, err, "untrusted certificate should be rejected")
+}
+
+func TestPool(t *testing.T) {
+	s := ldaptest.NewServer(testEntries...)
+	defer s.Close()
+	pool := ldap.NewPool(&ldap.Config{URL: s.URL, Timeout: 5 * time.Second}, ldap.PoolOptions{MaxIdle: 1})
+	defer pool.Close()
+	for i := 0; i < 3; i++ {
+		conn, err := pool.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NoError(t, conn.Bind("cn=service,dc=example,dc=com", "service"))
+		pool.Put(conn)
+	}
+	assert.Equal(t, 1, s.Connections(), "connections should be reused")
+}
+
+func TestPool_dropped(t *testing.T) {
+	s := ldaptest.NewServer(testEntries...)
+	defer s.Close()
+	pool := ldap.NewPool(&ldap.Config{URL: s.URL, Timeout: 5 * time.Second}, ldap.PoolOptions{MaxIdle: 1})
+	defer pool.Close()
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(conn)
+	s.DropConnections()
+	// Give the client side a moment to see the connection close
+	time.Sleep(50 * time.Millisecond)
+	conn, err = pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Put(conn)
+	assert.NoError(t, conn.Bind("cn=service,dc=example,dc=com", "service"), "dead connections should be replaced")
+	assert.Equal(t, 2, s.Connections())
+}
+
+func TestPool_idleTimeout(t *testing.T) {
+	s := ldaptest.NewServer(testEntries...)
+	defer s.Close()
+	pool := ldap.NewPool(&ldap.Config{URL: s.URL, Timeout: 5 * time.Second},
+		ldap.PoolOptions{MaxIdle: 1, IdleTimeout: 20 * time.Millisecond})
+	defer pool.Close()
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(conn)
+	time.Sleep(50 * time.Millisecond)
+	conn, err = pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, conn.Bind("cn=service,dc=example,dc=com", "service"))
+	pool.Put(conn)
+	assert.Equal(t, 2, s.Connections(), "expired connections shouldn't be reused")
+}
+
+func TestPool_maxOpen(t *testing.T) {
+	s := ldaptest.NewServer(testEntries...)
+	defer s.Close()
+	pool := ldap.NewPool(&ldap.Config{URL: s.URL, Timeout: 50 * time.Millisecond}, ldap.PoolOptions{MaxIdle: 1, MaxOpen: 1})
+	defer pool.Close()
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pool.Get()
+	assert.Equal(t, ldap.ErrPoolTimeout, err, "only MaxOpen connections may be in use")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pool.Put(conn)
+	}()
+	conn, err = pool.Get()
+	if assert.NoError(t, err, "connections that are put back should be handed out") {
+		pool.Put(conn)
+	}
+	assert.Equal(t, 1, s.Connections())
+}
+
+func TestIsTransient(t *testing.T) {
+	s := ldaptest.NewServer()
+	s.Close()
+	_, err := ldap.Dial(&ldap.Config{URL: s.URL, Timeout: time.Second})
+	assert.True(t, ldap.IsTransient(err), "failing to connect is transient")
+	assert.True(t, ldap.IsTransient(&ldap.Error{ResultCode: ldap.ResultBusy}))
+	assert.True(t, ldap.IsTransient(ldap.ErrConnectionClosed))
+	assert.False(t, ldap.IsTransient(&ldap.Error{ResultCode: ldap.ResultInvalidCredentials}))
+}
+
+func TestDial_unavailable(t *testing.T) {
+	s := ldaptest.NewServer()
+	s.Close()
+	_, err := ldap.Dial(&ldap.Config{URL: s.URL, Timeout: time.Second})
+	assert.Error(t, err)
+	assert.False(t, ldap.IsInvalidCredentials(err))
+}
@@ -0,0 +1,211 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/amdonov/lite-idp/ldap/internal/ber"
+)
+
+// Filter choice tags from RFC 4511
+const (
+	FilterAnd            = 0
+	FilterOr             = 1
+	FilterNot            = 2
+	FilterEqualityMatch  = 3
+	FilterSubstrings     = 4
+	FilterGreaterOrEqual = 5
+	FilterLessOrEqual    = 6
+	FilterPresent        = 7
+	FilterApproxMatch    = 8
+)
+
+// Substring choice tags
+const (
+	SubstringInitial = 0
+	SubstringAny     = 1
+	SubstringFinal   = 2
+)
+
+// EscapeFilter escapes a value so it can be safely included in a search filter
+func EscapeFilter(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// compileFilter converts the string representation of a filter from RFC 4515 into its BER encoding
+func compileFilter(filter string) (*ber.Packet, error) {
+	if filter == "" {
+		filter = "(objectClass=*)"
+	}
+	p, pos, err := parseFilter(filter, 0)
+	if err != nil {
+		return nil, err
+	}
+	if pos != len(filter) {
+		return nil, fmt.Errorf("unexpected data after filter at position %d", pos)
+	}
+	return p, nil
+}
+
+func parseFilter(filter string, pos int) (*ber.Packet, int, error) {
+	if pos >= len(filter) || filter[pos] != '(' {
+		return nil, pos, fmt.Errorf("filter must start with ( at position %d", pos)
+	}
+	pos++
+	if pos >= len(filter) {
+		return nil, pos, fmt.Errorf("unterminated filter")
+	}
+	var p *ber.Packet
+	switch filter[pos] {
+	case '&', '|':
+		tag := byte(FilterAnd)
+		if filter[pos] == '|' {
+			tag = FilterOr
+		}
+		p = ber.New(ber.ClassContext, tag, true)
+		pos++
+		for pos < len(filter) && filter[pos] == '(' {
+			child, next, err := parseFilter(filter, pos)
+			if err != nil {
+				return nil, next, err
+			}
+			p.Add(child)
+			pos = next
+		}
+	case '!':
+		child, next, err := parseFilter(filter, pos+1)
+		if err != nil {
+			return nil, next, err
+		}
+		p = ber.New(ber.ClassContext, FilterNot, true).Add(child)
+		pos = next
+	default:
+		end := strings.IndexByte(filter[pos:], ')')
+		if end < 0 {
+			return nil, pos, fmt.Errorf("unterminated filter")
+		}
+		item, err := parseItem(filter[pos : pos+end])
+		if err != nil {
+			return nil, pos, err
+		}
+		p = item
+		pos += end
+	}
+	if pos >= len(filter) || filter[pos] != ')' {
+		return nil, pos, fmt.Errorf("filter must end with ) at position %d", pos)
+	}
+	return p, pos + 1, nil
+}
+
+func parseItem(item string) (*ber.Packet, error) {
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, fmt.Errorf("invalid filter item %s", item)
+	}
+	attr, value := item[:eq], item[eq+1:]
+	if strings.ContainsAny(value, "()") {
+		return nil, fmt.Errorf("unescaped parenthesis in filter item %s", item)
+	}
+	tag := byte(FilterEqualityMatch)
+	switch attr[len(attr)-1] {
+	case '>':
+		tag = FilterGreaterOrEqual
+	case '<':
+		tag = FilterLessOrEqual
+	case '~':
+		tag = FilterApproxMatch
+	}
+	if tag != FilterEqualityMatch {
+		attr = attr[:len(attr)-1]
+	}
+	if attr == "" {
+		return nil, fmt.Errorf("invalid filter item %s", item)
+	}
+	if tag == FilterEqualityMatch && value == "*" {
+		return ber.NewString(ber.ClassContext, FilterPresent, attr), nil
+	}
+	if tag == FilterEqualityMatch && strings.Contains(value, "*") {
+		return parseSubstrings(attr, value)
+	}
+	v, err := unescapeFilter(value)
+	if err != nil {
+		return nil, err
+	}
+	return ber.New(ber.ClassContext, tag, true).Add(
+		ber.NewString(ber.ClassUniversal, ber.TagOctetString, attr),
+		ber.NewString(ber.ClassUniversal, ber.TagOctetString, v),
+	), nil
+}
+
+func parseSubstrings(attr, value string) (*ber.Packet, error) {
+	substrings := ber.NewSequence()
+	parts := strings.Split(value, "*")
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		v, err := unescapeFilter(part)
+		if err != nil {
+			return nil, err
+		}
+		tag := byte(SubstringAny)
+		switch i {
+		case 0:
+			tag = SubstringInitial
+		case len(parts) - 1:
+			tag = SubstringFinal
+		}
+		substrings.Add(ber.NewString(ber.ClassContext, tag, v))
+	}
+	return ber.New(ber.ClassContext, FilterSubstrings, true).Add(
+		ber.NewString(ber.ClassUniversal, ber.TagOctetString, attr),
+		substrings,
+	), nil
+}
+
+func unescapeFilter(value string) (string, error) {
+	if !strings.Contains(value, "\\") {
+		return value, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			b.WriteByte(value[i])
+			continue
+		}
+		if i+3 > len(value) {
+			return "", fmt.Errorf("invalid escape in filter value %s", value)
+		}
+		decoded, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in filter value %s", value)
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
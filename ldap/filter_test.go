@@ -0,0 +1,68 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"testing"
+
+	"github.com/amdonov/lite-idp/ldap/internal/ber"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEscapeFilter(t *testing.T) {
+	assert.Equal(t, `joe\2a\28\29\5c`, EscapeFilter(`joe*()\`))
+	assert.Equal(t, "joe", EscapeFilter("joe"))
+}
+
+func Test_compileFilter(t *testing.T) {
+	p, err := compileFilter("(&(uid=joe)(!(mail=*))(|(cn=J*o*e)(age>=21)))")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, p.Is(ber.ClassContext, FilterAnd))
+	assert.Len(t, p.Children, 3)
+	assert.True(t, p.Children[0].Is(ber.ClassContext, FilterEqualityMatch))
+	assert.Equal(t, "joe", p.Children[0].Children[1].String())
+	not := p.Children[1]
+	assert.True(t, not.Is(ber.ClassContext, FilterNot))
+	assert.True(t, not.Children[0].Is(ber.ClassContext, FilterPresent))
+	assert.Equal(t, "mail", not.Children[0].String())
+	or := p.Children[2]
+	substrings := or.Children[0]
+	assert.True(t, substrings.Is(ber.ClassContext, FilterSubstrings))
+	parts := substrings.Children[1].Children
+	if assert.Len(t, parts, 3) {
+		assert.True(t, parts[0].Is(ber.ClassContext, SubstringInitial))
+		assert.True(t, parts[1].Is(ber.ClassContext, SubstringAny))
+		assert.True(t, parts[2].Is(ber.ClassContext, SubstringFinal))
+	}
+	assert.True(t, or.Children[1].Is(ber.ClassContext, FilterGreaterOrEqual))
+	assert.Equal(t, "age", or.Children[1].Children[0].String())
+}
+
+func Test_compileFilter_escapes(t *testing.T) {
+	p, err := compileFilter("(cn=" + EscapeFilter("a*(b)") + ")")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "a*(b)", p.Children[1].String())
+}
+
+func Test_compileFilter_invalid(t *testing.T) {
+	for _, f := range []string{"uid=joe", "(uid=joe", "(uid=joe))", "(=joe)", "(uid=jo(e)", `(uid=\2)`} {
+		_, err := compileFilter(f)
+		assert.Error(t, err, f)
+	}
+}
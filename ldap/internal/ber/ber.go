@@ -0,0 +1,198 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ber implements the subset of the ASN.1 Basic Encoding Rules used by LDAP
+package ber
+
+import (
+	"bytes"
+	"errors"
+	"io"
+)
+
+// Identifier classes
+const (
+	ClassUniversal   byte = 0x00
+	ClassApplication byte = 0x40
+	ClassContext     byte = 0x80
+)
+
+// Universal tags
+const (
+	TagBoolean     byte = 0x01
+	TagInteger     byte = 0x02
+	TagOctetString byte = 0x04
+	TagNull        byte = 0x05
+	TagEnumerated  byte = 0x0a
+	TagSequence    byte = 0x10
+	TagSet         byte = 0x11
+)
+
+const (
+	constructed = 0x20
+	// Directory responses are small. Refuse anything that looks unreasonable.
+	maxLength = 16 << 20
+)
+
+// Packet is a single BER element. Primitive elements hold a Value, constructed elements hold Children.
+type Packet struct {
+	Class       byte
+	Constructed bool
+	Tag         byte
+	Value       []byte
+	Children    []*Packet
+}
+
+// New returns an empty element
+func New(class, tag byte, constructed bool) *Packet {
+	return &Packet{Class: class, Tag: tag, Constructed: constructed}
+}
+
+// NewSequence returns an empty universal sequence
+func NewSequence() *Packet {
+	return New(ClassUniversal, TagSequence, true)
+}
+
+// NewString returns a primitive element holding s
+func NewString(class, tag byte, s string) *Packet {
+	return &Packet{Class: class, Tag: tag, Value: []byte(s)}
+}
+
+// NewInteger returns a primitive element holding the two's complement encoding of v
+func NewInteger(class, tag byte, v int64) *Packet {
+	n := 1
+	for i := v; i > 127 || i < -128; i >>= 8 {
+		n++
+	}
+	b := make([]byte, n)
+	for j := n - 1; j >= 0; j-- {
+		b[j] = byte(v)
+		v >>= 8
+	}
+	return &Packet{Class: class, Tag: tag, Value: b}
+}
+
+// NewBoolean returns a universal boolean
+func NewBoolean(v bool) *Packet {
+	b := byte(0x00)
+	if v {
+		b = 0xff
+	}
+	return &Packet{Class: ClassUniversal, Tag: TagBoolean, Value: []byte{b}}
+}
+
+// Add appends children to a constructed element
+func (p *Packet) Add(children ...*Packet) *Packet {
+	p.Children = append(p.Children, children...)
+	return p
+}
+
+// Is reports whether the element has the given class and tag
+func (p *Packet) Is(class, tag byte) bool {
+	return p.Class == class && p.Tag == tag
+}
+
+// String returns the value of a primitive element as a string
+func (p *Packet) String() string {
+	return string(p.Value)
+}
+
+// Int decodes the value of an integer or enumerated element
+func (p *Packet) Int() (int64, error) {
+	if len(p.Value) == 0 || len(p.Value) > 8 {
+		return 0, errors.New("invalid integer length")
+	}
+	v := int64(int8(p.Value[0]))
+	for _, b := range p.Value[1:] {
+		v = v<<8 | int64(b)
+	}
+	return v, nil
+}
+
+// Bytes returns the BER encoding of the element
+func (p *Packet) Bytes() []byte {
+	content := p.Value
+	identifier := p.Class | p.Tag
+	if p.Constructed {
+		identifier |= constructed
+		content = nil
+		for _, c := range p.Children {
+			content = append(content, c.Bytes()...)
+		}
+	}
+	out := append([]byte{identifier}, encodeLength(len(content))...)
+	return append(out, content...)
+}
+
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// Read decodes the next element from r
+func Read(r io.Reader) (*Packet, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	p := &Packet{
+		Class:       header[0] & 0xc0,
+		Constructed: header[0]&constructed != 0,
+		Tag:         header[0] & 0x1f,
+	}
+	if p.Tag == 0x1f {
+		return nil, errors.New("multi-byte tags are not supported")
+	}
+	length := int(header[1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 {
+			return nil, errors.New("unsupported length encoding")
+		}
+		lb := make([]byte, n)
+		if _, err := io.ReadFull(r, lb); err != nil {
+			return nil, err
+		}
+		length = 0
+		for _, b := range lb {
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxLength {
+		return nil, errors.New("element exceeds maximum length")
+	}
+	content := make([]byte, length)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return nil, err
+	}
+	if !p.Constructed {
+		p.Value = content
+		return p, nil
+	}
+	reader := bytes.NewReader(content)
+	for reader.Len() > 0 {
+		child, err := Read(reader)
+		if err != nil {
+			return nil, err
+		}
+		p.Children = append(p.Children, child)
+	}
+	return p, nil
+}
@@ -0,0 +1,76 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ber
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewInteger(t *testing.T) {
+	tests := []struct {
+		v    int64
+		want []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x00, 0x80}},
+		{-1, []byte{0xff}},
+		{-129, []byte{0xff, 0x7f}},
+		{65536, []byte{0x01, 0x00, 0x00}},
+	}
+	for _, tt := range tests {
+		p := NewInteger(ClassUniversal, TagInteger, tt.v)
+		assert.Equal(t, tt.want, p.Value)
+		v, err := p.Int()
+		assert.NoError(t, err)
+		assert.Equal(t, tt.v, v)
+	}
+}
+
+func TestRead(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	p := NewSequence().Add(
+		NewInteger(ClassUniversal, TagInteger, 7),
+		New(ClassApplication, 0, true).Add(
+			NewString(ClassUniversal, TagOctetString, long),
+			NewString(ClassContext, 0, "secret"),
+		),
+		NewBoolean(true),
+	)
+	decoded, err := Read(bytes.NewReader(p.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, decoded.Is(ClassUniversal, TagSequence))
+	assert.Len(t, decoded.Children, 3)
+	id, _ := decoded.Children[0].Int()
+	assert.Equal(t, int64(7), id)
+	bind := decoded.Children[1]
+	assert.True(t, bind.Constructed)
+	assert.True(t, bind.Is(ClassApplication, 0))
+	assert.Equal(t, long, bind.Children[0].String())
+	assert.Equal(t, "secret", bind.Children[1].String())
+	assert.Equal(t, []byte{0xff}, decoded.Children[2].Value)
+}
+
+func TestRead_truncated(t *testing.T) {
+	data := NewString(ClassUniversal, TagOctetString, "truncated").Bytes()
+	_, err := Read(bytes.NewReader(data[:len(data)-2]))
+	assert.Error(t, err)
+}
@@ -0,0 +1,361 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package ldaptest provides an in-memory directory server for testing LDAP integrations
+package ldaptest
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/amdonov/lite-idp/ldap/internal/ber"
+)
+
+// Entry is a directory entry. Binds as the entry succeed with Password.
+type Entry struct {
+	DN         string
+	Password   string
+	Attributes map[string][]string
+}
+
+// Server is an in-memory directory server supporting simple binds, searches, StartTLS and LDAPS
+type Server struct {
+	// URL of the server, ldap://127.0.0.1:port or ldaps://127.0.0.1:port
+	URL string
+	// Certificates trusted by clients for LDAPS and StartTLS
+	RootCAs *x509.CertPool
+
+	entries   []Entry
+	listener  net.Listener
+	tlsConfig *tls.Config
+	mu        sync.Mutex
+	accepted  int
+	binds     int
+	conns     map[net.Conn]bool
+	wg        sync.WaitGroup
+}
+
+// NewServer starts a server on a loopback port
+func NewServer(entries ...Entry) *Server {
+	return start("ldap", entries)
+}
+
+// NewTLSServer starts a server that requires TLS from the start of each connection
+func NewTLSServer(entries ...Entry) *Server {
+	return start("ldaps", entries)
+}
+
+func start(scheme string, entries []Entry) *Server {
+	s := &Server{entries: entries, conns: map[net.Conn]bool{}}
+	s.tlsConfig, s.RootCAs = selfSigned()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("ldaptest: failed to listen: " + err.Error())
+	}
+	if scheme == "ldaps" {
+		listener = tls.NewListener(listener, s.tlsConfig)
+	}
+	s.listener = listener
+	s.URL = scheme + "://" + listener.Addr().String()
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// Close stops accepting connections
+func (s *Server) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+// DropConnections closes the open connections without a notice of disconnection, like a server restart or a
+// firewall that drops idle connections
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Connections returns the number of connections accepted
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+// Binds returns the number of bind requests received
+func (s *Server) Binds() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.binds
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.accepted++
+		s.conns[conn] = true
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	accepted := conn
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, accepted)
+		s.mu.Unlock()
+	}()
+	reader := bufio.NewReader(conn)
+	for {
+		msg, err := ber.Read(reader)
+		if err != nil || len(msg.Children) < 2 {
+			return
+		}
+		id, _ := msg.Children[0].Int()
+		op := msg.Children[1]
+		reply := func(p *ber.Packet) error {
+			_, err := conn.Write(ber.NewSequence().Add(
+				ber.NewInteger(ber.ClassUniversal, ber.TagInteger, id), p).Bytes())
+			return err
+		}
+		switch {
+		case op.Is(ber.ClassApplication, 0):
+			err = reply(result(1, s.bind(op)))
+		case op.Is(ber.ClassApplication, 2):
+			return
+		case op.Is(ber.ClassApplication, 3):
+			for _, e := range s.search(op) {
+				if err = reply(e); err != nil {
+					return
+				}
+			}
+			err = reply(result(5, 0))
+		case op.Is(ber.ClassApplication, 23):
+			if err = reply(result(24, 0)); err != nil {
+				return
+			}
+			tlsConn := tls.Server(conn, s.tlsConfig)
+			if err = tlsConn.Handshake(); err != nil {
+				return
+			}
+			conn = tlsConn
+			reader = bufio.NewReader(conn)
+		default:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func result(tag byte, code int64) *ber.Packet {
+	return ber.New(ber.ClassApplication, tag, true).Add(
+		ber.NewInteger(ber.ClassUniversal, ber.TagEnumerated, code),
+		ber.NewString(ber.ClassUniversal, ber.TagOctetString, ""),
+		ber.NewString(ber.ClassUniversal, ber.TagOctetString, ""),
+	)
+}
+
+func (s *Server) bind(op *ber.Packet) int64 {
+	s.mu.Lock()
+	s.binds++
+	s.mu.Unlock()
+	if len(op.Children) < 3 {
+		return 2
+	}
+	dn, password := op.Children[1].String(), op.Children[2].String()
+	if dn == "" && password == "" {
+		return 0
+	}
+	for _, e := range s.entries {
+		if strings.EqualFold(e.DN, dn) && e.Password != "" && e.Password == password {
+			return 0
+		}
+	}
+	return 49
+}
+
+func (s *Server) search(op *ber.Packet) []*ber.Packet {
+	if len(op.Children) < 8 {
+		return nil
+	}
+	base := strings.ToLower(op.Children[0].String())
+	filter := op.Children[6]
+	requested := map[string]bool{}
+	for _, a := range op.Children[7].Children {
+		requested[strings.ToLower(a.String())] = true
+	}
+	results := []*ber.Packet{}
+	for _, e := range s.entries {
+		if !strings.HasSuffix(strings.ToLower(e.DN), base) || !matches(e, filter) {
+			continue
+		}
+		attributes := ber.NewSequence()
+		for name, values := range e.Attributes {
+			if len(requested) > 0 && !requested[strings.ToLower(name)] {
+				continue
+			}
+			set := ber.New(ber.ClassUniversal, ber.TagSet, true)
+			for _, v := range values {
+				set.Add(ber.NewString(ber.ClassUniversal, ber.TagOctetString, v))
+			}
+			attributes.Add(ber.NewSequence().Add(
+				ber.NewString(ber.ClassUniversal, ber.TagOctetString, name), set))
+		}
+		results = append(results, ber.New(ber.ClassApplication, 4, true).Add(
+			ber.NewString(ber.ClassUniversal, ber.TagOctetString, e.DN), attributes))
+	}
+	return results
+}
+
+func values(e Entry, name string) ([]string, bool) {
+	if strings.EqualFold(name, "objectClass") {
+		if v, ok := e.Attributes[name]; ok {
+			return v, true
+		}
+		return []string{"top"}, true
+	}
+	for k, v := range e.Attributes {
+		if strings.EqualFold(k, name) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func matches(e Entry, filter *ber.Packet) bool {
+	if filter.Class != ber.ClassContext {
+		return false
+	}
+	switch filter.Tag {
+	case 0:
+		for _, c := range filter.Children {
+			if !matches(e, c) {
+				return false
+			}
+		}
+		return true
+	case 1:
+		for _, c := range filter.Children {
+			if matches(e, c) {
+				return true
+			}
+		}
+		return false
+	case 2:
+		return len(filter.Children) == 1 && !matches(e, filter.Children[0])
+	case 3, 8:
+		if len(filter.Children) < 2 {
+			return false
+		}
+		vals, _ := values(e, filter.Children[0].String())
+		for _, v := range vals {
+			if strings.EqualFold(v, filter.Children[1].String()) {
+				return true
+			}
+		}
+		return false
+	case 4:
+		if len(filter.Children) < 2 {
+			return false
+		}
+		vals, _ := values(e, filter.Children[0].String())
+		for _, v := range vals {
+			if matchSubstrings(strings.ToLower(v), filter.Children[1]) {
+				return true
+			}
+		}
+		return false
+	case 7:
+		_, ok := values(e, filter.String())
+		return ok
+	}
+	return false
+}
+
+func matchSubstrings(v string, substrings *ber.Packet) bool {
+	for _, s := range substrings.Children {
+		part := strings.ToLower(s.String())
+		switch s.Tag {
+		case 0:
+			if !strings.HasPrefix(v, part) {
+				return false
+			}
+			v = v[len(part):]
+		case 1:
+			i := strings.Index(v, part)
+			if i < 0 {
+				return false
+			}
+			v = v[i+len(part):]
+		case 2:
+			if !strings.HasSuffix(v, part) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func selfSigned() (*tls.Config, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic("ldaptest: failed to generate key: " + err.Error())
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ldaptest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic("ldaptest: failed to create certificate: " + err.Error())
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic("ldaptest: failed to parse certificate: " + err.Error())
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}, pool
+}
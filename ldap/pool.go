@@ -0,0 +1,169 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ldap
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrPoolTimeout is returned by Get when MaxOpen connections stayed in use for the Timeout of the pool's Config
+var ErrPoolTimeout = errors.New("timed out waiting for an ldap connection")
+
+// PoolOptions limit the connections a Pool keeps
+type PoolOptions struct {
+	// MaxIdle connections are kept for reuse
+	MaxIdle int
+	// MaxOpen connections may be in use at once. Zero doesn't limit them.
+	MaxOpen int
+	// IdleTimeout closes connections that weren't used for longer. Zero keeps them until they break.
+	IdleTimeout time.Duration
+}
+
+// Pool keeps idle connections to a directory server for reuse
+type Pool struct {
+	config  *Config
+	options PoolOptions
+	// slots holds a token for each connection in use, nil if MaxOpen is zero
+	slots chan struct{}
+	mu    sync.Mutex
+	// most recently used last
+	idle []idleConn
+}
+
+type idleConn struct {
+	conn  *Conn
+	since time.Time
+}
+
+// NewPool returns a pool that dials connections with config as they're needed
+func NewPool(config *Config, options PoolOptions) *Pool {
+	if options.MaxIdle < 0 {
+		options.MaxIdle = 0
+	}
+	p := &Pool{config: config, options: options}
+	if options.MaxOpen > 0 {
+		p.slots = make(chan struct{}, options.MaxOpen)
+	}
+	return p
+}
+
+// Get returns an idle connection or dials a new one. Idle connections that expired or that the server closed are
+// discarded. When MaxOpen connections are in use, Get waits up to the Timeout of the Config for one to be put back.
+func (p *Pool) Get() (*Conn, error) {
+	if err := p.acquire(); err != nil {
+		return nil, err
+	}
+	for {
+		c := p.takeIdle()
+		if c == nil {
+			break
+		}
+		if c.Alive() {
+			return c, nil
+		}
+		c.Close()
+	}
+	c, err := Dial(p.config)
+	if err != nil {
+		p.release()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Put returns a connection to the pool. Broken connections and those that don't fit are closed.
+func (p *Pool) Put(c *Conn) {
+	defer p.release()
+	if c.Broken() {
+		c.Close()
+		return
+	}
+	p.mu.Lock()
+	if len(p.idle) < p.options.MaxIdle {
+		p.idle = append(p.idle, idleConn{conn: c, since: time.Now()})
+		c = nil
+	}
+	p.mu.Unlock()
+	if c != nil {
+		c.Close()
+	}
+}
+
+// Close closes all idle connections
+func (p *Pool) Close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.mu.Unlock()
+	for _, ic := range idle {
+		ic.conn.Close()
+	}
+}
+
+// takeIdle returns the most recently used idle connection that hasn't expired, closing the expired ones
+func (p *Pool) takeIdle() *Conn {
+	p.mu.Lock()
+	var expired []*Conn
+	if p.options.IdleTimeout > 0 {
+		cutoff := time.Now().Add(-p.options.IdleTimeout)
+		n := 0
+		for n < len(p.idle) && p.idle[n].since.Before(cutoff) {
+			expired = append(expired, p.idle[n].conn)
+			n++
+		}
+		p.idle = p.idle[n:]
+	}
+	var c *Conn
+	if last := len(p.idle) - 1; last >= 0 {
+		c = p.idle[last].conn
+		p.idle = p.idle[:last]
+	}
+	p.mu.Unlock()
+	for _, e := range expired {
+		e.Close()
+	}
+	return c
+}
+
+func (p *Pool) acquire() error {
+	if p.slots == nil {
+		return nil
+	}
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if p.config.Timeout <= 0 {
+		p.slots <- struct{}{}
+		return nil
+	}
+	timer := time.NewTimer(p.config.Timeout)
+	defer timer.Stop()
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return ErrPoolTimeout
+	}
+}
+
+func (p *Pool) release() {
+	if p.slots != nil {
+		<-p.slots
+	}
+}
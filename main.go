@@ -26,40 +26,62 @@ import (
 	"github.com/spf13/viper"
 )
 
+// envPrefix is prepended to the environment variables read for settings, so listen-address is read from
+// LITEIDP_LISTEN_ADDRESS and other variables in the environment aren't mistaken for settings
+const envPrefix = "LITEIDP"
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "lite-idp",
 	Short: "SAML 2 Identity Provider",
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		if err := initConfig(); err != nil {
+			// The flags were fine, so their usage wouldn't help
+			cmd.SilenceUsage = true
+			return err
+		}
+		return nil
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// Cobra has already printed the error to stderr when it's returned.
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
 		os.Exit(1)
 	}
 }
 
 func init() {
-	cobra.OnInitialize(initConfig)
+	rootCmd.PersistentFlags().String("config", "", "configuration file to use instead of config.yaml in /etc/lite-idp or the current directory")
+	viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
 }
 
-// initConfig reads in config file and ENV variables if set.
-func initConfig() {
-	viper.AddConfigPath("/etc/lite-idp")
-	viper.AddConfigPath(".")
-	viper.SetConfigName("config")
-
+// initConfig reads in config file and ENV variables if set. A configuration file named with --config or
+// LITEIDP_CONFIG has to load, while a missing config.yaml in the default locations only leaves the defaults in place.
+func initConfig() error {
+	viper.SetEnvPrefix(envPrefix)
 	viper.AutomaticEnv() // read in environment variables that match
-	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_", ".", "_"))
 
-	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("using config file:", viper.ConfigFileUsed())
-	} else {
-		fmt.Println("failed to load config file:", err)
+	file := viper.GetString("config")
+	viper.SetConfigFile(file)
+	if file == "" {
+		viper.AddConfigPath("/etc/lite-idp")
+		viper.AddConfigPath(".")
+		viper.SetConfigName("config")
+	}
+	// Messages go to stderr so commands can write to stdout
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok || file != "" {
+			return fmt.Errorf("failed to load config file: %v", err)
+		}
+		fmt.Fprintln(os.Stderr, "no config file found in /etc/lite-idp or the current directory, using the defaults")
+		return nil
 	}
+	fmt.Fprintln(os.Stderr, "using config file:", viper.ConfigFileUsed())
+	return nil
 }
 
 func main() {
@@ -70,5 +92,11 @@ func main() {
 	rootCmd.AddCommand(cmd.AddCmd)
 	rootCmd.AddCommand(cmd.HashCmd)
 	rootCmd.AddCommand(cmd.ClusterCmd())
+	rootCmd.AddCommand(cmd.MetadataCmd(&idp.IDP{}))
+	rootCmd.AddCommand(cmd.CheckCmd(&idp.IDP{}))
+	rootCmd.AddCommand(cmd.GenCertCmd())
+	rootCmd.AddCommand(cmd.PairwiseIDCmd())
+	rootCmd.AddCommand(cmd.TOTPCmd())
+	rootCmd.AddCommand(cmd.VersionCmd())
 	Execute()
 }
@@ -15,7 +15,9 @@
 package main
 
 import (
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/spf13/viper"
@@ -25,8 +27,37 @@ import (
 func Test_initConfig(t *testing.T) {
 	// make sure environment replacer is setup properly
 	viper.SetDefault("my-config-value", "a")
-	initConfig()
+	assert.NoError(t, initConfig())
 	assert.Equal(t, "a", viper.Get("my-config-value"), "initial value is wrong")
 	os.Setenv("MY_CONFIG_VALUE", "b")
-	assert.Equal(t, "b", viper.Get("my-config-value"), "second value is wrong")
+	defer os.Unsetenv("MY_CONFIG_VALUE")
+	assert.Equal(t, "a", viper.Get("my-config-value"), "variables without the prefix should be ignored")
+	os.Setenv("LITEIDP_MY_CONFIG_VALUE", "c")
+	defer os.Unsetenv("LITEIDP_MY_CONFIG_VALUE")
+	assert.Equal(t, "c", viper.Get("my-config-value"), "second value is wrong")
+}
+
+func Test_initConfig_file(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "idp.yaml")
+	if err = ioutil.WriteFile(file, []byte("entity-id: https://idp.example.com/custom\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defer viper.Set("config", "")
+	viper.Set("config", file)
+	assert.NoError(t, initConfig())
+	assert.Equal(t, "https://idp.example.com/custom", viper.GetString("entity-id"))
+
+	viper.Set("config", filepath.Join(dir, "missing.yaml"))
+	assert.Error(t, initConfig(), "a config file that was asked for has to load")
+
+	if err = ioutil.WriteFile(file, []byte("entity-id: [\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("config", file)
+	assert.Error(t, initConfig(), "a config file that can't be parsed has to fail")
 }
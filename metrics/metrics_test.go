@@ -0,0 +1,58 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_Handler(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounterVec("logins_total", "Logins.", "sp", "result")
+	counter.Inc("https://sp.example.com/", "success")
+	counter.Inc("https://sp.example.com/", "success")
+	counter.Inc(`quote"sp`, "failure")
+	histogram := r.NewHistogramVec("latency_seconds", "Latency.", []float64{1, 0.1}, "sp")
+	histogram.Observe(0.05, "a")
+	histogram.Observe(0.5, "a")
+	histogram.Observe(5, "a")
+	assert.Equal(t, float64(2), counter.Value("https://sp.example.com/", "success"))
+	assert.Equal(t, uint64(3), histogram.Count("a"))
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(w.Body)
+	assert.Equal(t, `# HELP logins_total Logins.
+# TYPE logins_total counter
+logins_total{sp="https://sp.example.com/",result="success"} 2
+logins_total{sp="quote\"sp",result="failure"} 1
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{sp="a",le="0.1"} 1
+latency_seconds_bucket{sp="a",le="1"} 2
+latency_seconds_bucket{sp="a",le="+Inf"} 3
+latency_seconds_sum{sp="a"} 5.55
+latency_seconds_count{sp="a"} 3
+`, string(body))
+}
+
+func TestCounterVec_wrongLabels(t *testing.T) {
+	counter := NewRegistry().NewCounterVec("logins_total", "Logins.", "sp")
+	assert.Panics(t, func() { counter.Inc("a", "b") })
+}
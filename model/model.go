@@ -24,14 +24,44 @@ package model
 import (
 	"github.com/amdonov/lite-idp/saml"
 	"github.com/golang/protobuf/ptypes"
+	"github.com/google/uuid"
 )
 
+// AppendAttributes adds copies of the attributes to the user. Values are merged into attributes the user already has.
 func (u *User) AppendAttributes(atts []*Attribute) {
-	if u.Attributes == nil {
-		u.Attributes = atts
-		return
+	for _, att := range atts {
+		existing := u.attribute(att.Name)
+		if existing == nil {
+			u.Attributes = append(u.Attributes, &Attribute{
+				Name:  att.Name,
+				Value: append([]string(nil), att.Value...),
+			})
+			continue
+		}
+		for _, v := range att.Value {
+			if !contains(existing.Value, v) {
+				existing.Value = append(existing.Value, v)
+			}
+		}
+	}
+}
+
+func (u *User) attribute(name string) *Attribute {
+	for _, att := range u.Attributes {
+		if att.Name == name {
+			return att
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
 	}
-	u.Attributes = append(u.Attributes, atts...)
+	return false
 }
 
 func (u *User) AttributeStatement() *saml.AttributeStatement {
@@ -61,14 +91,45 @@ func NewAuthnRequest(src *saml.AuthnRequest, relayState string) (*AuthnRequest,
 	if err != nil {
 		return nil, err
 	}
+	var index uint32
+	if src.AssertionConsumerServiceIndex != nil {
+		index = *src.AssertionConsumerServiceIndex
+	}
+	var format string
+	if src.NameIDPolicy != nil {
+		format = src.NameIDPolicy.Format
+	}
+	var classRefs []string
+	var comparison string
+	if src.RequestedAuthnContext != nil {
+		classRefs = src.RequestedAuthnContext.AuthnContextClassRef
+		comparison = src.RequestedAuthnContext.Comparison
+	}
+	var attributeIndex uint32
+	if src.AttributeConsumingServiceIndex != nil {
+		attributeIndex = *src.AttributeConsumingServiceIndex
+	}
+	var requesterIDs []string
+	if src.Scoping != nil {
+		requesterIDs = src.Scoping.RequesterID
+	}
 	return &AuthnRequest{
-		AssertionConsumerServiceURL:   src.AssertionConsumerServiceURL,
-		AssertionConsumerServiceIndex: src.AssertionConsumerServiceIndex,
-		Destination:                   src.Destination,
-		ID:                            src.ID,
-		ProtocolBinding:               src.ProtocolBinding,
-		RelayState:                    relayState,
-		IssueInstant:                  t,
-		Issuer:                        src.Issuer,
+		AssertionConsumerServiceURL:       src.AssertionConsumerServiceURL,
+		AssertionConsumerServiceIndex:     index,
+		Destination:                       src.Destination,
+		ID:                                src.ID,
+		ProtocolBinding:                   src.ProtocolBinding,
+		RelayState:                        relayState,
+		IssueInstant:                      t,
+		Issuer:                            src.Issuer,
+		NameIDFormat:                      format,
+		AuthnContextClassRefs:             classRefs,
+		AuthnContextComparison:            comparison,
+		ForceAuthn:                        src.ForceAuthn,
+		IsPassive:                         src.IsPassive,
+		CorrelationID:                     uuid.New().String(),
+		RequesterIDs:                      requesterIDs,
+		AttributeConsumingServiceIndex:    attributeIndex,
+		HasAttributeConsumingServiceIndex: src.AttributeConsumingServiceIndex != nil,
 	}, nil
 }
@@ -12,6 +12,7 @@ It has these top-level messages:
 	User
 	Attribute
 	ArtifactResponse
+	PendingLogin
 */
 package model
 
@@ -43,6 +44,23 @@ type AuthnRequest struct {
 	ProtocolBinding               string                     `protobuf:"bytes,7,opt,name=ProtocolBinding" json:"ProtocolBinding,omitempty"`
 	AssertionConsumerServiceIndex uint32                     `protobuf:"varint,8,opt,name=AssertionConsumerServiceIndex" json:"AssertionConsumerServiceIndex,omitempty"`
 	RelayState                    string                     `protobuf:"bytes,9,opt,name=RelayState" json:"RelayState,omitempty"`
+	// Binding used to deliver the request to the IdP
+	RequestBinding string `protobuf:"bytes,10,opt,name=RequestBinding" json:"RequestBinding,omitempty"`
+	// NameID format requested in the NameIDPolicy
+	NameIDFormat string `protobuf:"bytes,11,opt,name=NameIDFormat" json:"NameIDFormat,omitempty"`
+	// AuthnContextClassRefs and Comparison from the RequestedAuthnContext
+	AuthnContextClassRefs  []string `protobuf:"bytes,12,rep,name=AuthnContextClassRefs" json:"AuthnContextClassRefs,omitempty"`
+	AuthnContextComparison string   `protobuf:"bytes,13,opt,name=AuthnContextComparison" json:"AuthnContextComparison,omitempty"`
+	// ForceAuthn and IsPassive attributes of the request
+	ForceAuthn bool `protobuf:"varint,14,opt,name=ForceAuthn" json:"ForceAuthn,omitempty"`
+	IsPassive  bool `protobuf:"varint,15,opt,name=IsPassive" json:"IsPassive,omitempty"`
+	// Generated by the IdP to link audit events for the request to the assertion issued for it
+	CorrelationID string `protobuf:"bytes,16,opt,name=CorrelationID" json:"CorrelationID,omitempty"`
+	// RequesterIDs from the Scoping of a request sent by a proxy, naming the service providers it's acting for
+	RequesterIDs []string `protobuf:"bytes,17,rep,name=RequesterIDs" json:"RequesterIDs,omitempty"`
+	// AttributeConsumingServiceIndex of the request, if HasAttributeConsumingServiceIndex is set
+	AttributeConsumingServiceIndex    uint32 `protobuf:"varint,18,opt,name=AttributeConsumingServiceIndex" json:"AttributeConsumingServiceIndex,omitempty"`
+	HasAttributeConsumingServiceIndex bool   `protobuf:"varint,19,opt,name=HasAttributeConsumingServiceIndex" json:"HasAttributeConsumingServiceIndex,omitempty"`
 }
 
 func (m *AuthnRequest) Reset()                    { *m = AuthnRequest{} }
@@ -113,6 +131,76 @@ func (m *AuthnRequest) GetRelayState() string {
 	return ""
 }
 
+func (m *AuthnRequest) GetRequestBinding() string {
+	if m != nil {
+		return m.RequestBinding
+	}
+	return ""
+}
+
+func (m *AuthnRequest) GetNameIDFormat() string {
+	if m != nil {
+		return m.NameIDFormat
+	}
+	return ""
+}
+
+func (m *AuthnRequest) GetAuthnContextClassRefs() []string {
+	if m != nil {
+		return m.AuthnContextClassRefs
+	}
+	return nil
+}
+
+func (m *AuthnRequest) GetAuthnContextComparison() string {
+	if m != nil {
+		return m.AuthnContextComparison
+	}
+	return ""
+}
+
+func (m *AuthnRequest) GetForceAuthn() bool {
+	if m != nil {
+		return m.ForceAuthn
+	}
+	return false
+}
+
+func (m *AuthnRequest) GetIsPassive() bool {
+	if m != nil {
+		return m.IsPassive
+	}
+	return false
+}
+
+func (m *AuthnRequest) GetCorrelationID() string {
+	if m != nil {
+		return m.CorrelationID
+	}
+	return ""
+}
+
+func (m *AuthnRequest) GetRequesterIDs() []string {
+	if m != nil {
+		return m.RequesterIDs
+	}
+	return nil
+}
+
+func (m *AuthnRequest) GetAttributeConsumingServiceIndex() uint32 {
+	if m != nil {
+		return m.AttributeConsumingServiceIndex
+	}
+	return 0
+}
+
+func (m *AuthnRequest) GetHasAttributeConsumingServiceIndex() bool {
+	if m != nil {
+		return m.HasAttributeConsumingServiceIndex
+	}
+	return false
+}
+
 // Allows storage of user information to avoid
 // repeated logins, basis of SSO
 type User struct {
@@ -121,6 +209,19 @@ type User struct {
 	Context    string       `protobuf:"bytes,3,opt,name=Context" json:"Context,omitempty"`
 	IP         string       `protobuf:"bytes,4,opt,name=IP" json:"IP,omitempty"`
 	Attributes []*Attribute `protobuf:"bytes,5,rep,name=Attributes" json:"Attributes,omitempty"`
+	// Identifies the session in AuthnStatements and LogoutRequests
+	SessionIndex string `protobuf:"bytes,6,opt,name=SessionIndex" json:"SessionIndex,omitempty"`
+	// Entity IDs of service providers issued assertions during the session
+	ServiceProviders []string `protobuf:"bytes,7,rep,name=ServiceProviders" json:"ServiceProviders,omitempty"`
+	// Random key transient NameIDs are derived from during the session
+	TransientKey string `protobuf:"bytes,8,opt,name=TransientKey" json:"TransientKey,omitempty"`
+	// When the user logged in and when the session was last used, for the absolute and idle timeouts
+	AuthnInstant *google_protobuf.Timestamp `protobuf:"bytes,9,opt,name=AuthnInstant" json:"AuthnInstant,omitempty"`
+	LastActivity *google_protobuf.Timestamp `protobuf:"bytes,10,opt,name=LastActivity" json:"LastActivity,omitempty"`
+	// Key the session is stored under, which is also the value of the session cookie
+	SessionID string `protobuf:"bytes,11,opt,name=SessionID" json:"SessionID,omitempty"`
+	// DER client certificate the user logged in with, for holder-of-key subject confirmation
+	Certificate []byte `protobuf:"bytes,12,opt,name=Certificate" json:"Certificate,omitempty"`
 }
 
 func (m *User) Reset()                    { *m = User{} }
@@ -163,6 +264,55 @@ func (m *User) GetAttributes() []*Attribute {
 	return nil
 }
 
+func (m *User) GetSessionIndex() string {
+	if m != nil {
+		return m.SessionIndex
+	}
+	return ""
+}
+
+func (m *User) GetServiceProviders() []string {
+	if m != nil {
+		return m.ServiceProviders
+	}
+	return nil
+}
+
+func (m *User) GetTransientKey() string {
+	if m != nil {
+		return m.TransientKey
+	}
+	return ""
+}
+
+func (m *User) GetAuthnInstant() *google_protobuf.Timestamp {
+	if m != nil {
+		return m.AuthnInstant
+	}
+	return nil
+}
+
+func (m *User) GetLastActivity() *google_protobuf.Timestamp {
+	if m != nil {
+		return m.LastActivity
+	}
+	return nil
+}
+
+func (m *User) GetSessionID() string {
+	if m != nil {
+		return m.SessionID
+	}
+	return ""
+}
+
+func (m *User) GetCertificate() []byte {
+	if m != nil {
+		return m.Certificate
+	}
+	return nil
+}
+
 // User attributes
 type Attribute struct {
 	Name  string   `protobuf:"bytes,1,opt,name=Name" json:"Name,omitempty"`
@@ -193,6 +343,9 @@ func (m *Attribute) GetValue() []string {
 type ArtifactResponse struct {
 	User    *User         `protobuf:"bytes,1,opt,name=User" json:"User,omitempty"`
 	Request *AuthnRequest `protobuf:"bytes,2,opt,name=Request" json:"Request,omitempty"`
+	// Status reported instead of an assertion when the request couldn't be answered
+	StatusCode            string `protobuf:"bytes,3,opt,name=StatusCode" json:"StatusCode,omitempty"`
+	SecondLevelStatusCode string `protobuf:"bytes,4,opt,name=SecondLevelStatusCode" json:"SecondLevelStatusCode,omitempty"`
 }
 
 func (m *ArtifactResponse) Reset()                    { *m = ArtifactResponse{} }
@@ -214,41 +367,120 @@ func (m *ArtifactResponse) GetRequest() *AuthnRequest {
 	return nil
 }
 
+func (m *ArtifactResponse) GetStatusCode() string {
+	if m != nil {
+		return m.StatusCode
+	}
+	return ""
+}
+
+func (m *ArtifactResponse) GetSecondLevelStatusCode() string {
+	if m != nil {
+		return m.SecondLevelStatusCode
+	}
+	return ""
+}
+
+// Allows storage of a user who entered their password
+// while they're asked for a second factor
+type PendingLogin struct {
+	User    *User         `protobuf:"bytes,1,opt,name=User" json:"User,omitempty"`
+	Request *AuthnRequest `protobuf:"bytes,2,opt,name=Request" json:"Request,omitempty"`
+	// Identifies the saved AuthnRequest for returning to the login form
+	RequestID string `protobuf:"bytes,3,opt,name=RequestID" json:"RequestID,omitempty"`
+	Attempts  int32  `protobuf:"varint,4,opt,name=Attempts" json:"Attempts,omitempty"`
+}
+
+func (m *PendingLogin) Reset()                    { *m = PendingLogin{} }
+func (m *PendingLogin) String() string            { return proto.CompactTextString(m) }
+func (*PendingLogin) ProtoMessage()               {}
+func (*PendingLogin) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{4} }
+
+func (m *PendingLogin) GetUser() *User {
+	if m != nil {
+		return m.User
+	}
+	return nil
+}
+
+func (m *PendingLogin) GetRequest() *AuthnRequest {
+	if m != nil {
+		return m.Request
+	}
+	return nil
+}
+
+func (m *PendingLogin) GetRequestID() string {
+	if m != nil {
+		return m.RequestID
+	}
+	return ""
+}
+
+func (m *PendingLogin) GetAttempts() int32 {
+	if m != nil {
+		return m.Attempts
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*AuthnRequest)(nil), "model.AuthnRequest")
 	proto.RegisterType((*User)(nil), "model.User")
 	proto.RegisterType((*Attribute)(nil), "model.Attribute")
 	proto.RegisterType((*ArtifactResponse)(nil), "model.ArtifactResponse")
+	proto.RegisterType((*PendingLogin)(nil), "model.PendingLogin")
 }
 
 func init() { proto.RegisterFile("model.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 415 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x52, 0x4d, 0x8b, 0xd4, 0x40,
-	0x10, 0x25, 0x99, 0x2f, 0x53, 0x59, 0x75, 0x69, 0x45, 0x9a, 0x15, 0xdd, 0x30, 0xa7, 0x5c, 0xcc,
-	0xca, 0x88, 0x57, 0x71, 0xdc, 0x20, 0x04, 0x44, 0x86, 0x5e, 0x77, 0xef, 0x9d, 0x99, 0xda, 0xb1,
-	0x21, 0xe9, 0x1e, 0xbb, 0x2b, 0xb2, 0xde, 0x3d, 0xfb, 0x9b, 0x25, 0x9d, 0x64, 0x89, 0xa2, 0x73,
-	0xeb, 0xf7, 0xfa, 0x55, 0xbd, 0xfa, 0x82, 0xb8, 0x36, 0x3b, 0xac, 0xb2, 0x83, 0x35, 0x64, 0xd8,
-	0xcc, 0x83, 0xb3, 0xf3, 0xbd, 0x31, 0xfb, 0x0a, 0x2f, 0x3c, 0x59, 0x36, 0xb7, 0x17, 0xa4, 0x6a,
-	0x74, 0x24, 0xeb, 0x43, 0xa7, 0x5b, 0xfe, 0x9c, 0xc0, 0xc9, 0xba, 0xa1, 0xaf, 0x5a, 0xe0, 0xb7,
-	0x06, 0x1d, 0xb1, 0x47, 0x10, 0x16, 0x39, 0x0f, 0x92, 0x20, 0x8d, 0x44, 0x58, 0xe4, 0x8c, 0xc3,
-	0xe2, 0x06, 0xad, 0x53, 0x46, 0xf3, 0xd0, 0x93, 0x03, 0x64, 0xef, 0xe0, 0xa4, 0x70, 0xae, 0xc1,
-	0x42, 0x3b, 0x92, 0x9a, 0xf8, 0x24, 0x09, 0xd2, 0x78, 0x75, 0x96, 0x75, 0x96, 0xd9, 0x60, 0x99,
-	0x7d, 0x19, 0x2c, 0xc5, 0x1f, 0x7a, 0xf6, 0x0c, 0xe6, 0x1e, 0x5b, 0x3e, 0xf5, 0x89, 0x7b, 0xc4,
-	0x12, 0x88, 0x73, 0x74, 0xa4, 0xb4, 0xa4, 0xd6, 0x75, 0xe6, 0x3f, 0xc7, 0x14, 0x7b, 0x0f, 0xcf,
-	0xd7, 0xce, 0xa1, 0x6d, 0xc1, 0xa5, 0xd1, 0xae, 0xa9, 0xd1, 0x5e, 0xa1, 0xfd, 0xae, 0xb6, 0x78,
-	0x2d, 0x3e, 0xf1, 0xb9, 0x8f, 0x38, 0x26, 0x61, 0x29, 0x3c, 0xde, 0xb4, 0xf5, 0x6d, 0x4d, 0xf5,
-	0x41, 0xe9, 0x9d, 0xd2, 0x7b, 0xbe, 0xf0, 0x51, 0x7f, 0xd3, 0x2c, 0x87, 0x17, 0xff, 0x4b, 0x54,
-	0xe8, 0x1d, 0xde, 0xf1, 0x07, 0x49, 0x90, 0x3e, 0x14, 0xc7, 0x45, 0xec, 0x25, 0x80, 0xc0, 0x4a,
-	0xfe, 0xb8, 0x22, 0x49, 0xc8, 0x23, 0x6f, 0x35, 0x62, 0x96, 0xbf, 0x02, 0x98, 0x5e, 0x3b, 0xb4,
-	0x8c, 0xc1, 0xf4, 0xb3, 0xac, 0xb1, 0x5f, 0x80, 0x7f, 0xb7, 0x83, 0xfa, 0x68, 0x6c, 0x2d, 0xa9,
-	0xdf, 0x40, 0x8f, 0xda, 0xd5, 0x5c, 0x1a, 0x4d, 0x78, 0xd7, 0xcd, 0x3e, 0x12, 0x03, 0xf4, 0x4b,
-	0xdc, 0xf4, 0x63, 0x0d, 0x8b, 0x0d, 0x7b, 0x0d, 0xb0, 0x26, 0xb2, 0xaa, 0x6c, 0x08, 0x1d, 0x9f,
-	0x25, 0x93, 0x34, 0x5e, 0x9d, 0x66, 0xdd, 0xbd, 0xdc, 0x7f, 0x88, 0x91, 0x66, 0xf9, 0x16, 0xa2,
-	0x7b, 0xf4, 0xcf, 0xa2, 0x9e, 0xc2, 0xec, 0x46, 0x56, 0x0d, 0xf2, 0x30, 0x99, 0xa4, 0x91, 0xe8,
-	0xc0, 0xb2, 0x84, 0xd3, 0xb5, 0x25, 0x75, 0x2b, 0xb7, 0x24, 0xd0, 0x1d, 0x8c, 0x76, 0xc8, 0xce,
-	0xbb, 0xd6, 0x7c, 0x74, 0xbc, 0x8a, 0x7b, 0xdb, 0x96, 0x12, 0x5d, 0xcf, 0xaf, 0x60, 0xd1, 0x5f,
-	0x9f, 0x6f, 0x30, 0x5e, 0x3d, 0x19, 0x4a, 0x1b, 0x1d, 0xa6, 0x18, 0x34, 0xe5, 0xdc, 0x5f, 0xd6,
-	0x9b, 0xdf, 0x01, 0x00, 0x00, 0xff, 0xff, 0x56, 0x44, 0xcf, 0x22, 0xf0, 0x02, 0x00, 0x00,
+	// 738 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xad, 0x54, 0x5f, 0x4f, 0x13, 0x41,
+	0x10, 0x4f, 0x29, 0x2d, 0x74, 0xae, 0x60, 0x5d, 0x94, 0x5c, 0x50, 0x01, 0x1b, 0x63, 0x88, 0x89,
+	0xc5, 0xe0, 0x9f, 0x47, 0x63, 0x6d, 0x43, 0x6c, 0x6c, 0x4c, 0x73, 0x05, 0xde, 0x8f, 0x76, 0xa8,
+	0x9b, 0xf4, 0xee, 0xea, 0xed, 0x5e, 0x03, 0xdf, 0xc4, 0x8f, 0xe2, 0xb3, 0x9f, 0xc3, 0x0f, 0xe3,
+	0xec, 0xdc, 0x5e, 0xb9, 0x43, 0xa0, 0x2f, 0xbe, 0xed, 0xfc, 0xe6, 0xb7, 0x3b, 0xb3, 0x33, 0xf3,
+	0x1b, 0x70, 0x82, 0x68, 0x8c, 0xd3, 0xd6, 0x2c, 0x8e, 0x74, 0x24, 0x2a, 0x6c, 0xec, 0xec, 0x4d,
+	0xa2, 0x68, 0x32, 0xc5, 0x43, 0x06, 0xcf, 0x93, 0x8b, 0x43, 0x2d, 0x03, 0x54, 0xda, 0x0f, 0x66,
+	0x29, 0xaf, 0xf9, 0xa7, 0x0a, 0xf5, 0x76, 0xa2, 0xbf, 0x87, 0x1e, 0xfe, 0x48, 0xc8, 0x23, 0x36,
+	0x61, 0xa5, 0xd7, 0x75, 0x4b, 0xfb, 0xa5, 0x83, 0x9a, 0x47, 0x27, 0xe1, 0xc2, 0xda, 0x19, 0xc6,
+	0x4a, 0x46, 0xa1, 0xbb, 0xc2, 0x60, 0x66, 0x8a, 0x8f, 0x50, 0xef, 0x29, 0x95, 0x60, 0x2f, 0xa4,
+	0x07, 0x43, 0xed, 0x96, 0xc9, 0xed, 0x1c, 0xed, 0xb4, 0xd2, 0x90, 0xad, 0x2c, 0x64, 0xeb, 0x24,
+	0x0b, 0xe9, 0x15, 0xf8, 0x62, 0x1b, 0xaa, 0x6c, 0xc7, 0xee, 0x2a, 0x3f, 0x6c, 0x2d, 0xb1, 0x0f,
+	0x4e, 0x97, 0x2e, 0xc8, 0xd0, 0xd7, 0x26, 0x6a, 0x85, 0x9d, 0x79, 0x48, 0x7c, 0x82, 0x27, 0x6d,
+	0xa5, 0x30, 0x36, 0x46, 0x27, 0x0a, 0x55, 0x12, 0x60, 0x3c, 0xc4, 0x78, 0x2e, 0x47, 0x78, 0xea,
+	0xf5, 0xdd, 0x2a, 0xdf, 0xb8, 0x8f, 0x22, 0x0e, 0xe0, 0xc1, 0xc0, 0xe4, 0x37, 0x8a, 0xa6, 0x9f,
+	0x65, 0x38, 0x96, 0xe1, 0xc4, 0x5d, 0xe3, 0x5b, 0x37, 0x61, 0xd1, 0x85, 0x67, 0x77, 0x3d, 0xd4,
+	0x0b, 0xc7, 0x78, 0xe9, 0xae, 0xd3, 0xbd, 0x0d, 0xef, 0x7e, 0x92, 0xd8, 0x05, 0xf0, 0x70, 0xea,
+	0x5f, 0x0d, 0xb5, 0xaf, 0xd1, 0xad, 0x71, 0xa8, 0x1c, 0x22, 0x5e, 0xc2, 0xa6, 0x6d, 0x40, 0x96,
+	0x0e, 0x30, 0xe7, 0x06, 0x2a, 0x9a, 0x50, 0xff, 0xe6, 0x07, 0xd8, 0xeb, 0x1e, 0x47, 0x71, 0xe0,
+	0x6b, 0xd7, 0x61, 0x56, 0x01, 0x13, 0xef, 0xe0, 0x31, 0x77, 0x94, 0x12, 0xd1, 0x78, 0xa9, 0x3b,
+	0x53, 0x5f, 0x29, 0x0f, 0x2f, 0x94, 0x5b, 0xdf, 0x2f, 0x13, 0xf9, 0x76, 0xa7, 0xf8, 0x00, 0xdb,
+	0x05, 0x47, 0x14, 0xcc, 0xfc, 0x58, 0x2a, 0x6a, 0xc0, 0x06, 0xc7, 0xb8, 0xc3, 0x6b, 0x7e, 0x46,
+	0x71, 0x47, 0xc8, 0x6e, 0x77, 0x93, 0xb8, 0xeb, 0x5e, 0x0e, 0x11, 0x4f, 0xa1, 0xd6, 0x53, 0x03,
+	0x8a, 0x22, 0xe7, 0xe8, 0x3e, 0x60, 0xf7, 0x35, 0x20, 0x5e, 0xc0, 0x46, 0x27, 0x8a, 0x63, 0x2a,
+	0x84, 0x29, 0x1d, 0x0d, 0x5e, 0x83, 0x83, 0x15, 0x41, 0xf3, 0x6b, 0x5b, 0x07, 0x8c, 0x7b, 0x5d,
+	0xe5, 0x3e, 0xe4, 0x8f, 0x14, 0x30, 0x71, 0x0c, 0xbb, 0x6d, 0xad, 0x63, 0x79, 0x9e, 0x68, 0x4c,
+	0x5b, 0x40, 0xf5, 0x2a, 0x34, 0x4a, 0x70, 0xa3, 0x96, 0xb0, 0x44, 0x1f, 0x9e, 0x7f, 0xf1, 0xd5,
+	0x92, 0xa7, 0xb6, 0xf8, 0x1f, 0xcb, 0x89, 0xcd, 0xdf, 0x65, 0x58, 0x3d, 0xa5, 0xc1, 0x10, 0x02,
+	0x56, 0x4d, 0x93, 0xac, 0xb0, 0xf8, 0x6c, 0x04, 0x60, 0xdb, 0x98, 0x2a, 0xcb, 0x5a, 0x46, 0x72,
+	0xb6, 0xce, 0xac, 0x29, 0x92, 0x9c, 0x35, 0x59, 0x9c, 0x03, 0x2b, 0x17, 0x3a, 0x89, 0x37, 0x00,
+	0x8b, 0x04, 0x14, 0x29, 0xa5, 0x4c, 0x02, 0x6c, 0xb4, 0xd2, 0x3d, 0xb0, 0x70, 0x78, 0x39, 0x8e,
+	0x29, 0xe5, 0x10, 0x95, 0xd1, 0x6f, 0xfa, 0x93, 0x54, 0x2b, 0x05, 0x4c, 0xbc, 0x82, 0x86, 0xfd,
+	0x04, 0x89, 0x61, 0x2e, 0xc7, 0xa4, 0x77, 0x52, 0x87, 0x29, 0xf9, 0x3f, 0xb8, 0x79, 0xef, 0x24,
+	0xf6, 0x43, 0x25, 0x31, 0xd4, 0x5f, 0xf1, 0x8a, 0xd5, 0x40, 0xef, 0xe5, 0x31, 0xb3, 0x28, 0x78,
+	0x16, 0xb2, 0x45, 0x51, 0x5b, 0xbe, 0x28, 0xf2, 0x7c, 0x73, 0xbf, 0xef, 0x2b, 0xdd, 0x1e, 0x69,
+	0x39, 0x97, 0xfa, 0x8a, 0xa5, 0xb1, 0xe4, 0x7e, 0x9e, 0x6f, 0x46, 0x30, 0xfb, 0x5f, 0xd7, 0x2a,
+	0xe6, 0x1a, 0x30, 0xeb, 0xa6, 0x63, 0x94, 0x7b, 0x21, 0x47, 0x46, 0x9b, 0x75, 0xf2, 0xd7, 0xbd,
+	0x3c, 0xd4, 0x7c, 0x0f, 0xb5, 0x45, 0x05, 0x6f, 0x6d, 0xe4, 0x23, 0xa8, 0x9c, 0xf9, 0xd3, 0x04,
+	0xa9, 0x8f, 0xa6, 0x4a, 0xa9, 0xd1, 0xfc, 0x55, 0x82, 0x46, 0xdb, 0xbc, 0xe2, 0x8f, 0xb4, 0x87,
+	0x6a, 0x46, 0x03, 0x82, 0x62, 0x2f, 0x9d, 0x07, 0xbe, 0xee, 0x1c, 0x39, 0xb6, 0x57, 0x06, 0xf2,
+	0xd2, 0x41, 0x79, 0x0d, 0x6b, 0x76, 0xae, 0x79, 0x2a, 0x9c, 0xa3, 0xad, 0xac, 0x9f, 0xb9, 0x2d,
+	0xed, 0x65, 0x1c, 0x23, 0x3f, 0xb3, 0x41, 0x12, 0xd5, 0x21, 0x92, 0x1d, 0x97, 0x1c, 0x62, 0x96,
+	0xc1, 0x10, 0x47, 0x51, 0x38, 0xee, 0xe3, 0x1c, 0xa7, 0x39, 0x6a, 0x3a, 0x44, 0xb7, 0x3b, 0x9b,
+	0x3f, 0x4b, 0x50, 0x1f, 0x20, 0xaf, 0x9c, 0x7e, 0x34, 0x91, 0xe1, 0x7f, 0x4f, 0x9b, 0x5a, 0x62,
+	0x8f, 0xd4, 0x92, 0x34, 0xeb, 0x6b, 0x40, 0xec, 0xc0, 0x3a, 0x15, 0x1c, 0x83, 0x99, 0x56, 0x9c,
+	0x67, 0xc5, 0x5b, 0xd8, 0xe7, 0x55, 0x6e, 0xf7, 0xdb, 0xbf, 0x54, 0x2d, 0x45, 0x3c, 0xee, 0x06,
+	0x00, 0x00,
 }
@@ -38,6 +38,11 @@ func TestNewAuthnRequest(t *testing.T) {
 		t.Fatal(err)
 	}
 	assert.Equal(t, "http://sp.example.com/demo1/metadata.php", modelReq.GetIssuer(), "issuer doesn't match")
+	assert.Equal(t, "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress", modelReq.GetNameIDFormat())
+	assert.Equal(t, []string{"urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"}, modelReq.GetAuthnContextClassRefs())
+	assert.Equal(t, "exact", modelReq.GetAuthnContextComparison())
+	assert.NotEmpty(t, modelReq.GetCorrelationID(), "each request gets a correlation ID")
+	assert.Empty(t, modelReq.GetRequesterIDs(), "the request has no Scoping")
 }
 
 func TestUser_AttributeStatement(t *testing.T) {
@@ -50,3 +55,16 @@ func TestUser_AttributeStatement(t *testing.T) {
 	statement := user.AttributeStatement()
 	assert.Equal(t, 3, len(statement.Attribute), "expected 3 attributes")
 }
+
+func TestUser_AppendAttributes(t *testing.T) {
+	static := []*Attribute{{"mail", []string{"joe@gmail.com"}}}
+	user := &User{Name: "joe"}
+	user.AppendAttributes(static)
+	user.AppendAttributes([]*Attribute{
+		{"mail", []string{"joe@gmail.com", "joe@example.com"}},
+		{"memberOf", []string{"admins", "users"}},
+	})
+	assert.Equal(t, 2, len(user.Attributes), "attributes with the same name should be merged")
+	assert.Equal(t, []string{"joe@gmail.com", "joe@example.com"}, user.Attributes[0].Value)
+	assert.Equal(t, []string{"joe@gmail.com"}, static[0].Value, "source attributes should not be modified")
+}
@@ -0,0 +1,353 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build cgo
+
+package pkcs11
+
+/*
+#cgo linux LDFLAGS: -ldl
+#include <dlfcn.h>
+#include <stdlib.h>
+#include <string.h>
+
+// The subset of the PKCS #11 v2.40 header needed to sign. Unix libraries use the platform's default packing.
+typedef unsigned long CK_ULONG;
+typedef CK_ULONG CK_RV;
+typedef CK_ULONG CK_SLOT_ID;
+typedef CK_ULONG CK_SESSION_HANDLE;
+typedef CK_ULONG CK_OBJECT_HANDLE;
+typedef CK_ULONG CK_FLAGS;
+typedef unsigned char CK_BYTE;
+
+typedef struct { CK_BYTE major; CK_BYTE minor; } CK_VERSION;
+
+typedef struct {
+	CK_BYTE label[32];
+	CK_BYTE manufacturerID[32];
+	CK_BYTE model[16];
+	CK_BYTE serialNumber[16];
+	CK_FLAGS flags;
+	CK_ULONG ulMaxSessionCount;
+	CK_ULONG ulSessionCount;
+	CK_ULONG ulMaxRwSessionCount;
+	CK_ULONG ulRwSessionCount;
+	CK_ULONG ulMaxPinLen;
+	CK_ULONG ulMinPinLen;
+	CK_ULONG ulTotalPublicMemory;
+	CK_ULONG ulFreePublicMemory;
+	CK_ULONG ulTotalPrivateMemory;
+	CK_ULONG ulFreePrivateMemory;
+	CK_VERSION hardwareVersion;
+	CK_VERSION firmwareVersion;
+	CK_BYTE utcTime[16];
+} CK_TOKEN_INFO;
+
+typedef struct { CK_ULONG type; void *pValue; CK_ULONG ulValueLen; } CK_ATTRIBUTE;
+typedef struct { CK_ULONG mechanism; void *pParameter; CK_ULONG ulParameterLen; } CK_MECHANISM;
+
+typedef struct {
+	void *CreateMutex;
+	void *DestroyMutex;
+	void *LockMutex;
+	void *UnlockMutex;
+	CK_FLAGS flags;
+	void *pReserved;
+} CK_C_INITIALIZE_ARGS;
+
+// CK_FUNCTION_LIST up to C_Sign
+typedef struct {
+	CK_VERSION version;
+	CK_RV (*C_Initialize)(void *);
+	CK_RV (*C_Finalize)(void *);
+	void *C_GetInfo;
+	void *C_GetFunctionList;
+	CK_RV (*C_GetSlotList)(CK_BYTE, CK_SLOT_ID *, CK_ULONG *);
+	void *C_GetSlotInfo;
+	CK_RV (*C_GetTokenInfo)(CK_SLOT_ID, CK_TOKEN_INFO *);
+	void *C_GetMechanismList;
+	void *C_GetMechanismInfo;
+	void *C_InitToken;
+	void *C_InitPIN;
+	void *C_SetPIN;
+	CK_RV (*C_OpenSession)(CK_SLOT_ID, CK_FLAGS, void *, void *, CK_SESSION_HANDLE *);
+	CK_RV (*C_CloseSession)(CK_SESSION_HANDLE);
+	void *C_CloseAllSessions;
+	void *C_GetSessionInfo;
+	void *C_GetOperationState;
+	void *C_SetOperationState;
+	CK_RV (*C_Login)(CK_SESSION_HANDLE, CK_ULONG, CK_BYTE *, CK_ULONG);
+	void *C_Logout;
+	void *C_CreateObject;
+	void *C_CopyObject;
+	void *C_DestroyObject;
+	void *C_GetObjectSize;
+	void *C_GetAttributeValue;
+	void *C_SetAttributeValue;
+	CK_RV (*C_FindObjectsInit)(CK_SESSION_HANDLE, CK_ATTRIBUTE *, CK_ULONG);
+	CK_RV (*C_FindObjects)(CK_SESSION_HANDLE, CK_OBJECT_HANDLE *, CK_ULONG, CK_ULONG *);
+	CK_RV (*C_FindObjectsFinal)(CK_SESSION_HANDLE);
+	void *C_EncryptInit;
+	void *C_Encrypt;
+	void *C_EncryptUpdate;
+	void *C_EncryptFinal;
+	void *C_DecryptInit;
+	void *C_Decrypt;
+	void *C_DecryptUpdate;
+	void *C_DecryptFinal;
+	void *C_DigestInit;
+	void *C_Digest;
+	void *C_DigestUpdate;
+	void *C_DigestKey;
+	void *C_DigestFinal;
+	CK_RV (*C_SignInit)(CK_SESSION_HANDLE, CK_MECHANISM *, CK_OBJECT_HANDLE);
+	CK_RV (*C_Sign)(CK_SESSION_HANDLE, CK_BYTE *, CK_ULONG, CK_BYTE *, CK_ULONG *);
+} CK_FUNCTION_LIST;
+
+#define CKR_OK 0x0
+#define CKR_USER_ALREADY_LOGGED_IN 0x100
+#define CKR_CRYPTOKI_ALREADY_INITIALIZED 0x191
+#define CKF_OS_LOCKING_OK 0x2
+#define CKF_SERIAL_SESSION 0x4
+#define CKU_USER 1
+#define CKA_CLASS 0x0
+#define CKA_LABEL 0x3
+#define CKA_ID 0x102
+#define CKO_PRIVATE_KEY 0x3
+
+static CK_RV load(const char *path, void **handle, CK_FUNCTION_LIST **list, char **err) {
+	*handle = dlopen(path, RTLD_NOW | RTLD_LOCAL);
+	if (*handle == NULL) {
+		*err = strdup(dlerror());
+		return 0;
+	}
+	CK_RV (*getFunctionList)(CK_FUNCTION_LIST **) = dlsym(*handle, "C_GetFunctionList");
+	if (getFunctionList == NULL) {
+		*err = strdup("C_GetFunctionList not found");
+		dlclose(*handle);
+		return 0;
+	}
+	CK_RV rv = getFunctionList(list);
+	if (rv != CKR_OK) {
+		dlclose(*handle);
+		return rv;
+	}
+	// Go calls the library from many threads
+	CK_C_INITIALIZE_ARGS args;
+	memset(&args, 0, sizeof(args));
+	args.flags = CKF_OS_LOCKING_OK;
+	rv = (*list)->C_Initialize(&args);
+	if (rv == CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		rv = CKR_OK;
+	}
+	return rv;
+}
+
+static CK_RV getSlotList(CK_FUNCTION_LIST *list, CK_SLOT_ID *slots, CK_ULONG *count) {
+	return list->C_GetSlotList(1, slots, count);
+}
+
+static CK_RV getTokenLabel(CK_FUNCTION_LIST *list, CK_SLOT_ID slot, CK_BYTE *label) {
+	CK_TOKEN_INFO info;
+	CK_RV rv = list->C_GetTokenInfo(slot, &info);
+	if (rv == CKR_OK) {
+		memcpy(label, info.label, sizeof(info.label));
+	}
+	return rv;
+}
+
+static CK_RV openSession(CK_FUNCTION_LIST *list, CK_SLOT_ID slot, CK_SESSION_HANDLE *session) {
+	return list->C_OpenSession(slot, CKF_SERIAL_SESSION, NULL, NULL, session);
+}
+
+static CK_RV closeSession(CK_FUNCTION_LIST *list, CK_SESSION_HANDLE session) {
+	return list->C_CloseSession(session);
+}
+
+static CK_RV login(CK_FUNCTION_LIST *list, CK_SESSION_HANDLE session, CK_BYTE *pin, CK_ULONG pinLen) {
+	CK_RV rv = list->C_Login(session, CKU_USER, pin, pinLen);
+	if (rv == CKR_USER_ALREADY_LOGGED_IN) {
+		rv = CKR_OK;
+	}
+	return rv;
+}
+
+static CK_RV findKeys(CK_FUNCTION_LIST *list, CK_SESSION_HANDLE session, CK_BYTE *label, CK_ULONG labelLen,
+		CK_BYTE *id, CK_ULONG idLen, CK_OBJECT_HANDLE *keys, CK_ULONG max, CK_ULONG *count) {
+	CK_ULONG class = CKO_PRIVATE_KEY;
+	CK_ATTRIBUTE template[3];
+	CK_ULONG n = 0;
+	template[n].type = CKA_CLASS;
+	template[n].pValue = &class;
+	template[n++].ulValueLen = sizeof(class);
+	if (labelLen > 0) {
+		template[n].type = CKA_LABEL;
+		template[n].pValue = label;
+		template[n++].ulValueLen = labelLen;
+	}
+	if (idLen > 0) {
+		template[n].type = CKA_ID;
+		template[n].pValue = id;
+		template[n++].ulValueLen = idLen;
+	}
+	CK_RV rv = list->C_FindObjectsInit(session, template, n);
+	if (rv != CKR_OK) {
+		return rv;
+	}
+	rv = list->C_FindObjects(session, keys, max, count);
+	CK_RV final = list->C_FindObjectsFinal(session);
+	return rv != CKR_OK ? rv : final;
+}
+
+static CK_RV sign(CK_FUNCTION_LIST *list, CK_SESSION_HANDLE session, CK_OBJECT_HANDLE key, CK_ULONG mechanism,
+		CK_BYTE *data, CK_ULONG dataLen, CK_BYTE *signature, CK_ULONG *signatureLen) {
+	CK_MECHANISM m = {mechanism, NULL, 0};
+	CK_RV rv = list->C_SignInit(session, &m, key);
+	if (rv != CKR_OK) {
+		return rv;
+	}
+	return list->C_Sign(session, data, dataLen, signature, signatureLen);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// maxSignatureSize holds an RSA-16384 or any ECDSA signature
+const maxSignatureSize = 2048
+
+// modules are shared by every signer since libraries can only be initialized once per process
+var (
+	modulesMu sync.Mutex
+	modules   = map[string]*cModule{}
+)
+
+// cModule calls a PKCS #11 library loaded with dlopen
+type cModule struct {
+	list *C.CK_FUNCTION_LIST
+}
+
+func check(rv C.CK_RV) error {
+	if rv != C.CKR_OK {
+		return Error(rv)
+	}
+	return nil
+}
+
+func loadModule(path string) (module, error) {
+	modulesMu.Lock()
+	defer modulesMu.Unlock()
+	if m, ok := modules[path]; ok {
+		return m, nil
+	}
+	cPath := C.CString(path)
+	defer C.free(unsafe.Pointer(cPath))
+	var handle unsafe.Pointer
+	var list *C.CK_FUNCTION_LIST
+	var cErr *C.char
+	rv := C.load(cPath, &handle, &list, &cErr)
+	if cErr != nil {
+		defer C.free(unsafe.Pointer(cErr))
+		return nil, fmt.Errorf("pkcs11: failed to load %s: %s", path, C.GoString(cErr))
+	}
+	if err := check(rv); err != nil {
+		return nil, fmt.Errorf("pkcs11: failed to initialize %s: %v", path, err)
+	}
+	m := &cModule{list: list}
+	modules[path] = m
+	return m, nil
+}
+
+func (m *cModule) slots() ([]uint, error) {
+	var count C.CK_ULONG
+	if err := check(C.getSlotList(m.list, nil, &count)); err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	slots := make([]C.CK_SLOT_ID, count)
+	if err := check(C.getSlotList(m.list, &slots[0], &count)); err != nil {
+		return nil, err
+	}
+	ids := make([]uint, count)
+	for i := range ids {
+		ids[i] = uint(slots[i])
+	}
+	return ids, nil
+}
+
+func (m *cModule) tokenLabel(slot uint) (string, error) {
+	var label [32]C.CK_BYTE
+	if err := check(C.getTokenLabel(m.list, C.CK_SLOT_ID(slot), &label[0])); err != nil {
+		return "", err
+	}
+	// Labels are padded with spaces
+	return strings.TrimRight(C.GoStringN((*C.char)(unsafe.Pointer(&label[0])), 32), " \x00"), nil
+}
+
+func (m *cModule) openSession(slot uint) (uint, error) {
+	var session C.CK_SESSION_HANDLE
+	if err := check(C.openSession(m.list, C.CK_SLOT_ID(slot), &session)); err != nil {
+		return 0, err
+	}
+	return uint(session), nil
+}
+
+func (m *cModule) closeSession(session uint) error {
+	return check(C.closeSession(m.list, C.CK_SESSION_HANDLE(session)))
+}
+
+func (m *cModule) login(session uint, pin string) error {
+	cPin := C.CBytes([]byte(pin))
+	defer C.free(cPin)
+	return check(C.login(m.list, C.CK_SESSION_HANDLE(session), (*C.CK_BYTE)(cPin), C.CK_ULONG(len(pin))))
+}
+
+func (m *cModule) findKeys(session uint, label string, id []byte) ([]uint, error) {
+	cLabel := C.CBytes([]byte(label))
+	defer C.free(cLabel)
+	cID := C.CBytes(id)
+	defer C.free(cID)
+	// Two are enough to tell that the key is ambiguous
+	var keys [2]C.CK_OBJECT_HANDLE
+	var count C.CK_ULONG
+	if err := check(C.findKeys(m.list, C.CK_SESSION_HANDLE(session), (*C.CK_BYTE)(cLabel), C.CK_ULONG(len(label)),
+		(*C.CK_BYTE)(cID), C.CK_ULONG(len(id)), &keys[0], C.CK_ULONG(len(keys)), &count)); err != nil {
+		return nil, err
+	}
+	handles := make([]uint, count)
+	for i := range handles {
+		handles[i] = uint(keys[i])
+	}
+	return handles, nil
+}
+
+func (m *cModule) sign(session, key, mechanism uint, data []byte) ([]byte, error) {
+	cData := C.CBytes(data)
+	defer C.free(cData)
+	signature := C.malloc(maxSignatureSize)
+	defer C.free(signature)
+	length := C.CK_ULONG(maxSignatureSize)
+	if err := check(C.sign(m.list, C.CK_SESSION_HANDLE(session), C.CK_OBJECT_HANDLE(key), C.CK_ULONG(mechanism),
+		(*C.CK_BYTE)(cData), C.CK_ULONG(len(data)), (*C.CK_BYTE)(signature), &length)); err != nil {
+		return nil, err
+	}
+	return C.GoBytes(signature, C.int(length)), nil
+}
@@ -0,0 +1,220 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pkcs11 signs with private keys kept in a hardware security module or other PKCS #11 token. The vendor's
+// PKCS #11 library is loaded at runtime, which requires cgo.
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+)
+
+// Mechanisms used to sign digests
+const (
+	mechanismRSAPKCS = 0x1
+	mechanismECDSA   = 0x1041
+)
+
+// Error is a PKCS #11 return value other than CKR_OK, such as 0xA0 for CKR_PIN_INCORRECT
+type Error uint
+
+func (e Error) Error() string {
+	return fmt.Sprintf("pkcs11: error 0x%X", uint(e))
+}
+
+// module is the part of a PKCS #11 library the signer uses
+type module interface {
+	// slots lists the slots with a token present
+	slots() ([]uint, error)
+	tokenLabel(slot uint) (string, error)
+	openSession(slot uint) (uint, error)
+	login(session uint, pin string) error
+	// findKeys returns the private keys with the label and ID, either of which may be empty
+	findKeys(session uint, label string, id []byte) ([]uint, error)
+	sign(session, key, mechanism uint, data []byte) ([]byte, error)
+	closeSession(session uint) error
+}
+
+// Signer signs with a private key that doesn't leave the token. It supports RSA PKCS #1 v1.5 and ECDSA signatures.
+// Signatures are made one at a time with a single session.
+type Signer struct {
+	public  crypto.PublicKey
+	mu      sync.Mutex
+	module  module
+	session uint
+	key     uint
+}
+
+// NewSigner logs in to the token and finds the private key named by the URI. The public key, usually from the
+// key's certificate, determines how digests are signed.
+func NewSigner(uri string, public crypto.PublicKey) (*Signer, error) {
+	u, err := ParseURI(uri)
+	if err != nil {
+		return nil, err
+	}
+	return NewSignerFromURI(u, public)
+}
+
+// NewSignerFromURI is NewSigner for a URI that was already parsed, such as one whose PIN came from elsewhere
+func NewSignerFromURI(u *URI, public crypto.PublicKey) (*Signer, error) {
+	m, err := loadModule(u.ModulePath)
+	if err != nil {
+		return nil, err
+	}
+	return newSigner(m, u, public)
+}
+
+func newSigner(m module, u *URI, public crypto.PublicKey) (*Signer, error) {
+	switch public.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, errors.New("pkcs11: signing requires an RSA or ECDSA key")
+	}
+	slots, err := m.slots()
+	if err != nil {
+		return nil, err
+	}
+	for _, slot := range slots {
+		if u.SlotID != nil && slot != *u.SlotID {
+			continue
+		}
+		if u.Token != "" {
+			label, err := m.tokenLabel(slot)
+			if err != nil {
+				return nil, err
+			}
+			if label != u.Token {
+				continue
+			}
+		}
+		session, err := m.openSession(slot)
+		if err != nil {
+			return nil, err
+		}
+		key, err := findKey(m, session, u)
+		if err != nil {
+			m.closeSession(session)
+			return nil, err
+		}
+		if key != nil {
+			return &Signer{public: public, module: m, session: session, key: *key}, nil
+		}
+		m.closeSession(session)
+	}
+	return nil, fmt.Errorf("pkcs11: private key %s wasn't found", describe(u))
+}
+
+// findKey logs in and returns the key if the token has it
+func findKey(m module, session uint, u *URI) (*uint, error) {
+	if u.PIN != "" {
+		if err := m.login(session, u.PIN); err != nil {
+			return nil, err
+		}
+	}
+	keys, err := m.findKeys(session, u.Object, u.ID)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+	if len(keys) > 1 {
+		return nil, fmt.Errorf("pkcs11: %d private keys match %s", len(keys), describe(u))
+	}
+	return &keys[0], nil
+}
+
+// describe names the key in errors without the PIN
+func describe(u *URI) string {
+	s := fmt.Sprintf("object=%q", u.Object)
+	if len(u.ID) > 0 {
+		s += fmt.Sprintf(" id=%x", u.ID)
+	}
+	if u.Token != "" {
+		s += fmt.Sprintf(" token=%q", u.Token)
+	}
+	return s
+}
+
+// Public returns the public key given to NewSigner
+func (s *Signer) Public() crypto.PublicKey {
+	return s.public
+}
+
+// digestInfoPrefixes are the DER encoded DigestInfo headers that precede digests in PKCS #1 v1.5 signatures
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA224: {0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x04, 0x05, 0x00, 0x04, 0x1c},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// Sign signs the digest on the token. ECDSA signatures are returned in ASN.1 like ecdsa.SignASN1.
+func (s *Signer) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != 0 && len(digest) != opts.HashFunc().Size() {
+		return nil, errors.New("pkcs11: digest length doesn't match the hash function")
+	}
+	switch s.public.(type) {
+	case *rsa.PublicKey:
+		if _, ok := opts.(*rsa.PSSOptions); ok {
+			return nil, errors.New("pkcs11: RSA-PSS signatures aren't supported")
+		}
+		prefix, ok := digestInfoPrefixes[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("pkcs11: unsupported hash function %v", opts.HashFunc())
+		}
+		return s.sign(mechanismRSAPKCS, append(append([]byte{}, prefix...), digest...))
+	default:
+		signature, err := s.sign(mechanismECDSA, digest)
+		if err != nil {
+			return nil, err
+		}
+		// Tokens return r and s concatenated
+		if len(signature) == 0 || len(signature)%2 != 0 {
+			return nil, errors.New("pkcs11: invalid ECDSA signature from token")
+		}
+		half := len(signature) / 2
+		return asn1.Marshal(struct{ R, S *big.Int }{
+			new(big.Int).SetBytes(signature[:half]),
+			new(big.Int).SetBytes(signature[half:]),
+		})
+	}
+}
+
+func (s *Signer) sign(mechanism uint, data []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.module == nil {
+		return nil, errors.New("pkcs11: signer is closed")
+	}
+	return s.module.sign(s.session, s.key, mechanism, data)
+}
+
+// Close ends the signer's session. The library stays loaded for other signers.
+func (s *Signer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.module == nil {
+		return nil
+	}
+	err := s.module.closeSession(s.session)
+	s.module = nil
+	return err
+}
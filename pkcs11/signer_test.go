@@ -0,0 +1,179 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeModule is a token in slot 2 labeled idp with one key labeled signing
+type fakeModule struct {
+	key      crypto.Signer
+	pin      string
+	loggedIn bool
+	sessions int
+}
+
+func (m *fakeModule) slots() ([]uint, error) {
+	return []uint{1, 2}, nil
+}
+
+func (m *fakeModule) tokenLabel(slot uint) (string, error) {
+	if slot == 2 {
+		return "idp", nil
+	}
+	return "other", nil
+}
+
+func (m *fakeModule) openSession(slot uint) (uint, error) {
+	m.sessions++
+	return slot, nil
+}
+
+func (m *fakeModule) login(session uint, pin string) error {
+	if pin != m.pin {
+		return Error(0xA0)
+	}
+	m.loggedIn = true
+	return nil
+}
+
+func (m *fakeModule) findKeys(session uint, label string, id []byte) ([]uint, error) {
+	if session != 2 || !m.loggedIn || (label != "" && label != "signing") || (id != nil && string(id) != "\x01") {
+		return nil, nil
+	}
+	return []uint{7}, nil
+}
+
+func (m *fakeModule) sign(session, key, mechanism uint, data []byte) ([]byte, error) {
+	if key != 7 {
+		return nil, Error(0x60)
+	}
+	switch k := m.key.(type) {
+	case *rsa.PrivateKey:
+		if mechanism != mechanismRSAPKCS {
+			return nil, Error(0x70)
+		}
+		// The data already has the DigestInfo
+		return rsa.SignPKCS1v15(rand.Reader, k, 0, data)
+	case *ecdsa.PrivateKey:
+		if mechanism != mechanismECDSA {
+			return nil, Error(0x70)
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, k, data)
+		if err != nil {
+			return nil, err
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		signature := make([]byte, 2*size)
+		r.FillBytes(signature[:size])
+		s.FillBytes(signature[size:])
+		return signature, nil
+	}
+	return nil, errors.New("unsupported key")
+}
+
+func (m *fakeModule) closeSession(session uint) error {
+	m.sessions--
+	return nil
+}
+
+func TestSigner_Sign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &fakeModule{key: rsaKey, pin: "1234"}
+	signer, err := newSigner(m, &URI{Token: "idp", Object: "signing", PIN: "1234"}, rsaKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, m.sessions, "sessions for slots without the key should be closed")
+	assert.Equal(t, rsaKey.Public(), signer.Public())
+	for hash, sum := range map[crypto.Hash][]byte{
+		crypto.SHA1:   sha1.New().Sum(nil),
+		crypto.SHA256: sha256.New().Sum(nil),
+		crypto.SHA384: sha512.New384().Sum(nil),
+		crypto.SHA512: sha512.New().Sum(nil),
+	} {
+		signature, err := signer.Sign(rand.Reader, sum, hash)
+		if assert.NoError(t, err) {
+			assert.NoError(t, rsa.VerifyPKCS1v15(&rsaKey.PublicKey, hash, sum, signature), "DigestInfo for %v", hash)
+		}
+	}
+	_, err = signer.Sign(rand.Reader, sha256.New().Sum(nil), &rsa.PSSOptions{Hash: crypto.SHA256})
+	assert.Error(t, err, "RSA-PSS isn't supported")
+	_, err = signer.Sign(rand.Reader, []byte{1, 2, 3}, crypto.SHA256)
+	assert.Error(t, err, "the digest is too short")
+
+	assert.NoError(t, signer.Close())
+	assert.Equal(t, 0, m.sessions)
+	_, err = signer.Sign(rand.Reader, sha256.New().Sum(nil), crypto.SHA256)
+	assert.Error(t, err, "the signer is closed")
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err = newSigner(&fakeModule{key: ecKey, pin: "1234"}, &URI{ID: []byte{1}, PIN: "1234"}, ecKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.New().Sum(nil)
+	signature, err := signer.Sign(rand.Reader, sum, crypto.SHA256)
+	if assert.NoError(t, err) {
+		assert.True(t, ecdsa.VerifyASN1(&ecKey.PublicKey, sum, signature), "ECDSA signatures should be ASN.1")
+	}
+}
+
+func TestNewSigner_errors(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slot := uint(1)
+	tests := []struct {
+		name   string
+		uri    *URI
+		public crypto.PublicKey
+	}{
+		{"wrong PIN", &URI{Object: "signing", PIN: "0000"}, rsaKey.Public()},
+		{"other label", &URI{Object: "encryption", PIN: "1234"}, rsaKey.Public()},
+		{"other token", &URI{Token: "other", Object: "signing", PIN: "1234"}, rsaKey.Public()},
+		{"other slot", &URI{SlotID: &slot, Object: "signing", PIN: "1234"}, rsaKey.Public()},
+		{"unsupported key", &URI{Object: "signing", PIN: "1234"}, "key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &fakeModule{key: rsaKey, pin: "1234"}
+			_, err := newSigner(m, tt.uri, tt.public)
+			assert.Error(t, err)
+			assert.Equal(t, 0, m.sessions, "sessions should be closed")
+		})
+	}
+	_, err = NewSigner("pkcs11:object=signing?module-path=missing.so", rsaKey.Public())
+	assert.Error(t, err)
+}
@@ -0,0 +1,137 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Scheme starts the URIs of PKCS #11 objects
+const Scheme = "pkcs11:"
+
+// URI identifies a private key on a token with the attributes from RFC 7512, such as
+// pkcs11:token=idp;object=signing?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234
+type URI struct {
+	// Token is the label of the token, any token with the key is used if it's empty
+	Token string
+	// SlotID selects the slot with the token when it's set
+	SlotID *uint
+	// Object is the label of the key
+	Object string
+	// ID is the key's identifier, which can be used instead of or along with the label
+	ID []byte
+	// ModulePath is the PKCS #11 library from the HSM vendor
+	ModulePath string
+	// PIN logs in to the token, from pin-value or read from the file in pin-source
+	PIN string
+}
+
+// IsURI reports whether the value is a PKCS #11 URI instead of a file name
+func IsURI(value string) bool {
+	return len(value) >= len(Scheme) && strings.EqualFold(value[:len(Scheme)], Scheme)
+}
+
+// ParseURI reads a PKCS #11 URI. The module-path query attribute and either the object or the id path attribute
+// are required. Errors don't include the PIN.
+func ParseURI(value string) (*URI, error) {
+	if !IsURI(value) {
+		return nil, errors.New("pkcs11: URI must start with pkcs11:")
+	}
+	path, query := value[len(Scheme):], ""
+	if q := strings.IndexByte(path, '?'); q >= 0 {
+		path, query = path[:q], path[q+1:]
+	}
+	u := &URI{}
+	for _, attr := range splitAttributes(path, ";") {
+		name, value, err := readAttribute(attr)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "token":
+			u.Token = value
+		case "object":
+			u.Object = value
+		case "id":
+			u.ID = []byte(value)
+		case "slot-id":
+			id, err := strconv.ParseUint(value, 10, 0)
+			if err != nil {
+				return nil, fmt.Errorf("pkcs11: invalid slot-id %q", value)
+			}
+			slot := uint(id)
+			u.SlotID = &slot
+		case "type":
+			if value != "private" {
+				return nil, fmt.Errorf("pkcs11: the URI must name a private key, not a %s object", value)
+			}
+		default:
+			return nil, fmt.Errorf("pkcs11: unsupported path attribute %s", name)
+		}
+	}
+	for _, attr := range splitAttributes(query, "&") {
+		name, value, err := readAttribute(attr)
+		if err != nil {
+			return nil, err
+		}
+		switch name {
+		case "module-path":
+			u.ModulePath = value
+		case "pin-value":
+			u.PIN = value
+		case "pin-source":
+			data, err := ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
+			if err != nil {
+				return nil, fmt.Errorf("pkcs11: failed to read pin-source: %v", err)
+			}
+			u.PIN = strings.TrimRight(string(data), "\r\n")
+		default:
+			return nil, fmt.Errorf("pkcs11: unsupported query attribute %s", name)
+		}
+	}
+	if u.ModulePath == "" {
+		return nil, errors.New("pkcs11: the URI must include a module-path")
+	}
+	if u.Object == "" && len(u.ID) == 0 {
+		return nil, errors.New("pkcs11: the URI must include the object or id of the key")
+	}
+	return u, nil
+}
+
+func splitAttributes(s, sep string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, sep)
+}
+
+// readAttribute splits a percent-encoded name=value attribute
+func readAttribute(attr string) (string, string, error) {
+	eq := strings.IndexByte(attr, '=')
+	if eq < 0 {
+		return "", "", fmt.Errorf("pkcs11: attribute %q doesn't have a value", attr)
+	}
+	name := attr[:eq]
+	value, err := url.PathUnescape(attr[eq+1:])
+	if err != nil {
+		return "", "", fmt.Errorf("pkcs11: invalid value for %s", name)
+	}
+	return name, value, nil
+}
@@ -0,0 +1,77 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkcs11
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseURI(t *testing.T) {
+	u, err := ParseURI("pkcs11:token=IdP%20HSM;object=signing;id=%01%02;slot-id=3;type=private" +
+		"?module-path=/usr/lib/softhsm/libsofthsm2.so&pin-value=1234")
+	if assert.NoError(t, err) {
+		assert.Equal(t, "IdP HSM", u.Token)
+		assert.Equal(t, "signing", u.Object)
+		assert.Equal(t, []byte{1, 2}, u.ID)
+		if assert.NotNil(t, u.SlotID) {
+			assert.Equal(t, uint(3), *u.SlotID)
+		}
+		assert.Equal(t, "/usr/lib/softhsm/libsofthsm2.so", u.ModulePath)
+		assert.Equal(t, "1234", u.PIN)
+	}
+
+	dir, err := ioutil.TempDir("", "pkcs11")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pin := filepath.Join(dir, "pin")
+	if err = ioutil.WriteFile(pin, []byte("5678\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	u, err = ParseURI("PKCS11:object=signing?module-path=/lib/p11.so&pin-source=file:" + pin)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "5678", u.PIN, "the newline should be trimmed from the pin-source")
+		assert.Nil(t, u.SlotID)
+	}
+
+	for _, uri := range []string{
+		"/etc/lite-idp/signing-key.pem",
+		"pkcs11:object=signing",
+		"pkcs11:token=idp?module-path=/lib/p11.so",
+		"pkcs11:object=signing;type=cert?module-path=/lib/p11.so",
+		"pkcs11:object=signing;slot-id=one?module-path=/lib/p11.so",
+		"pkcs11:object=signing;library-version=1?module-path=/lib/p11.so",
+		"pkcs11:object?module-path=/lib/p11.so",
+		"pkcs11:object=signing?module-path=/lib/p11.so&pin-source=missing",
+	} {
+		_, err = ParseURI(uri + "&pin-value=secret")
+		if assert.Error(t, err, uri) {
+			assert.False(t, strings.Contains(err.Error(), "secret"), "errors shouldn't include the PIN")
+		}
+	}
+}
+
+func TestIsURI(t *testing.T) {
+	assert.True(t, IsURI("pkcs11:object=signing"))
+	assert.False(t, IsURI("signing-key.pem"))
+	assert.False(t, IsURI("pkcs"))
+}
@@ -19,18 +19,20 @@ import (
 	"net"
 	"time"
 
+	"github.com/amdonov/lite-idp/dsig"
 	"github.com/amdonov/xmlsig"
 )
 
 type Subject struct {
 	XMLName             xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Subject"`
 	NameID              *NameID
+	EncryptedID         *EncryptedID
 	SubjectConfirmation *SubjectConfirmation
 }
 
 type Issuer struct {
 	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
-	Format  string   `xml:",attr"`
+	Format  string   `xml:",attr,omitempty"`
 	Value   string   `xml:",chardata"`
 }
 
@@ -53,11 +55,12 @@ type AuthnContext struct {
 }
 
 type AuthnStatement struct {
-	XMLName         xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnStatement"`
-	AuthnInstant    time.Time `xml:",attr"`
-	SessionIndex    string    `xml:",attr"`
-	SubjectLocality *SubjectLocality
-	AuthnContext    *AuthnContext
+	XMLName             xml.Name   `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnStatement"`
+	AuthnInstant        time.Time  `xml:",attr"`
+	SessionIndex        string     `xml:",attr"`
+	SessionNotOnOrAfter *time.Time `xml:",attr,omitempty"`
+	SubjectLocality     *SubjectLocality
+	AuthnContext        *AuthnContext
 }
 
 type AttributeValue struct {
@@ -67,9 +70,9 @@ type AttributeValue struct {
 
 type Attribute struct {
 	XMLName        xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Attribute"`
-	FriendlyName   string   `xml:",attr"`
+	FriendlyName   string   `xml:",attr,omitempty"`
 	Name           string   `xml:",attr"`
-	NameFormat     string   `xml:",attr"`
+	NameFormat     string   `xml:",attr,omitempty"`
 	AttributeValue []AttributeValue
 }
 
@@ -83,6 +86,7 @@ type NameID struct {
 	Format          string   `xml:",attr"`
 	NameQualifier   string   `xml:",attr"`
 	SPNameQualifier string   `xml:",attr"`
+	SPProvidedID    string   `xml:",attr,omitempty"`
 	Value           string   `xml:",chardata"`
 }
 
@@ -95,14 +99,18 @@ type SubjectConfirmation struct {
 type SubjectConfirmationData struct {
 	XMLName      xml.Name  `xml:"urn:oasis:names:tc:SAML:2.0:assertion SubjectConfirmationData"`
 	Address      net.IP    `xml:",attr"`
-	InResponseTo string    `xml:",attr"`
+	InResponseTo string    `xml:",attr,omitempty"`
 	NotOnOrAfter time.Time `xml:",attr"`
 	Recipient    string    `xml:",attr"`
+	// Set for holder-of-key confirmation, when the data is a KeyInfoConfirmationDataType holding the key's KeyInfo
+	XMLNSXSI string          `xml:"xmlns:xsi,attr,omitempty"`
+	Type     string          `xml:"xsi:type,attr,omitempty"`
+	KeyInfo  *xmlsig.KeyInfo `xml:",omitempty"`
 }
 
 type AudienceRestriction struct {
 	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion AudienceRestriction"`
-	Audience string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Audience"`
+	Audience []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Audience"`
 }
 
 type Assertion struct {
@@ -111,10 +119,21 @@ type Assertion struct {
 	Version            string    `xml:",attr"`
 	IssueInstant       time.Time `xml:",attr"`
 	Issuer             *Issuer
-	Signature          *xmlsig.Signature
+	Signature          *dsig.Signature
 	Subject            *Subject
 	Conditions         *Conditions
+	Advice             *Advice
 	AuthnStatement     *AuthnStatement
 	AttributeStatement *AttributeStatement
 	RawXML             string `xml:"-"`
 }
+
+// Advice is additional information the issuer gives relying parties along with an assertion
+type Advice struct {
+	XMLName         xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Advice"`
+	AssertionIDRef  []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AssertionIDRef,omitempty"`
+	AssertionURIRef []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AssertionURIRef,omitempty"`
+	// Elements from other namespaces, written after the references. The XML has to declare the namespaces it uses.
+	// When an Advice is read, it holds everything in the element.
+	Other string `xml:",innerxml"`
+}
@@ -0,0 +1,72 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saml
+
+import (
+	"encoding/xml"
+
+	"github.com/amdonov/xmlsig"
+)
+
+type EncryptedAssertion struct {
+	XMLName       xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion EncryptedAssertion"`
+	EncryptedData EncryptedData
+}
+
+// EncryptedID holds a NameID. The key may be in the EncryptedData's KeyInfo or follow it.
+type EncryptedID struct {
+	XMLName       xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion EncryptedID"`
+	EncryptedData EncryptedData
+	EncryptedKey  []EncryptedKey
+}
+
+type EncryptedData struct {
+	XMLName          xml.Name `xml:"http://www.w3.org/2001/04/xmlenc# EncryptedData"`
+	ID               string   `xml:"Id,attr,omitempty"`
+	Type             string   `xml:",attr,omitempty"`
+	EncryptionMethod EncryptionMethod
+	KeyInfo          *EncryptedKeyInfo
+	CipherData       CipherData
+}
+
+type EncryptedKeyInfo struct {
+	XMLName      xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# KeyInfo"`
+	EncryptedKey *EncryptedKey
+}
+
+type EncryptedKey struct {
+	XMLName          xml.Name `xml:"http://www.w3.org/2001/04/xmlenc# EncryptedKey"`
+	ID               string   `xml:"Id,attr,omitempty"`
+	Recipient        string   `xml:",attr,omitempty"`
+	EncryptionMethod EncryptionMethod
+	KeyInfo          *xmlsig.KeyInfo
+	CipherData       CipherData
+}
+
+type EncryptionMethod struct {
+	XMLName      xml.Name      `xml:"http://www.w3.org/2001/04/xmlenc# EncryptionMethod"`
+	Algorithm    string        `xml:",attr"`
+	DigestMethod *DigestMethod `xml:",omitempty"`
+}
+
+type DigestMethod struct {
+	XMLName   xml.Name `xml:"http://www.w3.org/2000/09/xmldsig# DigestMethod"`
+	Algorithm string   `xml:",attr"`
+}
+
+type CipherData struct {
+	XMLName     xml.Name `xml:"http://www.w3.org/2001/04/xmlenc# CipherData"`
+	CipherValue string   `xml:"http://www.w3.org/2001/04/xmlenc# CipherValue"`
+}
@@ -0,0 +1,71 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package saml
+
+import (
+	"encoding/xml"
+
+	"github.com/amdonov/lite-idp/dsig"
+)
+
+// ManageNameIDRequest changes the SPProvidedID of a NameID with NewID or NewEncryptedID, or ends its use with Terminate
+type ManageNameIDRequest struct {
+	RequestAbstractType
+	XMLName        xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol ManageNameIDRequest"`
+	Signature      *dsig.Signature
+	NameID         *NameID
+	EncryptedID    *EncryptedID
+	NewID          *string `xml:"urn:oasis:names:tc:SAML:2.0:protocol NewID"`
+	NewEncryptedID *NewEncryptedID
+	Terminate      *Terminate
+}
+
+// NewEncryptedID holds a NewID encrypted for the IdP
+type NewEncryptedID struct {
+	XMLName       xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NewEncryptedID"`
+	EncryptedData EncryptedData
+	EncryptedKey  []EncryptedKey
+}
+
+// Terminate ends the use of a NameID
+type Terminate struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Terminate"`
+}
+
+type ManageNameIDResponse struct {
+	StatusResponseType
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol ManageNameIDResponse"`
+}
+
+type ManageNameIDRequestEnv struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    ManageNameIDRequestBody
+}
+
+type ManageNameIDRequestBody struct {
+	XMLName    xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	RawRequest string   `xml:",innerxml"`
+	Request    ManageNameIDRequest
+}
+
+type ManageNameIDResponseEnv struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    ManageNameIDResponseBody
+}
+
+type ManageNameIDResponseBody struct {
+	XMLName  xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	Response ManageNameIDResponse
+}
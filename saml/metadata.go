@@ -16,15 +16,70 @@ package saml
 
 import (
 	"encoding/xml"
+	"time"
 
+	"github.com/amdonov/lite-idp/dsig"
 	"github.com/amdonov/xmlsig"
 )
 
 type EntityDescriptor struct {
-	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
-	ID        string   `xml:",attr"`
-	EntityID  string   `xml:"entityID,attr"`
-	Signature *xmlsig.Signature
+	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	ID       string   `xml:",attr"`
+	EntityID string   `xml:"entityID,attr"`
+	// Time after which the metadata must not be trusted
+	ValidUntil *time.Time `xml:"validUntil,attr,omitempty"`
+	// How long the metadata can be cached before it's fetched again, an xs:duration such as PT24H
+	CacheDuration string `xml:"cacheDuration,attr,omitempty"`
+	Signature     *dsig.Signature
+	Extensions    *Extensions
+}
+
+// EntitiesDescriptor is an aggregate of the metadata of many entities, such as a federation's. Aggregates can be nested.
+type EntitiesDescriptor struct {
+	XMLName            xml.Name   `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntitiesDescriptor"`
+	ID                 string     `xml:",attr,omitempty"`
+	Name               string     `xml:",attr,omitempty"`
+	ValidUntil         *time.Time `xml:"validUntil,attr,omitempty"`
+	Signature          *dsig.Signature
+	EntitiesDescriptor []EntitiesDescriptor
+	EntityDescriptor   []SPEntityDescriptor
+}
+
+type Extensions struct {
+	XMLName          xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata Extensions"`
+	EntityAttributes *EntityAttributes
+	UIInfo           *UIInfo
+	DigestMethod     []AlgorithmMethod `xml:"urn:oasis:names:tc:SAML:metadata:algsupport DigestMethod"`
+	SigningMethod    []AlgorithmMethod `xml:"urn:oasis:names:tc:SAML:metadata:algsupport SigningMethod"`
+}
+
+// EntityAttributes holds attributes of the entity itself, such as its entity categories
+type EntityAttributes struct {
+	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:metadata:attribute EntityAttributes"`
+	Attribute []Attribute
+}
+
+// UIInfo describes the entity to users
+type UIInfo struct {
+	XMLName             xml.Name        `xml:"urn:oasis:names:tc:SAML:metadata:ui UIInfo"`
+	DisplayName         []LocalizedName `xml:"urn:oasis:names:tc:SAML:metadata:ui DisplayName"`
+	Description         []LocalizedName `xml:"urn:oasis:names:tc:SAML:metadata:ui Description"`
+	Logo                []Logo
+	InformationURL      []LocalizedName `xml:"urn:oasis:names:tc:SAML:metadata:ui InformationURL"`
+	PrivacyStatementURL []LocalizedName `xml:"urn:oasis:names:tc:SAML:metadata:ui PrivacyStatementURL"`
+}
+
+// Logo is the location of an image of the given size in pixels
+type Logo struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:metadata:ui Logo"`
+	Height  uint     `xml:"height,attr"`
+	Width   uint     `xml:"width,attr"`
+	Lang    string   `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Value   string   `xml:",chardata"`
+}
+
+type AlgorithmMethod struct {
+	Algorithm string `xml:",attr"`
 }
 
 type SPEntityDescriptor struct {
@@ -36,16 +91,42 @@ type IDPEntityDescriptor struct {
 	EntityDescriptor
 	IDPSSODescriptor             IDPSSODescriptor
 	AttributeAuthorityDescriptor AttributeAuthorityDescriptor
+	Organization                 *Organization
+	ContactPerson                []ContactPerson
+}
+
+type Organization struct {
+	XMLName                 xml.Name        `xml:"urn:oasis:names:tc:SAML:2.0:metadata Organization"`
+	OrganizationName        []LocalizedName `xml:"OrganizationName"`
+	OrganizationDisplayName []LocalizedName `xml:"OrganizationDisplayName"`
+	OrganizationURL         []LocalizedName `xml:"OrganizationURL"`
+}
+
+// LocalizedName is a value in the language given by xml:lang
+type LocalizedName struct {
+	Lang  string `xml:"http://www.w3.org/XML/1998/namespace lang,attr"`
+	Value string `xml:",chardata"`
+}
+
+type ContactPerson struct {
+	XMLName         xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata ContactPerson"`
+	ContactType     string   `xml:"contactType,attr"`
+	GivenName       string   `xml:"GivenName,omitempty"`
+	EmailAddress    []string `xml:"EmailAddress"`
+	TelephoneNumber []string `xml:"TelephoneNumber"`
 }
 
 type IDPSSODescriptor struct {
 	XMLName                    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata IDPSSODescriptor"`
 	ProtocolSupportEnumeration string   `xml:"protocolSupportEnumeration,attr"`
 	WantAuthnRequestsSigned    bool     `xml:",attr"`
-	KeyDescriptor              KeyDescriptor
+	Extensions                 *Extensions
+	KeyDescriptor              []KeyDescriptor
 	ArtifactResolutionService  ArtifactResolutionService
-	NameIDFormat               string `xml:"NameIDFormat"`
-	SingleSignOnService        SingleSignOnService
+	SingleLogoutService        []SingleLogoutService
+	ManageNameIDService        []ManageNameIDService
+	NameIDFormat               []string `xml:"NameIDFormat"`
+	SingleSignOnService        []SingleSignOnService
 }
 
 type Service struct {
@@ -61,7 +142,7 @@ type AttributeService struct {
 type AttributeAuthorityDescriptor struct {
 	XMLName                    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata AttributeAuthorityDescriptor"`
 	ProtocolSupportEnumeration string   `xml:"protocolSupportEnumeration,attr"`
-	KeyDescriptor              KeyDescriptor
+	KeyDescriptor              []KeyDescriptor
 	AttributeService           AttributeService
 	NameIDFormat               string `xml:"NameIDFormat"`
 }
@@ -71,6 +152,18 @@ type SingleSignOnService struct {
 	Service
 }
 
+type SingleLogoutService struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata SingleLogoutService"`
+	Service
+	ResponseLocation string `xml:",attr,omitempty"`
+}
+
+type ManageNameIDService struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata ManageNameIDService"`
+	Service
+	ResponseLocation string `xml:",attr,omitempty"`
+}
+
 type ArtifactResolutionService struct {
 	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata ArtifactResolutionService"`
 	Service
@@ -82,8 +175,13 @@ type SPSSODescriptor struct {
 	AuthnRequestsSigned        bool     `xml:",attr"`
 	WantAssertionsSigned       bool     `xml:",attr"`
 	ProtocolSupportEnumeration string   `xml:"protocolSupportEnumeration,attr"`
+	Extensions                 *Extensions
+	SingleLogoutService        []SingleLogoutService
+	ManageNameIDService        []ManageNameIDService
+	NameIDFormat               []string `xml:"NameIDFormat"`
 	AssertionConsumerService   []AssertionConsumerService
-	KeyDescriptor              KeyDescriptor
+	AttributeConsumingService  []AttributeConsumingService
+	KeyDescriptor              []KeyDescriptor
 }
 
 type AssertionConsumerService struct {
@@ -93,6 +191,25 @@ type AssertionConsumerService struct {
 	Index     uint32 `xml:"index,attr"`
 }
 
+// AttributeConsumingService lists the attributes a service provider asks for. AuthnRequests select one by index.
+type AttributeConsumingService struct {
+	XMLName            xml.Name        `xml:"urn:oasis:names:tc:SAML:2.0:metadata AttributeConsumingService"`
+	Index              uint32          `xml:"index,attr"`
+	IsDefault          bool            `xml:"isDefault,attr,omitempty"`
+	ServiceName        []LocalizedName `xml:"urn:oasis:names:tc:SAML:2.0:metadata ServiceName"`
+	RequestedAttribute []RequestedAttribute
+}
+
+// RequestedAttribute is an attribute a service provider asks for, with the values it accepts if it lists any
+type RequestedAttribute struct {
+	XMLName        xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata RequestedAttribute"`
+	Name           string   `xml:",attr"`
+	NameFormat     string   `xml:",attr,omitempty"`
+	FriendlyName   string   `xml:",attr,omitempty"`
+	IsRequired     bool     `xml:"isRequired,attr,omitempty"`
+	AttributeValue []AttributeValue
+}
+
 type KeyDescriptor struct {
 	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata KeyDescriptor"`
 	Use     string   `xml:"use,attr,omitempty"`
@@ -18,15 +18,56 @@ import (
 	"encoding/xml"
 	"time"
 
-	"github.com/amdonov/xmlsig"
+	"github.com/amdonov/lite-idp/dsig"
 )
 
 type AuthnRequest struct {
 	RequestAbstractType
-	XMLName                       xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
-	AssertionConsumerServiceURL   string   `xml:",attr"`
-	ProtocolBinding               string   `xml:",attr"`
-	AssertionConsumerServiceIndex uint32   `xml:",attr"`
+	XMLName                        xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	AssertionConsumerServiceURL    string   `xml:",attr"`
+	ProtocolBinding                string   `xml:",attr"`
+	AssertionConsumerServiceIndex  *uint32  `xml:",attr,omitempty"`
+	AttributeConsumingServiceIndex *uint32  `xml:",attr,omitempty"`
+	ForceAuthn                     bool     `xml:",attr,omitempty"`
+	IsPassive                      bool     `xml:",attr,omitempty"`
+	Signature                      *dsig.Signature
+	NameIDPolicy                   *NameIDPolicy
+	RequestedAuthnContext          *RequestedAuthnContext
+	Scoping                        *Scoping
+}
+
+type NameIDPolicy struct {
+	XMLName         xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+	Format          string   `xml:",attr,omitempty"`
+	SPNameQualifier string   `xml:",attr,omitempty"`
+	AllowCreate     bool     `xml:",attr,omitempty"`
+}
+
+type RequestedAuthnContext struct {
+	XMLName              xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol RequestedAuthnContext"`
+	Comparison           string   `xml:",attr,omitempty"`
+	AuthnContextClassRef []string `xml:"urn:oasis:names:tc:SAML:2.0:assertion AuthnContextClassRef"`
+}
+
+// Scoping limits the identity providers that may authenticate the user for a request that can be proxied
+type Scoping struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Scoping"`
+	// ProxyCount is the number of times the request may still be proxied, unlimited if it's nil
+	ProxyCount  *int `xml:",attr,omitempty"`
+	IDPList     *IDPList
+	RequesterID []string `xml:"urn:oasis:names:tc:SAML:2.0:protocol RequesterID"`
+}
+
+type IDPList struct {
+	XMLName     xml.Name   `xml:"urn:oasis:names:tc:SAML:2.0:protocol IDPList"`
+	IDPEntry    []IDPEntry `xml:"urn:oasis:names:tc:SAML:2.0:protocol IDPEntry"`
+	GetComplete string     `xml:"urn:oasis:names:tc:SAML:2.0:protocol GetComplete,omitempty"`
+}
+
+type IDPEntry struct {
+	ProviderID string `xml:",attr"`
+	Name       string `xml:",attr,omitempty"`
+	Loc        string `xml:",attr,omitempty"`
 }
 
 type ArtifactResolveEnvelope struct {
@@ -36,6 +77,7 @@ type ArtifactResolveEnvelope struct {
 
 type ArtifactResolveBody struct {
 	XMLName         xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	RawRequest      string   `xml:",innerxml"`
 	ArtifactResolve ArtifactResolve
 }
 
@@ -43,7 +85,7 @@ type ArtifactResolve struct {
 	RequestAbstractType
 	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol ArtifactResolve"`
 	Artifact  string   `xml:"urn:oasis:names:tc:SAML:2.0:protocol Artifact"`
-	Signature *xmlsig.Signature
+	Signature *dsig.Signature
 }
 
 type ArtifactResponseEnvelope struct {
@@ -62,21 +104,95 @@ type ArtifactResponse struct {
 	Response Response
 }
 
+type ECPRequestEnvelope struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    ECPRequestBody
+}
+
+type ECPRequestBody struct {
+	XMLName      xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	RawRequest   string   `xml:",innerxml"`
+	AuthnRequest AuthnRequest
+}
+
+type ECPResponseEnvelope struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Header  ECPResponseHeader
+	Body    ECPResponseBody
+}
+
+type ECPResponseHeader struct {
+	XMLName  xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Header"`
+	Response ECPResponse
+}
+
+type ECPResponse struct {
+	XMLName                     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:profiles:SSO:ecp Response"`
+	MustUnderstand              string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ mustUnderstand,attr"`
+	Actor                       string   `xml:"http://schemas.xmlsoap.org/soap/envelope/ actor,attr"`
+	AssertionConsumerServiceURL string   `xml:",attr"`
+}
+
+type ECPResponseBody struct {
+	XMLName  xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	Response Response
+}
+
 type Response struct {
 	StatusResponseType
-	XMLName      xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Response"`
-	RawAssertion string   `xml:",innerxml"`
-	Assertion    *Assertion
+	XMLName            xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Response"`
+	RawAssertion       string   `xml:",innerxml"`
+	Assertion          *Assertion
+	EncryptedAssertion *EncryptedAssertion
+}
+
+type LogoutRequest struct {
+	RequestAbstractType
+	XMLName      xml.Name   `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutRequest"`
+	Reason       string     `xml:",attr,omitempty"`
+	NotOnOrAfter *time.Time `xml:",attr,omitempty"`
+	Signature    *dsig.Signature
+	NameID       *NameID
+	SessionIndex []string `xml:"urn:oasis:names:tc:SAML:2.0:protocol SessionIndex"`
+}
+
+type LogoutResponse struct {
+	StatusResponseType
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutResponse"`
+}
+
+type LogoutRequestEnv struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    LogoutRequestBody
+}
+
+type LogoutRequestBody struct {
+	XMLName    xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	RawRequest string   `xml:",innerxml"`
+	Request    LogoutRequest
+}
+
+type LogoutResponseEnv struct {
+	XMLName xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Envelope"`
+	Body    LogoutResponseBody
+}
+
+type LogoutResponseBody struct {
+	XMLName     xml.Name `xml:"http://schemas.xmlsoap.org/soap/envelope/ Body"`
+	RawResponse string   `xml:",innerxml"`
+	Response    LogoutResponse
 }
 
 type Status struct {
-	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
-	StatusCode StatusCode
+	XMLName       xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+	StatusCode    StatusCode
+	StatusMessage string `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusMessage,omitempty"`
 }
 
 type StatusCode struct {
-	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
-	Value   string   `xml:",attr"`
+	XMLName    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
+	Value      string   `xml:",attr"`
+	StatusCode *StatusCode
 }
 
 type RequestAbstractType struct {
@@ -92,7 +208,8 @@ type StatusResponseType struct {
 	Version      string    `xml:",attr"`
 	IssueInstant time.Time `xml:",attr"`
 	Issuer       *Issuer
+	Signature    *dsig.Signature
 	Destination  string `xml:",attr,omitempty"`
-	InResponseTo string `xml:",attr"`
+	InResponseTo string `xml:",attr,omitempty"`
 	Status       *Status
 }
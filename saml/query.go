@@ -3,7 +3,7 @@ package saml
 import (
 	"encoding/xml"
 
-	"github.com/amdonov/xmlsig"
+	"github.com/amdonov/lite-idp/dsig"
 )
 
 type AttributeQueryEnv struct {
@@ -18,9 +18,11 @@ type AttributeQueryBody struct {
 
 type AttributeQuery struct {
 	RequestAbstractType
-	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AttributeQuery"`
-	Subject   Subject
-	Signature *xmlsig.Signature
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AttributeQuery"`
+	Subject Subject
+	// Attributes the service provider wants, all of them if it's empty
+	Attribute []Attribute `xml:"urn:oasis:names:tc:SAML:2.0:assertion Attribute"`
+	Signature *dsig.Signature
 }
 
 type AttributeRespEnv struct {
@@ -20,9 +20,9 @@ import (
 	"text/template"
 	"time"
 
+	"github.com/amdonov/lite-idp/dsig"
 	"github.com/amdonov/lite-idp/saml"
 	"github.com/amdonov/lite-idp/store"
-	"github.com/amdonov/xmlsig"
 )
 
 // ServiceProvider acts as a SAML service provider
@@ -56,7 +56,7 @@ func New(conf Configuration) (ServiceProvider, error) {
 	}
 	cert := conf.TLSConfig.Certificates[0]
 
-	signer, err := xmlsig.NewSigner(cert)
+	signer, err := dsig.NewSigner(cert, dsig.SignerOptions{})
 	if err != nil {
 		return nil, err
 	}
@@ -82,7 +82,7 @@ func New(conf Configuration) (ServiceProvider, error) {
 type serviceProvider struct {
 	configuration   Configuration
 	requestTemplate *template.Template
-	signer          xmlsig.Signer
+	signer          dsig.Signer
 	client          *http.Client
 	stateCache      store.Cache
 }
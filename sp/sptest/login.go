@@ -0,0 +1,156 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sptest
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/amdonov/lite-idp/saml"
+)
+
+// maxSteps limits the redirects and pages followed during a login
+const maxSteps = 10
+
+// Result is what the IdP delivered to an assertion consumer service
+type Result struct {
+	// PostBinding or ArtifactBinding
+	Binding string
+	// The posted Response, or the SOAP response the artifact was resolved to
+	Response   []byte
+	RelayState string
+}
+
+// Login sends the request to the IdP with the binding, logs in through the password form, and returns what the
+// IdP delivers to the assertion consumer service. Artifacts are resolved. Users with a session aren't asked to
+// log in again.
+func (sp *SP) Login(binding string, req *saml.AuthnRequest, relayState, username, password string) (*Result, error) {
+	var resp *http.Response
+	var err error
+	switch binding {
+	case RedirectBinding:
+		var location string
+		if location, err = sp.RedirectURL(req, relayState); err != nil {
+			return nil, err
+		}
+		resp, err = sp.Client.Get(location)
+	case PostBinding:
+		var form url.Values
+		if form, err = sp.PostForm(req, relayState); err != nil {
+			return nil, err
+		}
+		resp, err = sp.Client.PostForm(sp.SSOURL, form)
+	default:
+		return nil, fmt.Errorf("unsupported request binding %s", binding)
+	}
+	submitted := false
+	for step := 0; step < maxSteps; step++ {
+		if err != nil {
+			return nil, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case resp.StatusCode >= 300 && resp.StatusCode < 400:
+			location, err := resp.Request.URL.Parse(resp.Header.Get("Location"))
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(location.String(), sp.ArtifactACSURL) {
+				return sp.artifactResult(location)
+			}
+			if strings.HasSuffix(location.Path, "/ui/login.html") {
+				if submitted {
+					return nil, fmt.Errorf("login failed: %s", location.Query().Get("error"))
+				}
+				submitted = true
+				resp, err = sp.submitLogin(location, username, password)
+				continue
+			}
+			resp, err = sp.Client.Get(location.String())
+		case resp.StatusCode == http.StatusOK:
+			return sp.postResult(body)
+		default:
+			return nil, fmt.Errorf("%s returned %s: %s", resp.Request.URL, resp.Status, strings.TrimSpace(string(body)))
+		}
+	}
+	return nil, errors.New("too many steps to log in")
+}
+
+// submitLogin fills in the login form at the location
+func (sp *SP) submitLogin(location *url.URL, username, password string) (*http.Response, error) {
+	resp, err := sp.Client.Get(location.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("login page returned %s", resp.Status)
+	}
+	doc, err := goquery.NewDocumentFromReader(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	token, ok := doc.Find("input[name=csrfToken]").Attr("value")
+	if !ok {
+		return nil, errors.New("login page doesn't have a CSRF token")
+	}
+	form := url.Values{}
+	form.Set("requestId", location.Query().Get("requestId"))
+	form.Set("csrfToken", token)
+	form.Set("username", username)
+	form.Set("password", password)
+	action := *location
+	action.RawQuery = ""
+	return sp.Client.PostForm(action.String(), form)
+}
+
+// postResult reads the response from a page that posts it to the assertion consumer service
+func (sp *SP) postResult(page []byte) (*Result, error) {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(string(page)))
+	if err != nil {
+		return nil, err
+	}
+	form := doc.Find("form")
+	if action, _ := form.Attr("action"); action != sp.PostACSURL {
+		return nil, fmt.Errorf("page doesn't post to the assertion consumer service: %s", strings.TrimSpace(doc.Text()))
+	}
+	value, _ := form.Find("input[name=SAMLResponse]").Attr("value")
+	response, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	relayState, _ := form.Find("input[name=RelayState]").Attr("value")
+	return &Result{Binding: PostBinding, Response: response, RelayState: relayState}, nil
+}
+
+// artifactResult resolves the artifact sent to the assertion consumer service
+func (sp *SP) artifactResult(location *url.URL) (*Result, error) {
+	query := location.Query()
+	response, err := sp.ResolveArtifact(query.Get("SAMLart"))
+	if err != nil {
+		return nil, err
+	}
+	return &Result{Binding: ArtifactBinding, Response: response, RelayState: query.Get("RelayState")}, nil
+}
@@ -0,0 +1,286 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package sptest provides a mock SAML service provider for testing an identity provider end to end. It signs
+// AuthnRequests for the HTTP-Redirect and HTTP-POST bindings, logs in through the IdP's password form like a
+// browser, resolves artifacts, sends attribute queries, and validates the assertions it gets back.
+package sptest
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/saml"
+	"github.com/amdonov/xmlsig"
+)
+
+// Bindings used for requests and responses
+const (
+	RedirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	PostBinding     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	ArtifactBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Artifact"
+)
+
+// SP is a mock service provider. Its assertion consumer services are never contacted. Responses the IdP sends
+// to them are captured instead.
+type SP struct {
+	EntityID string
+	// Locations of the assertion consumer services for the POST and artifact bindings
+	PostACSURL     string
+	ArtifactACSURL string
+	// Signs requests and authenticates the SP when it resolves artifacts
+	Certificate tls.Certificate
+	// IdP endpoints
+	SSOURL      string
+	ArtifactURL string
+	QueryURL    string
+	// Key that the IdP signs assertions with
+	IDPKey crypto.PublicKey
+	// Client acting as the SP and the user's browser. It keeps cookies and doesn't follow redirects.
+	Client *http.Client
+	signer dsig.Signer
+}
+
+// New returns a service provider that talks to the IdP with a copy of client, which must trust the IdP.
+// The client presents cert when the IdP asks for a certificate.
+func New(entityID string, cert tls.Certificate, client *http.Client, idpKey crypto.PublicKey) (*SP, error) {
+	signer, err := dsig.NewSigner(cert, dsig.SignerOptions{})
+	if err != nil {
+		return nil, err
+	}
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		return nil, err
+	}
+	c := *client
+	c.Jar = jar
+	c.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	if transport, ok := c.Transport.(*http.Transport); ok {
+		transport = transport.Clone()
+		transport.TLSClientConfig = transport.TLSClientConfig.Clone()
+		transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		c.Transport = transport
+	}
+	return &SP{
+		EntityID:       entityID,
+		PostACSURL:     "https://sp.example.com/acs/post",
+		ArtifactACSURL: "https://sp.example.com/acs/artifact",
+		Certificate:    cert,
+		IDPKey:         idpKey,
+		Client:         &c,
+		signer:         signer,
+	}, nil
+}
+
+// Metadata returns the SP's metadata for registering it with the IdP
+func (sp *SP) Metadata() ([]byte, error) {
+	ed := &saml.SPEntityDescriptor{
+		EntityDescriptor: saml.EntityDescriptor{
+			ID:       saml.NewID(),
+			EntityID: sp.EntityID,
+		},
+		SPSSODescriptor: saml.SPSSODescriptor{
+			AuthnRequestsSigned:        true,
+			WantAssertionsSigned:       true,
+			ProtocolSupportEnumeration: "urn:oasis:names:tc:SAML:2.0:protocol",
+			AssertionConsumerService: []saml.AssertionConsumerService{
+				{
+					Service:   saml.Service{Binding: PostBinding, Location: sp.PostACSURL},
+					IsDefault: true,
+					Index:     0,
+				},
+				{
+					Service: saml.Service{Binding: ArtifactBinding, Location: sp.ArtifactACSURL},
+					Index:   1,
+				},
+			},
+			KeyDescriptor: []saml.KeyDescriptor{{
+				Use: "signing",
+				KeyInfo: xmlsig.KeyInfo{
+					X509Data: &xmlsig.X509Data{
+						X509Certificate: base64.StdEncoding.EncodeToString(sp.Certificate.Certificate[0]),
+					},
+				},
+			}},
+		},
+	}
+	return xml.Marshal(ed)
+}
+
+// AuthnRequest returns a request for a response with the protocol binding
+func (sp *SP) AuthnRequest(protocolBinding string) *saml.AuthnRequest {
+	return &saml.AuthnRequest{
+		RequestAbstractType: saml.RequestAbstractType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now(),
+			Issuer:       sp.EntityID,
+			Destination:  sp.SSOURL,
+		},
+		ProtocolBinding: protocolBinding,
+	}
+}
+
+// RedirectURL returns the location that sends the request to the IdP with the HTTP-Redirect binding
+func (sp *SP) RedirectURL(req *saml.AuthnRequest, relayState string) (string, error) {
+	data, err := xml.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	writer, err := flate.NewWriter(&b, flate.DefaultCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err = writer.Write(data); err != nil {
+		return "", err
+	}
+	if err = writer.Close(); err != nil {
+		return "", err
+	}
+	// The signature covers the parameters in this order
+	query := "SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString(b.Bytes()))
+	if relayState != "" {
+		query += "&RelayState=" + url.QueryEscape(relayState)
+	}
+	query += "&SigAlg=" + url.QueryEscape(sp.signer.Algorithm())
+	signature, err := sp.signer.Sign([]byte(query))
+	if err != nil {
+		return "", err
+	}
+	return sp.SSOURL + "?" + query + "&Signature=" + url.QueryEscape(signature), nil
+}
+
+// PostForm returns the form that sends the request to the IdP with the HTTP-POST binding. The request gets an
+// enveloped signature.
+func (sp *SP) PostForm(req *saml.AuthnRequest, relayState string) (url.Values, error) {
+	signature, err := sp.signer.CreateSignature(req)
+	if err != nil {
+		return nil, err
+	}
+	req.Signature = signature
+	data, err := xml.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("SAMLRequest", base64.StdEncoding.EncodeToString(data))
+	if relayState != "" {
+		form.Set("RelayState", relayState)
+	}
+	return form, nil
+}
+
+// ResolveArtifact sends an ArtifactResolve and returns the IdP's SOAP response
+func (sp *SP) ResolveArtifact(artifact string) ([]byte, error) {
+	resolve := saml.ArtifactResolveEnvelope{
+		Body: saml.ArtifactResolveBody{
+			ArtifactResolve: saml.ArtifactResolve{
+				RequestAbstractType: saml.RequestAbstractType{
+					ID:           saml.NewID(),
+					Version:      "2.0",
+					IssueInstant: time.Now(),
+					Issuer:       sp.EntityID,
+					Destination:  sp.ArtifactURL,
+				},
+				Artifact: artifact,
+			},
+		},
+	}
+	signature, err := sp.signer.CreateSignature(resolve.Body.ArtifactResolve)
+	if err != nil {
+		return nil, err
+	}
+	resolve.Body.ArtifactResolve.Signature = signature
+	return sp.soap(sp.ArtifactURL, resolve)
+}
+
+// AttributeQuery returns a query for the subject's attributes. It asks for the listed attributes, or all of them
+// if there are none.
+func (sp *SP) AttributeQuery(nameID *saml.NameID, attributes ...saml.Attribute) *saml.AttributeQuery {
+	return &saml.AttributeQuery{
+		RequestAbstractType: saml.RequestAbstractType{
+			ID:           saml.NewID(),
+			Version:      "2.0",
+			IssueInstant: time.Now(),
+			Issuer:       sp.EntityID,
+			Destination:  sp.QueryURL,
+		},
+		Subject:   saml.Subject{NameID: nameID},
+		Attribute: attributes,
+	}
+}
+
+// Query signs and sends the query and returns the IdP's SOAP response
+func (sp *SP) Query(query *saml.AttributeQuery) ([]byte, error) {
+	signature, err := sp.signer.CreateSignature(query)
+	if err != nil {
+		return nil, err
+	}
+	query.Signature = signature
+	return sp.soap(sp.QueryURL, saml.AttributeQueryEnv{Body: saml.AttributeQueryBody{Query: *query}})
+}
+
+// soap posts the envelope and returns the response body
+func (sp *SP) soap(location string, envelope interface{}) ([]byte, error) {
+	data, err := xml.Marshal(envelope)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := sp.Client.Post(location, "text/xml", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s: %s", location, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+// element returns the first element with the name in the XML document as it appears in the document
+func element(data []byte, name xml.Name) ([]byte, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		start := decoder.InputOffset()
+		token, err := decoder.Token()
+		if err != nil {
+			return nil, fmt.Errorf("document doesn't have a %s element", name.Local)
+		}
+		if el, ok := token.(xml.StartElement); ok && el.Name == name {
+			if err = decoder.Skip(); err != nil {
+				return nil, err
+			}
+			return data[start:decoder.InputOffset()], nil
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sptest
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/amdonov/lite-idp/dsig"
+	"github.com/amdonov/lite-idp/saml"
+)
+
+const (
+	protocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	assertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	statusSuccess      = "urn:oasis:names:tc:SAML:2.0:status:Success"
+)
+
+// errNoAssertion is returned when a successful response doesn't carry an assertion the SP can read
+var errNoAssertion = errors.New("response doesn't have an assertion")
+
+// Validate checks the Response in data, which may be wrapped in a SOAP envelope, and returns its assertion. The
+// response must be successful and in response to the request with the ID, or unsolicited if it's empty. The
+// assertion must be signed by the IdP's key, currently valid, and have the SP as an audience.
+func (sp *SP) Validate(data []byte, requestID string) (*saml.Assertion, error) {
+	raw, err := element(data, xml.Name{Space: protocolNamespace, Local: "Response"})
+	if err != nil {
+		return nil, err
+	}
+	response := &saml.Response{}
+	if err = xml.Unmarshal(raw, response); err != nil {
+		return nil, err
+	}
+	if response.Status == nil || response.Status.StatusCode.Value != statusSuccess {
+		status := ""
+		if response.Status != nil {
+			status = response.Status.StatusCode.Value
+		}
+		return nil, fmt.Errorf("response has status %q", status)
+	}
+	if response.InResponseTo != requestID {
+		return nil, fmt.Errorf("response is in response to %q rather than %q", response.InResponseTo, requestID)
+	}
+	raw, err = element(raw, xml.Name{Space: assertionNamespace, Local: "Assertion"})
+	if err != nil {
+		return nil, errNoAssertion
+	}
+	if err = dsig.Verify(raw, sp.IDPKey); err != nil {
+		return nil, fmt.Errorf("assertion signature isn't valid: %v", err)
+	}
+	assertion := &saml.Assertion{}
+	if err = xml.Unmarshal(raw, assertion); err != nil {
+		return nil, err
+	}
+	if err = sp.checkConditions(assertion.Conditions); err != nil {
+		return nil, err
+	}
+	return assertion, nil
+}
+
+// checkConditions verifies the assertion's validity period and audiences
+func (sp *SP) checkConditions(conditions *saml.Conditions) error {
+	if conditions == nil {
+		return errors.New("assertion doesn't have conditions")
+	}
+	now := time.Now()
+	if now.Before(conditions.NotBefore) || !now.Before(conditions.NotOnOrAfter) {
+		return fmt.Errorf("assertion is only valid from %s until %s", conditions.NotBefore, conditions.NotOnOrAfter)
+	}
+	if conditions.AudienceRestriction == nil {
+		return errors.New("assertion doesn't restrict its audience")
+	}
+	for _, audience := range conditions.AudienceRestriction.Audience {
+		if audience == sp.EntityID {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s isn't an audience of the assertion", sp.EntityID)
+}
+
+// Attributes returns the values of the assertion's attributes by name
+func Attributes(assertion *saml.Assertion) map[string][]string {
+	attributes := map[string][]string{}
+	if assertion.AttributeStatement == nil {
+		return attributes
+	}
+	for _, att := range assertion.AttributeStatement.Attribute {
+		for _, value := range att.AttributeValue {
+			attributes[att.Name] = append(attributes[att.Name], value.Value)
+		}
+	}
+	return attributes
+}
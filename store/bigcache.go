@@ -15,11 +15,15 @@
 package store
 
 import (
+	"sync"
+
 	"github.com/allegro/bigcache"
 )
 
 type bigcacheStore struct {
 	cache *bigcache.BigCache
+	// serializes Take and Add so they're atomic with respect to each other
+	mu sync.Mutex
 }
 
 func (b *bigcacheStore) Set(key string, entry []byte) error {
@@ -28,10 +32,13 @@ func (b *bigcacheStore) Set(key string, entry []byte) error {
 
 func (b *bigcacheStore) Get(key string) ([]byte, error) {
 	entry, err := b.cache.Get(key)
+	if _, ok := err.(*bigcache.EntryNotFoundError); ok {
+		return nil, ErrNotFound
+	}
 	if len(entry) == 7 {
 		// this might be a deleted key
 		if "DELETED" == string(entry) {
-			return nil, &bigcache.EntryNotFoundError{}
+			return nil, ErrNotFound
 		}
 	}
 	return entry, err
@@ -40,3 +47,43 @@ func (b *bigcacheStore) Get(key string) ([]byte, error) {
 func (b *bigcacheStore) Delete(key string) error {
 	return b.Set(key, []byte("DELETED"))
 }
+
+func (b *bigcacheStore) Take(key string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entry, err := b.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return entry, b.Delete(key)
+}
+
+func (b *bigcacheStore) Add(key string, entry []byte) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.Get(key)
+	if err == nil {
+		return false, nil
+	}
+	if err != ErrNotFound {
+		return false, err
+	}
+	return true, b.Set(key, entry)
+}
+
+// List only returns entries because bigcache doesn't return their keys intact
+func (b *bigcacheStore) List(f func(entry []byte) error) error {
+	for it := b.cache.Iterator(); it.SetNext(); {
+		info, err := it.Value()
+		if err != nil {
+			return err
+		}
+		if "DELETED" == string(info.Value()) {
+			continue
+		}
+		if err = f(info.Value()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
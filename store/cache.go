@@ -15,22 +15,96 @@
 package store
 
 import (
+	"errors"
 	"time"
 
 	"github.com/allegro/bigcache"
 )
 
+// ErrNotFound is returned by Get for keys that are missing or expired
+var ErrNotFound = errors.New("entry not found")
+
+// Cache stores the IdP's state, such as sessions, artifacts, and pairwise identifiers. Every entry in a cache has the
+// same time to live, which is chosen when the cache is created. Zero means entries never expire, for implementations
+// that support it. Implementations must be safe for concurrent use, and each operation must be atomic for its key:
+// a Get sees either the whole entry from a completed Set or nothing, never a partial write. Caches shared by several
+// IdP instances must give the same guarantee across instances.
 type Cache interface {
+	// Set stores the entry under key, replacing any existing entry and restarting its time to live
 	Set(key string, entry []byte) error
+	// Get returns the entry for key or ErrNotFound if it's missing, deleted, or expired
 	Get(key string) ([]byte, error)
+	// Delete removes the entry for key. Deleting a missing key isn't an error.
 	Delete(key string) error
 }
 
-// Default to a big cache implementation
+// Taker is implemented by caches that can remove an entry as they return it. Take is an atomic get and delete:
+// when callers take the same key concurrently, only one gets the entry and the rest get ErrNotFound. Artifacts are
+// taken so they can only be resolved once.
+type Taker interface {
+	Take(key string) ([]byte, error)
+}
+
+// Adder is implemented by caches that can store an entry only if the key isn't already present. Add is atomic:
+// when callers add the same key concurrently, exactly one of them reports that it was stored. Request IDs are added
+// to the ReplayCache so a replayed request is detected.
+type Adder interface {
+	Add(key string, entry []byte) (bool, error)
+}
+
+// Lister is implemented by caches that can list their entries, such as the sessions in the UserCache
+type Lister interface {
+	// List calls f with every entry in the cache, stopping at the first error f returns
+	List(f func(entry []byte) error) error
+}
+
+// ErrNotListable is returned by List for caches that can't list their entries
+var ErrNotListable = errors.New("cache can't list its entries")
+
+// List calls f with every entry in the cache, or returns ErrNotListable if the cache doesn't implement Lister
+func List(cache Cache, f func(entry []byte) error) error {
+	if lister, ok := cache.(Lister); ok {
+		return lister.List(f)
+	}
+	return ErrNotListable
+}
+
+// Take returns the entry for key and deletes it. Caches that don't implement Taker fall back to Get and Delete,
+// which lets concurrent callers get the same entry.
+func Take(cache Cache, key string) ([]byte, error) {
+	if taker, ok := cache.(Taker); ok {
+		return taker.Take(key)
+	}
+	entry, err := cache.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	return entry, cache.Delete(key)
+}
+
+// Add stores the entry unless key is already present and reports whether it was stored. Caches that don't
+// implement Adder fall back to Get and Set, which lets concurrent callers both add the same key.
+func Add(cache Cache, key string, entry []byte) (bool, error) {
+	if adder, ok := cache.(Adder); ok {
+		return adder.Add(key, entry)
+	}
+	_, err := cache.Get(key)
+	if err == nil {
+		return false, nil
+	}
+	if err != ErrNotFound {
+		return false, err
+	}
+	return true, cache.Set(key, entry)
+}
+
+// New returns a cache that keeps its entries in the memory of this process using BigCache. It implements Taker,
+// Adder, and Lister, but it can't be shared by IdP instances and entries are lost when the process exits. Entries
+// expire after duration, which must be positive.
 func New(duration time.Duration) (Cache, error) {
 	cache, err := bigcache.NewBigCache(bigcache.DefaultConfig(duration))
 	if err != nil {
 		return nil, err
 	}
-	return &bigcacheStore{cache}, nil
+	return &bigcacheStore{cache: cache}, nil
 }
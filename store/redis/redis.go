@@ -19,37 +19,152 @@ import (
 
 	"github.com/amdonov/lite-idp/store"
 	"github.com/go-redis/redis"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 )
 
+// Options are the connection settings of a Redis server
+type Options struct {
+	Address  string
+	Password string
+	DB       int
+}
+
+// New returns a cache backed by the Redis server configured in the redis key of the IDP's configuration.
+// Entries expire after duration, or never if it's zero. Redis being unreachable at startup is logged rather than treated
+// as fatal so instances can start before Redis is available. Requests fail until it is.
 func New(duration time.Duration) (store.Cache, error) {
+	return NewWithOptions(viperOptions(), "", duration), nil
+}
+
+// NewWithPrefix returns a cache that keeps its entries under keys starting with prefix, so they can be told apart
+// from those of other caches in the same database. Unlike caches from New, it can list its entries.
+func NewWithPrefix(prefix string, duration time.Duration) (store.Cache, error) {
+	return NewWithOptions(viperOptions(), prefix, duration), nil
+}
+
+// NewWithOptions returns a cache like NewWithPrefix that connects to the Redis server in options instead of the one
+// in the global configuration. The cache implements store.Taker and store.Adder with single Redis operations, so
+// they're atomic across every IdP instance using the server.
+func NewWithOptions(options Options, prefix string, duration time.Duration) store.Cache {
 	redisdb := redis.NewClient(&redis.Options{
-		Addr:     viper.GetString("redis.address"),
-		Password: viper.GetString("redis.password"),
+		Addr:     options.Address,
+		Password: options.Password,
+		DB:       options.DB,
 	})
-	return &cache{redisdb, duration}, nil
+	if err := redisdb.Ping().Err(); err != nil {
+		log.Warnf("redis server at %s is unreachable: %v", redisdb.Options().Addr, err)
+	}
+	return &cache{redisdb, duration, prefix}
+}
+
+func viperOptions() Options {
+	return Options{
+		Address:  viper.GetString("redis.address"),
+		Password: viper.GetString("redis.password"),
+		DB:       viper.GetInt("redis.db"),
+	}
 }
 
 type cache struct {
 	client   *redis.Client
 	duration time.Duration
+	prefix   string
 }
 
 func (c *cache) Set(key string, entry []byte) error {
-	return c.client.Set(key, entry, c.duration).Err()
+	err := c.client.Set(c.prefix+key, entry, c.duration).Err()
+	if err != nil {
+		log.Errorf("failed to store entry in redis: %v", err)
+	}
+	return err
 }
 func (c *cache) Get(key string) ([]byte, error) {
-	res, err := c.client.Get(key).Result()
+	res, err := c.client.Get(c.prefix + key).Bytes()
 	if err != nil {
+		// Missing and expired keys are expected
+		if err == redis.Nil {
+			return nil, store.ErrNotFound
+		}
+		log.Errorf("failed to retrieve entry from redis: %v", err)
 		return nil, err
 	}
-	return []byte(res), nil
+	return res, nil
 }
 func (c *cache) Delete(key string) error {
-	return c.client.Del(key).Err()
+	err := c.client.Del(c.prefix + key).Err()
+	if err != nil {
+		log.Errorf("failed to delete entry from redis: %v", err)
+	}
+	return err
+}
+
+// Take gets and deletes the entry in a MULTI/EXEC transaction. GETDEL would do the same, but it requires Redis 6.2.
+func (c *cache) Take(key string) ([]byte, error) {
+	var get *redis.StringCmd
+	_, err := c.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		get = pipe.Get(c.prefix + key)
+		pipe.Del(c.prefix + key)
+		return nil
+	})
+	if err == redis.Nil {
+		return nil, store.ErrNotFound
+	}
+	if err != nil {
+		log.Errorf("failed to take entry from redis: %v", err)
+		return nil, err
+	}
+	return get.Bytes()
+}
+
+// Add stores the entry with SETNX so only one instance in the cluster adds a key
+func (c *cache) Add(key string, entry []byte) (bool, error) {
+	added, err := c.client.SetNX(c.prefix+key, entry, c.duration).Result()
+	if err != nil {
+		log.Errorf("failed to add entry to redis: %v", err)
+	}
+	return added, err
+}
+
+func (c *cache) List(f func(entry []byte) error) error {
+	if c.prefix == "" {
+		return store.ErrNotListable
+	}
+	var cursor uint64
+	for {
+		keys, next, err := c.client.Scan(cursor, c.prefix+"*", 100).Result()
+		if err != nil {
+			log.Errorf("failed to list entries in redis: %v", err)
+			return err
+		}
+		for _, key := range keys {
+			entry, err := c.client.Get(key).Bytes()
+			// Entries can expire or be deleted during the scan
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				log.Errorf("failed to retrieve entry from redis: %v", err)
+				return err
+			}
+			if err = f(entry); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// Close closes the connections to the redis server
+func (c *cache) Close() error {
+	return c.client.Close()
 }
 
 func init() {
 	viper.SetDefault("redis.address", "127.0.0.1:6379")
 	viper.SetDefault("redis.password", "")
+	viper.SetDefault("redis.db", 0)
 }
@@ -15,10 +15,12 @@
 package redis
 
 import (
+	"io"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis"
+	"github.com/amdonov/lite-idp/store"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
@@ -45,7 +47,174 @@ func TestNew(t *testing.T) {
 	assert.Equal(t, value, res)
 	cache.Delete("test")
 	_, err = cache.Get("test")
-	if err == nil {
-		t.Fatal("should not have returned value")
+	assert.Equal(t, store.ErrNotFound, err)
+}
+
+func TestNew_noExpiration(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	viper.Set("redis.address", s.Addr())
+	cache, err := New(0)
+	if err != nil {
+		t.Fatal(err)
 	}
+	if err = cache.Set("test", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, time.Duration(0), s.TTL("test"), "entry shouldn't expire")
+}
+
+func TestNew_db(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	viper.Set("redis.address", s.Addr())
+	viper.Set("redis.db", 2)
+	defer viper.Set("redis.db", 0)
+	cache, err := New(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.Set("test", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	s.Select(2)
+	assert.True(t, s.Exists("test"), "entry should be stored in the configured database")
+	assert.Equal(t, time.Minute, s.TTL("test"), "entry should expire")
+}
+
+func TestNew_unavailable(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("redis.address", s.Addr())
+	s.Close()
+	cache, err := New(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, cache.Set("test", []byte("value")))
+	_, err = cache.Get("test")
+	assert.Error(t, err)
+}
+
+func TestCache_Close(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	viper.Set("redis.address", s.Addr())
+	cache, err := New(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, cache.(io.Closer).Close())
+	assert.Error(t, cache.Set("test", []byte("value")), "closed caches should not be usable")
+}
+
+func TestCache_Take(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	viper.Set("redis.address", s.Addr())
+	cache, err := New(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.Set("artifact", []byte("response")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := store.Take(cache, "artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []byte("response"), data)
+	assert.False(t, s.Exists("artifact"), "taken entries should be deleted")
+	_, err = store.Take(cache, "artifact")
+	assert.Equal(t, store.ErrNotFound, err, "entries can only be taken once")
+}
+
+func TestCache_Add(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	viper.Set("redis.address", s.Addr())
+	cache, err := New(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := store.Add(cache, "id", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, added)
+	assert.Equal(t, time.Minute, s.TTL("id"), "added entries should expire")
+	added, err = store.Add(cache, "id", []byte("2"))
+	assert.NoError(t, err)
+	assert.False(t, added, "existing keys should not be replaced")
+	value, _ := s.Get("id")
+	assert.Equal(t, "1", value)
+}
+
+func TestNewWithPrefix(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	viper.Set("redis.address", s.Addr())
+	sessions, err := NewWithPrefix("session:", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := New(time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions.Set("a", []byte("1"))
+	sessions.Set("b", []byte("2"))
+	other.Set("c", []byte("3"))
+	assert.True(t, s.Exists("session:a"), "keys should be prefixed")
+	value, err := sessions.Get("a")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), value)
+	_, err = other.Get("a")
+	assert.Equal(t, store.ErrNotFound, err)
+
+	var entries []string
+	assert.NoError(t, store.List(sessions, func(entry []byte) error {
+		entries = append(entries, string(entry))
+		return nil
+	}))
+	assert.ElementsMatch(t, []string{"1", "2"}, entries, "only the prefixed entries should be listed")
+	assert.Equal(t, store.ErrNotListable, store.List(other, func([]byte) error { return nil }))
+
+	assert.NoError(t, sessions.Delete("a"))
+	assert.False(t, s.Exists("session:a"))
+}
+
+func TestNewWithOptions(t *testing.T) {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	viper.Set("redis.address", "127.0.0.1:1")
+	defer viper.Set("redis.address", "127.0.0.1:6379")
+	cache := NewWithOptions(Options{Address: s.Addr(), DB: 3}, "", time.Minute)
+	defer cache.(io.Closer).Close()
+	assert.NoError(t, cache.Set("test", []byte("value")), "the options should be used instead of the global configuration")
+	s.Select(3)
+	assert.True(t, s.Exists("test"))
 }
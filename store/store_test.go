@@ -4,7 +4,7 @@
 // you may not use this file except in compliance with the License.
 // You may obtain a copy of the License at
 //
-//     http://www.apache.org/licenses/LICENSE-2.0
+//	http://www.apache.org/licenses/LICENSE-2.0
 //
 // Unless required by applicable law or agreed to in writing, software
 // distributed under the License is distributed on an "AS IS" BASIS,
@@ -14,6 +14,8 @@
 package store
 
 import (
+	"errors"
+	"sync"
 	"testing"
 	"time"
 )
@@ -37,7 +39,99 @@ func TestDelete(t *testing.T) {
 		t.Fatal(err)
 	}
 	_, err = cache.Get("test")
-	if err == nil {
-		t.Fatal("should not have returned value")
+	if err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestTake(t *testing.T) {
+	cache, err := New(5 * time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("artifact", []byte("response"))
+	data, err := Take(cache, "artifact")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "response" {
+		t.Fatal("data did not match expected value")
+	}
+	if _, err = Take(cache, "artifact"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestTake_concurrent(t *testing.T) {
+	cache, err := New(5 * time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("artifact", []byte("response"))
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		taken int
+	)
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := Take(cache, "artifact"); err == nil {
+				mu.Lock()
+				taken++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if taken != 1 {
+		t.Fatalf("expected the entry to be taken once, got %d", taken)
+	}
+}
+
+func TestAdd(t *testing.T) {
+	cache, err := New(5 * time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := Add(cache, "id", []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !added {
+		t.Fatal("expected first add to succeed")
+	}
+	if added, _ = Add(cache, "id", []byte("2")); added {
+		t.Fatal("expected second add to fail")
+	}
+}
+
+func TestList(t *testing.T) {
+	cache, err := New(5 * time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("a", []byte("1"))
+	cache.Set("b", []byte("2"))
+	cache.Set("c", []byte("3"))
+	cache.Delete("b")
+	entries := map[string]bool{}
+	err = List(cache, func(entry []byte) error {
+		entries[string(entry)] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || !entries["1"] || !entries["3"] {
+		t.Fatalf("expected 1 and 3, got %v", entries)
+	}
+	stop := errors.New("stop")
+	if err = List(cache, func([]byte) error { return stop }); err != stop {
+		t.Fatalf("expected the error from f, got %v", err)
+	}
+	if err = List(struct{ Cache }{cache}, func([]byte) error { return nil }); err != ErrNotListable {
+		t.Fatalf("expected ErrNotListable, got %v", err)
 	}
 }
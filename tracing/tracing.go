@@ -0,0 +1,243 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package tracing records spans for HTTP requests and exports them to an OpenTelemetry collector with OTLP over HTTP.
+// Spans are carried in request contexts. Starting a span from a context without one does nothing, so instrumented
+// code costs next to nothing when tracing is off.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds from the OpenTelemetry protocol
+const (
+	kindInternal = 1
+	kindServer   = 2
+)
+
+// Attribute is a key and a string, int64, or bool value recorded on a span
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// String returns a string attribute
+func String(key, value string) Attribute {
+	return Attribute{key, value}
+}
+
+// Int returns an integer attribute
+func Int(key string, value int) Attribute {
+	return Attribute{key, int64(value)}
+}
+
+// Bool returns a boolean attribute
+func Bool(key string, value bool) Attribute {
+	return Attribute{key, value}
+}
+
+// Tracer starts spans and exports them when they end
+type Tracer struct {
+	exporter *exporter
+}
+
+// New returns a tracer that sends spans for the service to the OTLP/HTTP traces endpoint, for example
+// http://localhost:4318/v1/traces. Close the tracer to send any remaining spans.
+func New(endpoint, service string) *Tracer {
+	return &Tracer{exporter: newExporter(endpoint, service)}
+}
+
+// Close sends spans that haven't been exported yet and stops the exporter
+func (t *Tracer) Close() error {
+	return t.exporter.close()
+}
+
+// Span is a timed operation within a trace. A nil span ignores every call, which is what Start returns when
+// the context isn't being traced.
+type Span struct {
+	tracer   *Tracer
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes []Attribute
+	err        string
+}
+
+type spanKey struct{}
+
+// ContextWithSpan returns a copy of ctx carrying the span
+func ContextWithSpan(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+// SpanFromContext returns the current span or nil if the context isn't being traced
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// Start begins a child of the context's span. The context is returned unchanged with a nil span if it isn't being
+// traced. The span must be ended.
+func Start(ctx context.Context, name string, attributes ...Attribute) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	s := parent.tracer.newSpan(name, kindInternal, attributes)
+	s.traceID = parent.traceID
+	s.parentID = parent.spanID
+	return ContextWithSpan(ctx, s), s
+}
+
+func (t *Tracer) newSpan(name string, kind int, attributes []Attribute) *Span {
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now(), attributes: attributes}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// SetAttributes adds attributes to the span, replacing earlier values for the same keys
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, attribute := range attributes {
+		replaced := false
+		for i := range s.attributes {
+			if s.attributes[i].Key == attribute.Key {
+				s.attributes[i] = attribute
+				replaced = true
+			}
+		}
+		if !replaced {
+			s.attributes = append(s.attributes, attribute)
+		}
+	}
+}
+
+// RecordError marks the span as failed. Nil errors are ignored so it can be deferred with a named error result.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+// End finishes the span and queues it for export. Later calls do nothing.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	ended := !s.end.IsZero()
+	if !ended {
+		s.end = time.Now()
+	}
+	s.mu.Unlock()
+	if !ended {
+		s.tracer.exporter.add(s)
+	}
+}
+
+// TraceParent returns the span's W3C traceparent header value
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.spanID[:]) + "-01"
+}
+
+// parseTraceParent reads the trace and parent span IDs from a W3C traceparent header
+func parseTraceParent(header string) (traceID [16]byte, spanID [8]byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil || spanID == [8]byte{} {
+		return traceID, spanID, false
+	}
+	return traceID, spanID, true
+}
+
+// Handler starts a server span for each request, continuing the caller's trace if the request has a
+// traceparent header. Handlers can add to the span with SpanFromContext and start children with Start.
+func (t *Tracer) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s := t.newSpan(r.Method+" "+r.URL.Path, kindServer, []Attribute{
+			String("http.method", r.Method),
+			String("http.target", r.URL.Path),
+			String("http.host", r.Host),
+		})
+		if traceID, parentID, ok := parseTraceParent(r.Header.Get("traceparent")); ok {
+			s.traceID, s.parentID = traceID, parentID
+		} else {
+			rand.Read(s.traceID[:])
+		}
+		defer s.End()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ContextWithSpan(r.Context(), s)))
+		s.SetAttributes(Int("http.status_code", recorder.status))
+		if recorder.status >= http.StatusInternalServerError {
+			s.mu.Lock()
+			s.err = http.StatusText(recorder.status)
+			s.mu.Unlock()
+		}
+	})
+}
+
+// statusRecorder remembers the status code written by the wrapped handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush lets streaming handlers flush through the recorder
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// collector records the spans posted to it
+type collector struct {
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	req := otlpRequest{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, resource := range req.ResourceSpans {
+		for _, scope := range resource.ScopeSpans {
+			c.spans = append(c.spans, scope.Spans...)
+		}
+	}
+}
+
+func TestTracer_Handler(t *testing.T) {
+	c := &collector{}
+	ts := httptest.NewServer(c)
+	defer ts.Close()
+	tracer := New(ts.URL+"/v1/traces", "lite-idp")
+	handler := tracer.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SpanFromContext(r.Context()).SetAttributes(String("saml.sp", "https://sp.example.com/"))
+		_, span := Start(r.Context(), "sign_assertion")
+		span.RecordError(errors.New("no key"))
+		span.End()
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	req := httptest.NewRequest("GET", "/SAML2/Redirect/SSO", nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.NoError(t, tracer.Close())
+
+	if !assert.Len(t, c.spans, 2) {
+		return
+	}
+	child, server := c.spans[0], c.spans[1]
+	assert.Equal(t, "GET /SAML2/Redirect/SSO", server.Name)
+	assert.Equal(t, kindServer, server.Kind)
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", server.TraceID, "the caller's trace should continue")
+	assert.Equal(t, "00f067aa0ba902b7", server.ParentSpanID)
+	assert.Contains(t, server.Attributes, otlpAttribute{Key: "saml.sp", Value: map[string]interface{}{"stringValue": "https://sp.example.com/"}})
+	assert.Contains(t, server.Attributes, otlpAttribute{Key: "http.status_code", Value: map[string]interface{}{"intValue": "500"}})
+	assert.Equal(t, statusError, server.Status.Code)
+	assert.Equal(t, server.TraceID, child.TraceID)
+	assert.Equal(t, server.SpanID, child.ParentSpanID)
+	assert.Equal(t, &otlpStatus{Code: statusError, Message: "no key"}, child.Status)
+}
+
+func TestStart_untraced(t *testing.T) {
+	ctx := context.Background()
+	started, span := Start(ctx, "sign_assertion")
+	assert.Nil(t, span)
+	assert.Equal(t, ctx, started)
+	// Nil spans ignore every call
+	span.SetAttributes(String("saml.sp", "dex"))
+	span.RecordError(errors.New("failed"))
+	span.End()
+	assert.Empty(t, span.TraceParent())
+}
+
+func Test_parseTraceParent(t *testing.T) {
+	_, _, ok := parseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.True(t, ok)
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+	} {
+		_, _, ok = parseTraceParent(header)
+		assert.False(t, ok, header)
+	}
+}
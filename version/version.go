@@ -0,0 +1,70 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package version reports which build of lite-idp is running. Release builds set the version, commit, and date
+// with the linker:
+//
+//	go build -ldflags "-X github.com/amdonov/lite-idp/version.Version=1.2.0 \
+//	  -X github.com/amdonov/lite-idp/version.Commit=$(git rev-parse HEAD) \
+//	  -X github.com/amdonov/lite-idp/version.Date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set with -ldflags -X when building a release
+var (
+	Version = "dev"
+	Commit  = ""
+	Date    = ""
+)
+
+// Info describes the running build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	Date      string `json:"date"`
+	GoVersion string `json:"goVersion"`
+}
+
+// Get returns the running build's information. The commit and date recorded by the go command from the
+// git checkout are used when they weren't set with -ldflags.
+func Get() Info {
+	info := Info{Version: Version, Commit: Commit, Date: Date, GoVersion: runtime.Version()}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.Date == "":
+				info.Date = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+func (info Info) String() string {
+	s := "lite-idp " + info.Version
+	if info.Commit != "" {
+		s += " commit " + info.Commit
+	}
+	if info.Date != "" {
+		s += " built " + info.Date
+	}
+	return fmt.Sprintf("%s %s", s, info.GoVersion)
+}
@@ -0,0 +1,36 @@
+// Copyright © 2018 Aaron Donovan <amdonov@gmail.com>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package version
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGet(t *testing.T) {
+	defer func(version, commit, date string) {
+		Version, Commit, Date = version, commit, date
+	}(Version, Commit, Date)
+	Version, Commit, Date = "1.2.0", "0123abc", "2018-01-02T15:04:05Z"
+	info := Get()
+	assert.Equal(t, Info{Version: "1.2.0", Commit: "0123abc", Date: "2018-01-02T15:04:05Z", GoVersion: runtime.Version()}, info,
+		"values set with ldflags should take precedence")
+	assert.Equal(t, "lite-idp 1.2.0 commit 0123abc built 2018-01-02T15:04:05Z "+runtime.Version(), info.String())
+
+	Version, Commit, Date = "dev", "", ""
+	assert.Equal(t, "dev", Get().Version)
+}